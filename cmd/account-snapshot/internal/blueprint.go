@@ -46,11 +46,14 @@ func ConvertToBlueprint(s *Snapshot, serverName string) (*b.Blueprint, error) {
 			}
 			// set DM list if this is the syncing user
 			if userID == s.UserID {
+				// the content of m.direct is the map of user ID -> DM room IDs itself
+				dms := make(map[string]interface{}, len(s.AccountDataDMs))
+				for dmUserID, roomIDs := range s.AccountDataDMs {
+					dms[dmUserID] = roomIDs
+				}
 				user.AccountData = append(user.AccountData, b.AccountData{
-					Type: "m.direct",
-					Value: map[string]interface{}{
-						"content": s.AccountDataDMs,
-					},
+					Type:  "m.direct",
+					Value: dms,
 				})
 			}
 			hs.Users = append(hs.Users, user)
@@ -0,0 +1,66 @@
+package internal
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/matrix-org/complement/internal/instruction"
+)
+
+func TestConvertToBlueprintAccountDataDMs(t *testing.T) {
+	s := &Snapshot{
+		UserID: "@anon-0:hs1",
+		Devices: map[string][]string{
+			"@anon-0:hs1": {NoEncryptedDevice},
+		},
+		AccountDataDMs: map[string][]string{
+			"@anon-1:hs1": {"!dm1:hs1", "!dm2:hs1"},
+		},
+		Rooms: []AnonSnapshotRoom{
+			{
+				ID:      "!room:hs1",
+				Creator: "@anon-0:hs1",
+				Timeline: []json.RawMessage{
+					json.RawMessage(`{"type":"m.room.create","sender":"@anon-0:hs1","state_key":"","content":{}}`),
+					json.RawMessage(`{"type":"m.room.message","sender":"@anon-0:hs1","content":{"msgtype":"m.text","body":"hi"}}`),
+				},
+			},
+		},
+	}
+	bp, err := ConvertToBlueprint(s, "hs1")
+	if err != nil {
+		t.Fatalf("ConvertToBlueprint: %s", err)
+	}
+
+	// run the blueprint against a homeserver which accepts everything, recording the account data set
+	var mu sync.Mutex
+	accountData := make(map[string]json.RawMessage)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body, _ := ioutil.ReadAll(req.Body)
+		if i := strings.Index(req.URL.Path, "/account_data/"); i != -1 && req.Method == "PUT" {
+			mu.Lock()
+			accountData[req.URL.Path[i+len("/account_data/"):]] = body
+			mu.Unlock()
+		}
+		w.Write([]byte(`{"user_id":"@anon-0:hs1","access_token":"token","device_id":"device-default","room_id":"!new:hs1","event_id":"$event"}`)) // nolint:errcheck
+	}))
+	defer srv.Close()
+	runner := instruction.NewRunner(bp.Name, false, false)
+	if err := runner.Run(bp.Homeservers[0], srv.URL); err != nil {
+		t.Fatalf("failed to run blueprint: %s", err)
+	}
+
+	var got map[string][]string
+	if err := json.Unmarshal(accountData["m.direct"], &got); err != nil {
+		t.Fatalf("m.direct is not a map of user ID to room IDs: %s: %s", err, accountData["m.direct"])
+	}
+	if !reflect.DeepEqual(got, s.AccountDataDMs) {
+		t.Errorf("got m.direct %v want %v", got, s.AccountDataDMs)
+	}
+}
@@ -9,6 +9,7 @@ import (
 	"strings"
 	"time"
 
+	"github.com/matrix-org/complement/internal/b"
 	"github.com/matrix-org/complement/internal/config"
 	"github.com/matrix-org/complement/internal/docker"
 	"github.com/sirupsen/logrus"
@@ -22,6 +23,7 @@ type Config struct {
 	SpawnHSTimeout         time.Duration
 	KeepBlueprints         []string
 	Snapshot               string
+	BlueprintsDir          string
 }
 
 func (c *Config) DeriveComplementConfig(baseImageURI string) *config.Complement {
@@ -39,6 +41,7 @@ func NewConfig() *Config {
 		SpawnHSTimeout:         5 * time.Second,
 		KeepBlueprints:         strings.Split(os.Getenv("HOMERUNNER_KEEP_BLUEPRINTS"), " "),
 		Snapshot:               os.Getenv("HOMERUNNER_SNAPSHOT_BLUEPRINT"),
+		BlueprintsDir:          os.Getenv("HOMERUNNER_BLUEPRINTS_DIR"),
 	}
 	if val, _ := strconv.Atoi(os.Getenv("HOMERUNNER_LIFETIME_MINS")); val != 0 {
 		cfg.HomeserverLifetimeMins = val
@@ -69,6 +72,17 @@ func main() {
 	}
 	cleanup(cfg)
 
+	if cfg.BlueprintsDir != "" {
+		bps, err := b.LoadBlueprints(cfg.BlueprintsDir)
+		if err != nil {
+			logrus.Fatalf("failed to load blueprints: %s", err)
+		}
+		for i := range bps {
+			b.KnownBlueprints[bps[i].Name] = &bps[i]
+		}
+		logrus.Infof("Loaded %d blueprints from %s", len(bps), cfg.BlueprintsDir)
+	}
+
 	if cfg.Snapshot != "" {
 		logrus.Infof("Running in single-shot snapshot mode for request file '%s'", cfg.Snapshot)
 		// pretend the file is the request
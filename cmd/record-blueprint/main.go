@@ -0,0 +1,313 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/tidwall/gjson"
+
+	"github.com/matrix-org/complement/internal/b"
+)
+
+/*
+ * Record Blueprint - Record the users and rooms of a running homeserver as a blueprint.
+ * The blueprint is written to stdout as JSON, which can be loaded with b.LoadBlueprintFile.
+ */
+
+var (
+	flagHSURL    = flag.String("url", "http://localhost:8008", "HS URL")
+	flagHSName   = flag.String("hs", "hs1", "The name of the homeserver in the blueprint")
+	flagName     = flag.String("name", "recorded", "The name of the blueprint")
+	flagMessages = flag.Int("messages", 20, "The number of recent events to record in each room")
+	flagUsers    = userFlags{}
+)
+
+// The state events which are copied into the blueprint. Other state, e.g power levels, refers to users and
+// rooms which may not be recorded.
+var recordedStateTypes = map[string]bool{
+	"m.room.name":               true,
+	"m.room.topic":              true,
+	"m.room.join_rules":         true,
+	"m.room.history_visibility": true,
+	"m.room.guest_access":       true,
+	"m.room.encryption":         true,
+}
+
+// The events which aren't recorded, as they refer to other events or can't be sent by the blueprint.
+var ignoredEventTypes = map[string]bool{
+	"m.room.encrypted": true,
+	"m.reaction":       true,
+	"m.room.redaction": true,
+}
+
+// userFlags are the users to record, given as -user @alice:example.org=ACCESS_TOKEN
+type userFlags map[string]string
+
+func (u userFlags) String() string {
+	return fmt.Sprintf("%d users", len(u))
+}
+
+func (u userFlags) Set(s string) error {
+	userID, token, ok := strings.Cut(s, "=")
+	if !ok || !strings.HasPrefix(userID, "@") || token == "" {
+		return fmt.Errorf("users must be given as @user:domain=access_token")
+	}
+	u[userID] = token
+	return nil
+}
+
+// recordedRoom is what the recorded users can see of a room.
+type recordedRoom struct {
+	id      string
+	creator string
+	version string
+	state   map[string]gjson.Result // type -> event, for recordedStateTypes
+	// user ID -> membership, for recorded users
+	memberships map[string]string
+	// event ID -> event, of the recent non-state events
+	timeline map[string]gjson.Result
+}
+
+func main() {
+	flag.Var(flagUsers, "user", "A user to record, as @user:domain=access_token. Repeat for each user.")
+	flag.Parse()
+	if len(flagUsers) == 0 {
+		fmt.Fprintf(os.Stderr,
+			"Record the users and rooms of a running homeserver as a blueprint.\n"+
+				"Only the given users, the rooms they are in and the recent events they sent are recorded.\n"+
+				"The blueprint is written to stdout\n\n"+
+				"Usage: ./record-blueprint -url https://localhost:8448 -user @alice:localhost=syt_... -user @bob:localhost=syt_... > blueprint.json\n\n")
+		flag.PrintDefaults()
+		os.Exit(1)
+	}
+	rooms := make(map[string]*recordedRoom)
+	for userID, token := range flagUsers {
+		log.Printf("Syncing as %s...\n", userID)
+		syncRes, err := doSync(*flagHSURL, token, *flagMessages)
+		if err != nil {
+			log.Panicf("FATAL: failed to sync as %s: %s", userID, err)
+		}
+		recordSync(rooms, userID, syncRes)
+	}
+	bp := convertToBlueprint(rooms)
+	out, err := json.MarshalIndent(bp, "", "  ")
+	if err != nil {
+		log.Panicf("FATAL: failed to marshal blueprint: %s", err)
+	}
+	fmt.Println(string(out))
+}
+
+func doSync(hsURL, token string, limit int) (gjson.Result, error) {
+	filter := fmt.Sprintf(`{"room":{"timeline":{"limit":%d},"state":{"lazy_load_members":false}},"presence":{"types":[]}}`, limit)
+	req, err := http.NewRequest("GET", hsURL+"/_matrix/client/v3/sync?timeout=0&filter="+url.QueryEscape(filter), nil)
+	if err != nil {
+		return gjson.Result{}, err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return gjson.Result{}, err
+	}
+	defer res.Body.Close()
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return gjson.Result{}, err
+	}
+	if res.StatusCode != 200 {
+		return gjson.Result{}, fmt.Errorf("response returned %s: %s", res.Status, string(body))
+	}
+	return gjson.ParseBytes(body), nil
+}
+
+// recordSync adds what `userID` can see of their rooms in the /sync response to `rooms`.
+func recordSync(rooms map[string]*recordedRoom, userID string, syncRes gjson.Result) {
+	room := func(roomID string) *recordedRoom {
+		if rooms[roomID] == nil {
+			rooms[roomID] = &recordedRoom{
+				id:          roomID,
+				state:       make(map[string]gjson.Result),
+				memberships: make(map[string]string),
+				timeline:    make(map[string]gjson.Result),
+			}
+		}
+		return rooms[roomID]
+	}
+	syncRes.Get("rooms.join").ForEach(func(roomID, r gjson.Result) bool {
+		rr := room(roomID.Str)
+		for _, ev := range append(r.Get("state.events").Array(), r.Get("timeline.events").Array()...) {
+			recordEvent(rr, ev)
+		}
+		rr.memberships[userID] = "join"
+		return true
+	})
+	syncRes.Get("rooms.invite").ForEach(func(roomID, r gjson.Result) bool {
+		rr := room(roomID.Str)
+		for _, ev := range r.Get("invite_state.events").Array() {
+			recordEvent(rr, ev)
+		}
+		if rr.memberships[userID] == "" {
+			rr.memberships[userID] = "invite"
+		}
+		return true
+	})
+}
+
+func recordEvent(rr *recordedRoom, ev gjson.Result) {
+	evType := ev.Get("type").Str
+	if ignoredEventTypes[evType] {
+		return
+	}
+	if !ev.Get("state_key").Exists() {
+		rr.timeline[ev.Get("event_id").Str] = ev
+		return
+	}
+	switch {
+	case evType == "m.room.create":
+		rr.creator = ev.Get("sender").Str
+		rr.version = ev.Get("content.room_version").Str
+	case evType == "m.room.member":
+		// memberships of other recorded users are taken from their own /sync, so they are complete
+		if _, ok := flagUsers[ev.Get("state_key").Str]; ok && ev.Get("content.membership").Str == "join" {
+			rr.memberships[ev.Get("state_key").Str] = "join"
+		}
+	case recordedStateTypes[evType]:
+		rr.state[evType] = ev
+	}
+}
+
+func convertToBlueprint(rooms map[string]*recordedRoom) *b.Blueprint {
+	hs := b.Homeserver{
+		Name: *flagHSName,
+	}
+	userIDs := make([]string, 0, len(flagUsers))
+	for userID := range flagUsers {
+		userIDs = append(userIDs, userID)
+	}
+	sort.Strings(userIDs)
+	for _, userID := range userIDs {
+		hs.Users = append(hs.Users, b.User{
+			Localpart:   localpart(userID),
+			DisplayName: strings.TrimPrefix(localpart(userID), "@"),
+		})
+	}
+	roomIDs := make([]string, 0, len(rooms))
+	for roomID := range rooms {
+		roomIDs = append(roomIDs, roomID)
+	}
+	sort.Strings(roomIDs)
+	for i, roomID := range roomIDs {
+		r := convertRoom(rooms[roomID], fmt.Sprintf("room_%d", i))
+		if r == nil {
+			log.Printf("Skipping %s, which no recorded user is joined to\n", roomID)
+			continue
+		}
+		hs.Rooms = append(hs.Rooms, *r)
+	}
+	return &b.Blueprint{
+		Name:        *flagName,
+		Homeservers: []b.Homeserver{hs},
+	}
+}
+
+func convertRoom(rr *recordedRoom, ref string) *b.Room {
+	// the room is created by its creator if they are recorded, else the first recorded member
+	creator := rr.creator
+	if rr.memberships[creator] != "join" {
+		creator = ""
+		for _, userID := range sortedKeys(rr.memberships) {
+			if rr.memberships[userID] == "join" {
+				creator = userID
+				break
+			}
+		}
+	}
+	if creator == "" {
+		return nil
+	}
+	preset := "private_chat"
+	if rr.state["m.room.join_rules"].Get("content.join_rule").Str == "public" {
+		preset = "public_chat"
+	}
+	r := &b.Room{
+		Ref:     ref,
+		Creator: localpart(creator),
+		CreateRoom: map[string]interface{}{
+			"preset": preset,
+		},
+		Version: rr.version,
+	}
+	stateTypes := make([]string, 0, len(rr.state))
+	for evType := range rr.state {
+		stateTypes = append(stateTypes, evType)
+	}
+	sort.Strings(stateTypes)
+	for _, evType := range stateTypes {
+		ev := rr.state[evType]
+		r.Events = append(r.Events, b.Event{
+			Type:     evType,
+			Sender:   localpart(creator),
+			StateKey: b.Ptr(ev.Get("state_key").Str),
+			Content:  content(ev),
+		})
+	}
+	for _, userID := range sortedKeys(rr.memberships) {
+		if userID == creator {
+			continue
+		}
+		r.Events = append(r.Events, b.Invite(localpart(creator), localpart(userID)))
+		if rr.memberships[userID] == "join" {
+			r.Events = append(r.Events, b.Join(localpart(userID)))
+		}
+	}
+	// send the recent events of recorded users in the order they were sent
+	var timeline []gjson.Result
+	skipped := 0
+	for _, ev := range rr.timeline {
+		if rr.memberships[ev.Get("sender").Str] != "join" {
+			skipped++
+			continue
+		}
+		timeline = append(timeline, ev)
+	}
+	sort.Slice(timeline, func(i, j int) bool {
+		return timeline[i].Get("origin_server_ts").Int() < timeline[j].Get("origin_server_ts").Int()
+	})
+	for _, ev := range timeline {
+		r.Events = append(r.Events, b.Event{
+			Type:    ev.Get("type").Str,
+			Sender:  localpart(ev.Get("sender").Str),
+			Content: content(ev),
+		})
+	}
+	if skipped > 0 {
+		log.Printf("%s: skipped %d events sent by users who aren't recorded\n", rr.id, skipped)
+	}
+	return r
+}
+
+// localpart returns the user ID without its domain, as blueprints refer to users, e.g "@alice".
+func localpart(userID string) string {
+	return strings.Split(userID, ":")[0]
+}
+
+func content(ev gjson.Result) map[string]interface{} {
+	c, _ := ev.Get("content").Value().(map[string]interface{})
+	return c
+}
+
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/tidwall/gjson"
+
+	"github.com/matrix-org/complement/internal/b"
+)
+
+func TestConvertRoom(t *testing.T) {
+	testCases := []struct {
+		name string
+		room *recordedRoom
+		want *b.Room
+	}{
+		{
+			name: "no recorded user is joined",
+			room: &recordedRoom{
+				creator:     "@alice:hs1",
+				memberships: map[string]string{"@bob:hs1": "invite"},
+			},
+			want: nil,
+		},
+		{
+			name: "public room made by its creator",
+			room: &recordedRoom{
+				creator: "@alice:hs1",
+				version: "10",
+				state: map[string]gjson.Result{
+					"m.room.name":       gjson.Parse(`{"type":"m.room.name","state_key":"","content":{"name":"Room"}}`),
+					"m.room.join_rules": gjson.Parse(`{"type":"m.room.join_rules","state_key":"","content":{"join_rule":"public"}}`),
+				},
+				memberships: map[string]string{
+					"@alice:hs1":   "join",
+					"@bob:hs1":     "join",
+					"@charlie:hs1": "invite",
+				},
+			},
+			want: &b.Room{
+				Ref:        "room",
+				Creator:    "@alice",
+				CreateRoom: map[string]interface{}{"preset": "public_chat"},
+				Version:    "10",
+				Events: []b.Event{
+					{Type: "m.room.join_rules", Sender: "@alice", StateKey: b.Ptr(""), Content: map[string]interface{}{"join_rule": "public"}},
+					{Type: "m.room.name", Sender: "@alice", StateKey: b.Ptr(""), Content: map[string]interface{}{"name": "Room"}},
+					b.Invite("@alice", "@bob"),
+					b.Join("@bob"),
+					b.Invite("@alice", "@charlie"),
+				},
+			},
+		},
+		{
+			name: "creator isn't recorded",
+			room: &recordedRoom{
+				creator: "@zara:hs1",
+				memberships: map[string]string{
+					"@charlie:hs1": "join",
+					"@bob:hs1":     "join",
+				},
+			},
+			want: &b.Room{
+				Ref:        "room",
+				Creator:    "@bob",
+				CreateRoom: map[string]interface{}{"preset": "private_chat"},
+				Events: []b.Event{
+					b.Invite("@bob", "@charlie"),
+					b.Join("@charlie"),
+				},
+			},
+		},
+		{
+			name: "timeline is sent in order, without events of other users",
+			room: &recordedRoom{
+				creator:     "@alice:hs1",
+				memberships: map[string]string{"@alice:hs1": "join"},
+				timeline: map[string]gjson.Result{
+					"$b": gjson.Parse(`{"type":"m.room.message","sender":"@alice:hs1","origin_server_ts":2,"content":{"body":"second"}}`),
+					"$a": gjson.Parse(`{"type":"m.room.message","sender":"@alice:hs1","origin_server_ts":1,"content":{"body":"first"}}`),
+					"$c": gjson.Parse(`{"type":"m.room.message","sender":"@zara:hs1","origin_server_ts":0,"content":{"body":"other"}}`),
+				},
+			},
+			want: &b.Room{
+				Ref:        "room",
+				Creator:    "@alice",
+				CreateRoom: map[string]interface{}{"preset": "private_chat"},
+				Events: []b.Event{
+					{Type: "m.room.message", Sender: "@alice", Content: map[string]interface{}{"body": "first"}},
+					{Type: "m.room.message", Sender: "@alice", Content: map[string]interface{}{"body": "second"}},
+				},
+			},
+		},
+	}
+	for _, tc := range testCases {
+		got := convertRoom(tc.room, "room")
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%s: got %+v want %+v", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestUserFlags(t *testing.T) {
+	testCases := []struct {
+		flag    string
+		wantErr bool
+	}{
+		{flag: "@alice:hs1=token"},
+		{flag: "@alice:hs1=tok=en"},
+		{flag: "@alice:hs1", wantErr: true},
+		{flag: "alice:hs1=token", wantErr: true},
+		{flag: "@alice:hs1=", wantErr: true},
+	}
+	for _, tc := range testCases {
+		u := userFlags{}
+		err := u.Set(tc.flag)
+		if (err != nil) != tc.wantErr {
+			t.Errorf("Set(%q): got error %v, want error: %v", tc.flag, err, tc.wantErr)
+		}
+	}
+}
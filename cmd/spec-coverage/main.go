@@ -0,0 +1,361 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+/*
+ * Spec Coverage - List the areas of the Matrix spec and the MSCs which Complement tests, and, given the
+ * reports of test runs against homeservers, which of them each homeserver passes, skips or fails.
+ *
+ * Tests are annotated with `// spec: <area>` comment lines, either in the doc comment of the test function,
+ * or on the line(s) directly above a `t.Run` call with a literal subtest name.
+ */
+
+const annotationPrefix = "spec:"
+
+// homeserverResults is a repeatable -results flag of the form name=report.json
+type homeserverResults []string
+
+func (r *homeserverResults) String() string {
+	return strings.Join(*r, ",")
+}
+
+func (r *homeserverResults) Set(value string) error {
+	if !strings.Contains(value, "=") {
+		return fmt.Errorf("want name=report.json, got %s", value)
+	}
+	*r = append(*r, value)
+	return nil
+}
+
+var (
+	flagTests   = flag.String("tests", "./tests", "The directory of the tests to look for annotations in, recursively")
+	flagJSON    = flag.String("json", "", "Write a JSON report to this file, as well as printing the Markdown report")
+	flagResults homeserverResults
+)
+
+// testResult is the part of a result written by test-report which is needed here.
+type testResult struct {
+	Package string `json:"package"`
+	Test    string `json:"test"`
+	Status  string `json:"status"`
+}
+
+// testID identifies a test or subtest, as tests in different packages can have the same name.
+type testID struct {
+	Package string
+	Test    string
+}
+
+// AreaCoverage is the coverage of a single spec area or MSC.
+type AreaCoverage struct {
+	Area  string      `json:"area"`
+	Tests []*AreaTest `json:"tests"`
+}
+
+// AreaTest is a test or subtest annotated with a spec area.
+type AreaTest struct {
+	Package string `json:"package"`
+	Test    string `json:"test"`
+	// The status of the test for each homeserver: pass, fail, skip, flaked or "not run" if it is missing from
+	// the report of the homeserver, e.g because it is behind a build tag.
+	Results map[string]string `json:"results,omitempty"`
+}
+
+func main() {
+	flag.Var(&flagResults, "results", "The JSON report written by test-report for a homeserver, as name=report.json. Can be repeated.")
+	flag.Parse()
+
+	areas, err := findAnnotations(*flagTests)
+	if err != nil {
+		log.Fatalf("FATAL: failed to find annotations: %s", err)
+	}
+	var homeservers []string
+	results := make(map[string]map[testID]string)
+	for _, r := range flagResults {
+		name, path := splitResultsFlag(r)
+		statuses, err := readResults(path)
+		if err != nil {
+			log.Fatalf("FATAL: failed to read results for %s: %s", name, err)
+		}
+		homeservers = append(homeservers, name)
+		results[name] = statuses
+	}
+
+	var coverage []*AreaCoverage
+	for _, area := range sortedKeys(areas) {
+		c := &AreaCoverage{
+			Area: area,
+		}
+		for _, id := range areas[area] {
+			test := &AreaTest{
+				Package: id.Package,
+				Test:    id.Test,
+			}
+			if len(homeservers) > 0 {
+				test.Results = make(map[string]string)
+			}
+			for _, hs := range homeservers {
+				status, ok := results[hs][id]
+				if !ok {
+					status = "not run"
+				}
+				test.Results[hs] = status
+			}
+			c.Tests = append(c.Tests, test)
+		}
+		coverage = append(coverage, c)
+	}
+
+	printMarkdown(coverage, homeservers)
+	if *flagJSON != "" {
+		b, err := json.MarshalIndent(coverage, "", "  ")
+		if err != nil {
+			log.Fatalf("FATAL: failed to marshal JSON report: %s", err)
+		}
+		if err = ioutil.WriteFile(*flagJSON, b, 0644); err != nil {
+			log.Fatalf("FATAL: failed to write JSON report: %s", err)
+		}
+	}
+}
+
+func splitResultsFlag(value string) (name, path string) {
+	i := strings.Index(value, "=")
+	return value[:i], value[i+1:]
+}
+
+// readResults reads a JSON report written by test-report, returning the status of each test.
+func readResults(path string) (map[testID]string, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var results []testResult
+	if err = json.Unmarshal(b, &results); err != nil {
+		return nil, err
+	}
+	statuses := make(map[testID]string, len(results))
+	for _, r := range results {
+		statuses[testID{r.Package, r.Test}] = r.Status
+	}
+	return statuses, nil
+}
+
+// findAnnotations returns the tests and subtests annotated with each spec area, as go test names them.
+func findAnnotations(dir string) (map[string][]testID, error) {
+	areas := make(map[string][]testID)
+	importPath, err := importPathFunc(dir)
+	if err != nil {
+		return nil, err
+	}
+	err = filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() || !strings.HasSuffix(info.Name(), "_test.go") {
+			return nil
+		}
+		fset := token.NewFileSet()
+		astFile, err := parser.ParseFile(fset, path, nil, parser.ParseComments)
+		if err != nil {
+			return err
+		}
+		// comments directly above a t.Run call end on the line before it
+		commentsByEndLine := make(map[int]*ast.CommentGroup)
+		for _, cg := range astFile.Comments {
+			commentsByEndLine[fset.Position(cg.End()).Line] = cg
+		}
+		for _, decl := range astFile.Decls {
+			fn, ok := decl.(*ast.FuncDecl)
+			if !ok || fn.Recv != nil || !strings.HasPrefix(fn.Name.Name, "Test") || fn.Body == nil {
+				continue
+			}
+			test := testID{importPath(filepath.Dir(path)), fn.Name.Name}
+			for _, area := range annotations(fn.Doc) {
+				areas[area] = append(areas[area], test)
+			}
+			findSubtestAnnotations(fset, fn.Body, test, commentsByEndLine, areas)
+		}
+		return nil
+	})
+	return areas, err
+}
+
+// importPathFunc returns a function which returns the import path of the package in a directory under `dir`,
+// using the go.mod of the module which `dir` is in.
+func importPathFunc(dir string) (func(pkgDir string) string, error) {
+	root, err := filepath.Abs(dir)
+	if err != nil {
+		return nil, err
+	}
+	for {
+		data, err := ioutil.ReadFile(filepath.Join(root, "go.mod"))
+		if err == nil {
+			modulePath := ""
+			for _, line := range strings.Split(string(data), "\n") {
+				if fields := strings.Fields(line); len(fields) == 2 && fields[0] == "module" {
+					modulePath = strings.Trim(fields[1], `"`)
+				}
+			}
+			if modulePath == "" {
+				return nil, fmt.Errorf("%s has no module path", filepath.Join(root, "go.mod"))
+			}
+			return func(pkgDir string) string {
+				abs, _ := filepath.Abs(pkgDir)
+				rel, _ := filepath.Rel(root, abs)
+				if rel == "." {
+					return modulePath
+				}
+				return modulePath + "/" + filepath.ToSlash(rel)
+			}, nil
+		}
+		if !os.IsNotExist(err) {
+			return nil, err
+		}
+		parent := filepath.Dir(root)
+		if parent == root {
+			return nil, fmt.Errorf("%s is not in a Go module", dir)
+		}
+		root = parent
+	}
+}
+
+// findSubtestAnnotations looks for annotated t.Run calls in `node`, and in turn in the functions passed to them.
+func findSubtestAnnotations(fset *token.FileSet, node ast.Node, test testID, commentsByEndLine map[int]*ast.CommentGroup, areas map[string][]testID) {
+	ast.Inspect(node, func(n ast.Node) bool {
+		call, ok := n.(*ast.CallExpr)
+		if !ok {
+			return true
+		}
+		sel, ok := call.Fun.(*ast.SelectorExpr)
+		if !ok || sel.Sel.Name != "Run" || len(call.Args) != 2 {
+			return true
+		}
+		lit, ok := call.Args[0].(*ast.BasicLit)
+		if !ok || lit.Kind != token.STRING {
+			return true
+		}
+		name, err := strconv.Unquote(lit.Value)
+		if err != nil {
+			return true
+		}
+		subtest := testID{test.Package, test.Test + "/" + rewriteSubtestName(name)}
+		for _, area := range annotations(commentsByEndLine[fset.Position(call.Pos()).Line-1]) {
+			areas[area] = append(areas[area], subtest)
+		}
+		findSubtestAnnotations(fset, call.Args[1], subtest, commentsByEndLine, areas)
+		return false
+	})
+}
+
+// rewriteSubtestName names a subtest like the testing package does, which replaces each space with an
+// underscore and escapes characters which can't be printed.
+func rewriteSubtestName(name string) string {
+	var b strings.Builder
+	for _, r := range name {
+		switch {
+		case unicode.IsSpace(r):
+			b.WriteRune('_')
+		case !strconv.IsPrint(r):
+			s := strconv.QuoteRune(r)
+			b.WriteString(s[1 : len(s)-1])
+		default:
+			b.WriteRune(r)
+		}
+	}
+	return b.String()
+}
+
+func annotations(cg *ast.CommentGroup) []string {
+	if cg == nil {
+		return nil
+	}
+	var areas []string
+	for _, line := range strings.Split(cg.Text(), "\n") {
+		line = strings.TrimSpace(line)
+		if strings.HasPrefix(line, annotationPrefix) {
+			areas = append(areas, strings.TrimSpace(strings.TrimPrefix(line, annotationPrefix)))
+		}
+	}
+	return areas
+}
+
+func printMarkdown(coverage []*AreaCoverage, homeservers []string) {
+	fmt.Printf("| Spec area | Tests |")
+	for _, hs := range homeservers {
+		fmt.Printf(" %s |", hs)
+	}
+	fmt.Printf("\n| --- | --- |")
+	for range homeservers {
+		fmt.Printf(" --- |")
+	}
+	fmt.Println()
+	for _, c := range coverage {
+		fmt.Printf("| %s | %d |", c.Area, len(c.Tests))
+		for _, hs := range homeservers {
+			statuses := make([]string, len(c.Tests))
+			for i, test := range c.Tests {
+				statuses[i] = test.Results[hs]
+			}
+			fmt.Printf(" %s |", summarise(statuses))
+		}
+		fmt.Println()
+	}
+	fmt.Printf("\nTOTAL: %d spec areas covered\n", len(coverage))
+}
+
+// summarise describes the statuses of the tests of a spec area for one homeserver, e.g "✓ 3/3" or
+// "× 2/3, 1 failing". Tests which flaked passed in the end, so count as passing but are pointed out.
+func summarise(statuses []string) string {
+	counts := make(map[string]int)
+	for _, status := range statuses {
+		counts[status]++
+	}
+	passed := counts["pass"] + counts["flaked"]
+	var summary string
+	switch {
+	case passed == len(statuses):
+		summary = fmt.Sprintf("✓ %d/%d", passed, len(statuses))
+	case counts["skip"]+counts["not run"] == len(statuses):
+		return "skipped"
+	default:
+		summary = fmt.Sprintf("× %d/%d", passed, len(statuses))
+	}
+	for _, status := range []string{"fail", "flaked", "skip", "not run"} {
+		if counts[status] == 0 {
+			continue
+		}
+		label := status
+		switch status {
+		case "fail":
+			label = "failing"
+		case "skip":
+			label = "skipped"
+		}
+		summary += fmt.Sprintf(", %d %s", counts[status], label)
+	}
+	return summary
+}
+
+func sortedKeys(in map[string][]testID) []string {
+	out := make([]string, 0, len(in))
+	for k := range in {
+		out = append(out, k)
+	}
+	sort.Strings(out)
+	return out
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestFindAnnotations(t *testing.T) {
+	areas, err := findAnnotations("testdata/module")
+	if err != nil {
+		t.Fatalf("findAnnotations: %s", err)
+	}
+	want := map[string][]testID{
+		"area-one": {
+			{"example.com/specs", "TestA"},
+			{"example.com/specs/sub", "TestA"},
+		},
+		"area-two": {
+			{"example.com/specs", "TestA/two__spaces"},
+			{"example.com/specs", "TestA/two__spaces/nested"},
+		},
+	}
+	if !reflect.DeepEqual(areas, want) {
+		t.Errorf("got %v want %v", areas, want)
+	}
+}
+
+func TestReadResults(t *testing.T) {
+	got, err := readResults("testdata/hs1.json")
+	if err != nil {
+		t.Fatalf("readResults: %s", err)
+	}
+	want := map[testID]string{
+		{"example.com/specs", "TestA"}:                    "flaked",
+		{"example.com/specs", "TestA/two__spaces"}:        "pass",
+		{"example.com/specs", "TestA/two__spaces/nested"}: "skip",
+		{"example.com/specs/sub", "TestA"}:                "fail",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v want %v", got, want)
+	}
+}
+
+func TestRewriteSubtestName(t *testing.T) {
+	testCases := []struct {
+		name string
+		want string
+	}{
+		{"simple", "simple"},
+		{"with spaces", "with_spaces"},
+		{"two  spaces", "two__spaces"},
+		{" leading and trailing ", "_leading_and_trailing_"},
+		{"tab\tand\nnewline", "tab_and_newline"},
+		{"bell\a", `bell\a`},
+		{"unicode café", "unicode_café"},
+	}
+	for _, tc := range testCases {
+		if got := rewriteSubtestName(tc.name); got != tc.want {
+			t.Errorf("rewriteSubtestName(%q) = %q, want %q", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestSummarise(t *testing.T) {
+	testCases := []struct {
+		statuses []string
+		want     string
+	}{
+		{[]string{"pass", "pass"}, "✓ 2/2"},
+		{[]string{"pass", "flaked"}, "✓ 2/2, 1 flaked"},
+		{[]string{"skip", "not run"}, "skipped"},
+		{[]string{"pass", "fail", "skip"}, "× 1/3, 1 failing, 1 skipped"},
+		{[]string{"flaked", "fail", "not run"}, "× 1/3, 1 failing, 1 flaked, 1 not run"},
+	}
+	for _, tc := range testCases {
+		if got := summarise(tc.statuses); got != tc.want {
+			t.Errorf("summarise(%v) = %q, want %q", tc.statuses, got, tc.want)
+		}
+	}
+}
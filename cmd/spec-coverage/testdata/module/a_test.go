@@ -0,0 +1,13 @@
+package specs
+
+import "testing"
+
+// spec: area-one
+func TestA(t *testing.T) {
+	// spec: area-two
+	t.Run("two  spaces", func(t *testing.T) {
+		// spec: area-two
+		t.Run("nested", func(t *testing.T) {})
+	})
+	t.Run("not annotated", func(t *testing.T) {})
+}
@@ -0,0 +1,3 @@
+module example.com/specs
+
+go 1.18
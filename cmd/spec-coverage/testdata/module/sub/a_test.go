@@ -0,0 +1,6 @@
+package sub
+
+import "testing"
+
+// spec: area-one
+func TestA(t *testing.T) {}
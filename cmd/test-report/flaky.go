@@ -0,0 +1,177 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// flakyStat is a line of the -flaky-stats file.
+type flakyStat struct {
+	Time     time.Time `json:"time"`
+	Package  string    `json:"package"`
+	Test     string    `json:"test"`
+	Attempts int       `json:"attempts"`
+	// True if the test passed on a later attempt, false if it failed every time
+	Flaked bool `json:"flaked"`
+}
+
+// readFlakyList reads a file of flaky test names, e.g TestPartialStateJoin or TestKnocking/Knocking_on_a_room,
+// one per line. Blank lines and lines starting with '#' are ignored. Listing a test includes its subtests.
+func readFlakyList(path string) (map[string]bool, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	flaky := make(map[string]bool)
+	for _, line := range strings.Split(string(b), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		flaky[line] = true
+	}
+	return flaky, nil
+}
+
+// isFlaky returns true if the test or one of its parents is listed as flaky.
+func isFlaky(flaky map[string]bool, testName string) bool {
+	parts := strings.Split(testName, "/")
+	for i := range parts {
+		if flaky[strings.Join(parts[:i+1], "/")] {
+			return true
+		}
+	}
+	return false
+}
+
+// retryFlaky reruns each failed top-level test whose failures are all in tests listed as flaky, up to -retries
+// times, with `rerun`. If a rerun passes, the failed tests are marked as flaked, so they don't fail the run.
+func retryFlaky(results []*TestResult, flaky map[string]bool, rerun func(pkg, testName string) (bool, error)) {
+	var stats []flakyStat
+	for _, top := range results {
+		if top.Status != "fail" || strings.Contains(top.Test, "/") {
+			continue
+		}
+		var failed []*TestResult
+		for _, r := range results {
+			if r.Package == top.Package && r.Status == "fail" && (r.Test == top.Test || strings.HasPrefix(r.Test, top.Test+"/")) {
+				failed = append(failed, r)
+			}
+		}
+		if !onlyFlakyFailures(failed, flaky) {
+			continue
+		}
+		attempts := 1
+		passed := false
+		for attempts <= *flagRetries && !passed {
+			attempts++
+			log.Printf("Rerunning flaky test %s (attempt %d)", top.Test, attempts)
+			var err error
+			passed, err = rerun(top.Package, top.Test)
+			if err != nil {
+				log.Printf("WARNING: failed to rerun %s: %s", top.Test, err)
+				break
+			}
+		}
+		for _, r := range failed {
+			r.Attempts = attempts
+			if passed {
+				r.Status = "flaked"
+			}
+		}
+		stats = append(stats, flakyStat{
+			Time:     time.Now(),
+			Package:  top.Package,
+			Test:     top.Test,
+			Attempts: attempts,
+			Flaked:   passed,
+		})
+	}
+	if *flagStats != "" && len(stats) > 0 {
+		if err := appendStats(*flagStats, stats); err != nil {
+			log.Printf("WARNING: failed to write flaky test stats: %s", err)
+		}
+	}
+}
+
+// onlyFlakyFailures returns true if every failed test which doesn't have a failed subtest is flaky. Parents
+// fail when their subtests do, so they are flaky if the subtests are.
+func onlyFlakyFailures(failed []*TestResult, flaky map[string]bool) bool {
+	for _, r := range failed {
+		hasFailedSubtest := false
+		for _, sub := range failed {
+			if strings.HasPrefix(sub.Test, r.Test+"/") {
+				hasFailedSubtest = true
+				break
+			}
+		}
+		if !hasFailedSubtest && !isFlaky(flaky, r.Test) {
+			return false
+		}
+	}
+	return true
+}
+
+// rerun runs the top-level test on its own with `go test`, returning true if it passed.
+func rerun(pkg, testName string) (bool, error) {
+	args := []string{"test", "-json", "-count=1", "-run", "^" + regexp.QuoteMeta(testName) + "$"}
+	args = append(args, strings.Fields(*flagTestFlags)...)
+	args = append(args, pkg)
+	cmd := exec.Command("go", args...)
+	// the test may be in another shard of the run this is retrying, which would skip it
+	cmd.Env = withoutSharding(os.Environ())
+	cmd.Stderr = os.Stderr
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return false, err
+	}
+	if err = cmd.Start(); err != nil {
+		return false, err
+	}
+	results, err := readResults(bufio.NewReader(stdout))
+	// go test exits non-zero when the test fails, which the results show
+	_ = cmd.Wait()
+	if err != nil {
+		return false, err
+	}
+	for _, r := range results {
+		if r.Test == testName {
+			return r.Status == "pass", nil
+		}
+	}
+	return false, fmt.Errorf("no result for %s, the package may have failed to build", testName)
+}
+
+func appendStats(path string, stats []flakyStat) error {
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	enc := json.NewEncoder(f)
+	for _, stat := range stats {
+		if err = enc.Encode(stat); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// withoutSharding returns the environment variables `environ` without those which split tests into shards.
+func withoutSharding(environ []string) []string {
+	var env []string
+	for _, kv := range environ {
+		if !strings.HasPrefix(kv, "COMPLEMENT_SHARD_") {
+			env = append(env, kv)
+		}
+	}
+	return env
+}
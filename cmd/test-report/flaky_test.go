@@ -0,0 +1,199 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+func TestWithoutSharding(t *testing.T) {
+	testCases := []struct {
+		environ []string
+		want    []string
+	}{
+		{
+			environ: []string{"PATH=/bin", "COMPLEMENT_SHARD_INDEX=1", "COMPLEMENT_SHARD_TOTAL=4", "COMPLEMENT_SHARD_TIMINGS=t.json", "COMPLEMENT_BASE_IMAGE=hs"},
+			want:    []string{"PATH=/bin", "COMPLEMENT_BASE_IMAGE=hs"},
+		},
+		{
+			environ: []string{"COMPLEMENT_SHARD_INDEX=0"},
+			want:    nil,
+		},
+	}
+	for _, tc := range testCases {
+		if got := withoutSharding(tc.environ); !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("withoutSharding(%v) = %v, want %v", tc.environ, got, tc.want)
+		}
+	}
+}
+
+func TestIsFlaky(t *testing.T) {
+	flaky := map[string]bool{"TestPartialStateJoin": true, "TestKnocking/Knocking_on_a_room": true}
+	testCases := []struct {
+		testName string
+		want     bool
+	}{
+		{testName: "TestPartialStateJoin", want: true},
+		{testName: "TestPartialStateJoin/Lazy_loading", want: true},
+		{testName: "TestKnocking", want: false},
+		{testName: "TestKnocking/Knocking_on_a_room", want: true},
+		{testName: "TestKnocking/Knocking_on_a_room/Parallel", want: true},
+		{testName: "TestKnocking/Knocking_on_a_room_twice", want: false},
+		{testName: "TestPartialStateJoinFails", want: false},
+	}
+	for _, tc := range testCases {
+		if got := isFlaky(flaky, tc.testName); got != tc.want {
+			t.Errorf("isFlaky(%s) = %v, want %v", tc.testName, got, tc.want)
+		}
+	}
+}
+
+func TestOnlyFlakyFailures(t *testing.T) {
+	flaky := map[string]bool{"TestKnocking/Knocking_on_a_room": true}
+	failed := func(testNames ...string) []*TestResult {
+		var results []*TestResult
+		for _, name := range testNames {
+			results = append(results, &TestResult{Test: name, Status: "fail"})
+		}
+		return results
+	}
+	testCases := []struct {
+		name   string
+		failed []*TestResult
+		want   bool
+	}{
+		{
+			// the parent isn't listed, but only fails because its flaky subtest does
+			name:   "parent with a flaky subtest",
+			failed: failed("TestKnocking", "TestKnocking/Knocking_on_a_room"),
+			want:   true,
+		},
+		{
+			name:   "parent with flaky subtests of subtests",
+			failed: failed("TestKnocking", "TestKnocking/Knocking_on_a_room", "TestKnocking/Knocking_on_a_room/Parallel"),
+			want:   true,
+		},
+		{
+			name:   "flaky and non-flaky subtests",
+			failed: failed("TestKnocking", "TestKnocking/Knocking_on_a_room", "TestKnocking/Knocking_twice"),
+			want:   false,
+		},
+		{
+			// the parent failed itself, e.g with t.Fatalf after its subtests
+			name:   "parent without a failed subtest",
+			failed: failed("TestKnocking"),
+			want:   false,
+		},
+	}
+	for _, tc := range testCases {
+		if got := onlyFlakyFailures(tc.failed, flaky); got != tc.want {
+			t.Errorf("%s: got %v want %v", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestRetryFlaky(t *testing.T) {
+	retries := *flagRetries
+	defer func() { *flagRetries = retries }()
+	*flagRetries = 2
+	flaky := map[string]bool{"TestFlaky": true, "TestMixed/Flaky": true}
+
+	testCases := []struct {
+		name string
+		// the results of successive reruns
+		reruns       []bool
+		rerunErr     error
+		results      []*TestResult
+		wantReruns   []string
+		wantStatus   []string
+		wantAttempts int
+	}{
+		{
+			name:         "passes on the first rerun",
+			reruns:       []bool{true},
+			results:      []*TestResult{{Package: "tests", Test: "TestFlaky", Status: "fail"}},
+			wantReruns:   []string{"TestFlaky"},
+			wantStatus:   []string{"flaked"},
+			wantAttempts: 2,
+		},
+		{
+			name:         "passes on the last rerun",
+			reruns:       []bool{false, true},
+			results:      []*TestResult{{Package: "tests", Test: "TestFlaky", Status: "fail"}},
+			wantReruns:   []string{"TestFlaky", "TestFlaky"},
+			wantStatus:   []string{"flaked"},
+			wantAttempts: 3,
+		},
+		{
+			name:         "fails every rerun",
+			reruns:       []bool{false, false},
+			results:      []*TestResult{{Package: "tests", Test: "TestFlaky", Status: "fail"}},
+			wantReruns:   []string{"TestFlaky", "TestFlaky"},
+			wantStatus:   []string{"fail"},
+			wantAttempts: 3,
+		},
+		{
+			// the whole top-level test is rerun, and the parent and subtest are both marked
+			name:   "parent with a flaky subtest",
+			reruns: []bool{true},
+			results: []*TestResult{
+				{Package: "tests", Test: "TestMixed", Status: "fail"},
+				{Package: "tests", Test: "TestMixed/Flaky", Status: "fail"},
+				{Package: "tests", Test: "TestMixed/Stable", Status: "pass"},
+			},
+			wantReruns:   []string{"TestMixed"},
+			wantStatus:   []string{"flaked", "flaked", "pass"},
+			wantAttempts: 2,
+		},
+		{
+			name: "flaky and non-flaky failures",
+			results: []*TestResult{
+				{Package: "tests", Test: "TestMixed", Status: "fail"},
+				{Package: "tests", Test: "TestMixed/Flaky", Status: "fail"},
+				{Package: "tests", Test: "TestMixed/Stable", Status: "fail"},
+			},
+			wantStatus: []string{"fail", "fail", "fail"},
+		},
+		{
+			// e.g the package no longer builds, which another rerun won't fix
+			name:         "rerun fails",
+			reruns:       []bool{false},
+			rerunErr:     fmt.Errorf("no result for TestFlaky"),
+			results:      []*TestResult{{Package: "tests", Test: "TestFlaky", Status: "fail"}},
+			wantReruns:   []string{"TestFlaky"},
+			wantStatus:   []string{"fail"},
+			wantAttempts: 2,
+		},
+		{
+			name:       "not flaky",
+			results:    []*TestResult{{Package: "tests", Test: "TestStable", Status: "fail"}},
+			wantStatus: []string{"fail"},
+		},
+		{
+			name:       "passed",
+			results:    []*TestResult{{Package: "tests", Test: "TestFlaky", Status: "pass"}},
+			wantStatus: []string{"pass"},
+		},
+	}
+	for _, tc := range testCases {
+		var reruns []string
+		retryFlaky(tc.results, flaky, func(pkg, testName string) (bool, error) {
+			if len(reruns) >= len(tc.reruns) {
+				t.Fatalf("%s: rerun %s more than %d times", tc.name, testName, len(tc.reruns))
+			}
+			reruns = append(reruns, testName)
+			return tc.reruns[len(reruns)-1], tc.rerunErr
+		})
+		if !reflect.DeepEqual(reruns, tc.wantReruns) {
+			t.Errorf("%s: reran %v want %v", tc.name, reruns, tc.wantReruns)
+		}
+		for i, r := range tc.results {
+			if r.Status != tc.wantStatus[i] {
+				t.Errorf("%s: %s got status %s want %s", tc.name, r.Test, r.Status, tc.wantStatus[i])
+			}
+			if r.Status != "pass" && r.Attempts != tc.wantAttempts {
+				t.Errorf("%s: %s got %d attempts want %d", tc.name, r.Test, r.Attempts, tc.wantAttempts)
+			}
+		}
+	}
+}
@@ -0,0 +1,322 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"encoding/xml"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/matrix-org/complement/internal/testlog"
+)
+
+/*
+ * Test Report - Convert the output of `go test -json` into JUnit XML and/or JSON, with links to the
+ * homeserver logs and HAR files Complement wrote for each test, so CI systems can show the results.
+ */
+
+var (
+	flagJUnit     = flag.String("junit", "", "Write a JUnit XML report to this file")
+	flagJSON      = flag.String("json", "", "Write a JSON report to this file")
+	flagArtifacts = flag.String("artifacts", os.Getenv("COMPLEMENT_ARTIFACTS_DIR"), "The COMPLEMENT_ARTIFACTS_DIR of the test run, to link homeserver logs")
+	flagCapture   = flag.String("capture", os.Getenv("COMPLEMENT_CAPTURE_DIR"), "The COMPLEMENT_CAPTURE_DIR of the test run, to link HAR files")
+	flagPassthru  = flag.Bool("passthru", false, "Print the test output to stdout as it is read, like go test -v")
+	flagFlaky     = flag.String("flaky", "", "A file listing known flaky tests, one per line, which are rerun if they fail")
+	flagRetries   = flag.Int("retries", 2, "How many times to rerun a failed flaky test")
+	flagTestFlags = flag.String("test-flags", "", "Extra flags to give go test when rerunning flaky tests, e.g -tags")
+	flagStats     = flag.String("flaky-stats", "", "Append a JSON line for each rerun flaky test to this file, to track flakiness over time")
+)
+
+// The name given to the result of a package which failed outside of any test, e.g because it didn't build,
+// TestMain exited or a goroutine panicked.
+const packageTestName = "(package)"
+
+// testEvent is a line of `go test -json` output, see `go doc test2json`.
+type testEvent struct {
+	Time    time.Time
+	Action  string
+	Package string
+	Test    string
+	Elapsed float64
+	Output  string
+}
+
+// TestResult is the result of a single test or subtest.
+type TestResult struct {
+	Package string  `json:"package"`
+	Test    string  `json:"test"`
+	Status  string  `json:"status"` // pass, fail, skip or flaked
+	Elapsed float64 `json:"elapsed_secs"`
+	// How many times a flaky test was run, if it failed the first time
+	Attempts int `json:"attempts,omitempty"`
+	// Why the test was skipped, from the message given to t.Skip
+	SkipReason string `json:"skip_reason,omitempty"`
+	// The output of failed tests
+	Output string `json:"output,omitempty"`
+	// Paths to the homeserver logs and HAR files written for the test
+	Artifacts []string `json:"artifacts,omitempty"`
+
+	output strings.Builder
+}
+
+func main() {
+	flag.Parse()
+	if *flagJUnit == "" && *flagJSON == "" {
+		fmt.Fprintf(os.Stderr,
+			"Convert the output of `go test -json` into JUnit XML and/or JSON test reports.\n\n"+
+				"Usage: go test -json ./tests/... | ./test-report -junit report.xml -json report.json\n\n")
+		flag.PrintDefaults()
+		os.Exit(1)
+	}
+	results, err := readResults(bufio.NewReader(os.Stdin))
+	if err != nil {
+		log.Fatalf("FATAL: failed to read test output: %s", err)
+	}
+	if *flagFlaky != "" {
+		flaky, err := readFlakyList(*flagFlaky)
+		if err != nil {
+			log.Fatalf("FATAL: failed to read flaky tests: %s", err)
+		}
+		retryFlaky(results, flaky, rerun)
+	}
+	counts := make(map[string]int)
+	for _, r := range results {
+		if r.Test != packageTestName {
+			r.Artifacts = findArtifacts(r.Test)
+		}
+		counts[r.Status]++
+	}
+	if *flagJUnit != "" {
+		if err = writeJUnit(*flagJUnit, results); err != nil {
+			log.Fatalf("FATAL: failed to write JUnit report: %s", err)
+		}
+	}
+	if *flagJSON != "" {
+		b, err := json.MarshalIndent(results, "", "  ")
+		if err != nil {
+			log.Fatalf("FATAL: failed to marshal JSON report: %s", err)
+		}
+		if err = ioutil.WriteFile(*flagJSON, b, 0644); err != nil {
+			log.Fatalf("FATAL: failed to write JSON report: %s", err)
+		}
+	}
+	log.Printf("%d tests: %d passed, %d failed, %d skipped, %d flaked\n", len(results), counts["pass"], counts["fail"], counts["skip"], counts["flaked"])
+	if counts["fail"] > 0 {
+		os.Exit(1)
+	}
+}
+
+func readResults(r *bufio.Reader) ([]*TestResult, error) {
+	var results []*TestResult
+	byName := make(map[string]*TestResult)
+	// the output and result of each package outside of its tests
+	pkgOutput := make(map[string]*strings.Builder)
+	var pkgFailures []testEvent
+	dec := json.NewDecoder(r)
+	for {
+		var ev testEvent
+		if err := dec.Decode(&ev); err != nil {
+			if err == io.EOF {
+				break
+			}
+			return nil, err
+		}
+		if *flagPassthru && ev.Action == "output" {
+			fmt.Print(ev.Output)
+		}
+		if ev.Test == "" {
+			switch ev.Action {
+			case "output":
+				if pkgOutput[ev.Package] == nil {
+					pkgOutput[ev.Package] = &strings.Builder{}
+				}
+				pkgOutput[ev.Package].WriteString(ev.Output)
+			case "fail":
+				pkgFailures = append(pkgFailures, ev)
+			}
+			continue
+		}
+		key := ev.Package + " " + ev.Test
+		result := byName[key]
+		if result == nil {
+			result = &TestResult{
+				Package: ev.Package,
+				Test:    ev.Test,
+			}
+			byName[key] = result
+			results = append(results, result)
+		}
+		switch ev.Action {
+		case "output":
+			result.output.WriteString(ev.Output)
+		case "pass", "fail", "skip":
+			result.Status = ev.Action
+			result.Elapsed = ev.Elapsed
+			if ev.Action == "fail" {
+				result.Output = result.output.String()
+			}
+			if ev.Action == "skip" {
+				result.SkipReason = skipReason(result.output.String())
+			}
+		}
+	}
+	// tests which never finished, e.g because the test binary timed out
+	for _, result := range results {
+		if result.Status == "" {
+			result.Status = "fail"
+			result.Output = result.output.String()
+		}
+	}
+	// packages fail when their tests do, so only report packages which failed without a failed test, as
+	// otherwise nothing would show that the tests of the package never ran
+	for _, ev := range pkgFailures {
+		testFailed := false
+		for _, result := range results {
+			if result.Package == ev.Package && result.Status == "fail" {
+				testFailed = true
+				break
+			}
+		}
+		if testFailed {
+			continue
+		}
+		var output string
+		if pkgOutput[ev.Package] != nil {
+			output = pkgOutput[ev.Package].String()
+		}
+		results = append(results, &TestResult{
+			Package: ev.Package,
+			Test:    packageTestName,
+			Status:  "fail",
+			Elapsed: ev.Elapsed,
+			Output:  output,
+		})
+	}
+	return results, nil
+}
+
+// skipReason returns the messages logged by a skipped test, which include the reason given to t.Skip.
+func skipReason(output string) string {
+	var lines []string
+	for _, line := range strings.Split(output, "\n") {
+		trimmed := strings.TrimSpace(line)
+		if trimmed == "" || strings.HasPrefix(trimmed, "=== ") || strings.HasPrefix(trimmed, "--- ") {
+			continue
+		}
+		lines = append(lines, trimmed)
+	}
+	return strings.Join(lines, "\n")
+}
+
+// findArtifacts returns the files Complement wrote for the test. Deployments and HAR files are usually
+// made for the top-level test, so the files of the top-level test are included for subtests.
+func findArtifacts(testName string) []string {
+	names := []string{testName}
+	if top := strings.Split(testName, "/")[0]; top != testName {
+		names = append(names, top)
+	}
+	var paths []string
+	for _, name := range names {
+		filename := testlog.Filename(name)
+		if *flagArtifacts != "" {
+			dir := filepath.Join(*flagArtifacts, filename)
+			entries, _ := ioutil.ReadDir(dir)
+			for _, e := range entries {
+				paths = append(paths, filepath.Join(dir, e.Name()))
+			}
+		}
+		if *flagCapture != "" {
+			har := filepath.Join(*flagCapture, filename+".har")
+			if _, err := os.Stat(har); err == nil {
+				paths = append(paths, har)
+			}
+		}
+	}
+	sort.Strings(paths)
+	return paths
+}
+
+type junitTestSuites struct {
+	XMLName xml.Name         `xml:"testsuites"`
+	Suites  []junitTestSuite `xml:"testsuite"`
+}
+
+type junitTestSuite struct {
+	Name     string          `xml:"name,attr"`
+	Tests    int             `xml:"tests,attr"`
+	Failures int             `xml:"failures,attr"`
+	Skipped  int             `xml:"skipped,attr"`
+	Time     string          `xml:"time,attr"`
+	Cases    []junitTestCase `xml:"testcase"`
+
+	elapsed float64
+}
+
+type junitTestCase struct {
+	ClassName string        `xml:"classname,attr"`
+	Name      string        `xml:"name,attr"`
+	Time      string        `xml:"time,attr"`
+	Failure   *junitMessage `xml:"failure,omitempty"`
+	Skipped   *junitMessage `xml:"skipped,omitempty"`
+	SystemOut string        `xml:"system-out,omitempty"`
+}
+
+type junitMessage struct {
+	Message string `xml:"message,attr"`
+	Body    string `xml:",chardata"`
+}
+
+func writeJUnit(path string, results []*TestResult) error {
+	suites := make(map[string]*junitTestSuite)
+	var names []string
+	for _, r := range results {
+		suite := suites[r.Package]
+		if suite == nil {
+			suite = &junitTestSuite{Name: r.Package}
+			suites[r.Package] = suite
+			names = append(names, r.Package)
+		}
+		tc := junitTestCase{
+			ClassName: r.Package,
+			Name:      r.Test,
+			Time:      fmt.Sprintf("%.3f", r.Elapsed),
+		}
+		switch r.Status {
+		case "fail":
+			suite.Failures++
+			tc.Failure = &junitMessage{Message: "Failed", Body: r.Output}
+		case "skip":
+			suite.Skipped++
+			tc.Skipped = &junitMessage{Message: r.SkipReason}
+		case "flaked":
+			tc.SystemOut = fmt.Sprintf("Flaked: passed on attempt %d after failing with:\n%s\n", r.Attempts, r.Output)
+		}
+		if len(r.Artifacts) > 0 {
+			tc.SystemOut += "Artifacts:\n" + strings.Join(r.Artifacts, "\n")
+		}
+		suite.Tests++
+		// only top-level tests count towards the time of the suite, as subtests are part of them
+		if !strings.Contains(r.Test, "/") {
+			suite.elapsed += r.Elapsed
+			suite.Time = fmt.Sprintf("%.3f", suite.elapsed)
+		}
+		suite.Cases = append(suite.Cases, tc)
+	}
+	var out junitTestSuites
+	for _, name := range names {
+		out.Suites = append(out.Suites, *suites[name])
+	}
+	b, err := xml.MarshalIndent(out, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, append([]byte(xml.Header), b...), 0644)
+}
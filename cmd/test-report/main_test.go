@@ -0,0 +1,95 @@
+package main
+
+import (
+	"bufio"
+	"strings"
+	"testing"
+)
+
+func TestReadResultsPackageFailures(t *testing.T) {
+	testCases := []struct {
+		name       string
+		events     []string
+		wantStatus map[string]string
+	}{
+		{
+			name: "package fails without a failed test",
+			events: []string{
+				`{"Action":"run","Package":"pkg","Test":"TestA"}`,
+				`{"Action":"pass","Package":"pkg","Test":"TestA","Elapsed":1}`,
+				`{"Action":"output","Package":"pkg","Output":"panic: boom\n"}`,
+				`{"Action":"fail","Package":"pkg","Elapsed":2}`,
+			},
+			wantStatus: map[string]string{
+				"TestA":         "pass",
+				packageTestName: "fail",
+			},
+		},
+		{
+			name: "package fails to build",
+			events: []string{
+				`{"Action":"output","Package":"pkg","Output":"FAIL\tpkg [build failed]\n"}`,
+				`{"Action":"fail","Package":"pkg","Elapsed":0}`,
+			},
+			wantStatus: map[string]string{
+				packageTestName: "fail",
+			},
+		},
+		{
+			name: "package fails because a test did",
+			events: []string{
+				`{"Action":"run","Package":"pkg","Test":"TestA"}`,
+				`{"Action":"fail","Package":"pkg","Test":"TestA","Elapsed":1}`,
+				`{"Action":"fail","Package":"pkg","Elapsed":2}`,
+			},
+			wantStatus: map[string]string{
+				"TestA": "fail",
+			},
+		},
+		{
+			name: "package passes",
+			events: []string{
+				`{"Action":"run","Package":"pkg","Test":"TestA"}`,
+				`{"Action":"pass","Package":"pkg","Test":"TestA","Elapsed":1}`,
+				`{"Action":"pass","Package":"pkg","Elapsed":2}`,
+			},
+			wantStatus: map[string]string{
+				"TestA": "pass",
+			},
+		},
+	}
+	for _, tc := range testCases {
+		results, err := readResults(bufio.NewReader(strings.NewReader(strings.Join(tc.events, "\n"))))
+		if err != nil {
+			t.Fatalf("%s: readResults returned error: %s", tc.name, err)
+		}
+		gotStatus := make(map[string]string)
+		for _, r := range results {
+			gotStatus[r.Test] = r.Status
+		}
+		if len(gotStatus) != len(tc.wantStatus) {
+			t.Errorf("%s: got results %v want %v", tc.name, gotStatus, tc.wantStatus)
+			continue
+		}
+		for name, want := range tc.wantStatus {
+			if gotStatus[name] != want {
+				t.Errorf("%s: got %s for %s, want %s", tc.name, gotStatus[name], name, want)
+			}
+		}
+	}
+}
+
+func TestReadResultsPackageFailureOutput(t *testing.T) {
+	events := `{"Action":"output","Package":"pkg","Output":"panic: boom\n"}
+{"Action":"fail","Package":"pkg","Elapsed":2}`
+	results, err := readResults(bufio.NewReader(strings.NewReader(events)))
+	if err != nil {
+		t.Fatalf("readResults returned error: %s", err)
+	}
+	if len(results) != 1 {
+		t.Fatalf("got %d results, want 1", len(results))
+	}
+	if !strings.Contains(results[0].Output, "panic: boom") {
+		t.Errorf("output of package failure doesn't include the panic: %q", results[0].Output)
+	}
+}
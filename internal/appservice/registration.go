@@ -0,0 +1,103 @@
+package appservice
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"strings"
+)
+
+// Namespace is a single namespace entry in an application service registration.
+type Namespace struct {
+	Exclusive bool
+	Regex     string
+}
+
+// Namespaces are the users, aliases and rooms which an application service is interested in.
+type Namespaces struct {
+	Users   []Namespace
+	Aliases []Namespace
+	Rooms   []Namespace
+}
+
+// Registration is an application service registration, as read by the homeserver on startup.
+type Registration struct {
+	ID              string
+	URL             string
+	HSToken         string
+	ASToken         string
+	SenderLocalpart string
+	RateLimited     bool
+	Namespaces      Namespaces
+	// If true, ephemeral events and to-device messages are pushed to the application service (MSC2409)
+	ReceiveEphemeral bool
+	// If true, the application service can masquerade as devices and is sent device list
+	// changes and one-time key counts (MSC3202)
+	MSC3202 bool
+}
+
+// NewRegistration returns a registration for the given ID with freshly generated tokens. The
+// registration is interested in all users with the localpart prefix `{id}_`, non-exclusively.
+func NewRegistration(id string) (*Registration, error) {
+	hsToken, err := randomToken()
+	if err != nil {
+		return nil, err
+	}
+	asToken, err := randomToken()
+	if err != nil {
+		return nil, err
+	}
+	return &Registration{
+		ID:              id,
+		HSToken:         hsToken,
+		ASToken:         asToken,
+		SenderLocalpart: id + "_bot",
+		Namespaces: Namespaces{
+			Users: []Namespace{
+				{
+					Exclusive: false,
+					Regex:     "@" + id + "_.*",
+				},
+			},
+		},
+	}, nil
+}
+
+// YAML returns the registration in the YAML format expected by homeservers.
+func (r *Registration) YAML() string {
+	return fmt.Sprintf("id: %s\n", r.ID) +
+		fmt.Sprintf("hs_token: %s\n", r.HSToken) +
+		fmt.Sprintf("as_token: %s\n", r.ASToken) +
+		fmt.Sprintf("url: '%s'\n", r.URL) +
+		fmt.Sprintf("sender_localpart: %s\n", r.SenderLocalpart) +
+		fmt.Sprintf("rate_limited: %v\n", r.RateLimited) +
+		fmt.Sprintf("receive_ephemeral: %v\n", r.ReceiveEphemeral) +
+		fmt.Sprintf("de.sorunome.msc2409.push_ephemeral: %v\n", r.ReceiveEphemeral) +
+		fmt.Sprintf("org.matrix.msc3202: %v\n", r.MSC3202) +
+		"namespaces:\n" +
+		namespacesYAML("users", r.Namespaces.Users) +
+		namespacesYAML("rooms", r.Namespaces.Rooms) +
+		namespacesYAML("aliases", r.Namespaces.Aliases)
+}
+
+func namespacesYAML(key string, namespaces []Namespace) string {
+	if len(namespaces) == 0 {
+		return fmt.Sprintf("  %s: []\n", key)
+	}
+	var sb strings.Builder
+	sb.WriteString(fmt.Sprintf("  %s:\n", key))
+	for _, ns := range namespaces {
+		sb.WriteString(fmt.Sprintf("    - exclusive: %v\n", ns.Exclusive))
+		// single quote the regex so YAML doesn't interpret any special characters in it
+		sb.WriteString(fmt.Sprintf("      regex: '%s'\n", strings.ReplaceAll(ns.Regex, "'", "''")))
+	}
+	return sb.String()
+}
+
+func randomToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
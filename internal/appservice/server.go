@@ -0,0 +1,475 @@
+// Package appservice contains a mock application service which homeservers can push events to
+package appservice
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/tidwall/gjson"
+
+	"github.com/matrix-org/complement/internal/capture"
+	"github.com/matrix-org/complement/internal/client"
+	"github.com/matrix-org/complement/internal/docker"
+	"github.com/matrix-org/complement/internal/match"
+	"github.com/matrix-org/complement/internal/watchdog"
+)
+
+var serverCounter uint64
+
+// The query parameter used to masquerade as a device, as defined by MSC3202.
+const deviceIDQueryParam = "org.matrix.msc3202.device_id"
+
+// Server represents a mock application service. Homeservers are told about it by passing
+// Server.DeployOption to Deploy.
+type Server struct {
+	t *testing.T
+
+	// Default: true
+	UnexpectedRequestsAreErrors bool
+
+	// The registration for this application service. Tokens are generated by NewServer and the
+	// URL is set by Listen. Namespaces can be modified with options or before calling DeployOption.
+	Registration *Registration
+
+	listening bool
+	mux       *mux.Router
+	srv       *http.Server
+
+	txnMu    sync.Mutex
+	txnIDs   map[string]bool
+	txns     [][]byte
+	txnReady chan struct{} // closed and replaced whenever a new transaction arrives
+
+	pingMu sync.Mutex
+	pings  []string
+}
+
+// NewServer creates a new mock application service with configured options.
+func NewServer(t *testing.T, opts ...func(*Server)) *Server {
+	id := fmt.Sprintf("complement_as_%d", atomic.AddUint64(&serverCounter, 1))
+	reg, err := NewRegistration(id)
+	if err != nil {
+		t.Fatalf("appservice.NewServer failed to generate registration: %s", err)
+	}
+	srv := &Server{
+		t:                           t,
+		UnexpectedRequestsAreErrors: true,
+		Registration:                reg,
+		mux:                         mux.NewRouter(),
+		txnIDs:                      make(map[string]bool),
+		txnReady:                    make(chan struct{}),
+	}
+	srv.mux.Use(func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+			if !srv.isAuthorised(req) {
+				t.Errorf("appservice.Server received request without a valid hs_token: %s %s", req.Method, req.URL.Path)
+				w.WriteHeader(403)
+				w.Write([]byte(`{"errcode":"M_FORBIDDEN","error":"complement: bad hs_token"}`))
+				return
+			}
+			h.ServeHTTP(w, req)
+		})
+	})
+	srv.mux.NotFoundHandler = http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if srv.UnexpectedRequestsAreErrors {
+			body, _ := ioutil.ReadAll(req.Body)
+			t.Errorf("appservice.Server.UnexpectedRequestsAreErrors=true received unexpected request: %s %s\n%s", req.Method, req.URL.Path, string(body))
+		} else {
+			t.Logf("appservice.Server.UnexpectedRequestsAreErrors=false received unexpected request: %s %s", req.Method, req.URL.Path)
+		}
+		w.WriteHeader(404)
+		w.Write([]byte(`{"errcode":"M_UNRECOGNIZED","error":"complement: appservice is not listening for this path"}`))
+	})
+	// transactions are always handled: homeservers will retry (and eventually back off) if we don't.
+	txnHandler := http.HandlerFunc(srv.handleTransaction)
+	srv.mux.Handle("/_matrix/app/v1/transactions/{txnID}", txnHandler).Methods("PUT")
+	srv.mux.Handle("/transactions/{txnID}", txnHandler).Methods("PUT")
+	srv.mux.HandleFunc("/_matrix/app/v1/ping", srv.handlePing).Methods("POST")
+	srv.srv = &http.Server{
+		Handler: srv.mux,
+	}
+	for _, opt := range opts {
+		opt(srv)
+	}
+	return srv
+}
+
+// WithUserNamespace adds a user namespace regex to the registration.
+func WithUserNamespace(regex string, exclusive bool) func(*Server) {
+	return func(s *Server) {
+		s.Registration.Namespaces.Users = append(s.Registration.Namespaces.Users, Namespace{Regex: regex, Exclusive: exclusive})
+	}
+}
+
+// WithRoomNamespace adds a room ID namespace regex to the registration.
+func WithRoomNamespace(regex string, exclusive bool) func(*Server) {
+	return func(s *Server) {
+		s.Registration.Namespaces.Rooms = append(s.Registration.Namespaces.Rooms, Namespace{Regex: regex, Exclusive: exclusive})
+	}
+}
+
+// WithAliasNamespace adds a room alias namespace regex to the registration.
+func WithAliasNamespace(regex string, exclusive bool) func(*Server) {
+	return func(s *Server) {
+		s.Registration.Namespaces.Aliases = append(s.Registration.Namespaces.Aliases, Namespace{Regex: regex, Exclusive: exclusive})
+	}
+}
+
+// WithEphemeralEvents is an option which asks the homeserver to push ephemeral events and to-device
+// messages to the application service (MSC2409).
+func WithEphemeralEvents() func(*Server) {
+	return func(s *Server) {
+		s.Registration.ReceiveEphemeral = true
+	}
+}
+
+// WithDeviceMasquerading is an option which allows the application service to masquerade as devices
+// of its users, and asks the homeserver to send it device list changes and one-time key counts (MSC3202).
+// Homeservers may need the feature enabled in their config as well.
+func WithDeviceMasquerading() func(*Server) {
+	return func(s *Server) {
+		s.Registration.MSC3202 = true
+	}
+}
+
+// HandleUserQueries is an option which answers GET /users/{userId} requests from the homeserver.
+// `exists` is called with the queried user ID and should return true if the user exists. If the
+// user should be created on demand, `exists` must register the user before returning true.
+func HandleUserQueries(exists func(userID string) bool) func(*Server) {
+	return func(s *Server) {
+		fn := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			queryResponse(w, exists(mux.Vars(req)["userID"]))
+		})
+		s.mux.Handle("/_matrix/app/v1/users/{userID}", fn).Methods("GET")
+		s.mux.Handle("/users/{userID}", fn).Methods("GET")
+	}
+}
+
+// HandleRoomAliasQueries is an option which answers GET /rooms/{roomAlias} requests from the homeserver.
+// `exists` is called with the queried room alias and should return true if the alias exists. If the
+// room should be created on demand, `exists` must create the room and alias before returning true.
+func HandleRoomAliasQueries(exists func(roomAlias string) bool) func(*Server) {
+	return func(s *Server) {
+		fn := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			queryResponse(w, exists(mux.Vars(req)["roomAlias"]))
+		})
+		s.mux.Handle("/_matrix/app/v1/rooms/{roomAlias}", fn).Methods("GET")
+		s.mux.Handle("/rooms/{roomAlias}", fn).Methods("GET")
+	}
+}
+
+func queryResponse(w http.ResponseWriter, exists bool) {
+	if exists {
+		w.WriteHeader(200)
+		w.Write([]byte(`{}`))
+		return
+	}
+	w.WriteHeader(404)
+	w.Write([]byte(`{"errcode":"M_NOT_FOUND","error":"complement: not found"}`))
+}
+
+// Mux returns this server's router so you can attach additional paths.
+func (s *Server) Mux() *mux.Router {
+	return s.mux
+}
+
+// Listen for requests from the homeserver - call the returned function to gracefully close the server.
+// This must be called before DeployOption as it determines the URL in the registration.
+func (s *Server) Listen() (cancel func()) {
+	if s.listening {
+		return func() {}
+	}
+	var wg sync.WaitGroup
+	wg.Add(1)
+
+	ln, err := net.Listen("tcp", ":0") //nolint
+	if err != nil {
+		s.t.Fatalf("appservice.Server.Listen: net.Listen failed: %s", err)
+	}
+	port := ln.Addr().(*net.TCPAddr).Port
+	s.Registration.URL = fmt.Sprintf("http://%s:%d", docker.HostnameRunningComplement, port)
+	s.listening = true
+
+	go func() {
+		defer ln.Close()
+		defer wg.Done()
+		err := s.srv.Serve(ln)
+		if err != nil && err != http.ErrServerClosed {
+			s.t.Logf("appservice.Server.Listen: Serve failed: %s", err)
+		}
+	}()
+
+	return func() {
+		err := s.srv.Shutdown(context.Background())
+		if err != nil {
+			s.t.Fatalf("appservice.Server.Listen: failed to shutdown server: %s", err)
+		}
+		wg.Wait()
+	}
+}
+
+// DeployOption returns an option for Deploy which installs this application service's registration
+// on the homeserver `hsName`.
+func (s *Server) DeployOption(hsName string) docker.DeployOption {
+	if !s.listening {
+		s.t.Fatalf("DeployOption() called before Listen() - this is not supported because Listen() chooses a high-numbered port and thus changes the registration URL. Ensure you Listen() first!")
+	}
+	return docker.WithApplicationServiceRegistration(hsName, s.Registration.ID, s.Registration.YAML())
+}
+
+// SenderUserID returns the user ID of the application service's sender user on the given homeserver.
+func (s *Server) SenderUserID(hsName string) string {
+	return fmt.Sprintf("@%s:%s", s.Registration.SenderLocalpart, hsName)
+}
+
+// Client returns a CSAPI client authenticated with the as_token, acting as the sender user.
+func (s *Server) Client(t *testing.T, deployment *docker.Deployment, hsName string) *client.CSAPI {
+	t.Helper()
+	return s.MasqueradeClient(t, deployment, hsName, "")
+}
+
+// MasqueradeClient returns a CSAPI client authenticated with the as_token which adds
+// `user_id=userID` to every request, acting as the given user. If userID is "" then
+// the client acts as the sender user.
+func (s *Server) MasqueradeClient(t *testing.T, deployment *docker.Deployment, hsName, userID string) *client.CSAPI {
+	t.Helper()
+	return s.MasqueradeDeviceClient(t, deployment, hsName, userID, "")
+}
+
+// MasqueradeDeviceClient is like MasqueradeClient but additionally acts as the given device of the user,
+// which must already exist. The application service must have been created WithDeviceMasquerading.
+func (s *Server) MasqueradeDeviceClient(t *testing.T, deployment *docker.Deployment, hsName, userID, deviceID string) *client.CSAPI {
+	t.Helper()
+	dep, ok := deployment.HS[hsName]
+	if !ok {
+		t.Fatalf("appservice.Server.MasqueradeClient - HS name '%s' not found", hsName)
+		return nil
+	}
+	cli := &http.Client{
+		Timeout: 30 * time.Second,
+	}
+	clientUserID := s.SenderUserID(hsName)
+	if userID != "" {
+		cli.Transport = &masqueradeRoundTripper{
+			userID:   userID,
+			deviceID: deviceID,
+			wrap:     http.DefaultTransport,
+		}
+		clientUserID = userID
+	}
+	// record the request after the user_id has been added
+	cli.Transport = capture.ForTest(t, deployment.Config.CaptureDir).RoundTripper(hsName, cli.Transport)
+	return &client.CSAPI{
+		UserID:           clientUserID,
+		DeviceID:         deviceID,
+		AccessToken:      s.Registration.ASToken,
+		BaseURL:          dep.BaseURL,
+		Client:           client.NewLoggedClient(t, hsName, cli),
+		SyncUntilTimeout: 5 * time.Second,
+		Debug:            deployment.Config.DebugLoggingEnabled,
+	}
+}
+
+// MustRegisterGhost registers the user `localpart` on `hsName` using the application service
+// registration type, then returns a client which masquerades as that user. The localpart must
+// fall within one of this application service's user namespaces.
+func (s *Server) MustRegisterGhost(t *testing.T, deployment *docker.Deployment, hsName, localpart string) *client.CSAPI {
+	t.Helper()
+	asClient := s.Client(t, deployment, hsName)
+	res := asClient.MustDoFunc(t, "POST", []string{"_matrix", "client", "r0", "register"}, client.WithJSONBody(t, map[string]interface{}{
+		"type":     "m.login.application_service",
+		"username": localpart,
+	}))
+	userID := client.GetJSONFieldStr(t, client.ParseJSON(t, res), "user_id")
+	return s.MasqueradeClient(t, deployment, hsName, userID)
+}
+
+// WithTimestamp sets the `ts` query parameter on the request, which application services can use
+// to set the origin_server_ts of events they send.
+func WithTimestamp(ts time.Time) client.RequestOpt {
+	return client.WithQueries(url.Values{
+		"ts": []string{strconv.FormatInt(ts.UnixNano()/int64(time.Millisecond), 10)},
+	})
+}
+
+// Pings returns the transaction IDs of all pings received so far (MSC2659), in the order they were received.
+// Pings which were sent without a transaction ID are recorded as "".
+func (s *Server) Pings() []string {
+	s.pingMu.Lock()
+	defer s.pingMu.Unlock()
+	pings := make([]string, len(s.pings))
+	copy(pings, s.pings)
+	return pings
+}
+
+// Transactions returns the bodies of all transactions received so far, in the order they were received.
+// Retried transactions are only included once.
+func (s *Server) Transactions() [][]byte {
+	s.txnMu.Lock()
+	defer s.txnMu.Unlock()
+	txns := make([][]byte, len(s.txns))
+	copy(txns, s.txns)
+	return txns
+}
+
+// AwaitTransaction blocks until a transaction is received which passes all the `matchers`, then returns
+// the transaction body. Transactions which were received before this function was called are also checked.
+// Fails the test if no transaction matches within `timeout`.
+func (s *Server) AwaitTransaction(t *testing.T, timeout time.Duration, matchers ...match.JSON) []byte {
+	t.Helper()
+	defer watchdog.Waiting(t, "AwaitTransaction")()
+	deadline := time.After(timeout)
+	checked := 0
+	var lastErr error
+	for {
+		s.txnMu.Lock()
+		txns := s.txns[checked:]
+		ready := s.txnReady
+		s.txnMu.Unlock()
+		for _, txn := range txns {
+			checked++
+			lastErr = matchAll(txn, matchers)
+			if lastErr == nil {
+				return txn
+			}
+		}
+		select {
+		case <-ready:
+		case <-deadline:
+			t.Fatalf("AwaitTransaction: timed out after %v having seen %d transactions, last error: %v", timeout, checked, lastErr)
+			return nil
+		}
+	}
+}
+
+// TransactionHasEvent returns a matcher for use with AwaitTransaction which passes if at least one event
+// in the transaction passes the `check` function.
+func TransactionHasEvent(check func(gjson.Result) bool) match.JSON {
+	return func(body []byte) error {
+		events := gjson.GetBytes(body, "events")
+		if !events.IsArray() {
+			return fmt.Errorf("transaction has no events array")
+		}
+		for _, ev := range events.Array() {
+			if check(ev) {
+				return nil
+			}
+		}
+		return fmt.Errorf("check function did not pass for any of the %d events in the transaction", len(events.Array()))
+	}
+}
+
+// TransactionHasToDevice returns a matcher for use with AwaitTransaction which passes if at least one
+// to-device message in the transaction passes the `check` function. Both the stable `to_device` key and
+// the unstable MSC2409 key are checked.
+func TransactionHasToDevice(check func(gjson.Result) bool) match.JSON {
+	return func(body []byte) error {
+		count := 0
+		for _, key := range []string{"to_device", "de\\.sorunome\\.msc2409\\.to_device"} {
+			msgs := gjson.GetBytes(body, key)
+			if !msgs.IsArray() {
+				continue
+			}
+			for _, msg := range msgs.Array() {
+				count++
+				if check(msg) {
+					return nil
+				}
+			}
+		}
+		return fmt.Errorf("check function did not pass for any of the %d to-device messages in the transaction", count)
+	}
+}
+
+func matchAll(body []byte, matchers []match.JSON) error {
+	for _, m := range matchers {
+		if err := m(body); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *Server) handleTransaction(w http.ResponseWriter, req *http.Request) {
+	txnID := mux.Vars(req)["txnID"]
+	body, err := ioutil.ReadAll(req.Body)
+	if err != nil || !gjson.ValidBytes(body) {
+		s.t.Errorf("appservice.Server: transaction %s is not valid JSON: %v", txnID, err)
+		w.WriteHeader(400)
+		w.Write([]byte(`{"errcode":"M_NOT_JSON","error":"complement: transaction is not valid JSON"}`))
+		return
+	}
+	s.txnMu.Lock()
+	if !s.txnIDs[txnID] {
+		s.txnIDs[txnID] = true
+		s.txns = append(s.txns, body)
+		close(s.txnReady)
+		s.txnReady = make(chan struct{})
+	}
+	s.txnMu.Unlock()
+	w.WriteHeader(200)
+	w.Write([]byte(`{}`))
+}
+
+func (s *Server) handlePing(w http.ResponseWriter, req *http.Request) {
+	body, err := ioutil.ReadAll(req.Body)
+	if err != nil || (len(body) > 0 && !gjson.ValidBytes(body)) {
+		s.t.Errorf("appservice.Server: ping is not valid JSON: %v", err)
+		w.WriteHeader(400)
+		w.Write([]byte(`{"errcode":"M_NOT_JSON","error":"complement: ping is not valid JSON"}`))
+		return
+	}
+	s.pingMu.Lock()
+	s.pings = append(s.pings, gjson.GetBytes(body, "transaction_id").Str)
+	s.pingMu.Unlock()
+	w.WriteHeader(200)
+	w.Write([]byte(`{}`))
+}
+
+// isAuthorised returns true if the request has the hs_token for this application service, either
+// as a bearer token or as the legacy access_token query parameter.
+func (s *Server) isAuthorised(req *http.Request) bool {
+	token := req.URL.Query().Get("access_token")
+	if auth := req.Header.Get("Authorization"); len(auth) > len("Bearer ") {
+		token = auth[len("Bearer "):]
+	}
+	return token == s.Registration.HSToken
+}
+
+// masqueradeRoundTripper adds a user_id query parameter to every request which doesn't already have one,
+// and the MSC3202 device_id query parameter if a device ID is set.
+type masqueradeRoundTripper struct {
+	userID   string
+	deviceID string
+	wrap     http.RoundTripper
+}
+
+func (t *masqueradeRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	q := req.URL.Query()
+	modified := false
+	if q.Get("user_id") == "" {
+		q.Set("user_id", t.userID)
+		modified = true
+	}
+	if t.deviceID != "" && q.Get(deviceIDQueryParam) == "" {
+		q.Set(deviceIDQueryParam, t.deviceID)
+		modified = true
+	}
+	if modified {
+		// RoundTrippers must not modify the original request
+		req = req.Clone(req.Context())
+		req.URL.RawQuery = q.Encode()
+	}
+	return t.wrap.RoundTrip(req)
+}
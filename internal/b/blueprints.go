@@ -20,6 +20,7 @@ import (
 	"fmt"
 	"strconv"
 	"strings"
+	"time"
 )
 
 // KnownBlueprints lists static blueprints
@@ -33,6 +34,7 @@ var KnownBlueprints = map[string]*Blueprint{
 	BlueprintPerfManyMessages.Name:            &BlueprintPerfManyMessages,
 	BlueprintPerfManyRooms.Name:               &BlueprintPerfManyRooms,
 	BlueprintPerfE2EERoom.Name:                &BlueprintPerfE2EERoom,
+	BlueprintSpace.Name:                       &BlueprintSpace,
 }
 
 // Blueprint represents an entire deployment to make.
@@ -43,6 +45,22 @@ type Blueprint struct {
 	Homeservers []Homeserver
 	// A set of user IDs to retain access_tokens for. If empty, all tokens are kept.
 	KeepAccessTokensForUsers []string
+	// Rooms shared between the homeservers, which are added to the rooms of the homeservers when the
+	// blueprint is validated.
+	Rooms []SharedRoom
+}
+
+// SharedRoom is a room with members on several homeservers. The creator invites each member, who then joins,
+// in the order they are listed, and the invited users are left invited. Users are full user IDs, e.g
+// "@bob:hs2", and the creator's homeserver must be listed in the blueprint before the homeservers of the
+// other users, as homeservers are built in order.
+type SharedRoom struct {
+	Ref        string
+	Creator    string
+	CreateRoom map[string]interface{}
+	Version    string
+	Members    []string
+	Invited    []string
 }
 
 type Homeserver struct {
@@ -54,18 +72,87 @@ type Homeserver struct {
 	Rooms []Room
 	// The list of application services to create on the homeserver
 	ApplicationServices []ApplicationService
+	// Name -> container port of extra ports the homeserver listens on, e.g admin or replication APIs, which
+	// are published so tests can find them with Deployment.GetPort
+	Ports map[string]int
+	// If set, the name of an image in COMPLEMENT_EXTRA_IMAGES to run the homeserver from instead of the
+	// base image. Set this with WithImage so the blueprint is built separately for each image.
+	Image string
+	// Steps to run against the homeserver once its users and rooms are made, in order, for state which
+	// can't be described otherwise, e.g key backups or admin actions.
+	Steps []Step
+	// If set, the homeserver runs from a compose file instead of the base image. It isn't built into an
+	// image, so it is deployed afresh and its users and rooms are created every time it is deployed.
+	Compose *Compose
+}
+
+// Step is an HTTP request to make to the homeserver while the blueprint is built, or a Go function to call.
+// Paths and string values in the body can refer to rooms in the blueprint as {room:REF}, and to values
+// stored by earlier steps as {NAME}, e.g
+//
+//	Steps: []Step{
+//		{User: "@alice", Method: "POST", Path: "/_matrix/client/v3/room_keys/version", Body: ..., Store: map[string]string{"backup": "version"}},
+//		{User: "@alice", Method: "PUT", Path: "/_matrix/client/v3/room_keys/keys/{room:main}?version={backup}", Body: ...},
+//	}
+type Step struct {
+	// The localpart of the user making the request, e.g "@alice". Empty for requests without an access token.
+	User   string
+	Method string
+	// The path and query of the request.
+	Path string
+	Body map[string]interface{}
+	// Name -> gjson path of a string in the response, to store for later steps.
+	Store map[string]string
+	// If set, called instead of making a request, with the base URL of the homeserver and the access tokens
+	// of its users keyed by user ID. Functions can't be hashed, so blueprints with them aren't cached across
+	// runs by COMPLEMENT_CACHE_BLUEPRINTS, and aren't shared by Extend.
+	Func func(baseURL string, accessTokens map[string]string) error `json:"-"`
+}
+
+// Compose describes a homeserver which runs alongside other services, e.g a reverse proxy or database,
+// from a docker compose file.
+type Compose struct {
+	// The path to the compose file, relative to the test package.
+	File string
+	// The service running the homeserver. Defaults to the homeserver's name.
+	Service string
 }
 
 type User struct {
 	Localpart   string
 	DisplayName string
 	AvatarURL   string
+	// Global account data to set for this user.
 	AccountData []AccountData
-	DeviceID    *string
+	// Account data to set for this user in rooms in the blueprint.
+	RoomAccountData []RoomAccountData
+	// Tags to give rooms in the blueprint, e.g m.favourite.
+	Tags []Tag
+	// Push rules to add, or default push rules to change, for this user.
+	PushRules []PushRule
+	DeviceID  *string
 	// Enable end-to end encryption for this user and upload the given
 	// amount of one-time keys. This requires the DeviceId to be set as
 	// well.
 	OneTimeKeys uint
+	// Further devices to log the user in on, e.g to test encryption between a user's devices.
+	Devices []Device
+	// Register this user as a guest. Guests are given a user ID by the server, so the Localpart is
+	// only used to refer to the guest in the blueprint and in Deployment.Client e.g "@guest:hs1". As
+	// the real user ID isn't known in advance, guests cannot be used in membership state keys.
+	Guest bool
+}
+
+// Device is a device a user logs in on as well as the one they registered with. Its access token is kept
+// with the blueprint, see Deployment.DeviceClient.
+type Device struct {
+	// The device ID, which must be unique for the user.
+	ID          string
+	DisplayName string
+	// Upload device keys for this device.
+	Keys bool
+	// Upload device keys and this many one-time keys for this device.
+	OneTimeKeys uint
 }
 
 type AccountData struct {
@@ -73,21 +160,117 @@ type AccountData struct {
 	Value map[string]interface{}
 }
 
+// RoomAccountData is account data for the room with the Ref `Room`.
+type RoomAccountData struct {
+	Room  string
+	Type  string
+	Value map[string]interface{}
+}
+
+// Tag is a tag on the room with the Ref `Room`, with an optional order between 0 and 1.
+type Tag struct {
+	Room  string
+	Tag   string
+	Order *float64
+}
+
+// PushRule adds or changes the push rule `RuleID` of the kind `Kind`, e.g override or content.
+type PushRule struct {
+	Kind   string
+	RuleID string
+	// The conditions, pattern and actions of a new rule. Leave it nil to change a default rule, e.g .m.rule.master.
+	Rule map[string]interface{}
+	// If set, replaces the actions of the rule.
+	Actions []interface{}
+	// If set, enables or disables the rule.
+	Enabled *bool
+}
+
 type Room struct {
 	// The unique reference for this room. Used to link together rooms across homeservers.
 	Ref        string
 	Creator    string
 	CreateRoom map[string]interface{}
-	Events     []Event
+	// If set, the room version to create the room with, overriding any room_version in CreateRoom.
+	Version string
+	// If set, merged into any creation_content in CreateRoom, e.g to set the room's type.
+	CreationContent map[string]interface{}
+	Events          []Event
+	// If set, the room is a space with these rooms as its children, which are added by the creator once
+	// every room is made. See Space.
+	Children []SpaceChild
+}
+
+// SpaceChild is a child of a space, which is the room in the blueprint with the Ref `Ref`.
+type SpaceChild struct {
+	Ref string
+	// If true, the room is suggested to members of the space.
+	Suggested bool
+	// If set, the string the children of the space are sorted by.
+	Order string
+}
+
+// CreateRoomBody returns the body of the /createRoom request for the room, which is CreateRoom with the
+// room's Version and CreationContent applied.
+func (r Room) CreateRoomBody() map[string]interface{} {
+	if r.Version == "" && r.CreationContent == nil {
+		return r.CreateRoom
+	}
+	body := make(map[string]interface{}, len(r.CreateRoom)+1)
+	for k, v := range r.CreateRoom {
+		body[k] = v
+	}
+	if r.Version != "" {
+		body["room_version"] = r.Version
+	}
+	if r.CreationContent != nil {
+		content := make(map[string]interface{})
+		if existing, ok := body["creation_content"].(map[string]interface{}); ok {
+			for k, v := range existing {
+				content[k] = v
+			}
+		}
+		for k, v := range r.CreationContent {
+			content[k] = v
+		}
+		body["creation_content"] = content
+	}
+	return body
 }
 
+// HostPlaceholder can be used in the URL of an application service in a blueprint for the hostname of
+// Complement from the perspective of the homeserver, which is replaced when the homeserver is deployed,
+// e.g "http://" + b.HostPlaceholder + ":9000". Use docker.WithApplicationServiceURL to change the whole URL
+// when deploying, e.g to point it at a mock application service listening on a random port.
+const HostPlaceholder = "{{COMPLEMENT_HOST}}"
+
 type ApplicationService struct {
-	ID              string
+	ID string
+	// The tokens, which are generated if they are left empty.
 	HSToken         string
 	ASToken         string
 	URL             string
 	SenderLocalpart string
 	RateLimited     bool
+	// The users, aliases and rooms the application service is interested in. Defaults to all users,
+	// non-exclusively.
+	Namespaces *ApplicationServiceNamespaces
+	// Which of the tokens were generated by Validate
+	generatedHSToken bool
+	generatedASToken bool
+}
+
+// ApplicationServiceNamespaces are the users, aliases and rooms which an application service is interested in.
+type ApplicationServiceNamespaces struct {
+	Users   []ApplicationServiceNamespace
+	Aliases []ApplicationServiceNamespace
+	Rooms   []ApplicationServiceNamespace
+}
+
+// ApplicationServiceNamespace is a regex of IDs in a namespace, e.g "@irc_.*:hs1".
+type ApplicationServiceNamespace struct {
+	Exclusive bool
+	Regex     string
 }
 
 type Event struct {
@@ -95,6 +278,11 @@ type Event struct {
 	Sender   string
 	StateKey *string
 	Content  map[string]interface{}
+	// If set, the origin_server_ts of the event, e.g to make a history spanning days. The event is sent
+	// by an application service masquerading as the sender with the `ts` query parameter, so in blueprints
+	// the homeserver must have an application service whose namespace includes the sender, and clients
+	// sending the event must be application services.
+	Timestamp time.Time
 
 	/* The following fields are ignored in blueprints as clients are unable to set them.
 	 * They are used with federation.Server.
@@ -112,6 +300,44 @@ type Event struct {
 	PrevEvents interface{}
 }
 
+// WithImage returns a copy of the blueprint with the homeserver `hsName` running from the image named
+// `image` in COMPLEMENT_EXTRA_IMAGES, e.g to test federation between the current and previous release.
+// The copy has a different name, so it is built separately from the original blueprint.
+func WithImage(bp Blueprint, hsName, image string) Blueprint {
+	homeservers := make([]Homeserver, len(bp.Homeservers))
+	copy(homeservers, bp.Homeservers)
+	for i := range homeservers {
+		if homeservers[i].Name == hsName {
+			homeservers[i].Image = image
+		}
+	}
+	bp.Homeservers = homeservers
+	bp.Name = fmt.Sprintf("%s_%s_%s", bp.Name, hsName, image)
+	return bp
+}
+
+// WithRoomVersion returns a copy of the blueprint where the rooms it creates without a Version are created
+// with the room version `version`, so one blueprint can be deployed for each room version under test, e.g
+//
+//	for _, ver := range []string{"9", "10"} {
+//		deployment := Deploy(t, b.WithRoomVersion(b.BlueprintOneToOneRoom, ver))
+//		...
+//	}
+//
+// The copy has a different name, so it is built separately for each version.
+func WithRoomVersion(bp Blueprint, version string) Blueprint {
+	bp = copyBlueprint(bp)
+	for _, hs := range bp.Homeservers {
+		for i := range hs.Rooms {
+			if hs.Rooms[i].Creator != "" && hs.Rooms[i].Version == "" {
+				hs.Rooms[i].Version = version
+			}
+		}
+	}
+	bp.Name = fmt.Sprintf("%s_room_v%s", bp.Name, version)
+	return bp
+}
+
 func MustValidate(bp Blueprint) Blueprint {
 	bp2, err := Validate(bp)
 	if err != nil {
@@ -121,10 +347,31 @@ func MustValidate(bp Blueprint) Blueprint {
 }
 
 func Validate(bp Blueprint) (Blueprint, error) {
+	bp, err := validate(bp)
+	if err != nil {
+		return bp, err
+	}
+	return bp, validateSpaceChildren(bp)
+}
+
+// validate normalises the blueprint and checks everything which doesn't depend on rooms made elsewhere in
+// it, so Extend can check the rest once extensions are merged into their base.
+func validate(bp Blueprint) (Blueprint, error) {
 	if bp.Name == "" {
 		return bp, fmt.Errorf("Blueprint must have a Name")
 	}
+	// HS name -> position in the blueprint, as events can only be sent by users on homeservers made earlier
+	hsIndexes := make(map[string]int)
+	// HS name -> true if it has application services, which events with a Timestamp are sent by
+	hasAppServices := make(map[string]bool)
+	for i, hs := range bp.Homeservers {
+		hsIndexes[hs.Name] = i
+		hasAppServices[hs.Name] = len(hs.ApplicationServices) > 0
+	}
 	var err error
+	if bp, err = expandSharedRooms(bp, hsIndexes); err != nil {
+		return bp, err
+	}
 	for _, hs := range bp.Homeservers {
 		for i, u := range hs.Users {
 			if !strings.HasPrefix(u.Localpart, "@") {
@@ -133,14 +380,44 @@ func Validate(bp Blueprint) (Blueprint, error) {
 			if strings.Contains(u.Localpart, ":") {
 				return bp, fmt.Errorf("HS %s user localpart '%s' must not contain a domain", hs.Name, u.Localpart)
 			}
+			if u.OneTimeKeys > 0 && u.DeviceID == nil {
+				return bp, fmt.Errorf("HS %s user '%s' must have a DeviceID to upload one-time keys", hs.Name, u.Localpart)
+			}
+			deviceIDs := make(map[string]bool)
+			for _, dev := range u.Devices {
+				if u.Guest {
+					return bp, fmt.Errorf("HS %s user '%s' is a guest, so can't log in on more devices", hs.Name, u.Localpart)
+				}
+				if dev.ID == "" || deviceIDs[dev.ID] || (u.DeviceID != nil && *u.DeviceID == dev.ID) {
+					return bp, fmt.Errorf("HS %s user '%s' devices must have unique IDs", hs.Name, u.Localpart)
+				}
+				deviceIDs[dev.ID] = true
+			}
 			// strip the @
 			hs.Users[i].Localpart = hs.Users[i].Localpart[1:]
 		}
 		for i := range hs.Rooms {
-			hs.Rooms[i], err = normaliseRoom(hs.Name, hs.Rooms[i])
+			hs.Rooms[i], err = normaliseRoom(hs.Name, hsIndexes, hs.Rooms[i])
 			if err != nil {
 				return bp, err
 			}
+			for _, ev := range hs.Rooms[i].Events {
+				// the event is sent through the sender's homeserver, which may not be this one
+				if senderHS := userDomain(ev.Sender); !ev.Timestamp.IsZero() && !hasAppServices[senderHS] {
+					return bp, fmt.Errorf("HS %s must have an application service to send events with a Timestamp from %s", senderHS, ev.Sender)
+				}
+			}
+		}
+		for i := range hs.Steps {
+			if hs.Steps[i].Func == nil && (hs.Steps[i].Method == "" || hs.Steps[i].Path == "") {
+				return bp, fmt.Errorf("HS %s step %d must have a Method and Path, or a Func", hs.Name, i)
+			}
+			if hs.Steps[i].User != "" {
+				hs.Steps[i].User, err = normaliseUser(hs.Steps[i].User, hs.Name)
+				if err != nil {
+					return bp, err
+				}
+			}
 		}
 		for i, as := range hs.ApplicationServices {
 			hs.ApplicationServices[i], err = normalizeApplicationService(as)
@@ -153,7 +430,86 @@ func Validate(bp Blueprint) (Blueprint, error) {
 	return bp, nil
 }
 
-func normaliseRoom(hsName string, r Room) (Room, error) {
+// validateSpaceChildren checks the children of every space are made by the time they are added, which is once
+// the rooms of the space's homeserver are made, so they must be on that homeserver or one listed before it.
+func validateSpaceChildren(bp Blueprint) error {
+	createdRooms := make(map[string]bool)
+	for _, hs := range bp.Homeservers {
+		for _, r := range hs.Rooms {
+			if r.Ref != "" && r.Creator != "" {
+				createdRooms[r.Ref] = true
+			}
+		}
+		for _, r := range hs.Rooms {
+			for _, child := range r.Children {
+				if !createdRooms[child.Ref] {
+					return fmt.Errorf("HS %s room %s: child room %s must be made on %s or a homeserver listed before it", hs.Name, r.Ref, child.Ref, hs.Name)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// expandSharedRooms adds the blueprint's shared rooms to the rooms of its homeservers.
+func expandSharedRooms(bp Blueprint, hsIndexes map[string]int) (Blueprint, error) {
+	for _, sr := range bp.Rooms {
+		creatorHS := userDomain(sr.Creator)
+		creatorIndex, ok := hsIndexes[creatorHS]
+		if !ok {
+			return bp, fmt.Errorf("shared room %s: creator %s must be on a homeserver in the blueprint", sr.Ref, sr.Creator)
+		}
+		if sr.Ref == "" {
+			return bp, fmt.Errorf("shared room created by %s must have a Ref", sr.Creator)
+		}
+		// HS name -> index of the room in its rooms
+		roomIndexes := map[string]int{creatorHS: len(bp.Homeservers[creatorIndex].Rooms)}
+		bp.Homeservers[creatorIndex].Rooms = append(bp.Homeservers[creatorIndex].Rooms, Room{
+			Ref:        sr.Ref,
+			Creator:    sr.Creator,
+			CreateRoom: sr.CreateRoom,
+			Version:    sr.Version,
+		})
+		addEvents := func(userID string, events ...Event) error {
+			hsName := userDomain(userID)
+			hsIndex, ok := hsIndexes[hsName]
+			if !ok || hsIndex < creatorIndex {
+				return fmt.Errorf("shared room %s: %s must be on a homeserver listed after %s", sr.Ref, userID, creatorHS)
+			}
+			if _, ok := roomIndexes[hsName]; !ok {
+				roomIndexes[hsName] = len(bp.Homeservers[hsIndex].Rooms)
+				bp.Homeservers[hsIndex].Rooms = append(bp.Homeservers[hsIndex].Rooms, Room{Ref: sr.Ref})
+			}
+			room := &bp.Homeservers[hsIndex].Rooms[roomIndexes[hsName]]
+			room.Events = append(room.Events, events...)
+			return nil
+		}
+		for _, member := range sr.Members {
+			if err := addEvents(member, Invite(sr.Creator, member), Join(member)); err != nil {
+				return bp, err
+			}
+		}
+		for _, invitee := range sr.Invited {
+			if err := addEvents(invitee, Invite(sr.Creator, invitee)); err != nil {
+				return bp, err
+			}
+		}
+	}
+	// the rooms are now part of the homeservers, so they aren't added again if the blueprint is validated again
+	bp.Rooms = nil
+	return bp, nil
+}
+
+// userDomain returns the domain of the user ID `userID`, or "" if it has none.
+func userDomain(userID string) string {
+	i := strings.Index(userID, ":")
+	if i == -1 {
+		return ""
+	}
+	return userID[i+1:]
+}
+
+func normaliseRoom(hsName string, hsIndexes map[string]int, r Room) (Room, error) {
 	var err error
 	if r.Creator != "" {
 		r.Creator, err = normaliseUser(r.Creator, hsName)
@@ -163,16 +519,30 @@ func normaliseRoom(hsName string, r Room) (Room, error) {
 	} else if r.Ref == "" {
 		return r, fmt.Errorf("%s : room must have either a Ref or a Creator", hsName)
 	}
+	if len(r.Children) > 0 && r.Creator == "" {
+		return r, fmt.Errorf("%s : room %s must have a Creator to add children to it", hsName, r.Ref)
+	}
 	for i := range r.Events {
-		r.Events[i].Sender, err = normaliseUser(r.Events[i].Sender, hsName)
-		if err != nil {
-			return r, err
-		}
-		if r.Events[i].StateKey != nil && r.Events[i].Type == "m.room.member" {
-			skey, err := normaliseUser(*r.Events[i].StateKey, hsName)
+		// senders may be on homeservers made earlier, e.g to invite users to rooms on those homeservers, and
+		// the events are sent through their homeserver
+		sender := r.Events[i].Sender
+		if senderHS := userDomain(sender); senderHS == "" || hsIndexes[senderHS] >= hsIndexes[hsName] {
+			sender, err = normaliseUser(sender, hsName)
 			if err != nil {
 				return r, err
 			}
+		} else if _, ok := hsIndexes[senderHS]; !ok {
+			return r, fmt.Errorf("HS '%s' user '%s' is not on a homeserver in the blueprint", hsName, sender)
+		}
+		r.Events[i].Sender = sender
+		if r.Events[i].StateKey != nil && r.Events[i].Type == "m.room.member" {
+			skey := *r.Events[i].StateKey
+			if _, ok := hsIndexes[userDomain(skey)]; !ok {
+				skey, err = normaliseUser(skey, hsName)
+				if err != nil {
+					return r, err
+				}
+			}
 			r.Events[i].StateKey = &skey
 		}
 	}
@@ -195,22 +565,60 @@ func normaliseUser(u string, hsName string) (string, error) {
 }
 
 func normalizeApplicationService(as ApplicationService) (ApplicationService, error) {
-	hsToken := make([]byte, 32)
-	_, err := rand.Read(hsToken)
-	if err != nil {
-		return as, err
+	if as.ID == "" || as.SenderLocalpart == "" {
+		return as, fmt.Errorf("application service must have an ID and SenderLocalpart")
+	}
+	if as.HSToken == "" {
+		hsToken := make([]byte, 32)
+		_, err := rand.Read(hsToken)
+		if err != nil {
+			return as, err
+		}
+		as.HSToken = hex.EncodeToString(hsToken)
+		as.generatedHSToken = true
 	}
 
-	asToken := make([]byte, 32)
-	_, err = rand.Read(asToken)
-	if err != nil {
-		return as, err
+	if as.ASToken == "" {
+		asToken := make([]byte, 32)
+		_, err := rand.Read(asToken)
+		if err != nil {
+			return as, err
+		}
+		as.ASToken = hex.EncodeToString(asToken)
+		as.generatedASToken = true
 	}
 
-	as.HSToken = hex.EncodeToString(hsToken)
-	as.ASToken = hex.EncodeToString(asToken)
+	return as, nil
+}
+
+// HasFuncSteps returns true if any homeserver in the blueprint has a step with a Func.
+func HasFuncSteps(bp Blueprint) bool {
+	for _, hs := range bp.Homeservers {
+		for _, step := range hs.Steps {
+			if step.Func != nil {
+				return true
+			}
+		}
+	}
+	return false
+}
 
-	return as, err
+// WithoutGeneratedTokens returns a copy of the blueprint without the application service tokens generated by
+// Validate, which are different every time, so the blueprint can be compared with one validated in another run.
+func WithoutGeneratedTokens(bp Blueprint) Blueprint {
+	bp = copyBlueprint(bp)
+	for i := range bp.Homeservers {
+		for j := range bp.Homeservers[i].ApplicationServices {
+			as := &bp.Homeservers[i].ApplicationServices[j]
+			if as.generatedHSToken {
+				as.HSToken = ""
+			}
+			if as.generatedASToken {
+				as.ASToken = ""
+			}
+		}
+	}
+	return bp
 }
 
 // Ptr returns a pointer to `in`, because Go doesn't allow you to inline this.
@@ -0,0 +1,134 @@
+package b
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestWithoutGeneratedTokens(t *testing.T) {
+	bp := Blueprint{
+		Name: "as",
+		Homeservers: []Homeserver{
+			{
+				Name: "hs1",
+				ApplicationServices: []ApplicationService{
+					{ID: "generated", SenderLocalpart: "bot1"},
+					{ID: "fixed", SenderLocalpart: "bot2", HSToken: "hs_token", ASToken: "as_token"},
+				},
+			},
+		},
+	}
+	// as if validated in two runs, since Validate modifies the homeservers of the blueprint it is given
+	first := MustValidate(copyBlueprint(bp))
+	second := MustValidate(copyBlueprint(bp))
+	if first.Homeservers[0].ApplicationServices[0].ASToken == second.Homeservers[0].ApplicationServices[0].ASToken {
+		t.Fatalf("Validate generated the same token twice")
+	}
+	firstJSON, _ := json.Marshal(WithoutGeneratedTokens(first))
+	secondJSON, _ := json.Marshal(WithoutGeneratedTokens(second))
+	if string(firstJSON) != string(secondJSON) {
+		t.Errorf("blueprints validated twice differ without generated tokens:\n%s\n%s", firstJSON, secondJSON)
+	}
+	fixed := WithoutGeneratedTokens(first).Homeservers[0].ApplicationServices[1]
+	if fixed.HSToken != "hs_token" || fixed.ASToken != "as_token" {
+		t.Errorf("tokens given in the blueprint were removed: %+v", fixed)
+	}
+	if first.Homeservers[0].ApplicationServices[0].ASToken == "" {
+		t.Errorf("WithoutGeneratedTokens modified the blueprint it was given")
+	}
+}
+
+func TestValidateSpaceChildren(t *testing.T) {
+	room := func(ref string) Room {
+		return Room{Ref: ref, Creator: "@alice"}
+	}
+	testCases := []struct {
+		name    string
+		hs1     []Room
+		hs2     []Room
+		wantErr bool
+	}{
+		{
+			name: "child made after the space on the same homeserver",
+			hs1:  []Room{Space("@alice", "space", SpaceChild{Ref: "child"}), room("child")},
+		},
+		{
+			name: "child on an earlier homeserver",
+			hs1:  []Room{room("child")},
+			hs2:  []Room{Space("@alice", "space", SpaceChild{Ref: "child"})},
+		},
+		{
+			name:    "child on a later homeserver",
+			hs1:     []Room{Space("@alice", "space", SpaceChild{Ref: "child"})},
+			hs2:     []Room{room("child")},
+			wantErr: true,
+		},
+		{
+			name:    "child not in the blueprint",
+			hs1:     []Room{Space("@alice", "space", SpaceChild{Ref: "child"})},
+			wantErr: true,
+		},
+	}
+	for _, tc := range testCases {
+		_, err := Validate(Blueprint{
+			Name: "spaces",
+			Homeservers: []Homeserver{
+				{Name: "hs1", Users: []User{{Localpart: "@alice"}}, Rooms: tc.hs1},
+				{Name: "hs2", Users: []User{{Localpart: "@alice"}}, Rooms: tc.hs2},
+			},
+		})
+		if (err != nil) != tc.wantErr {
+			t.Errorf("%s: Validate returned error %v, want error=%v", tc.name, err, tc.wantErr)
+		}
+	}
+}
+
+func TestValidateTimestamps(t *testing.T) {
+	as := func() []ApplicationService {
+		return []ApplicationService{{ID: "as", SenderLocalpart: "bot"}}
+	}
+	event := func(sender string) []Room {
+		return []Room{{
+			Ref:     "room",
+			Creator: "@alice",
+			Events:  []Event{{Type: "m.room.message", Sender: sender, Timestamp: time.Unix(1000, 0)}},
+		}}
+	}
+	testCases := []struct {
+		name    string
+		hs1     Homeserver
+		hs2     Homeserver
+		wantErr bool
+	}{
+		{
+			name: "sender's homeserver has an application service",
+			hs1:  Homeserver{ApplicationServices: as(), Rooms: event("@alice")},
+		},
+		{
+			name:    "sender's homeserver has no application service",
+			hs1:     Homeserver{Rooms: event("@alice")},
+			wantErr: true,
+		},
+		{
+			name: "sender on an earlier homeserver with an application service",
+			hs1:  Homeserver{ApplicationServices: as()},
+			hs2:  Homeserver{Rooms: event("@alice:hs1")},
+		},
+		{
+			name:    "sender on an earlier homeserver without an application service",
+			hs2:     Homeserver{ApplicationServices: as(), Rooms: event("@alice:hs1")},
+			wantErr: true,
+		},
+	}
+	for _, tc := range testCases {
+		tc.hs1.Name = "hs1"
+		tc.hs1.Users = []User{{Localpart: "@alice"}}
+		tc.hs2.Name = "hs2"
+		tc.hs2.Users = []User{{Localpart: "@alice"}}
+		_, err := Validate(Blueprint{Name: "timestamps", Homeservers: []Homeserver{tc.hs1, tc.hs2}})
+		if (err != nil) != tc.wantErr {
+			t.Errorf("%s: got error %v, want error: %v", tc.name, err, tc.wantErr)
+		}
+	}
+}
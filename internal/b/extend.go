@@ -0,0 +1,230 @@
+package b
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"sync/atomic"
+)
+
+// The number of extensions with Func steps, which are never shared as functions can't be compared
+var funcExtensions uint64
+
+// MustExtend is Extend, but panics if the blueprints can't be combined, so it can be used inline, e.g
+//
+//	deployment := Deploy(t, b.MustExtend(b.BlueprintAlice, b.Blueprint{
+//		Homeservers: []b.Homeserver{
+//			{
+//				Name:  "hs1",
+//				Users: []b.User{{Localpart: "@bob"}},
+//				Rooms: []b.Room{{Ref: "alice_and_bob", Creator: "@alice", Events: ...}},
+//			},
+//		},
+//	}))
+func MustExtend(base Blueprint, extras ...Blueprint) Blueprint {
+	bp, err := Extend(base, extras...)
+	if err != nil {
+		panic("MustExtend: " + err.Error())
+	}
+	return bp
+}
+
+// Extend returns a copy of the validated blueprint `base` with the homeservers of `extras` merged into it.
+// The extras are written like any other blueprint but don't need a name. Homeservers with the same name
+// as one in the base have their users, rooms, application services and steps added to it, and rooms with
+// the same Ref as a room on that homeserver have their events and space children added to the end of it.
+// Other homeservers are added to the deployment.
+//
+// The copy is named after the base and a hash of the extras, so extending a blueprint the same way in
+// several tests shares one image, and any change to the extras builds a new one. Extras with Func steps
+// can't be hashed, so every call gets a blueprint of its own. Room creators and the
+// senders of added events must be users on their homeserver, the targets of added memberships must be
+// users in the blueprint, and rooms joined by Ref must be created somewhere in the blueprint.
+func Extend(base Blueprint, extras ...Blueprint) (Blueprint, error) {
+	bp := copyBlueprint(base)
+	hash := sha256.New()
+	for i, extra := range extras {
+		// hash before validating, as validation generates random application service tokens
+		data, err := json.Marshal(extra)
+		if err != nil {
+			return bp, fmt.Errorf("extension %d of %s: %w", i, base.Name, err)
+		}
+		hash.Write(data)
+		if HasFuncSteps(extra) {
+			fmt.Fprintf(hash, "func steps %d %d", os.Getpid(), atomic.AddUint64(&funcExtensions, 1))
+		}
+		extra = inOrderOf(copyBlueprint(extra), bp)
+		extra.Name = base.Name
+		if extra, err = validate(extra); err != nil {
+			return bp, fmt.Errorf("extension %d of %s: %w", i, base.Name, err)
+		}
+		if err = mergeBlueprint(&bp, extra); err != nil {
+			return bp, fmt.Errorf("extension %d of %s: %w", i, base.Name, err)
+		}
+	}
+	bp.Name = fmt.Sprintf("%s_ext_%s", base.Name, hex.EncodeToString(hash.Sum(nil))[:10])
+	if err := validateReferences(bp); err != nil {
+		return bp, fmt.Errorf("extension of %s: %w", base.Name, err)
+	}
+	return bp, nil
+}
+
+// inOrderOf returns `extra` with its homeservers in the order they will be in once merged into `bp`, adding
+// empty ones for the homeservers of `bp` which it doesn't extend. Validating it then sees every homeserver,
+// e.g so shared rooms can have members on homeservers of the base blueprint.
+func inOrderOf(extra, bp Blueprint) Blueprint {
+	extraHSes := make(map[string]Homeserver)
+	for _, hs := range extra.Homeservers {
+		extraHSes[hs.Name] = hs
+	}
+	var homeservers []Homeserver
+	for _, hs := range bp.Homeservers {
+		ehs, ok := extraHSes[hs.Name]
+		if !ok {
+			ehs = Homeserver{Name: hs.Name}
+		}
+		delete(extraHSes, hs.Name)
+		homeservers = append(homeservers, ehs)
+	}
+	for _, hs := range extra.Homeservers {
+		if _, ok := extraHSes[hs.Name]; ok {
+			homeservers = append(homeservers, hs)
+		}
+	}
+	extra.Homeservers = homeservers
+	return extra
+}
+
+// copyBlueprint copies the slices of the blueprint down to the events, so they can be appended to and
+// validated without changing the original, which is usually a package level variable.
+func copyBlueprint(bp Blueprint) Blueprint {
+	bp.KeepAccessTokensForUsers = append([]string(nil), bp.KeepAccessTokensForUsers...)
+	homeservers := make([]Homeserver, len(bp.Homeservers))
+	for i, hs := range bp.Homeservers {
+		hs.Users = append([]User(nil), hs.Users...)
+		hs.ApplicationServices = append([]ApplicationService(nil), hs.ApplicationServices...)
+		hs.Steps = append([]Step(nil), hs.Steps...)
+		rooms := make([]Room, len(hs.Rooms))
+		for j, r := range hs.Rooms {
+			r.Events = append([]Event(nil), r.Events...)
+			r.Children = append([]SpaceChild(nil), r.Children...)
+			rooms[j] = r
+		}
+		hs.Rooms = rooms
+		homeservers[i] = hs
+	}
+	bp.Homeservers = homeservers
+	return bp
+}
+
+func mergeBlueprint(bp *Blueprint, extra Blueprint) error {
+	bp.KeepAccessTokensForUsers = append(bp.KeepAccessTokensForUsers, extra.KeepAccessTokensForUsers...)
+	for _, ehs := range extra.Homeservers {
+		var hs *Homeserver
+		for i := range bp.Homeservers {
+			if bp.Homeservers[i].Name == ehs.Name {
+				hs = &bp.Homeservers[i]
+			}
+		}
+		if hs == nil {
+			bp.Homeservers = append(bp.Homeservers, ehs)
+			continue
+		}
+		if ehs.Image != "" || ehs.Compose != nil || len(ehs.Ports) > 0 {
+			return fmt.Errorf("HS %s already exists, so its image, compose file and ports can't be changed", ehs.Name)
+		}
+		for _, u := range ehs.Users {
+			for _, existing := range hs.Users {
+				if existing.Localpart == u.Localpart {
+					return fmt.Errorf("HS %s already has a user @%s", hs.Name, u.Localpart)
+				}
+			}
+			hs.Users = append(hs.Users, u)
+		}
+		for _, as := range ehs.ApplicationServices {
+			for _, existing := range hs.ApplicationServices {
+				if existing.ID == as.ID {
+					return fmt.Errorf("HS %s already has an application service %s", hs.Name, as.ID)
+				}
+			}
+			hs.ApplicationServices = append(hs.ApplicationServices, as)
+		}
+		hs.Steps = append(hs.Steps, ehs.Steps...)
+		for _, r := range ehs.Rooms {
+			existing := -1
+			for i := range hs.Rooms {
+				if r.Ref != "" && hs.Rooms[i].Ref == r.Ref {
+					existing = i
+				}
+			}
+			if existing == -1 {
+				hs.Rooms = append(hs.Rooms, r)
+				continue
+			}
+			if r.Creator != "" || r.CreateRoom != nil || r.Version != "" || r.CreationContent != nil {
+				return fmt.Errorf("HS %s already has a room %s, so it can only be given more events", hs.Name, r.Ref)
+			}
+			hs.Rooms[existing].Events = append(hs.Rooms[existing].Events, r.Events...)
+			hs.Rooms[existing].Children = append(hs.Rooms[existing].Children, r.Children...)
+		}
+	}
+	return nil
+}
+
+// validateReferences checks that the users and rooms mentioned by the blueprint exist in it, and that the
+// children of spaces are made before they are added.
+func validateReferences(bp Blueprint) error {
+	users := make(map[string]bool)
+	createdRooms := make(map[string]bool)
+	for _, hs := range bp.Homeservers {
+		for _, u := range hs.Users {
+			users["@"+u.Localpart+":"+hs.Name] = true
+		}
+		for _, as := range hs.ApplicationServices {
+			users["@"+strings.TrimPrefix(as.SenderLocalpart, "@")+":"+hs.Name] = true
+		}
+		for _, r := range hs.Rooms {
+			if r.Ref != "" && r.Creator != "" {
+				createdRooms[r.Ref] = true
+			}
+		}
+	}
+	for _, hs := range bp.Homeservers {
+		for _, u := range hs.Users {
+			for _, ad := range u.RoomAccountData {
+				if !createdRooms[ad.Room] {
+					return fmt.Errorf("HS %s user @%s has account data in room %s, which isn't in the blueprint", hs.Name, u.Localpart, ad.Room)
+				}
+			}
+			for _, tag := range u.Tags {
+				if !createdRooms[tag.Room] {
+					return fmt.Errorf("HS %s user @%s has a tag on room %s, which isn't in the blueprint", hs.Name, u.Localpart, tag.Room)
+				}
+			}
+		}
+		for _, r := range hs.Rooms {
+			name := r.Ref
+			if name == "" {
+				name = "created by " + r.Creator
+			}
+			if r.Creator != "" && !users[r.Creator] {
+				return fmt.Errorf("HS %s room %s: creator %s is not a user in the blueprint", hs.Name, name, r.Creator)
+			}
+			if r.Creator == "" && !createdRooms[r.Ref] {
+				return fmt.Errorf("HS %s room %s: no homeserver in the blueprint creates it", hs.Name, name)
+			}
+			for _, ev := range r.Events {
+				if !users[ev.Sender] {
+					return fmt.Errorf("HS %s room %s: %s event sender %s is not a user in the blueprint", hs.Name, name, ev.Type, ev.Sender)
+				}
+				if ev.Type == "m.room.member" && ev.StateKey != nil && !users[*ev.StateKey] {
+					return fmt.Errorf("HS %s room %s: member %s is not a user in the blueprint", hs.Name, name, *ev.StateKey)
+				}
+			}
+		}
+	}
+	return validateSpaceChildren(bp)
+}
@@ -0,0 +1,228 @@
+package b
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestExtend(t *testing.T) {
+	base := MustValidate(Blueprint{
+		Name: "base",
+		Homeservers: []Homeserver{
+			{
+				Name:  "hs1",
+				Users: []User{{Localpart: "@alice"}},
+				Rooms: []Room{{Ref: "room", Creator: "@alice"}},
+			},
+		},
+	})
+	testCases := []struct {
+		name          string
+		extra         Blueprint
+		wantErr       string
+		wantUsers     []string
+		wantRoomEvent int // the number of events in "room"
+		wantHSes      int
+	}{
+		{
+			name: "users are added to existing homeservers",
+			extra: Blueprint{Homeservers: []Homeserver{
+				{Name: "hs1", Users: []User{{Localpart: "@bob"}}},
+			}},
+			wantUsers:     []string{"alice", "bob"},
+			wantRoomEvent: 0,
+			wantHSes:      1,
+		},
+		{
+			name: "events are added to rooms with the same ref",
+			extra: Blueprint{Homeservers: []Homeserver{
+				{
+					Name:  "hs1",
+					Rooms: []Room{{Ref: "room", Events: []Event{{Type: "m.room.message", Sender: "@alice"}}}},
+				},
+			}},
+			wantUsers:     []string{"alice"},
+			wantRoomEvent: 1,
+			wantHSes:      1,
+		},
+		{
+			name: "other homeservers are added",
+			extra: Blueprint{Homeservers: []Homeserver{
+				{Name: "hs2", Users: []User{{Localpart: "@bob"}}},
+			}},
+			wantUsers: []string{"alice"},
+			wantHSes:  2,
+		},
+		{
+			name: "duplicate user",
+			extra: Blueprint{Homeservers: []Homeserver{
+				{Name: "hs1", Users: []User{{Localpart: "@alice"}}},
+			}},
+			wantErr: "already has a user @alice",
+		},
+		{
+			name: "existing room can't be recreated",
+			extra: Blueprint{Homeservers: []Homeserver{
+				{Name: "hs1", Rooms: []Room{{Ref: "room", Creator: "@alice"}}},
+			}},
+			wantErr: "can only be given more events",
+		},
+		{
+			name: "existing homeserver can't change image",
+			extra: Blueprint{Homeservers: []Homeserver{
+				{Name: "hs1", Image: "other"},
+			}},
+			wantErr: "image, compose file and ports can't be changed",
+		},
+		{
+			name: "unknown sender",
+			extra: Blueprint{Homeservers: []Homeserver{
+				{
+					Name:  "hs1",
+					Rooms: []Room{{Ref: "room", Events: []Event{{Type: "m.room.message", Sender: "@zoe"}}}},
+				},
+			}},
+			wantErr: "sender @zoe:hs1 is not a user in the blueprint",
+		},
+	}
+	for _, tc := range testCases {
+		bp, err := Extend(base, tc.extra)
+		if tc.wantErr != "" {
+			if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+				t.Errorf("%s: Extend returned %v, want an error containing %q", tc.name, err, tc.wantErr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: Extend returned %s", tc.name, err)
+			continue
+		}
+		if len(bp.Homeservers) != tc.wantHSes {
+			t.Errorf("%s: got %d homeservers, want %d", tc.name, len(bp.Homeservers), tc.wantHSes)
+			continue
+		}
+		var users []string
+		for _, u := range bp.Homeservers[0].Users {
+			users = append(users, u.Localpart)
+		}
+		if strings.Join(users, ",") != strings.Join(tc.wantUsers, ",") {
+			t.Errorf("%s: HS hs1 has users %v, want %v", tc.name, users, tc.wantUsers)
+		}
+		if got := len(bp.Homeservers[0].Rooms[0].Events); got != tc.wantRoomEvent {
+			t.Errorf("%s: room has %d events, want %d", tc.name, got, tc.wantRoomEvent)
+		}
+		// the base is left alone
+		if got := len(base.Homeservers[0].Users); got != 1 {
+			t.Errorf("%s: base HS hs1 has %d users after extending it, want 1", tc.name, got)
+		}
+		if got := len(base.Homeservers[0].Rooms[0].Events); got != 0 {
+			t.Errorf("%s: base room has %d events after extending it, want 0", tc.name, got)
+		}
+	}
+}
+
+func TestExtendName(t *testing.T) {
+	base := MustValidate(Blueprint{
+		Name:        "base",
+		Homeservers: []Homeserver{{Name: "hs1", Users: []User{{Localpart: "@alice"}}}},
+	})
+	bob := Blueprint{
+		Homeservers: []Homeserver{{Name: "hs1", Users: []User{{Localpart: "@bob"}}}},
+	}
+	charlie := Blueprint{
+		Homeservers: []Homeserver{{Name: "hs1", Users: []User{{Localpart: "@charlie"}}}},
+	}
+	withFunc := func() Blueprint {
+		return Blueprint{
+			Homeservers: []Homeserver{{Name: "hs1", Steps: []Step{{Func: func(string, map[string]string) error { return nil }}}}},
+		}
+	}
+	testCases := []struct {
+		name      string
+		a, b      Blueprint
+		wantEqual bool
+	}{
+		{name: "same extras", a: bob, b: bob, wantEqual: true},
+		{name: "different extras", a: bob, b: charlie},
+		// the functions may do different things, e.g if they capture different variables
+		{name: "func steps", a: withFunc(), b: withFunc()},
+	}
+	for _, tc := range testCases {
+		a := MustExtend(base, tc.a)
+		b := MustExtend(base, tc.b)
+		if equal := a.Name == b.Name; equal != tc.wantEqual {
+			t.Errorf("%s: extended blueprints are named %s and %s, want equal=%v", tc.name, a.Name, b.Name, tc.wantEqual)
+		}
+	}
+}
+
+func TestExtendSharedRoomWithBaseHomeservers(t *testing.T) {
+	base := MustValidate(Blueprint{
+		Name: "base",
+		Homeservers: []Homeserver{
+			{Name: "hs1", Users: []User{{Localpart: "@alice"}}},
+			{Name: "hs2", Users: []User{{Localpart: "@bob"}}},
+		},
+	})
+	testCases := []struct {
+		name    string
+		extra   Blueprint
+		wantErr string
+	}{
+		{
+			name: "base homeservers",
+			extra: Blueprint{Rooms: []SharedRoom{
+				{Ref: "shared", Creator: "@alice:hs1", Members: []string{"@bob:hs2"}},
+			}},
+		},
+		{
+			name: "base and new homeservers",
+			extra: Blueprint{
+				Homeservers: []Homeserver{{Name: "hs3", Users: []User{{Localpart: "@charlie"}}}},
+				Rooms: []SharedRoom{
+					{Ref: "shared", Creator: "@alice:hs1", Members: []string{"@bob:hs2", "@charlie:hs3"}},
+				},
+			},
+		},
+		{
+			name: "creator on a homeserver listed after a member",
+			extra: Blueprint{Rooms: []SharedRoom{
+				{Ref: "shared", Creator: "@bob:hs2", Members: []string{"@alice:hs1"}},
+			}},
+			wantErr: "must be on a homeserver listed after hs2",
+		},
+		{
+			name: "unknown member",
+			extra: Blueprint{Rooms: []SharedRoom{
+				{Ref: "shared", Creator: "@alice:hs1", Members: []string{"@zoe:hs2"}},
+			}},
+			wantErr: "member @zoe:hs2 is not a user in the blueprint",
+		},
+	}
+	for _, tc := range testCases {
+		bp, err := Extend(base, tc.extra)
+		if tc.wantErr != "" {
+			if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+				t.Errorf("%s: Extend returned %v, want an error containing %q", tc.name, err, tc.wantErr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: Extend returned %s", tc.name, err)
+			continue
+		}
+		// every member's homeserver joins the room
+		for _, hs := range bp.Homeservers {
+			found := false
+			for _, r := range hs.Rooms {
+				found = found || r.Ref == "shared"
+			}
+			if !found {
+				t.Errorf("%s: HS %s has no shared room, has %+v", tc.name, hs.Name, hs.Rooms)
+			}
+		}
+		if got := len(bp.Homeservers[0].Users); got != 1 {
+			t.Errorf("%s: HS hs1 has %d users, want its 1 user", tc.name, got)
+		}
+	}
+}
@@ -0,0 +1,142 @@
+package b
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// The extensions of blueprint files, in the order they are looked for.
+var blueprintFileExtensions = []string{".yaml", ".yml", ".json"}
+
+// LoadBlueprintFile loads a blueprint from a YAML or JSON file, so blueprints can be written without Go.
+// Keys are the names of the fields of Blueprint and the types it contains, matched case-insensitively, e.g
+//
+//	name: alice_and_bob
+//	homeservers:
+//	  - name: hs1
+//	    users:
+//	      - localpart: "@alice"
+//	        displayName: Alice
+//
+// The blueprint is named after the file, without its extension, unless it has a name. Unknown keys are
+// errors, so typos aren't silently ignored, and the blueprint is validated like MustValidate.
+func LoadBlueprintFile(path string) (Blueprint, error) {
+	var bp Blueprint
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return bp, err
+	}
+	ext := filepath.Ext(path)
+	if ext != ".json" {
+		// decode YAML generically and go via JSON, so both formats share the JSON field matching
+		var generic interface{}
+		if err = yaml.Unmarshal(data, &generic); err != nil {
+			return bp, fmt.Errorf("%s: %w", path, err)
+		}
+		if data, err = json.Marshal(generic); err != nil {
+			return bp, fmt.Errorf("%s: %w", path, err)
+		}
+	}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err = dec.Decode(&bp); err != nil {
+		return bp, fmt.Errorf("%s: %w", path, err)
+	}
+	name := strings.TrimSuffix(filepath.Base(path), ext)
+	if bp.Name == "" {
+		bp.Name = name
+	}
+	if err = validateFile(bp); err != nil {
+		return bp, fmt.Errorf("%s: %w", path, err)
+	}
+	if bp, err = Validate(bp); err != nil {
+		return bp, fmt.Errorf("%s: %w", path, err)
+	}
+	return bp, nil
+}
+
+// LoadBlueprint loads the blueprint `name` from `dir`, from the first of $name.yaml, $name.yml and $name.json
+// which exists. See LoadBlueprintFile.
+func LoadBlueprint(dir, name string) (Blueprint, error) {
+	for _, ext := range blueprintFileExtensions {
+		path := filepath.Join(dir, name+ext)
+		if _, err := os.Stat(path); err == nil {
+			return LoadBlueprintFile(path)
+		}
+	}
+	return Blueprint{}, fmt.Errorf("no blueprint file named %s in %s", name, dir)
+}
+
+// MustLoadBlueprint is LoadBlueprint, but panics if the blueprint can't be loaded, for use in package
+// level variables like the blueprints written in Go, e.g `var bp = b.MustLoadBlueprint("blueprints", "alice")`.
+func MustLoadBlueprint(dir, name string) Blueprint {
+	bp, err := LoadBlueprint(dir, name)
+	if err != nil {
+		panic("MustLoadBlueprint: " + err.Error())
+	}
+	return bp
+}
+
+// LoadBlueprints loads every blueprint file in `dir`, in name order. See LoadBlueprintFile.
+func LoadBlueprints(dir string) ([]Blueprint, error) {
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var paths []string
+	for _, e := range entries {
+		for _, ext := range blueprintFileExtensions {
+			if !e.IsDir() && filepath.Ext(e.Name()) == ext {
+				paths = append(paths, filepath.Join(dir, e.Name()))
+			}
+		}
+	}
+	sort.Strings(paths)
+	names := make(map[string]string)
+	var bps []Blueprint
+	for _, path := range paths {
+		bp, err := LoadBlueprintFile(path)
+		if err != nil {
+			return nil, err
+		}
+		if other, ok := names[bp.Name]; ok {
+			return nil, fmt.Errorf("%s: blueprint %s is also defined by %s", path, bp.Name, other)
+		}
+		names[bp.Name] = path
+		bps = append(bps, bp)
+	}
+	return bps, nil
+}
+
+// validateFile checks the parts of a blueprint which the blueprints written in Go get right by construction.
+func validateFile(bp Blueprint) error {
+	if len(bp.Homeservers) == 0 {
+		return fmt.Errorf("blueprint %s has no homeservers", bp.Name)
+	}
+	hsNames := make(map[string]bool)
+	for _, hs := range bp.Homeservers {
+		if hs.Name == "" {
+			return fmt.Errorf("blueprint %s has a homeserver without a name", bp.Name)
+		}
+		if hsNames[hs.Name] {
+			return fmt.Errorf("blueprint %s has more than one homeserver named %s", bp.Name, hs.Name)
+		}
+		hsNames[hs.Name] = true
+		for _, r := range hs.Rooms {
+			for _, ev := range r.Events {
+				if ev.Type == "" || ev.Sender == "" {
+					return fmt.Errorf("HS %s has an event without a type or sender", hs.Name)
+				}
+			}
+		}
+	}
+	return nil
+}
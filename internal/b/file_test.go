@@ -0,0 +1,85 @@
+package b
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLoadBlueprintsInRepo(t *testing.T) {
+	bps, err := LoadBlueprints(filepath.Join("..", "..", "blueprints"))
+	if err != nil {
+		t.Fatalf("LoadBlueprints returned %s", err)
+	}
+	var names []string
+	for _, bp := range bps {
+		names = append(names, bp.Name)
+	}
+	if got, want := strings.Join(names, ","), "alice_and_bob,federated_public_room"; got != want {
+		t.Fatalf("loaded blueprints %s, want %s", got, want)
+	}
+	// the shared room is added to the rooms of the creator's homeserver when validated
+	if rooms := bps[1].Homeservers[0].Rooms; len(rooms) != 2 {
+		t.Errorf("hs1 of federated_public_room has %d rooms, want 2", len(rooms))
+	}
+	if bp := MustLoadBlueprint(filepath.Join("..", "..", "blueprints"), "alice_and_bob"); bp.Homeservers[0].Users[1].DisplayName != "Bob" {
+		t.Errorf("alice_and_bob has users %+v, want Bob to have his display name", bp.Homeservers[0].Users)
+	}
+}
+
+func TestLoadBlueprintFile(t *testing.T) {
+	testCases := []struct {
+		file     string
+		contents string
+		wantName string
+		wantErr  string
+	}{
+		{
+			file:     "named_after_file.yml",
+			contents: "homeservers:\n  - name: hs1\n",
+			wantName: "named_after_file",
+		},
+		{
+			file:     "file.json",
+			contents: `{"name": "named_in_file", "homeservers": [{"name": "hs1"}]}`,
+			wantName: "named_in_file",
+		},
+		{
+			file:     "typo.yaml",
+			contents: "homeservers:\n  - name: hs1\n    user: []\n",
+			wantErr:  `unknown field "user"`,
+		},
+		{
+			file:     "empty.yaml",
+			contents: "name: empty\n",
+			wantErr:  "has no homeservers",
+		},
+		{
+			file:     "event.yaml",
+			contents: "homeservers:\n  - name: hs1\n    rooms:\n      - events:\n          - type: m.room.message\n",
+			wantErr:  "event without a type or sender",
+		},
+	}
+	dir := t.TempDir()
+	for _, tc := range testCases {
+		path := filepath.Join(dir, tc.file)
+		if err := os.WriteFile(path, []byte(tc.contents), 0644); err != nil {
+			t.Fatalf("failed to write %s: %s", tc.file, err)
+		}
+		bp, err := LoadBlueprintFile(path)
+		if tc.wantErr != "" {
+			if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+				t.Errorf("%s: LoadBlueprintFile returned %v, want an error containing %q", tc.file, err, tc.wantErr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: LoadBlueprintFile returned %s", tc.file, err)
+			continue
+		}
+		if bp.Name != tc.wantName {
+			t.Errorf("%s: blueprint is named %s, want %s", tc.file, bp.Name, tc.wantName)
+		}
+	}
+}
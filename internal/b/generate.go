@@ -0,0 +1,87 @@
+package b
+
+import "fmt"
+
+// GenerateOpts sizes a blueprint made by GenerateBlueprint.
+type GenerateOpts struct {
+	// The number of users on the homeserver, named @user0, @user1 and so on.
+	Users int
+	// The number of rooms each user creates.
+	RoomsPerUser int
+	// The number of messages sent in each room, by its members in turn.
+	MessagesPerRoom int
+	// The number of members of each room, including its creator. The creator is joined by the users after
+	// them in order. Defaults to 2, and is capped at Users.
+	MembersPerRoom int
+	// The name of the homeserver. Defaults to hs1.
+	HSName string
+}
+
+// GenerateBlueprint returns a blueprint of a single homeserver with `opts.Users` users, who each create
+// `opts.RoomsPerUser` public rooms and send `opts.MessagesPerRoom` messages between the members of each room,
+// for load and pagination tests which need a large dataset, e.g
+//
+//	deployment := Deploy(t, b.GenerateBlueprint(b.GenerateOpts{Users: 50, RoomsPerUser: 10, MessagesPerRoom: 100}))
+//
+// The blueprint only depends on the options, so it is the same every time it is generated and is named after
+// them, so it can be cached. Room i created by @userN has the Ref "userN_room_i". Rooms are created in parallel,
+// so large datasets are built faster than rooms with many events.
+func GenerateBlueprint(opts GenerateOpts) Blueprint {
+	if opts.HSName == "" {
+		opts.HSName = "hs1"
+	}
+	if opts.MembersPerRoom == 0 {
+		opts.MembersPerRoom = 2
+	}
+	if opts.MembersPerRoom > opts.Users {
+		opts.MembersPerRoom = opts.Users
+	}
+	users := make([]User, opts.Users)
+	for i := range users {
+		users[i] = User{
+			Localpart:   fmt.Sprintf("@user%d", i),
+			DisplayName: fmt.Sprintf("User %d", i),
+		}
+	}
+	var rooms []Room
+	for u := range users {
+		for r := 0; r < opts.RoomsPerUser; r++ {
+			members := make([]string, opts.MembersPerRoom)
+			for m := range members {
+				members[m] = users[(u+m)%len(users)].Localpart
+			}
+			var events []Event
+			for _, member := range members[1:] {
+				events = append(events, Event{
+					Type:     "m.room.member",
+					StateKey: Ptr(member),
+					Content: map[string]interface{}{
+						"membership": "join",
+					},
+					Sender: member,
+				})
+			}
+			events = append(events, manyMessages(members, opts.MessagesPerRoom)...)
+			rooms = append(rooms, Room{
+				Ref:     fmt.Sprintf("user%d_room_%d", u, r),
+				Creator: members[0],
+				CreateRoom: map[string]interface{}{
+					"preset": "public_chat",
+				},
+				Events: events,
+			})
+		}
+	}
+	return MustValidate(Blueprint{
+		Name: fmt.Sprintf(
+			"generated_%s_u%d_r%d_m%d_j%d", opts.HSName, opts.Users, opts.RoomsPerUser, opts.MessagesPerRoom, opts.MembersPerRoom,
+		),
+		Homeservers: []Homeserver{
+			{
+				Name:  opts.HSName,
+				Users: users,
+				Rooms: rooms,
+			},
+		},
+	})
+}
@@ -0,0 +1,76 @@
+package b
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestGenerateBlueprint(t *testing.T) {
+	testCases := []struct {
+		opts             GenerateOpts
+		wantName         string
+		wantUsers        int
+		wantRooms        int
+		wantEventsInRoom int
+		wantMembers      []string // of the first room
+	}{
+		{
+			opts:             GenerateOpts{Users: 3, RoomsPerUser: 2, MessagesPerRoom: 5},
+			wantName:         "generated_hs1_u3_r2_m5_j2",
+			wantUsers:        3,
+			wantRooms:        6,
+			wantEventsInRoom: 1 + 5,
+			wantMembers:      []string{"@user0:hs1", "@user1:hs1"},
+		},
+		{
+			opts:             GenerateOpts{Users: 4, RoomsPerUser: 1, MessagesPerRoom: 2, MembersPerRoom: 3, HSName: "hs2"},
+			wantName:         "generated_hs2_u4_r1_m2_j3",
+			wantUsers:        4,
+			wantRooms:        4,
+			wantEventsInRoom: 2 + 2,
+			wantMembers:      []string{"@user0:hs2", "@user1:hs2", "@user2:hs2"},
+		},
+		{
+			// members are capped at the number of users
+			opts:             GenerateOpts{Users: 1, RoomsPerUser: 1, MembersPerRoom: 5},
+			wantName:         "generated_hs1_u1_r1_m0_j1",
+			wantUsers:        1,
+			wantRooms:        1,
+			wantEventsInRoom: 0,
+			wantMembers:      []string{"@user0:hs1"},
+		},
+	}
+	for _, tc := range testCases {
+		bp := GenerateBlueprint(tc.opts)
+		if bp.Name != tc.wantName {
+			t.Errorf("%+v: got name %s want %s", tc.opts, bp.Name, tc.wantName)
+		}
+		hs := bp.Homeservers[0]
+		if len(hs.Users) != tc.wantUsers {
+			t.Errorf("%+v: got %d users want %d", tc.opts, len(hs.Users), tc.wantUsers)
+		}
+		if len(hs.Rooms) != tc.wantRooms {
+			t.Fatalf("%+v: got %d rooms want %d", tc.opts, len(hs.Rooms), tc.wantRooms)
+		}
+		room := hs.Rooms[0]
+		if room.Ref != "user0_room_0" {
+			t.Errorf("%+v: got ref %s want user0_room_0", tc.opts, room.Ref)
+		}
+		if len(room.Events) != tc.wantEventsInRoom {
+			t.Errorf("%+v: got %d events want %d", tc.opts, len(room.Events), tc.wantEventsInRoom)
+		}
+		members := []string{room.Creator}
+		for _, ev := range room.Events {
+			if ev.Type == "m.room.member" {
+				members = append(members, *ev.StateKey)
+			}
+		}
+		if !reflect.DeepEqual(members, tc.wantMembers) {
+			t.Errorf("%+v: got members %v want %v", tc.opts, members, tc.wantMembers)
+		}
+		// the same options always generate the same blueprint
+		if again := GenerateBlueprint(tc.opts); !reflect.DeepEqual(again, bp) {
+			t.Errorf("%+v: generated a different blueprint the second time", tc.opts)
+		}
+	}
+}
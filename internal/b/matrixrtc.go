@@ -0,0 +1,46 @@
+package b
+
+import "time"
+
+// CallMemberStateKey returns the state key of the m.call.member event for `deviceID` of `userID`, as used by
+// MatrixRTC (MSC4143). The leading underscore stops the state key being restricted to `userID` by servers.
+func CallMemberStateKey(userID, deviceID string) string {
+	return "_" + userID + "_" + deviceID
+}
+
+// CallMember returns an m.call.member state event (MSC3401/MSC4143) for `deviceID` of `userID` joining the
+// room-scoped call `callID` using LiveKit. The membership expires `expires` after the event is sent, unless it is
+// sent again. Set the Sender to `userID` when using it in a blueprint.
+func CallMember(userID, deviceID, callID string, expires time.Duration) Event {
+	focus := map[string]interface{}{
+		"type":                "livekit",
+		"livekit_service_url": "https://livekit.example.org",
+		"livekit_alias":       callID,
+	}
+	return Event{
+		Type:     "m.call.member",
+		StateKey: Ptr(CallMemberStateKey(userID, deviceID)),
+		Content: map[string]interface{}{
+			"application": "m.call",
+			"call_id":     callID,
+			"scope":       "m.room",
+			"device_id":   deviceID,
+			"expires":     expires.Milliseconds(),
+			"focus_active": map[string]interface{}{
+				"type":            "livekit",
+				"focus_selection": "oldest_membership",
+			},
+			"foci_preferred": []interface{}{focus},
+		},
+	}
+}
+
+// CallMemberLeave returns an m.call.member state event for `deviceID` of `userID` leaving the call, which
+// is represented by empty content.
+func CallMemberLeave(userID, deviceID string) Event {
+	return Event{
+		Type:     "m.call.member",
+		StateKey: Ptr(CallMemberStateKey(userID, deviceID)),
+		Content:  map[string]interface{}{},
+	}
+}
@@ -0,0 +1,55 @@
+package b
+
+// Join returns an event for blueprints which joins `user` to the room.
+func Join(user string) Event {
+	return membership(user, user, "join")
+}
+
+// Leave returns an event for blueprints which makes `user` leave the room. Use it after Join to start a test
+// with the user having left the room.
+func Leave(user string) Event {
+	return membership(user, user, "leave")
+}
+
+// Invite returns an event for blueprints where `sender` invites `target` to the room.
+func Invite(sender, target string) Event {
+	return membership(sender, target, "invite")
+}
+
+// Kick returns an event for blueprints where `sender` kicks `target` from the room.
+func Kick(sender, target string) Event {
+	return membership(sender, target, "leave")
+}
+
+// Ban returns an event for blueprints where `sender` bans `target` from the room for `reason`, which may be empty.
+func Ban(sender, target, reason string) Event {
+	ev := membership(sender, target, "ban")
+	if reason != "" {
+		ev.Content["reason"] = reason
+	}
+	return ev
+}
+
+// Knock returns an event for blueprints where `user` knocks on the room. The room must allow knocking, i.e
+// have the join rule "knock" and a room version which supports it, e.g
+//
+//	Room{
+//		Creator:    "@alice",
+//		Version:    "7",
+//		CreateRoom: map[string]interface{}{"initial_state": []map[string]interface{}{{"type": "m.room.join_rules", "content": map[string]interface{}{"join_rule": "knock"}}}},
+//		Events:     []Event{Knock("@bob")},
+//	}
+func Knock(user string) Event {
+	return membership(user, user, "knock")
+}
+
+func membership(sender, target, membership string) Event {
+	return Event{
+		Type:     "m.room.member",
+		Sender:   sender,
+		StateKey: Ptr(target),
+		Content: map[string]interface{}{
+			"membership": membership,
+		},
+	}
+}
@@ -0,0 +1,52 @@
+package b
+
+// RecommendationBan is the only recommendation defined for policy rules, and means the entity should be banned.
+const RecommendationBan = "m.ban"
+
+// PolicyRuleUser returns an m.policy.rule.user state event which recommends `recommendation` for users matching
+// the glob `entity`. Set the Sender when using it in a blueprint.
+func PolicyRuleUser(entity, recommendation, reason string) Event {
+	return policyRule("m.policy.rule.user", entity, recommendation, reason)
+}
+
+// PolicyRuleRoom returns an m.policy.rule.room state event which recommends `recommendation` for rooms matching
+// the glob `entity`. Set the Sender when using it in a blueprint.
+func PolicyRuleRoom(entity, recommendation, reason string) Event {
+	return policyRule("m.policy.rule.room", entity, recommendation, reason)
+}
+
+// PolicyRuleServer returns an m.policy.rule.server state event which recommends `recommendation` for servers
+// matching the glob `entity`. Set the Sender when using it in a blueprint.
+func PolicyRuleServer(entity, recommendation, reason string) Event {
+	return policyRule("m.policy.rule.server", entity, recommendation, reason)
+}
+
+// PolicyListRoom returns a room for use in blueprints which is a policy list (MSC2313) created by `creator`
+// and containing `rules`, which are sent by `creator`.
+func PolicyListRoom(creator string, rules ...Event) Room {
+	events := make([]Event, len(rules))
+	for i, rule := range rules {
+		rule.Sender = creator
+		events[i] = rule
+	}
+	return Room{
+		Creator: creator,
+		CreateRoom: map[string]interface{}{
+			"preset": "private_chat",
+		},
+		Events: events,
+	}
+}
+
+func policyRule(eventType, entity, recommendation, reason string) Event {
+	return Event{
+		Type: eventType,
+		// the state key is opaque, but must be unique per entity to avoid rules replacing each other
+		StateKey: Ptr("rule:" + entity),
+		Content: map[string]interface{}{
+			"entity":         entity,
+			"recommendation": recommendation,
+			"reason":         reason,
+		},
+	}
+}
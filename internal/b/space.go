@@ -0,0 +1,70 @@
+package b
+
+// Space returns a space for blueprints which is created by `creator` and has the rooms in the blueprint with
+// the Refs of `children` as its children, e.g
+//
+//	Rooms: []Room{
+//		Space("@alice", "space", SpaceChild{Ref: "general", Suggested: true}, SpaceChild{Ref: "random"}),
+//		{Ref: "general", Creator: "@alice"},
+//		{Ref: "random", Creator: "@alice"},
+//	}
+//
+// Children are added once every room on the space's homeserver is made, so they must be on that homeserver
+// or one listed before it in the blueprint.
+func Space(creator, ref string, children ...SpaceChild) Room {
+	return Room{
+		Ref:     ref,
+		Creator: creator,
+		CreateRoom: map[string]interface{}{
+			"preset": "public_chat",
+		},
+		CreationContent: map[string]interface{}{
+			"type": "m.space",
+		},
+		Children: children,
+	}
+}
+
+// BlueprintSpace contains a homeserver with 2 users, and a public space made by alice with 2 child rooms and
+// a subspace with 1 child room, all of which bob has joined:
+//
+//	space
+//	├── general (suggested)
+//	├── random
+//	└── subspace
+//	    └── nested
+var BlueprintSpace = MustValidate(Blueprint{
+	Name: "space",
+	Homeservers: []Homeserver{
+		{
+			Name: "hs1",
+			Users: []User{
+				{
+					Localpart:   "@alice",
+					DisplayName: "Alice",
+				},
+				{
+					Localpart:   "@bob",
+					DisplayName: "Bob",
+				},
+			},
+			Rooms: []Room{
+				joinedByBob(Space("@alice", "space",
+					SpaceChild{Ref: "general", Suggested: true, Order: "a"},
+					SpaceChild{Ref: "random", Order: "b"},
+					SpaceChild{Ref: "subspace", Order: "c"},
+				)),
+				joinedByBob(Room{Ref: "general", Creator: "@alice", CreateRoom: map[string]interface{}{"preset": "public_chat", "name": "General"}}),
+				joinedByBob(Room{Ref: "random", Creator: "@alice", CreateRoom: map[string]interface{}{"preset": "public_chat", "name": "Random"}}),
+				joinedByBob(Space("@alice", "subspace", SpaceChild{Ref: "nested"})),
+				joinedByBob(Room{Ref: "nested", Creator: "@alice", CreateRoom: map[string]interface{}{"preset": "public_chat", "name": "Nested"}}),
+			},
+		},
+	},
+})
+
+// joinedByBob returns the room with bob joining it once it is made.
+func joinedByBob(r Room) Room {
+	r.Events = append(r.Events, Join("@bob"))
+	return r
+}
@@ -0,0 +1,84 @@
+package b
+
+import "time"
+
+// VoIPVersion is the version of the VoIP signalling events produced by the Call* builders.
+const VoIPVersion = "1"
+
+// CallInvite returns an m.call.invite event for `callID` offering `sdp`, which expires after `lifetime`.
+// `partyID` identifies the sending device in the call. Set the Sender when using it in a blueprint.
+func CallInvite(callID, partyID, sdp string, lifetime time.Duration) Event {
+	return Event{
+		Type: "m.call.invite",
+		Content: map[string]interface{}{
+			"call_id":  callID,
+			"party_id": partyID,
+			"version":  VoIPVersion,
+			"lifetime": lifetime.Milliseconds(),
+			"offer": map[string]interface{}{
+				"type": "offer",
+				"sdp":  sdp,
+			},
+		},
+	}
+}
+
+// CallAnswer returns an m.call.answer event for `callID` answering with `sdp`.
+func CallAnswer(callID, partyID, sdp string) Event {
+	return Event{
+		Type: "m.call.answer",
+		Content: map[string]interface{}{
+			"call_id":  callID,
+			"party_id": partyID,
+			"version":  VoIPVersion,
+			"answer": map[string]interface{}{
+				"type": "answer",
+				"sdp":  sdp,
+			},
+		},
+	}
+}
+
+// CallCandidate is a single ICE candidate in an m.call.candidates event.
+type CallCandidate struct {
+	Candidate     string
+	SDPMid        string
+	SDPMLineIndex int
+}
+
+// CallCandidates returns an m.call.candidates event for `callID` containing `candidates`.
+func CallCandidates(callID, partyID string, candidates ...CallCandidate) Event {
+	cs := make([]interface{}, len(candidates))
+	for i, c := range candidates {
+		cs[i] = map[string]interface{}{
+			"candidate":     c.Candidate,
+			"sdpMid":        c.SDPMid,
+			"sdpMLineIndex": c.SDPMLineIndex,
+		}
+	}
+	return Event{
+		Type: "m.call.candidates",
+		Content: map[string]interface{}{
+			"call_id":    callID,
+			"party_id":   partyID,
+			"version":    VoIPVersion,
+			"candidates": cs,
+		},
+	}
+}
+
+// CallHangup returns an m.call.hangup event for `callID`. `reason` is optional, e.g "user_hangup".
+func CallHangup(callID, partyID, reason string) Event {
+	content := map[string]interface{}{
+		"call_id":  callID,
+		"party_id": partyID,
+		"version":  VoIPVersion,
+	}
+	if reason != "" {
+		content["reason"] = reason
+	}
+	return Event{
+		Type:    "m.call.hangup",
+		Content: content,
+	}
+}
@@ -0,0 +1,251 @@
+// Package capture records HTTP exchanges made during a test and writes them out as a HAR file when the
+// test fails, so failures which only happen in CI can be debugged without reproducing them locally.
+//
+// Capturing is enabled by setting COMPLEMENT_CAPTURE_DIR to the directory the HAR files should be written
+// to. One file is written per failing top-level test which created a client or federation server, named
+// after the test. Access tokens, passwords and X-Matrix signatures are redacted before being written.
+package capture
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/complement/internal/testlog"
+)
+
+var (
+	recordersMu sync.Mutex
+	recorders   = make(map[*testing.T]*Recorder)
+)
+
+// Recorder records HTTP exchanges for a single test. A nil Recorder is valid and records nothing.
+type Recorder struct {
+	t       *testing.T
+	dir     string
+	mu      sync.Mutex
+	entries []harEntry
+}
+
+// ForTest returns the Recorder for `t`, creating it if this is the first time it has been requested. The
+// recorded exchanges are written to `dir` when `t` finishes, if it failed. Returns nil if `dir` is empty,
+// which disables capturing.
+func ForTest(t *testing.T, dir string) *Recorder {
+	if dir == "" {
+		return nil
+	}
+	recordersMu.Lock()
+	defer recordersMu.Unlock()
+	if r, ok := recorders[t]; ok {
+		return r
+	}
+	r := &Recorder{
+		t:   t,
+		dir: dir,
+	}
+	recorders[t] = r
+	t.Cleanup(func() {
+		recordersMu.Lock()
+		delete(recorders, t)
+		recordersMu.Unlock()
+		if t.Failed() {
+			r.write()
+		}
+	})
+	return r
+}
+
+// RoundTripper wraps `wrap` so every request sent through it is recorded. `name` is recorded alongside
+// each exchange to identify where it came from, e.g "hs1". If the Recorder is nil, returns `wrap`.
+func (r *Recorder) RoundTripper(name string, wrap http.RoundTripper) http.RoundTripper {
+	if r == nil {
+		return wrap
+	}
+	if wrap == nil {
+		wrap = http.DefaultTransport
+	}
+	return &roundTripper{
+		recorder: r,
+		name:     name,
+		wrap:     wrap,
+	}
+}
+
+// Middleware returns a middleware which records every request received by the server and the response
+// sent back. Wrap the whole router with it, as the middleware of a mux.Router doesn't see requests which
+// match no route. If the Recorder is nil, requests pass through untouched.
+func (r *Recorder) Middleware(name string) func(http.Handler) http.Handler {
+	return func(h http.Handler) http.Handler {
+		if r == nil {
+			return h
+		}
+		return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			start := time.Now()
+			reqBody := readBody(&req.Body)
+			rw := &responseRecorder{
+				ResponseWriter: w,
+				statusCode:     http.StatusOK,
+			}
+			h.ServeHTTP(rw, req)
+			r.record(name, start, req, reqBody, &http.Response{
+				Status:     strconv.Itoa(rw.statusCode) + " " + http.StatusText(rw.statusCode),
+				StatusCode: rw.statusCode,
+				Proto:      req.Proto,
+				Header:     w.Header(),
+			}, rw.body.Bytes())
+		})
+	}
+}
+
+type roundTripper struct {
+	recorder *Recorder
+	name     string
+	wrap     http.RoundTripper
+}
+
+func (rt *roundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	start := time.Now()
+	reqBody := readBody(&req.Body)
+	res, err := rt.wrap.RoundTrip(req)
+	if err != nil {
+		rt.recorder.record(rt.name, start, req, reqBody, nil, nil)
+		return res, err
+	}
+	// record the body as it is read, rather than reading it all here, so it is still streamed to the caller
+	res.Body = &recordingBody{
+		ReadCloser: res.Body,
+		done: func(resBody []byte) {
+			rt.recorder.record(rt.name, start, req, reqBody, res, resBody)
+		},
+	}
+	return res, err
+}
+
+// recordingBody keeps a copy of a response body as it is read, and calls done with it when the body has been
+// read to the end or closed, whichever is first. Responses whose bodies are never closed aren't recorded.
+type recordingBody struct {
+	io.ReadCloser
+	done func(body []byte)
+	mu   sync.Mutex
+	buf  bytes.Buffer
+	once sync.Once
+}
+
+func (b *recordingBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.mu.Lock()
+	b.buf.Write(p[:n])
+	b.mu.Unlock()
+	if err != nil {
+		b.finish()
+	}
+	return n, err
+}
+
+func (b *recordingBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.finish()
+	return err
+}
+
+func (b *recordingBody) finish() {
+	b.once.Do(func() {
+		b.mu.Lock()
+		body := append([]byte(nil), b.buf.Bytes()...)
+		b.mu.Unlock()
+		b.done(body)
+	})
+}
+
+type responseRecorder struct {
+	http.ResponseWriter
+	statusCode  int
+	wroteHeader bool
+	body        bytes.Buffer
+}
+
+func (w *responseRecorder) WriteHeader(statusCode int) {
+	if !w.wroteHeader {
+		w.statusCode = statusCode
+		w.wroteHeader = true
+	}
+	w.ResponseWriter.WriteHeader(statusCode)
+}
+
+func (w *responseRecorder) Write(b []byte) (int, error) {
+	w.wroteHeader = true
+	w.body.Write(b)
+	return w.ResponseWriter.Write(b)
+}
+
+// readBody reads the whole of `body` and replaces it with a reader over the same bytes, so it can be
+// read again by whoever is next in the chain.
+func readBody(body *io.ReadCloser) []byte {
+	if *body == nil || *body == http.NoBody {
+		return nil
+	}
+	b, err := ioutil.ReadAll(*body)
+	(*body).Close()
+	*body = ioutil.NopCloser(bytes.NewReader(b))
+	if err != nil {
+		return nil
+	}
+	return b
+}
+
+func (r *Recorder) record(name string, start time.Time, req *http.Request, reqBody []byte, res *http.Response, resBody []byte) {
+	entry := newHAREntry(name, start, time.Since(start), req, reqBody, res, resBody)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.entries = append(r.entries, entry)
+}
+
+// Len returns the number of exchanges recorded so far.
+func (r *Recorder) Len() int {
+	if r == nil {
+		return 0
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return len(r.entries)
+}
+
+func (r *Recorder) write() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if len(r.entries) == 0 {
+		return
+	}
+	if err := os.MkdirAll(r.dir, 0755); err != nil {
+		r.t.Logf("capture: failed to create %s: %s", r.dir, err)
+		return
+	}
+	b, err := json.MarshalIndent(harFile{
+		Log: harLog{
+			Version: "1.2",
+			Creator: harCreator{
+				Name:    "complement",
+				Version: "1",
+			},
+			Entries: r.entries,
+		},
+	}, "", "  ")
+	if err != nil {
+		r.t.Logf("capture: failed to marshal HAR: %s", err)
+		return
+	}
+	path := filepath.Join(r.dir, testlog.Filename(r.t.Name())+".har")
+	if err = ioutil.WriteFile(path, b, 0644); err != nil {
+		r.t.Logf("capture: failed to write %s: %s", path, err)
+		return
+	}
+	r.t.Logf("capture: wrote %d HTTP exchanges to %s", len(r.entries), path)
+}
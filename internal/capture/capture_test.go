@@ -0,0 +1,93 @@
+package capture
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestRoundTripperStreamsResponseBody(t *testing.T) {
+	release := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(200)
+		w.(http.Flusher).Flush()
+		<-release
+		w.Write([]byte(`{"streamed":true}`)) // nolint:errcheck
+	}))
+	defer srv.Close()
+	r := ForTest(t, t.TempDir())
+	cli := &http.Client{
+		Transport: r.RoundTripper("hs1", nil),
+	}
+	returned := make(chan *http.Response)
+	go func() {
+		res, err := cli.Get(srv.URL)
+		if err != nil {
+			t.Errorf("request failed: %s", err)
+		}
+		returned <- res
+	}()
+	var res *http.Response
+	select {
+	case res = <-returned:
+	case <-time.After(5 * time.Second):
+		close(release)
+		t.Fatalf("request didn't return until the body was sent")
+	}
+	if len(r.entries) != 0 {
+		t.Errorf("recorded the exchange before the body was read")
+	}
+	close(release)
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		t.Fatalf("failed to read body: %s", err)
+	}
+	res.Body.Close()
+	if string(body) != `{"streamed":true}` {
+		t.Errorf("read body %q", body)
+	}
+	if len(r.entries) != 1 {
+		t.Fatalf("recorded %d exchanges, want 1", len(r.entries))
+	}
+	if got := r.entries[0].Response.Content.Text; got != string(body) {
+		t.Errorf("recorded body %q, want %q", got, body)
+	}
+}
+
+func TestRedactBody(t *testing.T) {
+	testCases := []struct {
+		body string
+		want string
+	}{
+		{body: `{"user_id":"@alice:hs1"}`, want: `{"user_id":"@alice:hs1"}`},
+		{body: `{"access_token":"secret","user_id":"@alice:hs1"}`, want: `{"access_token":"<redacted>","user_id":"@alice:hs1"}`},
+		{body: `{"guest_access_token":"secret"}`, want: `{"guest_access_token":"<redacted>"}`},
+		{body: `{"auth":{"type":"m.login.password","password":"secret"}}`, want: `{"auth":{"password":"<redacted>","type":"m.login.password"}}`},
+		{body: `[{"refresh_token":"secret"}]`, want: `[{"refresh_token":"<redacted>"}]`},
+		{body: `not json`, want: `not json`},
+	}
+	for _, tc := range testCases {
+		got := redactBody([]byte(tc.body))
+		// compare JSON bodies as values, as re-encoding them escapes '<' and '>'
+		var gotJSON, wantJSON interface{}
+		if json.Unmarshal([]byte(got), &gotJSON) == nil && json.Unmarshal([]byte(tc.want), &wantJSON) == nil {
+			if !reflect.DeepEqual(gotJSON, wantJSON) {
+				t.Errorf("redactBody(%s) = %s, want %s", tc.body, got, tc.want)
+			}
+		} else if got != tc.want {
+			t.Errorf("redactBody(%s) = %s, want %s", tc.body, got, tc.want)
+		}
+	}
+}
+
+func TestHAREntryRedactsQuery(t *testing.T) {
+	req := httptest.NewRequest("GET", "https://hs1/_matrix/client/v3/sync?access_token=secret&since=s1", nil)
+	entry := newHAREntry("hs1", time.Now(), time.Second, req, nil, nil, nil)
+	if want := "https://hs1/_matrix/client/v3/sync?access_token=%3Credacted%3E&since=s1"; entry.Request.URL != want {
+		t.Errorf("got URL %s want %s", entry.Request.URL, want)
+	}
+}
@@ -0,0 +1,235 @@
+package capture
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const redacted = "<redacted>"
+
+// Query parameters and JSON keys in request/response bodies which are replaced with <redacted>
+var redactedKeys = map[string]bool{
+	"access_token":       true,
+	"refresh_token":      true,
+	"guest_access_token": true,
+	"password":           true,
+	"new_password":       true,
+	"token":              true,
+	"hs_token":           true,
+	"as_token":           true,
+}
+
+// The types below are the subset of HAR 1.2 which Complement produces.
+// See http://www.softwareishard.com/blog/har-12-spec/
+
+type harFile struct {
+	Log harLog `json:"log"`
+}
+
+type harLog struct {
+	Version string     `json:"version"`
+	Creator harCreator `json:"creator"`
+	Entries []harEntry `json:"entries"`
+}
+
+type harCreator struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+}
+
+type harEntry struct {
+	StartedDateTime string      `json:"startedDateTime"`
+	Time            float64     `json:"time"`
+	Request         harRequest  `json:"request"`
+	Response        harResponse `json:"response"`
+	Cache           struct{}    `json:"cache"`
+	Timings         harTimings  `json:"timings"`
+	Comment         string      `json:"comment,omitempty"`
+}
+
+type harNameValue struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+type harRequest struct {
+	Method      string         `json:"method"`
+	URL         string         `json:"url"`
+	HTTPVersion string         `json:"httpVersion"`
+	Headers     []harNameValue `json:"headers"`
+	QueryString []harNameValue `json:"queryString"`
+	Cookies     []harNameValue `json:"cookies"`
+	PostData    *harPostData   `json:"postData,omitempty"`
+	HeadersSize int            `json:"headersSize"`
+	BodySize    int            `json:"bodySize"`
+}
+
+type harPostData struct {
+	MimeType string `json:"mimeType"`
+	Text     string `json:"text"`
+}
+
+type harResponse struct {
+	Status      int            `json:"status"`
+	StatusText  string         `json:"statusText"`
+	HTTPVersion string         `json:"httpVersion"`
+	Headers     []harNameValue `json:"headers"`
+	Cookies     []harNameValue `json:"cookies"`
+	Content     harContent     `json:"content"`
+	RedirectURL string         `json:"redirectURL"`
+	HeadersSize int            `json:"headersSize"`
+	BodySize    int            `json:"bodySize"`
+}
+
+type harContent struct {
+	Size     int    `json:"size"`
+	MimeType string `json:"mimeType"`
+	Text     string `json:"text,omitempty"`
+}
+
+type harTimings struct {
+	Send    float64 `json:"send"`
+	Wait    float64 `json:"wait"`
+	Receive float64 `json:"receive"`
+}
+
+// newHAREntry converts an exchange into a HAR entry, redacting credentials. `res` is nil if the request
+// failed without a response.
+func newHAREntry(name string, start time.Time, duration time.Duration, req *http.Request, reqBody []byte, res *http.Response, resBody []byte) harEntry {
+	ms := float64(duration) / float64(time.Millisecond)
+	u := *req.URL
+	query := u.Query()
+	for key := range query {
+		if redactedKeys[key] {
+			query.Set(key, redacted)
+		}
+	}
+	u.RawQuery = query.Encode()
+	if u.Host == "" {
+		// server side requests don't have the host set on the URL
+		u.Host = req.Host
+		u.Scheme = "https"
+	}
+	entry := harEntry{
+		StartedDateTime: start.UTC().Format(time.RFC3339Nano),
+		Time:            ms,
+		Request: harRequest{
+			Method:      req.Method,
+			URL:         u.String(),
+			HTTPVersion: req.Proto,
+			Headers:     harHeaders(req.Header),
+			QueryString: harQuery(query),
+			Cookies:     []harNameValue{},
+			HeadersSize: -1,
+			BodySize:    len(reqBody),
+		},
+		Response: harResponse{
+			Headers:     []harNameValue{},
+			Cookies:     []harNameValue{},
+			HeadersSize: -1,
+			BodySize:    -1,
+		},
+		Timings: harTimings{
+			Wait: ms,
+		},
+		Comment: name,
+	}
+	if len(reqBody) > 0 {
+		entry.Request.PostData = &harPostData{
+			MimeType: req.Header.Get("Content-Type"),
+			Text:     redactBody(reqBody),
+		}
+	}
+	if res == nil {
+		// HAR has no way to represent a failed request other than a status of 0
+		return entry
+	}
+	entry.Response.Status = res.StatusCode
+	entry.Response.StatusText = strings.TrimPrefix(res.Status, strconv.Itoa(res.StatusCode)+" ")
+	entry.Response.HTTPVersion = res.Proto
+	entry.Response.Headers = harHeaders(res.Header)
+	entry.Response.BodySize = len(resBody)
+	entry.Response.Content = harContent{
+		Size:     len(resBody),
+		MimeType: res.Header.Get("Content-Type"),
+		Text:     redactBody(resBody),
+	}
+	return entry
+}
+
+func harHeaders(header http.Header) []harNameValue {
+	headers := []harNameValue{}
+	for name, values := range header {
+		for _, value := range values {
+			if name == "Authorization" {
+				// keep the scheme so it's clear whether it was a Bearer or X-Matrix request
+				value = strings.SplitN(value, " ", 2)[0] + " " + redacted
+			}
+			headers = append(headers, harNameValue{Name: name, Value: value})
+		}
+	}
+	sort.Slice(headers, func(i, j int) bool {
+		return headers[i].Name < headers[j].Name
+	})
+	return headers
+}
+
+func harQuery(query url.Values) []harNameValue {
+	params := []harNameValue{}
+	for name, values := range query {
+		for _, value := range values {
+			params = append(params, harNameValue{Name: name, Value: value})
+		}
+	}
+	sort.Slice(params, func(i, j int) bool {
+		return params[i].Name < params[j].Name
+	})
+	return params
+}
+
+// redactBody returns `body` as a string, with the values of any redacted keys replaced if it is a JSON
+// object. Other bodies are returned unchanged.
+func redactBody(body []byte) string {
+	var obj interface{}
+	if err := json.Unmarshal(body, &obj); err != nil {
+		return string(body)
+	}
+	if !redactJSON(obj) {
+		return string(body)
+	}
+	b, err := json.Marshal(obj)
+	if err != nil {
+		return string(body)
+	}
+	return string(b)
+}
+
+// redactJSON replaces the values of redacted keys in `v` in place. Returns true if anything was replaced.
+func redactJSON(v interface{}) bool {
+	changed := false
+	switch val := v.(type) {
+	case map[string]interface{}:
+		for key, child := range val {
+			if redactedKeys[key] {
+				val[key] = redacted
+				changed = true
+				continue
+			}
+			if redactJSON(child) {
+				changed = true
+			}
+		}
+	case []interface{}:
+		for _, child := range val {
+			if redactJSON(child) {
+				changed = true
+			}
+		}
+	}
+	return changed
+}
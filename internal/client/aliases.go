@@ -0,0 +1,73 @@
+package client
+
+import (
+	"net/http"
+	"testing"
+)
+
+// SetRoomAlias creates the alias `roomAlias` for `roomID`, returning the response. The response is not checked
+// so this can be used to test failure modes, see MustSetRoomAlias.
+func (c *CSAPI) SetRoomAlias(t *testing.T, roomID, roomAlias string) *http.Response {
+	t.Helper()
+	return c.DoFunc(t, "PUT", []string{"_matrix", "client", "r0", "directory", "room", roomAlias}, WithJSONBody(t, map[string]interface{}{
+		"room_id": roomID,
+	}))
+}
+
+// MustSetRoomAlias creates the alias `roomAlias` for `roomID`, else fails the test.
+func (c *CSAPI) MustSetRoomAlias(t *testing.T, roomID, roomAlias string) {
+	t.Helper()
+	c.MustDoFunc(t, "PUT", []string{"_matrix", "client", "r0", "directory", "room", roomAlias}, WithJSONBody(t, map[string]interface{}{
+		"room_id": roomID,
+	}))
+}
+
+// GetRoomAlias resolves `roomAlias`, which may be on a remote server, returning the response. The response is
+// not checked so this can be used to test failure modes, see MustResolveRoomAlias.
+func (c *CSAPI) GetRoomAlias(t *testing.T, roomAlias string) *http.Response {
+	t.Helper()
+	return c.DoFunc(t, "GET", []string{"_matrix", "client", "r0", "directory", "room", roomAlias})
+}
+
+// MustResolveRoomAlias resolves `roomAlias`, which may be on a remote server, else fails the test.
+// Returns the room ID and the servers which are joined to the room.
+func (c *CSAPI) MustResolveRoomAlias(t *testing.T, roomAlias string) (roomID string, servers []string) {
+	t.Helper()
+	res := c.MustDoFunc(t, "GET", []string{"_matrix", "client", "r0", "directory", "room", roomAlias})
+	body := ParseJSON(t, res)
+	return GetJSONFieldStr(t, body, "room_id"), GetJSONFieldStringArray(t, body, "servers")
+}
+
+// DeleteRoomAlias deletes `roomAlias`, returning the response. The response is not checked so this can be used
+// to test failure modes, see MustDeleteRoomAlias.
+func (c *CSAPI) DeleteRoomAlias(t *testing.T, roomAlias string) *http.Response {
+	t.Helper()
+	return c.DoFunc(t, "DELETE", []string{"_matrix", "client", "r0", "directory", "room", roomAlias})
+}
+
+// MustDeleteRoomAlias deletes `roomAlias`, else fails the test.
+func (c *CSAPI) MustDeleteRoomAlias(t *testing.T, roomAlias string) {
+	t.Helper()
+	c.MustDoFunc(t, "DELETE", []string{"_matrix", "client", "r0", "directory", "room", roomAlias})
+}
+
+// GetRoomAliases lists the local aliases of `roomID`, returning the response. The response is not checked
+// so this can be used to test failure modes. The response body has an `aliases` array.
+func (c *CSAPI) GetRoomAliases(t *testing.T, roomID string) *http.Response {
+	t.Helper()
+	return c.DoFunc(t, "GET", []string{"_matrix", "client", "r0", "rooms", roomID, "aliases"})
+}
+
+// SetCanonicalAlias sends an m.room.canonical_alias event into `roomID`, returning the response. If `altAliases`
+// is nil then `alt_aliases` is omitted from the event. The response is not checked so this can be used to test
+// failure modes, e.g when the alias does not point to the room.
+func (c *CSAPI) SetCanonicalAlias(t *testing.T, roomID, roomAlias string, altAliases []string) *http.Response {
+	t.Helper()
+	content := map[string]interface{}{
+		"alias": roomAlias,
+	}
+	if altAliases != nil {
+		content["alt_aliases"] = altAliases
+	}
+	return c.DoFunc(t, "PUT", []string{"_matrix", "client", "r0", "rooms", roomID, "state", "m.room.canonical_alias"}, WithJSONBody(t, content))
+}
@@ -0,0 +1,124 @@
+package client
+
+import (
+	"net/http"
+	"net/url"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/tidwall/gjson"
+)
+
+// The event types and content fields used when importing history with /batch_send (MSC2716).
+const (
+	MSC2716InsertionEventType = "org.matrix.msc2716.insertion"
+	MSC2716BatchEventType     = "org.matrix.msc2716.batch"
+	MSC2716MarkerEventType    = "org.matrix.msc2716.marker"
+
+	MSC2716HistoricalContentField      = "org.matrix.msc2716.historical"
+	MSC2716NextBatchIDContentField     = "org.matrix.msc2716.next_batch_id"
+	MSC2716MarkerInsertionContentField = "org.matrix.msc2716.marker.insertion"
+)
+
+// BatchSendReq is a request to import a batch of historical events, as used by BatchSend.
+type BatchSendReq struct {
+	// The event to insert the batch after. Required.
+	PrevEventID string
+	// The next_batch_id of a previous batch, to insert this batch before it. If empty, a new insertion
+	// point is made after PrevEventID.
+	BatchID string
+	// State events which are resolved at the start of the batch, typically memberships of the senders.
+	StateEventsAtStart []map[string]interface{}
+	// The historical events to import, oldest first. Each needs a type, sender, origin_server_ts and content.
+	Events []map[string]interface{}
+}
+
+// BatchSendResult is the response from /batch_send, as returned by MustBatchSend.
+type BatchSendResult struct {
+	// The IDs of the imported events, oldest first
+	EventIDs []string
+	// The IDs of the imported StateEventsAtStart
+	StateEventIDs []string
+	// The insertion event at the start of the batch, which the next batch is inserted before
+	InsertionEventID string
+	// The batch event at the end of the batch, which connects it to the previous insertion point
+	BatchEventID string
+	// The insertion event made after PrevEventID, if no BatchID was given
+	BaseInsertionEventID string
+	// The batch ID to use to insert the next, older, batch
+	NextBatchID string
+	// The whole response body, for use with must.MatchJSONBytes
+	Raw []byte
+}
+
+// ExpectedMessagesOrder returns the events the batch should appear as when paginating backwards with /messages,
+// newest first. Use with match.JSONEventIDsInOrderWhere and match.IsHistoricalEvent.
+func (r BatchSendResult) ExpectedMessagesOrder() []string {
+	var eventIDs []string
+	if r.BaseInsertionEventID != "" {
+		eventIDs = append(eventIDs, r.BaseInsertionEventID)
+	}
+	eventIDs = append(eventIDs, r.BatchEventID)
+	for i := len(r.EventIDs) - 1; i >= 0; i-- {
+		eventIDs = append(eventIDs, r.EventIDs[i])
+	}
+	return append(eventIDs, r.InsertionEventID)
+}
+
+// BatchSend imports a batch of historical events into `roomID` (MSC2716), returning the response. Only
+// application services may import history. The response is not checked so this can be used to test failure
+// modes, see MustBatchSend.
+func (c *CSAPI) BatchSend(t *testing.T, roomID string, req BatchSendReq) *http.Response {
+	t.Helper()
+	query := url.Values{
+		"prev_event_id": []string{req.PrevEventID},
+	}
+	if req.BatchID != "" {
+		query.Set("batch_id", req.BatchID)
+	}
+	stateEvents := req.StateEventsAtStart
+	if stateEvents == nil {
+		stateEvents = []map[string]interface{}{}
+	}
+	return c.DoFunc(
+		t, "POST", []string{"_matrix", "client", "unstable", "org.matrix.msc2716", "rooms", roomID, "batch_send"},
+		WithJSONBody(t, map[string]interface{}{
+			"events":                req.Events,
+			"state_events_at_start": stateEvents,
+		}),
+		WithQueries(query),
+	)
+}
+
+// MustBatchSend imports a batch of historical events into `roomID` (MSC2716), else fails the test.
+func (c *CSAPI) MustBatchSend(t *testing.T, roomID string, req BatchSendReq) BatchSendResult {
+	t.Helper()
+	res := c.BatchSend(t, roomID, req)
+	body := ParseJSON(t, res)
+	if res.StatusCode != 200 {
+		t.Fatalf("MustBatchSend: got HTTP %d want 200: %s", res.StatusCode, string(body))
+	}
+	return BatchSendResult{
+		EventIDs:             GetJSONFieldStringArray(t, body, "event_ids"),
+		StateEventIDs:        GetJSONFieldStringArray(t, body, "state_event_ids"),
+		InsertionEventID:     GetJSONFieldStr(t, body, "insertion_event_id"),
+		BatchEventID:         GetJSONFieldStr(t, body, "batch_event_id"),
+		BaseInsertionEventID: gjson.GetBytes(body, "base_insertion_event_id").Str,
+		NextBatchID:          GetJSONFieldStr(t, body, "next_batch_id"),
+		Raw:                  body,
+	}
+}
+
+// SendMarker sends a marker event into `roomID` pointing at `insertionEventID`, which tells other homeservers
+// that history has been imported there, else fails the test. Returns the event ID of the marker event. Each
+// marker has a unique state key so they all remain in the current state.
+func (c *CSAPI) SendMarker(t *testing.T, roomID, insertionEventID string) string {
+	t.Helper()
+	c.txnID++
+	stateKey := "marker_" + strconv.FormatInt(time.Now().UnixNano(), 10) + "_" + strconv.Itoa(c.txnID)
+	res := c.MustDoFunc(t, "PUT", []string{"_matrix", "client", "r0", "rooms", roomID, "state", MSC2716MarkerEventType, stateKey}, WithJSONBody(t, map[string]interface{}{
+		MSC2716MarkerInsertionContentField: insertionEventID,
+	}))
+	return GetJSONFieldStr(t, ParseJSON(t, res), "event_id")
+}
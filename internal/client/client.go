@@ -2,17 +2,20 @@ package client
 
 import (
 	"bytes"
+	"context"
 	"crypto/hmac"
 	"crypto/sha1" // nolint:gosec
 	"encoding/hex"
 	"encoding/json"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"net/http"
 	"net/http/httputil"
 	"net/url"
 	"strconv"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 
@@ -20,7 +23,10 @@ import (
 	"github.com/tidwall/gjson"
 
 	"github.com/matrix-org/complement/internal/b"
+	"github.com/matrix-org/complement/internal/match"
 	"github.com/matrix-org/complement/internal/must"
+	"github.com/matrix-org/complement/internal/testlog"
+	"github.com/matrix-org/complement/internal/watchdog"
 )
 
 const (
@@ -31,6 +37,10 @@ const (
 // See functions starting with `With...` in this package for more info.
 type RequestOpt func(req *http.Request)
 
+// the longest CSAPI.DoFunc will wait before retrying a rate limited request, so misbehaving servers can't
+// stall tests
+const maxRateLimitWait = 10 * time.Second
+
 // SyncCheckOpt is a functional option for use with MustSyncUntil which should return <nil> if
 // the response satisfies the check, else return a human friendly error.
 // The result object is the entire /sync response from this request.
@@ -79,8 +89,19 @@ type CSAPI struct {
 	SyncUntilTimeout time.Duration
 	// True to enable verbose logging
 	Debug bool
+	// If true, rate limited requests (HTTP 429) are returned to the caller rather than retried. Set this in
+	// tests which assert rate limiting.
+	DisableRateLimitRetries bool
+	// The maximum number of times to retry a rate limited request. Defaults to 5 if 0.
+	RateLimitRetries int
+	// How long to wait before retrying a rate limited request if the server doesn't say via retry_after_ms,
+	// doubling on each retry. Defaults to 100ms if 0. Waits are capped at maxRateLimitWait.
+	RateLimitBackoff time.Duration
 
 	txnID int
+	// responses which don't change during a test, cached on first use
+	capabilities []byte
+	versions     []byte
 }
 
 // UploadContent uploads the provided content with an optional file name. Fails the test on error. Returns the MXC URI.
@@ -155,6 +176,24 @@ func (c *CSAPI) InviteRoom(t *testing.T, roomID string, userID string) {
 	c.MustDo(t, "POST", []string{"_matrix", "client", "r0", "rooms", roomID, "invite"}, body)
 }
 
+// UpgradeRoom upgrades `roomID` to the room version `newVersion`, else fails the test. Returns the room ID
+// of the new room.
+func (c *CSAPI) UpgradeRoom(t *testing.T, roomID, newVersion string) string {
+	t.Helper()
+	res := c.MustDoFunc(t, "POST", []string{"_matrix", "client", "r0", "rooms", roomID, "upgrade"}, WithJSONBody(t, map[string]interface{}{
+		"new_version": newVersion,
+	}))
+	body := ParseJSON(t, res)
+	return GetJSONFieldStr(t, body, "replacement_room")
+}
+
+// GetRoomState returns the current state of `roomID` as a JSON array of state events, else fails the test.
+func (c *CSAPI) GetRoomState(t *testing.T, roomID string) []byte {
+	t.Helper()
+	res := c.MustDoFunc(t, "GET", []string{"_matrix", "client", "r0", "rooms", roomID, "state"})
+	return ParseJSON(t, res)
+}
+
 func (c *CSAPI) GetGlobalAccountData(t *testing.T, eventType string) *http.Response {
 	return c.MustDoFunc(t, "GET", []string{"_matrix", "client", "r0", "user", c.UserID, "account_data", eventType})
 }
@@ -163,19 +202,169 @@ func (c *CSAPI) SetGlobalAccountData(t *testing.T, eventType string, content map
 	return c.MustDoFunc(t, "PUT", []string{"_matrix", "client", "r0", "user", c.UserID, "account_data", eventType}, WithJSONBody(t, content))
 }
 
-// SendEventSynced sends `e` into the room and waits for its event ID to come down /sync.
-// Returns the event ID of the sent event.
-func (c *CSAPI) SendEventSynced(t *testing.T, roomID string, e b.Event) string {
+// SetIgnoredUsers replaces the m.ignored_user_list of the user with `userIDs`, else fails the test.
+// Call with no `userIDs` to unignore everyone.
+func (c *CSAPI) SetIgnoredUsers(t *testing.T, userIDs ...string) {
+	t.Helper()
+	ignored := make(map[string]interface{}, len(userIDs))
+	for _, userID := range userIDs {
+		ignored[userID] = map[string]interface{}{}
+	}
+	c.MustDoFunc(t, "PUT", []string{"_matrix", "client", "r0", "user", c.UserID, "account_data", "m.ignored_user_list"}, WithJSONBody(t, map[string]interface{}{
+		"ignored_users": ignored,
+	}))
+}
+
+func (c *CSAPI) GetRoomAccountData(t *testing.T, roomID string, eventType string) *http.Response {
+	return c.MustDoFunc(t, "GET", []string{"_matrix", "client", "r0", "user", c.UserID, "rooms", roomID, "account_data", eventType})
+}
+
+func (c *CSAPI) SetRoomAccountData(t *testing.T, roomID string, eventType string, content map[string]interface{}) *http.Response {
+	return c.MustDoFunc(t, "PUT", []string{"_matrix", "client", "r0", "user", c.UserID, "rooms", roomID, "account_data", eventType}, WithJSONBody(t, content))
+}
+
+// AddTag tags `roomID` with `tag`, e.g "m.favourite", else fails the test.
+func (c *CSAPI) AddTag(t *testing.T, roomID, tag string) {
+	t.Helper()
+	c.MustDoFunc(t, "PUT", []string{"_matrix", "client", "r0", "user", c.UserID, "rooms", roomID, "tags", tag}, WithJSONBody(t, map[string]interface{}{}))
+}
+
+// AddTagWithOrder tags `roomID` with `tag` and the given `order`, which is used to sort rooms with the same tag
+// and should be between 0 and 1. Fails the test on error.
+func (c *CSAPI) AddTagWithOrder(t *testing.T, roomID, tag string, order float64) {
+	t.Helper()
+	c.MustDoFunc(t, "PUT", []string{"_matrix", "client", "r0", "user", c.UserID, "rooms", roomID, "tags", tag}, WithJSONBody(t, map[string]interface{}{
+		"order": order,
+	}))
+}
+
+// RemoveTag removes `tag` from `roomID`, else fails the test.
+func (c *CSAPI) RemoveTag(t *testing.T, roomID, tag string) {
+	t.Helper()
+	c.MustDoFunc(t, "DELETE", []string{"_matrix", "client", "r0", "user", c.UserID, "rooms", roomID, "tags", tag})
+}
+
+// GetTags returns the tags on `roomID` as an object of tag name to tag content, else fails the test.
+func (c *CSAPI) GetTags(t *testing.T, roomID string) gjson.Result {
+	t.Helper()
+	res := c.MustDoFunc(t, "GET", []string{"_matrix", "client", "r0", "user", c.UserID, "rooms", roomID, "tags"})
+	return gjson.GetBytes(ParseJSON(t, res), "tags")
+}
+
+// SetPresence sets the presence state of the user to `state`, which is one of "online", "offline" or
+// "unavailable", with an optional status message. Fails the test on error.
+func (c *CSAPI) SetPresence(t *testing.T, state, statusMsg string) {
+	t.Helper()
+	body := map[string]interface{}{
+		"presence": state,
+	}
+	if statusMsg != "" {
+		body["status_msg"] = statusMsg
+	}
+	c.MustDoFunc(t, "PUT", []string{"_matrix", "client", "r0", "presence", c.UserID, "status"}, WithJSONBody(t, body))
+}
+
+// GetPresence returns the presence of `userID`. Fails the test on error. The response body has `presence`
+// and optionally `status_msg`, `last_active_ago` and `currently_active`.
+func (c *CSAPI) GetPresence(t *testing.T, userID string) *http.Response {
+	t.Helper()
+	return c.MustDoFunc(t, "GET", []string{"_matrix", "client", "r0", "presence", userID, "status"})
+}
+
+// SendTyping marks the user as typing (or not) in the room, else fails the test. The homeserver will stop
+// showing the user as typing after `timeout`, which is only sent if `typing` is true.
+func (c *CSAPI) SendTyping(t *testing.T, roomID string, typing bool, timeout time.Duration) {
+	t.Helper()
+	body := map[string]interface{}{
+		"typing": typing,
+	}
+	if typing {
+		body["timeout"] = timeout.Milliseconds()
+	}
+	c.MustDoFunc(t, "PUT", []string{"_matrix", "client", "r0", "rooms", roomID, "typing", c.UserID}, WithJSONBody(t, body))
+}
+
+// SendReceipt sends a receipt of type `receiptType` for `eventID`, else fails the test. The receipt type is one of
+// "m.read" or "m.read.private" (MSC2285). If `threadID` is not empty then the receipt is threaded, which can be
+// the thread root event ID or "main" for the main timeline.
+func (c *CSAPI) SendReceipt(t *testing.T, roomID, eventID, receiptType, threadID string) {
+	t.Helper()
+	body := map[string]interface{}{}
+	if threadID != "" {
+		body["thread_id"] = threadID
+	}
+	c.MustDoFunc(t, "POST", []string{"_matrix", "client", "v3", "rooms", roomID, "receipt", receiptType, eventID}, WithJSONBody(t, body))
+}
+
+// SetReadMarkers moves the m.fully_read marker and sends m.read and m.read.private receipts in a single request,
+// else fails the test. Empty event IDs are not sent.
+func (c *CSAPI) SetReadMarkers(t *testing.T, roomID, fullyReadEventID, readEventID, readPrivateEventID string) {
+	t.Helper()
+	body := map[string]interface{}{}
+	if fullyReadEventID != "" {
+		body["m.fully_read"] = fullyReadEventID
+	}
+	if readEventID != "" {
+		body["m.read"] = readEventID
+	}
+	if readPrivateEventID != "" {
+		body["m.read.private"] = readPrivateEventID
+	}
+	c.MustDoFunc(t, "POST", []string{"_matrix", "client", "v3", "rooms", roomID, "read_markers"}, WithJSONBody(t, body))
+}
+
+// SendToDevice sends a to-device message of type `eventType` to the given users and devices, else fails the test.
+// `messages` is a map of user ID to device ID to message content, as in the request body of /sendToDevice.
+func (c *CSAPI) SendToDevice(t *testing.T, eventType string, messages map[string]map[string]interface{}) {
+	t.Helper()
+	c.txnID++
+	c.MustDoFunc(
+		t, "PUT", []string{"_matrix", "client", "r0", "sendToDevice", eventType, strconv.Itoa(c.txnID)},
+		WithJSONBody(t, map[string]interface{}{
+			"messages": messages,
+		}),
+	)
+}
+
+// PingAppService asks the homeserver to ping the application service `appserviceID` (MSC2659). The client must be
+// authenticated with that application service's as_token. If `transactionID` is not empty it is sent to the
+// application service with the ping. Returns the response, which has `duration_ms` on success.
+func (c *CSAPI) PingAppService(t *testing.T, appserviceID, transactionID string) *http.Response {
+	t.Helper()
+	body := map[string]interface{}{}
+	if transactionID != "" {
+		body["transaction_id"] = transactionID
+	}
+	return c.DoFunc(t, "POST", []string{"_matrix", "client", "v1", "appservice", appserviceID, "ping"}, WithJSONBody(t, body))
+}
+
+// SendEventUnsynced sends `e` into the room, else fails the test. Returns the event ID of the sent event,
+// without waiting for it to come down /sync.
+func (c *CSAPI) SendEventUnsynced(t *testing.T, roomID string, e b.Event) string {
 	t.Helper()
 	c.txnID++
 	paths := []string{"_matrix", "client", "r0", "rooms", roomID, "send", e.Type, strconv.Itoa(c.txnID)}
 	if e.StateKey != nil {
 		paths = []string{"_matrix", "client", "r0", "rooms", roomID, "state", e.Type, *e.StateKey}
 	}
-	res := c.MustDo(t, "PUT", paths, e.Content)
+	opts := []RequestOpt{WithJSONBody(t, e.Content)}
+	if !e.Timestamp.IsZero() {
+		// the client must be an application service to set the timestamp
+		opts = append(opts, WithQueries(url.Values{
+			"ts": []string{strconv.FormatInt(e.Timestamp.UnixMilli(), 10)},
+		}))
+	}
+	res := c.MustDoFunc(t, "PUT", paths, opts...)
 	body := ParseJSON(t, res)
-	eventID := GetJSONFieldStr(t, body, "event_id")
-	t.Logf("SendEventSynced waiting for event ID %s", eventID)
+	return GetJSONFieldStr(t, body, "event_id")
+}
+
+// SendEventSynced sends `e` into the room and waits for its event ID to come down /sync.
+// Returns the event ID of the sent event.
+func (c *CSAPI) SendEventSynced(t *testing.T, roomID string, e b.Event) string {
+	t.Helper()
+	eventID := c.SendEventUnsynced(t, roomID, e)
+	testlog.ForTest(t).With("component", "client", "user", c.UserID).Infof("SendEventSynced waiting for event ID %s", eventID)
 	c.MustSyncUntil(t, SyncReq{}, SyncTimelineHas(roomID, func(r gjson.Result) bool {
 		return r.Get("event_id").Str == eventID
 	}))
@@ -321,6 +510,38 @@ func (c *CSAPI) RegisterUser(t *testing.T, localpart, password string) (userID,
 	return userID, accessToken, deviceID
 }
 
+// RegisterGuest will register a guest user, whose user ID is chosen by the server, and return the user ID,
+// access token & device ID. Fails the test on network error.
+func (c *CSAPI) RegisterGuest(t *testing.T) (userID, accessToken, deviceID string) {
+	t.Helper()
+	res := c.MustDoFunc(t, "POST", []string{"_matrix", "client", "r0", "register"}, WithJSONBody(t, map[string]interface{}{}), WithQueries(url.Values{
+		"kind": []string{"guest"},
+	}))
+	body := ParseJSON(t, res)
+	return GetJSONFieldStr(t, body, "user_id"), GetJSONFieldStr(t, body, "access_token"), GetJSONFieldStr(t, body, "device_id")
+}
+
+// MustUpgradeGuest upgrades the guest user to a full account with the given `localpart` and `password`, else
+// fails the test. Guests keep their user ID when upgrading, so `localpart` must be the localpart of the guest's
+// user ID. The client is updated to use the access token and device ID of the full account.
+func (c *CSAPI) MustUpgradeGuest(t *testing.T, localpart, password string) {
+	t.Helper()
+	res := c.MustDoFunc(t, "POST", []string{"_matrix", "client", "r0", "register"}, WithJSONBody(t, map[string]interface{}{
+		"auth": map[string]string{
+			"type": "m.login.dummy",
+		},
+		"username":           localpart,
+		"password":           password,
+		"guest_access_token": c.AccessToken,
+	}))
+	body := ParseJSON(t, res)
+	if userID := GetJSONFieldStr(t, body, "user_id"); userID != c.UserID {
+		t.Fatalf("MustUpgradeGuest: upgraded guest %s but got user ID %s", c.UserID, userID)
+	}
+	c.AccessToken = GetJSONFieldStr(t, body, "access_token")
+	c.DeviceID = GetJSONFieldStr(t, body, "device_id")
+}
+
 // RegisterSharedSecret registers a new account with a shared secret via HMAC
 // See https://github.com/matrix-org/synapse/blob/e550ab17adc8dd3c48daf7fedcd09418a73f524b/synapse/_scripts/register_new_matrix_user.py#L40
 func (c *CSAPI) RegisterSharedSecret(t *testing.T, user, pass string, isAdmin bool) (userID, accessToken, deviceID string) {
@@ -362,17 +583,69 @@ func (c *CSAPI) RegisterSharedSecret(t *testing.T, user, pass string, isAdmin bo
 	return userID, accessToken, deviceID
 }
 
-// GetCapbabilities queries the server's capabilities
+// GetCapbabilities queries the server's capabilities. The response is cached, so only the first call makes a request.
 func (c *CSAPI) GetCapabilities(t *testing.T) []byte {
 	t.Helper()
+	if c.capabilities != nil {
+		return c.capabilities
+	}
 	res := c.MustDoFunc(t, "GET", []string{"_matrix", "client", "r0", "capabilities"})
 	body, err := ioutil.ReadAll(res.Body)
 	if err != nil {
 		t.Fatalf("unable to read response body: %v", err)
 	}
+	c.capabilities = body
 	return body
 }
 
+// GetVersions queries the spec versions and unstable features supported by the server. The response is cached,
+// so only the first call makes a request.
+func (c *CSAPI) GetVersions(t *testing.T) []byte {
+	t.Helper()
+	if c.versions != nil {
+		return c.versions
+	}
+	res := c.MustDoFunc(t, "GET", []string{"_matrix", "client", "versions"})
+	c.versions = ParseJSON(t, res)
+	return c.versions
+}
+
+// SupportsUnstableFeature returns true if the server advertises `feature` as enabled in the `unstable_features`
+// of /versions, e.g "org.matrix.msc3030".
+func (c *CSAPI) SupportsUnstableFeature(t *testing.T, feature string) bool {
+	t.Helper()
+	return gjson.GetBytes(c.GetVersions(t), "unstable_features."+GjsonEscape(feature)).Bool()
+}
+
+// OpenIDToken is an OpenID access token, as returned by GetOpenIDToken. Third parties verify it by calling
+// /_matrix/federation/v1/openid/userinfo on MatrixServerName.
+type OpenIDToken struct {
+	AccessToken      string
+	TokenType        string
+	MatrixServerName string
+	ExpiresIn        int64
+}
+
+// GetOpenIDToken requests an OpenID access token for the user, else fails the test.
+func (c *CSAPI) GetOpenIDToken(t *testing.T) OpenIDToken {
+	t.Helper()
+	res := c.MustDoFunc(t, "POST", []string{"_matrix", "client", "v3", "user", c.UserID, "openid", "request_token"}, WithJSONBody(t, map[string]interface{}{}))
+	body := ParseJSON(t, res)
+	return OpenIDToken{
+		AccessToken:      GetJSONFieldStr(t, body, "access_token"),
+		TokenType:        GetJSONFieldStr(t, body, "token_type"),
+		MatrixServerName: GetJSONFieldStr(t, body, "matrix_server_name"),
+		ExpiresIn:        gjson.GetBytes(body, "expires_in").Int(),
+	}
+}
+
+// GetTurnServer queries the TURN server credentials for VoIP calls, returning the response. The response is not
+// checked as servers without a TURN server configured may return an error or an empty object.
+func (c *CSAPI) GetTurnServer(t *testing.T) *http.Response {
+	t.Helper()
+	return c.DoFunc(t, "GET", []string{"_matrix", "client", "v3", "voip", "turnServer"})
+}
+
 // GetDefaultRoomVersion returns the server's default room version
 func (c *CSAPI) GetDefaultRoomVersion(t *testing.T) gomatrixserverlib.RoomVersion {
 	t.Helper()
@@ -431,12 +704,40 @@ func WithJSONBody(t *testing.T, obj interface{}) RequestOpt {
 	}
 }
 
-// WithQueries sets the query parameters on the request.
+// WithQueries sets the query parameters on the request. Parameters set by earlier RequestOpts
+// are kept unless they are overwritten by a key in `q`.
 // This function should not be used to set an "access_token" parameter for Matrix authentication.
 // Instead, set CSAPI.AccessToken.
 func WithQueries(q url.Values) RequestOpt {
 	return func(req *http.Request) {
-		req.URL.RawQuery = q.Encode()
+		query := req.URL.Query()
+		for k, v := range q {
+			query[k] = v
+		}
+		req.URL.RawQuery = query.Encode()
+	}
+}
+
+// WithContext sets the context of the request to `ctx`, so the request is aborted when `ctx` is cancelled
+// or its deadline passes. This is independent of other requests made by the client, so it can be used to
+// cancel one of many concurrent requests.
+func WithContext(ctx context.Context) RequestOpt {
+	return func(req *http.Request) {
+		*req = *req.WithContext(ctx)
+	}
+}
+
+// WithTimeout aborts the request if it takes longer than `timeout`, including reading the response body.
+// This is independent of other requests made by the client, unlike setting CSAPI.Client.Timeout, so it is
+// safe to use with concurrent requests. The timeout of the underlying http.Client still applies, so `timeout`
+// can only shorten it.
+func WithTimeout(timeout time.Duration) RequestOpt {
+	return func(req *http.Request) {
+		ctx, cancel := context.WithTimeout(req.Context(), timeout)
+		// The response body may be read after DoFunc returns, so the context can't be cancelled when the
+		// request completes. Release it when the timeout passes instead.
+		time.AfterFunc(timeout, cancel)
+		*req = *req.WithContext(ctx)
 	}
 }
 
@@ -452,6 +753,59 @@ func (c *CSAPI) MustDoFunc(t *testing.T, method string, paths []string, opts ...
 	return res
 }
 
+// Burst performs the HTTP request `n` times in quick succession and returns the status code of each
+// response, in order. Rate limited requests are not retried, whatever DisableRateLimitRetries is set to.
+// Use this with must.NotRateLimited or must.RateLimitedAfter to test rate limits.
+func (c *CSAPI) Burst(t *testing.T, n int, method string, paths []string, opts ...RequestOpt) []int {
+	t.Helper()
+	// retrying would hide the 429s this is looking for
+	noRetries := *c
+	noRetries.DisableRateLimitRetries = true
+	statusCodes := make([]int, n)
+	for i := 0; i < n; i++ {
+		// DoFunc escapes the paths in place, so give it a fresh copy each time
+		res := noRetries.DoFunc(t, method, append([]string{}, paths...), opts...)
+		io.Copy(ioutil.Discard, res.Body) // nolint:errcheck
+		res.Body.Close()
+		statusCodes[i] = res.StatusCode
+	}
+	return statusCodes
+}
+
+// DoUntil repeatedly performs the HTTP request until the response matches `m`, then returns the response body.
+// Fails the test if no response matches within `timeout`, reporting why the last response did not match.
+// Use this instead of sleeping when waiting for the server to eventually reflect a change, e.g a room
+// appearing in the room directory:
+//    client.DoUntil(t, "GET", []string{"_matrix", "client", "v3", "publicRooms"}, match.HTTPResponse{
+//    	StatusCode: 200,
+//    	JSON: []match.JSON{
+//    		match.JSONCheckOffAllowUnwanted("chunk", []interface{}{roomID}, func(r gjson.Result) interface{} {
+//    			return r.Get("room_id").Str
+//    		}, nil),
+//    	},
+//    }, 5*time.Second)
+func (c *CSAPI) DoUntil(t *testing.T, method string, paths []string, m match.HTTPResponse, timeout time.Duration, opts ...RequestOpt) []byte {
+	t.Helper()
+	start := time.Now()
+	for {
+		// DoFunc escapes the paths in place, so give it a fresh copy each time
+		res := c.DoFunc(t, method, append([]string{}, paths...), opts...)
+		body, err := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		if err != nil {
+			t.Fatalf("CSAPI.DoUntil failed to read response body: %s", err)
+		}
+		err = match.CheckHTTPResponse(res, body, m)
+		if err == nil {
+			return body
+		}
+		if time.Since(start) > timeout {
+			t.Fatalf("CSAPI.DoUntil %s %s timed out after %v. Last response did not match: %s - body: %s", method, res.Request.URL.Path, timeout, err, string(body))
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
 // DoFunc performs an arbitrary HTTP request to the server. This function supports RequestOpts to set
 // extra information on the request such as an HTTP request body, query parameters and content-type.
 // See all functions in this package starting with `With...`.
@@ -487,37 +841,128 @@ func (c *CSAPI) DoFunc(t *testing.T, method string, paths []string, opts ...Requ
 	if req.Header.Get("Content-Type") == "" {
 		req.Header.Set("Content-Type", "application/json")
 	}
-	// debug log the request
+	// log the request, only to the test log file unless debugging
+	logger := testlog.ForTest(t).With("component", "client", "user", c.UserID)
+	level := testlog.LevelDebug
 	if c.Debug {
-		t.Logf("Making %s request to %s (%s)", method, req.URL, c.AccessToken)
-		contentType := req.Header.Get("Content-Type")
-		if contentType == "application/json" || strings.HasPrefix(contentType, "text/") {
-			if req.Body != nil {
-				body, _ := ioutil.ReadAll(req.Body)
-				t.Logf("Request body: %s", string(body))
-				req.Body = ioutil.NopCloser(bytes.NewBuffer(body))
-			}
-		} else {
-			t.Logf("Request body: <binary:%s>", contentType)
+		level = testlog.LevelInfo
+	}
+	logger.Logf(level, "Making %s request to %s", method, req.URL)
+	contentType := req.Header.Get("Content-Type")
+	if contentType == "application/json" || strings.HasPrefix(contentType, "text/") {
+		if req.Body != nil {
+			body, _ := ioutil.ReadAll(req.Body)
+			logger.Logf(level, "Request body: %s", string(body))
+			req.Body = ioutil.NopCloser(bytes.NewBuffer(body))
+		}
+	} else {
+		logger.Logf(level, "Request body: <binary:%s>", contentType)
+	}
+	// keep the body so the request can be retried
+	var reqBody []byte
+	if req.Body != nil {
+		reqBody, err = ioutil.ReadAll(req.Body)
+		if err != nil {
+			t.Fatalf("CSAPI.DoFunc failed to read request body: %s", err)
 		}
+		req.Body = ioutil.NopCloser(bytes.NewBuffer(reqBody))
 	}
-	// Perform the HTTP request
+	// Perform the HTTP request, retrying if it is rate limited
 	res, err := c.Client.Do(req)
+	for attempt := 0; err == nil && res.StatusCode == http.StatusTooManyRequests && c.shouldRetryRateLimited(attempt); attempt++ {
+		wait := c.rateLimitWait(res, attempt)
+		logger.Warnf("CSAPI.DoFunc %s %s was rate limited, retrying in %v", method, req.URL.Path, wait)
+		time.Sleep(wait)
+		if reqBody != nil {
+			req.Body = ioutil.NopCloser(bytes.NewBuffer(reqBody))
+		}
+		res, err = c.Client.Do(req)
+	}
 	if err != nil {
 		t.Fatalf("CSAPI.DoFunc response returned error: %s", err)
 	}
-	// debug log the response
-	if c.Debug && res != nil {
-		var dump []byte
-		dump, err = httputil.DumpResponse(res, true)
-		if err != nil {
-			t.Fatalf("CSAPI.DoFunc failed to dump response body: %s", err)
+	// log the response, and the body as it is read if debugging, as reading it here would stop it being streamed
+	var dump []byte
+	dump, err = httputil.DumpResponse(res, false)
+	if err != nil {
+		t.Fatalf("CSAPI.DoFunc failed to dump response: %s", err)
+	}
+	logger.Logf(level, "%s", string(dump))
+	if c.Debug {
+		res.Body = &loggedBody{
+			ReadCloser: res.Body,
+			log: func(body []byte) {
+				logger.Logf(level, "Response body: %s", string(body))
+			},
 		}
-		t.Logf("%s", string(dump))
 	}
 	return res
 }
 
+// loggedBody keeps a copy of a response body as it is read, and logs it when the body has been read to the
+// end or closed, whichever is first.
+type loggedBody struct {
+	io.ReadCloser
+	log  func(body []byte)
+	mu   sync.Mutex
+	buf  bytes.Buffer
+	once sync.Once
+}
+
+func (b *loggedBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.mu.Lock()
+	b.buf.Write(p[:n])
+	b.mu.Unlock()
+	if err != nil {
+		b.finish()
+	}
+	return n, err
+}
+
+func (b *loggedBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.finish()
+	return err
+}
+
+func (b *loggedBody) finish() {
+	b.once.Do(func() {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		b.log(b.buf.Bytes())
+	})
+}
+
+func (c *CSAPI) shouldRetryRateLimited(attempt int) bool {
+	if c.DisableRateLimitRetries {
+		return false
+	}
+	retries := c.RateLimitRetries
+	if retries == 0 {
+		retries = 5
+	}
+	return attempt < retries
+}
+
+// rateLimitWait returns how long to wait before retrying the rate limited response `res`, consuming its body.
+func (c *CSAPI) rateLimitWait(res *http.Response, attempt int) time.Duration {
+	body, _ := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	wait := time.Duration(gjson.GetBytes(body, "retry_after_ms").Int()) * time.Millisecond
+	if wait <= 0 {
+		wait = c.RateLimitBackoff
+		if wait == 0 {
+			wait = 100 * time.Millisecond
+		}
+		wait <<= attempt
+	}
+	if wait > maxRateLimitWait {
+		wait = maxRateLimitWait
+	}
+	return wait
+}
+
 // NewLoggedClient returns an http.Client which logs requests/responses
 func NewLoggedClient(t *testing.T, hsName string, cli *http.Client) *http.Client {
 	t.Helper()
@@ -543,11 +988,14 @@ type loggedRoundTripper struct {
 func (t *loggedRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
 	start := time.Now()
 	res, err := t.wrap.RoundTrip(req)
+	var summary string
 	if err != nil {
-		t.t.Logf("%s %s%s => error: %s (%s)", req.Method, t.hsName, req.URL.Path, err, time.Since(start))
+		summary = fmt.Sprintf("%s %s%s => error: %s (%s)", req.Method, t.hsName, req.URL.Path, err, time.Since(start))
 	} else {
-		t.t.Logf("%s %s%s => %s (%s)", req.Method, t.hsName, req.URL.Path, res.Status, time.Since(start))
+		summary = fmt.Sprintf("%s %s%s => %s (%s)", req.Method, t.hsName, req.URL.Path, res.Status, time.Since(start))
 	}
+	testlog.ForTest(t.t).With("component", "client", "hs", t.hsName).Infof("%s", summary)
+	watchdog.RecordHTTP(t.t, summary)
 	return res, err
 }
 
@@ -628,6 +1076,20 @@ func SyncTimelineHasEventID(roomID string, eventID string) SyncCheckOpt {
 	})
 }
 
+// Check that the timeline for `roomID` has the event `eventID`, and that it passes all the `matchers`.
+// This can be used to check the bundled aggregations of an event, e.g with match.JSONThreadSummary.
+func SyncTimelineEventMatches(roomID, eventID string, matchers ...match.JSON) SyncCheckOpt {
+	return func(clientUserID string, topLevelSyncJSON gjson.Result) error {
+		err := match.JSONArrayEventMatches(
+			"rooms.join."+GjsonEscape(roomID)+".timeline.events", eventID, matchers...,
+		)([]byte(topLevelSyncJSON.Raw))
+		if err == nil {
+			return nil
+		}
+		return fmt.Errorf("SyncTimelineEventMatches(%s): %s", roomID, err)
+	}
+}
+
 // Checks that `userID` gets invited to `roomID`.
 //
 // This checks different parts of the /sync response depending on the client making the request.
@@ -695,6 +1157,153 @@ func SyncLeftFrom(userID, roomID string) SyncCheckOpt {
 	}
 }
 
+// Checks that the latest m.typing event for `roomID` lists exactly the users in `userIDs`, in any order.
+// An empty `userIDs` checks that nobody is typing, e.g after a typing notification has timed out.
+func SyncUsersTyping(roomID string, userIDs []string) SyncCheckOpt {
+	return func(clientUserID string, topLevelSyncJSON gjson.Result) error {
+		key := "rooms.join." + GjsonEscape(roomID) + ".ephemeral.events"
+		array := topLevelSyncJSON.Get(key)
+		if !array.IsArray() {
+			return fmt.Errorf("SyncUsersTyping(%s): Key %s does not exist or isn't an array", roomID, key)
+		}
+		var typing gjson.Result
+		for _, ev := range array.Array() {
+			if ev.Get("type").Str == "m.typing" {
+				typing = ev
+			}
+		}
+		if !typing.Exists() {
+			return fmt.Errorf("SyncUsersTyping(%s): no m.typing event", roomID)
+		}
+		want := make(map[string]bool, len(userIDs))
+		for _, userID := range userIDs {
+			want[userID] = true
+		}
+		got := typing.Get("content.user_ids").Array()
+		if len(got) != len(want) {
+			return fmt.Errorf("SyncUsersTyping(%s): got typing users %s, want %v", roomID, typing.Get("content.user_ids").Raw, userIDs)
+		}
+		for _, userID := range got {
+			if !want[userID.Str] {
+				return fmt.Errorf("SyncUsersTyping(%s): got typing users %s, want %v", roomID, typing.Get("content.user_ids").Raw, userIDs)
+			}
+		}
+		return nil
+	}
+}
+
+// Checks that the ephemeral events for `roomID` include a receipt of type `receiptType` by `userID` for `eventID`.
+// Private receipts are only visible to the user who sent them.
+func SyncReceiptHas(roomID, userID, receiptType, eventID string) SyncCheckOpt {
+	return syncReceiptHas(roomID, userID, receiptType, eventID, nil)
+}
+
+// Checks that the ephemeral events for `roomID` include a receipt of type `receiptType` by `userID` for `eventID`
+// in the thread `threadID`, which is "main" for the main timeline. Receipts without a thread ID do not pass.
+func SyncThreadedReceiptHas(roomID, userID, receiptType, eventID, threadID string) SyncCheckOpt {
+	return syncReceiptHas(roomID, userID, receiptType, eventID, &threadID)
+}
+
+func syncReceiptHas(roomID, userID, receiptType, eventID string, threadID *string) SyncCheckOpt {
+	return func(clientUserID string, topLevelSyncJSON gjson.Result) error {
+		receiptKey := GjsonEscape(eventID) + "." + GjsonEscape(receiptType) + "." + GjsonEscape(userID)
+		err := loopArray(
+			topLevelSyncJSON, "rooms.join."+GjsonEscape(roomID)+".ephemeral.events",
+			func(ev gjson.Result) bool {
+				if ev.Get("type").Str != "m.receipt" {
+					return false
+				}
+				receipt := ev.Get("content." + receiptKey)
+				if !receipt.Exists() {
+					return false
+				}
+				return threadID == nil || receipt.Get("thread_id").Str == *threadID
+			},
+		)
+		if err == nil {
+			return nil
+		}
+		return fmt.Errorf("SyncReceiptHas(%s,%s,%s,%s): %s", roomID, userID, receiptType, eventID, err)
+	}
+}
+
+// Checks that the unread notification counts for `roomID` are exactly `notificationCount` and `highlightCount`,
+// e.g to check that the counts are reset to 0 after sending a receipt. The room must be in the /sync response.
+func SyncUnreadNotificationsAre(roomID string, notificationCount, highlightCount int64) SyncCheckOpt {
+	return func(clientUserID string, topLevelSyncJSON gjson.Result) error {
+		room := topLevelSyncJSON.Get("rooms.join." + GjsonEscape(roomID))
+		if !room.Exists() {
+			return fmt.Errorf("SyncUnreadNotificationsAre(%s): room not in join section", roomID)
+		}
+		return checkNotificationCounts(room.Get("unread_notifications"), roomID, notificationCount, highlightCount)
+	}
+}
+
+// Checks that the unread notification counts for the thread `threadID` in `roomID` are exactly `notificationCount`
+// and `highlightCount`. Threads without unread notifications may be omitted from /sync, which counts as 0. The room
+// must be in the /sync response.
+func SyncUnreadThreadNotificationsAre(roomID, threadID string, notificationCount, highlightCount int64) SyncCheckOpt {
+	return func(clientUserID string, topLevelSyncJSON gjson.Result) error {
+		room := topLevelSyncJSON.Get("rooms.join." + GjsonEscape(roomID))
+		if !room.Exists() {
+			return fmt.Errorf("SyncUnreadThreadNotificationsAre(%s): room not in join section", roomID)
+		}
+		counts := room.Get("unread_thread_notifications." + GjsonEscape(threadID))
+		if !counts.Exists() {
+			// servers may only implement the unstable prefix of MSC3773
+			counts = room.Get("org\\.matrix\\.msc3773\\.unread_thread_notifications." + GjsonEscape(threadID))
+		}
+		return checkNotificationCounts(counts, roomID+" "+threadID, notificationCount, highlightCount)
+	}
+}
+
+func checkNotificationCounts(counts gjson.Result, name string, notificationCount, highlightCount int64) error {
+	// missing counts are 0
+	gotNotif := counts.Get("notification_count").Int()
+	gotHighlight := counts.Get("highlight_count").Int()
+	if gotNotif != notificationCount || gotHighlight != highlightCount {
+		return fmt.Errorf(
+			"unread notifications for %s: got notification_count=%d highlight_count=%d, want notification_count=%d highlight_count=%d",
+			name, gotNotif, gotHighlight, notificationCount, highlightCount,
+		)
+	}
+	return nil
+}
+
+// Calls the `check` function for each room account data event in `roomID`, and returns with success if the
+// `check` function returns true for at least one event.
+func SyncRoomAccountDataHas(roomID string, check func(gjson.Result) bool) SyncCheckOpt {
+	return func(clientUserID string, topLevelSyncJSON gjson.Result) error {
+		err := loopArray(topLevelSyncJSON, "rooms.join."+GjsonEscape(roomID)+".account_data.events", check)
+		if err == nil {
+			return nil
+		}
+		return fmt.Errorf("SyncRoomAccountDataHas(%s): %s", roomID, err)
+	}
+}
+
+// Checks that `roomID` has the tag `tag` in its m.tag room account data.
+func SyncRoomHasTag(roomID, tag string) SyncCheckOpt {
+	return SyncRoomAccountDataHas(roomID, func(ev gjson.Result) bool {
+		return ev.Get("type").Str == "m.tag" && ev.Get("content.tags."+GjsonEscape(tag)).Exists()
+	})
+}
+
+// Checks that `roomID` has an m.tag room account data event which does not have the tag `tag`, e.g after
+// the tag has been removed.
+func SyncRoomHasNoTag(roomID, tag string) SyncCheckOpt {
+	return SyncRoomAccountDataHas(roomID, func(ev gjson.Result) bool {
+		return ev.Get("type").Str == "m.tag" && !ev.Get("content.tags."+GjsonEscape(tag)).Exists()
+	})
+}
+
+// Checks that the m.fully_read marker in `roomID` is at `eventID`.
+func SyncFullyReadIs(roomID, eventID string) SyncCheckOpt {
+	return SyncRoomAccountDataHas(roomID, func(ev gjson.Result) bool {
+		return ev.Get("type").Str == "m.fully_read" && ev.Get("content.event_id").Str == eventID
+	})
+}
+
 // Calls the `check` function for each global account data event, and returns with success if the
 // `check` function returns true for at least one event.
 func SyncGlobalAccountDataHas(check func(gjson.Result) bool) SyncCheckOpt {
@@ -703,6 +1312,141 @@ func SyncGlobalAccountDataHas(check func(gjson.Result) bool) SyncCheckOpt {
 	}
 }
 
+// Checks that the m.ignored_user_list account data lists exactly the users in `userIDs`, in any order.
+func SyncIgnoredUsersAre(userIDs ...string) SyncCheckOpt {
+	return func(clientUserID string, topLevelSyncJSON gjson.Result) error {
+		err := loopArray(topLevelSyncJSON, "account_data.events", func(ev gjson.Result) bool {
+			if ev.Get("type").Str != "m.ignored_user_list" {
+				return false
+			}
+			ignored := ev.Get("content.ignored_users").Map()
+			if len(ignored) != len(userIDs) {
+				return false
+			}
+			for _, userID := range userIDs {
+				if _, ok := ignored[userID]; !ok {
+					return false
+				}
+			}
+			return true
+		})
+		if err == nil {
+			return nil
+		}
+		return fmt.Errorf("SyncIgnoredUsersAre(%v): %s", userIDs, err)
+	}
+}
+
+// Checks that the timeline for `roomID` reaches `eventID` without returning any events sent by `sender`,
+// e.g because `sender` is ignored. `eventID` should be sent after the events which are expected to be hidden,
+// so that they would have been returned by the time this check passes. Once an event from `sender` is seen
+// this check never passes, so MustSyncUntil fails. As this check is stateful, don't reuse it between calls
+// to MustSyncUntil.
+func SyncTimelineHasEventIDWithoutSender(roomID, eventID, sender string) SyncCheckOpt {
+	var seen string
+	return func(clientUserID string, topLevelSyncJSON gjson.Result) error {
+		if seen != "" {
+			return fmt.Errorf("SyncTimelineHasEventIDWithoutSender(%s): saw event %s from %s", roomID, seen, sender)
+		}
+		found := false
+		for _, ev := range topLevelSyncJSON.Get("rooms.join." + GjsonEscape(roomID) + ".timeline.events").Array() {
+			if ev.Get("sender").Str == sender {
+				seen = ev.Get("event_id").Str
+				return fmt.Errorf("SyncTimelineHasEventIDWithoutSender(%s): saw event %s from %s", roomID, seen, sender)
+			}
+			if ev.Get("event_id").Str == eventID {
+				found = true
+			}
+		}
+		if !found {
+			return fmt.Errorf("SyncTimelineHasEventIDWithoutSender(%s): event %s not in timeline", roomID, eventID)
+		}
+		return nil
+	}
+}
+
+// Checks that `userID` gets invited to `roomID` without being told about invites to any of `hiddenRoomIDs`,
+// e.g because the inviter is ignored. The invite to `roomID` should be sent after the hidden invites, so that
+// they would have been returned by the time this check passes. Once an invite to a hidden room is seen this
+// check never passes, so MustSyncUntil fails. As this check is stateful, don't reuse it between calls to
+// MustSyncUntil.
+func SyncInvitedToWithout(userID, roomID string, hiddenRoomIDs ...string) SyncCheckOpt {
+	invited := SyncInvitedTo(userID, roomID)
+	var seen string
+	return func(clientUserID string, topLevelSyncJSON gjson.Result) error {
+		if seen == "" {
+			for _, hiddenRoomID := range hiddenRoomIDs {
+				if topLevelSyncJSON.Get("rooms.invite." + GjsonEscape(hiddenRoomID)).Exists() {
+					seen = hiddenRoomID
+					break
+				}
+			}
+		}
+		if seen != "" {
+			return fmt.Errorf("SyncInvitedToWithout(%s): saw invite to hidden room %s", roomID, seen)
+		}
+		return invited(clientUserID, topLevelSyncJSON)
+	}
+}
+
+// Checks that the timeline for `roomID` has an m.call.member event (MSC3401/MSC4143) for `deviceID` of `userID`
+// which is an unexpired membership of a call. Expiry is relative to the origin_server_ts of the event, so this
+// relies on the clocks of the test and the server roughly agreeing.
+func SyncCallMemberActive(roomID, userID, deviceID string) SyncCheckOpt {
+	stateKey := b.CallMemberStateKey(userID, deviceID)
+	return func(clientUserID string, topLevelSyncJSON gjson.Result) error {
+		err := SyncTimelineHas(roomID, func(ev gjson.Result) bool {
+			if ev.Get("type").Str != "m.call.member" || ev.Get("state_key").Str != stateKey {
+				return false
+			}
+			expires := ev.Get("content.expires")
+			if !expires.Exists() {
+				return false
+			}
+			expiresAt := time.Unix(0, (ev.Get("origin_server_ts").Int()+expires.Int())*int64(time.Millisecond))
+			return time.Now().Before(expiresAt)
+		})(clientUserID, topLevelSyncJSON)
+		if err == nil {
+			return nil
+		}
+		return fmt.Errorf("SyncCallMemberActive(%s,%s,%s): %s", roomID, userID, deviceID, err)
+	}
+}
+
+// Checks that the timeline for `roomID` has an m.call.member event for `deviceID` of `userID` with empty content,
+// which means the device has left the call.
+func SyncCallMemberLeft(roomID, userID, deviceID string) SyncCheckOpt {
+	stateKey := b.CallMemberStateKey(userID, deviceID)
+	return func(clientUserID string, topLevelSyncJSON gjson.Result) error {
+		err := SyncTimelineHas(roomID, func(ev gjson.Result) bool {
+			return ev.Get("type").Str == "m.call.member" && ev.Get("state_key").Str == stateKey &&
+				len(ev.Get("content").Map()) == 0
+		})(clientUserID, topLevelSyncJSON)
+		if err == nil {
+			return nil
+		}
+		return fmt.Errorf("SyncCallMemberLeft(%s,%s,%s): %s", roomID, userID, deviceID, err)
+	}
+}
+
+// Checks that a presence event for `userID` passes the `check` function. The `check` function is given the
+// whole presence event, so should inspect `content.presence`, `content.status_msg` etc. A nil `check`
+// passes for any presence event for the user.
+func SyncPresenceHas(userID string, check func(gjson.Result) bool) SyncCheckOpt {
+	return func(clientUserID string, topLevelSyncJSON gjson.Result) error {
+		err := loopArray(topLevelSyncJSON, "presence.events", func(ev gjson.Result) bool {
+			if ev.Get("type").Str != "m.presence" || ev.Get("sender").Str != userID {
+				return false
+			}
+			return check == nil || check(ev)
+		})
+		if err == nil {
+			return nil
+		}
+		return fmt.Errorf("SyncPresenceHas(%s): %s", userID, err)
+	}
+}
+
 func loopArray(object gjson.Result, key string, check func(gjson.Result) bool) error {
 	array := object.Get(key)
 	if !array.Exists() {
@@ -0,0 +1,193 @@
+package client
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/complement/internal/b"
+	"github.com/matrix-org/complement/internal/must"
+)
+
+// rateLimitedServer allows `burst` requests then rate limits the rest, counting them in `requests`.
+func rateLimitedServer(burst int64, requests *int64) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if atomic.AddInt64(requests, 1) > burst {
+			w.WriteHeader(http.StatusTooManyRequests)
+			w.Write([]byte(`{"errcode":"M_LIMIT_EXCEEDED","retry_after_ms":1}`)) // nolint:errcheck
+			return
+		}
+		w.Write([]byte(`{}`)) // nolint:errcheck
+	}))
+}
+
+func TestBurstIsNotRetried(t *testing.T) {
+	var requests int64
+	srv := rateLimitedServer(3, &requests)
+	defer srv.Close()
+	c := &CSAPI{
+		BaseURL:          srv.URL,
+		Client:           &http.Client{Timeout: 5 * time.Second},
+		RateLimitBackoff: time.Millisecond,
+	}
+	statusCodes := c.Burst(t, 5, "GET", []string{"_matrix", "client", "v3", "profile", "@alice:hs1"})
+	want := []int{200, 200, 200, 429, 429}
+	for i := range want {
+		if statusCodes[i] != want[i] {
+			t.Fatalf("Burst returned %v, want %v", statusCodes, want)
+		}
+	}
+	must.RateLimitedAfter(t, statusCodes, 3)
+	if got := atomic.LoadInt64(&requests); got != 5 {
+		t.Errorf("server got %d requests, want 5 as rate limited requests aren't retried", got)
+	}
+	if c.DisableRateLimitRetries {
+		t.Errorf("Burst changed DisableRateLimitRetries of the client")
+	}
+}
+
+func TestDoFuncRetriesRateLimited(t *testing.T) {
+	var requests int64
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if atomic.AddInt64(&requests, 1) == 1 {
+			w.WriteHeader(http.StatusTooManyRequests)
+			w.Write([]byte(`{"errcode":"M_LIMIT_EXCEEDED","retry_after_ms":1}`)) // nolint:errcheck
+			return
+		}
+		w.Write([]byte(`{}`)) // nolint:errcheck
+	}))
+	defer srv.Close()
+	c := &CSAPI{
+		BaseURL: srv.URL,
+		Client:  &http.Client{Timeout: 5 * time.Second},
+	}
+	res := c.DoFunc(t, "GET", []string{"_matrix", "client", "versions"})
+	res.Body.Close()
+	if res.StatusCode != 200 {
+		t.Errorf("DoFunc returned %d after a rate limited request, want it retried until 200", res.StatusCode)
+	}
+	if got := atomic.LoadInt64(&requests); got != 2 {
+		t.Errorf("server got %d requests, want 2", got)
+	}
+}
+
+func TestDebugStreamsResponseBody(t *testing.T) {
+	release := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(200)
+		w.(http.Flusher).Flush()
+		<-release
+		w.Write([]byte(`{}`)) // nolint:errcheck
+	}))
+	defer srv.Close()
+	defer close(release)
+	c := &CSAPI{
+		BaseURL: srv.URL,
+		Client:  &http.Client{Timeout: 5 * time.Second},
+		Debug:   true,
+	}
+	start := time.Now()
+	res := c.DoFunc(t, "GET", []string{"_matrix", "client", "versions"})
+	defer res.Body.Close()
+	if took := time.Since(start); took > 2*time.Second {
+		t.Errorf("DoFunc took %v, it read the body before returning", took)
+	}
+}
+
+func TestGetOpenIDToken(t *testing.T) {
+	var gotPath string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		gotPath = req.URL.Path
+		w.Write([]byte(`{"access_token":"abc","token_type":"Bearer","matrix_server_name":"hs1","expires_in":3600}`)) // nolint:errcheck
+	}))
+	defer srv.Close()
+	c := &CSAPI{
+		UserID:  "@alice:hs1",
+		BaseURL: srv.URL,
+		Client:  &http.Client{Timeout: 5 * time.Second},
+	}
+	token := c.GetOpenIDToken(t)
+	if gotPath != "/_matrix/client/v3/user/@alice:hs1/openid/request_token" {
+		t.Errorf("requested %s, want the user's request_token endpoint", gotPath)
+	}
+	want := OpenIDToken{
+		AccessToken:      "abc",
+		TokenType:        "Bearer",
+		MatrixServerName: "hs1",
+		ExpiresIn:        3600,
+	}
+	if token != want {
+		t.Errorf("got %+v want %+v", token, want)
+	}
+}
+
+func TestSendEventWithTimestamp(t *testing.T) {
+	var gotTS string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		gotTS = req.URL.Query().Get("ts")
+		w.Write([]byte(`{"event_id":"$event"}`)) // nolint:errcheck
+	}))
+	defer srv.Close()
+	c := &CSAPI{
+		BaseURL: srv.URL,
+		Client:  &http.Client{Timeout: 5 * time.Second},
+	}
+	testCases := []struct {
+		timestamp time.Time
+		wantTS    string
+	}{
+		{wantTS: ""},
+		{timestamp: time.Unix(1600000000, 123456789), wantTS: "1600000000123"},
+	}
+	for _, tc := range testCases {
+		c.SendEventUnsynced(t, "!room:hs1", b.Event{
+			Type:      "m.room.message",
+			Content:   map[string]interface{}{"body": "hello"},
+			Timestamp: tc.timestamp,
+		})
+		if gotTS != tc.wantTS {
+			t.Errorf("timestamp %v: sent ts=%q want %q", tc.timestamp, gotTS, tc.wantTS)
+		}
+	}
+}
+
+func TestMustWalkMessagesContinuesPastEmptyPages(t *testing.T) {
+	// dir -> from -> page, where some pages are empty as their events were filtered out
+	pages := map[string]map[string]string{
+		"b": {
+			"":   `{"chunk":[{"event_id":"$3"},{"event_id":"$2"}],"end":"b1"}`,
+			"b1": `{"chunk":[],"end":"b2"}`,
+			"b2": `{"chunk":[{"event_id":"$1"}]}`,
+		},
+		"f": {
+			"":   `{"chunk":[{"event_id":"$1"}],"end":"f1"}`,
+			"f1": `{"chunk":[],"end":"f2"}`,
+			"f2": `{"chunk":[{"event_id":"$2"},{"event_id":"$3"}]}`,
+		},
+	}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		page, ok := pages[req.URL.Query().Get("dir")][req.URL.Query().Get("from")]
+		if !ok {
+			w.WriteHeader(400)
+			w.Write([]byte(`{"errcode":"M_INVALID_PARAM"}`)) // nolint:errcheck
+			return
+		}
+		w.Write([]byte(page)) // nolint:errcheck
+	}))
+	defer srv.Close()
+	c := &CSAPI{
+		BaseURL: srv.URL,
+		Client:  &http.Client{Timeout: 5 * time.Second},
+	}
+	events := c.MustWalkMessages(t, "!room:hs1", MessagesWalkOpts{Limit: 2})
+	var got []string
+	for _, ev := range events {
+		got = append(got, ev.Get("event_id").Str)
+	}
+	if want := []string{"$1", "$2", "$3"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got events %v want %v", got, want)
+	}
+}
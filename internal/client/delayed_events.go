@@ -0,0 +1,108 @@
+package client
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/tidwall/gjson"
+
+	"github.com/matrix-org/complement/internal/b"
+)
+
+// The actions which can be taken on a scheduled delayed event (MSC4140) with UpdateDelayedEvent.
+const (
+	DelayedEventActionCancel  = "cancel"
+	DelayedEventActionRestart = "restart"
+	DelayedEventActionSend    = "send"
+)
+
+// SendDelayedEvent schedules `e` to be sent into `roomID` after `delay` (MSC4140), else fails the test.
+// State events are sent if `e` has a StateKey. Returns the delay ID of the scheduled event.
+func (c *CSAPI) SendDelayedEvent(t *testing.T, roomID string, e b.Event, delay time.Duration) string {
+	t.Helper()
+	c.txnID++
+	paths := []string{"_matrix", "client", "v3", "rooms", roomID, "send", e.Type, strconv.Itoa(c.txnID)}
+	if e.StateKey != nil {
+		paths = []string{"_matrix", "client", "v3", "rooms", roomID, "state", e.Type, *e.StateKey}
+	}
+	res := c.MustDoFunc(t, "PUT", paths, WithJSONBody(t, e.Content), WithQueries(url.Values{
+		"org.matrix.msc4140.delay": []string{strconv.FormatInt(delay.Milliseconds(), 10)},
+	}))
+	return GetJSONFieldStr(t, ParseJSON(t, res), "delay_id")
+}
+
+// GetDelayedEvents lists the delayed events of the user which have not been sent or cancelled yet, else fails
+// the test.
+func (c *CSAPI) GetDelayedEvents(t *testing.T) []gjson.Result {
+	t.Helper()
+	res := c.MustDoFunc(t, "GET", []string{"_matrix", "client", "unstable", "org.matrix.msc4140", "delayed_events"})
+	return gjson.GetBytes(ParseJSON(t, res), "delayed_events").Array()
+}
+
+// UpdateDelayedEvent takes `action` on the delayed event `delayID`, returning the response. `action` is one of
+// the DelayedEventAction constants. The response is not checked so this can be used to test failure modes,
+// e.g updating a delayed event which has already been sent.
+func (c *CSAPI) UpdateDelayedEvent(t *testing.T, delayID, action string) *http.Response {
+	t.Helper()
+	return c.DoFunc(t, "POST", []string{"_matrix", "client", "unstable", "org.matrix.msc4140", "delayed_events", delayID}, WithJSONBody(t, map[string]interface{}{
+		"action": action,
+	}))
+}
+
+// MustCancelDelayedEvent cancels the delayed event `delayID` so it is never sent, else fails the test.
+func (c *CSAPI) MustCancelDelayedEvent(t *testing.T, delayID string) {
+	t.Helper()
+	c.mustUpdateDelayedEvent(t, delayID, DelayedEventActionCancel)
+}
+
+// MustRestartDelayedEvent restarts the delay of the delayed event `delayID`, so it is sent after its original
+// delay from now, else fails the test.
+func (c *CSAPI) MustRestartDelayedEvent(t *testing.T, delayID string) {
+	t.Helper()
+	c.mustUpdateDelayedEvent(t, delayID, DelayedEventActionRestart)
+}
+
+// MustSendDelayedEventNow sends the delayed event `delayID` immediately, else fails the test.
+func (c *CSAPI) MustSendDelayedEventNow(t *testing.T, delayID string) {
+	t.Helper()
+	c.mustUpdateDelayedEvent(t, delayID, DelayedEventActionSend)
+}
+
+func (c *CSAPI) mustUpdateDelayedEvent(t *testing.T, delayID, action string) {
+	t.Helper()
+	c.MustDoFunc(t, "POST", []string{"_matrix", "client", "unstable", "org.matrix.msc4140", "delayed_events", delayID}, WithJSONBody(t, map[string]interface{}{
+		"action": action,
+	}))
+}
+
+// Checks that the timeline for `roomID` has an event which passes the `check` function and was sent no earlier
+// than `notBefore`, e.g the time a delayed event was scheduled plus its delay. Matching events which were sent
+// too early cause the check to fail. The origin_server_ts of the event is compared, so this relies on the clocks
+// of the test and the server roughly agreeing.
+func SyncDelayedEventSent(roomID string, notBefore time.Time, check func(gjson.Result) bool) SyncCheckOpt {
+	notBeforeMillis := notBefore.UnixNano() / int64(time.Millisecond)
+	return func(clientUserID string, topLevelSyncJSON gjson.Result) error {
+		var early []string
+		err := SyncTimelineHas(roomID, func(ev gjson.Result) bool {
+			if !check(ev) {
+				return false
+			}
+			if ev.Get("origin_server_ts").Int() < notBeforeMillis {
+				early = append(early, ev.Get("event_id").Str)
+				return false
+			}
+			return true
+		})(clientUserID, topLevelSyncJSON)
+		if err == nil {
+			return nil
+		}
+		if len(early) > 0 {
+			return fmt.Errorf("SyncDelayedEventSent(%s): events %v were sent before %v", roomID, early, notBefore)
+		}
+		return fmt.Errorf("SyncDelayedEventSent(%s): %s", roomID, err)
+	}
+}
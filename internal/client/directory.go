@@ -0,0 +1,106 @@
+package client
+
+import (
+	"encoding/json"
+	"net/url"
+	"testing"
+
+	"github.com/tidwall/gjson"
+)
+
+// SetRoomVisibility publishes (visibility "public") or unpublishes (visibility "private") `roomID` in the
+// room directory, else fails the test.
+func (c *CSAPI) SetRoomVisibility(t *testing.T, roomID, visibility string) {
+	t.Helper()
+	c.MustDoFunc(t, "PUT", []string{"_matrix", "client", "r0", "directory", "list", "room", roomID}, WithJSONBody(t, map[string]interface{}{
+		"visibility": visibility,
+	}))
+}
+
+// GetRoomVisibility returns the visibility of `roomID` in the room directory, else fails the test.
+func (c *CSAPI) GetRoomVisibility(t *testing.T, roomID string) string {
+	t.Helper()
+	res := c.MustDoFunc(t, "GET", []string{"_matrix", "client", "r0", "directory", "list", "room", roomID})
+	return GetJSONFieldStr(t, ParseJSON(t, res), "visibility")
+}
+
+// PublicRoomsReq contains the /publicRooms request configuration options. The empty struct `PublicRoomsReq{}`
+// is valid which will return the first page of the local room directory.
+type PublicRoomsReq struct {
+	// The server to fetch the room directory of. If empty, the local server is used.
+	Server string
+	// Only return rooms with this term in their name, topic or aliases.
+	Filter string
+	// The maximum number of rooms per page. If 0, the server decides.
+	Limit int
+	// If true, follow `next_batch` until all pages have been fetched.
+	Paginate bool
+}
+
+// PublicRooms is the response from QueryPublicRooms.
+type PublicRooms struct {
+	// All the rooms returned, in the order they were returned
+	Rooms []gjson.Result
+	// The total_room_count_estimate from the first page, or -1 if it was not present
+	TotalRoomCountEstimate int64
+	// The number of pages fetched
+	Pages int
+	// A JSON object with a `chunk` of all the rooms and the `total_room_count_estimate`, so the
+	// same matchers can be used for paginated and unpaginated requests, e.g with must.MatchJSONBytes
+	Raw []byte
+}
+
+// QueryPublicRooms fetches the room directory using POST /publicRooms, else fails the test.
+func (c *CSAPI) QueryPublicRooms(t *testing.T, req PublicRoomsReq) PublicRooms {
+	t.Helper()
+	query := url.Values{}
+	if req.Server != "" {
+		query.Set("server", req.Server)
+	}
+	result := PublicRooms{
+		TotalRoomCountEstimate: -1,
+	}
+	since := ""
+	for {
+		body := map[string]interface{}{}
+		if req.Limit > 0 {
+			body["limit"] = req.Limit
+		}
+		if req.Filter != "" {
+			body["filter"] = map[string]interface{}{
+				"generic_search_term": req.Filter,
+			}
+		}
+		if since != "" {
+			body["since"] = since
+		}
+		res := c.MustDoFunc(t, "POST", []string{"_matrix", "client", "r0", "publicRooms"}, WithQueries(query), WithJSONBody(t, body))
+		page := gjson.ParseBytes(ParseJSON(t, res))
+		if result.Pages == 0 && page.Get("total_room_count_estimate").Exists() {
+			result.TotalRoomCountEstimate = page.Get("total_room_count_estimate").Int()
+		}
+		result.Pages++
+		result.Rooms = append(result.Rooms, page.Get("chunk").Array()...)
+		since = page.Get("next_batch").Str
+		if !req.Paginate || since == "" {
+			break
+		}
+	}
+
+	chunk := make([]json.RawMessage, len(result.Rooms))
+	for i, room := range result.Rooms {
+		chunk[i] = json.RawMessage(room.Raw)
+	}
+	raw := map[string]interface{}{
+		"chunk": chunk,
+	}
+	if result.TotalRoomCountEstimate >= 0 {
+		raw["total_room_count_estimate"] = result.TotalRoomCountEstimate
+	}
+	var err error
+	result.Raw, err = json.Marshal(raw)
+	if err != nil {
+		t.Fatalf("QueryPublicRooms: failed to marshal rooms: %s", err)
+	}
+	return result
+}
@@ -0,0 +1,160 @@
+package client
+
+import (
+	"net/url"
+	"strconv"
+	"testing"
+
+	"github.com/tidwall/gjson"
+)
+
+// MessagesWalkOpts configures MustWalkMessages. The empty struct is valid and walks the entire room
+// history visible to the user, 10 events at a time.
+type MessagesWalkOpts struct {
+	// The token to start walking backwards from. If empty, starts from the latest event in the room.
+	From string
+	// The maximum number of events per page. Defaults to 10.
+	Limit int
+	// A JSON encoded RoomEventFilter to apply to every page.
+	Filter string
+}
+
+// MustWalkMessages paginates backwards through /messages in `roomID` until a page has no `end` token,
+// then paginates forwards from the start of the room. Pages may be empty, e.g when every event in them
+// was filtered out, so only a missing `end` token stops the walk. Returns the events seen when paginating backwards,
+// oldest first. Fails the test if:
+//   - any event is returned more than once when paginating in the same direction,
+//   - a page returns more than `Limit` events,
+//   - requesting the same page twice returns different events,
+//   - paginating forwards does not return the same events in the reverse order, which means there are
+//     gaps in one of the directions or the two directions disagree on the topological ordering.
+//
+// Events sent whilst walking may be returned when paginating forwards and are ignored.
+func (c *CSAPI) MustWalkMessages(t *testing.T, roomID string, opts MessagesWalkOpts) []gjson.Result {
+	t.Helper()
+	if opts.Limit == 0 {
+		opts.Limit = 10
+	}
+	backwards := c.walkMessages(t, roomID, "b", opts.From, opts)
+	forwards := c.walkMessages(t, roomID, "f", "", opts)
+
+	// reverse so both are oldest first
+	for i, j := 0, len(backwards)-1; i < j; i, j = i+1, j-1 {
+		backwards[i], backwards[j] = backwards[j], backwards[i]
+	}
+	if len(forwards) < len(backwards) {
+		t.Fatalf("MustWalkMessages: paginating backwards returned %d events but forwards only returned %d", len(backwards), len(forwards))
+	}
+	for i := range backwards {
+		gotID := forwards[i].Get("event_id").Str
+		wantID := backwards[i].Get("event_id").Str
+		if gotID != wantID {
+			t.Fatalf(
+				"MustWalkMessages: paginating forwards returned %s at position %d but paginating backwards returned %s",
+				gotID, i, wantID,
+			)
+		}
+	}
+	return backwards
+}
+
+// walkMessages paginates through /messages in the direction `dir` until a page has no `end` token, checking
+// for duplicate events and that each page is stable. Returns events in the order they were returned.
+func (c *CSAPI) walkMessages(t *testing.T, roomID, dir, from string, opts MessagesWalkOpts) []gjson.Result {
+	t.Helper()
+	var events []gjson.Result
+	seen := make(map[string]bool)
+	for {
+		page := c.messagesPage(t, roomID, dir, from, opts)
+		chunk := page.Get("chunk").Array()
+		if len(chunk) > opts.Limit {
+			t.Fatalf("MustWalkMessages: dir=%s from=%s returned %d events, more than the limit %d", dir, from, len(chunk), opts.Limit)
+		}
+		// the same token should always return the same events
+		again := c.messagesPage(t, roomID, dir, from, opts).Get("chunk").Array()
+		if len(again) < len(chunk) {
+			t.Fatalf("MustWalkMessages: dir=%s from=%s returned %d events then %d events", dir, from, len(chunk), len(again))
+		}
+		for i, ev := range chunk {
+			eventID := ev.Get("event_id").Str
+			if again[i].Get("event_id").Str != eventID {
+				t.Fatalf(
+					"MustWalkMessages: dir=%s from=%s is not stable, returned %s then %s at position %d",
+					dir, from, eventID, again[i].Get("event_id").Str, i,
+				)
+			}
+			if seen[eventID] {
+				t.Fatalf("MustWalkMessages: dir=%s from=%s returned duplicate event %s", dir, from, eventID)
+			}
+			seen[eventID] = true
+			events = append(events, ev)
+		}
+		end := page.Get("end").Str
+		if end == "" {
+			return events
+		}
+		if len(chunk) == 0 && end == from {
+			t.Fatalf("MustWalkMessages: dir=%s from=%s returned no events and the same end token, so would never finish", dir, from)
+		}
+		from = end
+	}
+}
+
+func (c *CSAPI) messagesPage(t *testing.T, roomID, dir, from string, opts MessagesWalkOpts) gjson.Result {
+	t.Helper()
+	query := url.Values{
+		"dir":   []string{dir},
+		"limit": []string{strconv.Itoa(opts.Limit)},
+	}
+	if from != "" {
+		query.Set("from", from)
+	}
+	if opts.Filter != "" {
+		query.Set("filter", opts.Filter)
+	}
+	res := c.MustDoFunc(t, "GET", []string{"_matrix", "client", "v3", "rooms", roomID, "messages"}, WithQueries(query))
+	return gjson.ParseBytes(ParseJSON(t, res))
+}
+
+// EventContext is the response from /context, as returned by GetEventContext.
+type EventContext struct {
+	// The event which context was requested for
+	Event gjson.Result
+	// Events before the event, newest first
+	EventsBefore []gjson.Result
+	// Events after the event, oldest first
+	EventsAfter []gjson.Result
+	// The state of the room at the last event returned
+	State []gjson.Result
+	// Pagination tokens for /messages
+	Start string
+	End   string
+	// The whole response body, for use with must.MatchJSONBytes
+	Raw []byte
+}
+
+// GetEventContext calls /context for `eventID`, else fails the test. `limit` is the maximum number of events
+// to return before and after the event, and is not sent if 0. `filter` is a JSON encoded RoomEventFilter,
+// e.g to enable lazy-loading members, and is not sent if empty.
+func (c *CSAPI) GetEventContext(t *testing.T, roomID, eventID string, limit int, filter string) EventContext {
+	t.Helper()
+	query := url.Values{}
+	if limit != 0 {
+		query.Set("limit", strconv.Itoa(limit))
+	}
+	if filter != "" {
+		query.Set("filter", filter)
+	}
+	res := c.MustDoFunc(t, "GET", []string{"_matrix", "client", "v3", "rooms", roomID, "context", eventID}, WithQueries(query))
+	body := ParseJSON(t, res)
+	result := gjson.ParseBytes(body)
+	return EventContext{
+		Event:        result.Get("event"),
+		EventsBefore: result.Get("events_before").Array(),
+		EventsAfter:  result.Get("events_after").Array(),
+		State:        result.Get("state").Array(),
+		Start:        result.Get("start").Str,
+		End:          result.Get("end").Str,
+		Raw:          body,
+	}
+}
@@ -0,0 +1,41 @@
+package client
+
+import (
+	"net/http"
+	"testing"
+)
+
+// ReportEvent reports `eventID` in `roomID` to the server administrators with the given `reason`, returning the
+// response. The response is not checked so this can be used to test failure modes, see MustReportEvent.
+func (c *CSAPI) ReportEvent(t *testing.T, roomID, eventID, reason string) *http.Response {
+	t.Helper()
+	return c.DoFunc(t, "POST", []string{"_matrix", "client", "v3", "rooms", roomID, "report", eventID}, WithJSONBody(t, map[string]interface{}{
+		"reason": reason,
+	}))
+}
+
+// MustReportEvent reports `eventID` in `roomID` to the server administrators with the given `reason`, else fails
+// the test.
+func (c *CSAPI) MustReportEvent(t *testing.T, roomID, eventID, reason string) {
+	t.Helper()
+	c.MustDoFunc(t, "POST", []string{"_matrix", "client", "v3", "rooms", roomID, "report", eventID}, WithJSONBody(t, map[string]interface{}{
+		"reason": reason,
+	}))
+}
+
+// ReportRoom reports `roomID` to the server administrators with the given `reason`, returning the response.
+// The response is not checked so this can be used to test failure modes, see MustReportRoom.
+func (c *CSAPI) ReportRoom(t *testing.T, roomID, reason string) *http.Response {
+	t.Helper()
+	return c.DoFunc(t, "POST", []string{"_matrix", "client", "v3", "rooms", roomID, "report"}, WithJSONBody(t, map[string]interface{}{
+		"reason": reason,
+	}))
+}
+
+// MustReportRoom reports `roomID` to the server administrators with the given `reason`, else fails the test.
+func (c *CSAPI) MustReportRoom(t *testing.T, roomID, reason string) {
+	t.Helper()
+	c.MustDoFunc(t, "POST", []string{"_matrix", "client", "v3", "rooms", roomID, "report"}, WithJSONBody(t, map[string]interface{}{
+		"reason": reason,
+	}))
+}
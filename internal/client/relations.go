@@ -0,0 +1,122 @@
+package client
+
+import (
+	"net/http"
+	"net/url"
+	"strconv"
+	"testing"
+
+	"github.com/tidwall/gjson"
+
+	"github.com/matrix-org/complement/internal/b"
+)
+
+// SendReaction annotates `eventID` with the reaction `key`, e.g an emoji, else fails the test. Returns the
+// event ID of the reaction, without waiting for it to come down /sync.
+func (c *CSAPI) SendReaction(t *testing.T, roomID, eventID, key string) string {
+	t.Helper()
+	return c.SendEventUnsynced(t, roomID, b.Event{
+		Type: "m.reaction",
+		Content: map[string]interface{}{
+			"m.relates_to": map[string]interface{}{
+				"rel_type": "m.annotation",
+				"event_id": eventID,
+				"key":      key,
+			},
+		},
+	})
+}
+
+// SendEdit replaces the content of the m.room.message `eventID` with `newContent`, else fails the test.
+// The fallback body is derived from the `body` of `newContent`. Returns the event ID of the edit, without
+// waiting for it to come down /sync.
+func (c *CSAPI) SendEdit(t *testing.T, roomID, eventID string, newContent map[string]interface{}) string {
+	t.Helper()
+	newBody, _ := newContent["body"].(string)
+	fallback := map[string]interface{}{
+		"msgtype":       newContent["msgtype"],
+		"body":          "* " + newBody,
+		"m.new_content": newContent,
+	}
+	return c.SendEventUnsynced(t, roomID, b.Event{
+		Type: "m.room.message",
+		Content: withRelation(fallback, map[string]interface{}{
+			"rel_type": "m.replace",
+			"event_id": eventID,
+		}),
+	})
+}
+
+// SendThreadReply sends an m.room.message event with the given `content` into the thread rooted at
+// `threadRootID`, else fails the test. Returns the event ID of the reply, without waiting for it to come
+// down /sync. The `content` is not modified.
+func (c *CSAPI) SendThreadReply(t *testing.T, roomID, threadRootID string, content map[string]interface{}) string {
+	t.Helper()
+	return c.SendEventUnsynced(t, roomID, b.Event{
+		Type: "m.room.message",
+		Content: withRelation(content, map[string]interface{}{
+			"rel_type": "m.thread",
+			"event_id": threadRootID,
+		}),
+	})
+}
+
+// GetRelations calls /relations for `eventID`, returning the response. If `relType` is not empty then only
+// relations of that type are returned, and if `eventType` is also not empty then only events of that type.
+// Use WithQueries to set `from`, `to`, `limit` and `dir`.
+func (c *CSAPI) GetRelations(t *testing.T, roomID, eventID, relType, eventType string, opts ...RequestOpt) *http.Response {
+	t.Helper()
+	paths := []string{"_matrix", "client", "v1", "rooms", roomID, "relations", eventID}
+	if relType != "" {
+		paths = append(paths, relType)
+		if eventType != "" {
+			paths = append(paths, eventType)
+		}
+	}
+	return c.MustDoFunc(t, "GET", paths, opts...)
+}
+
+// GetRelationsPaginated calls /relations for `eventID` like GetRelations, following `next_batch` until there
+// are no more pages. Each page has at most `limit` events. Returns all the events in the order they were
+// returned, else fails the test.
+func (c *CSAPI) GetRelationsPaginated(t *testing.T, roomID, eventID, relType, eventType string, limit int) []gjson.Result {
+	t.Helper()
+	var events []gjson.Result
+	from := ""
+	for {
+		query := url.Values{
+			"limit": []string{strconv.Itoa(limit)},
+		}
+		if from != "" {
+			query.Set("from", from)
+		}
+		res := c.GetRelations(t, roomID, eventID, relType, eventType, WithQueries(query))
+		body := gjson.ParseBytes(ParseJSON(t, res))
+		chunk := body.Get("chunk").Array()
+		if len(chunk) > limit {
+			t.Fatalf("GetRelationsPaginated: page has %d events, more than the limit %d", len(chunk), limit)
+		}
+		events = append(events, chunk...)
+		from = body.Get("next_batch").Str
+		if from == "" {
+			return events
+		}
+	}
+}
+
+// GetThreads calls /threads for `roomID`, returning the response. Use WithQueries to set `include`,
+// `from` and `limit`.
+func (c *CSAPI) GetThreads(t *testing.T, roomID string, opts ...RequestOpt) *http.Response {
+	t.Helper()
+	return c.MustDoFunc(t, "GET", []string{"_matrix", "client", "v1", "rooms", roomID, "threads"}, opts...)
+}
+
+// withRelation returns a shallow copy of `content` with `m.relates_to` set to `relatesTo`.
+func withRelation(content map[string]interface{}, relatesTo map[string]interface{}) map[string]interface{} {
+	c := make(map[string]interface{}, len(content)+1)
+	for k, v := range content {
+		c[k] = v
+	}
+	c["m.relates_to"] = relatesTo
+	return c
+}
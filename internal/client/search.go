@@ -0,0 +1,127 @@
+package client
+
+import (
+	"net/url"
+	"testing"
+
+	"github.com/tidwall/gjson"
+)
+
+// SearchReq contains the /search request configuration options for the `room_events` category. Only
+// `SearchTerm` is required.
+type SearchReq struct {
+	// The term to search for
+	SearchTerm string
+	// The keys to search, any of "content.body", "content.name" and "content.topic". If empty, the server
+	// searches all of them.
+	Keys []string
+	// A RoomEventFilter to apply to the search, e.g to limit the rooms searched
+	Filter map[string]interface{}
+	// One of "rank" or "recent". If empty, the server orders by rank.
+	OrderBy string
+	// Group results by any of "room_id" and "sender"
+	GroupBy []string
+	// If true, return the current state of the rooms containing results
+	IncludeState bool
+	// The number of events before and after each result to return. If both are 0, no context is requested.
+	BeforeLimit int
+	AfterLimit  int
+	// The next_batch token from a previous search, to fetch the next page of results
+	NextBatch string
+}
+
+// SearchResult is the `room_events` category of the /search response.
+type SearchResult struct {
+	// An approximate count of the total number of results
+	Count int64
+	// The results on this page, each with a `rank`, `result` and optionally a `context`
+	Results []gjson.Result
+	// Words which should be highlighted in the results
+	Highlights []string
+	// The token to fetch the next page of results, or "" if there are no more results
+	NextBatch string
+	// The whole response body, for use with must.MatchJSONBytes and the match.JSONSearch... matchers
+	Raw []byte
+}
+
+// Search performs a /search for room events, else fails the test.
+func (c *CSAPI) Search(t *testing.T, req SearchReq) SearchResult {
+	t.Helper()
+	criteria := map[string]interface{}{
+		"search_term": req.SearchTerm,
+	}
+	if len(req.Keys) > 0 {
+		criteria["keys"] = req.Keys
+	}
+	if req.Filter != nil {
+		criteria["filter"] = req.Filter
+	}
+	if req.OrderBy != "" {
+		criteria["order_by"] = req.OrderBy
+	}
+	if len(req.GroupBy) > 0 {
+		groups := make([]map[string]interface{}, len(req.GroupBy))
+		for i, key := range req.GroupBy {
+			groups[i] = map[string]interface{}{
+				"key": key,
+			}
+		}
+		criteria["groupings"] = map[string]interface{}{
+			"group_by": groups,
+		}
+	}
+	if req.IncludeState {
+		criteria["include_state"] = true
+	}
+	if req.BeforeLimit > 0 || req.AfterLimit > 0 {
+		criteria["event_context"] = map[string]interface{}{
+			"before_limit": req.BeforeLimit,
+			"after_limit":  req.AfterLimit,
+		}
+	}
+	query := url.Values{}
+	if req.NextBatch != "" {
+		query.Set("next_batch", req.NextBatch)
+	}
+	res := c.MustDoFunc(t, "POST", []string{"_matrix", "client", "r0", "search"}, WithQueries(query), WithJSONBody(t, map[string]interface{}{
+		"search_categories": map[string]interface{}{
+			"room_events": criteria,
+		},
+	}))
+	body := ParseJSON(t, res)
+	roomEvents := gjson.GetBytes(body, "search_categories.room_events")
+	result := SearchResult{
+		Count:     roomEvents.Get("count").Int(),
+		Results:   roomEvents.Get("results").Array(),
+		NextBatch: roomEvents.Get("next_batch").Str,
+		Raw:       body,
+	}
+	for _, highlight := range roomEvents.Get("highlights").Array() {
+		result.Highlights = append(result.Highlights, highlight.Str)
+	}
+	return result
+}
+
+// SearchPaginated performs a /search for room events like Search, following `next_batch` until there are no
+// more results. Returns the `result` event of every result in the order they were returned. Fails the test
+// if an event is returned more than once.
+func (c *CSAPI) SearchPaginated(t *testing.T, req SearchReq) []gjson.Result {
+	t.Helper()
+	var events []gjson.Result
+	seen := make(map[string]bool)
+	for {
+		page := c.Search(t, req)
+		for _, result := range page.Results {
+			eventID := result.Get("result.event_id").Str
+			if seen[eventID] {
+				t.Fatalf("SearchPaginated: event %s returned more than once", eventID)
+			}
+			seen[eventID] = true
+			events = append(events, result.Get("result"))
+		}
+		if page.NextBatch == "" || len(page.Results) == 0 {
+			return events
+		}
+		req.NextBatch = page.NextBatch
+	}
+}
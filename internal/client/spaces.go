@@ -0,0 +1,110 @@
+package client
+
+import (
+	"encoding/json"
+	"net/url"
+	"strconv"
+	"testing"
+
+	"github.com/tidwall/gjson"
+
+	"github.com/matrix-org/complement/internal/b"
+)
+
+// CreateSpace creates a space with an optional HTTP request body, which is the same as for CreateRoom.
+// The room type is set to m.space. Fails the test on error. Returns the room ID of the space.
+func (c *CSAPI) CreateSpace(t *testing.T, creationContent map[string]interface{}) string {
+	t.Helper()
+	reqBody := make(map[string]interface{}, len(creationContent)+1)
+	for k, v := range creationContent {
+		reqBody[k] = v
+	}
+	createContent := map[string]interface{}{}
+	if existing, ok := creationContent["creation_content"].(map[string]interface{}); ok {
+		for k, v := range existing {
+			createContent[k] = v
+		}
+	}
+	createContent["type"] = "m.space"
+	reqBody["creation_content"] = createContent
+	return c.CreateRoom(t, reqBody)
+}
+
+// AddSpaceChild adds `childRoomID` to the space `spaceID` by sending an m.space.child event, else fails the test.
+// `via` is the list of servers to try to join the child through. Returns the event ID, without waiting for it to
+// come down /sync.
+func (c *CSAPI) AddSpaceChild(t *testing.T, spaceID, childRoomID string, via []string, suggested bool) string {
+	t.Helper()
+	return c.SendEventUnsynced(t, spaceID, b.Event{
+		Type:     "m.space.child",
+		StateKey: b.Ptr(childRoomID),
+		Content: map[string]interface{}{
+			"via":       via,
+			"suggested": suggested,
+		},
+	})
+}
+
+// HierarchyReq contains the /hierarchy request configuration options. The empty struct `HierarchyReq{}` is valid
+// which will return the first page of the whole hierarchy.
+type HierarchyReq struct {
+	// Only return suggested children
+	SuggestedOnly bool
+	// The maximum depth to return children at. If 0, the server decides.
+	MaxDepth int
+	// The maximum number of rooms per page. If 0, the server decides.
+	Limit int
+	// If true, follow `next_batch` until all pages have been fetched.
+	Paginate bool
+}
+
+// Hierarchy is the response from GetHierarchy.
+type Hierarchy struct {
+	// All the rooms returned, in the order they were returned
+	Rooms []gjson.Result
+	// The number of pages fetched
+	Pages int
+	// A JSON object with the `rooms` of all pages, so the same matchers can be used for paginated
+	// and unpaginated requests, e.g with must.MatchJSONBytes
+	Raw []byte
+}
+
+// GetHierarchy fetches the space hierarchy of `roomID`, else fails the test.
+func (c *CSAPI) GetHierarchy(t *testing.T, roomID string, req HierarchyReq) Hierarchy {
+	t.Helper()
+	query := url.Values{}
+	if req.SuggestedOnly {
+		query.Set("suggested_only", "true")
+	}
+	if req.MaxDepth > 0 {
+		query.Set("max_depth", strconv.Itoa(req.MaxDepth))
+	}
+	if req.Limit > 0 {
+		query.Set("limit", strconv.Itoa(req.Limit))
+	}
+	var result Hierarchy
+	for {
+		res := c.MustDoFunc(t, "GET", []string{"_matrix", "client", "v1", "rooms", roomID, "hierarchy"}, WithQueries(query))
+		page := gjson.ParseBytes(ParseJSON(t, res))
+		result.Pages++
+		result.Rooms = append(result.Rooms, page.Get("rooms").Array()...)
+		nextBatch := page.Get("next_batch").Str
+		if !req.Paginate || nextBatch == "" {
+			break
+		}
+		query.Set("from", nextBatch)
+	}
+
+	rooms := make([]json.RawMessage, len(result.Rooms))
+	for i, room := range result.Rooms {
+		rooms[i] = json.RawMessage(room.Raw)
+	}
+	var err error
+	result.Raw, err = json.Marshal(map[string]interface{}{
+		"rooms": rooms,
+	})
+	if err != nil {
+		t.Fatalf("GetHierarchy: failed to marshal rooms: %s", err)
+	}
+	return result
+}
@@ -0,0 +1,31 @@
+package client
+
+import (
+	"net/http"
+	"net/url"
+	"testing"
+)
+
+// GetRoomSummary fetches the summary of `roomIDOrAlias` (MSC3266), returning the response. `via` are the servers
+// to ask for the summary of rooms the server isn't in. The response is not checked so this can be used to test
+// rooms which the user isn't allowed to preview, see MustGetRoomSummary.
+func (c *CSAPI) GetRoomSummary(t *testing.T, roomIDOrAlias string, via []string) *http.Response {
+	t.Helper()
+	query := url.Values{}
+	for _, server := range via {
+		query.Add("via", server)
+	}
+	return c.DoFunc(t, "GET", []string{"_matrix", "client", "unstable", "im.nheko.summary", "rooms", roomIDOrAlias, "summary"}, WithQueries(query))
+}
+
+// MustGetRoomSummary fetches the summary of `roomIDOrAlias` (MSC3266), else fails the test. Returns the response
+// body, for use with must.MatchJSONBytes.
+func (c *CSAPI) MustGetRoomSummary(t *testing.T, roomIDOrAlias string, via []string) []byte {
+	t.Helper()
+	res := c.GetRoomSummary(t, roomIDOrAlias, via)
+	body := ParseJSON(t, res)
+	if res.StatusCode != 200 {
+		t.Fatalf("MustGetRoomSummary: got HTTP %d want 200: %s", res.StatusCode, string(body))
+	}
+	return body
+}
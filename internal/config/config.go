@@ -6,13 +6,21 @@ import (
 	"crypto/rsa"
 	"crypto/x509"
 	"crypto/x509/pkix"
+	"encoding/hex"
 	"encoding/pem"
 	"fmt"
+	"io/ioutil"
 	"math/big"
+	"net"
 	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
+
+	"github.com/matrix-org/complement/internal/testlog"
 )
 
 type HostMount struct {
@@ -30,6 +38,80 @@ type Complement struct {
 	SpawnHSTimeout        time.Duration
 	KeepBlueprints        []string
 	HostMounts            []HostMount
+	// Name -> image of homeserver images to run instead of the base image, e.g to test federation
+	// between releases
+	ExtraImages map[string]string
+	// If true, blueprint images are kept after the run and reused by later runs, until the blueprint or the
+	// images it is built from change
+	CacheBlueprints bool
+	// If true, deployments are kept running after a test and reused by later tests using the same blueprint
+	PoolDeployments bool
+	// If true, all tests share one deployment per blueprint, which is never cleaned up
+	EnableDirtyRuns bool
+	// How long a single test may run before the watchdog dumps diagnostics and stops the run. 0 disables it.
+	TestTimeout time.Duration
+	// The directory to write HAR files of the HTTP requests made by failing tests to. Empty if disabled.
+	CaptureDir string
+	// The directory to write homeserver logs and `docker inspect` output to when a test fails. Empty if disabled.
+	ArtifactsDir string
+	// A shell command run in a homeserver container by Deployment.Profile, which profiles the homeserver
+	// until it is sent SIGINT. Empty if disabled.
+	ProfileCommand string
+	// If true, homeserver logs are logged to the test using the deployment as they happen
+	StreamLogs bool
+	// If true, deployments of failed tests are left running until enter is pressed, after printing how to
+	// reach the homeservers and the access tokens of their users
+	DebugPauseOnFailure bool
+	// The lowest level of messages logged to tests by internal/testlog. Every message is kept in the log
+	// files of failed tests in ArtifactsDir regardless.
+	LogLevel testlog.Level
+	// If true, each homeserver is given its own Postgres database in a separate container
+	Postgres bool
+	// The image to run Postgres databases from
+	PostgresImage string
+	// The image to run reverse proxies in front of homeservers from, see docker.WithReverseProxy
+	ProxyImage string
+	// The image to run mitmproxy sidecars from, see docker.WithInterception
+	MitmproxyImage string
+	// The platform to run images as, e.g "linux/amd64" to run amd64 images under emulation on arm64.
+	// Empty to use the platform of the machine running Complement.
+	Platform string
+	// The container runtime to use, "docker" or "podman"
+	ContainerRuntime string
+	// The CSAPI base URL of an already running homeserver to run tests against instead of deploying
+	// containers. Empty if disabled.
+	AttachBaseURL string
+	// The federation base URL of the already running homeserver, if AttachBaseURL is set
+	AttachFedBaseURL string
+	// The Kubernetes namespace to deploy homeservers into as pods instead of running containers. Empty if
+	// disabled.
+	KubernetesNamespace string
+	// The URL of the Kubernetes API, e.g that of `kubectl proxy`. Empty to use the service account of the pod
+	// Complement runs in.
+	KubernetesAPIURL string
+	// The address homeservers deployed to Kubernetes reach Complement at. Empty to use the address Complement
+	// reaches the Kubernetes API from.
+	KubernetesHostIP string
+	// A random ID for this run of Complement, which labels everything it creates
+	RunID string
+	// How old containers and networks from other runs must be before they are removed as orphans of runs
+	// which crashed. 0 disables removing them.
+	OrphanTTL time.Duration
+	// If true, the networks homeservers are connected to have IPv6 enabled as well as IPv4
+	IPv6 bool
+	// The shard of the tests to run, from 0 to ShardTotal-1, see internal/shard
+	ShardIndex int
+	// The number of shards the tests are split into. 0 or 1 runs all the tests.
+	ShardTotal int
+	// The JSON report written by cmd/test-report for a previous run, used to split the tests into shards
+	// which take about as long as each other. Empty to split them evenly by number.
+	ShardTimings string
+	// The most containers which may run at once across all deployments, counting homeservers, workers and
+	// sidecars, so running tests in parallel doesn't overload the machine. Deploying waits until enough
+	// containers are destroyed. 0 is unlimited.
+	MaxContainers int
+	// How many rooms are made at once when building a blueprint. 0 uses the default of 40.
+	BuildConcurrency int
 	// The namespace for all complement created blueprints and deployments
 	PackageNamespace string
 	// Certificate Authority generated values for this run of complement. Homeservers will use this
@@ -46,6 +128,16 @@ func NewConfigFromEnvVars(pkgNamespace, baseImageURI string) *Complement {
 	}
 	cfg.BaseImageArgs = strings.Split(os.Getenv("COMPLEMENT_BASE_IMAGE_ARGS"), " ")
 	cfg.DebugLoggingEnabled = os.Getenv("COMPLEMENT_DEBUG") == "1"
+	cfg.LogLevel = testlog.LevelInfo
+	if cfg.DebugLoggingEnabled {
+		cfg.LogLevel = testlog.LevelDebug
+	}
+	if level := os.Getenv("COMPLEMENT_LOG_LEVEL"); level != "" {
+		var err error
+		if cfg.LogLevel, err = testlog.ParseLevel(level); err != nil {
+			panic("COMPLEMENT_LOG_LEVEL parse error: " + err.Error())
+		}
+	}
 	cfg.AlwaysPrintServerLogs = os.Getenv("COMPLEMENT_ALWAYS_PRINT_SERVER_LOGS") == "1"
 	cfg.SpawnHSTimeout = time.Duration(parseEnvWithDefault("COMPLEMENT_SPAWN_HS_TIMEOUT_SECS", 30)) * time.Second
 	if os.Getenv("COMPLEMENT_VERSION_CHECK_ITERATIONS") != "" {
@@ -54,6 +146,52 @@ func NewConfigFromEnvVars(pkgNamespace, baseImageURI string) *Complement {
 		cfg.SpawnHSTimeout = time.Duration(50*parseEnvWithDefault("COMPLEMENT_VERSION_CHECK_ITERATIONS", 100)) * time.Millisecond
 	}
 	cfg.KeepBlueprints = strings.Split(os.Getenv("COMPLEMENT_KEEP_BLUEPRINTS"), " ")
+	cfg.CaptureDir = os.Getenv("COMPLEMENT_CAPTURE_DIR")
+	cfg.ArtifactsDir = os.Getenv("COMPLEMENT_ARTIFACTS_DIR")
+	if cfg.ArtifactsDir == "" {
+		cfg.ArtifactsDir = filepath.Join(os.TempDir(), "complement-artifacts")
+	}
+	cfg.ProfileCommand = os.Getenv("COMPLEMENT_PROFILE_CMD")
+	cfg.StreamLogs = os.Getenv("COMPLEMENT_STREAM_LOGS") == "1"
+	cfg.DebugPauseOnFailure = os.Getenv("COMPLEMENT_DEBUG_PAUSE_ON_FAILURE") == "1"
+	cfg.Postgres = os.Getenv("COMPLEMENT_POSTGRES") == "1"
+	cfg.PostgresImage = os.Getenv("COMPLEMENT_POSTGRES_IMAGE")
+	if cfg.PostgresImage == "" {
+		cfg.PostgresImage = "postgres:13-alpine"
+	}
+	cfg.ProxyImage = os.Getenv("COMPLEMENT_PROXY_IMAGE")
+	if cfg.ProxyImage == "" {
+		cfg.ProxyImage = "nginx:1.23-alpine"
+	}
+	cfg.MitmproxyImage = os.Getenv("COMPLEMENT_MITMPROXY_IMAGE")
+	if cfg.MitmproxyImage == "" {
+		cfg.MitmproxyImage = "mitmproxy/mitmproxy:9.0.1"
+	}
+	cfg.Platform = os.Getenv("COMPLEMENT_PLATFORM")
+	cfg.ContainerRuntime = os.Getenv("COMPLEMENT_CONTAINER_RUNTIME")
+	cfg.AttachBaseURL = os.Getenv("COMPLEMENT_ATTACH_BASE_URL")
+	cfg.AttachFedBaseURL = os.Getenv("COMPLEMENT_ATTACH_FED_BASE_URL")
+	cfg.KubernetesNamespace = os.Getenv("COMPLEMENT_KUBERNETES_NAMESPACE")
+	cfg.KubernetesAPIURL = os.Getenv("COMPLEMENT_KUBERNETES_API_URL")
+	cfg.KubernetesHostIP = os.Getenv("COMPLEMENT_KUBERNETES_HOST_IP")
+	cfg.CacheBlueprints = os.Getenv("COMPLEMENT_CACHE_BLUEPRINTS") == "1"
+	cfg.OrphanTTL = time.Duration(parseEnvWithDefault("COMPLEMENT_ORPHAN_TTL_SECS", 6*60*60)) * time.Second
+	cfg.IPv6 = os.Getenv("COMPLEMENT_ENABLE_IPV6") == "1"
+	cfg.BuildConcurrency = parseEnvWithDefault("COMPLEMENT_BUILD_CONCURRENCY", 0)
+	cfg.PoolDeployments = os.Getenv("COMPLEMENT_POOL_DEPLOYMENTS") == "1"
+	cfg.EnableDirtyRuns = os.Getenv("COMPLEMENT_ENABLE_DIRTY_RUNS") == "1"
+	cfg.TestTimeout = time.Duration(parseEnvWithDefault("COMPLEMENT_TEST_TIMEOUT_SECS", 0)) * time.Second
+	if os.Getenv("COMPLEMENT_MAX_CONTAINERS") == "auto" {
+		cfg.MaxContainers = autoMaxContainers(parseEnvWithDefault("COMPLEMENT_CONTAINER_MEMORY_MB", 512))
+	} else {
+		cfg.MaxContainers = parseEnvWithDefault("COMPLEMENT_MAX_CONTAINERS", 0)
+	}
+	cfg.ShardIndex = parseEnvWithDefault("COMPLEMENT_SHARD_INDEX", 0)
+	cfg.ShardTotal = parseEnvWithDefault("COMPLEMENT_SHARD_TOTAL", 0)
+	cfg.ShardTimings = os.Getenv("COMPLEMENT_SHARD_TIMINGS")
+	if cfg.ShardTotal > 1 && (cfg.ShardIndex < 0 || cfg.ShardIndex >= cfg.ShardTotal) {
+		panic(fmt.Sprintf("COMPLEMENT_SHARD_INDEX must be between 0 and %d", cfg.ShardTotal-1))
+	}
 	var err error
 	hostMounts := os.Getenv("COMPLEMENT_HOST_MOUNTS")
 	if hostMounts != "" {
@@ -62,10 +200,19 @@ func NewConfigFromEnvVars(pkgNamespace, baseImageURI string) *Complement {
 			panic("COMPLEMENT_HOST_MOUNTS parse error: " + err.Error())
 		}
 	}
-	if cfg.BaseImageURI == "" {
+	cfg.ExtraImages, err = newExtraImages(strings.Fields(os.Getenv("COMPLEMENT_EXTRA_IMAGES")))
+	if err != nil {
+		panic("COMPLEMENT_EXTRA_IMAGES parse error: " + err.Error())
+	}
+	if cfg.BaseImageURI == "" && cfg.AttachBaseURL == "" {
 		panic("COMPLEMENT_BASE_IMAGE must be set")
 	}
 	cfg.PackageNamespace = pkgNamespace
+	runID := make([]byte, 8)
+	if _, err := rand.Read(runID); err != nil {
+		panic("failed to generate run ID: " + err.Error())
+	}
+	cfg.RunID = hex.EncodeToString(runID)
 
 	// create CA certs and keys
 	if err := cfg.GenerateCA(); err != nil {
@@ -103,6 +250,78 @@ func (c *Complement) CAPrivateKeyBytes() ([]byte, error) {
 	return caKey.Bytes(), err
 }
 
+// ServerCertificate generates a TLS certificate for `host`, signed by the CA, and returns it and its private
+// key PEM encoded. The certificate is valid for an hour.
+func (c *Complement) ServerCertificate(host string) (certPEM, keyPEM []byte, err error) {
+	priv, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return nil, nil, err
+	}
+	serialNumberLimit := new(big.Int).Lsh(big.NewInt(1), 128)
+	serialNumber, err := rand.Int(rand.Reader, serialNumberLimit)
+	if err != nil {
+		return nil, nil, err
+	}
+	notBefore := time.Now()
+	template := x509.Certificate{
+		SerialNumber:          serialNumber,
+		NotBefore:             notBefore,
+		NotAfter:              notBefore.Add(time.Hour),
+		KeyUsage:              x509.KeyUsageKeyEncipherment | x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		Subject: pkix.Name{
+			Organization: []string{"matrix.org"},
+			CommonName:   host,
+		},
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		template.IPAddresses = append(template.IPAddresses, ip)
+	} else {
+		template.DNSNames = append(template.DNSNames, host)
+	}
+	derBytes, err := x509.CreateCertificate(rand.Reader, &template, c.CACertificate, &priv.PublicKey, c.CAPrivateKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	certPEM = pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: derBytes})
+	keyPEM = pem.EncodeToMemory(&pem.Block{
+		Type:  "RSA PRIVATE KEY",
+		Bytes: x509.MarshalPKCS1PrivateKey(priv),
+	})
+	return certPEM, keyPEM, nil
+}
+
+// autoMaxContainers returns how many containers this machine can run at once: one per CPU, or as many as
+// fit in the available memory if that is fewer, taking each to use `memoryMB`.
+func autoMaxContainers(memoryMB int) int {
+	max := runtime.NumCPU()
+	meminfo, err := ioutil.ReadFile("/proc/meminfo")
+	if err != nil || memoryMB <= 0 {
+		// not Linux, so only go by the CPUs
+		return max
+	}
+	for _, line := range strings.Split(string(meminfo), "\n") {
+		// e.g "MemAvailable:   12345678 kB"
+		fields := strings.Fields(line)
+		if len(fields) < 2 || fields[0] != "MemAvailable:" {
+			continue
+		}
+		availableKB, err := strconv.Atoi(fields[1])
+		if err != nil {
+			break
+		}
+		if byMemory := availableKB / 1024 / memoryMB; byMemory < max {
+			max = byMemory
+		}
+		break
+	}
+	if max < 1 {
+		max = 1
+	}
+	return max
+}
+
 func parseEnvWithDefault(key string, def int) int {
 	s := os.Getenv(key)
 	if s != "" {
@@ -136,6 +355,40 @@ func newHostMounts(mounts []string) ([]HostMount, error) {
 	return hostMounts, nil
 }
 
+// ImageURI returns the image named `name` in COMPLEMENT_EXTRA_IMAGES, or the base image if `name` is empty.
+func (c *Complement) ImageURI(name string) (string, error) {
+	if name == "" {
+		return c.BaseImageURI, nil
+	}
+	uri, ok := c.ExtraImages[name]
+	if !ok {
+		return "", fmt.Errorf("no image named '%s' in COMPLEMENT_EXTRA_IMAGES", name)
+	}
+	return uri, nil
+}
+
+// ExtraImageNames returns the names of the images in COMPLEMENT_EXTRA_IMAGES, in order.
+func (c *Complement) ExtraImageNames() []string {
+	names := make([]string, 0, len(c.ExtraImages))
+	for name := range c.ExtraImages {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func newExtraImages(images []string) (map[string]string, error) {
+	extraImages := make(map[string]string)
+	for _, img := range images {
+		name, uri, ok := strings.Cut(img, "=")
+		if !ok || name == "" || uri == "" {
+			return nil, fmt.Errorf("image '%s' malformed, want name=image", img)
+		}
+		extraImages[name] = uri
+	}
+	return extraImages, nil
+}
+
 // Generate a certificate and private key
 func generateCAValues() (*x509.Certificate, *rsa.PrivateKey, error) {
 	// valid for 10 years
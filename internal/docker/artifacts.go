@@ -0,0 +1,147 @@
+package docker
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/pkg/stdcopy"
+
+	"github.com/matrix-org/complement/internal/testlog"
+)
+
+// writeArtifacts writes the full logs and `docker inspect` output of every homeserver in the deployment to
+// a directory named after the test in COMPLEMENT_ARTIFACTS_DIR, so they are kept after the containers are
+// destroyed. Failures are logged rather than failing the test.
+func (d *Deployment) writeArtifacts(t *testing.T) {
+	t.Helper()
+	dir := d.artifactsDir(t)
+	if dir == "" {
+		return
+	}
+	for hsName, hsDep := range d.HS {
+		for name, containerID := range hsDep.containers(hsName) {
+			d.writeContainerArtifacts(t, dir, name, containerID)
+		}
+	}
+	t.Logf("Deployment: wrote homeserver logs and inspect output to %s", dir)
+}
+
+// artifactsDir creates and returns the directory in COMPLEMENT_ARTIFACTS_DIR for the test's artifacts.
+// Returns an empty string if artifacts are disabled or the directory could not be created.
+func (d *Deployment) artifactsDir(t *testing.T) string {
+	t.Helper()
+	if d.Config.ArtifactsDir == "" {
+		return ""
+	}
+	dir := filepath.Join(d.Config.ArtifactsDir, testlog.Filename(t.Name()))
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Logf("Deployment: failed to create artifacts directory %s: %s", dir, err)
+		return ""
+	}
+	return dir
+}
+
+// writeContainerArtifacts writes the logs and `docker inspect` output of a single container to `dir`.
+func (d *Deployment) writeContainerArtifacts(t *testing.T, dir, name, containerID string) {
+	t.Helper()
+	ctx := context.Background()
+	inspect, err := d.Deployer.Docker.ContainerInspect(ctx, containerID)
+	if err != nil {
+		t.Logf("Deployment: failed to inspect %s: %s", name, err)
+	} else {
+		b, _ := json.MarshalIndent(inspect, "", "  ")
+		if err = ioutil.WriteFile(filepath.Join(dir, name+".inspect.json"), b, 0644); err != nil {
+			t.Logf("Deployment: failed to write inspect output of %s: %s", name, err)
+		}
+	}
+	reader, err := d.Deployer.Docker.ContainerLogs(ctx, containerID, types.ContainerLogsOptions{
+		ShowStderr: true,
+		ShowStdout: true,
+		Timestamps: true,
+	})
+	if err != nil {
+		t.Logf("Deployment: failed to get logs of %s: %s", name, err)
+		return
+	}
+	var logs bytes.Buffer
+	_, err = stdcopy.StdCopy(&logs, &logs, reader)
+	reader.Close()
+	if err != nil {
+		t.Logf("Deployment: failed to read logs of %s: %s", name, err)
+	}
+	if err = ioutil.WriteFile(filepath.Join(dir, name+".log"), logs.Bytes(), 0644); err != nil {
+		t.Logf("Deployment: failed to write logs of %s: %s", name, err)
+	}
+}
+
+// StreamLogs logs the output of every homeserver in the deployment to `t` as it happens, until `t`
+// finishes. Enabled in the test suites with COMPLEMENT_STREAM_LOGS=1.
+func (d *Deployment) StreamLogs(t *testing.T) {
+	if d.attached || d.kube != nil {
+		return
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	var wg sync.WaitGroup
+	since := time.Now().Format(time.RFC3339Nano)
+	for hsName, hsDep := range d.HS {
+		reader, err := d.Deployer.Docker.ContainerLogs(ctx, hsDep.ContainerID, types.ContainerLogsOptions{
+			ShowStderr: true,
+			ShowStdout: true,
+			Follow:     true,
+			Since:      since,
+		})
+		if err != nil {
+			t.Logf("Deployment.StreamLogs: failed to follow logs of %s: %s", hsName, err)
+			continue
+		}
+		wg.Add(1)
+		go func(hsName string) {
+			defer wg.Done()
+			defer reader.Close()
+			w := &lineLogger{t: t, prefix: hsName}
+			stdcopy.StdCopy(w, w, reader)
+			w.flush()
+		}(hsName)
+	}
+	// t.Log panics once the test has finished, so stop streaming before then
+	t.Cleanup(func() {
+		cancel()
+		wg.Wait()
+	})
+}
+
+// lineLogger logs each complete line written to it to a test.
+type lineLogger struct {
+	t      *testing.T
+	prefix string
+	buf    []byte
+}
+
+func (w *lineLogger) Write(p []byte) (int, error) {
+	w.buf = append(w.buf, p...)
+	for {
+		i := bytes.IndexByte(w.buf, '\n')
+		if i < 0 {
+			break
+		}
+		w.t.Logf("%s: %s", w.prefix, strings.TrimRight(string(w.buf[:i]), "\r"))
+		w.buf = w.buf[i+1:]
+	}
+	return len(p), nil
+}
+
+func (w *lineLogger) flush() {
+	if len(w.buf) > 0 {
+		w.t.Logf("%s: %s", w.prefix, string(w.buf))
+		w.buf = nil
+	}
+}
@@ -0,0 +1,68 @@
+package docker
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/matrix-org/complement/internal/b"
+	"github.com/matrix-org/complement/internal/config"
+	"github.com/matrix-org/complement/internal/instruction"
+)
+
+// Attach makes a Deployment of the blueprint on the homeserver which is already running at
+// COMPLEMENT_ATTACH_BASE_URL, instead of running any containers. The blueprint must have a single
+// homeserver, which the running homeserver stands in for, so its server_name must be the blueprint's
+// homeserver name e.g "hs1". The blueprint's instructions are run against the homeserver, logging in as
+// users who already exist from an earlier run. Tests using the deployment are skipped if they need to
+// control the homeserver's container, e.g to restart it.
+func Attach(cfg *config.Complement, bprint b.Blueprint) (*Deployment, error) {
+	if len(bprint.Homeservers) != 1 {
+		return nil, fmt.Errorf("Attach: blueprint %s has %d homeservers, only 1 is supported", bprint.Name, len(bprint.Homeservers))
+	}
+	hs := bprint.Homeservers[0]
+	runner := instruction.NewRunner(bprint.Name, cfg.BestEffort, cfg.DebugLoggingEnabled)
+	runner.AllowExistingUsers()
+	runner.SetRoomConcurrency(cfg.BuildConcurrency)
+	if err := runner.Run(hs, cfg.AttachBaseURL); err != nil {
+		return nil, fmt.Errorf("Attach: failed to run instructions for %s: %w", bprint.Name, err)
+	}
+	return &Deployment{
+		Deployer: &Deployer{
+			DeployNamespace: "attached",
+			debugLogging:    cfg.DebugLoggingEnabled,
+			config:          cfg,
+		},
+		BlueprintName: bprint.Name,
+		HS: map[string]HomeserverDeployment{
+			hs.Name: {
+				BaseURL:             cfg.AttachBaseURL,
+				FedBaseURL:          cfg.AttachFedBaseURL,
+				AccessTokens:        runner.AccessTokens(hs.Name),
+				ApplicationServices: asIDToRegistrationFromLabels(labelsForApplicationServices(hs)),
+				DeviceIDs:           runner.DeviceIDs(hs.Name),
+				GuestUserIDs:        runner.GuestUserIDs(hs.Name),
+				DeviceAccessTokens:  runner.DeviceAccessTokens(hs.Name),
+			},
+		},
+		Config:   cfg,
+		attached: true,
+	}, nil
+}
+
+// Attached returns true if the deployment is of a homeserver which Complement did not start, via
+// COMPLEMENT_ATTACH_BASE_URL. Such homeservers can't be restarted, inspected or federated with.
+func (d *Deployment) Attached() bool {
+	return d.attached
+}
+
+// skipIfAttached skips the test if the deployment is attached or deployed to Kubernetes, as `method` needs
+// the homeserver's container.
+func (d *Deployment) skipIfAttached(t *testing.T, method string) {
+	t.Helper()
+	if d.attached {
+		t.Skipf("Deployment.%s - not supported when attached to an existing homeserver", method)
+	}
+	if d.kube != nil {
+		t.Skipf("Deployment.%s - not supported when deployed to Kubernetes", method)
+	}
+}
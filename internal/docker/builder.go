@@ -17,6 +17,8 @@ import (
 	"context"
 	"fmt"
 	"log"
+	"regexp"
+	"strconv"
 	"strings"
 	"time"
 
@@ -29,6 +31,7 @@ import (
 	"github.com/matrix-org/complement/internal/b"
 	"github.com/matrix-org/complement/internal/config"
 	"github.com/matrix-org/complement/internal/instruction"
+	"github.com/matrix-org/complement/internal/timing"
 )
 
 var (
@@ -46,7 +49,7 @@ type Builder struct {
 }
 
 func NewBuilder(cfg *config.Complement) (*Builder, error) {
-	cli, err := client.NewEnvClient()
+	cli, err := newClient(cfg)
 	if err != nil {
 		return nil, err
 	}
@@ -64,6 +67,9 @@ func (d *Builder) log(str string, args ...interface{}) {
 }
 
 func (d *Builder) Cleanup() {
+	if err := d.reapOrphans(); err != nil {
+		d.log("Cleanup: Failed to remove orphaned containers and networks: %s", err)
+	}
 	err := d.removeContainers()
 	if err != nil {
 		d.log("Cleanup: Failed to remove containers: %s", err)
@@ -125,7 +131,7 @@ func (d *Builder) removeImages() error {
 			continue
 		}
 		bprintName := img.Labels["complement_blueprint"]
-		keep := false
+		keep := d.Config.CacheBlueprints && img.Labels[blueprintHashLabel] != ""
 		for _, keepBprint := range d.Config.KeepBlueprints {
 			if bprintName == keepBprint {
 				keep = true
@@ -162,6 +168,8 @@ func (d *Builder) removeContainers() error {
 	for _, c := range containers {
 		err = d.Docker.ContainerRemove(context.Background(), c.ID, types.ContainerRemoveOptions{
 			Force: true,
+			// e.g the data volume declared by the postgres image
+			RemoveVolumes: true,
 		})
 		if err != nil {
 			return err
@@ -171,6 +179,10 @@ func (d *Builder) removeContainers() error {
 }
 
 func (d *Builder) ConstructBlueprintIfNotExist(bprint b.Blueprint) error {
+	defer timing.Track(timing.PhaseBuild)()
+	if err := checkImagePlatforms(d.Docker, d.Config, bprint); err != nil {
+		return fmt.Errorf("ConstructBlueprintIfNotExist(%s): %w", bprint.Name, err)
+	}
 	images, err := d.Docker.ImageList(context.Background(), types.ImageListOptions{
 		Filters: label(
 			"complement_blueprint="+bprint.Name,
@@ -180,6 +192,20 @@ func (d *Builder) ConstructBlueprintIfNotExist(bprint b.Blueprint) error {
 	if err != nil {
 		return fmt.Errorf("ConstructBlueprintIfNotExist(%s): failed to ImageList: %w", bprint.Name, err)
 	}
+	if len(images) > 0 && d.Config.CacheBlueprints && images[0].Labels[snapshotLabel] == "" {
+		hash, err := blueprintHash(d.Docker, d.Config, bprint)
+		if err != nil {
+			return fmt.Errorf("ConstructBlueprintIfNotExist(%s): failed to hash blueprint: %w", bprint.Name, err)
+		}
+		stale, err := removeStaleImages(d.Docker, images, hash)
+		if err != nil {
+			return fmt.Errorf("ConstructBlueprintIfNotExist(%s): failed to remove stale images: %w", bprint.Name, err)
+		}
+		if stale {
+			d.log("Rebuilding blueprint %s as it or its images have changed", bprint.Name)
+			images = nil
+		}
+	}
 	if len(images) == 0 {
 		d.ConstructBlueprint(bprint)
 	}
@@ -187,6 +213,11 @@ func (d *Builder) ConstructBlueprintIfNotExist(bprint b.Blueprint) error {
 }
 
 func (d *Builder) ConstructBlueprint(bprint b.Blueprint) error {
+	// homeservers running from compose files are deployed afresh rather than built into images
+	bprint = withoutComposeHomeservers(bprint)
+	if len(bprint.Homeservers) == 0 {
+		return nil
+	}
 	errs := d.construct(bprint)
 	if len(errs) > 0 {
 		for _, err := range errs {
@@ -237,12 +268,21 @@ func (d *Builder) ConstructBlueprint(bprint b.Blueprint) error {
 func (d *Builder) construct(bprint b.Blueprint) (errs []error) {
 	d.log("Constructing blueprint '%s'", bprint.Name)
 
-	networkID, err := createNetworkIfNotExists(d.Docker, d.Config.PackageNamespace, bprint.Name)
+	networkID, err := createNetworkIfNotExists(d.Docker, d.Config, bprint.Name)
 	if err != nil {
 		return []error{err}
 	}
 
+	var hash string
+	if d.Config.CacheBlueprints {
+		hash, err = blueprintHash(d.Docker, d.Config, bprint)
+		if err != nil {
+			return []error{err}
+		}
+	}
+
 	runner := instruction.NewRunner(bprint.Name, d.Config.BestEffort, d.Config.DebugLoggingEnabled)
+	runner.SetRoomConcurrency(d.Config.BuildConcurrency)
 	results := make([]result, len(bprint.Homeservers))
 	for i, hs := range bprint.Homeservers {
 		res := d.constructHomeserver(bprint.Name, runner, hs, networkID)
@@ -258,6 +298,10 @@ func (d *Builder) construct(bprint b.Blueprint) (errs []error) {
 				d.log("%s: failed to remove container which failed to deploy: %s", res.contextStr, delErr)
 			}
 		}
+		if res.postgresContainerID != "" {
+			// killed along with the homeserver container, and removed by Cleanup
+			defer d.Docker.ContainerKill(context.Background(), res.postgresContainerID, "KILL") // nolint:errcheck
+		}
 		// kill the container
 		defer func(r result) {
 			containerInfo, err := d.Docker.ContainerInspect(context.Background(), r.containerID)
@@ -304,11 +348,37 @@ func (d *Builder) construct(bprint b.Blueprint) (errs []error) {
 			}
 		}
 
+		deviceTokens := runner.DeviceAccessTokens(res.homeserver.Name)
+		if len(bprint.KeepAccessTokensForUsers) > 0 {
+			kept := make(map[string]map[string]string)
+			for _, userID := range bprint.KeepAccessTokensForUsers {
+				if tokens, ok := deviceTokens[userID]; ok {
+					kept[userID] = tokens
+				}
+			}
+			deviceTokens = kept
+		}
+		for k, v := range labelsForDeviceAccessTokens(deviceTokens) {
+			labels[k] = v
+		}
+
 		deviceIDs := runner.DeviceIDs(res.homeserver.Name)
 		for userID, deviceID := range deviceIDs {
 			labels["device_id"+userID] = deviceID
 		}
 
+		for blueprintUserID, userID := range runner.GuestUserIDs(res.homeserver.Name) {
+			labels["guest_user_id_"+blueprintUserID] = userID
+		}
+
+		for name, port := range res.homeserver.Ports {
+			labels[portLabelPrefix+name] = strconv.Itoa(port)
+		}
+
+		if hash != "" {
+			labels[blueprintHashLabel] = hash
+		}
+
 		// Combine the labels for tokens and application services
 		asLabels := labelsForApplicationServices(res.homeserver)
 		for k, v := range asLabels {
@@ -342,6 +412,30 @@ func (d *Builder) construct(bprint b.Blueprint) (errs []error) {
 		}
 		imageID := strings.Replace(commit.ID, "sha256:", "", 1)
 		d.log("%s: Created docker image %s\n", res.contextStr, imageID)
+
+		if res.postgresContainerID != "" {
+			// commit the database too, so the blueprint's data is kept. The homeserver has stopped, so
+			// nothing is writing to it.
+			d.Docker.ContainerStop(context.Background(), res.postgresContainerID, &timeout)
+			pgLabels := make(map[string]string)
+			if hash != "" {
+				pgLabels[blueprintHashLabel] = hash
+			}
+			commit, err = d.Docker.ContainerCommit(context.Background(), res.postgresContainerID, types.ContainerCommitOptions{
+				Author:    "Complement",
+				Pause:     true,
+				Reference: "localhost/complement:" + res.contextStr + "-" + postgresSidecar,
+				Config: &container.Config{
+					Labels: pgLabels,
+				},
+			})
+			if err != nil {
+				d.log("%s : failed to ContainerCommit postgres: %s\n", res.contextStr, err)
+				errs = append(errs, fmt.Errorf("%s : failed to ContainerCommit postgres: %w", res.contextStr, err))
+				continue
+			}
+			d.log("%s: Created postgres docker image %s\n", res.contextStr, strings.Replace(commit.ID, "sha256:", "", 1))
+		}
 	}
 	return errs
 }
@@ -350,7 +444,28 @@ func (d *Builder) construct(bprint b.Blueprint) (errs []error) {
 func (d *Builder) constructHomeserver(blueprintName string, runner *instruction.Runner, hs b.Homeserver, networkID string) result {
 	contextStr := fmt.Sprintf("%s.%s.%s", d.Config.PackageNamespace, blueprintName, hs.Name)
 	d.log("%s : constructing homeserver...\n", contextStr)
-	dep, err := d.deployBaseImage(blueprintName, hs, contextStr, networkID)
+	var hsOpts *hsDeployOptions
+	var postgresContainerID string
+	if d.Config.Postgres {
+		err := pullImageIfNotExists(d.Docker, d.Config.PostgresImage, d.Config.Platform)
+		if err == nil {
+			postgresContainerID, err = deployPostgres(
+				d.Docker, d.Config.PostgresImage, fmt.Sprintf("complement_%s", contextStr),
+				d.Config.PackageNamespace, blueprintName, hs.Name, contextStr, networkID, d.Config,
+			)
+		}
+		if err != nil {
+			log.Printf("%s : failed to deploy postgres: %s\n", contextStr, err)
+			return result{
+				err:                 err,
+				contextStr:          contextStr,
+				homeserver:          hs,
+				postgresContainerID: postgresContainerID,
+			}
+		}
+		hsOpts = hsOpts.withEnv(postgresEnv(hs.Name))
+	}
+	dep, err := d.deployBaseImage(blueprintName, hs, contextStr, networkID, hsOpts)
 	if err != nil {
 		log.Printf("%s : failed to deployBaseImage: %s\n", contextStr, err)
 		containerID := ""
@@ -358,10 +473,11 @@ func (d *Builder) constructHomeserver(blueprintName string, runner *instruction.
 			containerID = dep.ContainerID
 		}
 		return result{
-			err:         err,
-			containerID: containerID,
-			contextStr:  contextStr,
-			homeserver:  hs,
+			err:                 err,
+			containerID:         containerID,
+			contextStr:          contextStr,
+			homeserver:          hs,
+			postgresContainerID: postgresContainerID,
 		}
 	}
 	d.log("%s : deployed base image to %s (%s)\n", contextStr, dep.BaseURL, dep.ContainerID)
@@ -370,42 +486,85 @@ func (d *Builder) constructHomeserver(blueprintName string, runner *instruction.
 		d.log("%s : failed to run instructions: %s\n", contextStr, err)
 	}
 	return result{
-		err:         err,
-		containerID: dep.ContainerID,
-		contextStr:  contextStr,
-		homeserver:  hs,
+		err:                 err,
+		containerID:         dep.ContainerID,
+		contextStr:          contextStr,
+		homeserver:          hs,
+		postgresContainerID: postgresContainerID,
 	}
 }
 
 // deployBaseImage runs the base image and returns the baseURL, containerID or an error.
-func (d *Builder) deployBaseImage(blueprintName string, hs b.Homeserver, contextStr, networkID string) (*HomeserverDeployment, error) {
+func (d *Builder) deployBaseImage(blueprintName string, hs b.Homeserver, contextStr, networkID string, hsOpts *hsDeployOptions) (*HomeserverDeployment, error) {
 	asIDToRegistrationMap := asIDToRegistrationFromLabels(labelsForApplicationServices(hs))
+	imageURI, err := d.Config.ImageURI(hs.Image)
+	if err != nil {
+		return nil, err
+	}
+	if hs.Image != "" {
+		if err = pullImageIfNotExists(d.Docker, imageURI, d.Config.Platform); err != nil {
+			return nil, err
+		}
+	}
 
 	return deployImage(
-		d.Docker, d.Config.BaseImageURI, fmt.Sprintf("complement_%s", contextStr),
+		d.Docker, imageURI, fmt.Sprintf("complement_%s", contextStr),
 		d.Config.PackageNamespace, blueprintName, hs.Name, asIDToRegistrationMap, contextStr,
-		networkID, d.Config,
+		networkID, hsOpts, d.Config,
 	)
 }
 
 func generateASRegistrationYaml(as b.ApplicationService) string {
-	return fmt.Sprintf("id: %s\n", as.ID) +
+	yaml := fmt.Sprintf("id: %s\n", as.ID) +
 		fmt.Sprintf("hs_token: %s\n", as.HSToken) +
 		fmt.Sprintf("as_token: %s\n", as.ASToken) +
 		fmt.Sprintf("url: '%s'\n", as.URL) +
 		fmt.Sprintf("sender_localpart: %s\n", as.SenderLocalpart) +
 		fmt.Sprintf("rate_limited: %v\n", as.RateLimited) +
-		"namespaces:\n" +
-		"  users:\n" +
-		"    - exclusive: false\n" +
-		"      regex: .*\n" +
-		"  rooms: []\n" +
-		"  aliases: []\n"
+		"namespaces:\n"
+	if as.Namespaces == nil {
+		return yaml +
+			"  users:\n" +
+			"    - exclusive: false\n" +
+			"      regex: .*\n" +
+			"  rooms: []\n" +
+			"  aliases: []\n"
+	}
+	return yaml +
+		asNamespacesYaml("users", as.Namespaces.Users) +
+		asNamespacesYaml("rooms", as.Namespaces.Rooms) +
+		asNamespacesYaml("aliases", as.Namespaces.Aliases)
+}
+
+func asNamespacesYaml(key string, namespaces []b.ApplicationServiceNamespace) string {
+	if len(namespaces) == 0 {
+		return fmt.Sprintf("  %s: []\n", key)
+	}
+	yaml := fmt.Sprintf("  %s:\n", key)
+	for _, ns := range namespaces {
+		yaml += fmt.Sprintf("    - exclusive: %v\n", ns.Exclusive)
+		// single quote the regex so YAML doesn't interpret any special characters in it
+		yaml += fmt.Sprintf("      regex: '%s'\n", strings.ReplaceAll(ns.Regex, "'", "''"))
+	}
+	return yaml
+}
+
+// asURLLine matches the URL of an application service registration made by generateASRegistrationYaml.
+var asURLLine = regexp.MustCompile(`(?m)^url: .*$`)
+
+// resolveASRegistration returns the registration with its URL replaced by `url`, if it is set, and
+// b.HostPlaceholder replaced by the hostname of Complement.
+func resolveASRegistration(registration, url string) string {
+	if url != "" {
+		registration = asURLLine.ReplaceAllLiteralString(registration, fmt.Sprintf("url: '%s'", url))
+	}
+	return strings.ReplaceAll(registration, b.HostPlaceholder, HostnameRunningComplement)
 }
 
-// createNetworkIfNotExists creates a docker network and returns its id.
-// ID is guaranteed not to be empty when err == nil
-func createNetworkIfNotExists(docker *client.Client, pkgNamespace, blueprintName string) (networkID string, err error) {
+// createNetworkIfNotExists creates a docker network and returns its id. The network is dual-stack if
+// COMPLEMENT_ENABLE_IPV6 is set. ID is guaranteed not to be empty when err == nil
+func createNetworkIfNotExists(docker *client.Client, cfg *config.Complement, blueprintName string) (networkID string, err error) {
+	pkgNamespace := cfg.PackageNamespace
 	// check if a network already exists for this blueprint
 	nws, err := docker.NetworkList(context.Background(), types.NetworkListOptions{
 		Filters: label(
@@ -424,11 +583,14 @@ func createNetworkIfNotExists(docker *client.Client, pkgNamespace, blueprintName
 		return nws[0].ID, nil
 	}
 	// make a user-defined network so we get DNS based on the container name
+	// IPv6 subnets are allocated from the daemon's default-address-pools, which must include one.
 	nw, err := docker.NetworkCreate(context.Background(), "complement_"+pkgNamespace+"_"+blueprintName, types.NetworkCreate{
+		EnableIPv6: cfg.IPv6,
 		Labels: map[string]string{
 			complementLabel:        blueprintName,
 			"complement_blueprint": blueprintName,
 			"complement_pkg":       pkgNamespace,
+			runLabel:               cfg.RunID,
 		},
 	})
 	if err != nil {
@@ -490,4 +652,6 @@ type result struct {
 	containerID string
 	contextStr  string
 	homeserver  b.Homeserver
+	// The container of the homeserver's Postgres database, if COMPLEMENT_POSTGRES is set
+	postgresContainerID string
 }
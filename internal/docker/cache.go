@@ -0,0 +1,100 @@
+package docker
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/client"
+
+	"github.com/matrix-org/complement/internal/b"
+	"github.com/matrix-org/complement/internal/config"
+)
+
+// The label of blueprint images which holds the hash of what they were built from, if
+// COMPLEMENT_CACHE_BLUEPRINTS is set.
+const blueprintHashLabel = "complement_blueprint_hash"
+
+// blueprintHash returns a hash of the blueprint and the images it is built from, so images built from an
+// older version of either can be detected and rebuilt. Generated application service tokens aren't hashed,
+// as they are different in every run; deployments use the tokens in the labels of the images instead.
+// Returns an empty hash for blueprints with Func steps, which can't be hashed, so they aren't cached.
+func blueprintHash(docker *client.Client, cfg *config.Complement, bprint b.Blueprint) (string, error) {
+	if b.HasFuncSteps(bprint) {
+		return "", nil
+	}
+	// compose homeservers aren't built into images
+	bprint = b.WithoutGeneratedTokens(withoutComposeHomeservers(bprint))
+	imageIDs := make(map[string]string) // image URI -> ID
+	addImage := func(uri string) error {
+		if _, ok := imageIDs[uri]; ok {
+			return nil
+		}
+		img, _, err := docker.ImageInspectWithRaw(context.Background(), uri)
+		if err != nil {
+			return fmt.Errorf("failed to inspect image %s: %w", uri, err)
+		}
+		imageIDs[uri] = img.ID
+		return nil
+	}
+	for _, hs := range bprint.Homeservers {
+		uri, err := cfg.ImageURI(hs.Image)
+		if err != nil {
+			return "", err
+		}
+		if hs.Image != "" {
+			if err = pullImageIfNotExists(docker, uri, cfg.Platform); err != nil {
+				return "", err
+			}
+		}
+		if err = addImage(uri); err != nil {
+			return "", err
+		}
+	}
+	if cfg.Postgres {
+		if err := pullImageIfNotExists(docker, cfg.PostgresImage, cfg.Platform); err != nil {
+			return "", err
+		}
+		if err := addImage(cfg.PostgresImage); err != nil {
+			return "", err
+		}
+	}
+	// maps are marshalled in key order, so this is stable
+	data, err := json.Marshal(struct {
+		Blueprint b.Blueprint
+		Images    map[string]string
+		Postgres  bool
+	}{bprint, imageIDs, cfg.Postgres})
+	if err != nil {
+		return "", err
+	}
+	hash := sha256.Sum256(data)
+	return hex.EncodeToString(hash[:]), nil
+}
+
+// removeStaleImages removes the images of the blueprint if they weren't built from what `hash` was made
+// from, and returns true if there were any.
+func removeStaleImages(docker *client.Client, images []types.ImageSummary, hash string) (bool, error) {
+	stale := false
+	for _, img := range images {
+		if img.Labels[blueprintHashLabel] != hash {
+			stale = true
+			break
+		}
+	}
+	if !stale {
+		return false, nil
+	}
+	for _, img := range images {
+		_, err := docker.ImageRemove(context.Background(), img.ID, types.ImageRemoveOptions{
+			Force: true,
+		})
+		if err != nil {
+			return true, err
+		}
+	}
+	return true, nil
+}
@@ -0,0 +1,64 @@
+package docker
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+// WithClockControl lets the test move the clock of the homeserver `hsName` forward with AdvanceClock, so
+// behaviour which happens after a while, e.g token expiry or retention purges, can be tested without waiting.
+//
+// This uses libfaketime, which the image must include. The homeserver is given COMPLEMENT_FAKETIME=1, and the
+// image should then add libfaketime to LD_PRELOAD, as where it is installed differs between distributions.
+// It is also given FAKETIME_TIMESTAMP_FILE=MountFakeTimePath and FAKETIME_NO_CACHE=1, so libfaketime picks up
+// the offset written by AdvanceClock straight away.
+func WithClockControl(hsName string) DeployOption {
+	return func(opts *deployOptions) {
+		hsOpts := opts.homeserver(hsName)
+		hsOpts.clockControl = true
+		hsOpts.env["COMPLEMENT_FAKETIME"] = "1"
+		hsOpts.env["FAKETIME_TIMESTAMP_FILE"] = MountFakeTimePath
+		hsOpts.env["FAKETIME_NO_CACHE"] = "1"
+		hsOpts.files[MountFakeTimePath] = []byte("+0s\n")
+	}
+}
+
+// AdvanceClock moves the clock of the homeserver `hsName` forward by `d`, rounded up to the second, in its
+// main process and workers. The clock keeps running from the new time. Timers the homeserver has already set,
+// e.g with sleep(), are not brought forward, so it may only notice the new time the next time it checks.
+// Fails the test if the hsName is not found, it wasn't deployed WithClockControl, or the offset can't be
+// written.
+func (d *Deployment) AdvanceClock(t *testing.T, hsName string, duration time.Duration) {
+	t.Helper()
+	d.skipIfAttached(t, "AdvanceClock")
+	dep, ok := d.HS[hsName]
+	if !ok {
+		t.Fatalf("Deployment.AdvanceClock - HS name '%s' not found", hsName)
+		return
+	}
+	if !dep.clockControl {
+		t.Fatalf("Deployment.AdvanceClock - %s was not deployed WithClockControl", hsName)
+		return
+	}
+	d.mu.Lock()
+	if d.clockOffsets == nil {
+		d.clockOffsets = make(map[string]time.Duration)
+	}
+	// libfaketime offsets are in whole seconds
+	d.clockOffsets[hsName] += (duration + time.Second - 1).Truncate(time.Second)
+	offset := d.clockOffsets[hsName]
+	d.mu.Unlock()
+	contents := []byte(fmt.Sprintf("+%ds\n", int64(offset/time.Second)))
+	// only the homeserver's own processes read the offset, sidecars such as Postgres don't have libfaketime
+	containerIDs := map[string]string{hsName: dep.ContainerID}
+	for _, name := range dep.workers {
+		containerIDs[name+"."+hsName] = dep.Sidecars[name]
+	}
+	for _, name := range sortedKeys(containerIDs) {
+		if err := copyToContainer(d.Deployer.Docker, containerIDs[name], MountFakeTimePath, contents); err != nil {
+			t.Fatalf("Deployment.AdvanceClock - failed to advance clock of %s: %s", name, err)
+		}
+	}
+	t.Logf("Deployment.AdvanceClock - %s is now %s ahead", hsName, offset)
+}
@@ -0,0 +1,82 @@
+package docker
+
+import (
+	"archive/tar"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/docker/docker/client"
+)
+
+// fakeCopyDocker is a Docker API which records the files copied into each container.
+type fakeCopyDocker struct {
+	// container ID -> path -> contents
+	files map[string]map[string]string
+}
+
+func (f *fakeCopyDocker) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.Method != "PUT" || !strings.HasSuffix(req.URL.Path, "/archive") {
+		http.NotFound(w, req)
+		return
+	}
+	parts := strings.Split(req.URL.Path, "/")
+	containerID := parts[len(parts)-2]
+	tr := tar.NewReader(req.Body)
+	for {
+		hdr, err := tr.Next()
+		if err != nil {
+			break
+		}
+		data, _ := ioutil.ReadAll(tr)
+		if f.files[containerID] == nil {
+			f.files[containerID] = make(map[string]string)
+		}
+		f.files[containerID][hdr.Name] = string(data)
+	}
+}
+
+func TestWithClockControl(t *testing.T) {
+	opts := newDeployOptions([]DeployOption{WithClockControl("hs1")})
+	hsOpts := opts.homeservers["hs1"]
+	if hsOpts == nil || !hsOpts.clockControl {
+		t.Fatalf("hs1 has options %+v, want clock control", hsOpts)
+	}
+	if got := string(hsOpts.files[MountFakeTimePath]); got != "+0s\n" {
+		t.Errorf("initial offset file is %q, want +0s", got)
+	}
+}
+
+func TestAdvanceClock(t *testing.T) {
+	fake := &fakeCopyDocker{files: make(map[string]map[string]string)}
+	srv := httptest.NewServer(fake)
+	defer srv.Close()
+	docker, err := client.NewClientWithOpts(client.WithHost("tcp://"+srv.Listener.Addr().String()), client.WithVersion("1.41"))
+	if err != nil {
+		t.Fatalf("failed to make docker client: %s", err)
+	}
+	d := &Deployment{
+		HS: map[string]HomeserverDeployment{
+			"hs1": {
+				ContainerID:  "container1",
+				Sidecars:     map[string]string{postgresSidecar: "pg1", proxySidecar: "proxy1", "sync": "worker1"},
+				workers:      []string{"sync"},
+				clockControl: true,
+			},
+		},
+		Deployer: &Deployer{Docker: docker},
+	}
+	d.AdvanceClock(t, "hs1", time.Hour)
+	d.AdvanceClock(t, "hs1", 1500*time.Millisecond)
+	want := map[string]map[string]string{
+		"container1": {MountFakeTimePath: "+3602s\n"},
+		"worker1":    {MountFakeTimePath: "+3602s\n"},
+	}
+	if !reflect.DeepEqual(fake.files, want) {
+		t.Errorf("got files %v want %v", fake.files, want)
+	}
+}
@@ -0,0 +1,154 @@
+package docker
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/network"
+	"github.com/docker/docker/client"
+
+	"github.com/matrix-org/complement/internal/b"
+	"github.com/matrix-org/complement/internal/config"
+	"github.com/matrix-org/complement/internal/instruction"
+)
+
+// WithComposeHomeservers deploys the homeservers in the blueprint which run from a compose file, as they
+// are not built into images. The test suites pass this when UsesCompose returns true.
+func WithComposeHomeservers(bprint b.Blueprint) DeployOption {
+	return func(opts *deployOptions) {
+		for _, hs := range bprint.Homeservers {
+			if hs.Compose != nil {
+				opts.composeHomeservers = append(opts.composeHomeservers, hs)
+			}
+		}
+		opts.composeBlueprint = bprint.Name
+	}
+}
+
+// UsesCompose returns true if any homeserver in the blueprint runs from a compose file.
+func UsesCompose(bprint b.Blueprint) bool {
+	for _, hs := range bprint.Homeservers {
+		if hs.Compose != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// withoutComposeHomeservers returns the blueprint without the homeservers which run from a compose file,
+// which are deployed fresh every time rather than built into images.
+func withoutComposeHomeservers(bprint b.Blueprint) b.Blueprint {
+	var homeservers []b.Homeserver
+	for _, hs := range bprint.Homeservers {
+		if hs.Compose == nil {
+			homeservers = append(homeservers, hs)
+		}
+	}
+	bprint.Homeservers = homeservers
+	return bprint
+}
+
+// deployCompose brings up the compose project for the homeserver `hs`, connects the service running the
+// homeserver to the Complement network as `hs.Name`, then runs the homeserver's blueprint instructions.
+// The other services in the project are returned as sidecars.
+func deployCompose(
+	ctx context.Context, docker *client.Client, project, blueprintName string, hs b.Homeserver, networkID string,
+	cfg *config.Complement,
+) (*HomeserverDeployment, error) {
+	file, err := filepath.Abs(hs.Compose.File)
+	if err != nil {
+		return nil, err
+	}
+	service := hs.Compose.Service
+	if service == "" {
+		service = hs.Name
+	}
+	dep := &HomeserverDeployment{
+		Sidecars:       make(map[string]string),
+		composeProject: project,
+	}
+	// create the containers without starting them, so the homeserver is on the network with the CA
+	// before it starts, like homeservers deployed from images
+	if err = composeCmd(ctx, cfg, project, hs.Name, "-f", file, "up", "--no-start"); err != nil {
+		return dep, err
+	}
+	containers, err := docker.ContainerList(ctx, types.ContainerListOptions{
+		All:     true,
+		Filters: label("com.docker.compose.project=" + project),
+	})
+	if err != nil {
+		return dep, fmt.Errorf("failed to list containers of compose project %s: %w", project, err)
+	}
+	for _, c := range containers {
+		name := c.Labels["com.docker.compose.service"]
+		if name == service {
+			dep.ContainerID = c.ID
+		} else {
+			dep.Sidecars[name] = c.ID
+		}
+	}
+	if dep.ContainerID == "" {
+		return dep, fmt.Errorf("compose file %s has no service %s", file, service)
+	}
+	err = docker.NetworkConnect(ctx, networkID, dep.ContainerID, &network.EndpointSettings{
+		Aliases: []string{hs.Name},
+	})
+	if err != nil {
+		return dep, fmt.Errorf("failed to connect %s to the network: %w", service, err)
+	}
+	if err = copyCAToContainer(docker, dep.ContainerID, cfg); err != nil {
+		return dep, err
+	}
+	if err = composeCmd(ctx, cfg, project, hs.Name, "start"); err != nil {
+		return dep, err
+	}
+
+	inspect, baseURL, fedBaseURL, err := waitForPorts(ctx, docker, dep.ContainerID)
+	if err != nil {
+		return dep, fmt.Errorf("service %s must publish ports 8008 and 8448: %w", service, err)
+	}
+	dep.BaseURL = baseURL
+	dep.FedBaseURL = fedBaseURL
+	if _, err = waitForServer(ctx, docker, inspect, baseURL, cfg.SpawnHSTimeout); err != nil {
+		return dep, fmt.Errorf("failed to check server is up. %w", err)
+	}
+	runner := instruction.NewRunner(blueprintName, cfg.BestEffort, cfg.DebugLoggingEnabled)
+	runner.SetRoomConcurrency(cfg.BuildConcurrency)
+	if err = runner.Run(hs, baseURL); err != nil {
+		return dep, fmt.Errorf("failed to run instructions: %w", err)
+	}
+	dep.AccessTokens = runner.AccessTokens(hs.Name)
+	dep.ApplicationServices = asIDToRegistrationFromLabels(labelsForApplicationServices(hs))
+	dep.DeviceIDs = runner.DeviceIDs(hs.Name)
+	dep.GuestUserIDs = runner.GuestUserIDs(hs.Name)
+	dep.DeviceAccessTokens = runner.DeviceAccessTokens(hs.Name)
+	return dep, nil
+}
+
+// composeDown removes the networks and volumes of the compose project, after its containers are removed.
+func composeDown(cfg *config.Complement, project string) error {
+	return composeCmd(context.Background(), cfg, project, "", "down", "--volumes")
+}
+
+// composeCmd runs the compose command of the container runtime on the project. The homeserver's name is
+// available to the compose file as SERVER_NAME.
+func composeCmd(ctx context.Context, cfg *config.Complement, project, hsName string, args ...string) error {
+	rt, err := NewRuntime(cfg)
+	if err != nil {
+		return err
+	}
+	cmd := exec.CommandContext(ctx, rt.Name(), append([]string{"compose", "-p", project}, args...)...)
+	cmd.Env = append(os.Environ(), "SERVER_NAME="+hsName)
+	var output bytes.Buffer
+	cmd.Stdout = &output
+	cmd.Stderr = &output
+	if err = cmd.Run(); err != nil {
+		return fmt.Errorf("%s compose %v failed: %w: %s", rt.Name(), args, err, output.String())
+	}
+	return nil
+}
@@ -22,7 +22,6 @@ import (
 	"log"
 	"net/http"
 	"net/url"
-	"runtime"
 	"sync"
 	"time"
 
@@ -34,13 +33,17 @@ import (
 	"github.com/docker/docker/api/types/mount"
 	"github.com/docker/docker/api/types/network"
 
+	"github.com/matrix-org/complement/internal/b"
 	"github.com/matrix-org/complement/internal/config"
+	"github.com/matrix-org/complement/internal/timing"
 )
 
 const (
 	MountCACertPath     = "/complement/ca/ca.crt"
 	MountCAKeyPath      = "/complement/ca/ca.key"
 	MountAppServicePath = "/complement/appservice/" // All registration files sit here
+	MountConfigPath     = "/complement/config/"     // All config fragments from WithConfig sit here
+	MountFakeTimePath   = "/complement/faketime"    // The clock offset from AdvanceClock, for libfaketime
 )
 
 type Deployer struct {
@@ -53,7 +56,7 @@ type Deployer struct {
 }
 
 func NewDeployer(deployNamespace string, cfg *config.Complement) (*Deployer, error) {
-	cli, err := client.NewEnvClient()
+	cli, err := newClient(cfg)
 	if err != nil {
 		return nil, err
 	}
@@ -72,12 +75,169 @@ func (d *Deployer) log(str string, args ...interface{}) {
 	log.Printf(str, args...)
 }
 
-func (d *Deployer) Deploy(ctx context.Context, blueprintName string) (*Deployment, error) {
+// DeployOption is a functional option which modifies how the homeservers in a blueprint are deployed.
+// See functions starting with `With...` in this package for more info.
+type DeployOption func(*deployOptions)
+
+type deployOptions struct {
+	// HS name -> AS ID -> registration YAML, for registrations which are not part of the blueprint
+	applicationServices map[string]map[string]string
+	// HS name -> AS ID -> URL, for blueprint registrations which are given their URL on deployment
+	applicationServiceURLs map[string]map[string]string
+	// HS name -> options for that homeserver
+	homeservers map[string]*hsDeployOptions
+	// Homeservers in the blueprint which run from a compose file, and the name of that blueprint
+	composeHomeservers []b.Homeserver
+	composeBlueprint   string
+	// If true, the deployment is never pooled or shared, see WithIsolation
+	isolated bool
+}
+
+// newDeployOptions returns the options set by `opts`.
+func newDeployOptions(opts []DeployOption) *deployOptions {
+	options := &deployOptions{
+		applicationServices:    make(map[string]map[string]string),
+		applicationServiceURLs: make(map[string]map[string]string),
+		homeservers:            make(map[string]*hsDeployOptions),
+	}
+	for _, opt := range opts {
+		opt(options)
+	}
+	return options
+}
+
+// hsDeployOptions are deploy options which apply to a single homeserver.
+type hsDeployOptions struct {
+	// Extra environment variables for the container
+	env map[string]string
+	// Path -> contents of extra files copied into the container before it starts
+	files map[string][]byte
+	// Network conditions to apply once the homeserver has started, if any
+	networkConditions *NetworkConditions
+	// Extra processes of the homeserver to run in their own containers
+	workers []Worker
+	// Name -> container port of extra ports to publish, for GetPort
+	ports map[string]int
+	// Container paths to mount new temporary directories at, for TempMount
+	tempMounts []string
+	// If true, the homeserver is put behind a reverse proxy
+	reverseProxy bool
+	// If true, the homeserver's outbound traffic goes through a mitmproxy sidecar
+	intercept bool
+	// If true, the homeserver's clock can be moved with AdvanceClock
+	clockControl bool
+}
+
+// withEnv returns a copy of the options with the environment variables `env` added.
+func (o *hsDeployOptions) withEnv(env map[string]string) *hsDeployOptions {
+	c := hsDeployOptions{
+		env:   make(map[string]string),
+		files: make(map[string][]byte),
+	}
+	if o != nil {
+		c = *o
+		c.env = make(map[string]string)
+		for k, v := range o.env {
+			c.env[k] = v
+		}
+	}
+	for k, v := range env {
+		c.env[k] = v
+	}
+	return &c
+}
+
+// containersPerHomeserver returns how many containers a homeserver deployed with `o` runs: itself, its
+// workers and its sidecars.
+func containersPerHomeserver(o *hsDeployOptions, hasPostgres bool) int {
+	n := 1
+	if hasPostgres {
+		n++
+	}
+	if o == nil {
+		return n
+	}
+	n += len(o.workers)
+	if o.reverseProxy {
+		n++
+	}
+	if o.intercept {
+		n++
+	}
+	return n
+}
+
+func (opts *deployOptions) homeserver(hsName string) *hsDeployOptions {
+	if opts.homeservers[hsName] == nil {
+		opts.homeservers[hsName] = &hsDeployOptions{
+			env:   make(map[string]string),
+			files: make(map[string][]byte),
+			ports: make(map[string]int),
+		}
+	}
+	return opts.homeservers[hsName]
+}
+
+// WithIsolation makes a deployment which is only used by this test, even when deployments are pooled.
+// Use this for tests which depend on server-wide state, e.g room aliases, and it is required by methods
+// which change the homeservers themselves, e.g Deployment.Restart.
+func WithIsolation() DeployOption {
+	return func(opts *deployOptions) {
+		opts.isolated = true
+	}
+}
+
+// WithApplicationServiceRegistration adds the application service registration `registrationYAML`
+// to the homeserver `hsName` when it is deployed. Registrations with the same ID as one in the
+// blueprint replace the blueprint registration.
+func WithApplicationServiceRegistration(hsName, asID, registrationYAML string) DeployOption {
+	return func(opts *deployOptions) {
+		if opts.applicationServices[hsName] == nil {
+			opts.applicationServices[hsName] = make(map[string]string)
+		}
+		opts.applicationServices[hsName][asID] = registrationYAML
+	}
+}
+
+// WithApplicationServiceURL sets the URL of the application service `asID` in the blueprint to `url` when
+// the homeserver `hsName` is deployed, e.g to point it at a mock application service listening on a
+// random port. The URL may contain b.HostPlaceholder.
+func WithApplicationServiceURL(hsName, asID, url string) DeployOption {
+	return func(opts *deployOptions) {
+		if opts.applicationServiceURLs[hsName] == nil {
+			opts.applicationServiceURLs[hsName] = make(map[string]string)
+		}
+		opts.applicationServiceURLs[hsName][asID] = url
+	}
+}
+
+// WithEnv sets the environment variable `key` to `value` in the container of the homeserver `hsName`,
+// e.g to toggle a feature the image exposes as an environment variable.
+func WithEnv(hsName, key, value string) DeployOption {
+	return func(opts *deployOptions) {
+		opts.homeserver(hsName).env[key] = value
+	}
+}
+
+// WithConfig adds the config fragment `contents` to the container of the homeserver `hsName` at
+// MountConfigPath + `filename` before it starts, e.g to change rate limits or retention. The image is
+// responsible for merging fragments in this directory into its config, and fragments are in the format
+// of the homeserver's own config.
+func WithConfig(hsName, filename, contents string) DeployOption {
+	return func(opts *deployOptions) {
+		opts.homeserver(hsName).files[MountConfigPath+filename] = []byte(contents)
+	}
+}
+
+func (d *Deployer) Deploy(ctx context.Context, blueprintName string, opts ...DeployOption) (*Deployment, error) {
+	defer timing.Track(timing.PhaseDeploy)()
+	options := newDeployOptions(opts)
 	dep := &Deployment{
 		Deployer:      d,
 		BlueprintName: blueprintName,
 		HS:            make(map[string]HomeserverDeployment),
 		Config:        d.config,
+		isolated:      options.isolated,
 	}
 	images, err := d.Docker.ImageList(ctx, types.ImageListOptions{
 		Filters: label(
@@ -88,14 +248,38 @@ func (d *Deployer) Deploy(ctx context.Context, blueprintName string) (*Deploymen
 	if err != nil {
 		return nil, fmt.Errorf("Deploy: failed to ImageList: %w", err)
 	}
-	if len(images) == 0 {
+	// sidecar images e.g databases are deployed alongside the homeserver they belong to
+	sidecarImages := make(map[string]types.ImageSummary) // HS name -> postgres image
+	var hsImages []types.ImageSummary
+	for _, img := range images {
+		if img.Labels["complement_sidecar"] == postgresSidecar {
+			sidecarImages[img.Labels["complement_hs_name"]] = img
+		} else {
+			hsImages = append(hsImages, img)
+		}
+	}
+	images = hsImages
+	if len(images) == 0 && len(options.composeHomeservers) == 0 {
 		return nil, fmt.Errorf("Deploy: No images have been built for blueprint %s", blueprintName)
 	}
-	networkID, err := createNetworkIfNotExists(d.Docker, d.config.PackageNamespace, blueprintName)
+	networkID, err := createNetworkIfNotExists(d.Docker, d.config, blueprintName)
 	if err != nil {
 		return nil, fmt.Errorf("Deploy: %w", err)
 	}
 	d.networkID = networkID
+	dep.networkID = networkID
+	// workers and sidecars need as much as a homeserver
+	containers := len(options.composeHomeservers)
+	for _, img := range images {
+		hsName := img.Labels["complement_hs_name"]
+		_, hasPostgres := sidecarImages[hsName]
+		containers += containersPerHomeserver(options.homeservers[hsName], hasPostgres)
+	}
+	dep.limitHolder = limiterHolder(ctx, "Deploy "+d.DeployNamespace)
+	dep.limited, err = containerLimiter(d.config).acquire(ctx, dep.limitHolder, containers, "Deploy "+blueprintName)
+	if err != nil {
+		return nil, fmt.Errorf("Deploy: %w", err)
+	}
 
 	// deploy images in parallel
 	var mu sync.Mutex // protects mutable values like the counter and errors
@@ -110,16 +294,85 @@ func (d *Deployer) Deploy(ctx context.Context, blueprintName string) (*Deploymen
 		contextStr := img.Labels["complement_context"]
 		hsName := img.Labels["complement_hs_name"]
 		asIDToRegistrationMap := asIDToRegistrationFromLabels(img.Labels)
+		for asID, url := range options.applicationServiceURLs[hsName] {
+			if registration, ok := asIDToRegistrationMap[asID]; ok {
+				asIDToRegistrationMap[asID] = resolveASRegistration(registration, url)
+			}
+		}
+		for asID, registration := range options.applicationServices[hsName] {
+			asIDToRegistrationMap[asID] = registration
+		}
 
 		// TODO: Make CSAPI port configurable
-		deployment, err := deployImage(
-			d.Docker, img.ID, fmt.Sprintf("complement_%s_%s_%s_%d", d.config.PackageNamespace, d.DeployNamespace, contextStr, counter),
-			d.config.PackageNamespace, blueprintName, hsName, asIDToRegistrationMap, contextStr, networkID, d.config,
-		)
+		containerName := fmt.Sprintf("complement_%s_%s_%s_%d", d.config.PackageNamespace, d.DeployNamespace, contextStr, counter)
+		hsOpts := options.homeservers[hsName]
+		sidecars := make(map[string]string)
+		var deployment *HomeserverDeployment
+		var err error
+		if pgImg, ok := sidecarImages[hsName]; ok {
+			sidecars[postgresSidecar], err = deployPostgres(
+				d.Docker, pgImg.ID, containerName, d.config.PackageNamespace, blueprintName, hsName, contextStr, networkID, d.config,
+			)
+			hsOpts = hsOpts.withEnv(postgresEnv(hsName))
+		}
+		var interceptor *Interceptor
+		if err == nil && hsOpts != nil && hsOpts.intercept {
+			interceptor, err = newInterceptor()
+			if err == nil {
+				sidecars[interceptSidecar], err = deployInterceptor(
+					d.Docker, containerName, d.config.PackageNamespace, blueprintName, hsName, contextStr, networkID,
+					interceptor, d.config,
+				)
+			}
+			hsOpts = hsOpts.withEnv(interceptEnv(hsName))
+		}
+		if err == nil {
+			deployment, err = deployImage(
+				d.Docker, img.ID, containerName,
+				d.config.PackageNamespace, blueprintName, hsName, asIDToRegistrationMap, contextStr, networkID, hsOpts, d.config,
+			)
+		}
+		if err == nil && hsOpts != nil && len(hsOpts.workers) > 0 {
+			var workers map[string]string
+			workers, err = deployWorkers(
+				d.Docker, img.ID, containerName, d.config.PackageNamespace, blueprintName, hsName, contextStr, networkID,
+				asIDToRegistrationMap, deployment.tempMounts, hsOpts, d.config,
+			)
+			for _, name := range sortedKeys(workers) {
+				sidecars[name] = workers[name]
+				deployment.workers = append(deployment.workers, name)
+			}
+		}
+		if err == nil && hsOpts != nil && hsOpts.reverseProxy {
+			var baseURL, fedBaseURL string
+			sidecars[proxySidecar], baseURL, fedBaseURL, err = deployProxy(
+				d.Docker, containerName, d.config.PackageNamespace, blueprintName, hsName, contextStr, networkID, d.config,
+			)
+			deployment.BaseURL = baseURL
+			deployment.FedBaseURL = fedBaseURL
+		}
+		if deployment == nil && len(sidecars) > 0 {
+			deployment = &HomeserverDeployment{}
+		}
+		if deployment == nil && interceptor != nil {
+			interceptor.close()
+		}
+		if deployment != nil {
+			deployment.Sidecars = sidecars
+			deployment.interceptor = interceptor
+		}
 		if err != nil {
-			if deployment != nil && deployment.ContainerID != "" {
+			if deployment != nil {
 				// print logs to help debug
-				printLogs(d.Docker, deployment.ContainerID, contextStr)
+				for name, containerID := range deployment.containers(hsName) {
+					printLogs(d.Docker, containerID, name)
+				}
+			}
+			// make sure the containers are cleaned up if they were created
+			if deployment != nil && len(deployment.Sidecars) > 0 {
+				mu.Lock()
+				dep.HS[hsName] = *deployment
+				mu.Unlock()
 			}
 			return fmt.Errorf("Deploy: Failed to deploy image %+v : %w", img, err)
 		}
@@ -142,96 +395,171 @@ func (d *Deployer) Deploy(ctx context.Context, blueprintName string) (*Deploymen
 		}(img)
 	}
 	wg.Wait()
+
+	for _, hs := range options.composeHomeservers {
+		d.Counter++
+		project := composeProjectName(d.config.RunID, d.config.PackageNamespace, d.DeployNamespace, options.composeBlueprint, hs.Name, d.Counter)
+		deployment, err := deployCompose(ctx, d.Docker, project, options.composeBlueprint, hs, networkID, d.config)
+		if deployment != nil {
+			// make sure the containers are cleaned up if they were created
+			dep.HS[hs.Name] = *deployment
+		}
+		if err != nil {
+			if deployment != nil {
+				for name, containerID := range deployment.containers(hs.Name) {
+					printLogs(d.Docker, containerID, name)
+				}
+			}
+			lastErr = fmt.Errorf("Deploy: Failed to deploy %s from compose file %s : %w", hs.Name, hs.Compose.File, err)
+			continue
+		}
+		d.log("%s (compose) -> %s (%s)\n", hs.Name, deployment.BaseURL, deployment.ContainerID)
+	}
+	if lastErr != nil {
+		// failed deployments aren't destroyed, so don't keep other tests waiting for them
+		containerLimiter(d.config).release(dep.limitHolder, dep.limited)
+		dep.limited = 0
+	}
 	return dep, lastErr
 }
 
 // Destroy a deployment. This will kill all running containers.
 func (d *Deployer) Destroy(dep *Deployment, printServerLogs bool) {
-	for _, hsDep := range dep.HS {
-		if printServerLogs {
-			printLogs(d.Docker, hsDep.ContainerID, hsDep.ContainerID)
+	if dep.kube != nil {
+		dep.kube.destroy(printServerLogs)
+		containerLimiter(d.config).release(dep.limitHolder, dep.limited)
+		dep.limited = 0
+		return
+	}
+	for hsName, hsDep := range dep.HS {
+		containerIDs := hsDep.containers(hsName)
+		for _, name := range sortedKeys(containerIDs) {
+			containerID := containerIDs[name]
+			if printServerLogs {
+				printLogs(d.Docker, containerID, containerID)
+			}
+			err := d.Docker.ContainerKill(context.Background(), containerID, "KILL")
+			if err != nil {
+				log.Printf("Destroy: Failed to destroy container %s : %s\n", containerID, err)
+			}
+			err = d.Docker.ContainerRemove(context.Background(), containerID, types.ContainerRemoveOptions{
+				Force: true,
+				// e.g the data volume declared by the postgres image
+				RemoveVolumes: true,
+			})
+			if err != nil {
+				log.Printf("Destroy: Failed to remove container %s : %s\n", containerID, err)
+			}
 		}
-		err := d.Docker.ContainerKill(context.Background(), hsDep.ContainerID, "KILL")
-		if err != nil {
-			log.Printf("Destroy: Failed to destroy container %s : %s\n", hsDep.ContainerID, err)
+		removeTempMounts(hsDep.tempMounts)
+		if hsDep.interceptor != nil {
+			hsDep.interceptor.close()
 		}
-		err = d.Docker.ContainerRemove(context.Background(), hsDep.ContainerID, types.ContainerRemoveOptions{
-			Force: true,
-		})
-		if err != nil {
-			log.Printf("Destroy: Failed to remove container %s : %s\n", hsDep.ContainerID, err)
+		if hsDep.composeProject != "" {
+			if err := composeDown(d.config, hsDep.composeProject); err != nil {
+				log.Printf("Destroy: Failed to remove compose project %s : %s\n", hsDep.composeProject, err)
+			}
 		}
 	}
+	containerLimiter(d.config).release(dep.limitHolder, dep.limited)
+	dep.limited = 0
 }
 
 // nolint
 func deployImage(
 	docker *client.Client, imageID string, containerName, pkgNamespace, blueprintName, hsName string,
-	asIDToRegistrationMap map[string]string, contextStr, networkID string, cfg *config.Complement,
+	asIDToRegistrationMap map[string]string, contextStr, networkID string, hsOpts *hsDeployOptions, cfg *config.Complement,
 ) (*HomeserverDeployment, error) {
 	ctx := context.Background()
-	var extraHosts []string
-	var mounts []mount.Mount
-	var err error
-
-	if runtime.GOOS == "linux" {
-		// By default docker for linux does not expose this, so do it now.
-		// When https://github.com/moby/moby/pull/40007 lands in Docker 20, we should
-		// change this to be  `host.docker.internal:host-gateway`
-		extraHosts = []string{HostnameRunningComplement + ":172.17.0.1"}
+	tempMounts := make(map[string]string)
+	if hsOpts != nil {
+		for _, containerPath := range hsOpts.tempMounts {
+			hostPath, err := newTempMountDir()
+			if err != nil {
+				removeTempMounts(tempMounts)
+				return nil, err
+			}
+			tempMounts[containerPath] = hostPath
+		}
+	}
+	hostConfig, err := homeserverHostConfig(cfg, hsOpts, tempMounts)
+	if err != nil {
+		removeTempMounts(tempMounts)
+		return nil, err
+	}
+	if len(hostConfig.Mounts) > 0 {
+		log.Printf("Using host mounts: %+v", hostConfig.Mounts)
 	}
 
-	for _, m := range cfg.HostMounts {
-		mounts = append(mounts, mount.Mount{
-			Source:   m.HostPath,
-			Target:   m.ContainerPath,
-			ReadOnly: m.ReadOnly,
-			Type:     mount.TypeBind,
-		})
+	ports, err := namedPorts(ctx, docker, imageID, hsOpts)
+	if err != nil {
+		removeTempMounts(tempMounts)
+		return nil, err
 	}
-	if len(mounts) > 0 {
-		log.Printf("Using host mounts: %+v", mounts)
+	exposedPorts := make(nat.PortSet)
+	portBindings := nat.PortMap{
+		nat.Port("8008/tcp"): []nat.PortBinding{
+			{
+				HostIP: "127.0.0.1",
+			},
+		},
+		nat.Port("8448/tcp"): []nat.PortBinding{
+			{
+				HostIP: "127.0.0.1",
+			},
+		},
+	}
+	for _, port := range ports {
+		// the image may not expose the port, so always expose it
+		p := nat.Port(fmt.Sprintf("%d/tcp", port))
+		exposedPorts[p] = struct{}{}
+		portBindings[p] = []nat.PortBinding{
+			{
+				HostIP: "127.0.0.1",
+			},
+		}
+	}
+
+	hostConfig.PublishAllPorts = true
+	hostConfig.PortBindings = portBindings
+
+	alias := hsName
+	if hsOpts != nil && hsOpts.reverseProxy {
+		// the proxy takes over the homeserver's host name
+		alias = proxyBackend + "." + hsName
 	}
 
 	env := []string{
 		"SERVER_NAME=" + hsName,
 	}
+	if hsOpts != nil {
+		for k, v := range hsOpts.env {
+			env = append(env, k+"="+v)
+		}
+	}
 
 	body, err := docker.ContainerCreate(ctx, &container.Config{
-		Image: imageID,
-		Env:   env,
+		Image:        imageID,
+		Env:          env,
+		ExposedPorts: exposedPorts,
 		//Cmd:   d.ImageArgs,
 		Labels: map[string]string{
 			complementLabel:        contextStr,
 			"complement_blueprint": blueprintName,
 			"complement_pkg":       pkgNamespace,
 			"complement_hs_name":   hsName,
+			runLabel:               cfg.RunID,
 		},
-	}, &container.HostConfig{
-		PublishAllPorts: true,
-		PortBindings: nat.PortMap{
-			nat.Port("8008/tcp"): []nat.PortBinding{
-				{
-					HostIP: "127.0.0.1",
-				},
-			},
-			nat.Port("8448/tcp"): []nat.PortBinding{
-				{
-					HostIP: "127.0.0.1",
-				},
-			},
-		},
-		ExtraHosts: extraHosts,
-		Mounts:     mounts,
-	}, &network.NetworkingConfig{
+	}, hostConfig, &network.NetworkingConfig{
 		EndpointsConfig: map[string]*network.EndpointSettings{
 			contextStr: {
 				NetworkID: networkID,
-				Aliases:   []string{hsName},
+				Aliases:   []string{alias},
 			},
 		},
-	}, nil, containerName)
+	}, containerPlatform(cfg), containerName)
 	if err != nil {
+		removeTempMounts(tempMounts)
 		return nil, err
 	}
 	for _, w := range body.Warnings {
@@ -244,74 +572,301 @@ func deployImage(
 	}
 	stubDeployment := &HomeserverDeployment{
 		ContainerID: containerID,
+		tempMounts:  tempMounts,
+	}
+
+	if err = copyHomeserverFiles(docker, containerID, asIDToRegistrationMap, hsOpts); err != nil {
+		return stubDeployment, err
+	}
+
+	if err = copyCAToContainer(docker, containerID, cfg); err != nil {
+		return stubDeployment, err
+	}
+
+	err = docker.ContainerStart(ctx, containerID, types.ContainerStartOptions{})
+	if err != nil {
+		return stubDeployment, err
+	}
+	if cfg.DebugLoggingEnabled {
+		log.Printf("%s: Started container %s", contextStr, containerID)
 	}
 
-	// Create the application service files
+	inspect, baseURL, fedBaseURL, err := waitForPorts(ctx, docker, containerID)
+	if err != nil {
+		return stubDeployment, fmt.Errorf("%s : image %s : %w", contextStr, imageID, err)
+	}
+	for vol := range inspect.Config.Volumes {
+		log.Printf(
+			"WARNING: %s has a named VOLUME %s - volumes can lead to unpredictable behaviour due to "+
+				"test pollution. Remove the VOLUME in the Dockerfile to suppress this message.", containerName, vol,
+		)
+	}
+
+	iterCount, lastErr := waitForServer(ctx, docker, inspect, baseURL, cfg.SpawnHSTimeout)
+
+	d := &HomeserverDeployment{
+		BaseURL:             baseURL,
+		FedBaseURL:          fedBaseURL,
+		ContainerID:         containerID,
+		AccessTokens:        tokensFromLabels(inspect.Config.Labels),
+		ApplicationServices: asIDToRegistrationFromLabels(inspect.Config.Labels),
+		DeviceIDs:           deviceIDsFromLabels(inspect.Config.Labels),
+		GuestUserIDs:        guestUserIDsFromLabels(inspect.Config.Labels),
+		DeviceAccessTokens:  deviceAccessTokensFromLabels(inspect.Config.Labels),
+		ports:               ports,
+		tempMounts:          tempMounts,
+		clockControl:        hsOpts != nil && hsOpts.clockControl,
+	}
+	if lastErr != nil {
+		return d, fmt.Errorf("%s: failed to check server is up. %w", contextStr, lastErr)
+	} else {
+		if cfg.DebugLoggingEnabled {
+			log.Printf("%s: Server is responding after %d iterations", contextStr, iterCount)
+		}
+	}
+	if hsOpts != nil && hsOpts.networkConditions != nil {
+		// only degrade the network now the server is up, so startup isn't slowed down
+		if err = applyNetworkConditions(docker, containerID, *hsOpts.networkConditions); err != nil {
+			return d, fmt.Errorf("%s: %w", contextStr, err)
+		}
+	}
+	return d, nil
+}
+
+// copyCAToContainer copies the CA certificate and key into the container.
+// homeserverHostConfig returns the host config of every container running the homeserver, i.e its main
+// process and workers, so they can reach the same hosts, see the same mounts and run the same tools.
+// `tempMounts` is container path -> host path of the directories made for WithTempMount.
+func homeserverHostConfig(cfg *config.Complement, hsOpts *hsDeployOptions, tempMounts map[string]string) (*container.HostConfig, error) {
+	rt, err := NewRuntime(cfg)
+	if err != nil {
+		return nil, err
+	}
+	hostConfig := &container.HostConfig{
+		ExtraHosts: rt.ExtraHosts(),
+	}
+	for _, m := range cfg.HostMounts {
+		hostConfig.Mounts = append(hostConfig.Mounts, mount.Mount{
+			Source:   m.HostPath,
+			Target:   m.ContainerPath,
+			ReadOnly: m.ReadOnly,
+			Type:     mount.TypeBind,
+		})
+	}
+	if hsOpts != nil {
+		for _, containerPath := range hsOpts.tempMounts {
+			hostConfig.Mounts = append(hostConfig.Mounts, mount.Mount{
+				Source: tempMounts[containerPath],
+				Target: containerPath,
+				Type:   mount.TypeBind,
+			})
+		}
+	}
+	if hsOpts != nil && hsOpts.networkConditions != nil {
+		// needed to run `tc`
+		hostConfig.CapAdd = append(hostConfig.CapAdd, "NET_ADMIN")
+	}
+	if cfg.ProfileCommand != "" {
+		// needed by profilers which attach to the homeserver process, e.g py-spy
+		hostConfig.CapAdd = append(hostConfig.CapAdd, "SYS_PTRACE")
+	}
+	return hostConfig, nil
+}
+
+// copyHomeserverFiles copies the application service registrations and the extra files of `hsOpts` into a
+// container running the homeserver or one of its workers, before it starts.
+func copyHomeserverFiles(docker *client.Client, containerID string, asIDToRegistrationMap map[string]string, hsOpts *hsDeployOptions) error {
 	for asID, registration := range asIDToRegistrationMap {
-		err = copyToContainer(docker, containerID, fmt.Sprintf("%s%s.yaml", MountAppServicePath, url.PathEscape(asID)), []byte(registration))
+		registration = resolveASRegistration(registration, "")
+		err := copyToContainer(docker, containerID, fmt.Sprintf("%s%s.yaml", MountAppServicePath, url.PathEscape(asID)), []byte(registration))
 		if err != nil {
-			return stubDeployment, err
+			return err
+		}
+	}
+	if hsOpts != nil {
+		for path, contents := range hsOpts.files {
+			if err := copyToContainer(docker, containerID, path, contents); err != nil {
+				return fmt.Errorf("failed to copy %s to container: %s", path, err)
+			}
 		}
 	}
+	return nil
+}
 
-	// Copy CA certificate and key
+func copyCAToContainer(docker *client.Client, containerID string, cfg *config.Complement) error {
 	certBytes, err := cfg.CACertificateBytes()
 	if err != nil {
-		return stubDeployment, fmt.Errorf("failed to get CA certificate: %s", err)
+		return fmt.Errorf("failed to get CA certificate: %s", err)
 	}
 	err = copyToContainer(docker, containerID, MountCACertPath, certBytes)
 	if err != nil {
-		return stubDeployment, fmt.Errorf("failed to copy CA certificate to container: %s", err)
+		return fmt.Errorf("failed to copy CA certificate to container: %s", err)
 	}
 	certKeyBytes, err := cfg.CAPrivateKeyBytes()
 	if err != nil {
-		return stubDeployment, fmt.Errorf("failed to get CA key: %s", err)
+		return fmt.Errorf("failed to get CA key: %s", err)
 	}
 	err = copyToContainer(docker, containerID, MountCAKeyPath, certKeyBytes)
 	if err != nil {
-		return stubDeployment, fmt.Errorf("failed to copy CA key to container: %s", err)
+		return fmt.Errorf("failed to copy CA key to container: %s", err)
 	}
+	return nil
+}
 
-	err = docker.ContainerStart(ctx, containerID, types.ContainerStartOptions{})
+// StopServer stops the containers running `hsDep`, keeping their filesystems so they can be started again.
+// The homeserver is stopped first, so it can shut down cleanly while its database is still up.
+func (d *Deployer) StopServer(hsDep *HomeserverDeployment) error {
+	timeout := 10 * time.Second
+	if err := d.Docker.ContainerStop(context.Background(), hsDep.ContainerID, &timeout); err != nil {
+		return err
+	}
+	for name, containerID := range hsDep.Sidecars {
+		if err := d.Docker.ContainerStop(context.Background(), containerID, &timeout); err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+	}
+	return nil
+}
+
+// StartServer starts the container running `hsDep` after it was stopped, waits for the homeserver to
+// respond, and updates `hsDep` with the ports it is now published on.
+func (d *Deployer) StartServer(hsDep *HomeserverDeployment) error {
+	ctx := context.Background()
+	// the homeserver can't start without its database
+	if containerID, ok := hsDep.Sidecars[postgresSidecar]; ok {
+		if err := d.Docker.ContainerStart(ctx, containerID, types.ContainerStartOptions{}); err != nil {
+			return fmt.Errorf("%s: %w", postgresSidecar, err)
+		}
+		if err := waitForHealthy(ctx, d.Docker, containerID, d.config.SpawnHSTimeout); err != nil {
+			return fmt.Errorf("%s: %w", postgresSidecar, err)
+		}
+	}
+	err := d.Docker.ContainerStart(ctx, hsDep.ContainerID, types.ContainerStartOptions{})
 	if err != nil {
-		return stubDeployment, err
+		return err
 	}
-	if cfg.DebugLoggingEnabled {
-		log.Printf("%s: Started container %s", contextStr, containerID)
+	inspect, baseURL, fedBaseURL, err := waitForPorts(ctx, d.Docker, hsDep.ContainerID)
+	if err != nil {
+		return err
+	}
+	hsDep.BaseURL = baseURL
+	hsDep.FedBaseURL = fedBaseURL
+	if _, err = waitForServer(ctx, d.Docker, inspect, baseURL, d.config.SpawnHSTimeout); err != nil {
+		return err
+	}
+	for name, containerID := range hsDep.Sidecars {
+		if name == postgresSidecar {
+			continue
+		}
+		if err = d.Docker.ContainerStart(ctx, containerID, types.ContainerStartOptions{}); err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+		if err = waitForHealthy(ctx, d.Docker, containerID, d.config.SpawnHSTimeout); err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+	}
+	if containerID, ok := hsDep.Sidecars[proxySidecar]; ok {
+		// clients reach the homeserver through its proxy
+		if _, hsDep.BaseURL, hsDep.FedBaseURL, err = waitForPorts(ctx, d.Docker, containerID); err != nil {
+			return fmt.Errorf("%s: %w", proxySidecar, err)
+		}
+	}
+	return nil
+}
+
+// DisconnectServer disconnects the containers running `hsDep` from the network `networkID`.
+func (d *Deployer) DisconnectServer(networkID string, hsDep *HomeserverDeployment) error {
+	for name, containerID := range hsDep.Sidecars {
+		if err := d.Docker.NetworkDisconnect(context.Background(), networkID, containerID, true); err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+	}
+	return d.Docker.NetworkDisconnect(context.Background(), networkID, hsDep.ContainerID, true)
+}
+
+// ReconnectServer connects the containers running `hsDep` back to the network `networkID` under their host
+// names, and updates `hsDep` with the ports it is now published on.
+func (d *Deployer) ReconnectServer(networkID, hsName string, hsDep *HomeserverDeployment) error {
+	ctx := context.Background()
+	for name, containerID := range hsDep.Sidecars {
+		err := d.Docker.NetworkConnect(ctx, networkID, containerID, &network.EndpointSettings{
+			Aliases: []string{hsDep.alias(hsName, name)},
+		})
+		if err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+	}
+	err := d.Docker.NetworkConnect(ctx, networkID, hsDep.ContainerID, &network.EndpointSettings{
+		Aliases: []string{hsDep.alias(hsName, "")},
+	})
+	if err != nil {
+		return err
+	}
+	// clients reach the homeserver through its proxy, if it has one
+	publishedBy := hsDep.ContainerID
+	if containerID, ok := hsDep.Sidecars[proxySidecar]; ok {
+		publishedBy = containerID
+	}
+	_, baseURL, fedBaseURL, err := waitForPorts(ctx, d.Docker, publishedBy)
+	if err != nil {
+		return err
+	}
+	hsDep.BaseURL = baseURL
+	hsDep.FedBaseURL = fedBaseURL
+	return nil
+}
+
+// AddServer runs a homeserver named `hsName` from the image `imageRef` on the network `networkID`, pulling
+// the image if needed. The homeserver has no users or rooms. Returns the deployment of the homeserver, which
+// may be partially filled in if it failed to start.
+func (d *Deployer) AddServer(networkID, blueprintName, hsName, imageRef string) (*HomeserverDeployment, error) {
+	if err := pullImageIfNotExists(d.Docker, imageRef, d.config.Platform); err != nil {
+		return nil, err
 	}
+	d.Counter++
+	contextStr := fmt.Sprintf("%s.%s.%s", d.config.PackageNamespace, blueprintName, hsName)
+	containerName := fmt.Sprintf("complement_%s_%s_%s_%d", d.config.PackageNamespace, d.DeployNamespace, contextStr, d.Counter)
+	return deployImage(
+		d.Docker, imageRef, containerName, d.config.PackageNamespace, blueprintName, hsName, map[string]string{},
+		contextStr, networkID, nil, d.config,
+	)
+}
 
-	// We need to hammer the inspect endpoint until the ports show up, they don't appear immediately.
-	var inspect types.ContainerJSON
-	var baseURL, fedBaseURL string
+// waitForPorts inspects the container until its published ports show up, as they don't appear immediately.
+func waitForPorts(ctx context.Context, docker *client.Client, containerID string) (inspect types.ContainerJSON, baseURL, fedBaseURL string, err error) {
 	inspectStartTime := time.Now()
 	for time.Since(inspectStartTime) < time.Second {
 		inspect, err = docker.ContainerInspect(ctx, containerID)
 		if err != nil {
-			return stubDeployment, err
+			return
 		}
 		if inspect.State != nil && !inspect.State.Running {
 			// the container exited, bail out with a container ID for logs
-			return stubDeployment, fmt.Errorf("container is not running, state=%v", inspect.State.Status)
+			err = fmt.Errorf(
+				"container is not running, state=%v\n%s", inspect.State.Status, startupDiagnostics(ctx, docker, containerID, nil),
+			)
+			return
 		}
 		baseURL, fedBaseURL, err = endpoints(inspect.NetworkSettings.Ports, 8008, 8448)
 		if err == nil {
 			break
 		}
 	}
-	if err != nil {
-		return stubDeployment, fmt.Errorf("%s : image %s : %w", contextStr, imageID, err)
-	}
-	for vol := range inspect.Config.Volumes {
-		log.Printf(
-			"WARNING: %s has a named VOLUME %s - volumes can lead to unpredictable behaviour due to "+
-				"test pollution. Remove the VOLUME in the Dockerfile to suppress this message.", containerName, vol,
-		)
-	}
+	return
+}
 
+// waitForServer waits for the container to report itself healthy, if it has a healthcheck, then for the
+// homeserver to pass its readiness probe, by default responding to /versions. Returns the number of checks
+// made. The error explains why the container may have failed to start, for debugging.
+func waitForServer(ctx context.Context, docker *client.Client, inspect types.ContainerJSON, baseURL string, timeout time.Duration) (int, error) {
+	defer timing.Track(timing.PhaseHealthCheck)()
+	containerID := inspect.ID
+	var err error
 	var lastErr error
+	transcript := newProbeTranscript()
 
 	// Inspect health status of container to check it is up
-	stopTime := time.Now().Add(cfg.SpawnHSTimeout)
+	stopTime := time.Now().Add(timeout)
 	iterCount := 0
 	if inspect.State.Health != nil {
 		// If the container has a healthcheck, wait for it first
@@ -324,61 +879,44 @@ func deployImage(
 			inspect, err = docker.ContainerInspect(ctx, containerID)
 			if err != nil {
 				lastErr = fmt.Errorf("inspect container %s => error: %s", containerID, err)
+				transcript.add(lastErr.Error())
 				time.Sleep(50 * time.Millisecond)
 				continue
 			}
 			if inspect.State.Health.Status != "healthy" {
 				lastErr = fmt.Errorf("inspect container %s => health: %s", containerID, inspect.State.Health.Status)
+				transcript.add(lastErr.Error())
 				time.Sleep(50 * time.Millisecond)
 				continue
 			}
 			lastErr = nil
+			transcript.add("container is healthy")
 			break
 
 		}
 	}
 
 	// Having optionally waited for container to self-report healthy
-	// hit /versions to check it is actually responding
-	versionsURL := fmt.Sprintf("%s/_matrix/client/versions", baseURL)
-
+	// check it is actually responding
+	probe := readinessProbeFromLabels(inspect.Config.Labels)
 	for {
 		iterCount += 1
 		if time.Now().After(stopTime) {
 			lastErr = fmt.Errorf("timed out checking for homeserver to be up: %s", lastErr)
 			break
 		}
-		res, err := http.Get(versionsURL)
-		if err != nil {
-			lastErr = fmt.Errorf("GET %s => error: %s", versionsURL, err)
+		if lastErr = probe.check(baseURL); lastErr != nil {
+			transcript.add(lastErr.Error())
 			time.Sleep(50 * time.Millisecond)
 			continue
 		}
-		if res.StatusCode != 200 {
-			lastErr = fmt.Errorf("GET %s => HTTP %s", versionsURL, res.Status)
-			time.Sleep(50 * time.Millisecond)
-			continue
-		}
-		lastErr = nil
+		transcript.add("homeserver is ready")
 		break
 	}
-
-	d := &HomeserverDeployment{
-		BaseURL:             baseURL,
-		FedBaseURL:          fedBaseURL,
-		ContainerID:         containerID,
-		AccessTokens:        tokensFromLabels(inspect.Config.Labels),
-		ApplicationServices: asIDToRegistrationFromLabels(inspect.Config.Labels),
-		DeviceIDs:           deviceIDsFromLabels(inspect.Config.Labels),
-	}
 	if lastErr != nil {
-		return d, fmt.Errorf("%s: failed to check server is up. %w", contextStr, lastErr)
-	} else {
-		if cfg.DebugLoggingEnabled {
-			log.Printf("%s: Server is responding after %d iterations", contextStr, iterCount)
-		}
+		lastErr = fmt.Errorf("%w\n%s", lastErr, startupDiagnostics(ctx, docker, containerID, transcript))
 	}
-	return d, nil
+	return iterCount, lastErr
 }
 
 func copyToContainer(docker *client.Client, containerID, path string, data []byte) error {
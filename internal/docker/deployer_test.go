@@ -0,0 +1,153 @@
+package docker
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/mount"
+
+	"github.com/matrix-org/complement/internal/config"
+)
+
+func TestHomeserverDeployOptions(t *testing.T) {
+	testCases := []struct {
+		name      string
+		opts      []DeployOption
+		wantEnv   map[string]map[string]string
+		wantFiles map[string]map[string][]byte
+	}{
+		{
+			name: "env",
+			opts: []DeployOption{
+				WithEnv("hs1", "A", "1"),
+				WithEnv("hs1", "B", "2"),
+				WithEnv("hs2", "A", "3"),
+				WithEnv("hs1", "A", "4"),
+			},
+			wantEnv: map[string]map[string]string{
+				"hs1": {"A": "4", "B": "2"},
+				"hs2": {"A": "3"},
+			},
+			wantFiles: map[string]map[string][]byte{
+				"hs1": {},
+				"hs2": {},
+			},
+		},
+		{
+			name: "config",
+			opts: []DeployOption{
+				WithConfig("hs1", "ratelimits.yaml", "rc_message: {}"),
+				WithConfig("hs1", "retention.yaml", "retention: {}"),
+			},
+			wantEnv: map[string]map[string]string{
+				"hs1": {},
+			},
+			wantFiles: map[string]map[string][]byte{
+				"hs1": {
+					MountConfigPath + "ratelimits.yaml": []byte("rc_message: {}"),
+					MountConfigPath + "retention.yaml":  []byte("retention: {}"),
+				},
+			},
+		},
+		{
+			name: "rate limits",
+			opts: []DeployOption{
+				WithRateLimits("hs1", RateLimits{PerSecond: 0.1, Burst: 3}),
+				WithoutRateLimits("hs2"),
+			},
+			wantEnv: map[string]map[string]string{
+				"hs1": {
+					"COMPLEMENT_RATE_LIMITING":         "1",
+					"COMPLEMENT_RATE_LIMIT_PER_SECOND": "0.1",
+					"COMPLEMENT_RATE_LIMIT_BURST":      "3",
+				},
+				"hs2": {"COMPLEMENT_RATE_LIMITING": "0"},
+			},
+			wantFiles: map[string]map[string][]byte{
+				"hs1": {},
+				"hs2": {},
+			},
+		},
+		{
+			name: "rate limits removed",
+			opts: []DeployOption{
+				WithRateLimits("hs1", RateLimits{PerSecond: 0.1, Burst: 3}),
+				WithoutRateLimits("hs1"),
+			},
+			wantEnv: map[string]map[string]string{
+				"hs1": {"COMPLEMENT_RATE_LIMITING": "0"},
+			},
+			wantFiles: map[string]map[string][]byte{
+				"hs1": {},
+			},
+		},
+	}
+	for _, tc := range testCases {
+		opts := newDeployOptions(tc.opts)
+		env := make(map[string]map[string]string)
+		files := make(map[string]map[string][]byte)
+		for hsName, hsOpts := range opts.homeservers {
+			env[hsName] = hsOpts.env
+			files[hsName] = hsOpts.files
+		}
+		if !reflect.DeepEqual(env, tc.wantEnv) {
+			t.Errorf("%s: got env %v want %v", tc.name, env, tc.wantEnv)
+		}
+		if !reflect.DeepEqual(files, tc.wantFiles) {
+			t.Errorf("%s: got files %v want %v", tc.name, files, tc.wantFiles)
+		}
+	}
+}
+
+func TestWithEnvCopiesOptions(t *testing.T) {
+	var none *hsDeployOptions
+	if got := none.withEnv(map[string]string{"A": "1"}).env; !reflect.DeepEqual(got, map[string]string{"A": "1"}) {
+		t.Errorf("got env %v from no options, want the added env", got)
+	}
+	opts := newDeployOptions([]DeployOption{WithEnv("hs1", "A", "1")}).homeservers["hs1"]
+	got := opts.withEnv(map[string]string{"A": "2", "B": "3"})
+	if !reflect.DeepEqual(got.env, map[string]string{"A": "2", "B": "3"}) {
+		t.Errorf("got env %v, want the added env to override the options", got.env)
+	}
+	if !reflect.DeepEqual(opts.env, map[string]string{"A": "1"}) {
+		t.Errorf("options have env %v after adding to a copy, want them left alone", opts.env)
+	}
+}
+
+func TestHomeserverHostConfig(t *testing.T) {
+	cfg := &config.Complement{
+		HostMounts:     []config.HostMount{{HostPath: "/src", ContainerPath: "/app", ReadOnly: true}},
+		ProfileCommand: "py-spy record",
+	}
+	opts := newDeployOptions([]DeployOption{
+		WithTempMount("hs1", "/data"),
+		WithNetworkConditions("hs1", NetworkConditions{Delay: time.Second}),
+	})
+	got, err := homeserverHostConfig(cfg, opts.homeservers["hs1"], map[string]string{"/data": "/tmp/mount1"})
+	if err != nil {
+		t.Fatalf("homeserverHostConfig: %s", err)
+	}
+	want := &container.HostConfig{
+		ExtraHosts: []string{HostnameRunningComplement + ":172.17.0.1"},
+		Mounts: []mount.Mount{
+			{Type: mount.TypeBind, Source: "/src", Target: "/app", ReadOnly: true},
+			{Type: mount.TypeBind, Source: "/tmp/mount1", Target: "/data"},
+		},
+		CapAdd: []string{"NET_ADMIN", "SYS_PTRACE"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v want %+v", got, want)
+	}
+
+	// homeservers without options only get the config-wide settings
+	got, err = homeserverHostConfig(&config.Complement{}, nil, nil)
+	if err != nil {
+		t.Fatalf("homeserverHostConfig: %s", err)
+	}
+	want = &container.HostConfig{ExtraHosts: []string{HostnameRunningComplement + ":172.17.0.1"}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("no options: got %+v want %+v", got, want)
+	}
+}
@@ -1,9 +1,17 @@
 package docker
 
 import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
+	"github.com/matrix-org/complement/internal/capture"
 	"github.com/matrix-org/complement/internal/client"
 	"github.com/matrix-org/complement/internal/config"
 )
@@ -18,25 +26,106 @@ type Deployment struct {
 	// A map of HS name to a HomeserverDeployment
 	HS     map[string]HomeserverDeployment
 	Config *config.Complement
+
+	// The pool this deployment is returned to when destroyed, or nil if it isn't pooled
+	pool *Pool
+	// HS name -> user ID -> room ID -> membership when the deployment was made, for cleaning up pooled deployments
+	poolBaseline map[string]map[string]map[string]string
+	// HS name -> user ID -> profile, account data and push rules when the deployment was made, see poolBaseline
+	poolUserStates map[string]map[string]*userState
+	// The number of tests which have reused this deployment from the pool, guarded by mu
+	uses int
+	// Test name -> the namespace of names made by the test and its subtests, for dirty runs, see namespace
+	namespaces map[string]string
+	// The number of namespaces made, to name them
+	namespaceCount int
+	// True if this deployment is shared by all tests, for dirty runs
+	dirty bool
+	// True if this deployment was made WithIsolation, so it is only used by one test
+	isolated bool
+	// The number of users registered with a generated localpart
+	registrations uint64
+	// The number of profiles taken by Profile, to name their files
+	profiles uint64
+	// Guards AccessTokens and clients, as dirty deployments are used by tests concurrently
+	mu sync.RWMutex
+	// The docker network the homeservers are connected to
+	networkID string
+	// HS name -> how far its clock has been advanced by AdvanceClock
+	clockOffsets map[string]time.Duration
+	// HS name -> clients made for it, so they can be pointed at the new port when it is restarted
+	clients map[string][]*client.CSAPI
+	// True if the homeserver was already running and has no container, see Attach
+	attached bool
+	// The pods of the homeservers if they were deployed to Kubernetes, see DeployKubernetes
+	kube *kubeDeployment
+	// The number of containers taken from the limiter of COMPLEMENT_MAX_CONTAINERS, freed when destroyed
+	limited int
+	// Who the containers were taken for, see WithContainerHolder
+	limitHolder string
 }
 
 // HomeserverDeployment represents a running homeserver in a container.
 type HomeserverDeployment struct {
-	BaseURL             string            // e.g http://localhost:38646
-	FedBaseURL          string            // e.g https://localhost:48373
-	ContainerID         string            // e.g 10de45efba
-	AccessTokens        map[string]string // e.g { "@alice:hs1": "myAcc3ssT0ken" }
-	ApplicationServices map[string]string // e.g { "my-as-id": "id: xxx\nas_token: xxx ..."} }
-	DeviceIDs           map[string]string // e.g { "@alice:hs1": "myDeviceID" }
+	BaseURL             string                       // e.g http://localhost:38646
+	FedBaseURL          string                       // e.g https://localhost:48373
+	ContainerID         string                       // e.g 10de45efba
+	Sidecars            map[string]string            // e.g { "worker1": "a4b2f8e3c1" }, other containers serving this homeserver
+	AccessTokens        map[string]string            // e.g { "@alice:hs1": "myAcc3ssT0ken" }
+	ApplicationServices map[string]string            // e.g { "my-as-id": "id: xxx\nas_token: xxx ..."} }
+	DeviceIDs           map[string]string            // e.g { "@alice:hs1": "myDeviceID" }
+	GuestUserIDs        map[string]string            // e.g { "@guest:hs1": "@12:hs1" }
+	DeviceAccessTokens  map[string]map[string]string // e.g { "@alice:hs1": { "PHONE": "myAcc3ssT0ken" } }
+
+	// The compose project the homeserver runs in, or empty if it wasn't deployed from a compose file
+	composeProject string
+	// Name -> container port of the ports which can be looked up with GetPort
+	ports map[string]int
+	// Container path -> host directory mounted there by WithTempMount
+	tempMounts map[string]string
+	// The controller of the homeserver's mitmproxy sidecar, if it was deployed WithInterception
+	interceptor *Interceptor
+	// The names of the sidecars which are workers of the homeserver, see WithWorkers
+	workers []string
+	// True if the homeserver was deployed WithClockControl
+	clockControl bool
 }
 
 // Destroy the entire deployment. Destroys all running containers. If `printServerLogs` is true,
 // will print container logs before killing the container.
 func (d *Deployment) Destroy(t *testing.T) {
 	t.Helper()
+	d.pauseOnFailure(t)
+	if d.pool != nil {
+		d.pool.release(t, d)
+		return
+	}
+	if d.attached {
+		return
+	}
+	if t.Failed() && d.kube == nil {
+		d.writeArtifacts(t)
+	}
 	d.Deployer.Destroy(d, d.Deployer.config.AlwaysPrintServerLogs || t.Failed())
 }
 
+// PrintLogs prints the logs of every homeserver in the deployment.
+func (d *Deployment) PrintLogs() {
+	if d.attached {
+		return
+	}
+	if d.kube != nil {
+		d.kube.printLogs()
+		return
+	}
+	for hsName, hsDep := range d.HS {
+		containerIDs := hsDep.containers(hsName)
+		for _, name := range sortedKeys(containerIDs) {
+			printLogs(d.Deployer.Docker, containerIDs[name], name)
+		}
+	}
+}
+
 // Client returns a CSAPI client targeting the given hsName, using the access token for the given userID.
 // Fails the test if the hsName is not found. Returns an unauthenticated client if userID is "", fails the test
 // if the userID is otherwise not found.
@@ -47,7 +136,9 @@ func (d *Deployment) Client(t *testing.T, hsName, userID string) *client.CSAPI {
 		t.Fatalf("Deployment.Client - HS name '%s' not found", hsName)
 		return nil
 	}
+	d.mu.RLock()
 	token := dep.AccessTokens[userID]
+	d.mu.RUnlock()
 	if token == "" && userID != "" {
 		t.Fatalf("Deployment.Client - HS name '%s' - user ID '%s' not found", hsName, userID)
 		return nil
@@ -56,31 +147,150 @@ func (d *Deployment) Client(t *testing.T, hsName, userID string) *client.CSAPI {
 	if deviceID == "" && userID != "" {
 		t.Logf("WARNING: Deployment.Client - HS name '%s' - user ID '%s' - deviceID not found", hsName, userID)
 	}
-	return &client.CSAPI{
-		UserID:           userID,
-		AccessToken:      token,
-		DeviceID:         deviceID,
+	// guests in blueprints are referred to by their blueprint user ID, but the server chose their real one
+	if guestUserID, ok := dep.GuestUserIDs[userID]; ok {
+		userID = guestUserID
+	}
+	client := d.newClient(t, hsName, dep)
+	client.UserID = userID
+	client.AccessToken = token
+	client.DeviceID = deviceID
+	return client
+}
+
+// DeviceClient returns a CSAPI client targeting the given hsName, logged in as `userID` on `deviceID`, one of
+// the user's further devices in the blueprint. Fails the test if the hsName or device is not found.
+func (d *Deployment) DeviceClient(t *testing.T, hsName, userID, deviceID string) *client.CSAPI {
+	t.Helper()
+	dep, ok := d.HS[hsName]
+	if !ok {
+		t.Fatalf("Deployment.DeviceClient - HS name '%s' not found", hsName)
+		return nil
+	}
+	token := dep.DeviceAccessTokens[userID][deviceID]
+	if token == "" {
+		t.Fatalf("Deployment.DeviceClient - HS name '%s' - user ID '%s' - device '%s' not found", hsName, userID, deviceID)
+		return nil
+	}
+	client := d.newClient(t, hsName, dep)
+	client.UserID = userID
+	client.AccessToken = token
+	client.DeviceID = deviceID
+	return client
+}
+
+// newClient returns an unauthenticated client for `dep`, which is kept pointing at it if it is restarted
+// until the test finishes.
+func (d *Deployment) newClient(t *testing.T, hsName string, dep HomeserverDeployment) *client.CSAPI {
+	cli := &client.CSAPI{
 		BaseURL:          dep.BaseURL,
-		Client:           client.NewLoggedClient(t, hsName, nil),
+		Client:           d.loggedClient(t, hsName),
 		SyncUntilTimeout: 5 * time.Second,
 		Debug:            d.Deployer.debugLogging,
 	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.clients == nil {
+		d.clients = make(map[string][]*client.CSAPI)
+	}
+	d.clients[hsName] = append(d.clients[hsName], cli)
+	// forget the client once the test is done with it, as pooled deployments outlive many tests
+	t.Cleanup(func() {
+		d.removeClient(hsName, cli)
+	})
+	return cli
+}
+
+func (d *Deployment) removeClient(hsName string, cli *client.CSAPI) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	clients := d.clients[hsName]
+	for i := range clients {
+		if clients[i] == cli {
+			d.clients[hsName] = append(clients[:i], clients[i+1:]...)
+			break
+		}
+	}
+	if len(d.clients[hsName]) == 0 {
+		delete(d.clients, hsName)
+	}
 }
 
 // RegisterUser within a homeserver and return an authenticatedClient, Fails the test if the hsName is not found.
 func (d *Deployment) RegisterUser(t *testing.T, hsName, localpart, password string, isAdmin bool) *client.CSAPI {
+	t.Helper()
+	if ns := d.namespace(t); ns != "" {
+		// the user may have been registered by another test using this deployment
+		localpart += "-" + ns
+	}
+	return d.registerUser(t, hsName, localpart, password, isAdmin)
+}
+
+// RoomAliasName returns the localpart of a room alias to use instead of `name`, e.g as the room_alias_name
+// when creating a room, which is `name` unless the deployment is reused by other tests, which may use it too.
+// It is the same for every call with `name` in a test and its subtests, so the alias can be made in one
+// and looked up in another.
+func (d *Deployment) RoomAliasName(t *testing.T, name string) string {
+	t.Helper()
+	if ns := d.namespace(t); ns != "" {
+		return name + "-" + ns
+	}
+	return name
+}
+
+// namespace returns the suffix for names which other tests using this deployment may also use, e.g user IDs,
+// or "" if none are. It is the same for every call in a test and its subtests.
+func (d *Deployment) namespace(t *testing.T) string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if !d.dirty {
+		if d.uses > 0 {
+			// tests reuse pooled deployments one at a time
+			return strconv.Itoa(d.uses)
+		}
+		return ""
+	}
+	for name := t.Name(); ; name = name[:strings.LastIndex(name, "/")] {
+		if ns, ok := d.namespaces[name]; ok {
+			return ns
+		}
+		if !strings.Contains(name, "/") {
+			break
+		}
+	}
+	// named by a counter rather than the test, so reruns with -count don't collide
+	d.namespaceCount++
+	ns := fmt.Sprintf("t%d", d.namespaceCount)
+	if d.namespaces == nil {
+		d.namespaces = make(map[string]string)
+	}
+	name := t.Name()
+	d.namespaces[name] = ns
+	t.Cleanup(func() {
+		d.mu.Lock()
+		defer d.mu.Unlock()
+		delete(d.namespaces, name)
+	})
+	return ns
+}
+
+// Register registers a user with a unique localpart within a homeserver and returns an authenticated client.
+// Fails the test if the hsName is not found. Use this instead of RegisterUser when the user ID doesn't
+// matter, as it is safe to use on deployments shared with other tests.
+func (d *Deployment) Register(t *testing.T, hsName string) *client.CSAPI {
+	t.Helper()
+	localpart := fmt.Sprintf("user-%d", atomic.AddUint64(&d.registrations, 1))
+	return d.registerUser(t, hsName, localpart, "complement_meets_min_password_requirement", false)
+}
+
+func (d *Deployment) registerUser(t *testing.T, hsName, localpart, password string, isAdmin bool) *client.CSAPI {
 	t.Helper()
 	dep, ok := d.HS[hsName]
 	if !ok {
 		t.Fatalf("Deployment.Client - HS name '%s' not found", hsName)
 		return nil
 	}
-	client := &client.CSAPI{
-		BaseURL:          dep.BaseURL,
-		Client:           client.NewLoggedClient(t, hsName, nil),
-		SyncUntilTimeout: 5 * time.Second,
-		Debug:            d.Deployer.debugLogging,
-	}
+	client := d.newClient(t, hsName, dep)
 	var userID, accessToken, deviceID string
 	if isAdmin {
 		userID, accessToken, deviceID = client.RegisterSharedSecret(t, localpart, password, isAdmin)
@@ -89,10 +299,168 @@ func (d *Deployment) RegisterUser(t *testing.T, hsName, localpart, password stri
 	}
 
 	// remember the token so subsequent calls to deployment.Client return the user
+	d.mu.Lock()
 	dep.AccessTokens[userID] = accessToken
+	d.mu.Unlock()
 
 	client.UserID = userID
 	client.AccessToken = accessToken
 	client.DeviceID = deviceID
 	return client
 }
+
+// RegisterGuest registers a guest user within a homeserver and returns an authenticated client. Fails the test
+// if the hsName is not found.
+func (d *Deployment) RegisterGuest(t *testing.T, hsName string) *client.CSAPI {
+	t.Helper()
+	dep, ok := d.HS[hsName]
+	if !ok {
+		t.Fatalf("Deployment.Client - HS name '%s' not found", hsName)
+		return nil
+	}
+	client := d.newClient(t, hsName, dep)
+	client.UserID, client.AccessToken, client.DeviceID = client.RegisterGuest(t)
+	return client
+}
+
+// loggedClient returns an http.Client which logs requests/responses, and records them if
+// COMPLEMENT_CAPTURE_DIR is set.
+func (d *Deployment) loggedClient(t *testing.T, hsName string) *http.Client {
+	t.Helper()
+	cli := client.NewLoggedClient(t, hsName, nil)
+	cli.Transport = capture.ForTest(t, d.Config.CaptureDir).RoundTripper(hsName, cli.Transport)
+	return cli
+}
+
+// Restart stops then starts every homeserver in the deployment, keeping their data. The deployment must be
+// made with WithIsolation, as other tests reusing it would lose their homeservers. Fails the test if any
+// homeserver fails to stop or start.
+func (d *Deployment) Restart(t *testing.T) {
+	t.Helper()
+	d.requireIsolation(t, "Restart")
+	for hsName := range d.HS {
+		d.StopHS(t, hsName)
+		d.StartHS(t, hsName)
+	}
+}
+
+// StopHS stops the container running the homeserver `hsName`, keeping its data so it can be started again
+// with StartHS. Fails the test if the hsName is not found or the container fails to stop.
+func (d *Deployment) StopHS(t *testing.T, hsName string) {
+	t.Helper()
+	d.skipIfAttached(t, "StopHS")
+	d.requireIsolation(t, "StopHS")
+	dep, ok := d.HS[hsName]
+	if !ok {
+		t.Fatalf("Deployment.StopHS - HS name '%s' not found", hsName)
+		return
+	}
+	if err := d.Deployer.StopServer(&dep); err != nil {
+		t.Fatalf("Deployment.StopHS - failed to stop %s: %s", hsName, err)
+	}
+}
+
+// StartHS starts the homeserver `hsName` after it was stopped with StopHS, and waits for it to respond.
+// The homeserver is published on new ports, so existing clients are updated to use them. Fails the test
+// if the hsName is not found or the homeserver fails to start.
+func (d *Deployment) StartHS(t *testing.T, hsName string) {
+	t.Helper()
+	d.skipIfAttached(t, "StartHS")
+	d.requireIsolation(t, "StartHS")
+	dep, ok := d.HS[hsName]
+	if !ok {
+		t.Fatalf("Deployment.StartHS - HS name '%s' not found", hsName)
+		return
+	}
+	if err := d.Deployer.StartServer(&dep); err != nil {
+		t.Fatalf("Deployment.StartHS - failed to start %s: %s", hsName, err)
+	}
+	d.updateHS(hsName, dep)
+}
+
+// Disconnect removes the homeserver `hsName` from the deployment's network, so it can't reach or be reached
+// by the other homeservers or Complement, until Reconnect is called. Use this to test federation retries and
+// catch-up after a netsplit. Fails the test if the hsName is not found or the network can't be changed.
+func (d *Deployment) Disconnect(t *testing.T, hsName string) {
+	t.Helper()
+	d.skipIfAttached(t, "Disconnect")
+	d.requireIsolation(t, "Disconnect")
+	dep, ok := d.HS[hsName]
+	if !ok {
+		t.Fatalf("Deployment.Disconnect - HS name '%s' not found", hsName)
+		return
+	}
+	if err := d.Deployer.DisconnectServer(d.networkID, &dep); err != nil {
+		t.Fatalf("Deployment.Disconnect - failed to disconnect %s: %s", hsName, err)
+	}
+}
+
+// Reconnect adds the homeserver `hsName` back to the deployment's network after Disconnect. The homeserver
+// may be published on new ports, so existing clients are updated to use them. Fails the test if the hsName
+// is not found or the network can't be changed.
+func (d *Deployment) Reconnect(t *testing.T, hsName string) {
+	t.Helper()
+	d.skipIfAttached(t, "Reconnect")
+	d.requireIsolation(t, "Reconnect")
+	dep, ok := d.HS[hsName]
+	if !ok {
+		t.Fatalf("Deployment.Reconnect - HS name '%s' not found", hsName)
+		return
+	}
+	if err := d.Deployer.ReconnectServer(d.networkID, hsName, &dep); err != nil {
+		t.Fatalf("Deployment.Reconnect - failed to reconnect %s: %s", hsName, err)
+	}
+	d.updateHS(hsName, dep)
+}
+
+// AddHomeserver deploys a homeserver named `hsName` from the image `image` into the deployment, e.g to test
+// a server joining an established federated room late. `image` may be the name of an image in
+// COMPLEMENT_EXTRA_IMAGES, and if it is empty, the base image is used. The
+// homeserver has no users, so use RegisterUser to make some. It is destroyed along with the deployment, which
+// must be made with WithIsolation so it isn't reused by other tests. Fails the test if the hsName is already
+// in use or the homeserver fails to start.
+func (d *Deployment) AddHomeserver(t *testing.T, hsName, image string) {
+	t.Helper()
+	d.skipIfAttached(t, "AddHomeserver")
+	d.requireIsolation(t, "AddHomeserver")
+	if _, ok := d.HS[hsName]; ok {
+		t.Fatalf("Deployment.AddHomeserver - HS name '%s' already exists", hsName)
+		return
+	}
+	if uri, err := d.Config.ImageURI(image); err == nil {
+		image = uri
+	}
+	taken, err := containerLimiter(d.Config).acquire(context.Background(), d.limitHolder, 1, "AddHomeserver "+hsName)
+	if err != nil {
+		t.Fatalf("Deployment.AddHomeserver - %s", err)
+	}
+	d.limited += taken
+	dep, err := d.Deployer.AddServer(d.networkID, d.BlueprintName, hsName, image)
+	if dep != nil {
+		// make sure the container is cleaned up even if it failed to start
+		d.HS[hsName] = *dep
+	}
+	if err != nil {
+		t.Fatalf("Deployment.AddHomeserver - failed to deploy %s from %s: %s", hsName, image, err)
+	}
+}
+
+// updateHS replaces the HomeserverDeployment for `hsName`, and points existing clients at its base URL.
+func (d *Deployment) updateHS(hsName string, dep HomeserverDeployment) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.HS[hsName] = dep
+	for _, cli := range d.clients[hsName] {
+		cli.BaseURL = dep.BaseURL
+	}
+}
+
+// requireIsolation fails the test unless the deployment was made WithIsolation, as `method` changes its
+// homeservers underneath other tests when deployments are pooled or shared. This is checked even when they
+// aren't, so tests keep working when they are.
+func (d *Deployment) requireIsolation(t *testing.T, method string) {
+	t.Helper()
+	if !d.isolated || d.pool != nil || d.dirty {
+		t.Fatalf("Deployment.%s - deployment may be reused by other tests, deploy it with docker.WithIsolation()", method)
+	}
+}
@@ -0,0 +1,69 @@
+package docker
+
+import (
+	"testing"
+
+	"github.com/matrix-org/complement/internal/client"
+	"github.com/matrix-org/complement/internal/config"
+)
+
+func TestUpdateHSOnlyUpdatesClientsOfRunningTests(t *testing.T) {
+	d := &Deployment{
+		HS: map[string]HomeserverDeployment{
+			"hs1": {BaseURL: "http://localhost:1000"},
+		},
+		Config:   &config.Complement{},
+		Deployer: &Deployer{},
+	}
+	var finished *client.CSAPI
+	t.Run("finished", func(t *testing.T) {
+		finished = d.newClient(t, "hs1", d.HS["hs1"])
+	})
+	running := d.newClient(t, "hs1", d.HS["hs1"])
+	if got := len(d.clients["hs1"]); got != 1 {
+		t.Fatalf("deployment has %d clients, want only the client of the running test", got)
+	}
+	d.updateHS("hs1", HomeserverDeployment{BaseURL: "http://localhost:2000"})
+	if running.BaseURL != "http://localhost:2000" {
+		t.Errorf("client of the running test has base URL %s, want the new one", running.BaseURL)
+	}
+	if finished.BaseURL != "http://localhost:1000" {
+		t.Errorf("client of the finished test has base URL %s, want it left alone", finished.BaseURL)
+	}
+	if got := d.HS["hs1"].BaseURL; got != "http://localhost:2000" {
+		t.Errorf("deployment has base URL %s, want the new one", got)
+	}
+}
+
+func TestNamespace(t *testing.T) {
+	pooled := &Deployment{uses: 2}
+	if got := pooled.RoomAliasName(t, "room"); got != "room-2" {
+		t.Errorf("pooled deployment gave alias %s, want room-2", got)
+	}
+	if got := (&Deployment{}).RoomAliasName(t, "room"); got != "room" {
+		t.Errorf("new deployment gave alias %s, want room", got)
+	}
+
+	d := &Deployment{dirty: true}
+	var first, second string
+	t.Run("first", func(t *testing.T) {
+		first = d.RoomAliasName(t, "room")
+		if again := d.RoomAliasName(t, "room"); again != first {
+			t.Errorf("second call gave alias %s, want %s like the first", again, first)
+		}
+		t.Run("subtest", func(t *testing.T) {
+			if got := d.RoomAliasName(t, "room"); got != first {
+				t.Errorf("subtest gave alias %s, want %s like its parent", got, first)
+			}
+		})
+	})
+	t.Run("second", func(t *testing.T) {
+		second = d.RoomAliasName(t, "room")
+	})
+	if first == second || first == "room" {
+		t.Errorf("tests sharing a deployment gave aliases %s and %s, want different ones", first, second)
+	}
+	if len(d.namespaces) != 0 {
+		t.Errorf("deployment kept namespaces %v of finished tests", d.namespaces)
+	}
+}
@@ -0,0 +1,68 @@
+package docker
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/client"
+	"github.com/docker/docker/pkg/stdcopy"
+)
+
+// ExecResult is the output of a command run in a homeserver container.
+type ExecResult struct {
+	Stdout   string
+	Stderr   string
+	ExitCode int
+}
+
+// Exec runs `cmd` in the container of the homeserver `hsName`, e.g to run admin scripts like
+// register_new_matrix_user, and returns its output and exit code. A non-zero exit code does not fail the
+// test, so check ExitCode. Fails the test if the hsName is not found or the command could not be run.
+func (d *Deployment) Exec(t *testing.T, hsName string, cmd ...string) ExecResult {
+	t.Helper()
+	d.skipIfAttached(t, "Exec")
+	dep, ok := d.HS[hsName]
+	if !ok {
+		t.Fatalf("Deployment.Exec - HS name '%s' not found", hsName)
+		return ExecResult{}
+	}
+	res, err := execInContainer(context.Background(), d.Deployer.Docker, dep.ContainerID, cmd)
+	if err != nil {
+		t.Fatalf("Deployment.Exec - failed to run '%s' in %s: %s", strings.Join(cmd, " "), hsName, err)
+	}
+	return res
+}
+
+// execInContainer runs `cmd` in the container and waits for it to exit. Returns an error if the command
+// could not be run.
+func execInContainer(ctx context.Context, docker *client.Client, containerID string, cmd []string) (ExecResult, error) {
+	exec, err := docker.ContainerExecCreate(ctx, containerID, types.ExecConfig{
+		Cmd:          cmd,
+		AttachStdout: true,
+		AttachStderr: true,
+	})
+	if err != nil {
+		return ExecResult{}, err
+	}
+	attached, err := docker.ContainerExecAttach(ctx, exec.ID, types.ExecStartCheck{})
+	if err != nil {
+		return ExecResult{}, err
+	}
+	defer attached.Close()
+	var stdout, stderr bytes.Buffer
+	if _, err = stdcopy.StdCopy(&stdout, &stderr, attached.Reader); err != nil {
+		return ExecResult{}, err
+	}
+	inspect, err := docker.ContainerExecInspect(ctx, exec.ID)
+	if err != nil {
+		return ExecResult{}, err
+	}
+	return ExecResult{
+		Stdout:   stdout.String(),
+		Stderr:   stderr.String(),
+		ExitCode: inspect.ExitCode,
+	}, nil
+}
@@ -0,0 +1,91 @@
+package docker
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/client"
+	"github.com/docker/docker/pkg/stdcopy"
+)
+
+// fakeExecDocker is a Docker API which runs execs by writing `stdout` and `stderr` and exiting with `exitCode`.
+type fakeExecDocker struct {
+	stdout, stderr string
+	exitCode       int
+	// the commands execs were created with
+	cmds [][]string
+}
+
+func (f *fakeExecDocker) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	switch {
+	case strings.HasSuffix(req.URL.Path, "/containers/container1/exec"):
+		var config types.ExecConfig
+		if err := json.NewDecoder(req.Body).Decode(&config); err != nil {
+			http.Error(w, err.Error(), 400)
+			return
+		}
+		f.cmds = append(f.cmds, config.Cmd)
+		json.NewEncoder(w).Encode(types.IDResponse{ID: "exec1"}) // nolint:errcheck
+	case strings.HasSuffix(req.URL.Path, "/exec/exec1/start"):
+		ioutil.ReadAll(req.Body) // nolint:errcheck
+		conn, buf, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		buf.WriteString("HTTP/1.1 101 UPGRADED\r\nContent-Type: application/vnd.docker.raw-stream\r\nConnection: Upgrade\r\nUpgrade: tcp\r\n\r\n")
+		stdcopy.NewStdWriter(buf, stdcopy.Stdout).Write([]byte(f.stdout)) // nolint:errcheck
+		stdcopy.NewStdWriter(buf, stdcopy.Stderr).Write([]byte(f.stderr)) // nolint:errcheck
+		buf.Flush()
+	case strings.HasSuffix(req.URL.Path, "/exec/exec1/json"):
+		json.NewEncoder(w).Encode(types.ContainerExecInspect{ExecID: "exec1", ExitCode: f.exitCode}) // nolint:errcheck
+	default:
+		http.NotFound(w, req)
+	}
+}
+
+func TestExec(t *testing.T) {
+	testCases := []struct {
+		name string
+		fake *fakeExecDocker
+		want ExecResult
+	}{
+		{
+			name: "success",
+			fake: &fakeExecDocker{stdout: "hello\n"},
+			want: ExecResult{Stdout: "hello\n"},
+		},
+		{
+			name: "failure",
+			fake: &fakeExecDocker{stdout: "partial", stderr: "no such user\n", exitCode: 1},
+			want: ExecResult{Stdout: "partial", Stderr: "no such user\n", ExitCode: 1},
+		},
+	}
+	for _, tc := range testCases {
+		srv := httptest.NewServer(tc.fake)
+		docker, err := client.NewClientWithOpts(client.WithHost("tcp://"+srv.Listener.Addr().String()), client.WithVersion("1.41"))
+		if err != nil {
+			t.Fatalf("failed to make docker client: %s", err)
+		}
+		d := &Deployment{
+			HS: map[string]HomeserverDeployment{
+				"hs1": {ContainerID: "container1"},
+			},
+			Deployer: &Deployer{Docker: docker},
+		}
+		got := d.Exec(t, "hs1", "register_new_matrix_user", "-u", "alice")
+		srv.Close()
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%s: got %+v want %+v", tc.name, got, tc.want)
+		}
+		if want := [][]string{{"register_new_matrix_user", "-u", "alice"}}; !reflect.DeepEqual(tc.fake.cmds, want) {
+			t.Errorf("%s: ran %v want %v", tc.name, tc.fake.cmds, want)
+		}
+	}
+}
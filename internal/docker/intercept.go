@@ -0,0 +1,361 @@
+package docker
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/network"
+	"github.com/docker/docker/client"
+
+	"github.com/matrix-org/complement/internal/config"
+)
+
+// The name of the mitmproxy sidecar of a homeserver, in HomeserverDeployment.Sidecars.
+const interceptSidecar = "mitm"
+
+// The port the mitmproxy sidecar listens on as an HTTP(S) proxy.
+const interceptPort = 8080
+
+// Where the mitmproxy addon and config directory are copied to.
+const (
+	interceptAddonPath  = "/complement/mitm/addon.py"
+	interceptConfDir    = "/complement/mitm"
+	interceptCAFilePath = interceptConfDir + "/mitmproxy-ca.pem"
+)
+
+// interceptAddon is a mitmproxy addon which asks the Interceptor in Complement what to do with each request.
+const interceptAddon = `import asyncio
+import base64
+import json
+import os
+import urllib.request
+
+from mitmproxy import http
+
+CONTROLLER = os.environ["COMPLEMENT_INTERCEPT_CONTROLLER"]
+
+
+def ask(req):
+    r = urllib.request.Request(
+        CONTROLLER, data=json.dumps(req).encode(), headers={"Content-Type": "application/json"}
+    )
+    with urllib.request.urlopen(r, timeout=60) as res:
+        return json.load(res)
+
+
+class Complement:
+    async def request(self, flow):
+        req = flow.request
+        decision = await asyncio.to_thread(ask, {
+            "method": req.method,
+            "url": req.pretty_url,
+            "headers": [[k, v] for k, v in req.headers.items(multi=True)],
+            "body": base64.b64encode(req.raw_content or b"").decode(),
+        })
+        if decision.get("delay_ms"):
+            await asyncio.sleep(decision["delay_ms"] / 1000)
+        if decision.get("drop"):
+            flow.kill()
+            return
+        if decision.get("body") is not None:
+            req.content = base64.b64decode(decision["body"])
+        res = decision.get("response")
+        if res is not None:
+            flow.response = http.Response.make(res["code"], base64.b64decode(res["body"] or ""), res["headers"] or {})
+
+
+addons = [Complement()]
+`
+
+// InterceptRule describes what to do with requests a homeserver makes through its mitmproxy sidecar.
+type InterceptRule struct {
+	// Matches the requests the rule applies to. The request body can be read. Nil matches every request.
+	Match func(req *http.Request) bool
+	// How long to hold the request before acting on it
+	Delay time.Duration
+	// If true, the connection is closed without a response, like a network failure
+	Drop bool
+	// If set, sent to the homeserver instead of forwarding the request
+	Respond *InterceptResponse
+	// If set, called with the body of the request and returns the body to forward instead
+	ModifyBody func(body []byte) []byte
+	// How many requests the rule applies to before it is removed. 0 applies it until the test finishes.
+	Times int
+}
+
+// InterceptResponse is a response sent by an InterceptRule instead of forwarding the request.
+type InterceptResponse struct {
+	Code    int               `json:"code"`
+	Headers map[string]string `json:"headers"`
+	Body    []byte            `json:"body"`
+}
+
+// interceptedRequest is a request made through mitmproxy, as sent by the addon.
+type interceptedRequest struct {
+	Method  string      `json:"method"`
+	URL     string      `json:"url"`
+	Headers [][2]string `json:"headers"`
+	Body    []byte      `json:"body"`
+}
+
+// interceptDecision tells the addon what to do with a request.
+type interceptDecision struct {
+	DelayMS  int64              `json:"delay_ms,omitempty"`
+	Drop     bool               `json:"drop,omitempty"`
+	Body     *[]byte            `json:"body,omitempty"`
+	Response *InterceptResponse `json:"response,omitempty"`
+}
+
+// Interceptor controls the traffic a homeserver sends through its mitmproxy sidecar, see WithInterception.
+// Requests which match no rule are forwarded unchanged.
+type Interceptor struct {
+	mu    sync.Mutex
+	rules []*InterceptRule
+	ln    net.Listener
+	srv   *http.Server
+}
+
+// WithInterception routes the outbound HTTP traffic of the homeserver `hsName`, e.g federation requests and
+// pushes, through a mitmproxy sidecar which Deployment.Interceptor controls, so tests can delay, modify or
+// fail requests to see how the homeserver copes. TLS is intercepted using the Complement CA, which homeservers
+// already trust.
+//
+// The homeserver is given HTTP_PROXY and HTTPS_PROXY, along with COMPLEMENT_INTERCEPT_PROXY set to the same
+// proxy URL, and NO_PROXY covering its own sidecars. The image is responsible for sending outbound requests
+// through the proxy, which many homeservers don't do for federation by default. The mitmproxy image can be
+// changed with COMPLEMENT_MITMPROXY_IMAGE.
+func WithInterception(hsName string) DeployOption {
+	return func(opts *deployOptions) {
+		opts.homeserver(hsName).intercept = true
+	}
+}
+
+// interceptEnv returns the environment variables which send the outbound traffic of the homeserver `hsName`
+// through its mitmproxy sidecar.
+func interceptEnv(hsName string) map[string]string {
+	proxyURL := fmt.Sprintf("http://%s.%s:%d", interceptSidecar, hsName, interceptPort)
+	noProxy := strings.Join([]string{"localhost", "127.0.0.1", "*." + hsName, "." + hsName}, ",")
+	return map[string]string{
+		"COMPLEMENT_INTERCEPT_PROXY": proxyURL,
+		"HTTP_PROXY":                 proxyURL,
+		"HTTPS_PROXY":                proxyURL,
+		"http_proxy":                 proxyURL,
+		"https_proxy":                proxyURL,
+		"NO_PROXY":                   noProxy,
+		"no_proxy":                   noProxy,
+	}
+}
+
+// Interceptor returns the controller of the mitmproxy sidecar of the homeserver `hsName`. Fails the test if
+// the hsName is not found or it wasn't deployed WithInterception.
+func (d *Deployment) Interceptor(t *testing.T, hsName string) *Interceptor {
+	t.Helper()
+	d.skipIfAttached(t, "Interceptor")
+	dep, ok := d.HS[hsName]
+	if !ok {
+		t.Fatalf("Deployment.Interceptor - HS name '%s' not found", hsName)
+		return nil
+	}
+	if dep.interceptor == nil {
+		t.Fatalf("Deployment.Interceptor - %s was not deployed with docker.WithInterception", hsName)
+		return nil
+	}
+	return dep.interceptor
+}
+
+// Add applies the rule to requests made by the homeserver until the test finishes, or the rule has been
+// applied rule.Times times. Rules are checked in the order they were added, and the first match applies.
+func (ic *Interceptor) Add(t *testing.T, rule InterceptRule) {
+	t.Helper()
+	r := &rule
+	ic.mu.Lock()
+	ic.rules = append(ic.rules, r)
+	ic.mu.Unlock()
+	t.Cleanup(func() {
+		ic.remove(r)
+	})
+}
+
+func (ic *Interceptor) remove(rule *InterceptRule) {
+	ic.mu.Lock()
+	defer ic.mu.Unlock()
+	ic.removeLocked(rule)
+}
+
+func (ic *Interceptor) removeLocked(rule *InterceptRule) {
+	for i, r := range ic.rules {
+		if r == rule {
+			ic.rules = append(ic.rules[:i], ic.rules[i+1:]...)
+			return
+		}
+	}
+}
+
+// decide returns what to do with the request, using the first rule which matches it.
+func (ic *Interceptor) decide(ireq *interceptedRequest) (interceptDecision, error) {
+	req, err := http.NewRequest(ireq.Method, ireq.URL, bytes.NewReader(ireq.Body))
+	if err != nil {
+		return interceptDecision{}, err
+	}
+	for _, h := range ireq.Headers {
+		req.Header.Add(h[0], h[1])
+	}
+	ic.mu.Lock()
+	var rule *InterceptRule
+	for _, r := range ic.rules {
+		// rewind the body for each rule which reads it
+		req.Body = ioutil.NopCloser(bytes.NewReader(ireq.Body))
+		if r.Match == nil || r.Match(req) {
+			rule = r
+			break
+		}
+	}
+	if rule != nil && rule.Times > 0 {
+		rule.Times--
+		if rule.Times == 0 {
+			ic.removeLocked(rule)
+		}
+	}
+	ic.mu.Unlock()
+	var decision interceptDecision
+	if rule == nil {
+		return decision, nil
+	}
+	decision.DelayMS = rule.Delay.Milliseconds()
+	decision.Drop = rule.Drop
+	decision.Response = rule.Respond
+	if rule.ModifyBody != nil {
+		body := rule.ModifyBody(ireq.Body)
+		decision.Body = &body
+	}
+	return decision, nil
+}
+
+func (ic *Interceptor) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	var ireq interceptedRequest
+	if err := json.NewDecoder(req.Body).Decode(&ireq); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	decision, err := ic.decide(&ireq)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(decision) // nolint:errcheck
+}
+
+// newInterceptor starts the controller which the mitmproxy addon asks what to do with each request.
+func newInterceptor() (*Interceptor, error) {
+	ln, err := net.Listen("tcp", ":0") //nolint
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen for the mitmproxy addon: %w", err)
+	}
+	ic := &Interceptor{
+		ln: ln,
+	}
+	ic.srv = &http.Server{
+		Handler: ic,
+	}
+	go ic.srv.Serve(ln) // nolint:errcheck
+	return ic, nil
+}
+
+// controllerURL returns the URL of the controller, from the perspective of the mitmproxy sidecar.
+func (ic *Interceptor) controllerURL() string {
+	return fmt.Sprintf("http://%s:%d/", HostnameRunningComplement, ic.ln.Addr().(*net.TCPAddr).Port)
+}
+
+func (ic *Interceptor) close() {
+	ic.srv.Close()
+}
+
+// deployInterceptor starts a mitmproxy sidecar for the homeserver `hsName`, controlled by `ic`. Returns the
+// container ID, even on error, so it can be cleaned up.
+func deployInterceptor(
+	docker *client.Client, containerName, pkgNamespace, blueprintName, hsName, contextStr, networkID string,
+	ic *Interceptor, cfg *config.Complement,
+) (string, error) {
+	ctx := context.Background()
+	if err := pullImageIfNotExists(docker, cfg.MitmproxyImage, cfg.Platform); err != nil {
+		return "", err
+	}
+	rt, err := NewRuntime(cfg)
+	if err != nil {
+		return "", err
+	}
+	body, err := docker.ContainerCreate(ctx, &container.Config{
+		Image: cfg.MitmproxyImage,
+		// root, as mitmproxy writes to its config directory, which is copied in as root
+		User: "root",
+		Cmd: []string{
+			"mitmdump", "--mode", "regular", "--listen-port", fmt.Sprintf("%d", interceptPort),
+			"--set", "confdir=" + interceptConfDir,
+			// upstream homeservers have certificates signed by the Complement CA, which mitmproxy doesn't trust
+			"--set", "ssl_insecure=true",
+			"-s", interceptAddonPath,
+		},
+		Env: []string{
+			"COMPLEMENT_INTERCEPT_CONTROLLER=" + ic.controllerURL(),
+		},
+		Labels: map[string]string{
+			complementLabel:        contextStr,
+			"complement_blueprint": blueprintName,
+			"complement_pkg":       pkgNamespace,
+			"complement_hs_name":   hsName,
+			"complement_sidecar":   interceptSidecar,
+			runLabel:               cfg.RunID,
+		},
+	}, &container.HostConfig{
+		ExtraHosts: rt.ExtraHosts(),
+	}, &network.NetworkingConfig{
+		EndpointsConfig: map[string]*network.EndpointSettings{
+			contextStr: {
+				NetworkID: networkID,
+				Aliases:   []string{interceptSidecar + "." + hsName},
+			},
+		},
+	}, containerPlatform(cfg), containerName+"_"+interceptSidecar)
+	if err != nil {
+		return "", err
+	}
+	// mitmproxy signs the certificates it intercepts TLS with using the CA in its config directory, from a
+	// file holding both the key and certificate
+	caKey, err := cfg.CAPrivateKeyBytes()
+	if err != nil {
+		return body.ID, err
+	}
+	caCert, err := cfg.CACertificateBytes()
+	if err != nil {
+		return body.ID, err
+	}
+	files := map[string][]byte{
+		interceptAddonPath:  []byte(interceptAddon),
+		interceptCAFilePath: append(caKey, caCert...),
+	}
+	for path, contents := range files {
+		if err = copyToContainer(docker, body.ID, path, contents); err != nil {
+			return body.ID, err
+		}
+	}
+	if err = docker.ContainerStart(ctx, body.ID, types.ContainerStartOptions{}); err != nil {
+		return body.ID, err
+	}
+	if cfg.DebugLoggingEnabled {
+		log.Printf("%s: Started mitmproxy in container %s", contextStr, body.ID)
+	}
+	return body.ID, waitForHealthy(ctx, docker, body.ID, cfg.SpawnHSTimeout)
+}
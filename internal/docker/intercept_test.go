@@ -0,0 +1,132 @@
+package docker
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// askInterceptor sends the request to the interceptor as the mitmproxy addon does, returning its decision.
+func askInterceptor(t *testing.T, ic *Interceptor, method, url, body string) interceptDecision {
+	t.Helper()
+	data, err := json.Marshal(interceptedRequest{
+		Method:  method,
+		URL:     url,
+		Headers: [][2]string{{"Content-Type", "application/json"}},
+		Body:    []byte(body),
+	})
+	if err != nil {
+		t.Fatalf("failed to marshal request: %s", err)
+	}
+	w := httptest.NewRecorder()
+	ic.ServeHTTP(w, httptest.NewRequest("POST", "/", bytes.NewReader(data)))
+	if w.Code != 200 {
+		t.Fatalf("interceptor returned HTTP %d: %s", w.Code, w.Body.String())
+	}
+	var decision interceptDecision
+	if err := json.Unmarshal(w.Body.Bytes(), &decision); err != nil {
+		t.Fatalf("failed to unmarshal decision: %s", err)
+	}
+	return decision
+}
+
+func TestInterceptorDecide(t *testing.T) {
+	sendRequests := func(req *http.Request) bool {
+		return strings.Contains(req.URL.Path, "/send/")
+	}
+	modified := []byte(`{"modified":true}`)
+	testCases := []struct {
+		name  string
+		rules []InterceptRule
+		// the decisions for the same request made several times
+		want []interceptDecision
+	}{
+		{
+			name: "no rules forwards requests",
+			want: []interceptDecision{{}},
+		},
+		{
+			name:  "rule which doesn't match",
+			rules: []InterceptRule{{Match: func(req *http.Request) bool { return false }, Drop: true}},
+			want:  []interceptDecision{{}},
+		},
+		{
+			name:  "nil match applies to every request",
+			rules: []InterceptRule{{Delay: 1500 * time.Millisecond}},
+			want:  []interceptDecision{{DelayMS: 1500}, {DelayMS: 1500}},
+		},
+		{
+			name:  "times removes the rule",
+			rules: []InterceptRule{{Match: sendRequests, Drop: true, Times: 2}},
+			want:  []interceptDecision{{Drop: true}, {Drop: true}, {}},
+		},
+		{
+			name: "first matching rule applies",
+			rules: []InterceptRule{
+				{Match: sendRequests, Drop: true, Times: 1},
+				{Respond: &InterceptResponse{Code: 502, Body: []byte("bad gateway")}},
+			},
+			want: []interceptDecision{
+				{Drop: true},
+				{Response: &InterceptResponse{Code: 502, Body: []byte("bad gateway")}},
+			},
+		},
+		{
+			name: "match can read the body",
+			rules: []InterceptRule{
+				{
+					Match: func(req *http.Request) bool {
+						body, _ := ioutil.ReadAll(req.Body)
+						return bytes.Contains(body, []byte("nope"))
+					},
+					Drop: true,
+				},
+				{
+					Match: func(req *http.Request) bool {
+						body, _ := ioutil.ReadAll(req.Body)
+						return bytes.Contains(body, []byte("hello"))
+					},
+					ModifyBody: func(body []byte) []byte { return modified },
+				},
+			},
+			want: []interceptDecision{{Body: &modified}},
+		},
+	}
+	for _, tc := range testCases {
+		ic := &Interceptor{}
+		t.Run(tc.name, func(t *testing.T) {
+			for _, rule := range tc.rules {
+				ic.Add(t, rule)
+			}
+			for i, want := range tc.want {
+				got := askInterceptor(t, ic, "PUT", "https://hs2/_matrix/federation/v1/send/1", `{"hello":"world"}`)
+				if !reflect.DeepEqual(got, want) {
+					t.Errorf("request %d: got %+v want %+v", i, got, want)
+				}
+			}
+		})
+		if len(ic.rules) != 0 {
+			t.Errorf("%s: %d rules left after the test finished", tc.name, len(ic.rules))
+		}
+	}
+}
+
+func TestInterceptEnv(t *testing.T) {
+	env := interceptEnv("hs1")
+	for _, name := range []string{"COMPLEMENT_INTERCEPT_PROXY", "HTTP_PROXY", "HTTPS_PROXY", "http_proxy", "https_proxy"} {
+		if env[name] != "http://mitm.hs1:8080" {
+			t.Errorf("%s: got %s want the sidecar's proxy URL", name, env[name])
+		}
+	}
+	for _, name := range []string{"NO_PROXY", "no_proxy"} {
+		if !strings.Contains(env[name], ".hs1") {
+			t.Errorf("%s: got %s, want the homeserver's own sidecars excluded", name, env[name])
+		}
+	}
+}
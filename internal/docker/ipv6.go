@@ -0,0 +1,32 @@
+package docker
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/docker/docker/api/types"
+)
+
+// HostIPv6 returns the IPv6 address which homeservers in the deployment reach the machine running Complement
+// on, i.e the IPv6 gateway of their network. Use it with federation.WithServerHost to give a federation
+// server an IPv6 literal server name. Skips the test unless COMPLEMENT_ENABLE_IPV6 is set.
+func (d *Deployment) HostIPv6(t *testing.T) string {
+	t.Helper()
+	d.skipIfAttached(t, "HostIPv6")
+	if !d.Config.IPv6 {
+		t.Skipf("Deployment.HostIPv6 - IPv6 is not enabled, set COMPLEMENT_ENABLE_IPV6=1")
+	}
+	nw, err := d.Deployer.Docker.NetworkInspect(context.Background(), d.networkID, types.NetworkInspectOptions{})
+	if err != nil {
+		t.Fatalf("Deployment.HostIPv6 - failed to inspect network %s: %s", d.networkID, err)
+	}
+	for _, ipam := range nw.IPAM.Config {
+		ip := net.ParseIP(ipam.Gateway)
+		if ip != nil && ip.To4() == nil {
+			return ip.String()
+		}
+	}
+	t.Fatalf("Deployment.HostIPv6 - network %s has no IPv6 gateway", d.networkID)
+	return ""
+}
@@ -0,0 +1,671 @@
+package docker
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/matrix-org/complement/internal/b"
+	"github.com/matrix-org/complement/internal/config"
+	"github.com/matrix-org/complement/internal/instruction"
+	"github.com/matrix-org/complement/internal/timing"
+)
+
+// ErrKubernetesUnsupported is returned by DeployKubernetes when the blueprint or deploy options need something
+// only containers run by Docker or Podman can do, e.g workers or reverse proxies. Tests should be skipped.
+var ErrKubernetesUnsupported = errors.New("not supported when deploying to Kubernetes")
+
+var errKubeNotFound = errors.New("not found")
+
+// Where the service account of a pod is mounted, to talk to the API of the cluster the pod runs in.
+const kubeServiceAccountDir = "/var/run/secrets/kubernetes.io/serviceaccount"
+
+var (
+	// Kubernetes names must be DNS labels, which are lower case.
+	kubeUnsafeNameChars = regexp.MustCompile(`[^a-z0-9-]+`)
+	// Label values and config map keys may also have '_' and '.'.
+	kubeUnsafeKeyChars = regexp.MustCompile(`[^a-zA-Z0-9_.-]+`)
+)
+
+// DeployKubernetes deploys the blueprint as pods in COMPLEMENT_KUBERNETES_NAMESPACE, instead of running
+// containers, for CI clusters where docker-in-docker is prohibited. Each homeserver gets a pod running its
+// image, a service in front of it, and a config map holding the CA, application service registrations and
+// WithConfig fragments, mounted where the image expects them. Pods can't be committed as images, so the
+// blueprint's instructions are run against the homeservers on every deployment rather than being built once.
+//
+// Complement must be able to reach the services' cluster IPs, so it usually runs in a pod in the cluster
+// itself, and the homeservers reach Complement at COMPLEMENT_KUBERNETES_HOST_IP. Tests using the deployment
+// are skipped if they need to control the homeservers' containers, e.g to restart them.
+func DeployKubernetes(ctx context.Context, cfg *config.Complement, deployNamespace string, bprint b.Blueprint, opts ...DeployOption) (*Deployment, error) {
+	defer timing.Track(timing.PhaseDeploy)()
+	options := newDeployOptions(opts)
+	if err := kubeSupports(bprint, options); err != nil {
+		return nil, fmt.Errorf("DeployKubernetes: %w", err)
+	}
+	kube, err := newKubeClient(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("DeployKubernetes: %w", err)
+	}
+	hostIP, err := kubeHostIP(cfg, kube.apiURL)
+	if err != nil {
+		return nil, fmt.Errorf("DeployKubernetes: %w", err)
+	}
+	dep := &Deployment{
+		Deployer: &Deployer{
+			DeployNamespace: deployNamespace,
+			debugLogging:    cfg.DebugLoggingEnabled,
+			config:          cfg,
+		},
+		BlueprintName: bprint.Name,
+		HS:            make(map[string]HomeserverDeployment),
+		Config:        cfg,
+		isolated:      options.isolated,
+		kube: &kubeDeployment{
+			client: kube,
+			pods:   make(map[string]string),
+		},
+	}
+	dep.limitHolder = limiterHolder(ctx, "DeployKubernetes "+deployNamespace)
+	dep.limited, err = containerLimiter(cfg).acquire(ctx, dep.limitHolder, len(bprint.Homeservers), "DeployKubernetes "+bprint.Name)
+	if err != nil {
+		return nil, fmt.Errorf("DeployKubernetes: %w", err)
+	}
+	if err = dep.kube.deploy(ctx, cfg, deployNamespace, bprint, options, hostIP); err != nil {
+		dep.kube.destroy(true)
+		containerLimiter(cfg).release(dep.limitHolder, dep.limited)
+		dep.limited = 0
+		return nil, fmt.Errorf("DeployKubernetes: %w", err)
+	}
+
+	runner := instruction.NewRunner(bprint.Name, cfg.BestEffort, cfg.DebugLoggingEnabled)
+	runner.SetRoomConcurrency(cfg.BuildConcurrency)
+	for _, hs := range bprint.Homeservers {
+		ip := dep.kube.clusterIPs[hs.Name]
+		baseURL := "http://" + net.JoinHostPort(ip, "8008")
+		if err = runner.Run(hs, baseURL); err != nil {
+			dep.kube.destroy(true)
+			containerLimiter(cfg).release(dep.limitHolder, dep.limited)
+			dep.limited = 0
+			return nil, fmt.Errorf("DeployKubernetes: failed to run instructions for %s: %w", hs.Name, err)
+		}
+		// application services can use their as_token like an access token, like in deployments of images
+		accessTokens := runner.AccessTokens(hs.Name)
+		for userID, token := range tokensFromLabels(labelsForApplicationServices(hs)) {
+			accessTokens[userID] = token
+		}
+		dep.HS[hs.Name] = HomeserverDeployment{
+			BaseURL:             baseURL,
+			FedBaseURL:          "https://" + net.JoinHostPort(ip, "8448"),
+			AccessTokens:        accessTokens,
+			ApplicationServices: dep.kube.registrations[hs.Name],
+			DeviceIDs:           runner.DeviceIDs(hs.Name),
+			GuestUserIDs:        runner.GuestUserIDs(hs.Name),
+			DeviceAccessTokens:  runner.DeviceAccessTokens(hs.Name),
+		}
+	}
+	return dep, nil
+}
+
+// kubeSupports returns an error wrapping ErrKubernetesUnsupported if the blueprint or options need containers.
+func kubeSupports(bprint b.Blueprint, options *deployOptions) error {
+	if len(options.composeHomeservers) > 0 {
+		return fmt.Errorf("compose homeservers are %w", ErrKubernetesUnsupported)
+	}
+	for _, hs := range bprint.Homeservers {
+		if hs.Compose != nil {
+			return fmt.Errorf("compose homeservers are %w", ErrKubernetesUnsupported)
+		}
+	}
+	for hsName, hsOpts := range options.homeservers {
+		switch {
+		case len(hsOpts.workers) > 0:
+			return fmt.Errorf("%s: workers are %w", hsName, ErrKubernetesUnsupported)
+		case len(hsOpts.ports) > 0:
+			return fmt.Errorf("%s: extra ports are %w", hsName, ErrKubernetesUnsupported)
+		case len(hsOpts.tempMounts) > 0:
+			return fmt.Errorf("%s: temporary mounts are %w", hsName, ErrKubernetesUnsupported)
+		case hsOpts.networkConditions != nil:
+			return fmt.Errorf("%s: network conditions are %w", hsName, ErrKubernetesUnsupported)
+		case hsOpts.reverseProxy:
+			return fmt.Errorf("%s: reverse proxies are %w", hsName, ErrKubernetesUnsupported)
+		case hsOpts.intercept:
+			return fmt.Errorf("%s: interception is %w", hsName, ErrKubernetesUnsupported)
+		}
+	}
+	return nil
+}
+
+// kubeDeployment is the Kubernetes objects of a deployment made by DeployKubernetes.
+type kubeDeployment struct {
+	client *kubeClient
+	// HS name -> pod name. Services and config maps are named after their pod.
+	pods map[string]string
+	// HS name -> cluster IP of its service
+	clusterIPs map[string]string
+	// HS name -> AS ID -> registration YAML
+	registrations map[string]map[string]string
+	// guards destroyed, as tests may destroy deployments from cleanup functions
+	mu        sync.Mutex
+	destroyed bool
+}
+
+// deploy creates the services of every homeserver first, so their cluster IPs can be given to every pod
+// as the address of each homeserver's name, then the config maps and pods, and waits for the pods to be ready.
+func (k *kubeDeployment) deploy(ctx context.Context, cfg *config.Complement, deployNamespace string, bprint b.Blueprint, options *deployOptions, hostIP string) error {
+	k.clusterIPs = make(map[string]string)
+	k.registrations = make(map[string]map[string]string)
+	for _, hs := range bprint.Homeservers {
+		name := kubeResourceName(cfg.RunID, deployNamespace, bprint.Name, hs.Name)
+		k.pods[hs.Name] = name
+		var svc struct {
+			Spec struct {
+				ClusterIP string `json:"clusterIP"`
+			} `json:"spec"`
+		}
+		if err := k.client.create(ctx, "services", kubeService(name, kubeLabels(cfg, deployNamespace, bprint.Name, hs.Name)), &svc); err != nil {
+			return fmt.Errorf("failed to create service for %s: %w", hs.Name, err)
+		}
+		k.clusterIPs[hs.Name] = svc.Spec.ClusterIP
+	}
+	hostAliases := map[string]string{
+		HostnameRunningComplement: hostIP,
+	}
+	for hsName, ip := range k.clusterIPs {
+		hostAliases[hsName] = ip
+	}
+	for _, hs := range bprint.Homeservers {
+		name := k.pods[hs.Name]
+		labels := kubeLabels(cfg, deployNamespace, bprint.Name, hs.Name)
+		registrations := asIDToRegistrationFromLabels(labelsForApplicationServices(hs))
+		for asID, asURL := range options.applicationServiceURLs[hs.Name] {
+			if registration, ok := registrations[asID]; ok {
+				registrations[asID] = resolveASRegistration(registration, asURL)
+			}
+		}
+		for asID, registration := range options.applicationServices[hs.Name] {
+			registrations[asID] = registration
+		}
+		k.registrations[hs.Name] = registrations
+		files, err := kubeFiles(cfg, registrations, options.homeservers[hs.Name])
+		if err != nil {
+			return fmt.Errorf("%s: %w", hs.Name, err)
+		}
+		if err = k.client.create(ctx, "configmaps", kubeConfigMap(name, labels, files), nil); err != nil {
+			return fmt.Errorf("failed to create config map for %s: %w", hs.Name, err)
+		}
+		imageURI, err := cfg.ImageURI(hs.Image)
+		if err != nil {
+			return fmt.Errorf("%s: %w", hs.Name, err)
+		}
+		env := map[string]string{
+			"SERVER_NAME": hs.Name,
+		}
+		if hsOpts := options.homeservers[hs.Name]; hsOpts != nil {
+			for key, value := range hsOpts.env {
+				env[key] = value
+			}
+		}
+		pod := kubePod(name, imageURI, labels, env, files, hostAliases)
+		if err = k.client.create(ctx, "pods", pod, nil); err != nil {
+			return fmt.Errorf("failed to create pod for %s: %w", hs.Name, err)
+		}
+		if cfg.DebugLoggingEnabled {
+			log.Printf("%s: Created pod %s using image %s", hs.Name, name, imageURI)
+		}
+	}
+	defer timing.Track(timing.PhaseHealthCheck)()
+	for _, hs := range bprint.Homeservers {
+		if err := k.waitForPod(ctx, k.pods[hs.Name], cfg.SpawnHSTimeout); err != nil {
+			return fmt.Errorf("%s: %w", hs.Name, err)
+		}
+	}
+	return nil
+}
+
+// waitForPod waits for the readiness probe of the pod to pass, failing early if the pod can't start.
+func (k *kubeDeployment) waitForPod(ctx context.Context, name string, timeout time.Duration) error {
+	stopTime := time.Now().Add(timeout)
+	var lastErr error
+	for time.Now().Before(stopTime) {
+		var pod kubePodStatus
+		if err := k.client.get(ctx, "pods/"+name, &pod); err != nil {
+			lastErr = err
+		} else if pod.ready() {
+			return nil
+		} else if err = pod.failed(); err != nil {
+			return fmt.Errorf("pod %s failed to start: %w", name, err)
+		} else {
+			lastErr = fmt.Errorf("pod %s is %s", name, pod.Status.Phase)
+		}
+		time.Sleep(500 * time.Millisecond)
+	}
+	return fmt.Errorf("timed out waiting for pod %s to be ready: %s", name, lastErr)
+}
+
+// printLogs prints the logs of the homeserver pods.
+func (k *kubeDeployment) printLogs() {
+	for _, hsName := range sortedKeys(k.pods) {
+		logs, err := k.client.logs(context.Background(), k.pods[hsName])
+		if err != nil {
+			log.Printf("%s: failed to get logs of pod %s: %s", hsName, k.pods[hsName], err)
+			continue
+		}
+		log.Printf("============================================\n\n\n")
+		log.Printf("Server logs (%s):", hsName)
+		log.Print(logs)
+		log.Printf("============== %s : END LOGS ==============\n\n\n", hsName)
+	}
+}
+
+// destroy deletes the pods, services and config maps of the deployment, printing the logs of the pods first
+// if `printServerLogs` is true.
+func (k *kubeDeployment) destroy(printServerLogs bool) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if k.destroyed {
+		return
+	}
+	k.destroyed = true
+	if printServerLogs {
+		k.printLogs()
+	}
+	ctx := context.Background()
+	for _, hsName := range sortedKeys(k.pods) {
+		name := k.pods[hsName]
+		for _, resource := range []string{"pods", "services", "configmaps"} {
+			if err := k.client.delete(ctx, resource+"/"+name); err != nil {
+				log.Printf("Destroy: Failed to delete %s/%s : %s\n", resource, name, err)
+			}
+		}
+	}
+}
+
+// kubeResourceName returns the name of the objects of a homeserver. Names are DNS labels, so at most 63
+// characters, and unique to the run, so parallel runs can share a namespace.
+func kubeResourceName(runID, deployNamespace, blueprintName, hsName string) string {
+	if len(runID) > 8 {
+		runID = runID[:8]
+	}
+	name := kubeUnsafeNameChars.ReplaceAllString(strings.ToLower(
+		fmt.Sprintf("complement-%s-%s-%s-%s", runID, deployNamespace, blueprintName, hsName),
+	), "-")
+	if len(name) > 63 {
+		// keep the end, which has the deployment and homeserver names in it
+		name = "complement-" + strings.TrimLeft(name[len(name)-(63-len("complement-")):], "-")
+	}
+	return strings.TrimRight(name, "-")
+}
+
+// kubeLabels returns the labels of the objects of a homeserver. They match the labels of containers, so
+// `kubectl get pods -l complement_blueprint=...` works like `docker ps --filter`.
+func kubeLabels(cfg *config.Complement, deployNamespace, blueprintName, hsName string) map[string]string {
+	labels := map[string]string{
+		complementLabel:        deployNamespace,
+		"complement_blueprint": blueprintName,
+		"complement_pkg":       cfg.PackageNamespace,
+		"complement_hs_name":   hsName,
+		runLabel:               cfg.RunID,
+	}
+	for k, v := range labels {
+		labels[k] = strings.Trim(kubeUnsafeKeyChars.ReplaceAllString(v, "_"), "_.-")
+	}
+	return labels
+}
+
+// kubeFiles returns container path -> contents of the files which are copied into homeserver containers.
+func kubeFiles(cfg *config.Complement, registrations map[string]string, hsOpts *hsDeployOptions) (map[string][]byte, error) {
+	files := make(map[string][]byte)
+	certBytes, err := cfg.CACertificateBytes()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get CA certificate: %s", err)
+	}
+	files[MountCACertPath] = certBytes
+	keyBytes, err := cfg.CAPrivateKeyBytes()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get CA key: %s", err)
+	}
+	files[MountCAKeyPath] = keyBytes
+	for asID, registration := range registrations {
+		files[fmt.Sprintf("%s%s.yaml", MountAppServicePath, url.PathEscape(asID))] = []byte(resolveASRegistration(registration, ""))
+	}
+	if hsOpts != nil {
+		for path, contents := range hsOpts.files {
+			files[path] = contents
+		}
+	}
+	return files, nil
+}
+
+// kubeConfigMapKey returns the key of the file at `path` in the config map, as keys can't have '/' in them.
+func kubeConfigMapKey(path string) string {
+	return kubeUnsafeKeyChars.ReplaceAllString(strings.TrimPrefix(path, "/"), "_")
+}
+
+func kubeService(name string, labels map[string]string) map[string]interface{} {
+	return map[string]interface{}{
+		"apiVersion": "v1",
+		"kind":       "Service",
+		"metadata": map[string]interface{}{
+			"name":   name,
+			"labels": labels,
+		},
+		"spec": map[string]interface{}{
+			"selector": map[string]string{
+				"complement_pod": name,
+			},
+			"ports": []map[string]interface{}{
+				{"name": "client", "port": 8008, "targetPort": 8008},
+				{"name": "federation", "port": 8448, "targetPort": 8448},
+			},
+		},
+	}
+}
+
+func kubeConfigMap(name string, labels map[string]string, files map[string][]byte) map[string]interface{} {
+	data := make(map[string]string)
+	for path, contents := range files {
+		data[kubeConfigMapKey(path)] = string(contents)
+	}
+	return map[string]interface{}{
+		"apiVersion": "v1",
+		"kind":       "ConfigMap",
+		"metadata": map[string]interface{}{
+			"name":   name,
+			"labels": labels,
+		},
+		"data": data,
+	}
+}
+
+// kubePod returns a pod running the homeserver, with the files of its config map mounted at their paths.
+// Each file is mounted on its own with subPath, so the rest of the directories it is in are kept.
+func kubePod(name, image string, labels, env map[string]string, files map[string][]byte, hostAliases map[string]string) map[string]interface{} {
+	podLabels := map[string]string{
+		"complement_pod": name,
+	}
+	for k, v := range labels {
+		podLabels[k] = v
+	}
+	var envVars []map[string]string
+	for _, key := range sortedKeys(env) {
+		envVars = append(envVars, map[string]string{"name": key, "value": env[key]})
+	}
+	var mounts []map[string]interface{}
+	for _, path := range sortedKeys(files) {
+		mounts = append(mounts, map[string]interface{}{
+			"name":      "complement",
+			"mountPath": path,
+			"subPath":   kubeConfigMapKey(path),
+			"readOnly":  true,
+		})
+	}
+	// aliases with the same IP must be grouped
+	ipToHosts := make(map[string][]string)
+	for _, host := range sortedKeys(hostAliases) {
+		ipToHosts[hostAliases[host]] = append(ipToHosts[hostAliases[host]], host)
+	}
+	var aliases []map[string]interface{}
+	for _, ip := range sortedKeys(ipToHosts) {
+		aliases = append(aliases, map[string]interface{}{"ip": ip, "hostnames": ipToHosts[ip]})
+	}
+	return map[string]interface{}{
+		"apiVersion": "v1",
+		"kind":       "Pod",
+		"metadata": map[string]interface{}{
+			"name":   name,
+			"labels": podLabels,
+		},
+		"spec": map[string]interface{}{
+			"restartPolicy": "Never",
+			"hostAliases":   aliases,
+			"containers": []map[string]interface{}{
+				{
+					"name":  "homeserver",
+					"image": image,
+					"env":   envVars,
+					"ports": []map[string]interface{}{
+						{"name": "client", "containerPort": 8008},
+						{"name": "federation", "containerPort": 8448},
+					},
+					"readinessProbe": map[string]interface{}{
+						"httpGet": map[string]interface{}{
+							"path": "/_matrix/client/versions",
+							"port": 8008,
+						},
+						"periodSeconds":    1,
+						"failureThreshold": 1,
+					},
+					"volumeMounts": mounts,
+				},
+			},
+			"volumes": []map[string]interface{}{
+				{
+					"name": "complement",
+					"configMap": map[string]interface{}{
+						"name": name,
+					},
+				},
+			},
+		},
+	}
+}
+
+// kubePodStatus is the part of a pod which says whether it is ready.
+type kubePodStatus struct {
+	Status struct {
+		Phase      string `json:"phase"`
+		Conditions []struct {
+			Type   string `json:"type"`
+			Status string `json:"status"`
+		} `json:"conditions"`
+		ContainerStatuses []struct {
+			State struct {
+				Waiting *struct {
+					Reason  string `json:"reason"`
+					Message string `json:"message"`
+				} `json:"waiting"`
+				Terminated *struct {
+					Reason   string `json:"reason"`
+					ExitCode int    `json:"exitCode"`
+				} `json:"terminated"`
+			} `json:"state"`
+		} `json:"containerStatuses"`
+	} `json:"status"`
+}
+
+func (p *kubePodStatus) ready() bool {
+	for _, c := range p.Status.Conditions {
+		if c.Type == "Ready" && c.Status == "True" {
+			return true
+		}
+	}
+	return false
+}
+
+// failed returns why the pod won't become ready, or nil if it may still.
+func (p *kubePodStatus) failed() error {
+	if p.Status.Phase == "Failed" || p.Status.Phase == "Succeeded" {
+		return fmt.Errorf("pod exited with phase %s", p.Status.Phase)
+	}
+	for _, cs := range p.Status.ContainerStatuses {
+		if w := cs.State.Waiting; w != nil {
+			switch w.Reason {
+			case "ErrImagePull", "ImagePullBackOff", "InvalidImageName", "CreateContainerConfigError", "CrashLoopBackOff":
+				return fmt.Errorf("%s: %s", w.Reason, w.Message)
+			}
+		}
+		if term := cs.State.Terminated; term != nil {
+			return fmt.Errorf("container exited with code %d: %s", term.ExitCode, term.Reason)
+		}
+	}
+	return nil
+}
+
+// kubeClient talks to the API of a Kubernetes cluster, in one namespace.
+type kubeClient struct {
+	apiURL    string
+	namespace string
+	token     string
+	http      *http.Client
+}
+
+// newKubeClient connects to the API at COMPLEMENT_KUBERNETES_API_URL, e.g `kubectl proxy`, or otherwise with the
+// service account of the pod Complement runs in.
+func newKubeClient(cfg *config.Complement) (*kubeClient, error) {
+	c := &kubeClient{
+		apiURL:    strings.TrimSuffix(cfg.KubernetesAPIURL, "/"),
+		namespace: cfg.KubernetesNamespace,
+		http:      &http.Client{Timeout: 30 * time.Second},
+	}
+	if c.apiURL != "" {
+		return c, nil
+	}
+	host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+	if host == "" || port == "" {
+		return nil, fmt.Errorf("not running in a Kubernetes pod, set COMPLEMENT_KUBERNETES_API_URL")
+	}
+	c.apiURL = "https://" + net.JoinHostPort(host, port)
+	token, err := ioutil.ReadFile(kubeServiceAccountDir + "/token")
+	if err != nil {
+		return nil, fmt.Errorf("failed to read service account token: %w", err)
+	}
+	c.token = strings.TrimSpace(string(token))
+	caCert, err := ioutil.ReadFile(kubeServiceAccountDir + "/ca.crt")
+	if err != nil {
+		return nil, fmt.Errorf("failed to read service account CA: %w", err)
+	}
+	pool := x509.NewCertPool()
+	pool.AppendCertsFromPEM(caCert)
+	c.http.Transport = &http.Transport{
+		TLSClientConfig: &tls.Config{RootCAs: pool},
+	}
+	return c, nil
+}
+
+// kubeHostIP returns the address homeservers reach Complement at: COMPLEMENT_KUBERNETES_HOST_IP, or the address
+// Complement talks to the cluster from.
+func kubeHostIP(cfg *config.Complement, apiURL string) (string, error) {
+	if cfg.KubernetesHostIP != "" {
+		return cfg.KubernetesHostIP, nil
+	}
+	u, err := url.Parse(apiURL)
+	if err != nil {
+		return "", err
+	}
+	host := u.Host
+	if u.Port() == "" {
+		host = net.JoinHostPort(u.Hostname(), "443")
+	}
+	// nothing is sent over UDP, this only picks the route
+	conn, err := net.Dial("udp", host)
+	if err != nil {
+		return "", fmt.Errorf("failed to find the address of this machine, set COMPLEMENT_KUBERNETES_HOST_IP: %w", err)
+	}
+	defer conn.Close()
+	ip := conn.LocalAddr().(*net.UDPAddr).IP
+	if ip.IsLoopback() {
+		return "", fmt.Errorf("the Kubernetes API is on this machine, set COMPLEMENT_KUBERNETES_HOST_IP to an address pods can reach")
+	}
+	return ip.String(), nil
+}
+
+func (c *kubeClient) create(ctx context.Context, resource string, obj interface{}, out interface{}) error {
+	return c.do(ctx, "POST", resource, obj, out)
+}
+
+func (c *kubeClient) get(ctx context.Context, resource string, out interface{}) error {
+	return c.do(ctx, "GET", resource, nil, out)
+}
+
+// delete deletes the object, which may not exist if deploying it failed.
+func (c *kubeClient) delete(ctx context.Context, resource string) error {
+	// don't wait for the homeserver to shut down, as it is thrown away
+	err := c.do(ctx, "DELETE", resource, map[string]interface{}{"gracePeriodSeconds": 0}, nil)
+	if errors.Is(err, errKubeNotFound) {
+		return nil
+	}
+	return err
+}
+
+func (c *kubeClient) logs(ctx context.Context, pod string) (string, error) {
+	req, err := c.newRequest(ctx, "GET", "pods/"+pod+"/log", nil)
+	if err != nil {
+		return "", err
+	}
+	res, err := c.http.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return "", err
+	}
+	if res.StatusCode != 200 {
+		return "", fmt.Errorf("GET %s => HTTP %s: %s", req.URL.Path, res.Status, body)
+	}
+	return string(body), nil
+}
+
+func (c *kubeClient) newRequest(ctx context.Context, method, resource string, body io.Reader) (*http.Request, error) {
+	u := fmt.Sprintf("%s/api/v1/namespaces/%s/%s", c.apiURL, url.PathEscape(c.namespace), resource)
+	req, err := http.NewRequestWithContext(ctx, method, u, body)
+	if err != nil {
+		return nil, err
+	}
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
+	return req, nil
+}
+
+// do sends `in` as JSON to the resource, and decodes the response into `out` if it isn't nil.
+func (c *kubeClient) do(ctx context.Context, method, resource string, in interface{}, out interface{}) error {
+	var body io.Reader
+	if in != nil {
+		b, err := json.Marshal(in)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(b)
+	}
+	req, err := c.newRequest(ctx, method, resource, body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	res, err := c.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	resBody, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return err
+	}
+	if res.StatusCode == 404 {
+		return fmt.Errorf("%s %s => %w", method, req.URL.Path, errKubeNotFound)
+	}
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		return fmt.Errorf("%s %s => HTTP %s: %s", method, req.URL.Path, res.Status, resBody)
+	}
+	if out == nil {
+		return nil
+	}
+	return json.Unmarshal(resBody, out)
+}
@@ -0,0 +1,213 @@
+package docker
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/complement/internal/b"
+	"github.com/matrix-org/complement/internal/config"
+)
+
+func TestKubeResourceName(t *testing.T) {
+	dnsLabel := regexp.MustCompile(`^[a-z]([a-z0-9-]*[a-z0-9])?$`)
+	testCases := []struct {
+		runID, namespace, blueprint, hs string
+		want                            string
+	}{
+		{"0123456789abcdef", "1", "clean_hs", "hs1", "complement-01234567-1-clean-hs-hs1"},
+		{"abc", "12", "Federation One To One", "hs2", "complement-abc-12-federation-one-to-one-hs2"},
+		{"0123456789abcdef", "3", strings.Repeat("very_long_blueprint_name_", 5), "hs1", ""},
+	}
+	for _, tc := range testCases {
+		got := kubeResourceName(tc.runID, tc.namespace, tc.blueprint, tc.hs)
+		if tc.want != "" && got != tc.want {
+			t.Errorf("kubeResourceName(%q, %q, %q, %q) = %q, want %q", tc.runID, tc.namespace, tc.blueprint, tc.hs, got, tc.want)
+		}
+		if len(got) > 63 || !dnsLabel.MatchString(got) {
+			t.Errorf("kubeResourceName(%q, %q, %q, %q) = %q, which isn't a DNS label", tc.runID, tc.namespace, tc.blueprint, tc.hs, got)
+		}
+		if !strings.HasSuffix(got, "-"+tc.hs) {
+			t.Errorf("kubeResourceName(%q, %q, %q, %q) = %q, which doesn't end with the homeserver name", tc.runID, tc.namespace, tc.blueprint, tc.hs, got)
+		}
+	}
+}
+
+func TestKubeSupports(t *testing.T) {
+	testCases := []struct {
+		name        string
+		opts        []DeployOption
+		unsupported bool
+	}{
+		{name: "no options"},
+		{name: "config and env", opts: []DeployOption{WithConfig("hs1", "a.yaml", "a: 1"), WithEnv("hs1", "A", "1")}},
+		{name: "workers", opts: []DeployOption{WithWorkers("hs1", Worker{Name: "synchrotron", Type: "synchrotron"})}, unsupported: true},
+		{name: "reverse proxy", opts: []DeployOption{WithReverseProxy("hs1")}, unsupported: true},
+		{name: "network conditions", opts: []DeployOption{WithNetworkConditions("hs1", NetworkConditions{Delay: time.Second})}, unsupported: true},
+		{name: "temp mount", opts: []DeployOption{WithTempMount("hs1", "/data")}, unsupported: true},
+	}
+	for _, tc := range testCases {
+		options := &deployOptions{
+			applicationServices:    make(map[string]map[string]string),
+			applicationServiceURLs: make(map[string]map[string]string),
+			homeservers:            make(map[string]*hsDeployOptions),
+		}
+		for _, opt := range tc.opts {
+			opt(options)
+		}
+		err := kubeSupports(b.BlueprintCleanHS, options)
+		if got := errors.Is(err, ErrKubernetesUnsupported); got != tc.unsupported {
+			t.Errorf("%s: got error %v, want unsupported=%v", tc.name, err, tc.unsupported)
+		}
+	}
+}
+
+func TestKubePod(t *testing.T) {
+	files := map[string][]byte{
+		MountCACertPath:                 []byte("cert"),
+		MountConfigPath + "limits.yaml": []byte("limits"),
+	}
+	pod := kubePod("complement-hs1", "homeserver:latest", map[string]string{"complement_hs_name": "hs1"}, map[string]string{
+		"SERVER_NAME": "hs1",
+	}, files, map[string]string{
+		"hs1":                  "10.0.0.1",
+		"hs2":                  "10.0.0.2",
+		"host.docker.internal": "10.0.0.1",
+	})
+	b, err := json.Marshal(pod)
+	if err != nil {
+		t.Fatalf("failed to marshal pod: %s", err)
+	}
+	var got struct {
+		Metadata struct {
+			Labels map[string]string `json:"labels"`
+		} `json:"metadata"`
+		Spec struct {
+			HostAliases []struct {
+				IP        string   `json:"ip"`
+				Hostnames []string `json:"hostnames"`
+			} `json:"hostAliases"`
+			Containers []struct {
+				Image        string `json:"image"`
+				VolumeMounts []struct {
+					MountPath string `json:"mountPath"`
+					SubPath   string `json:"subPath"`
+				} `json:"volumeMounts"`
+			} `json:"containers"`
+		} `json:"spec"`
+	}
+	if err = json.Unmarshal(b, &got); err != nil {
+		t.Fatalf("failed to unmarshal pod: %s", err)
+	}
+	if got.Metadata.Labels["complement_pod"] != "complement-hs1" || got.Metadata.Labels["complement_hs_name"] != "hs1" {
+		t.Errorf("pod labels are %v, want complement_pod and complement_hs_name", got.Metadata.Labels)
+	}
+	if len(got.Spec.HostAliases) != 2 || got.Spec.HostAliases[0].IP != "10.0.0.1" || len(got.Spec.HostAliases[0].Hostnames) != 2 {
+		t.Errorf("host aliases are %+v, want hosts grouped by IP", got.Spec.HostAliases)
+	}
+	mounts := got.Spec.Containers[0].VolumeMounts
+	if len(mounts) != len(files) {
+		t.Fatalf("got %d volume mounts, want %d", len(mounts), len(files))
+	}
+	data := kubeConfigMap("complement-hs1", nil, files)["data"].(map[string]string)
+	for _, m := range mounts {
+		if string(files[m.MountPath]) != data[m.SubPath] {
+			t.Errorf("%s is mounted from config map key %s, which holds %q", m.MountPath, m.SubPath, data[m.SubPath])
+		}
+	}
+}
+
+// fakeKubeAPI is enough of the Kubernetes API to deploy pods which are ready straight away.
+type fakeKubeAPI struct {
+	mu      sync.Mutex
+	objects map[string]map[string]interface{} // resource/name -> object
+}
+
+func (f *fakeKubeAPI) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	path := strings.TrimPrefix(req.URL.Path, "/api/v1/namespaces/complement/")
+	switch req.Method {
+	case "POST":
+		var obj map[string]interface{}
+		json.NewDecoder(req.Body).Decode(&obj) // nolint:errcheck
+		name := obj["metadata"].(map[string]interface{})["name"].(string)
+		if path == "services" {
+			obj["spec"].(map[string]interface{})["clusterIP"] = "127.0.0.1"
+		}
+		f.objects[path+"/"+name] = obj
+		json.NewEncoder(w).Encode(obj) // nolint:errcheck
+	case "GET":
+		obj, ok := f.objects[path]
+		if !ok {
+			w.WriteHeader(404)
+			return
+		}
+		if strings.HasPrefix(path, "pods/") {
+			obj["status"] = map[string]interface{}{
+				"phase":      "Running",
+				"conditions": []map[string]string{{"type": "Ready", "status": "True"}},
+			}
+		}
+		json.NewEncoder(w).Encode(obj) // nolint:errcheck
+	case "DELETE":
+		if _, ok := f.objects[path]; !ok {
+			w.WriteHeader(404)
+			return
+		}
+		delete(f.objects, path)
+		w.Write([]byte("{}")) // nolint:errcheck
+	}
+}
+
+func TestDeployKubernetes(t *testing.T) {
+	api := &fakeKubeAPI{objects: make(map[string]map[string]interface{})}
+	srv := httptest.NewServer(api)
+	defer srv.Close()
+	cfg := &config.Complement{
+		BaseImageURI:        "homeserver:latest",
+		SpawnHSTimeout:      5 * time.Second,
+		PackageNamespace:    "test",
+		RunID:               "0123456789abcdef",
+		KubernetesNamespace: "complement",
+		KubernetesAPIURL:    srv.URL,
+		KubernetesHostIP:    "10.0.0.100",
+	}
+	if err := cfg.GenerateCA(); err != nil {
+		t.Fatalf("failed to generate CA: %s", err)
+	}
+	bprint := b.MustValidate(b.Blueprint{
+		Name: "kube",
+		Homeservers: []b.Homeserver{
+			{Name: "hs1"},
+		},
+	})
+	dep, err := DeployKubernetes(context.Background(), cfg, "1", bprint, WithConfig("hs1", "limits.yaml", "limits: {}"))
+	if err != nil {
+		t.Fatalf("DeployKubernetes returned error: %s", err)
+	}
+	if got := dep.HS["hs1"].BaseURL; got != "http://127.0.0.1:8008" {
+		t.Errorf("BaseURL is %s, want the cluster IP of the service", got)
+	}
+	name := kubeResourceName(cfg.RunID, "1", "kube", "hs1")
+	for _, resource := range []string{"pods", "services", "configmaps"} {
+		if _, ok := api.objects[resource+"/"+name]; !ok {
+			t.Errorf("%s/%s wasn't created", resource, name)
+		}
+	}
+	data := api.objects["configmaps/"+name]["data"].(map[string]interface{})
+	if data[kubeConfigMapKey(MountConfigPath+"limits.yaml")] != "limits: {}" {
+		t.Errorf("config map doesn't have the WithConfig fragment: %v", data)
+	}
+	dep.Destroy(t)
+	if len(api.objects) != 0 {
+		t.Errorf("objects left after Destroy: %v", api.objects)
+	}
+}
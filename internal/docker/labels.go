@@ -51,6 +51,16 @@ func labelsForApplicationServices(hs b.Homeserver) map[string]string {
 	return labels
 }
 
+func guestUserIDsFromLabels(labels map[string]string) map[string]string {
+	guestUserIDs := make(map[string]string)
+	for k, v := range labels {
+		if strings.HasPrefix(k, "guest_user_id_") {
+			guestUserIDs[strings.TrimPrefix(k, "guest_user_id_")] = v
+		}
+	}
+	return guestUserIDs
+}
+
 func deviceIDsFromLabels(labels map[string]string) map[string]string {
 	userIDToToken := make(map[string]string)
 	for k, v := range labels {
@@ -60,3 +70,33 @@ func deviceIDsFromLabels(labels map[string]string) map[string]string {
 	}
 	return userIDToToken
 }
+
+// labelsForDeviceAccessTokens returns labels 'device_access_token_$userid|$deviceid: $token' to store the access
+// tokens of users' further devices.
+func labelsForDeviceAccessTokens(deviceTokens map[string]map[string]string) map[string]string {
+	labels := make(map[string]string)
+	for userID, tokens := range deviceTokens {
+		for deviceID, token := range tokens {
+			labels["device_access_token_"+userID+"|"+deviceID] = token
+		}
+	}
+	return labels
+}
+
+func deviceAccessTokensFromLabels(labels map[string]string) map[string]map[string]string {
+	deviceTokens := make(map[string]map[string]string)
+	for k, v := range labels {
+		if !strings.HasPrefix(k, "device_access_token_") {
+			continue
+		}
+		userID, deviceID, ok := strings.Cut(strings.TrimPrefix(k, "device_access_token_"), "|")
+		if !ok {
+			continue
+		}
+		if deviceTokens[userID] == nil {
+			deviceTokens[userID] = make(map[string]string)
+		}
+		deviceTokens[userID][deviceID] = v
+	}
+	return deviceTokens
+}
@@ -0,0 +1,274 @@
+package docker
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/matrix-org/complement/internal/config"
+	"github.com/matrix-org/complement/internal/timing"
+)
+
+var (
+	limiterOnce  sync.Once
+	globalLimits *limiter
+)
+
+// How often deployments waiting for containers check if other test binaries have freed some
+const hostSlotsPollInterval = 500 * time.Millisecond
+
+// containerLimiter returns the limiter shared by every deployment in this test binary, or nil if
+// COMPLEMENT_MAX_CONTAINERS isn't set. The limit is shared with other test binaries on this machine, e.g
+// when running `go test ./tests/...`, where supported.
+func containerLimiter(cfg *config.Complement) *limiter {
+	limiterOnce.Do(func() {
+		if cfg.MaxContainers > 0 {
+			globalLimits = newLimiter(cfg.MaxContainers)
+			globalLimits.host = newHostSlots(filepath.Join(os.TempDir(), "complement-containers"), cfg.MaxContainers)
+		}
+	})
+	return globalLimits
+}
+
+type limiterHolderKey struct{}
+
+// WithContainerHolder returns a context for deploying containers on behalf of `holder`, e.g the name of a
+// test. A holder which already has containers from COMPLEMENT_MAX_CONTAINERS, or whose parent test does,
+// gets more straight away rather than waiting for itself to free some, which would never happen.
+func WithContainerHolder(ctx context.Context, holder string) context.Context {
+	return context.WithValue(ctx, limiterHolderKey{}, holder)
+}
+
+// limiterHolder returns the holder given to WithContainerHolder, or `fallback` if there isn't one.
+func limiterHolder(ctx context.Context, fallback string) string {
+	if holder, ok := ctx.Value(limiterHolderKey{}).(string); ok && holder != "" {
+		return holder
+	}
+	return fallback
+}
+
+// limiter is a semaphore of containers. Deployments wait in the order they asked, so a test deploying many
+// containers isn't starved by tests deploying one. A nil limiter is valid and never waits.
+type limiter struct {
+	mu       sync.Mutex
+	capacity int
+	used     int
+	queue    []*limiterWaiter
+	held     map[string]int // holder -> containers taken
+	// The containers taken from other test binaries on this machine, or nil if they aren't shared
+	host *hostSlots
+	// Destroys an idle deployment to free up containers, returning false if there are none, see Pool
+	reclaim func() bool
+}
+
+type limiterWaiter struct {
+	holder string
+	n      int
+	ready  chan struct{}
+}
+
+func newLimiter(capacity int) *limiter {
+	return &limiter{
+		capacity: capacity,
+		held:     make(map[string]int),
+	}
+}
+
+// acquire waits until `n` containers can be run for `holder`, and returns how many were taken, which must be
+// given to release. Asking for more than the capacity takes all of it. If the holder already has containers,
+// they are taken straight away even if that goes over the capacity.
+func (l *limiter) acquire(ctx context.Context, holder string, n int, what string) (int, error) {
+	if l == nil || n <= 0 {
+		return 0, nil
+	}
+	l.mu.Lock()
+	if l.holds(holder) {
+		l.used += n
+		l.held[holder] += n
+		l.host.take(n, false)
+		log.Printf("%s: %s already has containers, so running %d more even if that is over the limit of %d", what, holder, n, l.capacity)
+		l.mu.Unlock()
+		return n, nil
+	}
+	if n > l.capacity {
+		n = l.capacity
+	}
+	w := &limiterWaiter{holder: holder, n: n, ready: make(chan struct{})}
+	l.queue = append(l.queue, w)
+	l.grant()
+	select {
+	case <-w.ready:
+		l.mu.Unlock()
+		return n, nil
+	default:
+	}
+	log.Printf("%s: waiting for %d of %d containers to be free, %d deployments ahead", what, n, l.capacity, len(l.queue)-1)
+	reclaim := l.reclaim
+	l.mu.Unlock()
+	defer timing.Track(timing.PhaseWaitForContainers)()
+
+	// destroy idle pooled deployments until there is room, as they would otherwise be kept forever
+	for reclaim != nil {
+		select {
+		case <-w.ready:
+			return n, nil
+		default:
+		}
+		if !reclaim() {
+			break
+		}
+	}
+	// other test binaries don't tell us when they free containers, so keep checking
+	var poll <-chan time.Time
+	if l.host != nil {
+		ticker := time.NewTicker(hostSlotsPollInterval)
+		defer ticker.Stop()
+		poll = ticker.C
+	}
+	for {
+		select {
+		case <-w.ready:
+			return n, nil
+		case <-poll:
+			l.mu.Lock()
+			l.grant()
+			l.mu.Unlock()
+		case <-ctx.Done():
+			l.mu.Lock()
+			defer l.mu.Unlock()
+			select {
+			case <-w.ready:
+				// granted while giving up, so hand it back
+				l.free(holder, n)
+			default:
+				for i, queued := range l.queue {
+					if queued == w {
+						l.queue = append(l.queue[:i], l.queue[i+1:]...)
+						break
+					}
+				}
+				// the waiters behind this one may fit now
+				l.grant()
+			}
+			return 0, ctx.Err()
+		}
+	}
+}
+
+// release frees `n` containers taken by acquire for `holder`.
+func (l *limiter) release(holder string, n int) {
+	if l == nil || n <= 0 {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.free(holder, n)
+}
+
+// transfer moves `n` containers taken for `from` to `to`, e.g when a pooled deployment is reused by
+// another test.
+func (l *limiter) transfer(from, to string, n int) {
+	if l == nil || n <= 0 || from == to {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.held[from] -= n
+	if l.held[from] <= 0 {
+		delete(l.held, from)
+	}
+	l.held[to] += n
+}
+
+// holds returns true if `holder`, or a test it is a subtest of, has containers. l.mu must be held.
+func (l *limiter) holds(holder string) bool {
+	for h, n := range l.held {
+		if n > 0 && (holder == h || strings.HasPrefix(holder, h+"/")) {
+			return true
+		}
+	}
+	return false
+}
+
+// free gives back `n` containers of `holder` and wakes the waiters which now fit. l.mu must be held.
+func (l *limiter) free(holder string, n int) {
+	l.used -= n
+	l.held[holder] -= n
+	if l.held[holder] <= 0 {
+		delete(l.held, holder)
+	}
+	l.host.releaseTo(l.used)
+	l.grant()
+}
+
+// grant wakes the waiters at the front of the queue which now fit. l.mu must be held.
+func (l *limiter) grant() {
+	for len(l.queue) > 0 && l.used+l.queue[0].n <= l.capacity {
+		w := l.queue[0]
+		if !l.host.take(w.n, true) {
+			// other test binaries are using them
+			return
+		}
+		l.queue = l.queue[1:]
+		l.used += w.n
+		l.held[w.holder] += w.n
+		close(w.ready)
+	}
+}
+
+func (l *limiter) setReclaim(fn func() bool) {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.reclaim = fn
+}
+
+// hostSlots shares the limit between test binaries on this machine. Each container holds a lock on one of
+// `capacity` files in `dir`, which the OS releases if the test binary dies. A nil hostSlots is valid and
+// always has room. It is guarded by the limiter's mu.
+type hostSlots struct {
+	dir      string
+	capacity int
+	files    []*os.File // the locked slot files, at most one per container this test binary runs
+}
+
+// take locks `n` free slot files, or none if `all` is set and there aren't enough. Returns true if `n`
+// were taken.
+func (h *hostSlots) take(n int, all bool) bool {
+	if h == nil {
+		return true
+	}
+	var taken []*os.File
+	for i := 0; i < h.capacity && len(taken) < n; i++ {
+		// slots this test binary holds are locked via other files, so fail to lock here too
+		if f := lockFile(filepath.Join(h.dir, fmt.Sprintf("slot-%d.lock", i))); f != nil {
+			taken = append(taken, f)
+		}
+	}
+	if all && len(taken) < n {
+		for _, f := range taken {
+			f.Close()
+		}
+		return false
+	}
+	h.files = append(h.files, taken...)
+	return len(taken) == n
+}
+
+// releaseTo unlocks slot files until at most `used` are locked.
+func (h *hostSlots) releaseTo(used int) {
+	if h == nil {
+		return
+	}
+	for len(h.files) > used && len(h.files) > 0 {
+		h.files[len(h.files)-1].Close()
+		h.files = h.files[:len(h.files)-1]
+	}
+}
@@ -0,0 +1,130 @@
+package docker
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+// acquireWithin calls acquire, giving up after `timeout`.
+func acquireWithin(l *limiter, holder string, n int, timeout time.Duration) (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	return l.acquire(ctx, holder, n, "test")
+}
+
+func TestLimiterWaitsForRelease(t *testing.T) {
+	l := newLimiter(3)
+	if taken, err := acquireWithin(l, "TestA", 2, time.Second); err != nil || taken != 2 {
+		t.Fatalf("acquire returned %d, %v, want 2", taken, err)
+	}
+	if _, err := acquireWithin(l, "TestB", 2, 50*time.Millisecond); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("acquire over the capacity returned %v, want it to wait", err)
+	}
+	// the waiter which gave up mustn't keep the containers
+	if taken, err := acquireWithin(l, "TestC", 1, time.Second); err != nil || taken != 1 {
+		t.Fatalf("acquire returned %d, %v, want 1", taken, err)
+	}
+	got := make(chan int)
+	go func() {
+		taken, _ := acquireWithin(l, "TestB", 5, 5*time.Second)
+		got <- taken
+	}()
+	time.Sleep(50 * time.Millisecond)
+	l.release("TestA", 2)
+	l.release("TestC", 1)
+	if taken := <-got; taken != 3 {
+		t.Fatalf("acquire for more than the capacity took %d, want all 3", taken)
+	}
+}
+
+func TestLimiterHolderDoesNotWaitForItself(t *testing.T) {
+	testCases := []struct {
+		holder string
+		waits  bool
+	}{
+		{holder: "TestA"},
+		{holder: "TestA/subtest"},
+		{holder: "TestAB", waits: true},
+		{holder: "TestB", waits: true},
+	}
+	for _, tc := range testCases {
+		l := newLimiter(2)
+		if _, err := acquireWithin(l, "TestA", 2, time.Second); err != nil {
+			t.Fatalf("%s: acquire returned %s", tc.holder, err)
+		}
+		taken, err := acquireWithin(l, tc.holder, 1, 50*time.Millisecond)
+		if waits := errors.Is(err, context.DeadlineExceeded); waits != tc.waits {
+			t.Errorf("%s: acquire returned %d, %v, want waits=%v", tc.holder, taken, err, tc.waits)
+		}
+		l.release(tc.holder, taken)
+		l.release("TestA", 2)
+		if l.used != 0 || len(l.held) != 0 {
+			t.Errorf("%s: %d containers still used by %v after releasing them all", tc.holder, l.used, l.held)
+		}
+	}
+}
+
+func TestLimiterTransfer(t *testing.T) {
+	l := newLimiter(1)
+	if _, err := acquireWithin(l, "TestA", 1, time.Second); err != nil {
+		t.Fatalf("acquire returned %s", err)
+	}
+	l.transfer("TestA", "TestB", 1)
+	if _, err := acquireWithin(l, "TestA", 1, 50*time.Millisecond); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("acquire by the old holder returned %v, want it to wait", err)
+	}
+	if _, err := acquireWithin(l, "TestB", 1, 50*time.Millisecond); err != nil {
+		t.Fatalf("acquire by the new holder returned %s, want it to not wait for itself", err)
+	}
+}
+
+func TestLimiterSharedBetweenTestBinaries(t *testing.T) {
+	// each limiter stands in for a test binary, as their slot files are locked separately
+	dir := t.TempDir()
+	first := newLimiter(2)
+	first.host = newHostSlots(dir, 2)
+	second := newLimiter(2)
+	second.host = newHostSlots(dir, 2)
+	if first.host == nil {
+		t.Skipf("the limit isn't shared between test binaries on this platform")
+	}
+	if _, err := acquireWithin(first, "TestA", 2, time.Second); err != nil {
+		t.Fatalf("acquire returned %s", err)
+	}
+	if _, err := acquireWithin(second, "TestB", 1, 2*hostSlotsPollInterval); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("acquire in another test binary returned %v, want it to wait", err)
+	}
+	got := make(chan error)
+	go func() {
+		_, err := acquireWithin(second, "TestB", 1, 10*hostSlotsPollInterval)
+		got <- err
+	}()
+	first.release("TestA", 1)
+	if err := <-got; err != nil {
+		t.Fatalf("acquire in another test binary returned %s after a container was released", err)
+	}
+	if _, err := acquireWithin(first, "TestC", 1, 2*hostSlotsPollInterval); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("acquire returned %v, want it to wait for the other test binary", err)
+	}
+}
+
+func TestContainersPerHomeserver(t *testing.T) {
+	testCases := []struct {
+		name        string
+		opts        *hsDeployOptions
+		hasPostgres bool
+		want        int
+	}{
+		{name: "no options", want: 1},
+		{name: "postgres", hasPostgres: true, want: 2},
+		{name: "workers", opts: &hsDeployOptions{workers: []Worker{{Name: "w1"}, {Name: "w2"}}}, want: 3},
+		{name: "sidecars", opts: &hsDeployOptions{reverseProxy: true, intercept: true}, hasPostgres: true, want: 4},
+	}
+	for _, tc := range testCases {
+		if got := containersPerHomeserver(tc.opts, tc.hasPostgres); got != tc.want {
+			t.Errorf("%s: got %d containers, want %d", tc.name, got, tc.want)
+		}
+	}
+}
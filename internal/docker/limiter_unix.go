@@ -0,0 +1,36 @@
+//go:build !windows
+// +build !windows
+
+package docker
+
+import (
+	"log"
+	"os"
+	"syscall"
+)
+
+// newHostSlots returns the slot files in `dir` for sharing `capacity` containers between test binaries, or
+// nil if `dir` can't be used.
+func newHostSlots(dir string, capacity int) *hostSlots {
+	if err := os.MkdirAll(dir, 0o777); err != nil {
+		log.Printf("COMPLEMENT_MAX_CONTAINERS: not sharing the limit with other test binaries: %s", err)
+		return nil
+	}
+	return &hostSlots{
+		dir:      dir,
+		capacity: capacity,
+	}
+}
+
+// lockFile returns `path` opened with an exclusive lock, or nil if another open file has the lock.
+func lockFile(path string) *os.File {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0o666)
+	if err != nil {
+		return nil
+	}
+	if err = syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		f.Close()
+		return nil
+	}
+	return f
+}
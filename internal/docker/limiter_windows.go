@@ -0,0 +1,12 @@
+package docker
+
+import "os"
+
+// newHostSlots returns nil, as the limit isn't shared between test binaries on Windows.
+func newHostSlots(dir string, capacity int) *hostSlots {
+	return nil
+}
+
+func lockFile(path string) *os.File {
+	return nil
+}
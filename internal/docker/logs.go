@@ -0,0 +1,78 @@
+package docker
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/pkg/stdcopy"
+
+	"github.com/matrix-org/complement/internal/watchdog"
+)
+
+// AwaitLogLine waits until the homeserver `hsName` logs a line matching `re`, and returns the line. Use this
+// to assert server-side behaviour which has no API, e.g that events were purged. All lines logged since the
+// container started are checked, so the pattern should be specific enough to not match lines logged before
+// the behaviour being tested, e.g by including a room ID. Fails the test if the hsName is not found or no
+// line matches within `timeout`.
+func (d *Deployment) AwaitLogLine(t *testing.T, hsName string, re *regexp.Regexp, timeout time.Duration) string {
+	t.Helper()
+	d.skipIfAttached(t, "AwaitLogLine")
+	dep, ok := d.HS[hsName]
+	if !ok {
+		t.Fatalf("Deployment.AwaitLogLine - HS name '%s' not found", hsName)
+		return ""
+	}
+	defer watchdog.Waiting(t, fmt.Sprintf("%s to log a line matching %s", hsName, re))()
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	line, err := awaitLogLine(ctx, d.Deployer, dep.ContainerID, re)
+	if err != nil {
+		t.Fatalf("Deployment.AwaitLogLine - %s did not log a line matching %s within %v: %s", hsName, re, timeout, err)
+	}
+	return line
+}
+
+func awaitLogLine(ctx context.Context, d *Deployer, containerID string, re *regexp.Regexp) (string, error) {
+	reader, err := d.Docker.ContainerLogs(ctx, containerID, types.ContainerLogsOptions{
+		ShowStderr: true,
+		ShowStdout: true,
+		Follow:     true,
+	})
+	if err != nil {
+		return "", err
+	}
+	defer reader.Close()
+	// demultiplex stdout and stderr into a single stream of lines
+	pr, pw := io.Pipe()
+	go func() {
+		_, err := stdcopy.StdCopy(pw, pw, reader)
+		pw.CloseWithError(err)
+	}()
+	defer pr.Close()
+	line, err := findLogLine(pr, re)
+	if err != nil && ctx.Err() != nil {
+		return "", ctx.Err()
+	}
+	return line, err
+}
+
+// findLogLine returns the first line read from `r` which matches `re`.
+func findLogLine(r io.Reader, re *regexp.Regexp) (string, error) {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		if re.MatchString(scanner.Text()) {
+			return scanner.Text(), nil
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return "", err
+	}
+	return "", fmt.Errorf("container logs ended")
+}
@@ -0,0 +1,47 @@
+package docker
+
+import (
+	"regexp"
+	"strings"
+	"testing"
+)
+
+func TestFindLogLine(t *testing.T) {
+	logs := "starting\nPurged room !abc:hs1\nPurged room !def:hs1\n" + strings.Repeat("x", 100*1024) + "\nlong line done"
+	testCases := []struct {
+		name     string
+		re       *regexp.Regexp
+		wantLine string
+		wantErr  bool
+	}{
+		{
+			name:     "first matching line",
+			re:       regexp.MustCompile(`Purged room`),
+			wantLine: "Purged room !abc:hs1",
+		},
+		{
+			name:     "specific line",
+			re:       regexp.MustCompile(`Purged room !def:hs1`),
+			wantLine: "Purged room !def:hs1",
+		},
+		{
+			name:     "after a line longer than the initial buffer",
+			re:       regexp.MustCompile(`done$`),
+			wantLine: "long line done",
+		},
+		{
+			name:    "no match",
+			re:      regexp.MustCompile(`Purged room !ghi:hs1`),
+			wantErr: true,
+		},
+	}
+	for _, tc := range testCases {
+		line, err := findLogLine(strings.NewReader(logs), tc.re)
+		if (err != nil) != tc.wantErr {
+			t.Errorf("%s: got error %v, want error: %v", tc.name, err, tc.wantErr)
+		}
+		if line != tc.wantLine {
+			t.Errorf("%s: got line %q want %q", tc.name, line, tc.wantLine)
+		}
+	}
+}
@@ -0,0 +1,212 @@
+package docker
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// The port homeserver images should serve Prometheus metrics on, at /metrics. It is published on localhost
+// like the CSAPI and federation ports, and can be found with GetPort as "metrics".
+const MetricsPort = 9090
+
+// Metrics are the samples scraped from a homeserver's metrics endpoint.
+type Metrics []MetricSample
+
+// MetricSample is a single sample of a metric, e.g a counter or gauge, or one bucket of a histogram.
+type MetricSample struct {
+	Name   string
+	Labels map[string]string
+	Value  float64
+}
+
+// Sum returns the sum of the samples named `name` which have all of `labels`, e.g the total of a counter
+// across the label values not given. Returns 0 if there are no such samples.
+func (m Metrics) Sum(name string, labels map[string]string) float64 {
+	var sum float64
+	for _, s := range m {
+		if s.Name != name || !hasLabels(s.Labels, labels) {
+			continue
+		}
+		sum += s.Value
+	}
+	return sum
+}
+
+// Has returns true if there are any samples named `name` which have all of `labels`.
+func (m Metrics) Has(name string, labels map[string]string) bool {
+	for _, s := range m {
+		if s.Name == name && hasLabels(s.Labels, labels) {
+			return true
+		}
+	}
+	return false
+}
+
+func hasLabels(have, want map[string]string) bool {
+	for k, v := range want {
+		if have[k] != v {
+			return false
+		}
+	}
+	return true
+}
+
+// MetricCheck checks scraped metrics, returning an error if they are not as expected.
+type MetricCheck func(m Metrics) error
+
+// MetricEquals checks that the sum of the samples named `name` with `labels` is `value`.
+func MetricEquals(name string, labels map[string]string, value float64) MetricCheck {
+	return func(m Metrics) error {
+		if !m.Has(name, labels) {
+			return fmt.Errorf("MetricEquals: no samples of %s%v", name, labels)
+		}
+		if got := m.Sum(name, labels); got != value {
+			return fmt.Errorf("MetricEquals: %s%v is %v, want %v", name, labels, got, value)
+		}
+		return nil
+	}
+}
+
+// MetricAtLeast checks that the sum of the samples named `name` with `labels` is at least `value`.
+func MetricAtLeast(name string, labels map[string]string, value float64) MetricCheck {
+	return func(m Metrics) error {
+		if !m.Has(name, labels) {
+			return fmt.Errorf("MetricAtLeast: no samples of %s%v", name, labels)
+		}
+		if got := m.Sum(name, labels); got < value {
+			return fmt.Errorf("MetricAtLeast: %s%v is %v, want at least %v", name, labels, got, value)
+		}
+		return nil
+	}
+}
+
+// MetricIncreasedBy checks that the sum of the samples named `name` with `labels` has increased by `delta`
+// since the metrics `before` were scraped, e.g to check how many times a counter was incremented by an action.
+func MetricIncreasedBy(before Metrics, name string, labels map[string]string, delta float64) MetricCheck {
+	return func(m Metrics) error {
+		if got := m.Sum(name, labels) - before.Sum(name, labels); got != delta {
+			return fmt.Errorf("MetricIncreasedBy: %s%v increased by %v, want %v", name, labels, got, delta)
+		}
+		return nil
+	}
+}
+
+// ScrapeMetrics fetches the Prometheus metrics of the homeserver `hsName` and checks them with `checks`, so
+// tests can assert on internal behaviour, e.g the number of state resolutions performed. The homeserver image
+// must serve metrics on MetricsPort. Fails the test if the hsName is not found, the metrics can't be
+// scraped or a check fails.
+func (d *Deployment) ScrapeMetrics(t *testing.T, hsName string, checks ...MetricCheck) Metrics {
+	t.Helper()
+	d.skipIfAttached(t, "ScrapeMetrics")
+	dep, ok := d.HS[hsName]
+	if !ok {
+		t.Fatalf("Deployment.ScrapeMetrics - HS name '%s' not found", hsName)
+		return nil
+	}
+	port, err := hostPort(context.Background(), d.Deployer.Docker, dep.ContainerID, MetricsPort)
+	if err != nil {
+		t.Fatalf("Deployment.ScrapeMetrics - failed to find metrics port of %s: %s", hsName, err)
+	}
+	res, err := http.Get(fmt.Sprintf("http://%s:%d/metrics", HostnameRunningDocker, port))
+	if err != nil {
+		t.Fatalf("Deployment.ScrapeMetrics - failed to scrape %s: %s", hsName, err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != 200 {
+		t.Fatalf("Deployment.ScrapeMetrics - scraping %s returned HTTP %d", hsName, res.StatusCode)
+	}
+	metrics, err := parseMetrics(res.Body)
+	if err != nil {
+		t.Fatalf("Deployment.ScrapeMetrics - failed to parse metrics of %s: %s", hsName, err)
+	}
+	for _, check := range checks {
+		if err := check(metrics); err != nil {
+			t.Fatalf("Deployment.ScrapeMetrics - %s: %s", hsName, err)
+		}
+	}
+	return metrics
+}
+
+// parseMetrics parses the Prometheus text exposition format.
+func parseMetrics(r io.Reader) (Metrics, error) {
+	var metrics Metrics
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, 1024*1024)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		sample, err := parseMetricSample(line)
+		if err != nil {
+			return nil, err
+		}
+		metrics = append(metrics, sample)
+	}
+	return metrics, scanner.Err()
+}
+
+// parseMetricSample parses a line like `name{label="value",...} 1.5 [timestamp]`.
+func parseMetricSample(line string) (MetricSample, error) {
+	sample := MetricSample{
+		Labels: make(map[string]string),
+	}
+	i := strings.IndexAny(line, "{ ")
+	if i < 0 {
+		return sample, fmt.Errorf("malformed sample '%s'", line)
+	}
+	sample.Name = line[:i]
+	rest := line[i:]
+	if strings.HasPrefix(rest, "{") {
+		rest = rest[1:]
+		for {
+			rest = strings.TrimLeft(rest, " ,")
+			if strings.HasPrefix(rest, "}") {
+				rest = rest[1:]
+				break
+			}
+			eq := strings.Index(rest, "=\"")
+			if eq < 0 {
+				return sample, fmt.Errorf("malformed labels in sample '%s'", line)
+			}
+			name := rest[:eq]
+			rest = rest[eq+2:]
+			var value strings.Builder
+			for {
+				if rest == "" {
+					return sample, fmt.Errorf("unterminated label value in sample '%s'", line)
+				}
+				c := rest[0]
+				rest = rest[1:]
+				if c == '"' {
+					break
+				}
+				if c == '\\' && rest != "" {
+					c = rest[0]
+					rest = rest[1:]
+					if c == 'n' {
+						c = '\n'
+					}
+				}
+				value.WriteByte(c)
+			}
+			sample.Labels[name] = value.String()
+		}
+	}
+	fields := strings.Fields(rest)
+	if len(fields) == 0 {
+		return sample, fmt.Errorf("sample '%s' has no value", line)
+	}
+	value, err := strconv.ParseFloat(fields[0], 64)
+	if err != nil {
+		return sample, fmt.Errorf("sample '%s' has malformed value: %w", line, err)
+	}
+	sample.Value = value
+	return sample, nil
+}
@@ -0,0 +1,95 @@
+package docker
+
+import (
+	"math"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseMetricSample(t *testing.T) {
+	testCases := []struct {
+		line    string
+		want    MetricSample
+		wantErr bool
+	}{
+		{
+			line: `synapse_http_requests_total 12`,
+			want: MetricSample{Name: "synapse_http_requests_total", Labels: map[string]string{}, Value: 12},
+		},
+		{
+			line: `synapse_http_requests_total{method="GET",servlet="SyncRestServlet"} 3 1395066363000`,
+			want: MetricSample{
+				Name:   "synapse_http_requests_total",
+				Labels: map[string]string{"method": "GET", "servlet": "SyncRestServlet"},
+				Value:  3,
+			},
+		},
+		{
+			line: `msg{text="a \"quoted\", line\nbreak",} 1.5e3`,
+			want: MetricSample{Name: "msg", Labels: map[string]string{"text": "a \"quoted\", line\nbreak"}, Value: 1500},
+		},
+		{
+			line: `latency_bucket{le="+Inf"} +Inf`,
+			want: MetricSample{Name: "latency_bucket", Labels: map[string]string{"le": "+Inf"}, Value: math.Inf(1)},
+		},
+		{line: `no_value`, wantErr: true},
+		{line: `no_value{a="b"}`, wantErr: true},
+		{line: `bad_value 1.2.3`, wantErr: true},
+		{line: `bad_labels{a} 1`, wantErr: true},
+		{line: `unterminated{a="b} 1`, wantErr: true},
+	}
+	for _, tc := range testCases {
+		got, err := parseMetricSample(tc.line)
+		if tc.wantErr {
+			if err == nil {
+				t.Errorf("parseMetricSample(%s): got %+v, want an error", tc.line, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("parseMetricSample(%s): %s", tc.line, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("parseMetricSample(%s): got %+v want %+v", tc.line, got, tc.want)
+		}
+	}
+}
+
+func TestMetricChecks(t *testing.T) {
+	metrics, err := parseMetrics(strings.NewReader(`
+# HELP requests_total The number of requests.
+# TYPE requests_total counter
+requests_total{method="GET",code="200"} 5
+requests_total{method="GET",code="404"} 1
+requests_total{method="PUT",code="200"} 2
+`))
+	if err != nil {
+		t.Fatalf("parseMetrics: %s", err)
+	}
+	before := Metrics{
+		{Name: "requests_total", Labels: map[string]string{"method": "GET"}, Value: 4},
+	}
+	testCases := []struct {
+		name    string
+		check   MetricCheck
+		wantErr bool
+	}{
+		{name: "equals sums over other labels", check: MetricEquals("requests_total", map[string]string{"method": "GET"}, 6)},
+		{name: "equals all", check: MetricEquals("requests_total", nil, 8)},
+		{name: "equals wrong value", check: MetricEquals("requests_total", nil, 7), wantErr: true},
+		{name: "equals missing", check: MetricEquals("requests_total", map[string]string{"method": "POST"}, 0), wantErr: true},
+		{name: "at least", check: MetricAtLeast("requests_total", map[string]string{"code": "200"}, 7)},
+		{name: "at least too few", check: MetricAtLeast("requests_total", map[string]string{"code": "200"}, 8), wantErr: true},
+		{name: "at least missing", check: MetricAtLeast("missing_total", nil, 0), wantErr: true},
+		{name: "increased by", check: MetricIncreasedBy(before, "requests_total", map[string]string{"method": "GET"}, 2)},
+		{name: "increased by wrong delta", check: MetricIncreasedBy(before, "requests_total", map[string]string{"method": "GET"}, 1), wantErr: true},
+		{name: "increased by from nothing", check: MetricIncreasedBy(before, "requests_total", map[string]string{"method": "PUT"}, 2)},
+	}
+	for _, tc := range testCases {
+		if err := tc.check(metrics); (err != nil) != tc.wantErr {
+			t.Errorf("%s: got error %v, want error: %v", tc.name, err, tc.wantErr)
+		}
+	}
+}
@@ -0,0 +1,61 @@
+package docker
+
+import (
+	"io/ioutil"
+	"log"
+	"os"
+	"testing"
+)
+
+// WithTempMount mounts a new, empty directory at `containerPath` in the container of the homeserver `hsName`,
+// e.g its media store, so the test can assert on the files the homeserver writes or add fixtures with
+// TempMount. The directory is removed when the deployment is destroyed.
+func WithTempMount(hsName, containerPath string) DeployOption {
+	return func(opts *deployOptions) {
+		hsOpts := opts.homeserver(hsName)
+		hsOpts.tempMounts = append(hsOpts.tempMounts, containerPath)
+	}
+}
+
+// TempMount returns the directory on the host which is mounted at `containerPath` in the container of the
+// homeserver `hsName` by WithTempMount. Files written by the homeserver may be owned by the container's
+// user. Fails the test if the hsName is not found or nothing is mounted at `containerPath`.
+func (d *Deployment) TempMount(t *testing.T, hsName, containerPath string) string {
+	t.Helper()
+	d.skipIfAttached(t, "TempMount")
+	dep, ok := d.HS[hsName]
+	if !ok {
+		t.Fatalf("Deployment.TempMount - HS name '%s' not found", hsName)
+		return ""
+	}
+	hostPath, ok := dep.tempMounts[containerPath]
+	if !ok {
+		t.Fatalf("Deployment.TempMount - nothing is mounted at %s in %s, deploy with docker.WithTempMount", containerPath, hsName)
+		return ""
+	}
+	return hostPath
+}
+
+// newTempMountDir creates a directory to mount into a container, which any container user can write to.
+func newTempMountDir() (string, error) {
+	dir, err := ioutil.TempDir("", "complement-mount-")
+	if err != nil {
+		return "", err
+	}
+	// the homeserver may not run as the user running Complement
+	if err = os.Chmod(dir, 0777); err != nil {
+		os.RemoveAll(dir)
+		return "", err
+	}
+	return dir, nil
+}
+
+// removeTempMounts removes the directories made by newTempMountDir. Failures are logged, as files written by
+// the homeserver may be owned by another user.
+func removeTempMounts(tempMounts map[string]string) {
+	for _, hostPath := range tempMounts {
+		if err := os.RemoveAll(hostPath); err != nil {
+			log.Printf("Failed to remove temporary mount %s: %s", hostPath, err)
+		}
+	}
+}
@@ -0,0 +1,57 @@
+package docker
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/docker/docker/client"
+)
+
+// NetworkConditions describes how traffic sent by a homeserver is degraded, using `tc netem`.
+type NetworkConditions struct {
+	// How long to delay each packet by
+	Delay time.Duration
+	// The random variation added to Delay, up to this amount either way
+	Jitter time.Duration
+	// The percentage of packets to drop, from 0 to 100
+	Loss float64
+}
+
+// WithNetworkConditions degrades the network of the homeserver `hsName` once it has started, by adding
+// `tc netem` rules to its interface. This affects all traffic the homeserver sends, including responses
+// to clients. The homeserver image must include `tc` e.g from the iproute2 package, and the container is
+// given the NET_ADMIN capability so it can be run.
+func WithNetworkConditions(hsName string, nc NetworkConditions) DeployOption {
+	return func(opts *deployOptions) {
+		opts.homeserver(hsName).networkConditions = &nc
+	}
+}
+
+// tcArgs returns the `tc` command which applies the network conditions to the interface `dev`.
+func (nc NetworkConditions) tcArgs(dev string) []string {
+	args := []string{"tc", "qdisc", "replace", "dev", dev, "root", "netem"}
+	if nc.Delay > 0 || nc.Jitter > 0 {
+		args = append(args, "delay", fmt.Sprintf("%dus", nc.Delay.Microseconds()))
+		if nc.Jitter > 0 {
+			args = append(args, fmt.Sprintf("%dus", nc.Jitter.Microseconds()))
+		}
+	}
+	if nc.Loss > 0 {
+		args = append(args, "loss", strconv.FormatFloat(nc.Loss, 'f', -1, 64)+"%")
+	}
+	return args
+}
+
+// applyNetworkConditions adds the `tc netem` rules for `nc` to the container's network interface.
+func applyNetworkConditions(docker *client.Client, containerID string, nc NetworkConditions) error {
+	res, err := execInContainer(context.Background(), docker, containerID, nc.tcArgs("eth0"))
+	if err != nil {
+		return fmt.Errorf("failed to apply network conditions: %w", err)
+	}
+	if res.ExitCode != 0 {
+		return fmt.Errorf("failed to apply network conditions: tc exited with code %d: %s", res.ExitCode, res.Stderr)
+	}
+	return nil
+}
@@ -0,0 +1,62 @@
+package docker
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestNetworkConditionsTCArgs(t *testing.T) {
+	prefix := []string{"tc", "qdisc", "replace", "dev", "eth0", "root", "netem"}
+	testCases := []struct {
+		name string
+		nc   NetworkConditions
+		want []string
+	}{
+		{
+			name: "nothing",
+			want: prefix,
+		},
+		{
+			name: "delay",
+			nc:   NetworkConditions{Delay: 100 * time.Millisecond},
+			want: append(prefix, "delay", "100000us"),
+		},
+		{
+			name: "delay and jitter",
+			nc:   NetworkConditions{Delay: 100 * time.Millisecond, Jitter: 1500 * time.Microsecond},
+			want: append(prefix, "delay", "100000us", "1500us"),
+		},
+		{
+			name: "jitter only",
+			nc:   NetworkConditions{Jitter: time.Millisecond},
+			want: append(prefix, "delay", "0us", "1000us"),
+		},
+		{
+			name: "loss",
+			nc:   NetworkConditions{Loss: 2.5},
+			want: append(prefix, "loss", "2.5%"),
+		},
+		{
+			name: "everything",
+			nc:   NetworkConditions{Delay: time.Second, Jitter: time.Millisecond, Loss: 10},
+			want: append(prefix, "delay", "1000000us", "1000us", "loss", "10%"),
+		},
+	}
+	for _, tc := range testCases {
+		if got := tc.nc.tcArgs("eth0"); !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%s: got %v want %v", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestWithNetworkConditions(t *testing.T) {
+	nc := NetworkConditions{Delay: time.Second}
+	opts := newDeployOptions([]DeployOption{WithNetworkConditions("hs1", nc)})
+	if got := opts.homeservers["hs1"].networkConditions; got == nil || *got != nc {
+		t.Errorf("hs1 has network conditions %v, want %v", got, nc)
+	}
+	if got := opts.homeservers["hs2"]; got != nil {
+		t.Errorf("hs2 has options %+v, want none", got)
+	}
+}
@@ -0,0 +1,105 @@
+package docker
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Only one failed test pauses at a time, so parallel tests don't fight over the terminal.
+var pauseMu sync.Mutex
+
+// pauseOnFailure prints how to reach the homeservers of the deployment, with the access tokens of its users and
+// the rooms they are in, then waits for enter to be pressed, if `t` failed and COMPLEMENT_DEBUG_PAUSE_ON_FAILURE
+// is set. This leaves the homeservers running so the developer can poke at them, e.g with curl or Element.
+// Without a terminal, e.g in CI, the description is logged and the test carries on without pausing.
+func (d *Deployment) pauseOnFailure(t *testing.T) {
+	t.Helper()
+	if !d.Config.DebugPauseOnFailure || !t.Failed() {
+		return
+	}
+	pauseMu.Lock()
+	defer pauseMu.Unlock()
+	// `go test` doesn't connect stdin to the test binary, so only the terminal can be waited on
+	tty, err := os.OpenFile("/dev/tty", os.O_RDWR, 0)
+	if err != nil {
+		t.Logf("COMPLEMENT_DEBUG_PAUSE_ON_FAILURE: not pausing as there is no terminal to wait on: %s", err)
+		t.Log(d.debugSummary(t))
+		return
+	}
+	defer tty.Close()
+	fmt.Fprint(tty, d.debugSummary(t))
+	fmt.Fprintf(tty, "Press enter to destroy the deployment and carry on with the tests...")
+	_, _ = bufio.NewReader(tty).ReadString('\n')
+}
+
+// debugSummary describes the homeservers of the deployment for pauseOnFailure.
+func (d *Deployment) debugSummary(t *testing.T) string {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "\n==== %s failed, pausing with blueprint %s still running (COMPLEMENT_DEBUG_PAUSE_ON_FAILURE) ====\n", t.Name(), d.BlueprintName)
+	cli := &http.Client{
+		Timeout: 30 * time.Second,
+	}
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	for _, hsName := range sortedKeys(d.HS) {
+		hsDep := d.HS[hsName]
+		fmt.Fprintf(&sb, "%s:\n  client API:     %s\n  federation API: %s\n", hsName, hsDep.BaseURL, hsDep.FedBaseURL)
+		containerIDs := hsDep.containers(hsName)
+		if len(containerIDs) > 0 {
+			sb.WriteString("  containers:\n")
+		}
+		for _, name := range sortedKeys(containerIDs) {
+			sb.WriteString(d.describeContainer(name, containerIDs[name]))
+		}
+		// users registered during the test are only known by the clients made for them, e.g guests
+		tokens := make(map[string]string)
+		for userID, token := range hsDep.AccessTokens {
+			tokens[userID] = token
+		}
+		for _, cli := range d.clients[hsName] {
+			if cli.UserID != "" && cli.AccessToken != "" {
+				tokens[cli.UserID] = cli.AccessToken
+			}
+		}
+		if len(tokens) > 0 {
+			sb.WriteString("  users:\n")
+		}
+		for _, userID := range sortedKeys(tokens) {
+			fmt.Fprintf(&sb, "    %s access_token=%s\n", userID, tokens[userID])
+			rooms, err := userRoomMemberships(cli, hsDep.BaseURL, tokens[userID])
+			if err != nil {
+				fmt.Fprintf(&sb, "      failed to list rooms: %s\n", err)
+			}
+			for _, roomID := range sortedKeys(rooms) {
+				fmt.Fprintf(&sb, "      %s %s\n", rooms[roomID], roomID)
+			}
+		}
+	}
+	return sb.String()
+}
+
+// describeContainer returns the name of the container and the host ports its ports are published on.
+func (d *Deployment) describeContainer(name, containerID string) string {
+	inspect, err := d.Deployer.Docker.ContainerInspect(context.Background(), containerID)
+	if err != nil {
+		return fmt.Sprintf("    %s %s: failed to inspect: %s\n", name, containerID, err)
+	}
+	var ports []string
+	if inspect.NetworkSettings != nil {
+		for port, bindings := range inspect.NetworkSettings.Ports {
+			for _, binding := range bindings {
+				ports = append(ports, fmt.Sprintf("%s:%s->%s", binding.HostIP, binding.HostPort, port))
+			}
+		}
+	}
+	sort.Strings(ports)
+	return fmt.Sprintf("    %s %s (%s) %s\n", name, strings.TrimPrefix(inspect.Name, "/"), containerID, strings.Join(ports, " "))
+}
@@ -0,0 +1,50 @@
+package docker
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/matrix-org/complement/internal/client"
+)
+
+func TestDebugSummaryListsRoomsOfEveryUser(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		switch req.Header.Get("Authorization") {
+		case "Bearer alice_token":
+			w.Write([]byte(`{"rooms":{"join":{"!alice:hs1":{}}}}`)) // nolint:errcheck
+		case "Bearer guest_token":
+			w.Write([]byte(`{"rooms":{"invite":{"!guest:hs1":{}}}}`)) // nolint:errcheck
+		default:
+			w.WriteHeader(401)
+		}
+	}))
+	defer srv.Close()
+	d := &Deployment{
+		BlueprintName: "test",
+		HS: map[string]HomeserverDeployment{
+			"hs1": {
+				BaseURL: srv.URL,
+				AccessTokens: map[string]string{
+					"@alice:hs1": "alice_token",
+					"@bob:hs1":   "expired_token",
+				},
+			},
+		},
+		clients: map[string][]*client.CSAPI{
+			// registered during the test, so only known by its client
+			"hs1": {{UserID: "@guest:hs1", AccessToken: "guest_token"}},
+		},
+	}
+	summary := d.debugSummary(t)
+	for _, want := range []string{
+		"@alice:hs1 access_token=alice_token\n      join !alice:hs1\n",
+		"@bob:hs1 access_token=expired_token\n      failed to list rooms: ",
+		"@guest:hs1 access_token=guest_token\n      invite !guest:hs1\n",
+	} {
+		if !strings.Contains(summary, want) {
+			t.Errorf("summary doesn't contain %q:\n%s", want, summary)
+		}
+	}
+}
@@ -0,0 +1,101 @@
+package docker
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/docker/docker/client"
+	specs "github.com/opencontainers/image-spec/specs-go/v1"
+
+	"github.com/matrix-org/complement/internal/b"
+	"github.com/matrix-org/complement/internal/config"
+)
+
+// ErrImagePlatform is returned when a homeserver image can't run natively on the machine running Complement,
+// e.g an amd64-only image on Apple Silicon. Test suites skip tests which need such images.
+var ErrImagePlatform = errors.New("image is not built for this platform")
+
+// hostPlatform returns the platform containers run as natively, as reported by the daemon, which may differ
+// from the machine running Complement, e.g Docker Desktop runs containers in a Linux VM and DOCKER_HOST can
+// point at another machine.
+func hostPlatform(docker *client.Client) (string, error) {
+	info, err := docker.Info(context.Background())
+	if err != nil {
+		return "", fmt.Errorf("failed to get daemon info: %w", err)
+	}
+	return info.OSType + "/" + goArch(info.Architecture), nil
+}
+
+// goArch returns the Go name of the architecture `arch`, as reported by uname, which the daemon uses, e.g
+// x86_64 is amd64. Architectures which are already named as in Go are returned as is.
+func goArch(arch string) string {
+	switch arch {
+	case "x86_64":
+		return "amd64"
+	case "aarch64":
+		return "arm64"
+	case "i386", "i686":
+		return "386"
+	case "armv6l", "armv7l":
+		return "arm"
+	default:
+		return arch
+	}
+}
+
+// containerPlatform returns the platform to create containers as, from COMPLEMENT_PLATFORM, so they run
+// the same variant of multi-platform images as was pulled. Returns nil to use the daemon's platform.
+func containerPlatform(cfg *config.Complement) *specs.Platform {
+	if cfg.Platform == "" {
+		return nil
+	}
+	parts := strings.SplitN(cfg.Platform, "/", 3)
+	platform := &specs.Platform{OS: parts[0]}
+	if len(parts) > 1 {
+		platform.Architecture = parts[1]
+	}
+	if len(parts) > 2 {
+		platform.Variant = parts[2]
+	}
+	return platform
+}
+
+// checkImagePlatforms checks that the images of the homeservers in the blueprint can run natively, pulling
+// them if needed. Returns an error wrapping ErrImagePlatform if one can't, unless COMPLEMENT_PLATFORM is set,
+// in which case the images are run under emulation if needed.
+func checkImagePlatforms(docker *client.Client, cfg *config.Complement, bprint b.Blueprint) error {
+	if cfg.Platform != "" {
+		return nil
+	}
+	host, err := hostPlatform(docker)
+	if err != nil {
+		return err
+	}
+	for _, hs := range bprint.Homeservers {
+		if hs.Compose != nil {
+			continue
+		}
+		uri, err := cfg.ImageURI(hs.Image)
+		if err != nil {
+			return err
+		}
+		if hs.Image != "" {
+			if err = pullImageIfNotExists(docker, uri, cfg.Platform); err != nil {
+				return err
+			}
+		}
+		img, _, err := docker.ImageInspectWithRaw(context.Background(), uri)
+		if err != nil {
+			return fmt.Errorf("failed to inspect image %s: %w", uri, err)
+		}
+		if platform := img.Os + "/" + img.Architecture; platform != host {
+			return fmt.Errorf(
+				"%w: %s is %s but this machine is %s, set COMPLEMENT_PLATFORM=%s to run it under emulation",
+				ErrImagePlatform, uri, platform, host, platform,
+			)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,69 @@
+package docker
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/client"
+	specs "github.com/opencontainers/image-spec/specs-go/v1"
+
+	"github.com/matrix-org/complement/internal/config"
+)
+
+func TestContainerPlatform(t *testing.T) {
+	testCases := []struct {
+		platform string
+		want     *specs.Platform
+	}{
+		{platform: "", want: nil},
+		{platform: "linux", want: &specs.Platform{OS: "linux"}},
+		{platform: "linux/amd64", want: &specs.Platform{OS: "linux", Architecture: "amd64"}},
+		{platform: "linux/arm/v7", want: &specs.Platform{OS: "linux", Architecture: "arm", Variant: "v7"}},
+	}
+	for _, tc := range testCases {
+		got := containerPlatform(&config.Complement{Platform: tc.platform})
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("containerPlatform(%q): got %+v want %+v", tc.platform, got, tc.want)
+		}
+	}
+}
+
+func TestHostPlatform(t *testing.T) {
+	testCases := []struct {
+		arch string
+		want string
+	}{
+		{arch: "x86_64", want: "linux/amd64"},
+		{arch: "aarch64", want: "linux/arm64"},
+		{arch: "armv7l", want: "linux/arm"},
+		{arch: "i686", want: "linux/386"},
+		{arch: "s390x", want: "linux/s390x"},
+	}
+	for _, tc := range testCases {
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			if !strings.HasSuffix(req.URL.Path, "/info") {
+				http.NotFound(w, req)
+				return
+			}
+			json.NewEncoder(w).Encode(types.Info{OSType: "linux", Architecture: tc.arch}) // nolint:errcheck
+		}))
+		docker, err := client.NewClientWithOpts(client.WithHost("tcp://"+srv.Listener.Addr().String()), client.WithVersion("1.41"))
+		if err != nil {
+			t.Fatalf("failed to make docker client: %s", err)
+		}
+		got, err := hostPlatform(docker)
+		srv.Close()
+		if err != nil {
+			t.Errorf("%s: hostPlatform: %s", tc.arch, err)
+			continue
+		}
+		if got != tc.want {
+			t.Errorf("%s: got %s want %s", tc.arch, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,510 @@
+package docker
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/complement/internal/config"
+)
+
+// Pool keeps deployments running after tests finish with them, so later tests using the same blueprint
+// can reuse them instead of waiting for new containers to start. Enabled with COMPLEMENT_POOL_DEPLOYMENTS=1.
+//
+// Reusing a deployment means a test sees whatever the previous test left behind on the homeserver. To
+// keep this safe:
+//   - when a deployment is returned to the pool, every user with an access token leaves and forgets all
+//     rooms and rejects all invites which weren't made by the blueprint,
+//   - their profiles, account data and push rules are put back to how the blueprint left them,
+//   - users registered via Deployment.RegisterUser on a reused deployment have a suffix added to their
+//     localpart, as do the aliases of Deployment.RoomAliasName, so tests don't collide on them,
+//   - deployments used by a failing test, where a user left a room made by the blueprint, set account data
+//     of a new type, deleted a push rule, or whose clean up fails, are destroyed rather than reused,
+//   - deployments made with any DeployOption (e.g an application service, or WithIsolation) are never
+//     pooled.
+//
+// Messages and state sent in rooms made by the blueprint are not cleaned up. Tests which depend on
+// these rooms being untouched, or on server-wide state e.g room aliases or the room directory being
+// empty, should deploy WithIsolation.
+//
+// With COMPLEMENT_ENABLE_DIRTY_RUNS=1, the pool goes further: every test using a blueprint shares a single
+// deployment of it, concurrently, and it is only destroyed when the pool is closed. Nothing is cleaned up
+// between tests, so tests should use Deployment.Register to get users of their own.
+type Pool struct {
+	config  *config.Complement
+	mu      sync.Mutex
+	counter int
+	idle    map[string][]*Deployment     // blueprint name -> deployments not in use
+	shared  map[string]*sharedDeployment // blueprint name -> deployment used by all tests, for dirty runs
+}
+
+// The holder of the containers of idle deployments, see WithContainerHolder
+const idleHolder = "idle pooled deployments"
+
+type sharedDeployment struct {
+	once sync.Once
+	dep  *Deployment
+	err  error
+}
+
+// NewPool creates an empty pool.
+func NewPool(cfg *config.Complement) *Pool {
+	p := &Pool{
+		config: cfg,
+		idle:   make(map[string][]*Deployment),
+		shared: make(map[string]*sharedDeployment),
+	}
+	containerLimiter(cfg).setReclaim(p.destroyIdle)
+	return p
+}
+
+// Deploy returns an idle deployment of the blueprint if there is one, else deploys a new one. The
+// deployment is returned to the pool when Deployment.Destroy is called. If any `opts` are given, a new
+// deployment is always made and it is destroyed as normal.
+func (p *Pool) Deploy(ctx context.Context, blueprintName string, opts ...DeployOption) (*Deployment, error) {
+	if p.config.EnableDirtyRuns && len(opts) == 0 {
+		return p.sharedDeployment(ctx, blueprintName)
+	}
+	p.mu.Lock()
+	if idle := p.idle[blueprintName]; len(idle) > 0 && len(opts) == 0 {
+		dep := idle[len(idle)-1]
+		p.idle[blueprintName] = idle[:len(idle)-1]
+		p.mu.Unlock()
+		dep.mu.Lock()
+		dep.uses++
+		dep.mu.Unlock()
+		holder := limiterHolder(ctx, idleHolder)
+		containerLimiter(p.config).transfer(dep.limitHolder, holder, dep.limited)
+		dep.limitHolder = holder
+		return dep, nil
+	}
+	p.mu.Unlock()
+	dep, err := p.newDeployment(ctx, blueprintName, opts...)
+	if err != nil || len(opts) > 0 {
+		return dep, err
+	}
+	// remember the rooms the blueprint made, so they are kept when the deployment is cleaned up
+	dep.poolBaseline, err = dep.roomMemberships()
+	if err != nil {
+		dep.Deployer.Destroy(dep, true)
+		return nil, fmt.Errorf("Pool.Deploy: failed to list rooms in new deployment: %w", err)
+	}
+	dep.poolUserStates, err = dep.userStates()
+	if err != nil {
+		dep.Deployer.Destroy(dep, true)
+		return nil, fmt.Errorf("Pool.Deploy: failed to get users of new deployment: %w", err)
+	}
+	dep.pool = p
+	return dep, nil
+}
+
+// sharedDeployment returns the deployment of the blueprint which all tests share, deploying it if this is
+// the first time it is needed.
+func (p *Pool) sharedDeployment(ctx context.Context, blueprintName string) (*Deployment, error) {
+	p.mu.Lock()
+	shared := p.shared[blueprintName]
+	if shared == nil {
+		shared = &sharedDeployment{}
+		p.shared[blueprintName] = shared
+	}
+	p.mu.Unlock()
+	shared.once.Do(func() {
+		shared.dep, shared.err = p.newDeployment(ctx, blueprintName)
+		if shared.dep != nil {
+			shared.dep.pool = p
+			shared.dep.dirty = true
+		}
+	})
+	return shared.dep, shared.err
+}
+
+func (p *Pool) newDeployment(ctx context.Context, blueprintName string, opts ...DeployOption) (*Deployment, error) {
+	p.mu.Lock()
+	p.counter++
+	namespace := fmt.Sprintf("pool%d", p.counter)
+	p.mu.Unlock()
+	// each deployment needs its own Deployer as they are not safe to use concurrently
+	deployer, err := NewDeployer(namespace, p.config)
+	if err != nil {
+		return nil, fmt.Errorf("Pool.Deploy: %w", err)
+	}
+	return deployer.Deploy(ctx, blueprintName, opts...)
+}
+
+// Close destroys all idle and shared deployments.
+func (p *Pool) Close() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, deps := range p.idle {
+		for _, dep := range deps {
+			dep.Deployer.Destroy(dep, false)
+		}
+	}
+	for _, shared := range p.shared {
+		if shared.dep != nil {
+			shared.dep.Deployer.Destroy(shared.dep, false)
+		}
+	}
+	p.idle = make(map[string][]*Deployment)
+	p.shared = make(map[string]*sharedDeployment)
+}
+
+// destroyIdle destroys one idle deployment, to make room for other deployments when COMPLEMENT_MAX_CONTAINERS
+// is reached. Returns false if there are no idle deployments.
+func (p *Pool) destroyIdle() bool {
+	p.mu.Lock()
+	var dep *Deployment
+	for _, blueprintName := range sortedKeys(p.idle) {
+		if idle := p.idle[blueprintName]; len(idle) > 0 {
+			dep = idle[0]
+			p.idle[blueprintName] = idle[1:]
+			break
+		}
+	}
+	p.mu.Unlock()
+	if dep == nil {
+		return false
+	}
+	dep.Deployer.Destroy(dep, false)
+	return true
+}
+
+// release cleans up `dep` and returns it to the pool, or destroys it if that isn't safe.
+func (p *Pool) release(t *testing.T, dep *Deployment) {
+	t.Helper()
+	if t.Failed() {
+		dep.writeArtifacts(t)
+	}
+	if dep.dirty {
+		// other tests may still be using it
+		if t.Failed() || p.config.AlwaysPrintServerLogs {
+			dep.PrintLogs()
+		}
+		return
+	}
+	if t.Failed() {
+		dep.Deployer.Destroy(dep, true)
+		return
+	}
+	if err := dep.scrub(); err != nil {
+		t.Logf("Deployment.Destroy: not reusing deployment of %s as it could not be cleaned up: %s", dep.BlueprintName, err)
+		dep.Deployer.Destroy(dep, p.config.AlwaysPrintServerLogs)
+		return
+	}
+	if p.config.AlwaysPrintServerLogs {
+		dep.PrintLogs()
+	}
+	containerLimiter(p.config).transfer(dep.limitHolder, idleHolder, dep.limited)
+	dep.limitHolder = idleHolder
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.idle[dep.BlueprintName] = append(p.idle[dep.BlueprintName], dep)
+}
+
+// roomMemberships returns the rooms each user with an access token is joined to or invited to,
+// keyed by HS name then user ID then room ID.
+func (d *Deployment) roomMemberships() (map[string]map[string]map[string]string, error) {
+	cli := &http.Client{
+		Timeout: 30 * time.Second,
+	}
+	result := make(map[string]map[string]map[string]string)
+	for hsName, hs := range d.HS {
+		result[hsName] = make(map[string]map[string]string)
+		for userID, token := range hs.AccessTokens {
+			rooms, err := userRoomMemberships(cli, hs.BaseURL, token)
+			if err != nil {
+				return nil, fmt.Errorf("%s %s: %w", hsName, userID, err)
+			}
+			result[hsName][userID] = rooms
+		}
+	}
+	return result, nil
+}
+
+// userRoomMemberships returns the rooms the user with `token` is joined to or invited to, keyed by room ID.
+func userRoomMemberships(cli *http.Client, baseURL, token string) (map[string]string, error) {
+	// a filter which only includes room IDs
+	filter := `{"room":{"timeline":{"limit":0},"state":{"types":[]},"ephemeral":{"types":[]},"account_data":{"types":[]}},"presence":{"types":[]},"account_data":{"types":[]}}`
+	var syncRes struct {
+		Rooms struct {
+			Join   map[string]json.RawMessage `json:"join"`
+			Invite map[string]json.RawMessage `json:"invite"`
+		} `json:"rooms"`
+	}
+	err := doPoolRequest(cli, "GET", baseURL+"/_matrix/client/v3/sync?timeout=0&filter="+url.QueryEscape(filter), token, &syncRes)
+	if err != nil {
+		return nil, err
+	}
+	rooms := make(map[string]string)
+	for roomID := range syncRes.Rooms.Join {
+		rooms[roomID] = "join"
+	}
+	for roomID := range syncRes.Rooms.Invite {
+		rooms[roomID] = "invite"
+	}
+	return rooms, nil
+}
+
+// scrub makes every user with an access token leave and forget all rooms they are in or invited to which
+// they weren't when the deployment was made. Returns an error if a user is no longer in one of the rooms
+// they started in, as the deployment can't be restored to how it was.
+func (d *Deployment) scrub() error {
+	cli := &http.Client{
+		Timeout: 30 * time.Second,
+	}
+	memberships, err := d.roomMemberships()
+	if err != nil {
+		return err
+	}
+	for hsName, users := range memberships {
+		token := d.HS[hsName].AccessTokens
+		for userID, rooms := range users {
+			baseline := d.poolBaseline[hsName][userID]
+			for roomID, membership := range baseline {
+				if rooms[roomID] != membership {
+					return fmt.Errorf("%s is no longer %s in %s", userID, membership, roomID)
+				}
+			}
+			for roomID := range rooms {
+				if _, ok := baseline[roomID]; ok {
+					continue
+				}
+				roomURL := d.HS[hsName].BaseURL + "/_matrix/client/v3/rooms/" + url.PathEscape(roomID)
+				if err = doPoolRequest(cli, "POST", roomURL+"/leave", token[userID], nil); err != nil {
+					return fmt.Errorf("%s %s: %w", hsName, userID, err)
+				}
+				if err = doPoolRequest(cli, "POST", roomURL+"/forget", token[userID], nil); err != nil {
+					return fmt.Errorf("%s %s: %w", hsName, userID, err)
+				}
+			}
+		}
+	}
+	for hsName, users := range d.poolUserStates {
+		for userID, baseline := range users {
+			if err = restoreUserState(cli, d.HS[hsName].BaseURL, userID, d.HS[hsName].AccessTokens[userID], baseline); err != nil {
+				return fmt.Errorf("%s %s: %w", hsName, userID, err)
+			}
+		}
+	}
+	return nil
+}
+
+// userState is what a user can change outside of rooms, which scrub puts back.
+type userState struct {
+	// The response of GET /profile/{userID}
+	Profile map[string]json.RawMessage
+	// Room ID, or "" for global account data -> type -> content
+	AccountData map[string]map[string]json.RawMessage
+	// Kind -> push rules of that kind, in order
+	PushRules map[string][]pushRule
+}
+
+type pushRule map[string]json.RawMessage
+
+func (r pushRule) id() string {
+	var id string
+	json.Unmarshal(r["rule_id"], &id) // nolint:errcheck
+	return id
+}
+
+// The kinds of push rule, in the order the homeserver evaluates them
+var pushRuleKinds = []string{"override", "content", "room", "sender", "underride"}
+
+// userStates returns the state of each user with an access token, keyed by HS name then user ID.
+func (d *Deployment) userStates() (map[string]map[string]*userState, error) {
+	cli := &http.Client{
+		Timeout: 30 * time.Second,
+	}
+	result := make(map[string]map[string]*userState)
+	for hsName, hs := range d.HS {
+		result[hsName] = make(map[string]*userState)
+		for userID, token := range hs.AccessTokens {
+			state, err := getUserState(cli, hs.BaseURL, userID, token)
+			if err != nil {
+				return nil, fmt.Errorf("%s %s: %w", hsName, userID, err)
+			}
+			result[hsName][userID] = state
+		}
+	}
+	return result, nil
+}
+
+func getUserState(cli *http.Client, baseURL, userID, token string) (*userState, error) {
+	state := &userState{
+		AccountData: make(map[string]map[string]json.RawMessage),
+	}
+	if err := doPoolRequest(cli, "GET", baseURL+"/_matrix/client/v3/profile/"+url.PathEscape(userID), token, &state.Profile); err != nil {
+		return nil, err
+	}
+	var pushRules struct {
+		Global map[string][]pushRule `json:"global"`
+	}
+	if err := doPoolRequest(cli, "GET", baseURL+"/_matrix/client/v3/pushrules/", token, &pushRules); err != nil {
+		return nil, err
+	}
+	state.PushRules = pushRules.Global
+	// push rules are also given as account data, which can't be set directly
+	filter := `{"room":{"timeline":{"limit":0},"state":{"types":[]},"ephemeral":{"types":[]},"account_data":{"not_types":["m.push_rules"]}},"presence":{"types":[]},"account_data":{"not_types":["m.push_rules"]}}`
+	type accountData struct {
+		Events []struct {
+			Type    string          `json:"type"`
+			Content json.RawMessage `json:"content"`
+		} `json:"events"`
+	}
+	var syncRes struct {
+		AccountData accountData `json:"account_data"`
+		Rooms       struct {
+			Join map[string]struct {
+				AccountData accountData `json:"account_data"`
+			} `json:"join"`
+		} `json:"rooms"`
+	}
+	err := doPoolRequest(cli, "GET", baseURL+"/_matrix/client/v3/sync?timeout=0&filter="+url.QueryEscape(filter), token, &syncRes)
+	if err != nil {
+		return nil, err
+	}
+	addAccountData := func(roomID string, data accountData) {
+		state.AccountData[roomID] = make(map[string]json.RawMessage)
+		for _, ev := range data.Events {
+			state.AccountData[roomID][ev.Type] = ev.Content
+		}
+	}
+	addAccountData("", syncRes.AccountData)
+	for roomID, room := range syncRes.Rooms.Join {
+		addAccountData(roomID, room.AccountData)
+	}
+	return state, nil
+}
+
+// restoreUserState puts the profile, account data and push rules of `userID` back to `baseline`. Returns
+// an error if that can't be done, e.g account data of a new type was set, as it can't be deleted.
+func restoreUserState(cli *http.Client, baseURL, userID, token string, baseline *userState) error {
+	current, err := getUserState(cli, baseURL, userID, token)
+	if err != nil {
+		return err
+	}
+	userURL := baseURL + "/_matrix/client/v3/profile/" + url.PathEscape(userID)
+	for _, field := range []string{"displayname", "avatar_url"} {
+		if sameJSON(current.Profile[field], baseline.Profile[field]) {
+			continue
+		}
+		value := baseline.Profile[field]
+		if value == nil {
+			value = json.RawMessage(`""`)
+		}
+		body := map[string]json.RawMessage{field: value}
+		if err = doPoolRequest(cli, "PUT", userURL+"/"+field, token, nil, body); err != nil {
+			return err
+		}
+	}
+
+	for roomID, data := range current.AccountData {
+		accountDataURL := baseURL + "/_matrix/client/v3/user/" + url.PathEscape(userID)
+		if roomID != "" {
+			if _, ok := baseline.AccountData[roomID]; !ok {
+				// a room the user has now left and forgotten
+				continue
+			}
+			accountDataURL += "/rooms/" + url.PathEscape(roomID)
+		}
+		for evType, content := range data {
+			want, ok := baseline.AccountData[roomID][evType]
+			if !ok {
+				return fmt.Errorf("account data %s was set in room '%s', and it can't be removed", evType, roomID)
+			}
+			if sameJSON(content, want) {
+				continue
+			}
+			if err = doPoolRequest(cli, "PUT", accountDataURL+"/account_data/"+url.PathEscape(evType), token, nil, want); err != nil {
+				return err
+			}
+		}
+	}
+
+	for _, kind := range pushRuleKinds {
+		ruleURL := baseURL + "/_matrix/client/v3/pushrules/global/" + kind + "/"
+		wantRules := make(map[string]pushRule)
+		for _, rule := range baseline.PushRules[kind] {
+			wantRules[rule.id()] = rule
+		}
+		found := 0
+		for _, rule := range current.PushRules[kind] {
+			id := rule.id()
+			want, ok := wantRules[id]
+			if !ok {
+				if err = doPoolRequest(cli, "DELETE", ruleURL+url.PathEscape(id), token, nil); err != nil {
+					return err
+				}
+				continue
+			}
+			found++
+			for _, field := range []string{"enabled", "actions"} {
+				if sameJSON(rule[field], want[field]) {
+					continue
+				}
+				body := map[string]json.RawMessage{field: want[field]}
+				if err = doPoolRequest(cli, "PUT", ruleURL+url.PathEscape(id)+"/"+field, token, nil, body); err != nil {
+					return err
+				}
+			}
+		}
+		if found != len(wantRules) {
+			return fmt.Errorf("a %s push rule was deleted, and it can't be put back in order", kind)
+		}
+	}
+	return nil
+}
+
+// sameJSON returns true if `a` and `b` are equal once decoded, e.g ignoring the order of keys.
+func sameJSON(a, b json.RawMessage) bool {
+	if a == nil || b == nil {
+		return a == nil && b == nil
+	}
+	var av, bv interface{}
+	if json.Unmarshal(a, &av) != nil || json.Unmarshal(b, &bv) != nil {
+		return bytes.Equal(a, b)
+	}
+	return reflect.DeepEqual(av, bv)
+}
+
+// doPoolRequest makes a request with the JSON body `in`, or an empty JSON object for POSTs, and decodes the
+// JSON response into `out` if it isn't nil.
+func doPoolRequest(cli *http.Client, method, reqURL, token string, out interface{}, in ...interface{}) error {
+	var body io.Reader
+	if len(in) > 0 {
+		b, err := json.Marshal(in[0])
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(b)
+	} else if method == "POST" {
+		body = strings.NewReader("{}")
+	}
+	req, err := http.NewRequest(method, reqURL, body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set("Content-Type", "application/json")
+	res, err := cli.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != 200 {
+		return fmt.Errorf("%s %s returned HTTP %d", method, req.URL.Path, res.StatusCode)
+	}
+	if out != nil {
+		return json.NewDecoder(res.Body).Decode(out)
+	}
+	return nil
+}
@@ -0,0 +1,170 @@
+package docker
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeUserServer serves the profile, account data and push rules of a single user, and records changes.
+type fakeUserServer struct {
+	mu          sync.Mutex
+	profile     map[string]interface{}
+	accountData map[string]json.RawMessage
+	pushRules   map[string][]map[string]interface{}
+	requests    []string
+}
+
+func (s *fakeUserServer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	path := strings.TrimPrefix(req.URL.EscapedPath(), "/_matrix/client/v3")
+	if req.Method != "GET" {
+		s.requests = append(s.requests, req.Method+" "+path)
+	}
+	body, _ := io.ReadAll(req.Body)
+	var res interface{} = struct{}{}
+	switch {
+	case path == "/sync":
+		var events []map[string]interface{}
+		for evType, content := range s.accountData {
+			events = append(events, map[string]interface{}{"type": evType, "content": content})
+		}
+		res = map[string]interface{}{"account_data": map[string]interface{}{"events": events}}
+	case strings.HasPrefix(path, "/profile/"):
+		if req.Method == "GET" {
+			res = s.profile
+			break
+		}
+		var fields map[string]interface{}
+		json.Unmarshal(body, &fields) // nolint:errcheck
+		for k, v := range fields {
+			s.profile[k] = v
+		}
+	case path == "/pushrules/":
+		res = map[string]interface{}{"global": s.pushRules}
+	case strings.HasPrefix(path, "/pushrules/global/"):
+		parts := strings.Split(strings.TrimPrefix(path, "/pushrules/global/"), "/")
+		rules := s.pushRules[parts[0]]
+		for i, rule := range rules {
+			if rule["rule_id"] != parts[1] {
+				continue
+			}
+			if req.Method == "DELETE" {
+				s.pushRules[parts[0]] = append(rules[:i], rules[i+1:]...)
+			} else {
+				var fields map[string]interface{}
+				json.Unmarshal(body, &fields) // nolint:errcheck
+				rule[parts[2]] = fields[parts[2]]
+			}
+		}
+	case strings.Contains(path, "/account_data/"):
+		s.accountData[path[strings.LastIndex(path, "/")+1:]] = body
+	default:
+		w.WriteHeader(404)
+	}
+	json.NewEncoder(w).Encode(res) // nolint:errcheck
+}
+
+func TestScrubRestoresUserState(t *testing.T) {
+	testCases := []struct {
+		name         string
+		change       func(s *fakeUserServer)
+		wantRequests []string
+		wantErr      string
+	}{
+		{
+			name:   "nothing changed",
+			change: func(s *fakeUserServer) {},
+		},
+		{
+			name: "profile",
+			change: func(s *fakeUserServer) {
+				s.profile["displayname"] = "Alice 2"
+				s.profile["avatar_url"] = "mxc://hs1/avatar"
+			},
+			wantRequests: []string{
+				"PUT /profile/@alice:hs1/displayname",
+				"PUT /profile/@alice:hs1/avatar_url",
+			},
+		},
+		{
+			name: "account data",
+			change: func(s *fakeUserServer) {
+				s.accountData["m.direct"] = json.RawMessage(`{"@bob:hs1":["!dm:hs1"]}`)
+			},
+			wantRequests: []string{"PUT /user/@alice:hs1/account_data/m.direct"},
+		},
+		{
+			name: "new account data",
+			change: func(s *fakeUserServer) {
+				s.accountData["org.example.custom"] = json.RawMessage(`{}`)
+			},
+			wantErr: "account data org.example.custom was set",
+		},
+		{
+			name: "push rules",
+			change: func(s *fakeUserServer) {
+				s.pushRules["override"][0]["enabled"] = true
+				s.pushRules["room"] = append(s.pushRules["room"], map[string]interface{}{"rule_id": "!room:hs1", "actions": []string{}})
+			},
+			wantRequests: []string{
+				"PUT /pushrules/global/override/.m.rule.master/enabled",
+				"DELETE /pushrules/global/room/%21room:hs1",
+			},
+		},
+		{
+			name: "deleted push rule",
+			change: func(s *fakeUserServer) {
+				s.pushRules["override"] = nil
+			},
+			wantErr: "override push rule was deleted",
+		},
+	}
+	for _, tc := range testCases {
+		s := &fakeUserServer{
+			profile:     map[string]interface{}{"displayname": "Alice"},
+			accountData: map[string]json.RawMessage{"m.direct": json.RawMessage(`{}`)},
+			pushRules: map[string][]map[string]interface{}{
+				"override": {{"rule_id": ".m.rule.master", "enabled": false, "actions": []string{}}},
+			},
+		}
+		srv := httptest.NewServer(s)
+		d := &Deployment{
+			HS: map[string]HomeserverDeployment{
+				"hs1": {
+					BaseURL:      srv.URL,
+					AccessTokens: map[string]string{"@alice:hs1": "alice_token"},
+				},
+			},
+		}
+		var err error
+		d.poolUserStates, err = d.userStates()
+		if err != nil {
+			t.Fatalf("%s: userStates returned %s", tc.name, err)
+		}
+		tc.change(s)
+		err = d.scrub()
+		srv.Close()
+		if tc.wantErr != "" {
+			if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+				t.Errorf("%s: scrub returned %v, want an error containing %q", tc.name, err, tc.wantErr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: scrub returned %s", tc.name, err)
+			continue
+		}
+		if strings.Join(s.requests, "\n") != strings.Join(tc.wantRequests, "\n") {
+			t.Errorf("%s: scrub made requests %v, want %v", tc.name, s.requests, tc.wantRequests)
+		}
+		if s.profile["displayname"] != "Alice" || s.profile["avatar_url"] != "" && s.profile["avatar_url"] != nil {
+			t.Errorf("%s: profile is %v after scrub, want it restored", tc.name, s.profile)
+		}
+	}
+}
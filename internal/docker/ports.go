@@ -0,0 +1,91 @@
+package docker
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/docker/docker/client"
+	"github.com/docker/go-connections/nat"
+)
+
+// The prefix of blueprint image labels which name a port the homeserver listens on,
+// e.g `complement_port_admin: 8080`
+const portLabelPrefix = "complement_port_"
+
+// WithPort publishes the container port `port` of the homeserver `hsName` as `name`, e.g an admin or
+// replication API, so the test can find it with GetPort.
+func WithPort(hsName, name string, port int) DeployOption {
+	return func(opts *deployOptions) {
+		opts.homeserver(hsName).ports[name] = port
+	}
+}
+
+// GetPort returns the port on HostnameRunningDocker which the port named `name` of the homeserver `hsName`
+// is published on. Ports are named by the blueprint, WithPort, or "metrics" for MetricsPort. The port
+// changes when the homeserver is restarted, so look it up again afterwards. Fails the test if the hsName
+// or port is not found.
+func (d *Deployment) GetPort(t *testing.T, hsName, name string) int {
+	t.Helper()
+	d.skipIfAttached(t, "GetPort")
+	dep, ok := d.HS[hsName]
+	if !ok {
+		t.Fatalf("Deployment.GetPort - HS name '%s' not found", hsName)
+		return 0
+	}
+	containerPort, ok := dep.ports[name]
+	if !ok {
+		t.Fatalf("Deployment.GetPort - %s has no port named '%s'", hsName, name)
+		return 0
+	}
+	port, err := hostPort(context.Background(), d.Deployer.Docker, dep.ContainerID, containerPort)
+	if err != nil {
+		t.Fatalf("Deployment.GetPort - failed to find port '%s' of %s: %s", name, hsName, err)
+	}
+	return port
+}
+
+// namedPorts returns the named ports of a homeserver run from the image `imageID`: MetricsPort, then the
+// ports named by its blueprint, then the ports in `hsOpts`.
+func namedPorts(ctx context.Context, docker *client.Client, imageID string, hsOpts *hsDeployOptions) (map[string]int, error) {
+	ports := map[string]int{
+		"metrics": MetricsPort,
+	}
+	img, _, err := docker.ImageInspectWithRaw(ctx, imageID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to inspect image %s: %w", imageID, err)
+	}
+	if img.Config != nil {
+		for k, v := range img.Config.Labels {
+			if !strings.HasPrefix(k, portLabelPrefix) {
+				continue
+			}
+			port, err := strconv.Atoi(v)
+			if err != nil {
+				return nil, fmt.Errorf("image %s has malformed port label %s=%s", imageID, k, v)
+			}
+			ports[strings.TrimPrefix(k, portLabelPrefix)] = port
+		}
+	}
+	if hsOpts != nil {
+		for name, port := range hsOpts.ports {
+			ports[name] = port
+		}
+	}
+	return ports, nil
+}
+
+// hostPort returns the port on the host which the container port `containerPort` is published on.
+func hostPort(ctx context.Context, docker *client.Client, containerID string, containerPort int) (int, error) {
+	inspect, err := docker.ContainerInspect(ctx, containerID)
+	if err != nil {
+		return 0, err
+	}
+	bindings := inspect.NetworkSettings.Ports[nat.Port(fmt.Sprintf("%d/tcp", containerPort))]
+	if len(bindings) == 0 {
+		return 0, fmt.Errorf("port %d is not published", containerPort)
+	}
+	return strconv.Atoi(bindings[0].HostPort)
+}
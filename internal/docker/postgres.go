@@ -0,0 +1,172 @@
+package docker
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"testing"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/network"
+	"github.com/docker/docker/client"
+	"github.com/docker/go-connections/nat"
+	_ "github.com/lib/pq" // the "postgres" driver for database/sql, used by Deployment.DB
+
+	"github.com/matrix-org/complement/internal/config"
+)
+
+// The name of the Postgres sidecar of a homeserver, in HomeserverDeployment.Sidecars and the
+// `complement_sidecar` label of its blueprint image.
+const postgresSidecar = "postgres"
+
+// Where the Postgres sidecar keeps its data. This is not the VOLUME declared by the postgres image, so the
+// data is kept when the sidecar is committed as part of a blueprint.
+const postgresDataPath = "/complement/pgdata"
+
+// postgresEnv returns the environment variables which tell the homeserver `hsName` how to connect to its
+// Postgres sidecar.
+func postgresEnv(hsName string) map[string]string {
+	return map[string]string{
+		"COMPLEMENT_POSTGRES_HOST":     postgresSidecar + "." + hsName,
+		"COMPLEMENT_POSTGRES_USER":     "postgres",
+		"COMPLEMENT_POSTGRES_PASSWORD": "complement",
+		"COMPLEMENT_POSTGRES_DB":       "complement",
+	}
+}
+
+// deployPostgres starts a Postgres container for the homeserver `hsName` from `imageID`, which is either a
+// postgres image or a Postgres sidecar committed as part of a blueprint, and waits for it to accept
+// connections. Returns the container ID, even on error, so it can be cleaned up.
+func deployPostgres(
+	docker *client.Client, imageID, containerName, pkgNamespace, blueprintName, hsName, contextStr, networkID string,
+	cfg *config.Complement,
+) (string, error) {
+	ctx := context.Background()
+	env := postgresEnv(hsName)
+	body, err := docker.ContainerCreate(ctx, &container.Config{
+		Image: imageID,
+		Env: []string{
+			"POSTGRES_USER=" + env["COMPLEMENT_POSTGRES_USER"],
+			"POSTGRES_PASSWORD=" + env["COMPLEMENT_POSTGRES_PASSWORD"],
+			"POSTGRES_DB=" + env["COMPLEMENT_POSTGRES_DB"],
+			"PGDATA=" + postgresDataPath,
+		},
+		Labels: map[string]string{
+			complementLabel:        contextStr,
+			"complement_blueprint": blueprintName,
+			"complement_pkg":       pkgNamespace,
+			"complement_hs_name":   hsName,
+			"complement_sidecar":   postgresSidecar,
+			runLabel:               cfg.RunID,
+		},
+	}, &container.HostConfig{
+		// published so tests can inspect the database via Deployment.DB
+		PortBindings: nat.PortMap{
+			nat.Port("5432/tcp"): []nat.PortBinding{
+				{
+					HostIP: "127.0.0.1",
+				},
+			},
+		},
+	}, &network.NetworkingConfig{
+		EndpointsConfig: map[string]*network.EndpointSettings{
+			contextStr: {
+				NetworkID: networkID,
+				Aliases:   []string{postgresSidecar + "." + hsName},
+			},
+		},
+	}, containerPlatform(cfg), containerName+"_"+postgresSidecar)
+	if err != nil {
+		return "", err
+	}
+	if err = docker.ContainerStart(ctx, body.ID, types.ContainerStartOptions{}); err != nil {
+		return body.ID, err
+	}
+	if cfg.DebugLoggingEnabled {
+		log.Printf("%s: Started postgres in container %s", contextStr, body.ID)
+	}
+	// pg_isready succeeds while the entrypoint is still setting up the database, so query it instead
+	stopTime := time.Now().Add(cfg.SpawnHSTimeout)
+	for {
+		res, err := execInContainer(ctx, docker, body.ID, []string{
+			"psql", "-U", env["COMPLEMENT_POSTGRES_USER"], "-h", "127.0.0.1", "-d", env["COMPLEMENT_POSTGRES_DB"], "-c", "SELECT 1",
+		})
+		if err == nil && res.ExitCode == 0 {
+			return body.ID, nil
+		}
+		if time.Now().After(stopTime) {
+			if err == nil {
+				err = fmt.Errorf("psql exited with code %d: %s", res.ExitCode, res.Stderr)
+			}
+			return body.ID, fmt.Errorf("timed out waiting for postgres to be ready: %w", err)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+// pullImageIfNotExists pulls the image `ref` unless it is already present. If `platform` is set, e.g
+// "linux/amd64", that variant of a multi-platform image is pulled instead of the one for this machine.
+func pullImageIfNotExists(docker *client.Client, ref, platform string) error {
+	ctx := context.Background()
+	if _, _, err := docker.ImageInspectWithRaw(ctx, ref); err == nil {
+		return nil
+	}
+	reader, err := docker.ImagePull(ctx, ref, types.ImagePullOptions{
+		Platform: platform,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to pull %s: %w", ref, err)
+	}
+	defer reader.Close()
+	// the pull only completes once the progress output has been read
+	_, err = io.Copy(ioutil.Discard, reader)
+	return err
+}
+
+// DB returns a connection to the Postgres database of the homeserver `hsName`, so implementation-specific
+// tests can assert on data which has no API. The connection is closed when the test finishes. The homeserver
+// must be using Postgres, via COMPLEMENT_POSTGRES=1. Fails the test if the hsName is not found or the
+// database can't be connected to.
+func (d *Deployment) DB(t *testing.T, hsName string) *sql.DB {
+	t.Helper()
+	d.skipIfAttached(t, "DB")
+	dep, ok := d.HS[hsName]
+	if !ok {
+		t.Fatalf("Deployment.DB - HS name '%s' not found", hsName)
+		return nil
+	}
+	containerID, ok := dep.Sidecars[postgresSidecar]
+	if !ok {
+		t.Fatalf("Deployment.DB - %s is not using Postgres, set COMPLEMENT_POSTGRES=1", hsName)
+		return nil
+	}
+	inspect, err := d.Deployer.Docker.ContainerInspect(context.Background(), containerID)
+	if err != nil {
+		t.Fatalf("Deployment.DB - failed to inspect postgres container of %s: %s", hsName, err)
+	}
+	ports := inspect.NetworkSettings.Ports[nat.Port("5432/tcp")]
+	if len(ports) == 0 {
+		t.Fatalf("Deployment.DB - postgres port of %s is not published", hsName)
+	}
+	env := postgresEnv(hsName)
+	dsn := fmt.Sprintf(
+		"postgres://%s:%s@%s:%s/%s?sslmode=disable", env["COMPLEMENT_POSTGRES_USER"], env["COMPLEMENT_POSTGRES_PASSWORD"],
+		HostnameRunningDocker, ports[0].HostPort, env["COMPLEMENT_POSTGRES_DB"],
+	)
+	db, err := sql.Open("postgres", dsn)
+	if err != nil {
+		t.Fatalf("Deployment.DB - failed to open database of %s: %s", hsName, err)
+	}
+	t.Cleanup(func() {
+		db.Close()
+	})
+	if err = db.Ping(); err != nil {
+		t.Fatalf("Deployment.DB - failed to connect to database of %s: %s", hsName, err)
+	}
+	return db
+}
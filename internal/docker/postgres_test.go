@@ -0,0 +1,176 @@
+package docker
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/client"
+	"github.com/docker/go-connections/nat"
+)
+
+// fakePostgres speaks enough of the Postgres wire protocol to answer simple queries with `result`.
+type fakePostgres struct {
+	ln     net.Listener
+	result string
+
+	mu sync.Mutex
+	// the startup parameters and queries of every connection
+	params  map[string]string
+	queries []string
+}
+
+func newFakePostgres(t *testing.T, result string) *fakePostgres {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %s", err)
+	}
+	f := &fakePostgres{ln: ln, result: result, params: make(map[string]string)}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go f.serve(conn)
+		}
+	}()
+	t.Cleanup(func() {
+		ln.Close()
+	})
+	return f
+}
+
+func (f *fakePostgres) serve(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	// the startup message has no type byte, and is the protocol version then NUL-terminated keys and values
+	startup, err := readPostgresMessage(r)
+	if err != nil {
+		return
+	}
+	fields := strings.Split(string(startup[4:]), "\x00")
+	f.mu.Lock()
+	for i := 0; i+1 < len(fields); i += 2 {
+		f.params[fields[i]] = fields[i+1]
+	}
+	f.mu.Unlock()
+	writePostgresMessage(conn, 'R', []byte{0, 0, 0, 0}) // AuthenticationOk
+	writePostgresMessage(conn, 'Z', []byte("I"))        // ReadyForQuery
+	for {
+		typ, err := r.ReadByte()
+		if err != nil {
+			return
+		}
+		body, err := readPostgresMessage(r)
+		if err != nil {
+			return
+		}
+		switch typ {
+		case 'Q':
+			query := strings.TrimSuffix(string(body), "\x00")
+			f.mu.Lock()
+			f.queries = append(f.queries, query)
+			f.mu.Unlock()
+			if strings.TrimSpace(query) == ";" {
+				writePostgresMessage(conn, 'I', nil) // EmptyQueryResponse
+			} else {
+				// RowDescription of one text column
+				var desc bytes.Buffer
+				binary.Write(&desc, binary.BigEndian, int16(1)) // nolint:errcheck
+				desc.WriteString("result\x00")
+				binary.Write(&desc, binary.BigEndian, []int32{0})  // nolint:errcheck
+				binary.Write(&desc, binary.BigEndian, int16(0))    // nolint:errcheck
+				binary.Write(&desc, binary.BigEndian, int32(25))   // nolint:errcheck
+				binary.Write(&desc, binary.BigEndian, []int16{-1}) // nolint:errcheck
+				binary.Write(&desc, binary.BigEndian, int32(-1))   // nolint:errcheck
+				binary.Write(&desc, binary.BigEndian, int16(0))    // nolint:errcheck
+				writePostgresMessage(conn, 'T', desc.Bytes())
+				var row bytes.Buffer
+				binary.Write(&row, binary.BigEndian, int16(1))             // nolint:errcheck
+				binary.Write(&row, binary.BigEndian, int32(len(f.result))) // nolint:errcheck
+				row.WriteString(f.result)
+				writePostgresMessage(conn, 'D', row.Bytes())
+				writePostgresMessage(conn, 'C', []byte("SELECT 1\x00"))
+			}
+			writePostgresMessage(conn, 'Z', []byte("I"))
+		case 'X':
+			return
+		}
+	}
+}
+
+// readPostgresMessage reads a length-prefixed message body.
+func readPostgresMessage(r io.Reader) ([]byte, error) {
+	var length int32
+	if err := binary.Read(r, binary.BigEndian, &length); err != nil {
+		return nil, err
+	}
+	body := make([]byte, length-4)
+	_, err := io.ReadFull(r, body)
+	return body, err
+}
+
+func writePostgresMessage(w io.Writer, typ byte, body []byte) {
+	msg := []byte{typ, 0, 0, 0, 0}
+	binary.BigEndian.PutUint32(msg[1:], uint32(len(body)+4))
+	w.Write(append(msg, body...)) // nolint:errcheck
+}
+
+func TestDB(t *testing.T) {
+	pg := newFakePostgres(t, "3")
+	_, port, _ := net.SplitHostPort(pg.ln.Addr().String())
+	// a Docker API which has a Postgres sidecar publishing the fake's port
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if !strings.HasSuffix(req.URL.Path, "/containers/pg1/json") {
+			http.NotFound(w, req)
+			return
+		}
+		json.NewEncoder(w).Encode(types.ContainerJSON{ // nolint:errcheck
+			ContainerJSONBase: &types.ContainerJSONBase{ID: "pg1"},
+			NetworkSettings: &types.NetworkSettings{
+				NetworkSettingsBase: types.NetworkSettingsBase{
+					Ports: nat.PortMap{
+						nat.Port("5432/tcp"): []nat.PortBinding{{HostIP: "127.0.0.1", HostPort: port}},
+					},
+				},
+			},
+		})
+	}))
+	defer srv.Close()
+	docker, err := client.NewClientWithOpts(client.WithHost("tcp://"+srv.Listener.Addr().String()), client.WithVersion("1.41"))
+	if err != nil {
+		t.Fatalf("failed to make docker client: %s", err)
+	}
+	d := &Deployment{
+		HS: map[string]HomeserverDeployment{
+			"hs1": {ContainerID: "container1", Sidecars: map[string]string{postgresSidecar: "pg1"}},
+		},
+		Deployer: &Deployer{Docker: docker},
+	}
+
+	var count string
+	if err := d.DB(t, "hs1").QueryRow("SELECT count(*) FROM users").Scan(&count); err != nil {
+		t.Fatalf("failed to query database: %s", err)
+	}
+	if count != "3" {
+		t.Errorf("got %s want 3", count)
+	}
+	pg.mu.Lock()
+	defer pg.mu.Unlock()
+	if pg.params["user"] != "postgres" || pg.params["database"] != "complement" {
+		t.Errorf("connected with %v, want the sidecar's user and database", pg.params)
+	}
+	if len(pg.queries) == 0 || pg.queries[len(pg.queries)-1] != "SELECT count(*) FROM users" {
+		t.Errorf("got queries %v, want the test's query last", pg.queries)
+	}
+}
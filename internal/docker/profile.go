@@ -0,0 +1,88 @@
+package docker
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/docker/docker/api/types"
+)
+
+// Where COMPLEMENT_PROFILE_CMD writes the profile, and the PID of the profiler, inside the container.
+const (
+	profileOutputPath = "/tmp/complement.profile"
+	profilePIDPath    = "/tmp/complement.profile.pid"
+)
+
+// Profile starts profiling the homeserver `hsName` with COMPLEMENT_PROFILE_CMD, and returns a function which
+// stops profiling and writes the profile to the test's directory in COMPLEMENT_ARTIFACTS_DIR. Use this to
+// mark the slow section of a test, e.g `defer deployment.Profile(t, "hs1")()`. Does nothing if
+// COMPLEMENT_PROFILE_CMD is not set. Failures to profile are logged rather than failing the test.
+func (d *Deployment) Profile(t *testing.T, hsName string) (stop func()) {
+	t.Helper()
+	d.skipIfAttached(t, "Profile")
+	if d.Config.ProfileCommand == "" {
+		return func() {}
+	}
+	dep, ok := d.HS[hsName]
+	if !ok {
+		t.Fatalf("Deployment.Profile - HS name '%s' not found", hsName)
+		return func() {}
+	}
+	ctx := context.Background()
+	docker := d.Deployer.Docker
+	exec, err := docker.ContainerExecCreate(ctx, dep.ContainerID, types.ExecConfig{
+		Cmd: []string{"sh", "-c", fmt.Sprintf(
+			"rm -f %s %s; %s & echo $! > %s; wait", profileOutputPath, profilePIDPath, d.Config.ProfileCommand, profilePIDPath,
+		)},
+		Env: []string{"COMPLEMENT_PROFILE_OUTPUT=" + profileOutputPath},
+	})
+	if err == nil {
+		err = docker.ContainerExecStart(ctx, exec.ID, types.ExecStartCheck{Detach: true})
+	}
+	if err != nil {
+		t.Logf("Deployment.Profile - failed to start profiling %s: %s", hsName, err)
+		return func() {}
+	}
+	return func() {
+		t.Helper()
+		// the profiler may not have started yet if the section was short, so give it up to 30s
+		res, err := execInContainer(ctx, docker, dep.ContainerID, []string{"sh", "-c", fmt.Sprintf(
+			"i=0; while [ ! -f %s ]; do [ $i -ge 300 ] && exit 1; i=$((i+1)); sleep 0.1; done; kill -INT $(cat %s)",
+			profilePIDPath, profilePIDPath,
+		)})
+		if err == nil && res.ExitCode != 0 {
+			err = fmt.Errorf("the profiler did not start or could not be signalled: exit code %d %s", res.ExitCode, res.Stderr)
+		}
+		if err != nil {
+			t.Logf("Deployment.Profile - failed to stop profiling %s: %s", hsName, err)
+			return
+		}
+		// wait for the profiler to write the profile
+		for start := time.Now(); time.Since(start) < 30*time.Second; time.Sleep(100 * time.Millisecond) {
+			inspect, err := docker.ContainerExecInspect(ctx, exec.ID)
+			if err != nil || !inspect.Running {
+				break
+			}
+		}
+		res, err = execInContainer(ctx, docker, dep.ContainerID, []string{"cat", profileOutputPath})
+		if err != nil || res.ExitCode != 0 {
+			t.Logf("Deployment.Profile - failed to read profile of %s: %v %s", hsName, err, res.Stderr)
+			return
+		}
+		dir := d.artifactsDir(t)
+		if dir == "" {
+			return
+		}
+		path := filepath.Join(dir, fmt.Sprintf("%s.%d.profile", hsName, atomic.AddUint64(&d.profiles, 1)))
+		if err = ioutil.WriteFile(path, []byte(res.Stdout), 0644); err != nil {
+			t.Logf("Deployment.Profile - failed to write profile of %s: %s", hsName, err)
+			return
+		}
+		t.Logf("Deployment.Profile - wrote profile of %s to %s", hsName, path)
+	}
+}
@@ -0,0 +1,202 @@
+package docker
+
+import (
+	"context"
+	"fmt"
+	"log"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/network"
+	"github.com/docker/docker/client"
+	"github.com/docker/go-connections/nat"
+
+	"github.com/matrix-org/complement/internal/config"
+)
+
+// The name of the reverse proxy sidecar of a homeserver, in HomeserverDeployment.Sidecars.
+const proxySidecar = "proxy"
+
+// The name the homeserver behind a reverse proxy is reached on, as $proxyBackend.$hsName, as the proxy
+// takes over the homeserver's own host name.
+const proxyBackend = "backend"
+
+// Where the reverse proxy's config and TLS certificate are copied to.
+const (
+	proxyConfigPath = "/etc/nginx/nginx.conf"
+	proxyCertPath   = "/complement/proxy/server.crt"
+	proxyKeyPath    = "/complement/proxy/server.key"
+)
+
+// The placeholder in the proxy's config which is replaced by the container's DNS server when it starts, as
+// that depends on the container runtime and network, e.g Docker's embedded DNS server is 127.0.0.11 but
+// Podman's is on the network's gateway.
+const proxyResolverPlaceholder = "COMPLEMENT_RESOLVER"
+
+// proxyCommand returns the command of the reverse proxy container, which replaces the resolver placeholder in
+// the config at `configPath` with the first nameserver in `resolvConfPath` then runs its arguments.
+func proxyCommand(configPath, resolvConfPath string) []string {
+	script := fmt.Sprintf(`ns=$(awk '$1 == "nameserver" { print $2; exit }' %[2]s)
+if [ -z "$ns" ]; then
+	echo "no nameserver in %[2]s" >&2
+	exit 1
+fi
+case "$ns" in *:*) ns="[$ns]" ;; esac
+sed -i "s|%[3]s|$ns|" %[1]s
+exec "$@"`, configPath, resolvConfPath, proxyResolverPlaceholder)
+	return []string{"sh", "-c", script, "sh"}
+}
+
+// WithReverseProxy puts an nginx reverse proxy in front of the homeserver `hsName`, as in most real-world
+// deployments. The proxy takes over the homeserver's host name and published ports, so clients in the test
+// and other homeservers reach the homeserver through it. It passes client requests on port 8008 over plain
+// HTTP, terminates TLS for federation on ports 8448 and 443 with a certificate signed by the Complement CA,
+// and sets X-Forwarded-For, X-Forwarded-Proto and Host. It also serves /.well-known/matrix/server delegating
+// to port 443, so homeservers which support delegation federate via 443.
+//
+// The homeserver is given the environment variable COMPLEMENT_REVERSE_PROXY=1, and should trust
+// X-Forwarded-For when it is set, e.g so the client IPs of devices are those of the clients and not the proxy.
+// The proxy image can be changed with COMPLEMENT_PROXY_IMAGE, and must have sh, awk and sed.
+func WithReverseProxy(hsName string) DeployOption {
+	return func(opts *deployOptions) {
+		hsOpts := opts.homeserver(hsName)
+		hsOpts.reverseProxy = true
+		hsOpts.env["COMPLEMENT_REVERSE_PROXY"] = "1"
+	}
+}
+
+// alias returns the host name which the container of the sidecar `name` of the homeserver `hsName` is reached
+// on in the deployment's network, or that of the homeserver itself if `name` is empty.
+func (hsDep *HomeserverDeployment) alias(hsName, name string) string {
+	_, proxied := hsDep.Sidecars[proxySidecar]
+	switch {
+	case name == "" && proxied:
+		return proxyBackend + "." + hsName
+	case name == "" || name == proxySidecar:
+		return hsName
+	default:
+		return name + "." + hsName
+	}
+}
+
+// proxyConfig returns the nginx config of the reverse proxy in front of the homeserver `hsName`.
+func proxyConfig(hsName string) string {
+	backend := proxyBackend + "." + hsName
+	// Upstreams are set with variables so nginx resolves them per request, using the network's DNS server,
+	// instead of once on startup, as the homeserver's address changes when it is restarted.
+	return fmt.Sprintf(`events {}
+http {
+	resolver %[5]s valid=1s;
+	client_max_body_size 100M;
+	proxy_http_version 1.1;
+	proxy_read_timeout 300s;
+	proxy_set_header Host $http_host;
+	proxy_set_header X-Forwarded-For $proxy_add_x_forwarded_for;
+	proxy_set_header X-Forwarded-Proto $scheme;
+	proxy_set_header X-Real-IP $remote_addr;
+
+	server {
+		listen 8008;
+		location / {
+			set $backend http://%[1]s:8008;
+			proxy_pass $backend;
+		}
+	}
+
+	server {
+		listen 8448 ssl;
+		listen 443 ssl;
+		ssl_certificate %[3]s;
+		ssl_certificate_key %[4]s;
+		location = /.well-known/matrix/server {
+			default_type application/json;
+			return 200 '{"m.server": "%[2]s:443"}';
+		}
+		location / {
+			set $backend https://%[1]s:8448;
+			proxy_pass $backend;
+			proxy_ssl_server_name on;
+			proxy_ssl_name %[2]s;
+		}
+	}
+}
+`, backend, hsName, proxyCertPath, proxyKeyPath, proxyResolverPlaceholder)
+}
+
+// deployProxy starts a reverse proxy in front of the homeserver `hsName` and waits for the homeserver to
+// respond through it. Returns the container ID, even on error so it can be cleaned up, and the URLs of the
+// proxy's published client and federation ports.
+func deployProxy(
+	docker *client.Client, containerName, pkgNamespace, blueprintName, hsName, contextStr, networkID string,
+	cfg *config.Complement,
+) (containerID, baseURL, fedBaseURL string, err error) {
+	ctx := context.Background()
+	if err = pullImageIfNotExists(docker, cfg.ProxyImage, cfg.Platform); err != nil {
+		return "", "", "", err
+	}
+	portBindings := nat.PortMap{}
+	exposedPorts := nat.PortSet{}
+	for _, port := range []nat.Port{"8008/tcp", "8448/tcp", "443/tcp"} {
+		exposedPorts[port] = struct{}{}
+		portBindings[port] = []nat.PortBinding{
+			{
+				HostIP: "127.0.0.1",
+			},
+		}
+	}
+	body, err := docker.ContainerCreate(ctx, &container.Config{
+		Image:        cfg.ProxyImage,
+		Entrypoint:   proxyCommand(proxyConfigPath, "/etc/resolv.conf"),
+		Cmd:          []string{"nginx", "-g", "daemon off;"},
+		ExposedPorts: exposedPorts,
+		Labels: map[string]string{
+			complementLabel:        contextStr,
+			"complement_blueprint": blueprintName,
+			"complement_pkg":       pkgNamespace,
+			"complement_hs_name":   hsName,
+			"complement_sidecar":   proxySidecar,
+			runLabel:               cfg.RunID,
+		},
+	}, &container.HostConfig{
+		PortBindings: portBindings,
+	}, &network.NetworkingConfig{
+		EndpointsConfig: map[string]*network.EndpointSettings{
+			contextStr: {
+				NetworkID: networkID,
+				Aliases:   []string{hsName},
+			},
+		},
+	}, containerPlatform(cfg), containerName+"_"+proxySidecar)
+	if err != nil {
+		return "", "", "", err
+	}
+	containerID = body.ID
+	certPEM, keyPEM, err := cfg.ServerCertificate(hsName)
+	if err != nil {
+		return containerID, "", "", fmt.Errorf("failed to generate proxy certificate: %w", err)
+	}
+	files := map[string][]byte{
+		proxyConfigPath: []byte(proxyConfig(hsName)),
+		proxyCertPath:   certPEM,
+		proxyKeyPath:    keyPEM,
+	}
+	for path, contents := range files {
+		if err = copyToContainer(docker, containerID, path, contents); err != nil {
+			return containerID, "", "", err
+		}
+	}
+	if err = docker.ContainerStart(ctx, containerID, types.ContainerStartOptions{}); err != nil {
+		return containerID, "", "", err
+	}
+	if cfg.DebugLoggingEnabled {
+		log.Printf("%s: Started reverse proxy in container %s", contextStr, containerID)
+	}
+	inspect, baseURL, fedBaseURL, err := waitForPorts(ctx, docker, containerID)
+	if err != nil {
+		return containerID, "", "", err
+	}
+	if _, err = waitForServer(ctx, docker, inspect, baseURL, cfg.SpawnHSTimeout); err != nil {
+		return containerID, "", "", fmt.Errorf("homeserver is not responding through the proxy: %w", err)
+	}
+	return containerID, baseURL, fedBaseURL, nil
+}
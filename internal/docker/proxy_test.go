@@ -0,0 +1,91 @@
+package docker
+
+import (
+	"io/ioutil"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestWithReverseProxy(t *testing.T) {
+	opts := newDeployOptions([]DeployOption{WithReverseProxy("hs1")})
+	hsOpts := opts.homeservers["hs1"]
+	if hsOpts == nil || !hsOpts.reverseProxy {
+		t.Fatalf("hs1 has options %+v, want a reverse proxy", hsOpts)
+	}
+	if got := hsOpts.env["COMPLEMENT_REVERSE_PROXY"]; got != "1" {
+		t.Errorf("COMPLEMENT_REVERSE_PROXY=%q, want 1", got)
+	}
+	if got := opts.homeservers["hs2"]; got != nil {
+		t.Errorf("hs2 has options %+v, want none", got)
+	}
+	conf := proxyConfig("hs1")
+	for _, want := range []string{
+		"resolver " + proxyResolverPlaceholder + " valid=1s;",
+		"set $backend http://backend.hs1:8008;",
+		"set $backend https://backend.hs1:8448;",
+		`return 200 '{"m.server": "hs1:443"}';`,
+	} {
+		if !strings.Contains(conf, want) {
+			t.Errorf("proxy config is missing %q:\n%s", want, conf)
+		}
+	}
+}
+
+func TestProxyCommandSetsResolver(t *testing.T) {
+	testCases := []struct {
+		name       string
+		resolvConf string
+		want       string
+		wantErr    bool
+	}{
+		{
+			name:       "docker",
+			resolvConf: "nameserver 127.0.0.11\noptions ndots:0\n",
+			want:       "resolver 127.0.0.11 valid=1s;",
+		},
+		{
+			name:       "first nameserver",
+			resolvConf: "search dns.podman\nnameserver 10.89.0.1\nnameserver 10.89.0.2\n",
+			want:       "resolver 10.89.0.1 valid=1s;",
+		},
+		{
+			name:       "ipv6",
+			resolvConf: "nameserver fd00::1\n",
+			want:       "resolver [fd00::1] valid=1s;",
+		},
+		{
+			name:       "no nameserver",
+			resolvConf: "options ndots:0\n",
+			wantErr:    true,
+		},
+	}
+	for _, tc := range testCases {
+		dir := t.TempDir()
+		configPath := filepath.Join(dir, "nginx.conf")
+		resolvConfPath := filepath.Join(dir, "resolv.conf")
+		if err := ioutil.WriteFile(configPath, []byte(proxyConfig("hs1")), 0644); err != nil {
+			t.Fatalf("failed to write config: %s", err)
+		}
+		if err := ioutil.WriteFile(resolvConfPath, []byte(tc.resolvConf), 0644); err != nil {
+			t.Fatalf("failed to write resolv.conf: %s", err)
+		}
+		// run `cat` instead of nginx, to see the config it would have read
+		args := append(proxyCommand(configPath, resolvConfPath), "cat", configPath)
+		out, err := exec.Command(args[0], args[1:]...).Output()
+		if tc.wantErr {
+			if err == nil {
+				t.Errorf("%s: got config %s, want an error", tc.name, out)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: command failed: %s", tc.name, err)
+			continue
+		}
+		if !strings.Contains(string(out), tc.want) {
+			t.Errorf("%s: config is missing %q:\n%s", tc.name, tc.want, out)
+		}
+	}
+}
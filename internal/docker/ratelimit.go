@@ -0,0 +1,39 @@
+package docker
+
+import (
+	"strconv"
+)
+
+// RateLimits are the client-facing rate limits of a homeserver, applied to every rate limited endpoint.
+type RateLimits struct {
+	// The number of requests allowed per second, once the burst is used up
+	PerSecond float64
+	// The number of requests allowed in quick succession
+	Burst int
+}
+
+// WithRateLimits enables rate limiting on the homeserver `hsName` with the limits `rl`, by setting the
+// environment variables COMPLEMENT_RATE_LIMITING=1, COMPLEMENT_RATE_LIMIT_PER_SECOND and
+// COMPLEMENT_RATE_LIMIT_BURST. The image is responsible for translating these into its config, so this has
+// no effect on images which don't read them. See "Config overrides" in the README.
+func WithRateLimits(hsName string, rl RateLimits) DeployOption {
+	return func(opts *deployOptions) {
+		env := opts.homeserver(hsName).env
+		env["COMPLEMENT_RATE_LIMITING"] = "1"
+		env["COMPLEMENT_RATE_LIMIT_PER_SECOND"] = strconv.FormatFloat(rl.PerSecond, 'f', -1, 64)
+		env["COMPLEMENT_RATE_LIMIT_BURST"] = strconv.Itoa(rl.Burst)
+	}
+}
+
+// WithoutRateLimits disables rate limiting on the homeserver `hsName`, by setting the environment variable
+// COMPLEMENT_RATE_LIMITING=0. The image is responsible for translating this into its config, so this has no
+// effect on images which don't read it.
+func WithoutRateLimits(hsName string) DeployOption {
+	return func(opts *deployOptions) {
+		env := opts.homeserver(hsName).env
+		env["COMPLEMENT_RATE_LIMITING"] = "0"
+		// limits from an earlier WithRateLimits no longer apply
+		delete(env, "COMPLEMENT_RATE_LIMIT_PER_SECOND")
+		delete(env, "COMPLEMENT_RATE_LIMIT_BURST")
+	}
+}
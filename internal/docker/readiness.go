@@ -0,0 +1,174 @@
+package docker
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/filters"
+	"github.com/docker/docker/client"
+)
+
+// Image labels which replace the check that a homeserver is ready to be used. The check succeeds once a GET of
+// `complement_readiness_path` returns 200 with a body containing `complement_readiness_body`. By default,
+// this is a GET of /_matrix/client/versions with any body.
+const (
+	readinessPathLabel = "complement_readiness_path"
+	readinessBodyLabel = "complement_readiness_body"
+)
+
+// readinessProbe checks whether a homeserver is ready to be used.
+type readinessProbe struct {
+	path string
+	body string
+}
+
+// readinessProbeFromLabels returns the readiness probe of the container or image with `labels`.
+func readinessProbeFromLabels(labels map[string]string) readinessProbe {
+	probe := readinessProbe{
+		path: "/_matrix/client/versions",
+		body: labels[readinessBodyLabel],
+	}
+	if path := labels[readinessPathLabel]; path != "" {
+		probe.path = path
+	}
+	return probe
+}
+
+// check returns an error describing why the homeserver at `baseURL` isn't ready, or nil if it is.
+func (p readinessProbe) check(baseURL string) error {
+	u := baseURL + p.path
+	res, err := http.Get(u)
+	if err != nil {
+		return fmt.Errorf("GET %s => error: %s", u, err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != 200 {
+		return fmt.Errorf("GET %s => HTTP %s", u, res.Status)
+	}
+	if p.body == "" {
+		return nil
+	}
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return fmt.Errorf("GET %s => error reading body: %s", u, err)
+	}
+	if !strings.Contains(string(body), p.body) {
+		return fmt.Errorf("GET %s => body does not contain %q", u, p.body)
+	}
+	return nil
+}
+
+// probeTranscript records the outcomes of checking whether a homeserver is up, collapsing repeated outcomes,
+// so a failure to start can be explained by more than the last error.
+type probeTranscript struct {
+	start   time.Time
+	entries []transcriptEntry
+}
+
+type transcriptEntry struct {
+	first, last time.Duration
+	count       int
+	outcome     string
+}
+
+func newProbeTranscript() *probeTranscript {
+	return &probeTranscript{
+		start: time.Now(),
+	}
+}
+
+func (pt *probeTranscript) add(outcome string) {
+	at := time.Since(pt.start)
+	if n := len(pt.entries); n > 0 && pt.entries[n-1].outcome == outcome {
+		pt.entries[n-1].last = at
+		pt.entries[n-1].count++
+		return
+	}
+	pt.entries = append(pt.entries, transcriptEntry{
+		first:   at,
+		last:    at,
+		count:   1,
+		outcome: outcome,
+	})
+}
+
+func (pt *probeTranscript) String() string {
+	var sb strings.Builder
+	for _, e := range pt.entries {
+		fmt.Fprintf(&sb, "  %6.2fs", e.first.Seconds())
+		if e.count > 1 {
+			fmt.Fprintf(&sb, "-%.2fs (x%d)", e.last.Seconds(), e.count)
+		}
+		fmt.Fprintf(&sb, ": %s\n", e.outcome)
+	}
+	return sb.String()
+}
+
+// startupDiagnostics describes why the container may have failed to start: its state, the results of its
+// last healthchecks, the docker events for it since it was created, and the checks made by Complement in
+// `transcript`, which may be nil.
+func startupDiagnostics(ctx context.Context, docker *client.Client, containerID string, transcript *probeTranscript) string {
+	var sb strings.Builder
+	inspect, err := docker.ContainerInspect(ctx, containerID)
+	if err != nil {
+		fmt.Fprintf(&sb, "failed to inspect container %s: %s\n", containerID, err)
+	} else if inspect.State != nil {
+		state := inspect.State
+		fmt.Fprintf(&sb, "container %s: status=%s exit_code=%d oom_killed=%v", containerID, state.Status, state.ExitCode, state.OOMKilled)
+		if state.Error != "" {
+			fmt.Fprintf(&sb, " error=%q", state.Error)
+		}
+		sb.WriteString("\n")
+		if state.Health != nil && len(state.Health.Log) > 0 {
+			sb.WriteString("healthchecks:\n")
+			for _, h := range state.Health.Log {
+				fmt.Fprintf(&sb, "  %s exit_code=%d: %s\n", h.Start.Format(time.RFC3339), h.ExitCode, strings.TrimSpace(h.Output))
+			}
+		}
+	}
+	if transcript != nil && len(transcript.entries) > 0 {
+		sb.WriteString("readiness checks:\n")
+		sb.WriteString(transcript.String())
+	}
+	if err == nil {
+		sb.WriteString(containerEvents(ctx, docker, containerID, inspect.Created))
+	}
+	return sb.String()
+}
+
+// containerEvents returns the docker events for the container since `created`, e.g to see if it was killed
+// or restarted.
+func containerEvents(ctx context.Context, docker *client.Client, containerID, created string) string {
+	since := created
+	if t, err := time.Parse(time.RFC3339Nano, created); err == nil {
+		since = strconv.FormatInt(t.Unix(), 10)
+	}
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	messages, errs := docker.Events(ctx, types.EventsOptions{
+		Since:   since,
+		Until:   strconv.FormatInt(time.Now().Unix()+1, 10),
+		Filters: filters.NewArgs(filters.Arg("container", containerID)),
+	})
+	var sb strings.Builder
+	sb.WriteString("docker events:\n")
+	for {
+		select {
+		case msg := <-messages:
+			fmt.Fprintf(&sb, "  %s %s", time.Unix(0, msg.TimeNano).Format(time.RFC3339), msg.Action)
+			if exitCode := msg.Actor.Attributes["exitCode"]; exitCode != "" {
+				fmt.Fprintf(&sb, " exit_code=%s", exitCode)
+			}
+			sb.WriteString("\n")
+		case <-errs:
+			// io.EOF once the events until now have been sent
+			return sb.String()
+		}
+	}
+}
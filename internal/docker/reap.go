@@ -0,0 +1,123 @@
+package docker
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/docker/docker/api/types"
+)
+
+// The label of containers and networks which holds the ID of the run of Complement which created them.
+const runLabel = "complement_run"
+
+// The label compose gives the containers, networks and volumes of a project, which holds its name.
+const composeProjectLabel = "com.docker.compose.project"
+
+// Compose doesn't let Complement label what it creates, so the run is in the project name instead.
+var composeProjectRun = regexp.MustCompile(`^complement_([0-9a-f]+)_`)
+
+// composeProjectName returns the name of a compose project made by the run `runID`, see runOf.
+func composeProjectName(runID string, parts ...interface{}) string {
+	name := "complement_" + runID
+	for _, part := range parts {
+		name += fmt.Sprintf("_%v", part)
+	}
+	return name
+}
+
+// runOf returns the ID of the run of Complement which created the container, network or volume with
+// `labels`, or "" if it wasn't made by Complement.
+func runOf(labels map[string]string) string {
+	if run := labels[runLabel]; run != "" {
+		return run
+	}
+	if m := composeProjectRun.FindStringSubmatch(labels[composeProjectLabel]); m != nil {
+		return m[1]
+	}
+	return ""
+}
+
+// isOrphan returns true if the object with `labels`, created at `created`, was made by another run of
+// Complement more than `ttl` ago.
+func isOrphan(labels map[string]string, created time.Time, runID string, ttl time.Duration) bool {
+	run := runOf(labels)
+	return run != "" && run != runID && time.Since(created) >= ttl
+}
+
+// reapOrphans removes the containers, networks and compose volumes of other runs of Complement, in any
+// package, which are older than COMPLEMENT_ORPHAN_TTL_SECS. These were leaked by runs which crashed, as runs
+// clean up after themselves. Runs which are still going, e.g in another package, are left alone if they are
+// younger. Everything which can be removed is, and the errors of the rest are returned together.
+func (d *Builder) reapOrphans() error {
+	if d.Config.OrphanTTL == 0 {
+		return nil
+	}
+	ctx := context.Background()
+	var errs []string
+	fail := func(format string, args ...interface{}) {
+		errs = append(errs, fmt.Sprintf(format, args...))
+	}
+	// containers first, as networks and volumes can't be removed while they are in use
+	for _, filter := range []string{runLabel, composeProjectLabel} {
+		containers, err := d.Docker.ContainerList(ctx, types.ContainerListOptions{
+			All:     true,
+			Filters: label(filter),
+		})
+		if err != nil {
+			fail("failed to list containers: %s", err)
+			continue
+		}
+		for _, c := range containers {
+			if !isOrphan(c.Labels, time.Unix(c.Created, 0), d.Config.RunID, d.Config.OrphanTTL) {
+				continue
+			}
+			d.log("Removing container %s orphaned by run %s", c.ID, runOf(c.Labels))
+			err = d.Docker.ContainerRemove(ctx, c.ID, types.ContainerRemoveOptions{
+				Force:         true,
+				RemoveVolumes: true,
+			})
+			if err != nil {
+				fail("failed to remove container %s: %s", c.ID, err)
+			}
+		}
+	}
+	for _, filter := range []string{runLabel, composeProjectLabel} {
+		networks, err := d.Docker.NetworkList(ctx, types.NetworkListOptions{
+			Filters: label(filter),
+		})
+		if err != nil {
+			fail("failed to list networks: %s", err)
+			continue
+		}
+		for _, nw := range networks {
+			if !isOrphan(nw.Labels, nw.Created, d.Config.RunID, d.Config.OrphanTTL) {
+				continue
+			}
+			d.log("Removing network %s orphaned by run %s", nw.Name, runOf(nw.Labels))
+			if err = d.Docker.NetworkRemove(ctx, nw.ID); err != nil {
+				fail("failed to remove network %s: %s", nw.Name, err)
+			}
+		}
+	}
+	volumes, err := d.Docker.VolumeList(ctx, label(composeProjectLabel))
+	if err != nil {
+		fail("failed to list volumes: %s", err)
+	}
+	for _, vol := range volumes.Volumes {
+		created, err := time.Parse(time.RFC3339, vol.CreatedAt)
+		if err != nil || !isOrphan(vol.Labels, created, d.Config.RunID, d.Config.OrphanTTL) {
+			continue
+		}
+		d.log("Removing volume %s orphaned by run %s", vol.Name, runOf(vol.Labels))
+		if err = d.Docker.VolumeRemove(ctx, vol.Name, true); err != nil {
+			fail("failed to remove volume %s: %s", vol.Name, err)
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("%s", strings.Join(errs, "; "))
+	}
+	return nil
+}
@@ -0,0 +1,39 @@
+package docker
+
+import (
+	"testing"
+	"time"
+)
+
+func TestIsOrphan(t *testing.T) {
+	ttl := time.Hour
+	old := time.Now().Add(-2 * ttl)
+	testCases := []struct {
+		name    string
+		labels  map[string]string
+		created time.Time
+		want    bool
+	}{
+		{name: "other run", labels: map[string]string{runLabel: "0bad"}, created: old, want: true},
+		{name: "this run", labels: map[string]string{runLabel: "abc123"}, created: old},
+		{name: "other run within the TTL", labels: map[string]string{runLabel: "0bad"}, created: time.Now()},
+		{
+			name:    "compose project of other run",
+			labels:  map[string]string{composeProjectLabel: composeProjectName("0bad", "pkg", "ns", "bp", "hs1", 1)},
+			created: old,
+			want:    true,
+		},
+		{
+			name:    "compose project of this run",
+			labels:  map[string]string{composeProjectLabel: composeProjectName("abc123", "pkg", "ns", "bp", "hs1", 1)},
+			created: old,
+		},
+		{name: "compose project not made by Complement", labels: map[string]string{composeProjectLabel: "myapp"}, created: old},
+		{name: "no labels", created: old},
+	}
+	for _, tc := range testCases {
+		if got := isOrphan(tc.labels, tc.created, "abc123", ttl); got != tc.want {
+			t.Errorf("%s: isOrphan returned %v, want %v", tc.name, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,112 @@
+package docker
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+
+	"github.com/docker/docker/client"
+
+	"github.com/matrix-org/complement/internal/config"
+)
+
+// Runtime is a container runtime which serves the Docker Engine API. Complement talks to every runtime
+// with the Docker client, so a Runtime only describes how to connect to it and where it differs from Docker.
+type Runtime interface {
+	// Name returns the name of the runtime, as set in COMPLEMENT_CONTAINER_RUNTIME.
+	Name() string
+	// NewClient connects to the runtime's API.
+	NewClient() (*client.Client, error)
+	// ExtraHosts returns the hosts entries which make HostnameRunningComplement resolve to the machine
+	// running Complement from inside containers, in the form "host:address".
+	ExtraHosts() []string
+}
+
+// NewRuntime returns the container runtime selected by COMPLEMENT_CONTAINER_RUNTIME.
+func NewRuntime(cfg *config.Complement) (Runtime, error) {
+	switch cfg.ContainerRuntime {
+	case "", "docker":
+		return dockerRuntime{}, nil
+	case "podman":
+		return podmanRuntime{}, nil
+	default:
+		return nil, fmt.Errorf("unknown container runtime '%s', want docker or podman", cfg.ContainerRuntime)
+	}
+}
+
+// newClient connects to the container runtime selected by COMPLEMENT_CONTAINER_RUNTIME.
+func newClient(cfg *config.Complement) (*client.Client, error) {
+	rt, err := NewRuntime(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return rt.NewClient()
+}
+
+type dockerRuntime struct{}
+
+func (dockerRuntime) Name() string {
+	return "docker"
+}
+
+func (dockerRuntime) NewClient() (*client.Client, error) {
+	return client.NewEnvClient()
+}
+
+func (dockerRuntime) ExtraHosts() []string {
+	if runtime.GOOS != "linux" {
+		// Docker Desktop already resolves host.docker.internal
+		return nil
+	}
+	// By default docker for linux does not expose this, so do it now.
+	// When https://github.com/moby/moby/pull/40007 lands in Docker 20, we should
+	// change this to be  `host.docker.internal:host-gateway`
+	return []string{HostnameRunningComplement + ":172.17.0.1"}
+}
+
+// podmanRuntime talks to the Docker-compatible API served by `podman system service`, either rootless or
+// as root. Requires Podman 4.1 or later.
+type podmanRuntime struct{}
+
+func (podmanRuntime) Name() string {
+	return "podman"
+}
+
+func (podmanRuntime) NewClient() (*client.Client, error) {
+	host, err := podmanSocket()
+	if err != nil {
+		return nil, err
+	}
+	return client.NewClientWithOpts(client.FromEnv, client.WithHost(host), client.WithAPIVersionNegotiation())
+}
+
+func (podmanRuntime) ExtraHosts() []string {
+	// Podman isn't on a fixed bridge address like Docker, especially when rootless, but resolves
+	// host-gateway to the host for us.
+	return []string{HostnameRunningComplement + ":host-gateway"}
+}
+
+// podmanSocket returns the address of the Podman API. CONTAINER_HOST and DOCKER_HOST take precedence,
+// then the rootless socket of the current user, then the system socket.
+func podmanSocket() (string, error) {
+	for _, env := range []string{"CONTAINER_HOST", "DOCKER_HOST"} {
+		if host := os.Getenv(env); host != "" {
+			return host, nil
+		}
+	}
+	var candidates []string
+	if dir := os.Getenv("XDG_RUNTIME_DIR"); dir != "" {
+		candidates = append(candidates, filepath.Join(dir, "podman", "podman.sock"))
+	}
+	candidates = append(candidates,
+		fmt.Sprintf("/run/user/%d/podman/podman.sock", os.Getuid()),
+		"/run/podman/podman.sock",
+	)
+	for _, path := range candidates {
+		if _, err := os.Stat(path); err == nil {
+			return "unix://" + path, nil
+		}
+	}
+	return "", fmt.Errorf("no podman socket found at %v: start one with `systemctl --user start podman.socket` or set CONTAINER_HOST", candidates)
+}
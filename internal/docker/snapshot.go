@@ -0,0 +1,113 @@
+package docker
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"testing"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+)
+
+// The label of images made by Deployment.Snapshot. Snapshots are not built from a blueprint, so they are
+// never rebuilt when COMPLEMENT_CACHE_BLUEPRINTS is set.
+const snapshotLabel = "complement_snapshot"
+
+// Snapshot saves the current state of every homeserver in the deployment as a blueprint called `name`,
+// so expensive setup, e.g a room with thousands of members, can be done once and reused by later tests
+// with `Deploy(t, b.Blueprint{Name: name})`. The homeservers are stopped while they are saved, then started
+// again, and users registered during the test can be used in the snapshot. Snapshots are removed at the
+// end of the run. Fails the test if a homeserver can't be saved.
+func (d *Deployment) Snapshot(t *testing.T, name string) {
+	t.Helper()
+	d.skipIfAttached(t, "Snapshot")
+	if d.dirty {
+		t.Fatalf("Deployment.Snapshot - deployment is shared with other tests, deploy with docker.WithIsolation()")
+		return
+	}
+	for hsName, dep := range d.HS {
+		if dep.composeProject != "" {
+			t.Fatalf("Deployment.Snapshot - %s runs from a compose file and can't be saved", hsName)
+			return
+		}
+		if err := d.Deployer.StopServer(&dep); err != nil {
+			t.Fatalf("Deployment.Snapshot - failed to stop %s: %s", hsName, err)
+		}
+		err := d.commitSnapshot(name, hsName, dep)
+		if startErr := d.Deployer.StartServer(&dep); startErr != nil {
+			t.Fatalf("Deployment.Snapshot - failed to start %s: %s", hsName, startErr)
+		}
+		d.updateHS(hsName, dep)
+		if err != nil {
+			t.Fatalf("Deployment.Snapshot - failed to save %s: %s", hsName, err)
+		}
+	}
+}
+
+// commitSnapshot commits the stopped containers of the homeserver `hsName` as images of the blueprint
+// `blueprintName`, labelled like images made by the Builder.
+func (d *Deployment) commitSnapshot(blueprintName, hsName string, dep HomeserverDeployment) error {
+	contextStr := fmt.Sprintf("%s.%s.%s", d.Config.PackageNamespace, blueprintName, hsName)
+	labels := map[string]string{
+		complementLabel:        contextStr,
+		"complement_blueprint": blueprintName,
+		"complement_pkg":       d.Config.PackageNamespace,
+		"complement_hs_name":   hsName,
+		snapshotLabel:          "1",
+		// snapshots are removed at the end of the run even if the blueprint they came from is cached
+		blueprintHashLabel: "",
+	}
+	d.mu.RLock()
+	for userID, token := range dep.AccessTokens {
+		labels["access_token_"+userID] = token
+	}
+	d.mu.RUnlock()
+	for userID, deviceID := range dep.DeviceIDs {
+		labels["device_id"+userID] = deviceID
+	}
+	for k, v := range labelsForDeviceAccessTokens(dep.DeviceAccessTokens) {
+		labels[k] = v
+	}
+	for blueprintUserID, userID := range dep.GuestUserIDs {
+		labels["guest_user_id_"+blueprintUserID] = userID
+	}
+	for asID, registration := range dep.ApplicationServices {
+		labels["application_service_"+asID] = registration
+	}
+	// so GetPort works on homeservers deployed from the snapshot
+	for name, port := range dep.ports {
+		labels[portLabelPrefix+name] = strconv.Itoa(port)
+	}
+	_, err := d.Deployer.Docker.ContainerCommit(context.Background(), dep.ContainerID, types.ContainerCommitOptions{
+		Author:    "Complement",
+		Reference: "localhost/complement:" + contextStr,
+		Config: &container.Config{
+			Labels: labels,
+		},
+	})
+	if err != nil {
+		return err
+	}
+	containerID, ok := dep.Sidecars[postgresSidecar]
+	if !ok {
+		return nil
+	}
+	_, err = d.Deployer.Docker.ContainerCommit(context.Background(), containerID, types.ContainerCommitOptions{
+		Author:    "Complement",
+		Reference: "localhost/complement:" + contextStr + "-" + postgresSidecar,
+		Config: &container.Config{
+			Labels: map[string]string{
+				complementLabel:        contextStr,
+				"complement_blueprint": blueprintName,
+				"complement_hs_name":   hsName,
+				snapshotLabel:          "1",
+				blueprintHashLabel:     "",
+			},
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("%s: %w", postgresSidecar, err)
+	}
+	return nil
+}
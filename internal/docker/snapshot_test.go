@@ -0,0 +1,100 @@
+package docker
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/client"
+
+	"github.com/matrix-org/complement/internal/config"
+)
+
+// fakeSnapshotDocker is a Docker API which records the containers stopped and the labels of images committed.
+type fakeSnapshotDocker struct {
+	stopped []string
+	// container ID -> labels of the image committed from it
+	committed map[string]map[string]string
+}
+
+func (f *fakeSnapshotDocker) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	switch {
+	case strings.HasSuffix(req.URL.Path, "/stop"):
+		parts := strings.Split(req.URL.Path, "/")
+		f.stopped = append(f.stopped, parts[len(parts)-2])
+		w.WriteHeader(http.StatusNoContent)
+	case strings.HasSuffix(req.URL.Path, "/commit"):
+		var cfg container.Config
+		if err := json.NewDecoder(req.Body).Decode(&cfg); err != nil {
+			http.Error(w, err.Error(), 400)
+			return
+		}
+		f.committed[req.URL.Query().Get("container")] = cfg.Labels
+		json.NewEncoder(w).Encode(types.IDResponse{ID: "image1"}) // nolint:errcheck
+	default:
+		http.NotFound(w, req)
+	}
+}
+
+func newFakeSnapshotDeployment(t *testing.T, fake *fakeSnapshotDocker, dep HomeserverDeployment) *Deployment {
+	t.Helper()
+	srv := httptest.NewServer(fake)
+	t.Cleanup(srv.Close)
+	docker, err := client.NewClientWithOpts(client.WithHost("tcp://"+srv.Listener.Addr().String()), client.WithVersion("1.41"))
+	if err != nil {
+		t.Fatalf("failed to make docker client: %s", err)
+	}
+	return &Deployment{
+		HS:       map[string]HomeserverDeployment{"hs1": dep},
+		Deployer: &Deployer{Docker: docker},
+		Config:   &config.Complement{PackageNamespace: "pkg"},
+	}
+}
+
+func TestStopServerStopsHomeserverFirst(t *testing.T) {
+	fake := &fakeSnapshotDocker{}
+	dep := HomeserverDeployment{ContainerID: "container1", Sidecars: map[string]string{postgresSidecar: "pg1"}}
+	d := newFakeSnapshotDeployment(t, fake, dep)
+	if err := d.Deployer.StopServer(&dep); err != nil {
+		t.Fatalf("StopServer: %s", err)
+	}
+	if want := []string{"container1", "pg1"}; !reflect.DeepEqual(fake.stopped, want) {
+		t.Errorf("stopped %v, want %v", fake.stopped, want)
+	}
+}
+
+func TestCommitSnapshotLabels(t *testing.T) {
+	fake := &fakeSnapshotDocker{committed: make(map[string]map[string]string)}
+	dep := HomeserverDeployment{
+		ContainerID:  "container1",
+		Sidecars:     map[string]string{postgresSidecar: "pg1"},
+		AccessTokens: map[string]string{"@alice:hs1": "token"},
+		ports:        map[string]int{"metrics": MetricsPort, "admin": 8080},
+	}
+	d := newFakeSnapshotDeployment(t, fake, dep)
+	if err := d.commitSnapshot("snap", "hs1", dep); err != nil {
+		t.Fatalf("commitSnapshot: %s", err)
+	}
+	labels := fake.committed["container1"]
+	for k, want := range map[string]string{
+		complementLabel:             "pkg.snap.hs1",
+		"complement_blueprint":      "snap",
+		"access_token_@alice:hs1":   "token",
+		portLabelPrefix + "admin":   "8080",
+		portLabelPrefix + "metrics": "9090",
+		snapshotLabel:               "1",
+		"complement_hs_name":        "hs1",
+	} {
+		if labels[k] != want {
+			t.Errorf("homeserver image has %s=%q, want %q", k, labels[k], want)
+		}
+	}
+	if got := fake.committed["pg1"][snapshotLabel]; got != "1" {
+		t.Errorf("postgres image has %s=%q, want 1", snapshotLabel, got)
+	}
+}
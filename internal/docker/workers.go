@@ -0,0 +1,163 @@
+package docker
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/network"
+	"github.com/docker/docker/client"
+
+	"github.com/matrix-org/complement/internal/config"
+)
+
+// Worker is an extra process of a homeserver which runs in its own container, e.g a Synapse worker.
+type Worker struct {
+	// The name of the worker, unique within the homeserver. The worker can be reached on the deployment's
+	// network at $Name.$hsName.
+	Name string
+	// The kind of worker, which the image uses to decide what to run e.g "event_persister"
+	Type string
+}
+
+// WithWorkers splits the homeserver `hsName` across several containers: the container usually deployed
+// acts as the main process and reverse proxy, and each worker runs in a container of its own made from the
+// same image, started once the main process is up.
+//
+// The main process is given the environment variable COMPLEMENT_WORKERS, a space separated list of
+// $name=$type, and is responsible for routing requests to the workers. Each worker is given the environment
+// variables COMPLEMENT_WORKER_NAME, COMPLEMENT_WORKER_TYPE and COMPLEMENT_MAIN_PROCESS, the host name of the
+// main process, along with the environment variables, files and application service registrations given to
+// the main process e.g by WithEnv, WithConfig and AdvanceClock. The image is responsible for sharing
+// storage between the processes, e.g using the database from COMPLEMENT_POSTGRES.
+func WithWorkers(hsName string, workers ...Worker) DeployOption {
+	return func(opts *deployOptions) {
+		hsOpts := opts.homeserver(hsName)
+		hsOpts.workers = append(hsOpts.workers, workers...)
+		var list []string
+		for _, w := range hsOpts.workers {
+			list = append(list, w.Name+"="+w.Type)
+		}
+		hsOpts.env["COMPLEMENT_WORKERS"] = strings.Join(list, " ")
+	}
+}
+
+// deployWorkers starts a container for each worker of the homeserver `hsName`, using the same image as the
+// main process, and returns the container IDs keyed by worker name. Containers are returned even on error,
+// so they can be cleaned up. `tempMounts` are the main process's temp mounts, which workers share.
+func deployWorkers(
+	docker *client.Client, imageID, containerName, pkgNamespace, blueprintName, hsName, contextStr, networkID string,
+	asIDToRegistrationMap map[string]string, tempMounts map[string]string, hsOpts *hsDeployOptions, cfg *config.Complement,
+) (map[string]string, error) {
+	ctx := context.Background()
+	containerIDs := make(map[string]string)
+	hostConfig, err := homeserverHostConfig(cfg, hsOpts, tempMounts)
+	if err != nil {
+		return containerIDs, err
+	}
+	for _, w := range hsOpts.workers {
+		env := []string{
+			"SERVER_NAME=" + hsName,
+			"COMPLEMENT_WORKER_NAME=" + w.Name,
+			"COMPLEMENT_WORKER_TYPE=" + w.Type,
+			"COMPLEMENT_MAIN_PROCESS=" + hsName,
+		}
+		for k, v := range hsOpts.env {
+			env = append(env, k+"="+v)
+		}
+		body, err := docker.ContainerCreate(ctx, &container.Config{
+			Image: imageID,
+			Env:   env,
+			Labels: map[string]string{
+				complementLabel:        contextStr,
+				"complement_blueprint": blueprintName,
+				"complement_pkg":       pkgNamespace,
+				"complement_hs_name":   hsName,
+				"complement_worker":    w.Name,
+				runLabel:               cfg.RunID,
+			},
+		}, hostConfig, &network.NetworkingConfig{
+			EndpointsConfig: map[string]*network.EndpointSettings{
+				contextStr: {
+					NetworkID: networkID,
+					Aliases:   []string{w.Name + "." + hsName},
+				},
+			},
+		}, containerPlatform(cfg), containerName+"_"+w.Name)
+		if err != nil {
+			return containerIDs, fmt.Errorf("worker %s: %w", w.Name, err)
+		}
+		containerIDs[w.Name] = body.ID
+		// workers read the same config, e.g from WithConfig, AdvanceClock and application services
+		if err = copyHomeserverFiles(docker, body.ID, asIDToRegistrationMap, hsOpts); err != nil {
+			return containerIDs, fmt.Errorf("worker %s: %w", w.Name, err)
+		}
+		if err = copyCAToContainer(docker, body.ID, cfg); err != nil {
+			return containerIDs, fmt.Errorf("worker %s: %w", w.Name, err)
+		}
+		if err = docker.ContainerStart(ctx, body.ID, types.ContainerStartOptions{}); err != nil {
+			return containerIDs, fmt.Errorf("worker %s: %w", w.Name, err)
+		}
+		if cfg.DebugLoggingEnabled {
+			log.Printf("%s: Started worker %s in container %s", contextStr, w.Name, body.ID)
+		}
+	}
+	for name, containerID := range containerIDs {
+		if err := waitForHealthy(ctx, docker, containerID, cfg.SpawnHSTimeout); err != nil {
+			return containerIDs, fmt.Errorf("worker %s: %w", name, err)
+		}
+	}
+	return containerIDs, nil
+}
+
+// waitForHealthy waits for the container to report itself healthy, if it has a healthcheck, else for it to
+// be running.
+func waitForHealthy(ctx context.Context, docker *client.Client, containerID string, timeout time.Duration) error {
+	stopTime := time.Now().Add(timeout)
+	for {
+		inspect, err := docker.ContainerInspect(ctx, containerID)
+		if err != nil {
+			return err
+		}
+		if inspect.State == nil {
+			return fmt.Errorf("container %s has no state", containerID)
+		}
+		if !inspect.State.Running {
+			return fmt.Errorf("container %s is not running, state=%v", containerID, inspect.State.Status)
+		}
+		if inspect.State.Health == nil || inspect.State.Health.Status == "healthy" {
+			return nil
+		}
+		if time.Now().After(stopTime) {
+			return fmt.Errorf("timed out waiting for container %s to be healthy: %s", containerID, inspect.State.Health.Status)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+// containers returns the IDs of every container running the homeserver, keyed by a name for logging.
+func (hsDep *HomeserverDeployment) containers(hsName string) map[string]string {
+	containerIDs := make(map[string]string)
+	if hsDep.ContainerID != "" {
+		containerIDs[hsName] = hsDep.ContainerID
+	}
+	for name, containerID := range hsDep.Sidecars {
+		containerIDs[name+"."+hsName] = containerID
+	}
+	return containerIDs
+}
+
+// sortedKeys returns the keys of `m` in order, so output is stable.
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
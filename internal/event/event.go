@@ -0,0 +1,51 @@
+// Package event contains typed content for common Matrix events, which can be used instead of
+// map[string]interface{} literals when making a b.Event, e.g:
+//
+//	alice.SendEventSynced(t, roomID, event.New(event.Text("hello world")))
+//	alice.SendEventSynced(t, roomID, event.NewState(event.Name{Name: "My room"}, ""))
+package event
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/matrix-org/complement/internal/b"
+)
+
+// Content is the content of an event, which knows the type of the event it belongs to.
+type Content interface {
+	EventType() string
+}
+
+// New returns an event with the content `c`, for use in blueprints and with client send helpers.
+// Set the Sender when using it in a blueprint.
+func New(c Content) b.Event {
+	return b.Event{
+		Type:    c.EventType(),
+		Content: ToMap(c),
+	}
+}
+
+// NewState returns a state event with the content `c` and the state key `stateKey`, for use in blueprints
+// and with client send helpers. Set the Sender when using it in a blueprint.
+func NewState(c Content, stateKey string) b.Event {
+	return b.Event{
+		Type:     c.EventType(),
+		StateKey: b.Ptr(stateKey),
+		Content:  ToMap(c),
+	}
+}
+
+// ToMap converts the content `c` into the map representation used by b.Event. Panics if `c` cannot be
+// represented as a JSON object, which is a bug in this package.
+func ToMap(c Content) map[string]interface{} {
+	data, err := json.Marshal(c)
+	if err != nil {
+		panic(fmt.Sprintf("event.ToMap: failed to marshal %s content: %s", c.EventType(), err))
+	}
+	var content map[string]interface{}
+	if err := json.Unmarshal(data, &content); err != nil {
+		panic(fmt.Sprintf("event.ToMap: %s content is not a JSON object: %s", c.EventType(), err))
+	}
+	return content
+}
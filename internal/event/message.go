@@ -0,0 +1,39 @@
+package event
+
+// Message is the content of an m.room.message event.
+type Message struct {
+	MsgType       string `json:"msgtype"`
+	Body          string `json:"body"`
+	Format        string `json:"format,omitempty"`
+	FormattedBody string `json:"formatted_body,omitempty"`
+	// The mxc:// URI of the media, for m.image, m.file etc.
+	URL string `json:"url,omitempty"`
+}
+
+func (Message) EventType() string { return "m.room.message" }
+
+// Text returns an m.text message with the body `body`.
+func Text(body string) Message {
+	return Message{
+		MsgType: "m.text",
+		Body:    body,
+	}
+}
+
+// Notice returns an m.notice message with the body `body`.
+func Notice(body string) Message {
+	return Message{
+		MsgType: "m.notice",
+		Body:    body,
+	}
+}
+
+// HTML returns an m.text message with the plain text `body` and the HTML `formattedBody`.
+func HTML(body, formattedBody string) Message {
+	return Message{
+		MsgType:       "m.text",
+		Body:          body,
+		Format:        "org.matrix.custom.html",
+		FormattedBody: formattedBody,
+	}
+}
@@ -0,0 +1,136 @@
+package event
+
+// Member is the content of an m.room.member event. The state key is the user ID of the member.
+type Member struct {
+	Membership  string `json:"membership"`
+	DisplayName string `json:"displayname,omitempty"`
+	AvatarURL   string `json:"avatar_url,omitempty"`
+	Reason      string `json:"reason,omitempty"`
+	// The user who authorised a join to a restricted room
+	JoinAuthorisedViaUsersServer string `json:"join_authorised_via_users_server,omitempty"`
+}
+
+func (Member) EventType() string { return "m.room.member" }
+
+// The memberships used in m.room.member events.
+const (
+	MembershipInvite = "invite"
+	MembershipJoin   = "join"
+	MembershipKnock  = "knock"
+	MembershipLeave  = "leave"
+	MembershipBan    = "ban"
+)
+
+// PowerLevels is the content of an m.room.power_levels event.
+type PowerLevels struct {
+	Ban           *int64           `json:"ban,omitempty"`
+	Events        map[string]int64 `json:"events,omitempty"`
+	EventsDefault *int64           `json:"events_default,omitempty"`
+	Invite        *int64           `json:"invite,omitempty"`
+	Kick          *int64           `json:"kick,omitempty"`
+	Redact        *int64           `json:"redact,omitempty"`
+	StateDefault  *int64           `json:"state_default,omitempty"`
+	Users         map[string]int64 `json:"users,omitempty"`
+	UsersDefault  *int64           `json:"users_default,omitempty"`
+	Notifications map[string]int64 `json:"notifications,omitempty"`
+}
+
+func (PowerLevels) EventType() string { return "m.room.power_levels" }
+
+// Level returns a pointer to `level`, for the optional fields of PowerLevels.
+func Level(level int64) *int64 {
+	return &level
+}
+
+// JoinRules is the content of an m.room.join_rules event.
+type JoinRules struct {
+	JoinRule string `json:"join_rule"`
+	// The conditions for joining restricted rooms
+	Allow []JoinRuleAllow `json:"allow,omitempty"`
+}
+
+func (JoinRules) EventType() string { return "m.room.join_rules" }
+
+// JoinRuleAllow is a condition for joining a restricted room.
+type JoinRuleAllow struct {
+	Type   string `json:"type"`
+	RoomID string `json:"room_id,omitempty"`
+}
+
+// The join rules used in m.room.join_rules events.
+const (
+	JoinRulePublic           = "public"
+	JoinRuleInvite           = "invite"
+	JoinRuleKnock            = "knock"
+	JoinRuleRestricted       = "restricted"
+	JoinRuleKnockRestricted  = "knock_restricted"
+	JoinRulePrivate          = "private"
+	JoinRuleAllowRoomMembers = "m.room_membership"
+)
+
+// Restricted returns join rules which allow members of any of `roomIDs` to join.
+func Restricted(roomIDs ...string) JoinRules {
+	allow := make([]JoinRuleAllow, len(roomIDs))
+	for i, roomID := range roomIDs {
+		allow[i] = JoinRuleAllow{
+			Type:   JoinRuleAllowRoomMembers,
+			RoomID: roomID,
+		}
+	}
+	return JoinRules{
+		JoinRule: JoinRuleRestricted,
+		Allow:    allow,
+	}
+}
+
+// HistoryVisibility is the content of an m.room.history_visibility event.
+type HistoryVisibility struct {
+	HistoryVisibility string `json:"history_visibility"`
+}
+
+func (HistoryVisibility) EventType() string { return "m.room.history_visibility" }
+
+// GuestAccess is the content of an m.room.guest_access event.
+type GuestAccess struct {
+	GuestAccess string `json:"guest_access"`
+}
+
+func (GuestAccess) EventType() string { return "m.room.guest_access" }
+
+// Name is the content of an m.room.name event.
+type Name struct {
+	Name string `json:"name"`
+}
+
+func (Name) EventType() string { return "m.room.name" }
+
+// Topic is the content of an m.room.topic event.
+type Topic struct {
+	Topic string `json:"topic"`
+}
+
+func (Topic) EventType() string { return "m.room.topic" }
+
+// CanonicalAlias is the content of an m.room.canonical_alias event.
+type CanonicalAlias struct {
+	Alias      string   `json:"alias,omitempty"`
+	AltAliases []string `json:"alt_aliases,omitempty"`
+}
+
+func (CanonicalAlias) EventType() string { return "m.room.canonical_alias" }
+
+// Encryption is the content of an m.room.encryption event.
+type Encryption struct {
+	Algorithm          string `json:"algorithm"`
+	RotationPeriodMs   int64  `json:"rotation_period_ms,omitempty"`
+	RotationPeriodMsgs int64  `json:"rotation_period_msgs,omitempty"`
+}
+
+func (Encryption) EventType() string { return "m.room.encryption" }
+
+// Megolm returns the content of an m.room.encryption event which enables Megolm encryption.
+func Megolm() Encryption {
+	return Encryption{
+		Algorithm: "m.megolm.v1.aes-sha2",
+	}
+}
@@ -6,11 +6,15 @@ import (
 	"fmt"
 	"log"
 	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/gorilla/mux"
 	"github.com/matrix-org/gomatrixserverlib"
 	"github.com/matrix-org/util"
+	"github.com/tidwall/gjson"
 )
 
 // MakeJoinRequestsHandler is the http.Handler implementation for the make_join part of
@@ -262,6 +266,41 @@ func HandleDirectoryLookups() func(*Server) {
 	}
 }
 
+// HandleOpenIDUserInfoRequests will automatically return the user ID for any OpenID tokens made with
+// MakeOpenIDToken, and 401 for other tokens. These requests are not signed, as they are made on behalf
+// of third parties.
+func HandleOpenIDUserInfoRequests() func(*Server) {
+	return func(s *Server) {
+		if s.openIDHandlerSetup {
+			return
+		}
+		s.openIDHandlerSetup = true
+		s.mux.Handle("/_matrix/federation/v1/openid/userinfo", http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			s.openIDTokensMu.Lock()
+			userID, ok := s.openIDTokens[req.URL.Query().Get("access_token")]
+			s.openIDTokensMu.Unlock()
+			if !ok {
+				w.WriteHeader(401)
+				w.Write([]byte(`{
+					"errcode": "M_UNKNOWN_TOKEN",
+					"error": "Access token unknown or expired"
+				}`))
+				return
+			}
+			b, err := json.Marshal(gomatrixserverlib.UserInfo{
+				Sub: userID,
+			})
+			if err != nil {
+				w.WriteHeader(500)
+				w.Write([]byte("complement: HandleOpenIDUserInfoRequests failed to marshal JSON: " + err.Error()))
+				return
+			}
+			w.WriteHeader(200)
+			w.Write(b)
+		})).Methods("GET")
+	}
+}
+
 // HandleEventRequests is an option which will process GET /_matrix/federation/v1/event/{eventId} requests universally when requested.
 func HandleEventRequests() func(*Server) {
 	return func(srv *Server) {
@@ -398,6 +437,10 @@ func HandleTransactionRequests(pduCallback func(*gomatrixserverlib.Event), eduCa
 				return
 			}
 
+			srv.transactionsMu.Lock()
+			srv.transactions = append(srv.transactions, fedReq.Content())
+			srv.transactionsMu.Unlock()
+
 			// Unmarshal the request body into a transaction object
 			var transaction gomatrixserverlib.Transaction
 			err := json.Unmarshal(fedReq.Content(), &transaction)
@@ -498,3 +541,142 @@ func HandleTransactionRequests(pduCallback func(*gomatrixserverlib.Event), eduCa
 		})).Methods("PUT")
 	}
 }
+
+// HandlePublicRoomsRequests is an option which will process GET and POST /_matrix/federation/v1/publicRooms
+// requests by returning `rooms` in the order given. The `limit` and `since` parameters are supported, as is
+// filtering by `generic_search_term` on the room name and topic. `total_room_count_estimate` is always the
+// number of `rooms`.
+func HandlePublicRoomsRequests(rooms []gomatrixserverlib.PublicRoom) func(*Server) {
+	return func(srv *Server) {
+		srv.mux.Handle("/_matrix/federation/v1/publicRooms", srv.ValidFederationRequest(srv.t, func(fr *gomatrixserverlib.FederationRequest, pathParams map[string]string) util.JSONResponse {
+			var limit, since int
+			var searchTerm string
+			if fr.Method() == "POST" {
+				var body struct {
+					Limit  int    `json:"limit"`
+					Since  string `json:"since"`
+					Filter struct {
+						GenericSearchTerm string `json:"generic_search_term"`
+					} `json:"filter"`
+				}
+				if err := json.Unmarshal(fr.Content(), &body); err != nil {
+					return util.JSONResponse{
+						Code: 400,
+						JSON: map[string]string{"errcode": "M_BAD_JSON", "error": "complement: HandlePublicRoomsRequests: " + err.Error()},
+					}
+				}
+				limit = body.Limit
+				since, _ = strconv.Atoi(body.Since)
+				searchTerm = body.Filter.GenericSearchTerm
+			} else {
+				u, err := url.Parse(fr.RequestURI())
+				if err != nil {
+					return util.JSONResponse{
+						Code: 400,
+						JSON: map[string]string{"errcode": "M_INVALID_PARAM", "error": "complement: HandlePublicRoomsRequests: " + err.Error()},
+					}
+				}
+				limit, _ = strconv.Atoi(u.Query().Get("limit"))
+				since, _ = strconv.Atoi(u.Query().Get("since"))
+			}
+
+			term := strings.ToLower(searchTerm)
+			var matching []gomatrixserverlib.PublicRoom
+			for _, room := range rooms {
+				if term == "" || strings.Contains(strings.ToLower(room.Name), term) || strings.Contains(strings.ToLower(room.Topic), term) {
+					matching = append(matching, room)
+				}
+			}
+			if since > len(matching) {
+				since = len(matching)
+			}
+			end := len(matching)
+			if limit > 0 && since+limit < end {
+				end = since + limit
+			}
+			res := gomatrixserverlib.RespPublicRooms{
+				Chunk:                  matching[since:end],
+				TotalRoomCountEstimate: len(rooms),
+			}
+			if res.Chunk == nil {
+				res.Chunk = []gomatrixserverlib.PublicRoom{}
+			}
+			if end < len(matching) {
+				res.NextBatch = strconv.Itoa(end)
+			}
+			if since > 0 {
+				prev := since - limit
+				if prev < 0 {
+					prev = 0
+				}
+				res.PrevBatch = strconv.Itoa(prev)
+			}
+			return util.JSONResponse{
+				Code: 200,
+				JSON: res,
+			}
+		})).Methods("GET", "POST")
+	}
+}
+
+// HandleHierarchyRequests is an option which will process GET /_matrix/federation/v1/hierarchy/{roomID}
+// requests for rooms on this server, so remote homeservers can include them in space hierarchies. Summaries
+// are built from the current state of the room, and children which are also rooms on this server are
+// included. Other children are assumed to be known to the requesting server, and are not listed as inaccessible.
+// Returns 404 for unknown rooms.
+func HandleHierarchyRequests() func(*Server) {
+	return func(srv *Server) {
+		srv.mux.Handle("/_matrix/federation/v1/hierarchy/{roomID}", srv.ValidFederationRequest(srv.t, func(fr *gomatrixserverlib.FederationRequest, pathParams map[string]string) util.JSONResponse {
+			room, ok := srv.rooms[pathParams["roomID"]]
+			if !ok {
+				return util.JSONResponse{
+					Code: 404,
+					JSON: map[string]string{"errcode": "M_NOT_FOUND", "error": "complement: HandleHierarchyRequests: unknown room"},
+				}
+			}
+			suggestedOnly := false
+			if u, err := url.Parse(fr.RequestURI()); err == nil {
+				suggestedOnly = u.Query().Get("suggested_only") == "true"
+			}
+
+			summary := room.hierarchySummary()
+			childrenState := []json.RawMessage{}
+			children := []map[string]interface{}{}
+			for _, ev := range room.AllCurrentState() {
+				if ev.Type() != "m.space.child" {
+					continue
+				}
+				content := gjson.ParseBytes(ev.Content())
+				// children without `via` have been removed
+				if !content.Get("via").IsArray() || (suggestedOnly && !content.Get("suggested").Bool()) {
+					continue
+				}
+				childrenState = append(childrenState, strippedState(ev))
+				if child, ok := srv.rooms[*ev.StateKey()]; ok {
+					children = append(children, child.hierarchySummary())
+				}
+			}
+			summary["children_state"] = childrenState
+			return util.JSONResponse{
+				Code: 200,
+				JSON: map[string]interface{}{
+					"room":                  summary,
+					"children":              children,
+					"inaccessible_children": []string{},
+				},
+			}
+		})).Methods("GET")
+	}
+}
+
+// strippedState returns the event with only the fields used in space hierarchies.
+func strippedState(ev *gomatrixserverlib.Event) json.RawMessage {
+	b, _ := json.Marshal(map[string]interface{}{
+		"type":             ev.Type(),
+		"state_key":        ev.StateKey(),
+		"content":          json.RawMessage(ev.Content()),
+		"sender":           ev.Sender(),
+		"origin_server_ts": ev.OriginServerTS(),
+	})
+	return b
+}
@@ -16,6 +16,8 @@ import (
 	"net/http"
 	"os"
 	"path"
+	"strconv"
+	"strings"
 	"sync"
 	"testing"
 	"time"
@@ -25,8 +27,12 @@ import (
 	"github.com/matrix-org/util"
 
 	"github.com/matrix-org/complement/internal/b"
+	"github.com/matrix-org/complement/internal/capture"
 	"github.com/matrix-org/complement/internal/config"
 	"github.com/matrix-org/complement/internal/docker"
+	"github.com/matrix-org/complement/internal/testlog"
+	"github.com/matrix-org/complement/internal/timing"
+	"github.com/matrix-org/complement/internal/watchdog"
 )
 
 // Server represents a federation server
@@ -48,12 +54,25 @@ type Server struct {
 
 	directoryHandlerSetup bool
 	aliases               map[string]string
+	openIDHandlerSetup    bool
 	rooms                 map[string]*ServerRoom
 	keyRing               *gomatrixserverlib.KeyRing
+
+	// guards openIDTokens, which the userinfo handler reads while tests make tokens
+	openIDTokensMu sync.Mutex
+	openIDTokens   map[string]string
+
+	transactionsMu sync.Mutex
+	transactions   []json.RawMessage
 }
 
 // NewServer creates a new federation server with configured options.
 func NewServer(t *testing.T, deployment *docker.Deployment, opts ...func(*Server)) *Server {
+	if deployment.Attached() {
+		// the attached homeserver can't resolve the hostname Complement is running on
+		t.Skipf("federation.NewServer - not supported when attached to an existing homeserver")
+	}
+	defer timing.Track(timing.PhaseFederationStart)()
 	// generate signing key
 	_, priv, err := ed25519.GenerateKey(nil)
 	if err != nil {
@@ -66,10 +85,11 @@ func NewServer(t *testing.T, deployment *docker.Deployment, opts ...func(*Server
 		KeyID: "ed25519:complement",
 		mux:   mux.NewRouter(),
 		// The server name will be updated when the caller calls Listen() to include the port number
-		// of the HTTP server e.g "host.docker.internal:56353"
+		// of the HTTP server e.g "host.docker.internal:56353" or "[fd00::1]:56353"
 		serverName:                  docker.HostnameRunningComplement,
 		rooms:                       make(map[string]*ServerRoom),
 		aliases:                     make(map[string]string),
+		openIDTokens:                make(map[string]string),
 		UnexpectedRequestsAreErrors: true,
 	}
 	fetcher := &basicKeyFetcher{
@@ -93,30 +113,56 @@ func NewServer(t *testing.T, deployment *docker.Deployment, opts ...func(*Server
 			h.ServeHTTP(w, r)
 		})
 	})
+	srv.mux.Use(func(h http.Handler) http.Handler {
+		// Remember inbound requests in case the test hangs waiting for one
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			watchdog.RecordHTTP(t, fmt.Sprintf("federation inbound %s %s", r.Method, r.URL.Path))
+			testlog.ForTest(t).With("component", "federation").Debugf("inbound %s %s", r.Method, r.URL.Path)
+			h.ServeHTTP(w, r)
+		})
+	})
+	srv.mux.Use(func(h http.Handler) http.Handler {
+		// Time how long Complement takes to respond, for the summary at the end of the run
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			defer timing.Track(timing.PhaseFederationRequests)()
+			h.ServeHTTP(w, r)
+		})
+	})
 	srv.mux.NotFoundHandler = http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
 		if srv.UnexpectedRequestsAreErrors {
 			body, _ := ioutil.ReadAll(req.Body)
 			t.Errorf("Server.UnexpectedRequestsAreErrors=true received unexpected request to server: %s %s\n%s", req.Method, req.URL.Path, string(body))
 		} else {
-			t.Logf("Server.UnexpectedRequestsAreErrors=false received unexpected request to server: %s %s - sending 404 which may cause the HS to backoff from Complement", req.Method, req.URL.Path)
+			testlog.ForTest(t).With("component", "federation").Warnf("Server.UnexpectedRequestsAreErrors=false received unexpected request to server: %s %s - sending 404 which may cause the HS to backoff from Complement", req.Method, req.URL.Path)
 		}
 		w.WriteHeader(404)
 		w.Write([]byte("complement: federation server is not listening for this path"))
 	})
 
-	// generate certs and an http.Server
-	httpServer, certPath, keyPath, err := federationServer(deployment.Config, srv.mux)
+	for _, opt := range opts {
+		opt(srv)
+	}
+
+	// generate certs and an http.Server, after the options as they may change the host
+	// capture the whole router rather than using srv.mux.Use, which doesn't apply to the NotFoundHandler
+	handler := capture.ForTest(t, deployment.Config.CaptureDir).Middleware("federation inbound")(srv.mux)
+	httpServer, certPath, keyPath, err := federationServer(deployment.Config, srv.serverName, handler)
 	if err != nil {
 		t.Fatalf("complement: unable to create federation server and certificates: %s", err.Error())
 	}
 	srv.certPath = certPath
 	srv.keyPath = keyPath
 	srv.srv = httpServer
+	return srv
+}
 
-	for _, opt := range opts {
-		opt(srv)
+// WithServerHost makes the server name of the federation server `host` instead of HostnameRunningComplement.
+// The host may be an IP literal, e.g from Deployment.HostIPv6 to test federation over IPv6, in which case
+// IPv6 addresses are bracketed in the server name as the spec requires.
+func WithServerHost(host string) func(*Server) {
+	return func(srv *Server) {
+		srv.serverName = host
 	}
-	return srv
 }
 
 // Return the server name of this federation server. Only valid AFTER calling Listen() - doing so
@@ -132,6 +178,22 @@ func (s *Server) ServerName() string {
 	return s.serverName
 }
 
+// KeyRing returns the key ring which the server uses to verify signed federation requests, which
+// fetches signing keys from the deployed homeservers. It can be given to match.JSONEventValid to
+// check event signatures.
+func (s *Server) KeyRing() *gomatrixserverlib.KeyRing {
+	return s.keyRing
+}
+
+// ReceivedTransactions returns the bodies of the /send transactions received by the server, in the order
+// they arrived, including ones which were rejected for being too large. Transactions are only received when
+// the server was made with HandleTransactionRequests. Check them with must.MatchFederationTransaction.
+func (s *Server) ReceivedTransactions() []json.RawMessage {
+	s.transactionsMu.Lock()
+	defer s.transactionsMu.Unlock()
+	return append([]json.RawMessage(nil), s.transactions...)
+}
+
 // UserID returns the complete user ID for the given localpart
 func (s *Server) UserID(localpart string) string {
 	if !s.listening {
@@ -153,6 +215,22 @@ func (s *Server) MakeAliasMapping(aliasLocalpart, roomID string) string {
 	return alias
 }
 
+// MakeOpenIDToken will create an OpenID access token for `userID` on this server, which homeservers can verify
+// via /openid/userinfo. Returns the token. If this is the first time calling this function, a userinfo handler
+// will be added to handle verification requests over federation.
+func (s *Server) MakeOpenIDToken(userID string) string {
+	token := make([]byte, 16)
+	if _, err := rand.Read(token); err != nil {
+		s.t.Fatalf("MakeOpenIDToken: failed to generate token: %s", err)
+	}
+	accessToken := fmt.Sprintf("complement_openid_%x", token)
+	s.openIDTokensMu.Lock()
+	s.openIDTokens[accessToken] = userID
+	s.openIDTokensMu.Unlock()
+	HandleOpenIDUserInfoRequests()(s)
+	return accessToken
+}
+
 // MustMakeRoom will add a room to this server so it is accessible to other servers when prompted via federation.
 // The `events` will be added to this room. Returns the created room.
 func (s *Server) MustMakeRoom(t *testing.T, roomVer gomatrixserverlib.RoomVersion, events []b.Event) *ServerRoom {
@@ -160,7 +238,7 @@ func (s *Server) MustMakeRoom(t *testing.T, roomVer gomatrixserverlib.RoomVersio
 		s.t.Fatalf("MustMakeRoom() called before Listen() - this is not supported because Listen() chooses a high-numbered port and thus changes the server name and thus changes the room ID. Ensure you Listen() first!")
 	}
 	roomID := fmt.Sprintf("!%d:%s", len(s.rooms), s.serverName)
-	t.Logf("Creating room %s with version %s", roomID, roomVer)
+	testlog.ForTest(t).With("component", "federation").Infof("Creating room %s with version %s", roomID, roomVer)
 	room := newRoom(roomVer, roomID)
 
 	// sign all these events
@@ -181,7 +259,9 @@ func (s *Server) FederationClient(deployment *docker.Deployment) *gomatrixserver
 	}
 	f := gomatrixserverlib.NewFederationClient(
 		gomatrixserverlib.ServerName(s.serverName), s.KeyID, s.Priv,
-		gomatrixserverlib.WithTransport(&docker.RoundTripper{Deployment: deployment}),
+		gomatrixserverlib.WithTransport(
+			capture.ForTest(s.t, deployment.Config.CaptureDir).RoundTripper("federation outbound", &docker.RoundTripper{Deployment: deployment}),
+		),
 	)
 	return f
 }
@@ -224,7 +304,9 @@ func (s *Server) SendFederationRequest(deployment *docker.Deployment, req gomatr
 	}
 
 	httpClient := gomatrixserverlib.NewClient(gomatrixserverlib.WithTransport(&docker.RoundTripper{Deployment: deployment}))
-	return httpClient.DoRequestAndParseResponse(context.Background(), httpReq, resBody)
+	err = httpClient.DoRequestAndParseResponse(context.Background(), httpReq, resBody)
+	testlog.ForTest(s.t).With("component", "federation").Debugf("outbound %s %s%s => error: %v", req.Method(), req.Destination(), req.RequestURI(), err)
+	return err
 }
 
 // MustCreateEvent will create and sign a new latest event for the given room.
@@ -305,7 +387,7 @@ func (s *Server) MustJoinRoom(t *testing.T, deployment *docker.Deployment, remot
 	room.AddEvent(joinEvent)
 	s.rooms[roomID] = room
 
-	t.Logf("Server.MustJoinRoom joined room ID %s", roomID)
+	testlog.ForTest(t).With("component", "federation").Infof("Server.MustJoinRoom joined room ID %s", roomID)
 
 	return room
 }
@@ -345,7 +427,7 @@ func (s *Server) MustLeaveRoom(t *testing.T, deployment *docker.Deployment, remo
 	room.AddEvent(leaveEvent)
 	s.rooms[roomID] = room
 
-	t.Logf("Server.MustLeaveRoom left room ID %s", roomID)
+	testlog.ForTest(t).With("component", "federation").Infof("Server.MustLeaveRoom left room ID %s", roomID)
 }
 
 // ValidFederationRequest is a wrapper around http.HandlerFunc which automatically validates the incoming
@@ -400,7 +482,7 @@ func (s *Server) Listen() (cancel func()) {
 		s.t.Fatalf("ListenFederationServer: net.Listen failed: %s", err)
 	}
 	port := ln.Addr().(*net.TCPAddr).Port
-	s.serverName += fmt.Sprintf(":%d", port)
+	s.serverName = net.JoinHostPort(s.serverName, strconv.Itoa(port))
 	s.listening = true
 
 	go func() {
@@ -408,7 +490,7 @@ func (s *Server) Listen() (cancel func()) {
 		defer wg.Done()
 		err := s.srv.ServeTLS(ln, s.certPath, s.keyPath)
 		if err != nil && err != http.ErrServerClosed {
-			s.t.Logf("ListenFederationServer: ServeTLS failed: %s", err)
+			testlog.ForTest(s.t).With("component", "federation").Warnf("ListenFederationServer: ServeTLS failed: %s", err)
 			// Note that running s.t.FailNow is not allowed in a separate goroutine
 			// Tests will likely fail if the server is not listening anyways
 		}
@@ -423,15 +505,21 @@ func (s *Server) Listen() (cancel func()) {
 	}
 }
 
-// federationServer creates a federation server with the given handler
-func federationServer(cfg *config.Complement, h http.Handler) (*http.Server, string, string, error) {
+// federationServer creates a federation server with the given handler, and a certificate for `host`
+func federationServer(cfg *config.Complement, host string, h http.Handler) (*http.Server, string, string, error) {
 	var derBytes []byte
 	srv := &http.Server{
 		Addr:    ":8448",
 		Handler: h,
 	}
-	tlsCertPath := path.Join(os.TempDir(), "complement.crt")
-	tlsKeyPath := path.Join(os.TempDir(), "complement.key")
+	// servers are only listening on their certificate once Listen is called, so keep servers with other hosts
+	// from overwriting it in the meantime
+	fileName := "complement"
+	if host != docker.HostnameRunningComplement {
+		fileName += "-" + strings.ReplaceAll(host, ":", "_")
+	}
+	tlsCertPath := path.Join(os.TempDir(), fileName+".crt")
+	tlsKeyPath := path.Join(os.TempDir(), fileName+".key")
 	certificateDuration := time.Hour
 	priv, err := rsa.GenerateKey(rand.Reader, 4096)
 	if err != nil {
@@ -459,10 +547,10 @@ func federationServer(cfg *config.Complement, h http.Handler) (*http.Server, str
 			Locality:      []string{"London"},
 			StreetAddress: []string{"123 Street"},
 			PostalCode:    []string{"12345"},
-			CommonName:    docker.HostnameRunningComplement,
+			CommonName:    host,
 		},
 	}
-	host := docker.HostnameRunningComplement
+	// IP literals are verified against the IP SANs, as clients don't send them as SNI
 	if ip := net.ParseIP(host); ip != nil {
 		template.IPAddresses = append(template.IPAddresses, ip)
 	} else {
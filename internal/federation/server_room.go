@@ -6,6 +6,7 @@ import (
 	"testing"
 
 	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/tidwall/gjson"
 
 	"github.com/matrix-org/complement/internal/b"
 )
@@ -205,3 +206,40 @@ func (r *ServerRoom) EventIDsOrReferences(events []*gomatrixserverlib.Event) (re
 	}
 	return
 }
+
+// hierarchySummary returns the summary of this room used in space hierarchies, without children_state.
+func (r *ServerRoom) hierarchySummary() map[string]interface{} {
+	stateStr := func(evType, path string) string {
+		ev := r.CurrentState(evType, "")
+		if ev == nil {
+			return ""
+		}
+		return gjson.GetBytes(ev.Content(), path).Str
+	}
+	joinedMembers := 0
+	for _, ev := range r.AllCurrentState() {
+		if ev.Type() == "m.room.member" && gjson.GetBytes(ev.Content(), "membership").Str == "join" {
+			joinedMembers++
+		}
+	}
+	historyVisibility := stateStr("m.room.history_visibility", "history_visibility")
+	summary := map[string]interface{}{
+		"room_id":            r.RoomID,
+		"num_joined_members": joinedMembers,
+		"world_readable":     historyVisibility == "world_readable",
+		"guest_can_join":     stateStr("m.room.guest_access", "guest_access") == "can_join",
+		"join_rule":          stateStr("m.room.join_rules", "join_rule"),
+	}
+	for key, value := range map[string]string{
+		"name":            stateStr("m.room.name", "name"),
+		"topic":           stateStr("m.room.topic", "topic"),
+		"canonical_alias": stateStr("m.room.canonical_alias", "alias"),
+		"avatar_url":      stateStr("m.room.avatar", "url"),
+		"room_type":       stateStr("m.room.create", "type"),
+	} {
+		if value != "" {
+			summary[key] = value
+		}
+	}
+	return summary
+}
@@ -3,9 +3,14 @@ package federation
 import (
 	"crypto/tls"
 	"crypto/x509"
+	"encoding/json"
 	"net/http"
+	"net/url"
 	"testing"
 
+	"github.com/matrix-org/gomatrixserverlib"
+
+	"github.com/matrix-org/complement/internal/capture"
 	"github.com/matrix-org/complement/internal/config"
 	"github.com/matrix-org/complement/internal/docker"
 )
@@ -61,3 +66,169 @@ func TestComplementServerIsSigned(t *testing.T) {
 		}
 	}
 }
+
+func TestUnexpectedRequestsAreCaptured(t *testing.T) {
+	docker.HostnameRunningComplement = "localhost"
+	cfg := config.NewConfigFromEnvVars("test", "unimportant")
+	cfg.CaptureDir = t.TempDir()
+	srv := NewServer(t, &docker.Deployment{
+		Config: cfg,
+	})
+	srv.UnexpectedRequestsAreErrors = false
+	cancel := srv.Listen()
+	defer cancel()
+
+	caCertPool := x509.NewCertPool()
+	caCertPool.AddCert(cfg.CACertificate)
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: caCertPool}}}
+	resp, err := client.Get("https://" + srv.ServerName() + "/_matrix/federation/v1/unknown")
+	if err != nil {
+		t.Fatalf("Failed to GET: %s", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != 404 {
+		t.Errorf("expected 404, got %d", resp.StatusCode)
+	}
+	if got := capture.ForTest(t, cfg.CaptureDir).Len(); got != 1 {
+		t.Errorf("captured %d exchanges, want the request which matched no route", got)
+	}
+}
+
+func TestOpenIDUserInfo(t *testing.T) {
+	docker.HostnameRunningComplement = "localhost"
+	cfg := config.NewConfigFromEnvVars("test", "unimportant")
+	srv := NewServer(t, &docker.Deployment{
+		Config: cfg,
+	})
+	cancel := srv.Listen()
+	defer cancel()
+	token := srv.MakeOpenIDToken("@alice:" + srv.ServerName())
+
+	caCertPool := x509.NewCertPool()
+	caCertPool.AddCert(cfg.CACertificate)
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: caCertPool}}}
+
+	testCases := []struct {
+		token      string
+		wantStatus int
+		wantSub    string
+	}{
+		{
+			token:      token,
+			wantStatus: 200,
+			wantSub:    "@alice:" + srv.ServerName(),
+		},
+		{
+			token:      "not_a_real_token",
+			wantStatus: 401,
+		},
+	}
+	for _, tc := range testCases {
+		resp, err := client.Get("https://" + srv.ServerName() + "/_matrix/federation/v1/openid/userinfo?access_token=" + url.QueryEscape(tc.token))
+		if err != nil {
+			t.Fatalf("Failed to GET: %s", err)
+		}
+		var userInfo gomatrixserverlib.UserInfo
+		err = json.NewDecoder(resp.Body).Decode(&userInfo)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatalf("Failed to decode response: %s", err)
+		}
+		if resp.StatusCode != tc.wantStatus {
+			t.Errorf("token %s: expected %d, got %d", tc.token, tc.wantStatus, resp.StatusCode)
+		}
+		if userInfo.Sub != tc.wantSub {
+			t.Errorf("token %s: sub: got %q want %q", tc.token, userInfo.Sub, tc.wantSub)
+		}
+	}
+
+	// homeservers may verify tokens whilst the test makes more, which `go test -race` checks is safe
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 10; i++ {
+			resp, err := client.Get("https://" + srv.ServerName() + "/_matrix/federation/v1/openid/userinfo?access_token=" + url.QueryEscape(token))
+			if err != nil {
+				t.Errorf("Failed to GET: %s", err)
+				return
+			}
+			resp.Body.Close()
+		}
+	}()
+	for i := 0; i < 10; i++ {
+		srv.MakeOpenIDToken("@bob:" + srv.ServerName())
+	}
+	<-done
+}
+
+func TestReceivedTransactions(t *testing.T) {
+	docker.HostnameRunningComplement = "localhost"
+	cfg := config.NewConfigFromEnvVars("test", "unimportant")
+	srv := NewServer(t, &docker.Deployment{
+		Config: cfg,
+	}, HandleTransactionRequests(nil, nil))
+	cancel := srv.Listen()
+	defer cancel()
+
+	caCertPool := x509.NewCertPool()
+	caCertPool.AddCert(cfg.CACertificate)
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: caCertPool}}}
+
+	// the server trusts its own signing key, so it can send itself transactions
+	tooManyPDUs := make([]json.RawMessage, 51)
+	for i := range tooManyPDUs {
+		tooManyPDUs[i] = json.RawMessage(`{"room_id":"!unknown:hs1"}`)
+	}
+	testCases := []struct {
+		txnID       string
+		transaction map[string]interface{}
+		wantStatus  int
+	}{
+		{
+			txnID:       "1",
+			transaction: map[string]interface{}{"pdus": []json.RawMessage{}, "edus": []map[string]interface{}{{"edu_type": "m.typing", "content": map[string]interface{}{}}}},
+			wantStatus:  200,
+		},
+		{
+			// rejected for being too large, but still recorded
+			txnID:       "2",
+			transaction: map[string]interface{}{"pdus": tooManyPDUs},
+			wantStatus:  400,
+		},
+	}
+	var want []json.RawMessage
+	for _, tc := range testCases {
+		tc.transaction["origin"] = srv.ServerName()
+		fedReq := gomatrixserverlib.NewFederationRequest("PUT", gomatrixserverlib.ServerName(srv.ServerName()), "/_matrix/federation/v1/send/"+tc.txnID)
+		if err := fedReq.SetContent(tc.transaction); err != nil {
+			t.Fatalf("failed to set content: %s", err)
+		}
+		if err := fedReq.Sign(gomatrixserverlib.ServerName(srv.ServerName()), srv.KeyID, srv.Priv); err != nil {
+			t.Fatalf("failed to sign request: %s", err)
+		}
+		req, err := fedReq.HTTPRequest()
+		if err != nil {
+			t.Fatalf("failed to make request: %s", err)
+		}
+		req.URL.Scheme = "https"
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatalf("Failed to PUT: %s", err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != tc.wantStatus {
+			t.Errorf("transaction %s: expected %d, got %d", tc.txnID, tc.wantStatus, resp.StatusCode)
+		}
+		want = append(want, fedReq.Content())
+	}
+
+	got := srv.ReceivedTransactions()
+	if len(got) != len(want) {
+		t.Fatalf("got %d transactions want %d", len(got), len(want))
+	}
+	for i := range want {
+		if string(got[i]) != string(want[i]) {
+			t.Errorf("transaction %d: got %s want %s", i, got[i], want[i])
+		}
+	}
+}
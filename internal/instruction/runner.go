@@ -10,6 +10,8 @@ import (
 	"log"
 	"net/http"
 	"net/url"
+	"regexp"
+	"strconv"
 	"strings"
 	"sync"
 	"sync/atomic"
@@ -62,6 +64,8 @@ type Runner struct {
 	bestEffort bool
 	// set to true if the runner should stop
 	terminate atomic.Value
+	// if true, users may have been registered by an earlier run, so are logged in if they exist
+	usersMayExist bool
 }
 
 func NewRunner(blueprintName string, bestEffort, debugLogging bool) *Runner {
@@ -78,6 +82,20 @@ func NewRunner(blueprintName string, bestEffort, debugLogging bool) *Runner {
 	}
 }
 
+// AllowExistingUsers makes the runner log in as users which already exist on the homeserver instead of
+// failing to register them, e.g when running against a homeserver which is reused between runs.
+func (r *Runner) AllowExistingUsers() {
+	r.usersMayExist = true
+}
+
+// SetRoomConcurrency sets how many rooms are made at once, if n is more than 0. Rooms are spread evenly over
+// this many sets of requests, which run in parallel while the requests for each room run in order.
+func (r *Runner) SetRoomConcurrency(n int) {
+	if n > 0 {
+		r.roomConcurrency = n
+	}
+}
+
 func (r *Runner) log(str string, args ...interface{}) {
 	if !r.debugLogging {
 		return
@@ -115,6 +133,43 @@ func (r *Runner) DeviceIDs(hsDomain string) map[string]string {
 	return res
 }
 
+// GuestUserIDs returns the user IDs assigned by the server to all guests who were created on the given HS domain.
+// Returns a map of blueprint_user_id => user_id
+func (r *Runner) GuestUserIDs(hsDomain string) map[string]string {
+	res := make(map[string]string)
+	r.lookup.Range(func(k, v interface{}) bool {
+		key := k.(string)
+		val := v.(string)
+		if strings.HasPrefix(key, "guest_@") && strings.HasSuffix(key, ":"+hsDomain) {
+			res[strings.TrimPrefix(key, "guest_")] = val
+		}
+		return true
+	})
+	return res
+}
+
+// DeviceAccessTokens returns the access tokens for the further devices of all users who were created on the
+// given HS domain. Returns a map of user_id => device_id => access_token
+func (r *Runner) DeviceAccessTokens(hsDomain string) map[string]map[string]string {
+	res := make(map[string]map[string]string)
+	r.lookup.Range(func(k, v interface{}) bool {
+		key := k.(string)
+		if !strings.HasPrefix(key, "devicetoken_@") {
+			return true
+		}
+		userID, deviceID, ok := strings.Cut(strings.TrimPrefix(key, "devicetoken_"), "|")
+		if !ok || !strings.HasSuffix(userID, ":"+hsDomain) {
+			return true
+		}
+		if res[userID] == nil {
+			res[userID] = make(map[string]string)
+		}
+		res[userID][deviceID] = v.(string)
+		return true
+	})
+	return res
+}
+
 // Load a previously stored value from RunInstructions
 func (r *Runner) GetStoredValue(opts RunOpts, key string) string {
 	fullKey := opts.StoreNamespace + key
@@ -151,6 +206,12 @@ func (r *Runner) RunInstructions(opts RunOpts, instrs []Instr) (resErr error) {
 
 // Run all instructions until completion. Return an error if there was a problem executing any instruction.
 func (r *Runner) Run(hs b.Homeserver, hsURL string) (resErr error) {
+	// used to send events from users on this homeserver into rooms on homeservers made later
+	r.lookup.Store("hs_url_"+hs.Name, hsURL)
+	if len(hs.ApplicationServices) > 0 {
+		// used to send events with timestamps
+		r.lookup.Store("astoken_"+hs.Name, hs.ApplicationServices[0].ASToken)
+	}
 	userInstrSets := calculateUserInstructionSets(r, hs)
 	var wg sync.WaitGroup
 	wg.Add(len(userInstrSets))
@@ -184,9 +245,46 @@ func (r *Runner) Run(hs b.Homeserver, hsURL string) (resErr error) {
 			}
 		}(set)
 	}
-	// wait for all rooms to be made before returning from this function
+	// wait for all rooms to be made before setting up users' rooms
+	wg.Wait()
+	if resErr != nil {
+		return resErr
+	}
+	userRoomInstrSets := append(calculateUserRoomInstructionSets(r, hs), calculateSpaceInstructionSets(r, hs)...)
+	wg.Add(len(userRoomInstrSets))
+	for _, set := range userRoomInstrSets {
+		go func(s []instruction) {
+			defer wg.Done()
+			err := r.runInstructionSet(fmt.Sprintf("%s.%s", r.blueprintName, hs.Name), hsURL, s)
+			if err != nil {
+				r.log("Instruction set failed: %s", err)
+				resErr = err
+				r.terminate.Store(true)
+			}
+		}(set)
+	}
 	wg.Wait()
-	return resErr
+	if resErr != nil {
+		return resErr
+	}
+	return r.runSteps(hs, hsURL)
+}
+
+// runSteps runs the steps of the homeserver in order.
+func (r *Runner) runSteps(hs b.Homeserver, hsURL string) error {
+	contextStr := fmt.Sprintf("%s.%s", r.blueprintName, hs.Name)
+	for i, step := range hs.Steps {
+		if step.Func != nil {
+			if err := step.Func(hsURL, r.AccessTokens(hs.Name)); err != nil {
+				return fmt.Errorf("%s : step %d failed: %w", contextStr, i, err)
+			}
+			continue
+		}
+		if err := r.runInstructionSet(contextStr, hsURL, []instruction{instructionStep(step)}); err != nil {
+			return fmt.Errorf("%s : step %d failed: %w", contextStr, i, err)
+		}
+	}
+	return nil
 }
 
 func (r *Runner) runInstructionSet(contextStr string, hsURL string, instrs []instruction) error {
@@ -225,6 +323,11 @@ func (r *Runner) runInstructionSet(contextStr string, hsURL string, instrs []ins
 					return err
 				}
 			}
+			if res.StatusCode >= 400 && instr.allowedErrcode != "" && gjson.GetBytes(body, "errcode").Str == instr.allowedErrcode {
+				r.log("%s : request %s returned allowed error %s", contextStr, req.URL.String(), instr.allowedErrcode)
+				req, instr, i = r.next(instrs, hsURL, i)
+				continue
+			}
 			if res.StatusCode < 200 || res.StatusCode >= 300 {
 				r.log("INSTRUCTION: %+v\n", instr)
 				err = isFatalErr(fmt.Errorf("%s : request %s returned HTTP %s : %s", contextStr, req.URL.String(), res.Status, string(body)))
@@ -270,6 +373,11 @@ func (r *Runner) next(instrs []instruction, hsURL string, i int) (*http.Request,
 		}
 		body = bytes.NewBuffer(b)
 	}
+	if instr.hsName != "" {
+		if otherURL, ok := r.lookup.Load("hs_url_" + instr.hsName); ok {
+			hsURL = otherURL.(string)
+		}
+	}
 	req, err := http.NewRequest(instr.method, instr.url(hsURL, r.lookup), body)
 	if err != nil {
 		r.log("Stopping. Failed to form NewRequest for instruction: %s -- %+v \n", err, instr)
@@ -284,19 +392,7 @@ func (r *Runner) next(instrs []instruction, hsURL string, i int) (*http.Request,
 		}
 	}
 	for paramName, paramValue := range instr.queryParams {
-		// if the variable starts with a '.' then use the lookup table, else use the string literally
-		// this handles scenarios like:
-		// { $roomId: ".room_0", $eventType: "m.room.message" }
-		var valToEncode string
-		if paramValue[0] == '.' {
-			vint, ok := r.lookup.Load(strings.TrimPrefix(paramValue, "."))
-			if ok {
-				valToEncode = vint.(string)
-			}
-		} else {
-			valToEncode = paramValue
-		}
-		q.Set(paramName, valToEncode)
+		q.Set(paramName, resolve(paramValue, r.lookup))
 	}
 	req.URL.RawQuery = q.Encode()
 	return req, &instr, i
@@ -362,12 +458,19 @@ type instruction struct {
 	// The path or query placeholders to replace e.g "/foo/$roomId" with the substitution { $roomId: ".room_1"}.
 	// The key is the path param e.g $foo and the value is the lookup table key e.g ".room_id". If the value does not
 	// start with a '.' it is interpreted as a literal string to be substituted. e.g { $eventType: "m.room.message" }
+	// Values from blueprints which may start with a '.' must be escaped with literal.
 	substitutions map[string]string
 	// The fields (expressed as dot-style notation) which should be stored in a lookup table for later use.
 	// E.g to store the room_id in the response under the key 'foo' to use it later: { "foo" : ".room_id" }
 	storeResponse map[string]string
 	// Optional: A function to create the request body from the lookup map provided. Only used if `body` is <nil>.
 	bodyFn func(lk *sync.Map) interface{}
+	// Optional: The homeserver to send the request to, if it isn't the one the instructions are for, e.g when
+	// a user on another homeserver invites a user on this one.
+	hsName string
+	// Optional: An errcode which is not treated as a failure, e.g M_USER_IN_USE when the user may already exist.
+	// Nothing is stored from the response when it is returned.
+	allowedErrcode string
 }
 
 // url returns the complete path resolved url for this instruction. Query parameters must be
@@ -375,23 +478,37 @@ type instruction struct {
 func (i *instruction) url(hsURL string, lookup *sync.Map) string {
 	pathTemplate := i.path
 	for k, v := range i.substitutions {
-		// if the variable starts with a '.' then use the lookup table, else use the string literally
-		// this handles scenarios like:
-		// { $roomId: ".room_0", $eventType: "m.room.message" }
-		var valToEncode string
-		if v != "" && v[0] == '.' {
-			vint, ok := lookup.Load(strings.TrimPrefix(v, "."))
-			if ok {
-				valToEncode = vint.(string)
-			}
-		} else {
-			valToEncode = v
-		}
-		pathTemplate = strings.Replace(pathTemplate, k, url.PathEscape(valToEncode), -1)
+		pathTemplate = strings.Replace(pathTemplate, k, url.PathEscape(resolve(v, lookup)), -1)
 	}
 	return hsURL + pathTemplate
 }
 
+// resolve returns the value of a substitution or query parameter. If it starts with a '.' then it is looked up in
+// the lookup table, else it is used literally. This handles scenarios like:
+// { $roomId: ".room_0", $eventType: "m.room.message" }
+// Values escaped with literal are used literally even if they start with a '.'.
+func resolve(v string, lookup *sync.Map) string {
+	if strings.HasPrefix(v, `\`) {
+		return v[1:]
+	}
+	if strings.HasPrefix(v, ".") {
+		if vint, ok := lookup.Load(strings.TrimPrefix(v, ".")); ok {
+			return vint.(string)
+		}
+		return ""
+	}
+	return v
+}
+
+// literal escapes a value from a blueprint so resolve uses it literally, rather than looking it up if it starts
+// with a '.', e.g the push rule ID ".m.rule.master".
+func literal(v string) string {
+	if strings.HasPrefix(v, ".") || strings.HasPrefix(v, `\`) {
+		return `\` + v
+	}
+	return v
+}
+
 // calculateUserInstructionSets returns sets of HTTP requests to be executed in order. Sets can be executed in any order.
 func calculateUserInstructionSets(r *Runner, hs b.Homeserver) [][]instruction {
 	sets := make([][]instruction, r.userConcurrency)
@@ -402,9 +519,22 @@ func calculateUserInstructionSets(r *Runner, hs b.Homeserver) [][]instruction {
 		i := indexFor(user.Localpart, r.userConcurrency)
 		instrs := sets[i]
 
-		if createdUsers[user.Localpart] {
+		if user.Guest {
+			// guests can't log in, so always register a new guest
+			instrs = append(instrs, instructionRegisterGuest(hs, user))
+			if user.DisplayName != "" {
+				instrs = append(instrs, instructionDisplayName(hs, user))
+			}
+		} else if createdUsers[user.Localpart] {
 			// login instead as the device ID may be different
 			instrs = append(instrs, instructionLogin(hs, user))
+		} else if r.usersMayExist {
+			register := instructionRegister(hs, user)
+			register.allowedErrcode = "M_USER_IN_USE"
+			instrs = append(instrs, register, instructionLogin(hs, user))
+			if user.DisplayName != "" {
+				instrs = append(instrs, instructionDisplayName(hs, user))
+			}
 		} else {
 			instrs = append(instrs, instructionRegister(hs, user))
 			if user.DisplayName != "" {
@@ -414,7 +544,16 @@ func calculateUserInstructionSets(r *Runner, hs b.Homeserver) [][]instruction {
 		createdUsers[user.Localpart] = true
 
 		if user.OneTimeKeys > 0 {
-			instrs = append(instrs, instructionOneTimeKeyUpload(hs, user))
+			instrs = append(instrs, instructionKeyUpload(hs, user, *user.DeviceID, user.OneTimeKeys, "user_@"+user.Localpart+":"+hs.Name))
+		}
+		for _, dev := range user.Devices {
+			instrs = append(instrs, instructionsDevice(hs, user, dev)...)
+		}
+		for _, ad := range user.AccountData {
+			instrs = append(instrs, instructionAccountData(hs, user, ad))
+		}
+		for _, rule := range user.PushRules {
+			instrs = append(instrs, instructionsPushRule(hs, user, rule)...)
 		}
 		sets[i] = instrs
 	}
@@ -429,7 +568,8 @@ func calculateRoomInstructionSets(r *Runner, hs b.Homeserver) [][]instruction {
 
 	// add instructions to create rooms and send events
 	for roomIndex, room := range hs.Rooms {
-		setIndex := indexFor(fmt.Sprintf("%d", roomIndex), r.roomConcurrency)
+		// spread rooms evenly, as blueprints with thousands of rooms are only as quick as the biggest set
+		setIndex := roomIndex % r.roomConcurrency
 		instrs := sets[setIndex]
 		var queryParams = make(map[string]string)
 		if room.Creator != "" {
@@ -447,7 +587,7 @@ func calculateRoomInstructionSets(r *Runner, hs b.Homeserver) [][]instruction {
 				method:        "POST",
 				path:          "/_matrix/client/r0/createRoom",
 				accessToken:   "user_" + room.Creator,
-				body:          room.CreateRoom,
+				body:          room.CreateRoomBody(),
 				storeResponse: storeRes,
 			})
 		} else if room.Ref == "" {
@@ -459,20 +599,20 @@ func calculateRoomInstructionSets(r *Runner, hs b.Homeserver) [][]instruction {
 			var path string
 			subs := map[string]string{
 				"$roomId":    fmt.Sprintf(".room_%d", roomIndex),
-				"$eventType": event.Type,
+				"$eventType": literal(event.Type),
 			}
 			if room.Ref != "" {
 				subs["$roomId"] = fmt.Sprintf(".room_ref_%s", room.Ref)
 			}
 			if event.StateKey != nil {
 				path = "/_matrix/client/r0/rooms/$roomId/state/$eventType/$stateKey"
-				subs["$stateKey"] = *event.StateKey
+				subs["$stateKey"] = literal(*event.StateKey)
 			} else {
 				path = "/_matrix/client/r0/rooms/$roomId/send/$eventType/$txnId"
 				subs["$txnId"] = fmt.Sprintf("%d", eventIndex)
 			}
 
-			// special cases: room joining, leaving and inviting
+			// special cases: room joining, leaving, inviting, banning and knocking
 			if event.Type == "m.room.member" && event.StateKey != nil &&
 				event.Content != nil && event.Content["membership"] != nil {
 				membership, ok := event.Content["membership"].(string)
@@ -498,6 +638,14 @@ func calculateRoomInstructionSets(r *Runner, hs b.Homeserver) [][]instruction {
 						path = "/_matrix/client/r0/rooms/$roomId/invite"
 						method = "POST"
 						event.Content["user_id"] = *event.StateKey
+					case "ban":
+						path = "/_matrix/client/r0/rooms/$roomId/ban"
+						method = "POST"
+						event.Content["user_id"] = *event.StateKey
+					case "knock":
+						path = "/_matrix/client/v3/knock/$roomId"
+						method = "POST"
+						queryParams["server_name"] = fmt.Sprintf(".room_ref_%s_server_name", room.Ref)
 					}
 				}
 			} else if event.Type == "m.room.canonical_alias" && event.StateKey != nil &&
@@ -522,14 +670,30 @@ func calculateRoomInstructionSets(r *Runner, hs b.Homeserver) [][]instruction {
 					})
 				}
 			}
-			instrs = append(instrs, instruction{
+			instr := instruction{
 				method:        method,
 				path:          path,
 				body:          event.Content,
 				accessToken:   fmt.Sprintf("user_%s", event.Sender),
 				substitutions: subs,
 				queryParams:   queryParams,
-			})
+			}
+			senderHS := event.Sender[strings.Index(event.Sender, ":")+1:]
+			if senderHS != hs.Name {
+				instr.hsName = senderHS
+			}
+			if !event.Timestamp.IsZero() {
+				// only application services can set timestamps, so masquerade as the sender
+				instr.accessToken = "astoken_" + senderHS
+				instr.queryParams = map[string]string{
+					"user_id": event.Sender,
+					"ts":      strconv.FormatInt(event.Timestamp.UnixMilli(), 10),
+				}
+				for k, v := range queryParams {
+					instr.queryParams[k] = v
+				}
+			}
+			instrs = append(instrs, instr)
 		}
 		sets[setIndex] = instrs
 	}
@@ -537,6 +701,59 @@ func calculateRoomInstructionSets(r *Runner, hs b.Homeserver) [][]instruction {
 	return sets
 }
 
+// calculateUserRoomInstructionSets returns sets of HTTP requests which set up users' rooms, e.g tags, so must be
+// executed after the rooms are made. Sets can be executed in any order.
+func calculateUserRoomInstructionSets(r *Runner, hs b.Homeserver) [][]instruction {
+	sets := make([][]instruction, r.userConcurrency)
+	for _, user := range hs.Users {
+		i := indexFor(user.Localpart, r.userConcurrency)
+		for _, ad := range user.RoomAccountData {
+			sets[i] = append(sets[i], instructionRoomAccountData(hs, user, ad))
+		}
+		for _, tag := range user.Tags {
+			sets[i] = append(sets[i], instructionTag(hs, user, tag))
+		}
+	}
+	return sets
+}
+
+// calculateSpaceInstructionSets returns sets of HTTP requests which add the children of spaces, so must be executed
+// after the rooms are made. Sets can be executed in any order.
+func calculateSpaceInstructionSets(r *Runner, hs b.Homeserver) [][]instruction {
+	sets := make([][]instruction, r.roomConcurrency)
+	for roomIndex, room := range hs.Rooms {
+		setIndex := roomIndex % r.roomConcurrency
+		roomID := fmt.Sprintf(".room_%d", roomIndex)
+		if room.Ref != "" {
+			roomID = fmt.Sprintf(".room_ref_%s", room.Ref)
+		}
+		for _, child := range room.Children {
+			child := child
+			sets[setIndex] = append(sets[setIndex], instruction{
+				method:      "PUT",
+				path:        "/_matrix/client/r0/rooms/$roomId/state/m.space.child/$stateKey",
+				accessToken: "user_" + room.Creator,
+				substitutions: map[string]string{
+					"$roomId":   roomID,
+					"$stateKey": ".room_ref_" + child.Ref,
+				},
+				bodyFn: func(lk *sync.Map) interface{} {
+					via, _ := lk.Load(fmt.Sprintf("room_ref_%s_server_name", child.Ref))
+					content := map[string]interface{}{
+						"via":       []interface{}{via},
+						"suggested": child.Suggested,
+					}
+					if child.Order != "" {
+						content["order"] = child.Order
+					}
+					return content
+				},
+			})
+		}
+	}
+	return sets
+}
+
 func instructionRegister(hs b.Homeserver, user b.User) instruction {
 	body := map[string]interface{}{
 		"username": user.Localpart,
@@ -562,21 +779,133 @@ func instructionRegister(hs b.Homeserver, user b.User) instruction {
 	}
 }
 
+func instructionRegisterGuest(hs b.Homeserver, user b.User) instruction {
+	body := map[string]interface{}{}
+	if user.DeviceID != nil {
+		body["device_id"] = user.DeviceID
+	}
+
+	return instruction{
+		method:      "POST",
+		path:        "/_matrix/client/r0/register",
+		queryParams: map[string]string{"kind": "guest"},
+		accessToken: "",
+		body:        body,
+		storeResponse: map[string]string{
+			"user_@" + user.Localpart + ":" + hs.Name:   ".access_token",
+			"device_@" + user.Localpart + ":" + hs.Name: ".device_id",
+			"guest_@" + user.Localpart + ":" + hs.Name:  ".user_id",
+		},
+	}
+}
+
 func instructionDisplayName(hs b.Homeserver, user b.User) instruction {
 	body := map[string]interface{}{
 		"displayname": user.DisplayName,
 	}
+	userID := fmt.Sprintf("@%s:%s", user.Localpart, hs.Name)
+	substitutions := userSubstitutions(userID, user)
 	return instruction{
-		method: "PUT",
-		path: fmt.Sprintf(
-			"/_matrix/client/r0/profile/@%s:%s/displayname",
-			user.Localpart, hs.Name,
-		),
-		accessToken: fmt.Sprintf("user_@%s:%s", user.Localpart, hs.Name),
-		body:        body,
+		method:        "PUT",
+		path:          "/_matrix/client/r0/profile/$userID/displayname",
+		accessToken:   "user_" + userID,
+		body:          body,
+		substitutions: substitutions,
 	}
 }
 
+func instructionAccountData(hs b.Homeserver, user b.User, ad b.AccountData) instruction {
+	userID := fmt.Sprintf("@%s:%s", user.Localpart, hs.Name)
+	substitutions := userSubstitutions(userID, user)
+	substitutions["$type"] = literal(ad.Type)
+	return instruction{
+		method:        "PUT",
+		path:          "/_matrix/client/r0/user/$userID/account_data/$type",
+		accessToken:   "user_" + userID,
+		body:          ad.Value,
+		substitutions: substitutions,
+	}
+}
+
+func instructionRoomAccountData(hs b.Homeserver, user b.User, ad b.RoomAccountData) instruction {
+	userID := fmt.Sprintf("@%s:%s", user.Localpart, hs.Name)
+	substitutions := userSubstitutions(userID, user)
+	substitutions["$roomId"] = ".room_ref_" + ad.Room
+	substitutions["$type"] = literal(ad.Type)
+	return instruction{
+		method:        "PUT",
+		path:          "/_matrix/client/r0/user/$userID/rooms/$roomId/account_data/$type",
+		accessToken:   "user_" + userID,
+		body:          ad.Value,
+		substitutions: substitutions,
+	}
+}
+
+func instructionTag(hs b.Homeserver, user b.User, tag b.Tag) instruction {
+	userID := fmt.Sprintf("@%s:%s", user.Localpart, hs.Name)
+	substitutions := userSubstitutions(userID, user)
+	substitutions["$roomId"] = ".room_ref_" + tag.Room
+	substitutions["$tag"] = literal(tag.Tag)
+	body := map[string]interface{}{}
+	if tag.Order != nil {
+		body["order"] = *tag.Order
+	}
+	return instruction{
+		method:        "PUT",
+		path:          "/_matrix/client/r0/user/$userID/rooms/$roomId/tags/$tag",
+		accessToken:   "user_" + userID,
+		body:          body,
+		substitutions: substitutions,
+	}
+}
+
+// instructionsPushRule returns the requests to add the push rule, then change its actions and whether it is enabled.
+func instructionsPushRule(hs b.Homeserver, user b.User, rule b.PushRule) []instruction {
+	accessToken := fmt.Sprintf("user_@%s:%s", user.Localpart, hs.Name)
+	substitutions := map[string]string{
+		"$kind":   literal(rule.Kind),
+		"$ruleId": literal(rule.RuleID),
+	}
+	var instrs []instruction
+	if rule.Rule != nil {
+		instrs = append(instrs, instruction{
+			method:        "PUT",
+			path:          "/_matrix/client/r0/pushrules/global/$kind/$ruleId",
+			accessToken:   accessToken,
+			body:          rule.Rule,
+			substitutions: substitutions,
+		})
+	}
+	if rule.Actions != nil {
+		instrs = append(instrs, instruction{
+			method:        "PUT",
+			path:          "/_matrix/client/r0/pushrules/global/$kind/$ruleId/actions",
+			accessToken:   accessToken,
+			body:          map[string]interface{}{"actions": rule.Actions},
+			substitutions: substitutions,
+		})
+	}
+	if rule.Enabled != nil {
+		instrs = append(instrs, instruction{
+			method:        "PUT",
+			path:          "/_matrix/client/r0/pushrules/global/$kind/$ruleId/enabled",
+			accessToken:   accessToken,
+			body:          map[string]interface{}{"enabled": *rule.Enabled},
+			substitutions: substitutions,
+		})
+	}
+	return instrs
+}
+
+// userSubstitutions returns the substitutions for $userID in a path, which is looked up for guests as they
+// are given a user ID by the server.
+func userSubstitutions(userID string, user b.User) map[string]string {
+	if user.Guest {
+		return map[string]string{"$userID": ".guest_" + userID}
+	}
+	return map[string]string{"$userID": userID}
+}
+
 func instructionLogin(hs b.Homeserver, user b.User) instruction {
 	body := map[string]interface{}{
 		"type":     "m.login.password",
@@ -603,12 +932,49 @@ func instructionLogin(hs b.Homeserver, user b.User) instruction {
 	}
 }
 
-func instructionOneTimeKeyUpload(hs b.Homeserver, user b.User) instruction {
+// instructionsDevice returns the requests to log `user` in on `dev`, then name it and upload its keys.
+func instructionsDevice(hs b.Homeserver, user b.User, dev b.Device) []instruction {
+	userID := fmt.Sprintf("@%s:%s", user.Localpart, hs.Name)
+	tokenKey := "devicetoken_" + userID + "|" + dev.ID
+	instrs := []instruction{
+		{
+			method: "POST",
+			path:   "/_matrix/client/r0/login",
+			body: map[string]interface{}{
+				"type":      "m.login.password",
+				"user":      user.Localpart,
+				"password":  "complement_meets_min_pasword_req_" + user.Localpart,
+				"device_id": dev.ID,
+			},
+			storeResponse: map[string]string{
+				tokenKey: ".access_token",
+			},
+		},
+	}
+	if dev.DisplayName != "" {
+		instrs = append(instrs, instruction{
+			method:      "PUT",
+			path:        "/_matrix/client/r0/devices/$deviceId",
+			accessToken: tokenKey,
+			body: map[string]interface{}{
+				"display_name": dev.DisplayName,
+			},
+			substitutions: map[string]string{"$deviceId": literal(dev.ID)},
+		})
+	}
+	if dev.Keys || dev.OneTimeKeys > 0 {
+		instrs = append(instrs, instructionKeyUpload(hs, user, dev.ID, dev.OneTimeKeys, tokenKey))
+	}
+	return instrs
+}
+
+// instructionKeyUpload returns a request to upload new device keys and `oneTimeKeys` one-time keys for the
+// device `deviceID`, using the access token stored under `accessToken`.
+func instructionKeyUpload(hs b.Homeserver, user b.User, deviceID string, oneTimeKeys uint, accessToken string) instruction {
 	account := olm.NewAccount()
 	ed25519Key, curveKey := account.IdentityKeys()
 
 	userID := fmt.Sprintf("@%s:%s", user.Localpart, hs.Name)
-	deviceID := *user.DeviceID
 
 	ed25519KeyID := fmt.Sprintf("ed25519:%s", deviceID)
 	curveKeyID := fmt.Sprintf("curve25519:%s", deviceID)
@@ -631,9 +997,9 @@ func instructionOneTimeKeyUpload(hs b.Homeserver, user b.User) instruction {
 		},
 	}
 
-	account.GenOneTimeKeys(user.OneTimeKeys)
+	account.GenOneTimeKeys(oneTimeKeys)
 
-	oneTimeKeys := map[string]interface{}{}
+	otks := map[string]interface{}{}
 
 	for kid, key := range account.OneTimeKeys() {
 		keyID := fmt.Sprintf("signed_curve25519:%s", kid)
@@ -649,19 +1015,84 @@ func instructionOneTimeKeyUpload(hs b.Homeserver, user b.User) instruction {
 			},
 		}
 
-		oneTimeKeys[keyID] = keyMap
+		otks[keyID] = keyMap
 	}
 	return instruction{
 		method:      "POST",
 		path:        "/_matrix/client/r0/keys/upload",
-		accessToken: fmt.Sprintf("user_@%s:%s", user.Localpart, hs.Name),
+		accessToken: accessToken,
 		body: map[string]interface{}{
 			"device_keys":   deviceKeys,
-			"one_time_keys": oneTimeKeys,
+			"one_time_keys": otks,
 		},
 	}
 }
 
+// stepPlaceholder matches the placeholders in steps, e.g {room:main} or {backup}
+var stepPlaceholder = regexp.MustCompile(`\{([^{}]+)\}`)
+
+// stepLookupKey returns the lookup key of the value of a placeholder in a step.
+func stepLookupKey(placeholder string) string {
+	name := strings.Trim(placeholder, "{}")
+	if strings.HasPrefix(name, "room:") {
+		return "room_ref_" + strings.TrimPrefix(name, "room:")
+	}
+	return "step_" + name
+}
+
+func instructionStep(step b.Step) instruction {
+	subs := make(map[string]string)
+	for _, placeholder := range stepPlaceholder.FindAllString(step.Path, -1) {
+		subs[placeholder] = "." + stepLookupKey(placeholder)
+	}
+	storeRes := make(map[string]string)
+	for name, path := range step.Store {
+		storeRes["step_"+name] = "." + path
+	}
+	instr := instruction{
+		method:        step.Method,
+		path:          step.Path,
+		substitutions: subs,
+		storeResponse: storeRes,
+	}
+	if step.User != "" {
+		instr.accessToken = "user_" + step.User
+	}
+	if step.Body != nil {
+		instr.bodyFn = func(lk *sync.Map) interface{} {
+			return resolveStepValue(step.Body, lk)
+		}
+	}
+	return instr
+}
+
+// resolveStepValue returns a copy of `v` with the placeholders in its strings replaced.
+func resolveStepValue(v interface{}, lk *sync.Map) interface{} {
+	switch val := v.(type) {
+	case string:
+		return stepPlaceholder.ReplaceAllStringFunc(val, func(placeholder string) string {
+			resolved, ok := lk.Load(stepLookupKey(placeholder))
+			if !ok {
+				return placeholder
+			}
+			return resolved.(string)
+		})
+	case map[string]interface{}:
+		res := make(map[string]interface{}, len(val))
+		for k, elem := range val {
+			res[k] = resolveStepValue(elem, lk)
+		}
+		return res
+	case []interface{}:
+		res := make([]interface{}, len(val))
+		for i, elem := range val {
+			res[i] = resolveStepValue(elem, lk)
+		}
+		return res
+	}
+	return v
+}
+
 // indexFor hashes the input and returns a number % numEntries
 func indexFor(input string, numEntries int) int {
 	hh := fnv.New32a()
@@ -0,0 +1,241 @@
+package instruction
+
+import (
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/complement/internal/b"
+)
+
+func TestResolve(t *testing.T) {
+	lookup := &sync.Map{}
+	lookup.Store("room_0", "!abc:hs1")
+	testCases := []struct {
+		value string
+		want  string
+	}{
+		{".room_0", "!abc:hs1"},
+		{".missing", ""},
+		{"m.room.message", "m.room.message"},
+		{literal(".m.rule.master"), ".m.rule.master"},
+		{literal(`\odd`), `\odd`},
+		{literal("m.room.message"), "m.room.message"},
+		{"", ""},
+	}
+	for _, tc := range testCases {
+		if got := resolve(tc.value, lookup); got != tc.want {
+			t.Errorf("resolve(%q) = %q, want %q", tc.value, got, tc.want)
+		}
+	}
+}
+
+func TestInstructionURLsOfDottedValues(t *testing.T) {
+	hs := b.Homeserver{Name: "hs1"}
+	alice := b.User{Localpart: "alice"}
+	enabled := false
+	lookup := &sync.Map{}
+	lookup.Store("room_ref_room", "!room:hs1")
+	testCases := []struct {
+		name  string
+		instr instruction
+		want  string
+	}{
+		{
+			name: "default push rule",
+			instr: instructionsPushRule(hs, alice, b.PushRule{
+				Kind:    "override",
+				RuleID:  ".m.rule.master",
+				Enabled: &enabled,
+			})[0],
+			want: "http://hs1/_matrix/client/r0/pushrules/global/override/.m.rule.master/enabled",
+		},
+		{
+			name:  "account data",
+			instr: instructionAccountData(hs, alice, b.AccountData{Type: ".hidden"}),
+			want:  "http://hs1/_matrix/client/r0/user/@alice:hs1/account_data/.hidden",
+		},
+		{
+			name:  "room account data",
+			instr: instructionRoomAccountData(hs, alice, b.RoomAccountData{Room: "room", Type: ".hidden"}),
+			want:  "http://hs1/_matrix/client/r0/user/@alice:hs1/rooms/%21room:hs1/account_data/.hidden",
+		},
+	}
+	for _, tc := range testCases {
+		if got := tc.instr.url("http://hs1", lookup); got != tc.want {
+			t.Errorf("%s: got URL %s, want %s", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestRoomInstructionSetsAreEven(t *testing.T) {
+	bp := b.GenerateBlueprint(b.GenerateOpts{Users: 10, RoomsPerUser: 1})
+	testCases := []struct {
+		concurrency int
+		wantSets    int
+		wantRooms   []int // the number of rooms in each set
+	}{
+		{concurrency: 0, wantSets: 40, wantRooms: []int{1, 1, 1, 1, 1, 1, 1, 1, 1, 1}},
+		{concurrency: 3, wantSets: 3, wantRooms: []int{4, 3, 3}},
+		{concurrency: 10, wantSets: 10, wantRooms: []int{1, 1, 1, 1, 1, 1, 1, 1, 1, 1}},
+	}
+	for _, tc := range testCases {
+		r := NewRunner(bp.Name, false, false)
+		r.SetRoomConcurrency(tc.concurrency)
+		sets := calculateRoomInstructionSets(r, bp.Homeservers[0])
+		if len(sets) != tc.wantSets {
+			t.Errorf("concurrency %d: got %d sets want %d", tc.concurrency, len(sets), tc.wantSets)
+			continue
+		}
+		for i, want := range tc.wantRooms {
+			got := 0
+			for _, instr := range sets[i] {
+				if strings.HasSuffix(instr.path, "/createRoom") {
+					got++
+				}
+			}
+			if got != want {
+				t.Errorf("concurrency %d: set %d creates %d rooms want %d", tc.concurrency, i, got, want)
+			}
+		}
+	}
+}
+
+func TestRoomInstructionsWithTimestamps(t *testing.T) {
+	bp := b.MustValidate(b.Blueprint{
+		Name: "timestamps",
+		Homeservers: []b.Homeserver{
+			{
+				Name:                "hs1",
+				Users:               []b.User{{Localpart: "@alice"}},
+				ApplicationServices: []b.ApplicationService{{ID: "as", SenderLocalpart: "bot"}},
+			},
+			{
+				Name:  "hs2",
+				Users: []b.User{{Localpart: "@bob"}},
+				Rooms: []b.Room{
+					{
+						Ref:     "room",
+						Creator: "@bob",
+						Events: []b.Event{
+							{Type: "m.room.message", Sender: "@bob", Content: map[string]interface{}{"body": "now"}},
+							{Type: "m.room.message", Sender: "@alice:hs1", Content: map[string]interface{}{"body": "then"}, Timestamp: time.Unix(1600000000, 5000000)},
+						},
+					},
+				},
+			},
+		},
+	})
+	r := NewRunner(bp.Name, false, false)
+	r.SetRoomConcurrency(1)
+	instrs := calculateRoomInstructionSets(r, bp.Homeservers[1])[0]
+	testCases := []struct {
+		instr           instruction
+		wantAccessToken string
+		wantHSName      string
+		wantQuery       map[string]string
+	}{
+		{
+			instr:           instrs[1],
+			wantAccessToken: "user_@bob:hs2",
+			wantQuery:       map[string]string{},
+		},
+		{
+			instr:           instrs[2],
+			wantAccessToken: "astoken_hs1",
+			wantHSName:      "hs1",
+			wantQuery:       map[string]string{"user_id": "@alice:hs1", "ts": "1600000000005"},
+		},
+	}
+	for i, tc := range testCases {
+		if tc.instr.accessToken != tc.wantAccessToken {
+			t.Errorf("event %d: got access token %s want %s", i, tc.instr.accessToken, tc.wantAccessToken)
+		}
+		if tc.instr.hsName != tc.wantHSName {
+			t.Errorf("event %d: sent through %q want %q", i, tc.instr.hsName, tc.wantHSName)
+		}
+		if !reflect.DeepEqual(tc.instr.queryParams, tc.wantQuery) {
+			t.Errorf("event %d: got query %v want %v", i, tc.instr.queryParams, tc.wantQuery)
+		}
+	}
+}
+
+func TestRoomInstructionsForMemberships(t *testing.T) {
+	testCases := []struct {
+		event      b.Event
+		wantMethod string
+		wantPath   string
+		wantBody   map[string]interface{}
+	}{
+		{
+			event:      b.Join("@bob"),
+			wantMethod: "POST",
+			wantPath:   "/_matrix/client/r0/join/$roomId",
+			wantBody:   map[string]interface{}{"membership": "join"},
+		},
+		{
+			event:      b.Leave("@bob"),
+			wantMethod: "POST",
+			wantPath:   "/_matrix/client/r0/rooms/$roomId/leave",
+			wantBody:   map[string]interface{}{"membership": "leave"},
+		},
+		{
+			event:      b.Invite("@alice", "@bob"),
+			wantMethod: "POST",
+			wantPath:   "/_matrix/client/r0/rooms/$roomId/invite",
+			wantBody:   map[string]interface{}{"membership": "invite", "user_id": "@bob:hs1"},
+		},
+		{
+			event:      b.Kick("@alice", "@bob"),
+			wantMethod: "POST",
+			wantPath:   "/_matrix/client/r0/rooms/$roomId/kick",
+			wantBody:   map[string]interface{}{"membership": "leave", "user_id": "@bob:hs1"},
+		},
+		{
+			event:      b.Ban("@alice", "@bob", "spam"),
+			wantMethod: "POST",
+			wantPath:   "/_matrix/client/r0/rooms/$roomId/ban",
+			wantBody:   map[string]interface{}{"membership": "ban", "user_id": "@bob:hs1", "reason": "spam"},
+		},
+		{
+			event:      b.Ban("@alice", "@bob", ""),
+			wantMethod: "POST",
+			wantPath:   "/_matrix/client/r0/rooms/$roomId/ban",
+			wantBody:   map[string]interface{}{"membership": "ban", "user_id": "@bob:hs1"},
+		},
+		{
+			event:      b.Knock("@bob"),
+			wantMethod: "POST",
+			wantPath:   "/_matrix/client/v3/knock/$roomId",
+			wantBody:   map[string]interface{}{"membership": "knock"},
+		},
+	}
+	for _, tc := range testCases {
+		bp := b.MustValidate(b.Blueprint{
+			Name: "memberships",
+			Homeservers: []b.Homeserver{
+				{
+					Name:  "hs1",
+					Users: []b.User{{Localpart: "@alice"}, {Localpart: "@bob"}},
+					Rooms: []b.Room{{Ref: "room", Creator: "@alice", Events: []b.Event{tc.event}}},
+				},
+			},
+		})
+		r := NewRunner(bp.Name, false, false)
+		r.SetRoomConcurrency(1)
+		instrs := calculateRoomInstructionSets(r, bp.Homeservers[0])[0]
+		if len(instrs) != 2 {
+			t.Errorf("%s: got %d instructions, want to create the room and send the event", tc.wantPath, len(instrs))
+			continue
+		}
+		instr := instrs[1]
+		if instr.method != tc.wantMethod || instr.path != tc.wantPath {
+			t.Errorf("got %s %s want %s %s", instr.method, instr.path, tc.wantMethod, tc.wantPath)
+		}
+		if !reflect.DeepEqual(instr.body, tc.wantBody) {
+			t.Errorf("%s: got body %v want %v", tc.wantPath, instr.body, tc.wantBody)
+		}
+	}
+}
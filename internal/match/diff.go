@@ -0,0 +1,221 @@
+package match
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/tidwall/gjson"
+)
+
+// The number of lines shown either side of the failing key by Diff.
+const diffContextLines = 8
+
+// KeyError is returned by the matchers which check a single key, so that Diff can show where the key is
+// in the body.
+type KeyError struct {
+	// The gjson path of the key which didn't match.
+	Key string
+	// The value the matcher wanted, or nil if it wanted something other than a particular value.
+	Want interface{}
+	msg  string
+}
+
+func (e *KeyError) Error() string {
+	return e.msg
+}
+
+func keyError(key string, want interface{}, format string, args ...interface{}) error {
+	return &KeyError{
+		Key:  key,
+		Want: want,
+		msg:  fmt.Sprintf(format, args...),
+	}
+}
+
+// elementError returns `err`, from a matcher run on the element `elem` (an array index or object key) of the
+// array or object at the gjson path `key`, with the key of the KeyError in it, if any, made relative to the
+// whole body instead of the element, so Diff shows where the element is.
+func elementError(err error, key, elem string) error {
+	var keyErr *KeyError
+	if !errors.As(err, &keyErr) {
+		return err
+	}
+	path := joinGJSONPath([]string{elem})
+	if key != "" {
+		path = key + "." + path
+	}
+	if keyErr.Key != "" {
+		path += "." + keyErr.Key
+	}
+	keyErr.Key = path
+	return err
+}
+
+// Diff returns a readable explanation of why `body` failed a matcher with `err`, for use in test failures.
+// If the error came from a matcher which checks a single key, this shows the wanted and actual values of the
+// key, and the object or array containing it with the key marked, e.g
+//
+//	key 'content.body' got 'hi' want 'hello'
+//	  - want: "hello"
+//	  + got:  "hi"
+//	in 'content':
+//	    {
+//	  >   "body": "hi",
+//	      "msgtype": "m.text"
+//	    }
+//
+// Otherwise it returns the error and the indented body.
+func Diff(body []byte, err error) string {
+	var keyErr *KeyError
+	if !errors.As(err, &keyErr) {
+		return fmt.Sprintf("%s\nbody:\n%s", err, indentLines(prettyJSON(body), -1))
+	}
+	var sb strings.Builder
+	sb.WriteString(err.Error())
+	got := gjson.GetBytes(body, keyErr.Key)
+	if keyErr.Want != nil {
+		want, _ := json.Marshal(keyErr.Want)
+		fmt.Fprintf(&sb, "\n  - want: %s", want)
+	}
+	if got.Exists() {
+		fmt.Fprintf(&sb, "\n  + got:  %s", got.Raw)
+	} else {
+		sb.WriteString("\n  + got:  <missing>")
+	}
+	parts, ok := splitPath(keyErr.Key)
+	if !ok {
+		// queries and modifiers don't point at one place in the body
+		fmt.Fprintf(&sb, "\nbody:\n%s", indentLines(prettyJSON(body), -1))
+		return sb.String()
+	}
+	// show the closest enclosing object or array which exists, marking the key if it is in it
+	marked := ""
+	if got.Exists() && len(parts) > 0 {
+		marked = parts[len(parts)-1]
+	}
+	parts = parts[:len(parts)-1]
+	for {
+		parent := gjson.ParseBytes(body)
+		if len(parts) > 0 {
+			parent = gjson.GetBytes(body, joinGJSONPath(parts))
+		}
+		if parent.Exists() {
+			name := "body"
+			if len(parts) > 0 {
+				name = "'" + joinGJSONPath(parts) + "'"
+			}
+			lines := prettyJSON([]byte(parent.Raw))
+			fmt.Fprintf(&sb, "\nin %s:\n%s", name, indentLines(lines, markedLine(lines, parent, marked)))
+			return sb.String()
+		}
+		if len(parts) == 0 {
+			return sb.String()
+		}
+		marked = ""
+		parts = parts[:len(parts)-1]
+	}
+}
+
+// splitPath splits a gjson path into its keys, returning false if it uses anything other than keys and
+// array indexes.
+func splitPath(path string) ([]string, bool) {
+	var parts []string
+	var current strings.Builder
+	escaped := false
+	for _, c := range path {
+		switch {
+		case escaped:
+			current.WriteRune(c)
+			escaped = false
+		case c == '\\':
+			escaped = true
+		case c == '.':
+			parts = append(parts, current.String())
+			current.Reset()
+		case c == '#' || c == '*' || c == '?' || c == '|' || c == '@':
+			return nil, false
+		default:
+			current.WriteRune(c)
+		}
+	}
+	return append(parts, current.String()), true
+}
+
+func joinGJSONPath(parts []string) string {
+	escaped := make([]string, len(parts))
+	for i, p := range parts {
+		escaped[i] = strings.ReplaceAll(p, ".", `\.`)
+	}
+	return strings.Join(escaped, ".")
+}
+
+func prettyJSON(raw []byte) []string {
+	var buf bytes.Buffer
+	if err := json.Indent(&buf, raw, "", "  "); err != nil {
+		return []string{string(raw)}
+	}
+	return strings.Split(buf.String(), "\n")
+}
+
+// markedLine returns the line of the pretty printed `parent` where its child `key` starts, or -1.
+func markedLine(lines []string, parent gjson.Result, key string) int {
+	if key == "" {
+		return -1
+	}
+	if parent.IsObject() {
+		keyJSON, _ := json.Marshal(key)
+		for i, line := range lines {
+			if strings.HasPrefix(line, "  "+string(keyJSON)+":") {
+				return i
+			}
+		}
+		return -1
+	}
+	index, err := strconv.Atoi(key)
+	if err != nil || !parent.IsArray() {
+		return -1
+	}
+	// elements start on lines indented once, other than the ends of multi-line elements
+	for i, line := range lines {
+		if len(line) > 2 && line[:2] == "  " && line[2] != ' ' && line[2] != '}' && line[2] != ']' {
+			if index == 0 {
+				return i
+			}
+			index--
+		}
+	}
+	return -1
+}
+
+// indentLines indents the lines, prefixing the line `mark` with '>', and cuts them down to the lines around
+// it. Nothing is marked if `mark` is -1.
+func indentLines(lines []string, mark int) string {
+	start, end := 0, len(lines)
+	if mark >= 0 {
+		if mark-diffContextLines > start {
+			start = mark - diffContextLines
+		}
+		if mark+diffContextLines+1 < end {
+			end = mark + diffContextLines + 1
+		}
+	}
+	var sb strings.Builder
+	if start > 0 {
+		fmt.Fprintf(&sb, "      ... %d lines\n", start)
+	}
+	for i := start; i < end; i++ {
+		prefix := "    "
+		if i == mark {
+			prefix = "  > "
+		}
+		sb.WriteString(prefix + lines[i] + "\n")
+	}
+	if end < len(lines) {
+		fmt.Fprintf(&sb, "      ... %d lines\n", len(lines)-end)
+	}
+	return strings.TrimSuffix(sb.String(), "\n")
+}
@@ -0,0 +1,245 @@
+package match
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/tidwall/gjson"
+)
+
+func TestSplitPath(t *testing.T) {
+	testCases := []struct {
+		path   string
+		want   []string
+		wantOK bool
+	}{
+		{path: "content", want: []string{"content"}, wantOK: true},
+		{path: "content.body", want: []string{"content", "body"}, wantOK: true},
+		{path: "rooms.3.name", want: []string{"rooms", "3", "name"}, wantOK: true},
+		{path: `content.m\.relates_to.rel_type`, want: []string{"content", "m.relates_to", "rel_type"}, wantOK: true},
+		{path: `a\\b`, want: []string{`a\b`}, wantOK: true},
+		{path: "chunk.#", wantOK: false},
+		{path: `chunk.#(type=="m.room.member")`, wantOK: false},
+		{path: "ro*ms", wantOK: false},
+		{path: "name|@reverse", wantOK: false},
+	}
+	for _, tc := range testCases {
+		got, ok := splitPath(tc.path)
+		if ok != tc.wantOK {
+			t.Errorf("splitPath(%s): got ok=%v want %v", tc.path, ok, tc.wantOK)
+			continue
+		}
+		if ok && !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("splitPath(%s): got %q want %q", tc.path, got, tc.want)
+		}
+		// escaped keys survive a round trip
+		if ok && joinGJSONPath(got) != tc.path && !strings.Contains(tc.path, `\\`) {
+			t.Errorf("joinGJSONPath(%q): got %s want %s", got, joinGJSONPath(got), tc.path)
+		}
+	}
+}
+
+func TestMarkedLine(t *testing.T) {
+	object := gjson.Parse(`{"body":"hi","m.relates_to":{"rel_type":"m.thread"},"quote\"d":1}`)
+	array := gjson.Parse(`[{"a":1,"b":[1,2]},"x",[3],{}]`)
+	testCases := []struct {
+		name   string
+		parent gjson.Result
+		key    string
+		want   string
+	}{
+		{name: "object key", parent: object, key: "body", want: `  "body": "hi",`},
+		{name: "object key with a dot", parent: object, key: "m.relates_to", want: `  "m.relates_to": {`},
+		{name: "object key with a quote", parent: object, key: `quote"d`, want: `  "quote\"d": 1`},
+		{name: "nested key isn't matched", parent: object, key: "rel_type"},
+		{name: "missing key", parent: object, key: "missing"},
+		{name: "no key", parent: object, key: ""},
+		{name: "first element", parent: array, key: "0", want: "  {"},
+		{name: "element after a multi-line element", parent: array, key: "1", want: `  "x",`},
+		{name: "array element", parent: array, key: "2", want: "  ["},
+		{name: "last element", parent: array, key: "3", want: "  {}"},
+		{name: "index out of range", parent: array, key: "4"},
+		{name: "index on object", parent: object, key: "0"},
+		{name: "key on array", parent: array, key: "body"},
+	}
+	for _, tc := range testCases {
+		lines := prettyJSON([]byte(tc.parent.Raw))
+		got := ""
+		if i := markedLine(lines, tc.parent, tc.key); i != -1 {
+			got = lines[i]
+		}
+		if got != tc.want {
+			t.Errorf("%s: marked %q want %q", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestDiff(t *testing.T) {
+	event := []byte(`{"content":{"body":"hi","m.relates_to":{"rel_type":"m.thread"}},"type":"m.room.message"}`)
+	rooms := []byte(`{"rooms":[{"room_id":"!a","name":"A"},{"room_id":"!b","name":"Wrong"}]}`)
+	nameOf := func(roomID, name string) func(r gjson.Result) error {
+		return func(r gjson.Result) error {
+			if r.Get("room_id").Str == roomID {
+				return JSONKeyEqual("name", name)([]byte(r.Raw))
+			}
+			return nil
+		}
+	}
+	testCases := []struct {
+		name  string
+		body  []byte
+		check JSON
+		want  string
+	}{
+		{
+			name:  "key",
+			body:  event,
+			check: JSONKeyEqual("content.body", "hello"),
+			want: `key 'content.body' got 'hi' want 'hello'
+  - want: "hello"
+  + got:  "hi"
+in 'content':
+    {
+  >   "body": "hi",
+      "m.relates_to": {
+        "rel_type": "m.thread"
+      }
+    }`,
+		},
+		{
+			name:  "escaped key",
+			body:  event,
+			check: JSONKeyEqual(`content.m\.relates_to.rel_type`, "m.reference"),
+			want: `key 'content.m\.relates_to.rel_type' got 'm.thread' want 'm.reference'
+  - want: "m.reference"
+  + got:  "m.thread"
+in 'content.m\.relates_to':
+    {
+  >   "rel_type": "m.thread"
+    }`,
+		},
+		{
+			name:  "missing key shows the closest parent",
+			body:  event,
+			check: JSONKeyPresent("content.m\\.new_content.body"),
+			want: `key 'content.m\.new_content.body' missing
+  + got:  <missing>
+in 'content':
+    {
+      "body": "hi",
+      "m.relates_to": {
+        "rel_type": "m.thread"
+      }
+    }`,
+		},
+		{
+			name:  "array element",
+			body:  rooms,
+			check: JSONKeyEqual("rooms.1.name", "B"),
+			want: `key 'rooms.1.name' got 'Wrong' want 'B'
+  - want: "B"
+  + got:  "Wrong"
+in 'rooms.1':
+    {
+      "room_id": "!b",
+  >   "name": "Wrong"
+    }`,
+		},
+		{
+			// as in tests/federation_spaces_test.go, the key is relative to the element the matcher ran on
+			name:  "nested in JSONArrayEach",
+			body:  rooms,
+			check: JSONArrayEach("rooms", nameOf("!b", "Remote room")),
+			want: `key 'name' got 'Wrong' want 'Remote room'
+  - want: "Remote room"
+  + got:  "Wrong"
+in 'rooms.1':
+    {
+      "room_id": "!b",
+  >   "name": "Wrong"
+    }`,
+		},
+		{
+			name: "nested in JSONMapEach",
+			body: []byte(`{"rooms":{"!a:hs1":{"name":"A"},"!b.c:hs1":{"name":"Wrong"}}}`),
+			check: JSONMapEach("rooms", func(k, v gjson.Result) error {
+				return JSONKeyEqual("name", strings.ToUpper(k.Str[1:2]))([]byte(v.Raw))
+			}),
+			want: `key 'name' got 'Wrong' want 'B'
+  - want: "B"
+  + got:  "Wrong"
+in 'rooms.!b\.c:hs1':
+    {
+  >   "name": "Wrong"
+    }`,
+		},
+		{
+			name: "nested in JSONCheckOff",
+			body: rooms,
+			check: JSONCheckOff("rooms", []interface{}{"!a", "!b"}, func(r gjson.Result) interface{} {
+				return r.Get("room_id").Str
+			}, func(roomID interface{}, r gjson.Result) error {
+				return nameOf("!b", "B")(r)
+			}),
+			want: `key 'name' got 'Wrong' want 'B'
+  - want: "B"
+  + got:  "Wrong"
+in 'rooms.1':
+    {
+      "room_id": "!b",
+  >   "name": "Wrong"
+    }`,
+		},
+		{
+			name: "nested twice",
+			body: []byte(`[{"events":[{"type":"m.room.create"},{"type":"m.room.member"}]}]`),
+			check: JSONArrayEach("", func(r gjson.Result) error {
+				return JSONArrayEach("events", func(ev gjson.Result) error {
+					return JSONKeyPresent("state_key")([]byte(ev.Raw))
+				})([]byte(r.Raw))
+			}),
+			want: `key 'state_key' missing
+  + got:  <missing>
+in '0.events.0':
+    {
+      "type": "m.room.create"
+    }`,
+		},
+		{
+			name:  "other errors show the body",
+			body:  []byte(`{"a":1}`),
+			check: func(body []byte) error { return fmt.Errorf("bad") },
+			want: `bad
+body:
+    {
+      "a": 1
+    }`,
+		},
+		{
+			name:  "queries show the body",
+			body:  []byte(`{"a":[1]}`),
+			check: JSONKeyEqual("a.#", 2),
+			want: `key 'a.#' got '1' want '2'
+  - want: 2
+  + got:  1
+body:
+    {
+      "a": [
+        1
+      ]
+    }`,
+		},
+	}
+	for _, tc := range testCases {
+		err := tc.check(tc.body)
+		if err == nil {
+			t.Errorf("%s: check passed", tc.name)
+			continue
+		}
+		if got := Diff(tc.body, err); got != tc.want {
+			t.Errorf("%s: got diff:\n%s\nwant:\n%s", tc.name, got, tc.want)
+		}
+	}
+}
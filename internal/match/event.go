@@ -0,0 +1,146 @@
+package match
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"regexp"
+
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/tidwall/gjson"
+	"github.com/tidwall/sjson"
+)
+
+// The formats of event IDs, by room version.
+var eventIDFormats = map[gomatrixserverlib.EventIDFormat]*regexp.Regexp{
+	gomatrixserverlib.EventIDFormatV1: regexp.MustCompile(`^\$[^:]+:.+$`),
+	gomatrixserverlib.EventIDFormatV2: regexp.MustCompile(`^\$[A-Za-z0-9+/]{43}$`),
+	gomatrixserverlib.EventIDFormatV3: regexp.MustCompile(`^\$[A-Za-z0-9_-]{43}$`),
+}
+
+// JSONEventValid returns a matcher which will check that the event at `wantKey`, or the whole body if it
+// is "@this", is well-formed for `roomVersion`. Both the client format of events, e.g from /event, and the
+// federation format (PDUs), which has a `hashes` key, are checked.
+//
+// Client events must have an event ID in the format of the room version, a sender, type, timestamp and
+// content. PDUs must be canonical JSON if the room version requires it, have valid IDs and content which
+// matches its hash, and, if `verifier` is not nil, valid signatures from the servers which must sign them,
+// e.g using federation.Server.KeyRing(). In both formats, redacted events must have only the content the
+// room version keeps on redaction.
+func JSONEventValid(wantKey string, roomVersion gomatrixserverlib.RoomVersion, verifier gomatrixserverlib.JSONVerifier) JSON {
+	return func(body []byte) error {
+		res := gjson.GetBytes(body, wantKey)
+		if !res.Exists() {
+			return keyError(wantKey, nil, "key '%s' missing", wantKey)
+		}
+		if !res.IsObject() {
+			return keyError(wantKey, nil, "key '%s' is not an object", wantKey)
+		}
+		var err error
+		if res.Get("hashes").Exists() {
+			err = checkPDU([]byte(res.Raw), roomVersion, verifier)
+		} else {
+			err = checkClientEvent([]byte(res.Raw), roomVersion)
+		}
+		if err != nil {
+			return keyError(wantKey, nil, "key '%s' is not a valid room version %s event: %s", wantKey, roomVersion, err)
+		}
+		return nil
+	}
+}
+
+func checkEventIDFormat(eventID string, roomVersion gomatrixserverlib.RoomVersion) error {
+	format, err := roomVersion.EventIDFormat()
+	if err != nil {
+		return err
+	}
+	if !eventIDFormats[format].MatchString(eventID) {
+		return fmt.Errorf("event ID '%s' has the wrong format", eventID)
+	}
+	return nil
+}
+
+func checkClientEvent(eventJSON []byte, roomVersion gomatrixserverlib.RoomVersion) error {
+	for _, key := range []string{"event_id", "sender", "type"} {
+		if gjson.GetBytes(eventJSON, key).Type != gjson.String {
+			return fmt.Errorf("'%s' is missing or not a string", key)
+		}
+	}
+	if gjson.GetBytes(eventJSON, "origin_server_ts").Type != gjson.Number {
+		return fmt.Errorf("'origin_server_ts' is missing or not a number")
+	}
+	if !gjson.GetBytes(eventJSON, "content").IsObject() {
+		return fmt.Errorf("'content' is missing or not an object")
+	}
+	eventID := gjson.GetBytes(eventJSON, "event_id").Str
+	if err := checkEventIDFormat(eventID, roomVersion); err != nil {
+		return err
+	}
+	if _, _, err := gomatrixserverlib.SplitID('@', gjson.GetBytes(eventJSON, "sender").Str); err != nil {
+		return err
+	}
+	if !gjson.GetBytes(eventJSON, "unsigned.redacted_because").Exists() {
+		return nil
+	}
+	eventJSON, err := sjson.DeleteBytes(eventJSON, "unsigned")
+	if err != nil {
+		return err
+	}
+	ev, err := gomatrixserverlib.NewEventFromTrustedJSONWithEventID(eventID, eventJSON, false, roomVersion)
+	if err != nil {
+		return err
+	}
+	return checkRedactedContent(ev)
+}
+
+func checkPDU(eventJSON []byte, roomVersion gomatrixserverlib.RoomVersion, verifier gomatrixserverlib.JSONVerifier) error {
+	format, err := roomVersion.EventFormat()
+	if err != nil {
+		return err
+	}
+	if format == gomatrixserverlib.EventFormatV1 {
+		// later versions don't have event IDs in PDUs, as they are the hash of the event
+		if err = checkEventIDFormat(gjson.GetBytes(eventJSON, "event_id").Str, roomVersion); err != nil {
+			return err
+		}
+	}
+	// this checks the canonical JSON, IDs and hashes, and returns the event redacted if the hash doesn't
+	// match its content, which is only valid if the event really was redacted
+	ev, err := gomatrixserverlib.NewEventFromUntrustedJSON(eventJSON, roomVersion)
+	if err != nil {
+		return err
+	}
+	if ev.Redacted() {
+		content := gjson.GetBytes(eventJSON, "content").Value()
+		if !reflect.DeepEqual(content, gjson.ParseBytes(ev.Content()).Value()) {
+			return fmt.Errorf("content does not match its hash")
+		}
+	}
+	if gjson.GetBytes(eventJSON, "unsigned.redacted_because").Exists() {
+		if err = checkRedactedContent(ev); err != nil {
+			return err
+		}
+	}
+	if verifier != nil {
+		if err = ev.VerifyEventSignatures(context.Background(), verifier); err != nil {
+			return fmt.Errorf("bad signatures: %w", err)
+		}
+	}
+	return nil
+}
+
+// checkRedactedContent checks that the content of a redacted event is what the room version keeps on redaction.
+func checkRedactedContent(ev *gomatrixserverlib.Event) (err error) {
+	defer func() {
+		// Redact panics on events it can't redact, which a homeserver could return
+		if r := recover(); r != nil {
+			err = fmt.Errorf("failed to redact event: %v", r)
+		}
+	}()
+	got := gjson.ParseBytes(ev.Content()).Value()
+	want := gjson.ParseBytes(ev.Redact().Content()).Value()
+	if !reflect.DeepEqual(got, want) {
+		return fmt.Errorf("redacted event has content %v want %v", got, want)
+	}
+	return nil
+}
@@ -0,0 +1,196 @@
+package match
+
+import (
+	"context"
+	"crypto/ed25519"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/tidwall/sjson"
+)
+
+// keyVerifier verifies signatures with a single key, for every server.
+type keyVerifier struct {
+	keyID     gomatrixserverlib.KeyID
+	publicKey ed25519.PublicKey
+}
+
+func (v keyVerifier) VerifyJSONs(ctx context.Context, requests []gomatrixserverlib.VerifyJSONRequest) ([]gomatrixserverlib.VerifyJSONResult, error) {
+	results := make([]gomatrixserverlib.VerifyJSONResult, len(requests))
+	for i, req := range requests {
+		results[i].Error = gomatrixserverlib.VerifyJSON(string(req.ServerName), v.keyID, v.publicKey, req.Message)
+	}
+	return results, nil
+}
+
+// buildPDU returns a message event from @alice:hs1, signed by hs1 with `privateKey`, in the PDU format of
+// `roomVersion`.
+func buildPDU(t *testing.T, roomVersion gomatrixserverlib.RoomVersion, privateKey ed25519.PrivateKey) *gomatrixserverlib.Event {
+	t.Helper()
+	eb := gomatrixserverlib.EventBuilder{
+		Sender:     "@alice:hs1",
+		RoomID:     "!room:hs1",
+		Type:       "m.room.message",
+		PrevEvents: []string{},
+		AuthEvents: []string{},
+		Depth:      1,
+	}
+	if err := eb.SetContent(map[string]interface{}{"msgtype": "m.text", "body": "hello"}); err != nil {
+		t.Fatalf("failed to set content: %s", err)
+	}
+	ev, err := eb.Build(time.Now(), "hs1", "ed25519:1", privateKey, roomVersion)
+	if err != nil {
+		t.Fatalf("failed to build room version %s event: %s", roomVersion, err)
+	}
+	return ev
+}
+
+func TestJSONEventValid(t *testing.T) {
+	publicKey, privateKey, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatalf("failed to generate key: %s", err)
+	}
+	otherPublicKey, _, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatalf("failed to generate key: %s", err)
+	}
+	verifier := keyVerifier{keyID: "ed25519:1", publicKey: publicKey}
+	wrongVerifier := keyVerifier{keyID: "ed25519:1", publicKey: otherPublicKey}
+
+	// edit returns `json` with `path` set to `value`
+	edit := func(json []byte, path string, value interface{}) []byte {
+		t.Helper()
+		edited, err := sjson.SetBytes(json, path, value)
+		if err != nil {
+			t.Fatalf("failed to set %s: %s", path, err)
+		}
+		return edited
+	}
+	redactedBecause := map[string]interface{}{"type": "m.room.redaction", "sender": "@alice:hs1"}
+	pduV1 := buildPDU(t, gomatrixserverlib.RoomVersionV1, privateKey)
+	pduV6 := buildPDU(t, gomatrixserverlib.RoomVersionV6, privateKey)
+	v1ID := "$abc123:hs1"
+	v3ID := "$" + strings.Repeat("aB3_-", 8) + "xyz"
+	clientEvent := []byte(`{"sender":"@alice:hs1","type":"m.room.message","origin_server_ts":1,"content":{"msgtype":"m.text","body":"hello"}}`)
+
+	testCases := []struct {
+		name        string
+		roomVersion gomatrixserverlib.RoomVersion
+		verifier    gomatrixserverlib.JSONVerifier
+		body        []byte
+		wantErr     string
+	}{
+		{
+			name:        "v1 PDU",
+			roomVersion: gomatrixserverlib.RoomVersionV1,
+			verifier:    verifier,
+			body:        pduV1.JSON(),
+		},
+		{
+			name:        "v3+ PDU",
+			roomVersion: gomatrixserverlib.RoomVersionV6,
+			verifier:    verifier,
+			body:        pduV6.JSON(),
+		},
+		{
+			name:        "v1 PDU with a v3+ event ID",
+			roomVersion: gomatrixserverlib.RoomVersionV1,
+			body:        edit(pduV1.JSON(), "event_id", v3ID),
+			wantErr:     "has the wrong format",
+		},
+		{
+			name:        "v1 PDU in a v3+ room",
+			roomVersion: gomatrixserverlib.RoomVersionV6,
+			body:        pduV1.JSON(),
+			wantErr:     "not a valid room version 6 event",
+		},
+		{
+			name:        "tampered v1 PDU",
+			roomVersion: gomatrixserverlib.RoomVersionV1,
+			body:        edit(pduV1.JSON(), "content.body", "goodbye"),
+			wantErr:     "content does not match its hash",
+		},
+		{
+			name:        "tampered v3+ PDU",
+			roomVersion: gomatrixserverlib.RoomVersionV6,
+			body:        edit(pduV6.JSON(), "content.body", "goodbye"),
+			wantErr:     "content does not match its hash",
+		},
+		{
+			name:        "PDU signed with the wrong key",
+			roomVersion: gomatrixserverlib.RoomVersionV6,
+			verifier:    wrongVerifier,
+			body:        pduV6.JSON(),
+			wantErr:     "bad signatures",
+		},
+		{
+			name:        "redacted PDU",
+			roomVersion: gomatrixserverlib.RoomVersionV6,
+			verifier:    verifier,
+			body:        edit(pduV6.Redact().JSON(), "unsigned.redacted_because", redactedBecause),
+		},
+		{
+			name:        "wrongly redacted PDU",
+			roomVersion: gomatrixserverlib.RoomVersionV6,
+			body:        edit(pduV6.JSON(), "unsigned.redacted_because", redactedBecause),
+			wantErr:     "redacted event has content",
+		},
+		{
+			name:        "v1 client event",
+			roomVersion: gomatrixserverlib.RoomVersionV1,
+			body:        edit(clientEvent, "event_id", v1ID),
+		},
+		{
+			name:        "v3+ client event",
+			roomVersion: gomatrixserverlib.RoomVersionV6,
+			body:        edit(clientEvent, "event_id", v3ID),
+		},
+		{
+			name:        "v3+ client event with a v1 event ID",
+			roomVersion: gomatrixserverlib.RoomVersionV6,
+			body:        edit(clientEvent, "event_id", v1ID),
+			wantErr:     "event ID '" + v1ID + "' has the wrong format",
+		},
+		{
+			name:        "v4+ client event with a v3 event ID",
+			roomVersion: gomatrixserverlib.RoomVersionV6,
+			body:        edit(clientEvent, "event_id", strings.Replace(v3ID, "_", "/", 1)),
+			wantErr:     "has the wrong format",
+		},
+		{
+			name:        "client event without a timestamp",
+			roomVersion: gomatrixserverlib.RoomVersionV6,
+			body:        edit([]byte(`{"sender":"@alice:hs1","type":"m.room.message","content":{}}`), "event_id", v3ID),
+			wantErr:     "'origin_server_ts' is missing or not a number",
+		},
+		{
+			name:        "redacted client event",
+			roomVersion: gomatrixserverlib.RoomVersionV6,
+			body: edit(edit(edit(clientEvent, "event_id", v3ID), "content", map[string]interface{}{}),
+				"unsigned.redacted_because", redactedBecause),
+		},
+		{
+			name:        "wrongly redacted client event",
+			roomVersion: gomatrixserverlib.RoomVersionV6,
+			body:        edit(edit(clientEvent, "event_id", v3ID), "unsigned.redacted_because", redactedBecause),
+			wantErr:     "redacted event has content",
+		},
+		{
+			name:        "not an object",
+			roomVersion: gomatrixserverlib.RoomVersionV6,
+			body:        []byte(`[]`),
+			wantErr:     "is not an object",
+		},
+	}
+	for _, tc := range testCases {
+		err := JSONEventValid("@this", tc.roomVersion, tc.verifier)(tc.body)
+		if tc.wantErr == "" && err != nil {
+			t.Errorf("%s: got error %s, want none", tc.name, err)
+		}
+		if tc.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tc.wantErr)) {
+			t.Errorf("%s: got error %v, want %q", tc.name, err, tc.wantErr)
+		}
+	}
+}
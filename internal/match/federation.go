@@ -0,0 +1,85 @@
+package match
+
+import (
+	"fmt"
+
+	"github.com/tidwall/gjson"
+)
+
+// The limits on the size of a transaction, from https://spec.matrix.org/v1.3/server-server-api/#transactions
+const (
+	maxTransactionPDUs = 50
+	maxTransactionEDUs = 100
+)
+
+// FederationTransaction is the desired shape of a /send transaction received from a homeserver, e.g one
+// from federation.Server.ReceivedTransactions(). The PDU and EDU counts must be within the spec limits.
+type FederationTransaction struct {
+	// The number of PDUs must be between these, inclusive. MaxPDUs defaults to the spec limit of 50.
+	MinPDUs int
+	MaxPDUs int
+	// The number of EDUs must be between these, inclusive. MaxEDUs defaults to the spec limit of 100.
+	MinEDUs int
+	MaxEDUs int
+	// Every EDU type in the transaction must be one of these, e.g "m.typing", if it is not empty.
+	EDUTypes []string
+	// Matchers run on every PDU, e.g match.JSONKeyEqual("room_id", roomID).
+	PDUs []JSON
+	// Matchers run on every EDU.
+	EDUs []JSON
+	// Matchers run on the whole transaction, e.g to check that some PDU has a particular type.
+	JSON []JSON
+}
+
+// CheckFederationTransaction returns an error if the transaction `body` does not match `m`.
+func CheckFederationTransaction(body []byte, m FederationTransaction) error {
+	if !gjson.ValidBytes(body) {
+		return fmt.Errorf("transaction is not valid JSON")
+	}
+	maxPDUs, maxEDUs := m.MaxPDUs, m.MaxEDUs
+	if maxPDUs == 0 || maxPDUs > maxTransactionPDUs {
+		maxPDUs = maxTransactionPDUs
+	}
+	if maxEDUs == 0 || maxEDUs > maxTransactionEDUs {
+		maxEDUs = maxTransactionEDUs
+	}
+	pdus := gjson.GetBytes(body, "pdus").Array()
+	edus := gjson.GetBytes(body, "edus").Array()
+	if len(pdus) < m.MinPDUs || len(pdus) > maxPDUs {
+		return fmt.Errorf("transaction has %d PDUs want between %d and %d", len(pdus), m.MinPDUs, maxPDUs)
+	}
+	if len(edus) < m.MinEDUs || len(edus) > maxEDUs {
+		return fmt.Errorf("transaction has %d EDUs want between %d and %d", len(edus), m.MinEDUs, maxEDUs)
+	}
+	if len(m.EDUTypes) > 0 {
+		allowed := make(map[string]bool, len(m.EDUTypes))
+		for _, eduType := range m.EDUTypes {
+			allowed[eduType] = true
+		}
+		for i, edu := range edus {
+			if eduType := edu.Get("edu_type").Str; !allowed[eduType] {
+				return fmt.Errorf("transaction EDU %d has type %s want one of %v", i, eduType, m.EDUTypes)
+			}
+		}
+	}
+	for i, pdu := range pdus {
+		for _, jm := range m.PDUs {
+			if err := jm([]byte(pdu.Raw)); err != nil {
+				return fmt.Errorf("transaction PDU %d (%s): %s", i, pdu.Get("type").Str, err)
+			}
+		}
+	}
+	for i, edu := range edus {
+		for _, jm := range m.EDUs {
+			if err := jm([]byte(edu.Raw)); err != nil {
+				return fmt.Errorf("transaction EDU %d (%s): %s", i, edu.Get("edu_type").Str, err)
+			}
+		}
+	}
+	for _, jm := range m.JSON {
+		if err := jm(body); err != nil {
+			return err
+		}
+	}
+	return nil
+}
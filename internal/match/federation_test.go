@@ -0,0 +1,81 @@
+package match
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestCheckFederationTransaction(t *testing.T) {
+	// txn returns a transaction with `pdus` message PDUs and `edus` typing EDUs
+	txn := func(pdus, edus int) []byte {
+		t.Helper()
+		transaction := map[string][]interface{}{"pdus": {}, "edus": {}}
+		for i := 0; i < pdus; i++ {
+			transaction["pdus"] = append(transaction["pdus"], map[string]interface{}{"type": "m.room.message", "room_id": "!room:hs1"})
+		}
+		for i := 0; i < edus; i++ {
+			transaction["edus"] = append(transaction["edus"], map[string]interface{}{"edu_type": "m.typing", "content": map[string]interface{}{}})
+		}
+		body, err := json.Marshal(transaction)
+		if err != nil {
+			t.Fatalf("failed to marshal transaction: %s", err)
+		}
+		return body
+	}
+	testCases := []struct {
+		name    string
+		body    []byte
+		m       FederationTransaction
+		wantErr string
+	}{
+		{name: "empty", body: txn(0, 0)},
+		{name: "spec limits", body: txn(50, 100)},
+		{name: "too many PDUs", body: txn(51, 0), wantErr: "transaction has 51 PDUs want between 0 and 50"},
+		{name: "too many EDUs", body: txn(0, 101), wantErr: "transaction has 101 EDUs want between 0 and 100"},
+		{
+			name:    "maximums above the spec limits",
+			body:    txn(51, 0),
+			m:       FederationTransaction{MaxPDUs: 100, MaxEDUs: 200},
+			wantErr: "transaction has 51 PDUs want between 0 and 50",
+		},
+		{name: "within the bounds", body: txn(2, 1), m: FederationTransaction{MinPDUs: 1, MaxPDUs: 2, MinEDUs: 1, MaxEDUs: 1}},
+		{name: "too few PDUs", body: txn(0, 1), m: FederationTransaction{MinPDUs: 1}, wantErr: "transaction has 0 PDUs want between 1 and 50"},
+		{name: "too many EDUs for the maximum", body: txn(0, 2), m: FederationTransaction{MaxEDUs: 1}, wantErr: "transaction has 2 EDUs want between 0 and 1"},
+		{name: "allowed EDU types", body: txn(0, 2), m: FederationTransaction{EDUTypes: []string{"m.receipt", "m.typing"}}},
+		{
+			name:    "other EDU types",
+			body:    txn(0, 2),
+			m:       FederationTransaction{EDUTypes: []string{"m.receipt"}},
+			wantErr: "transaction EDU 0 has type m.typing want one of [m.receipt]",
+		},
+		{name: "PDU matchers", body: txn(2, 0), m: FederationTransaction{PDUs: []JSON{JSONKeyEqual("room_id", "!room:hs1")}}},
+		{
+			name:    "PDU matcher fails",
+			body:    txn(2, 0),
+			m:       FederationTransaction{PDUs: []JSON{JSONKeyEqual("room_id", "!other:hs1")}},
+			wantErr: "transaction PDU 0 (m.room.message): key 'room_id' got '!room:hs1' want '!other:hs1'",
+		},
+		{
+			name:    "EDU matcher fails",
+			body:    txn(0, 1),
+			m:       FederationTransaction{EDUs: []JSON{JSONKeyPresent("content.user_id")}},
+			wantErr: "transaction EDU 0 (m.typing): key 'content.user_id' missing",
+		},
+		{
+			name:    "transaction matcher fails",
+			body:    txn(1, 0),
+			m:       FederationTransaction{JSON: []JSON{JSONKeyPresent("origin")}},
+			wantErr: "key 'origin' missing",
+		},
+		{name: "invalid JSON", body: []byte(`{"pdus":`), wantErr: "transaction is not valid JSON"},
+	}
+	for _, tc := range testCases {
+		err := CheckFederationTransaction(tc.body, tc.m)
+		if tc.wantErr == "" && err != nil {
+			t.Errorf("%s: got error %s, want none", tc.name, err)
+		}
+		if tc.wantErr != "" && (err == nil || err.Error() != tc.wantErr) {
+			t.Errorf("%s: got error %v, want %q", tc.name, err, tc.wantErr)
+		}
+	}
+}
@@ -0,0 +1,191 @@
+package match
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// GoldenNormalizer rewrites the parts of a decoded JSON body which change every run, e.g event IDs, so the
+// rest of it can be compared with a golden file. Objects are map[string]interface{}, arrays []interface{}
+// and numbers float64.
+type GoldenNormalizer func(value interface{}) interface{}
+
+// GoldenJSON returns a matcher which will check that the JSON body, after the normalizers have been applied
+// in order, is the same as the JSON in the file `path`, relative to the test package, e.g
+//
+//	must.MatchResponse(t, res, match.HTTPResponse{
+//		JSON: []match.JSON{
+//			match.GoldenJSON(t, "testdata/hierarchy.json", match.NormalizeEventIDs, match.NormalizeRoomIDs),
+//		},
+//	})
+//
+// Run the tests with COMPLEMENT_UPDATE_GOLDEN=1 to write the normalized body to the file instead, then check
+// the file in.
+// Object keys are sorted, so only the contents of the body matter.
+func GoldenJSON(t *testing.T, path string, normalizers ...GoldenNormalizer) JSON {
+	return func(body []byte) error {
+		var value interface{}
+		if err := json.Unmarshal(body, &value); err != nil {
+			return fmt.Errorf("GoldenJSON: body is not JSON: %s", err)
+		}
+		for _, normalize := range normalizers {
+			value = normalize(value)
+		}
+		got, err := json.MarshalIndent(value, "", "  ")
+		if err != nil {
+			return fmt.Errorf("GoldenJSON: %s", err)
+		}
+		got = append(got, '\n')
+		if os.Getenv("COMPLEMENT_UPDATE_GOLDEN") == "1" {
+			if err = os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+				return fmt.Errorf("GoldenJSON: %s", err)
+			}
+			if err = ioutil.WriteFile(path, got, 0644); err != nil {
+				return fmt.Errorf("GoldenJSON: %s", err)
+			}
+			t.Logf("GoldenJSON: updated %s", path)
+			return nil
+		}
+		want, err := ioutil.ReadFile(path)
+		if err != nil {
+			return fmt.Errorf("GoldenJSON: %s, run with COMPLEMENT_UPDATE_GOLDEN=1 to create it", err)
+		}
+		if bytes.Equal(bytes.TrimSpace(want), bytes.TrimSpace(got)) {
+			return nil
+		}
+		return fmt.Errorf("GoldenJSON: body does not match %s, run with COMPLEMENT_UPDATE_GOLDEN=1 if the change is expected:\n%s", path, lineDiff(string(want), string(got)))
+	}
+}
+
+// NormalizeEventIDs replaces event IDs, in values and object keys, with "$EVENT_ID".
+func NormalizeEventIDs(value interface{}) interface{} {
+	return normalizeStrings(value, "$", "$EVENT_ID")
+}
+
+// NormalizeRoomIDs replaces room IDs, in values and object keys, with "!ROOM_ID".
+func NormalizeRoomIDs(value interface{}) interface{} {
+	return normalizeStrings(value, "!", "!ROOM_ID")
+}
+
+// NormalizeTimestamps replaces the values of keys which hold timestamps or durations, e.g origin_server_ts
+// and age, with 0.
+func NormalizeTimestamps(value interface{}) interface{} {
+	return NormalizeKeys(0, "origin_server_ts", "ts", "age", "last_active_ago", "expires_in_ms", "expiry_ts")(value)
+}
+
+// NormalizeTokens replaces the values of keys which hold tokens, e.g next_batch and access_token, with
+// "TOKEN".
+func NormalizeTokens(value interface{}) interface{} {
+	return NormalizeKeys(
+		"TOKEN", "next_batch", "prev_batch", "since", "start", "end", "next_token", "prev_token", "access_token",
+		"refresh_token", "device_id",
+	)(value)
+}
+
+// NormalizeKeys returns a normalizer which replaces the values of the object keys named `keys`, anywhere in
+// the body, with `replacement`.
+func NormalizeKeys(replacement interface{}, keys ...string) GoldenNormalizer {
+	replace := make(map[string]bool, len(keys))
+	for _, key := range keys {
+		replace[key] = true
+	}
+	var normalize GoldenNormalizer
+	normalize = func(value interface{}) interface{} {
+		switch val := value.(type) {
+		case map[string]interface{}:
+			for k, v := range val {
+				if replace[k] {
+					val[k] = replacement
+				} else {
+					val[k] = normalize(v)
+				}
+			}
+		case []interface{}:
+			for i, v := range val {
+				val[i] = normalize(v)
+			}
+		}
+		return value
+	}
+	return normalize
+}
+
+// normalizeStrings replaces strings and object keys starting with `prefix`. When object keys are replaced,
+// the object keeps the value of the last of them in sorted order.
+func normalizeStrings(value interface{}, prefix, replacement string) interface{} {
+	switch val := value.(type) {
+	case string:
+		if strings.HasPrefix(val, prefix) {
+			return replacement
+		}
+	case map[string]interface{}:
+		keys := make([]string, 0, len(val))
+		for k := range val {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		m := make(map[string]interface{}, len(val))
+		for _, k := range keys {
+			v := normalizeStrings(val[k], prefix, replacement)
+			if strings.HasPrefix(k, prefix) {
+				k = replacement
+			}
+			m[k] = v
+		}
+		return m
+	case []interface{}:
+		for i, v := range val {
+			val[i] = normalizeStrings(v, prefix, replacement)
+		}
+	}
+	return value
+}
+
+// lineDiff returns the lines which differ between `want` and `got`, between the lines they have in common
+// at the start and end.
+func lineDiff(want, got string) string {
+	wantLines := strings.Split(strings.TrimSpace(want), "\n")
+	gotLines := strings.Split(strings.TrimSpace(got), "\n")
+	first := 0
+	for first < len(wantLines) && first < len(gotLines) && wantLines[first] == gotLines[first] {
+		first++
+	}
+	wantEnd, gotEnd := len(wantLines), len(gotLines)
+	for wantEnd > first && gotEnd > first && wantLines[wantEnd-1] == gotLines[gotEnd-1] {
+		wantEnd--
+		gotEnd--
+	}
+	var sb strings.Builder
+	writeLines := func(prefix string, lines []string) {
+		for i, line := range lines {
+			if i == diffContextLines {
+				fmt.Fprintf(&sb, "%s... %d more lines\n", prefix, len(lines)-i)
+				break
+			}
+			sb.WriteString(prefix + line + "\n")
+		}
+	}
+	start := first - 3
+	if start < 0 {
+		start = 0
+	}
+	if start > 0 {
+		fmt.Fprintf(&sb, "  @@ line %d\n", start+1)
+	}
+	writeLines("    ", wantLines[start:first])
+	writeLines("  - ", wantLines[first:wantEnd])
+	writeLines("  + ", gotLines[first:gotEnd])
+	end := wantEnd + 3
+	if end > len(wantLines) {
+		end = len(wantLines)
+	}
+	writeLines("    ", wantLines[wantEnd:end])
+	return strings.TrimSuffix(sb.String(), "\n")
+}
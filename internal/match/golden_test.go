@@ -0,0 +1,57 @@
+package match
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestGoldenJSON(t *testing.T) {
+	normalizers := []GoldenNormalizer{NormalizeEventIDs, NormalizeRoomIDs, NormalizeTimestamps}
+	testCases := []struct {
+		name    string
+		body    string
+		wantErr string
+	}{
+		{
+			name: "matches after normalizing",
+			body: `{"!abc:hs1":{"type":"m.room.message","event_id":"$xyz","origin_server_ts":1234}}`,
+		},
+		{
+			name:    "different type",
+			body:    `{"!abc:hs1":{"type":"m.room.topic","event_id":"$xyz","origin_server_ts":1234}}`,
+			wantErr: `-     "type": "m.room.message"`,
+		},
+		{
+			name:    "not JSON",
+			body:    `{`,
+			wantErr: "body is not JSON",
+		},
+	}
+	for _, tc := range testCases {
+		err := GoldenJSON(t, "testdata/golden.json", normalizers...)([]byte(tc.body))
+		if tc.wantErr == "" && err != nil {
+			t.Errorf("%s: got error %s", tc.name, err)
+		}
+		if tc.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tc.wantErr)) {
+			t.Errorf("%s: got error %v, want %q", tc.name, err, tc.wantErr)
+		}
+	}
+}
+
+func TestGoldenJSONUpdate(t *testing.T) {
+	t.Setenv("COMPLEMENT_UPDATE_GOLDEN", "1")
+	path := filepath.Join(t.TempDir(), "testdata", "new.json")
+	if err := GoldenJSON(t, path, NormalizeTimestamps)([]byte(`{"b":1,"a":{"ts":5}}`)); err != nil {
+		t.Fatalf("GoldenJSON returned error when updating: %s", err)
+	}
+	got, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatalf("golden file wasn't written: %s", err)
+	}
+	want := "{\n  \"a\": {\n    \"ts\": 0\n  },\n  \"b\": 1\n}\n"
+	if string(got) != want {
+		t.Errorf("golden file is %q, want %q", got, want)
+	}
+}
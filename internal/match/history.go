@@ -0,0 +1,65 @@
+package match
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/tidwall/gjson"
+)
+
+// IsHistoricalEvent returns true if the event was imported with /batch_send (MSC2716). This includes the
+// messages and the insertion, batch and marker events, as they are all marked as historical.
+func IsHistoricalEvent(ev gjson.Result) bool {
+	return ev.Get("content").Get(strings.ReplaceAll("org.matrix.msc2716.historical", ".", `\.`)).Exists()
+}
+
+// JSONEventIDsInOrderWhere returns a matcher which will check that `wantKey` is an array of events which, after
+// ignoring events which don't pass `filter`, contains the event IDs `wantEventIDs` consecutively and in that
+// order. The events can start anywhere in the array, e.g to check that imported history appears in the right
+// place in /messages:
+//
+//	match.JSONEventIDsInOrderWhere("chunk", batch.ExpectedMessagesOrder(), match.IsHistoricalEvent)
+func JSONEventIDsInOrderWhere(wantKey string, wantEventIDs []string, filter func(gjson.Result) bool) JSON {
+	return func(body []byte) error {
+		if len(wantEventIDs) == 0 {
+			return fmt.Errorf("JSONEventIDsInOrderWhere: wantEventIDs can not be empty")
+		}
+		res := gjson.GetBytes(body, wantKey)
+		if !res.IsArray() {
+			return keyError(wantKey, nil, "key '%s' is missing or not an array", wantKey)
+		}
+		// for error messages
+		var got []string
+		for _, ev := range res.Array() {
+			if filter(ev) {
+				got = append(got, ev.Get("event_id").Str+" ("+ev.Get("content.body").Str+")")
+			}
+		}
+
+		remaining := wantEventIDs
+		started := false
+		for _, ev := range res.Array() {
+			eventID := ev.Get("event_id").Str
+			if !started && eventID == remaining[0] {
+				started = true
+			}
+			if !started || !filter(ev) {
+				continue
+			}
+			if eventID != remaining[0] {
+				return fmt.Errorf(
+					"key '%s' next event was %s but expected %s\nActualEvents (%d): %v\nExpectedEvents (%d): %v",
+					wantKey, eventID, remaining[0], len(got), got, len(wantEventIDs), wantEventIDs,
+				)
+			}
+			remaining = remaining[1:]
+			if len(remaining) == 0 {
+				return nil
+			}
+		}
+		return fmt.Errorf(
+			"key '%s' is missing %d events: %v\nActualEvents (%d): %v\nExpectedEvents (%d): %v",
+			wantKey, len(remaining), remaining, len(got), got, len(wantEventIDs), wantEventIDs,
+		)
+	}
+}
@@ -1,14 +1,317 @@
 package match
 
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/tidwall/gjson"
+)
+
 // HTTPResponse is the desired shape of the HTTP response. Can include any number of JSON matchers.
 type HTTPResponse struct {
 	StatusCode int
 	Headers    map[string]string
-	JSON       []JSON
+	// Checks on the headers other than equality, e.g HTTPHeaderMissing or HTTPHeaderCORS
+	HeaderMatchers []HTTPHeader
+	JSON           []JSON
+
+	// Limits on reading the body, for large or streamed responses like /send_join or media downloads.
+	// The body may be at most MaxBodySize bytes, and no more than that is read. Its first byte must arrive
+	// within FirstByteTimeout of starting to read it, and all of it within BodyTimeout. Both are measured from
+	// after the headers have arrived, as the request has returned by then; the client's Timeout covers the
+	// time until then. Zero means no limit.
+	MaxBodySize      int64
+	FirstByteTimeout time.Duration
+	BodyTimeout      time.Duration
+
+	// set by the HTTPResponse combinators, and checked after the fields above
+	combined func(res *http.Response, body []byte) error
 }
 
+// HTTPHeader will perform some matches on the given HTTP headers, returning an error on a mis-match.
+type HTTPHeader func(header http.Header) error
+
 // HTTPRequest is the desired shape of the HTTP request. Can include any number of JSON matchers.
 type HTTPRequest struct {
 	Headers map[string]string
 	JSON    []JSON
 }
+
+// ReadHTTPResponseBody reads the body of the response within the limits of `m`. If `m` has JSON matchers, the
+// body is checked to be valid JSON as it arrives, so a streamed body which goes wrong is reported with where
+// it went wrong, even if the rest of it never arrives.
+func ReadHTTPResponseBody(res *http.Response, m HTTPResponse) ([]byte, error) {
+	var reader io.Reader = res.Body
+	if m.MaxBodySize > 0 {
+		// read one more byte than allowed, to tell if the body is too large
+		reader = io.LimitReader(res.Body, m.MaxBodySize+1)
+	}
+	firstByte := make(chan struct{})
+	reader = &firstByteReader{Reader: reader, firstByte: firstByte}
+	type result struct {
+		body []byte
+		err  error
+	}
+	done := make(chan result, 1)
+	go func() {
+		var buf bytes.Buffer
+		tee := io.TeeReader(reader, &buf)
+		// a response with the wrong status code is reported as such, even if it isn't JSON
+		if m.JSON != nil && (m.StatusCode == 0 || res.StatusCode == m.StatusCode) {
+			dec := json.NewDecoder(tee)
+			for {
+				_, err := dec.Token()
+				if err == io.EOF {
+					break
+				}
+				if err != nil {
+					done <- result{buf.Bytes(), fmt.Errorf("response body is not valid JSON at byte %d: %s", dec.InputOffset(), err)}
+					return
+				}
+			}
+		}
+		_, err := io.Copy(ioutil.Discard, tee)
+		done <- result{buf.Bytes(), err}
+	}()
+
+	var firstByteTimeout, bodyTimeout <-chan time.Time
+	if m.FirstByteTimeout > 0 {
+		timer := time.NewTimer(m.FirstByteTimeout)
+		defer timer.Stop()
+		firstByteTimeout = timer.C
+	}
+	if m.BodyTimeout > 0 {
+		timer := time.NewTimer(m.BodyTimeout)
+		defer timer.Stop()
+		bodyTimeout = timer.C
+	}
+	for {
+		select {
+		case <-firstByte:
+			firstByte = nil
+			firstByteTimeout = nil
+		case <-firstByteTimeout:
+			res.Body.Close()
+			return nil, fmt.Errorf("first byte of the response body did not arrive within %v", m.FirstByteTimeout)
+		case <-bodyTimeout:
+			res.Body.Close()
+			return nil, fmt.Errorf("response body did not arrive within %v", m.BodyTimeout)
+		case r := <-done:
+			if m.MaxBodySize > 0 && int64(len(r.body)) > m.MaxBodySize {
+				return nil, fmt.Errorf("response body is larger than %d bytes", m.MaxBodySize)
+			}
+			return r.body, r.err
+		}
+	}
+}
+
+// firstByteReader closes `firstByte` when the first byte is read.
+type firstByteReader struct {
+	io.Reader
+	firstByte chan struct{}
+	closed    bool
+}
+
+func (r *firstByteReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	if n > 0 && !r.closed {
+		close(r.firstByte)
+		r.closed = true
+	}
+	return n, err
+}
+
+// CheckHTTPResponse returns an error if the response, whose body has already been read into `body`,
+// does not match `m`.
+func CheckHTTPResponse(res *http.Response, body []byte, m HTTPResponse) error {
+	if m.StatusCode != 0 && res.StatusCode != m.StatusCode {
+		return fmt.Errorf("got status %d want %d", res.StatusCode, m.StatusCode)
+	}
+	for name, val := range m.Headers {
+		if res.Header.Get(name) != val {
+			return fmt.Errorf("got %s: %s want %s", name, res.Header.Get(name), val)
+		}
+	}
+	for _, hm := range m.HeaderMatchers {
+		if err := hm(res.Header); err != nil {
+			return err
+		}
+	}
+	if m.JSON != nil {
+		if !gjson.ValidBytes(body) {
+			return fmt.Errorf("response body is not valid JSON")
+		}
+		for _, jm := range m.JSON {
+			if err := jm(body); err != nil {
+				return err
+			}
+		}
+	}
+	if m.combined != nil {
+		return m.combined(res, body)
+	}
+	return nil
+}
+
+// HTTPResponseAnyOf returns a matcher which passes if the response matches any of `matchers`, for when
+// the spec allows more than one behaviour, e.g
+//
+//	match.HTTPResponseAnyOf(
+//		match.HTTPResponse{StatusCode: 404},
+//		match.HTTPResponse{StatusCode: 403, JSON: []match.JSON{match.JSONKeyEqual("errcode", "M_FORBIDDEN")}},
+//	)
+func HTTPResponseAnyOf(matchers ...HTTPResponse) HTTPResponse {
+	return HTTPResponse{
+		combined: func(res *http.Response, body []byte) error {
+			if len(matchers) == 0 {
+				return fmt.Errorf("must provide at least one matcher to HTTPResponseAnyOf")
+			}
+			builder := strings.Builder{}
+			builder.WriteString("all matchers failed:")
+			for _, m := range matchers {
+				err := CheckHTTPResponse(res, body, m)
+				if err == nil {
+					return nil
+				}
+				builder.WriteString("\n    ")
+				builder.WriteString(err.Error())
+			}
+			return fmt.Errorf(builder.String())
+		},
+	}
+}
+
+// HTTPResponseAllOf returns a matcher which passes if the response matches all of `matchers`, so that
+// shared expectations can be combined with ones particular to a test.
+func HTTPResponseAllOf(matchers ...HTTPResponse) HTTPResponse {
+	return HTTPResponse{
+		combined: func(res *http.Response, body []byte) error {
+			for _, m := range matchers {
+				if err := CheckHTTPResponse(res, body, m); err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+	}
+}
+
+// HTTPResponseNot returns a matcher which passes if the response does not match `m`, e.g
+// `match.HTTPResponseNot(match.HTTPResponse{StatusCode: 500})`.
+func HTTPResponseNot(m HTTPResponse) HTTPResponse {
+	return HTTPResponse{
+		combined: func(res *http.Response, body []byte) error {
+			if CheckHTTPResponse(res, body, m) == nil {
+				return fmt.Errorf("response matched when it should not have: status %d", res.StatusCode)
+			}
+			return nil
+		},
+	}
+}
+
+// HTTPHeaderPresent returns a matcher which will check that the header `name` is present.
+func HTTPHeaderPresent(name string) HTTPHeader {
+	return func(header http.Header) error {
+		if len(header.Values(name)) == 0 {
+			return fmt.Errorf("header %s missing", name)
+		}
+		return nil
+	}
+}
+
+// HTTPHeaderMissing returns a matcher which will check that the header `name` is not present.
+func HTTPHeaderMissing(name string) HTTPHeader {
+	return func(header http.Header) error {
+		if values := header.Values(name); len(values) > 0 {
+			return fmt.Errorf("header %s present: %s", name, strings.Join(values, ", "))
+		}
+		return nil
+	}
+}
+
+// HTTPHeaderMatches returns a matcher which will check that the header `name` is present and matches the
+// regular expression `pattern`, e.g `match.HTTPHeaderMatches("Cache-Control", "max-age=[0-9]+")`.
+func HTTPHeaderMatches(name, pattern string) HTTPHeader {
+	re := regexp.MustCompile(pattern)
+	return func(header http.Header) error {
+		if len(header.Values(name)) == 0 {
+			return fmt.Errorf("header %s missing", name)
+		}
+		if !re.MatchString(header.Get(name)) {
+			return fmt.Errorf("got %s: %s which does not match %s", name, header.Get(name), pattern)
+		}
+		return nil
+	}
+}
+
+// HTTPHeaderCORS returns a matcher which will check that the headers allow web clients to make requests,
+// as the client-server API spec requires on all of its endpoints: any origin, the methods GET, POST, PUT,
+// DELETE and OPTIONS, and the headers X-Requested-With, Content-Type and Authorization.
+func HTTPHeaderCORS() HTTPHeader {
+	return func(header http.Header) error {
+		if origin := header.Get("Access-Control-Allow-Origin"); origin != "*" {
+			return fmt.Errorf("got Access-Control-Allow-Origin: %s want *", origin)
+		}
+		wants := map[string][]string{
+			"Access-Control-Allow-Methods": {"GET", "POST", "PUT", "DELETE", "OPTIONS"},
+			"Access-Control-Allow-Headers": {"X-Requested-With", "Content-Type", "Authorization"},
+		}
+		for _, name := range []string{"Access-Control-Allow-Methods", "Access-Control-Allow-Headers"} {
+			allowed := make(map[string]bool)
+			for _, value := range header.Values(name) {
+				for _, item := range strings.Split(value, ",") {
+					allowed[strings.ToLower(strings.TrimSpace(item))] = true
+				}
+			}
+			for _, want := range wants[name] {
+				// a wildcard allows everything except Authorization, which must be listed
+				if !allowed[strings.ToLower(want)] && !(allowed["*"] && want != "Authorization") {
+					return fmt.Errorf("got %s: %s which does not allow %s", name, strings.Join(header.Values(name), ", "), want)
+				}
+			}
+		}
+		return nil
+	}
+}
+
+// HTTPHeaderContentType returns a matcher which will check that the Content-Type header has the media type
+// `wantType`, ignoring parameters like the charset, e.g `match.HTTPHeaderContentType("image/png")`.
+func HTTPHeaderContentType(wantType string) HTTPHeader {
+	return func(header http.Header) error {
+		mediaType, _, err := mime.ParseMediaType(header.Get("Content-Type"))
+		if err != nil {
+			return fmt.Errorf("invalid Content-Type %s: %s", header.Get("Content-Type"), err)
+		}
+		if mediaType != wantType {
+			return fmt.Errorf("got Content-Type: %s want %s", mediaType, wantType)
+		}
+		return nil
+	}
+}
+
+// HTTPHeaderContentDisposition returns a matcher which will check that the Content-Disposition header, e.g
+// of downloaded media, has the type `wantType`, e.g "inline" or "attachment", and if `wantFilename` is not
+// empty, the filename `wantFilename`. Filenames given with `filename*` are decoded.
+func HTTPHeaderContentDisposition(wantType, wantFilename string) HTTPHeader {
+	return func(header http.Header) error {
+		disposition, params, err := mime.ParseMediaType(header.Get("Content-Disposition"))
+		if err != nil {
+			return fmt.Errorf("invalid Content-Disposition %s: %s", header.Get("Content-Disposition"), err)
+		}
+		if disposition != wantType {
+			return fmt.Errorf("got Content-Disposition: %s want %s", disposition, wantType)
+		}
+		if wantFilename != "" && params["filename"] != wantFilename {
+			return fmt.Errorf("got Content-Disposition filename %s want %s", params["filename"], wantFilename)
+		}
+		return nil
+	}
+}
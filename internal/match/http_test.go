@@ -0,0 +1,255 @@
+package match
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/complement/internal/capture"
+)
+
+// slowServer sends the headers straight away, waits `delay`, then sends `body` `repeat` times.
+func slowServer(delay time.Duration, body string, repeat int) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(200)
+		w.(http.Flusher).Flush()
+		select {
+		case <-time.After(delay):
+		case <-req.Context().Done():
+			return
+		}
+		for i := 0; i < repeat; i++ {
+			if _, err := w.Write([]byte(body)); err != nil {
+				return
+			}
+		}
+	}))
+}
+
+func TestReadHTTPResponseBodyLimits(t *testing.T) {
+	testCases := []struct {
+		name    string
+		delay   time.Duration
+		body    string
+		repeat  int
+		m       HTTPResponse
+		wantErr string
+	}{
+		{
+			name:   "within limits",
+			body:   `{"a":1}`,
+			repeat: 1,
+			m:      HTTPResponse{MaxBodySize: 7, FirstByteTimeout: time.Second, BodyTimeout: time.Second},
+		},
+		{
+			name:    "too large",
+			body:    `[1,2,3,4,5,6,7,8,9]`,
+			repeat:  100000,
+			m:       HTTPResponse{MaxBodySize: 100},
+			wantErr: "larger than 100 bytes",
+		},
+		{
+			name:    "first byte too late",
+			delay:   5 * time.Second,
+			body:    `{}`,
+			repeat:  1,
+			m:       HTTPResponse{FirstByteTimeout: 100 * time.Millisecond},
+			wantErr: "first byte",
+		},
+	}
+	for _, tc := range testCases {
+		srv := slowServer(tc.delay, tc.body, tc.repeat)
+		// the limits must hold with capturing enabled, as it wraps the response body
+		cli := &http.Client{
+			Transport: capture.ForTest(t, t.TempDir()).RoundTripper("hs1", nil),
+		}
+		start := time.Now()
+		res, err := cli.Get(srv.URL)
+		if err != nil {
+			t.Fatalf("%s: request failed: %s", tc.name, err)
+		}
+		_, err = ReadHTTPResponseBody(res, tc.m)
+		res.Body.Close()
+		srv.Close()
+		if tc.wantErr == "" && err != nil {
+			t.Errorf("%s: ReadHTTPResponseBody returned error %s", tc.name, err)
+		}
+		if tc.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tc.wantErr)) {
+			t.Errorf("%s: ReadHTTPResponseBody returned error %v, want %q", tc.name, err, tc.wantErr)
+		}
+		if took := time.Since(start); took > 2*time.Second {
+			t.Errorf("%s: took %v, the limits weren't applied as the body arrived", tc.name, took)
+		}
+	}
+}
+
+func TestHTTPResponseCombinators(t *testing.T) {
+	res := &http.Response{
+		StatusCode: 404,
+		Header:     http.Header{"Content-Type": []string{"application/json"}},
+	}
+	body := []byte(`{"errcode":"M_NOT_FOUND"}`)
+	notFound := HTTPResponse{StatusCode: 404}
+	forbidden := HTTPResponse{StatusCode: 403}
+	errcode := HTTPResponse{JSON: []JSON{JSONKeyEqual("errcode", "M_NOT_FOUND")}}
+	testCases := []struct {
+		name    string
+		m       HTTPResponse
+		wantErr string
+	}{
+		{name: "any of first matches", m: HTTPResponseAnyOf(notFound, forbidden)},
+		{name: "any of last matches", m: HTTPResponseAnyOf(forbidden, notFound)},
+		{
+			name: "any of none match",
+			m:    HTTPResponseAnyOf(forbidden, HTTPResponse{StatusCode: 404, Headers: map[string]string{"Content-Type": "text/plain"}}),
+			wantErr: "all matchers failed:\n" +
+				"    got status 404 want 403\n" +
+				"    got Content-Type: application/json want text/plain",
+		},
+		{name: "any of nothing", m: HTTPResponseAnyOf(), wantErr: "must provide at least one matcher to HTTPResponseAnyOf"},
+		{name: "all of match", m: HTTPResponseAllOf(notFound, errcode)},
+		{name: "all of nothing matches", m: HTTPResponseAllOf()},
+		{name: "all of one fails", m: HTTPResponseAllOf(errcode, forbidden), wantErr: "got status 404 want 403"},
+		{name: "not of failing matcher", m: HTTPResponseNot(forbidden)},
+		{name: "not of matching matcher", m: HTTPResponseNot(notFound), wantErr: "response matched when it should not have: status 404"},
+		{
+			name:    "fields are checked before combinators",
+			m:       HTTPResponse{StatusCode: 403, combined: HTTPResponseAnyOf(notFound).combined},
+			wantErr: "got status 404 want 403",
+		},
+	}
+	for _, tc := range testCases {
+		err := CheckHTTPResponse(res, body, tc.m)
+		if tc.wantErr == "" && err != nil {
+			t.Errorf("%s: got error %s, want none", tc.name, err)
+		}
+		if tc.wantErr != "" && (err == nil || err.Error() != tc.wantErr) {
+			t.Errorf("%s: got error %v, want %q", tc.name, err, tc.wantErr)
+		}
+	}
+}
+
+func TestHTTPHeaders(t *testing.T) {
+	corsHeaders := func(origin, methods, headers string) http.Header {
+		return http.Header{
+			"Access-Control-Allow-Origin":  []string{origin},
+			"Access-Control-Allow-Methods": []string{methods},
+			"Access-Control-Allow-Headers": []string{headers},
+		}
+	}
+	testCases := []struct {
+		name    string
+		header  http.Header
+		m       HTTPHeader
+		wantErr string
+	}{
+		{name: "present", header: http.Header{"Etag": []string{"1"}}, m: HTTPHeaderPresent("ETag")},
+		{name: "not present", header: http.Header{}, m: HTTPHeaderPresent("ETag"), wantErr: "header ETag missing"},
+		{name: "missing", header: http.Header{}, m: HTTPHeaderMissing("ETag")},
+		{name: "not missing", header: http.Header{"Etag": []string{"1", "2"}}, m: HTTPHeaderMissing("ETag"), wantErr: "header ETag present: 1, 2"},
+		{name: "matches", header: http.Header{"Cache-Control": []string{"public, max-age=60"}}, m: HTTPHeaderMatches("Cache-Control", "max-age=[0-9]+")},
+		{
+			name:    "does not match",
+			header:  http.Header{"Cache-Control": []string{"no-cache"}},
+			m:       HTTPHeaderMatches("Cache-Control", "max-age=[0-9]+"),
+			wantErr: "got Cache-Control: no-cache which does not match max-age=[0-9]+",
+		},
+		{name: "matches missing", header: http.Header{}, m: HTTPHeaderMatches("Cache-Control", ".*"), wantErr: "header Cache-Control missing"},
+		{
+			name:   "CORS",
+			header: corsHeaders("*", "GET, POST, PUT, DELETE, OPTIONS", "X-Requested-With, Content-Type, Authorization"),
+			m:      HTTPHeaderCORS(),
+		},
+		{
+			name: "CORS over several lines in any case",
+			header: http.Header{
+				"Access-Control-Allow-Origin":  []string{"*"},
+				"Access-Control-Allow-Methods": []string{"get, post", "PUT,DELETE,OPTIONS"},
+				"Access-Control-Allow-Headers": []string{"x-requested-with, content-type", "authorization"},
+			},
+			m: HTTPHeaderCORS(),
+		},
+		{
+			name:   "CORS wildcards with Authorization",
+			header: corsHeaders("*", "*", "*, Authorization"),
+			m:      HTTPHeaderCORS(),
+		},
+		{
+			// a wildcard doesn't cover Authorization, so it must be listed
+			name:    "CORS wildcard without Authorization",
+			header:  corsHeaders("*", "*", "*"),
+			m:       HTTPHeaderCORS(),
+			wantErr: "got Access-Control-Allow-Headers: * which does not allow Authorization",
+		},
+		{
+			name:    "CORS with an origin",
+			header:  corsHeaders("https://example.org", "*", "*, Authorization"),
+			m:       HTTPHeaderCORS(),
+			wantErr: "got Access-Control-Allow-Origin: https://example.org want *",
+		},
+		{
+			name:    "CORS without a method",
+			header:  corsHeaders("*", "GET, POST, PUT, DELETE", "*, Authorization"),
+			m:       HTTPHeaderCORS(),
+			wantErr: "got Access-Control-Allow-Methods: GET, POST, PUT, DELETE which does not allow OPTIONS",
+		},
+		{
+			name:    "CORS missing",
+			header:  http.Header{},
+			m:       HTTPHeaderCORS(),
+			wantErr: "got Access-Control-Allow-Origin:  want *",
+		},
+		{name: "content type", header: http.Header{"Content-Type": []string{"text/plain; charset=utf-8"}}, m: HTTPHeaderContentType("text/plain")},
+		{
+			name:    "wrong content type",
+			header:  http.Header{"Content-Type": []string{"text/html"}},
+			m:       HTTPHeaderContentType("text/plain"),
+			wantErr: "got Content-Type: text/html want text/plain",
+		},
+		{
+			name:    "invalid content type",
+			header:  http.Header{},
+			m:       HTTPHeaderContentType("text/plain"),
+			wantErr: "invalid Content-Type : mime: no media type",
+		},
+		{
+			name:   "content disposition",
+			header: http.Header{"Content-Disposition": []string{`attachment; filename="cat.png"`}},
+			m:      HTTPHeaderContentDisposition("attachment", "cat.png"),
+		},
+		{
+			name:   "content disposition of any filename",
+			header: http.Header{"Content-Disposition": []string{`inline; filename="cat.png"`}},
+			m:      HTTPHeaderContentDisposition("inline", ""),
+		},
+		{
+			name:   "content disposition with an encoded filename",
+			header: http.Header{"Content-Disposition": []string{`attachment; filename*=UTF-8''%E2%98%83%20snow.png`}},
+			m:      HTTPHeaderContentDisposition("attachment", "☃ snow.png"),
+		},
+		{
+			name:    "content disposition with the wrong type",
+			header:  http.Header{"Content-Disposition": []string{`inline; filename="cat.png"`}},
+			m:       HTTPHeaderContentDisposition("attachment", "cat.png"),
+			wantErr: "got Content-Disposition: inline want attachment",
+		},
+		{
+			name:    "content disposition with the wrong filename",
+			header:  http.Header{"Content-Disposition": []string{`attachment; filename*=UTF-8''dog.png`}},
+			m:       HTTPHeaderContentDisposition("attachment", "cat.png"),
+			wantErr: "got Content-Disposition filename dog.png want cat.png",
+		},
+	}
+	for _, tc := range testCases {
+		err := tc.m(tc.header)
+		if tc.wantErr == "" && err != nil {
+			t.Errorf("%s: got error %s, want none", tc.name, err)
+		}
+		if tc.wantErr != "" && (err == nil || err.Error() != tc.wantErr) {
+			t.Errorf("%s: got error %v, want %q", tc.name, err, tc.wantErr)
+		}
+	}
+}
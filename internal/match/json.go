@@ -1,9 +1,12 @@
 package match
 
 import (
+	"encoding/json"
 	"fmt"
 	"reflect"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/tidwall/gjson"
 )
@@ -19,11 +22,11 @@ func JSONKeyEqual(wantKey string, wantValue interface{}) JSON {
 	return func(body []byte) error {
 		res := gjson.GetBytes(body, wantKey)
 		if !res.Exists() {
-			return fmt.Errorf("key '%s' missing", wantKey)
+			return keyError(wantKey, nil, "key '%s' missing", wantKey)
 		}
 		gotValue := res.Value()
 		if !reflect.DeepEqual(gotValue, wantValue) {
-			return fmt.Errorf("key '%s' got '%v' want '%v'", wantKey, gotValue, wantValue)
+			return keyError(wantKey, wantValue, "key '%s' got '%v' want '%v'", wantKey, gotValue, wantValue)
 		}
 		return nil
 	}
@@ -35,7 +38,7 @@ func JSONKeyPresent(wantKey string) JSON {
 	return func(body []byte) error {
 		res := gjson.GetBytes(body, wantKey)
 		if !res.Exists() {
-			return fmt.Errorf("key '%s' missing", wantKey)
+			return keyError(wantKey, nil, "key '%s' missing", wantKey)
 		}
 		return nil
 	}
@@ -47,7 +50,7 @@ func JSONKeyMissing(forbiddenKey string) JSON {
 	return func(body []byte) error {
 		res := gjson.GetBytes(body, forbiddenKey)
 		if res.Exists() {
-			return fmt.Errorf("key '%s' present", forbiddenKey)
+			return keyError(forbiddenKey, nil, "key '%s' present", forbiddenKey)
 		}
 		return nil
 	}
@@ -59,10 +62,10 @@ func JSONKeyTypeEqual(wantKey string, wantType gjson.Type) JSON {
 	return func(body []byte) error {
 		res := gjson.GetBytes(body, wantKey)
 		if !res.Exists() {
-			return fmt.Errorf("key '%s' missing", wantKey)
+			return keyError(wantKey, nil, "key '%s' missing", wantKey)
 		}
 		if res.Type != wantType {
-			return fmt.Errorf("key '%s' is of the wrong type, got %s want %s", wantKey, res.Type, wantType)
+			return keyError(wantKey, nil, "key '%s' is of the wrong type, got %s want %s", wantKey, res.Type, wantType)
 		}
 		return nil
 	}
@@ -75,14 +78,14 @@ func JSONKeyArrayOfSize(wantKey string, wantSize int) JSON {
 	return func(body []byte) error {
 		res := gjson.GetBytes(body, wantKey)
 		if !res.Exists() {
-			return fmt.Errorf("key '%s' missing", wantKey)
+			return keyError(wantKey, nil, "key '%s' missing", wantKey)
 		}
 		if !res.IsArray() {
-			return fmt.Errorf("key '%s' is not an array", wantKey)
+			return keyError(wantKey, nil, "key '%s' is not an array", wantKey)
 		}
 		entries := res.Array()
 		if len(entries) != wantSize {
-			return fmt.Errorf("key '%s' is an array of the wrong size, got %v want %v", wantKey, len(entries), wantSize)
+			return keyError(wantKey, nil, "key '%s' is an array of the wrong size, got %v want %v", wantKey, len(entries), wantSize)
 		}
 		return nil
 	}
@@ -90,6 +93,8 @@ func JSONKeyArrayOfSize(wantKey string, wantSize int) JSON {
 
 func jsonCheckOffInternal(wantKey string, wantItems []interface{}, allowUnwantedItems bool, mapper func(gjson.Result) interface{}, fn func(interface{}, gjson.Result) error) JSON {
 	return func(body []byte) error {
+		// items are checked off by removing them, so copy them to allow the matcher to be run more than once
+		wantItems := append([]interface{}(nil), wantItems...)
 		res := gjson.GetBytes(body, wantKey)
 		if !res.Exists() {
 			return fmt.Errorf("missing key '%s'", wantKey)
@@ -98,10 +103,14 @@ func jsonCheckOffInternal(wantKey string, wantItems []interface{}, allowUnwanted
 			return fmt.Errorf("JSONCheckOff: key '%s' is not an array or object", wantKey)
 		}
 		var err error
+		index := 0
 		res.ForEach(func(key, val gjson.Result) bool {
 			itemRes := key
+			elem := key.Str
 			if res.IsArray() {
 				itemRes = val
+				elem = strconv.Itoa(index)
+				index++
 			}
 			// convert it to something we can check off
 			item := mapper(itemRes)
@@ -132,6 +141,7 @@ func jsonCheckOffInternal(wantKey string, wantItems []interface{}, allowUnwanted
 			if fn != nil {
 				err = fn(item, val)
 				if err != nil {
+					err = elementError(err, wantKey, elem)
 					return false
 				}
 			}
@@ -192,6 +202,62 @@ func JSONCheckOff(wantKey string, wantItems []interface{}, mapper func(gjson.Res
 	return jsonCheckOffInternal(wantKey, wantItems, false, mapper, fn)
 }
 
+// JSONCheckOffOrdered returns a matcher which will loop over the array `wantKey` and ensure that the items
+// in `wantItems` appear in it in the same order. Other items are allowed before, between and after them,
+// so gaps in e.g a timeline don't matter, but a wanted item appearing before an earlier wanted item is an
+// error, unlike JSONCheckOff and JSONCheckOffAllowUnwanted. `mapper` and `fn` are as for JSONCheckOff, and
+// `fn` is called for every item.
+//
+// Usage: (ensures `chunk` has these events in this order, possibly with other events between them)
+//
+//	JSONCheckOffOrdered("chunk", []interface{}{"$foo:bar", "$baz:quuz"}, func(r gjson.Result) interface{} {
+//		return r.Get("event_id").Str
+//	}, nil)
+func JSONCheckOffOrdered(wantKey string, wantItems []interface{}, mapper func(gjson.Result) interface{}, fn func(interface{}, gjson.Result) error) JSON {
+	return func(body []byte) error {
+		res := gjson.GetBytes(body, wantKey)
+		if !res.Exists() {
+			return fmt.Errorf("missing key '%s'", wantKey)
+		}
+		if !res.IsArray() {
+			return fmt.Errorf("JSONCheckOffOrdered: key '%s' is not an array", wantKey)
+		}
+		next := 0
+		index := -1
+		var err error
+		res.ForEach(func(_, val gjson.Result) bool {
+			index++
+			item := mapper(val)
+			if item == nil {
+				err = fmt.Errorf("JSONCheckOffOrdered: mapper function mapped %v to nil", val.Raw)
+				return false
+			}
+			for i := next; i < len(wantItems); i++ {
+				if !reflect.DeepEqual(wantItems[i], item) {
+					continue
+				}
+				if i != next {
+					err = fmt.Errorf("JSONCheckOffOrdered: item %v appeared before %v, want order %v", item, wantItems[next], wantItems)
+					return false
+				}
+				next++
+				break
+			}
+			if fn != nil {
+				if err = fn(item, val); err != nil {
+					err = elementError(err, wantKey, strconv.Itoa(index))
+					return false
+				}
+			}
+			return true
+		})
+		if err == nil && next < len(wantItems) {
+			err = fmt.Errorf("JSONCheckOffOrdered: did not see items: %v", wantItems[next:])
+		}
+		return err
+	}
+}
+
 // JSONArrayEach returns a matcher which will check that `wantKey` is an array then loops over each
 // item calling `fn`. If `fn` returns an error, iterating stops and an error is returned.
 func JSONArrayEach(wantKey string, fn func(gjson.Result) error) JSON {
@@ -207,11 +273,15 @@ func JSONArrayEach(wantKey string, fn func(gjson.Result) error) JSON {
 			return fmt.Errorf("missing key '%s'", wantKey)
 		}
 		if !res.IsArray() {
-			return fmt.Errorf("key '%s' is not an array", wantKey)
+			return keyError(wantKey, nil, "key '%s' is not an array", wantKey)
 		}
 		var err error
+		index := 0
 		res.ForEach(func(_, val gjson.Result) bool {
-			err = fn(val)
+			if err = fn(val); err != nil {
+				err = elementError(err, wantKey, strconv.Itoa(index))
+			}
+			index++
 			return err == nil
 		})
 		return err
@@ -227,17 +297,197 @@ func JSONMapEach(wantKey string, fn func(k, v gjson.Result) error) JSON {
 			return fmt.Errorf("missing key '%s'", wantKey)
 		}
 		if !res.IsObject() {
-			return fmt.Errorf("key '%s' is not an object", wantKey)
+			return keyError(wantKey, nil, "key '%s' is not an object", wantKey)
 		}
 		var err error
 		res.ForEach(func(key, val gjson.Result) bool {
-			err = fn(key, val)
+			if err = fn(key, val); err != nil {
+				err = elementError(err, wantKey, key.Str)
+			}
 			return err == nil
 		})
 		return err
 	}
 }
 
+// JSONArrayEventMatches returns a matcher which will check that `wantKey` is an array containing an event
+// with the event ID `eventID`, and that the event passes all the `matchers`. Use "" for a top-level array.
+// This can be used to check individual events in e.g the `chunk` of a /messages response.
+func JSONArrayEventMatches(wantKey, eventID string, matchers ...JSON) JSON {
+	return func(body []byte) error {
+		var res gjson.Result
+		if wantKey == "" {
+			res = gjson.ParseBytes(body)
+		} else {
+			res = gjson.GetBytes(body, wantKey)
+		}
+		if !res.IsArray() {
+			return keyError(wantKey, nil, "key '%s' is missing or not an array", wantKey)
+		}
+		for _, ev := range res.Array() {
+			if ev.Get("event_id").Str != eventID {
+				continue
+			}
+			for _, m := range matchers {
+				if err := m([]byte(ev.Raw)); err != nil {
+					return keyError(wantKey, nil, "key '%s' event %s: %s", wantKey, eventID, err)
+				}
+			}
+			return nil
+		}
+		return keyError(wantKey, nil, "key '%s' has no event with ID %s", wantKey, eventID)
+	}
+}
+
+// JSONEventIDsInOrder returns a matcher which will check that `wantKey` is an array of events with exactly
+// the event IDs `wantEventIDs`, in that order.
+func JSONEventIDsInOrder(wantKey string, wantEventIDs []string) JSON {
+	return func(body []byte) error {
+		res := gjson.GetBytes(body, wantKey)
+		if !res.IsArray() {
+			return keyError(wantKey, nil, "key '%s' is missing or not an array", wantKey)
+		}
+		events := res.Array()
+		gotEventIDs := make([]string, len(events))
+		for i, ev := range events {
+			gotEventIDs[i] = ev.Get("event_id").Str
+		}
+		if len(gotEventIDs) != len(wantEventIDs) {
+			return keyError(wantKey, nil, "key '%s' got event IDs %v want %v", wantKey, gotEventIDs, wantEventIDs)
+		}
+		for i := range gotEventIDs {
+			if gotEventIDs[i] != wantEventIDs[i] {
+				return keyError(wantKey, nil, "key '%s' got event IDs %v want %v", wantKey, gotEventIDs, wantEventIDs)
+			}
+		}
+		return nil
+	}
+}
+
+// JSONArrayHasState returns a matcher which will check that `wantKey` is an array of events containing
+// a state event with the type `eventType` and state key `stateKey`.
+func JSONArrayHasState(wantKey, eventType, stateKey string) JSON {
+	return func(body []byte) error {
+		res := gjson.GetBytes(body, wantKey)
+		if !res.IsArray() {
+			return keyError(wantKey, nil, "key '%s' is missing or not an array", wantKey)
+		}
+		for _, ev := range res.Array() {
+			sk := ev.Get("state_key")
+			if ev.Get("type").Str == eventType && sk.Exists() && sk.Str == stateKey {
+				return nil
+			}
+		}
+		return keyError(wantKey, nil, "key '%s' has no state event (%s, %s)", wantKey, eventType, stateKey)
+	}
+}
+
+// JSONArrayOrderedBy returns a matcher which will check that `wantKey` is an array of objects which are sorted
+// by the number at `sortKey` in each object, e.g ("chunk", "num_joined_members", true) for /publicRooms.
+// Objects without `sortKey` are treated as 0.
+func JSONArrayOrderedBy(wantKey, sortKey string, descending bool) JSON {
+	return func(body []byte) error {
+		res := gjson.GetBytes(body, wantKey)
+		if !res.IsArray() {
+			return keyError(wantKey, nil, "key '%s' is missing or not an array", wantKey)
+		}
+		items := res.Array()
+		for i := 1; i < len(items); i++ {
+			prev := items[i-1].Get(sortKey).Float()
+			curr := items[i].Get(sortKey).Float()
+			if (descending && curr > prev) || (!descending && curr < prev) {
+				return keyError(wantKey, nil, "key '%s' is not ordered by '%s' (descending=%v): index %d has %v then index %d has %v", wantKey, sortKey, descending, i-1, prev, i, curr)
+			}
+		}
+		return nil
+	}
+}
+
+// JSONKeyNumberInRange returns a matcher which will check that `wantKey` is a number between `min` and `max`
+// inclusive, e.g for estimates which the server does not need to calculate exactly, or
+// `match.JSONKeyNumberInRange("unsigned.age", 0, 5000)` for an event sent in the last 5 seconds.
+func JSONKeyNumberInRange(wantKey string, min, max float64) JSON {
+	return func(body []byte) error {
+		res := gjson.GetBytes(body, wantKey)
+		if !res.Exists() {
+			return keyError(wantKey, nil, "key '%s' missing", wantKey)
+		}
+		if res.Type != gjson.Number {
+			return keyError(wantKey, nil, "key '%s' is not a number: %s", wantKey, res.Raw)
+		}
+		if res.Num < min || res.Num > max {
+			return keyError(wantKey, nil, "key '%s' got %v want between %v and %v", wantKey, res.Num, min, max)
+		}
+		return nil
+	}
+}
+
+// JSONKeyTimestampWithin returns a matcher which will check that `wantKey` is present and is a timestamp in
+// milliseconds, like origin_server_ts, within `tolerance` of `want`, e.g
+// `match.JSONKeyTimestampWithin("origin_server_ts", time.Now(), time.Minute)`. Allow for the clocks of the
+// homeserver and Complement being slightly different.
+func JSONKeyTimestampWithin(wantKey string, want time.Time, tolerance time.Duration) JSON {
+	return func(body []byte) error {
+		res := gjson.GetBytes(body, wantKey)
+		if !res.Exists() {
+			return keyError(wantKey, nil, "key '%s' missing", wantKey)
+		}
+		if res.Type != gjson.Number {
+			return keyError(wantKey, nil, "key '%s' is not a number: %s", wantKey, res.Raw)
+		}
+		got := time.UnixMilli(res.Int())
+		diff := got.Sub(want)
+		if diff < -tolerance || diff > tolerance {
+			return keyError(
+				wantKey, nil, "key '%s' got %s (%d) want within %v of %s, off by %v",
+				wantKey, got.UTC().Format(time.RFC3339Nano), res.Int(), tolerance, want.UTC().Format(time.RFC3339Nano), diff,
+			)
+		}
+		return nil
+	}
+}
+
+// JSONInto returns a matcher which will decode the value at `wantKey` into `target` with json.Unmarshal, then
+// run `validators` on it, so a test gets typed access to the value as well as checking it, e.g
+//
+//	type roomSummary struct {
+//		JoinedMembers int `json:"m.joined_member_count"`
+//	}
+//	var summary roomSummary
+//	must.MatchResponse(t, res, match.HTTPResponse{
+//		JSON: []match.JSON{
+//			match.JSONInto("summary", &summary, func(s roomSummary) error {
+//				if s.JoinedMembers != 2 {
+//					return fmt.Errorf("got %d joined members want 2", s.JoinedMembers)
+//				}
+//				return nil
+//			}),
+//		},
+//	})
+//
+// `target` is reset before decoding, so nothing is left over when a matcher is reused, e.g in a retry loop, and
+// it is set even if a validator fails. Like json.Unmarshal, keys match fields case-insensitively and unknown
+// keys are ignored, so prefer the other matchers when exact keys matter.
+func JSONInto[T any](wantKey string, target *T, validators ...func(T) error) JSON {
+	return func(body []byte) error {
+		res := gjson.GetBytes(body, wantKey)
+		if !res.Exists() {
+			return keyError(wantKey, nil, "key '%s' missing", wantKey)
+		}
+		var zero T
+		*target = zero
+		if err := json.Unmarshal([]byte(res.Raw), target); err != nil {
+			return keyError(wantKey, nil, "key '%s' could not be decoded into %T: %s", wantKey, *target, err)
+		}
+		for _, validate := range validators {
+			if err := validate(*target); err != nil {
+				return keyError(wantKey, nil, "key '%s': %s", wantKey, err)
+			}
+		}
+		return nil
+	}
+}
+
 // AnyOf takes 1 or more `checkers`, and builds a new checker which accepts a given
 // json body iff it's accepted by at least one of the original `checkers`.
 func AnyOf(checkers ...JSON) JSON {
@@ -263,3 +513,27 @@ func AnyOf(checkers ...JSON) JSON {
 		return fmt.Errorf(builder.String())
 	}
 }
+
+// AllOf takes 1 or more `checkers`, and builds a new checker which passes if all of them pass, so that
+// checkers can be combined, e.g as one of the options given to AnyOf.
+func AllOf(checkers ...JSON) JSON {
+	return func(body []byte) error {
+		for _, check := range checkers {
+			if err := check(body); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+// Not builds a checker which passes if `checker` fails, e.g `match.Not(match.JSONKeyEqual("membership", "join"))`.
+// Prefer JSONKeyMissing to check that a key is absent, as its error is clearer.
+func Not(checker JSON) JSON {
+	return func(body []byte) error {
+		if err := checker(body); err == nil {
+			return fmt.Errorf("check passed when it should have failed")
+		}
+		return nil
+	}
+}
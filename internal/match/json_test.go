@@ -0,0 +1,189 @@
+package match
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+
+	"github.com/tidwall/gjson"
+)
+
+func TestJSONCombinators(t *testing.T) {
+	body := []byte(`{"membership":"join","displayname":"Alice"}`)
+	joined := JSONKeyEqual("membership", "join")
+	left := JSONKeyEqual("membership", "leave")
+	named := JSONKeyEqual("displayname", "Alice")
+	testCases := []struct {
+		name    string
+		check   JSON
+		wantErr string
+	}{
+		{name: "any of first passes", check: AnyOf(joined, left)},
+		{name: "any of last passes", check: AnyOf(left, joined)},
+		{
+			name:  "any of none pass",
+			check: AnyOf(left, JSONKeyEqual("displayname", "Bob")),
+			wantErr: "all checks failed:\n" +
+				"    key 'membership' got 'join' want 'leave'\n" +
+				"    key 'displayname' got 'Alice' want 'Bob'",
+		},
+		{name: "any of nothing", check: AnyOf(), wantErr: "must provide at least one checker to AnyOf"},
+		{name: "all of pass", check: AllOf(joined, named)},
+		{name: "all of nothing passes", check: AllOf()},
+		{name: "all of one fails", check: AllOf(joined, left), wantErr: "key 'membership' got 'join' want 'leave'"},
+		{name: "all of first failure", check: AllOf(left, JSONKeyEqual("displayname", "Bob")), wantErr: "key 'membership' got 'join' want 'leave'"},
+		{name: "not of failing check", check: Not(left)},
+		{name: "not of passing check", check: Not(joined), wantErr: "check passed when it should have failed"},
+		{name: "nested", check: AnyOf(AllOf(joined, Not(named)), AllOf(joined, named))},
+	}
+	for _, tc := range testCases {
+		err := tc.check(body)
+		if tc.wantErr == "" && err != nil {
+			t.Errorf("%s: got error %s, want none", tc.name, err)
+		}
+		if tc.wantErr != "" && (err == nil || err.Error() != tc.wantErr) {
+			t.Errorf("%s: got error %v, want %q", tc.name, err, tc.wantErr)
+		}
+	}
+}
+
+func TestJSONCheckOffOrdered(t *testing.T) {
+	eventID := func(r gjson.Result) interface{} {
+		return r.Get("event_id").Str
+	}
+	body := []byte(`{"chunk":[{"event_id":"$b"},{"event_id":"$x"},{"event_id":"$a"},{"event_id":"$c"}]}`)
+	testCases := []struct {
+		name    string
+		check   JSON
+		wantErr string
+	}{
+		{
+			name:  "in order with gaps",
+			check: JSONCheckOffOrdered("chunk", []interface{}{"$b", "$a", "$c"}, eventID, nil),
+		},
+		{
+			name:  "subset in order",
+			check: JSONCheckOffOrdered("chunk", []interface{}{"$b", "$c"}, eventID, nil),
+		},
+		{
+			name:    "misordered",
+			check:   JSONCheckOffOrdered("chunk", []interface{}{"$a", "$b", "$c"}, eventID, nil),
+			wantErr: "JSONCheckOffOrdered: item $b appeared before $a, want order [$a $b $c]",
+		},
+		{
+			// the wanted items of "misordered", which are all there, so only the ordered check-off rejects them
+			name:  "misordered unordered check-off",
+			check: JSONCheckOffAllowUnwanted("chunk", []interface{}{"$a", "$b", "$c"}, eventID, nil),
+		},
+		{
+			name:    "missing item",
+			check:   JSONCheckOffOrdered("chunk", []interface{}{"$b", "$d"}, eventID, nil),
+			wantErr: "JSONCheckOffOrdered: did not see items: [$d]",
+		},
+		{
+			name:    "not an array",
+			check:   JSONCheckOffOrdered("chunk.0", []interface{}{"$b"}, eventID, nil),
+			wantErr: "JSONCheckOffOrdered: key 'chunk.0' is not an array",
+		},
+		{
+			name: "fn is called for every item",
+			check: JSONCheckOffOrdered("chunk", []interface{}{"$b"}, eventID, func(item interface{}, _ gjson.Result) error {
+				if item == "$x" {
+					return fmt.Errorf("unexpected %v", item)
+				}
+				return nil
+			}),
+			wantErr: "unexpected $x",
+		},
+	}
+	for _, tc := range testCases {
+		err := tc.check(body)
+		if tc.wantErr == "" && err != nil {
+			t.Errorf("%s: got error %s, want none", tc.name, err)
+		}
+		if tc.wantErr != "" && (err == nil || err.Error() != tc.wantErr) {
+			t.Errorf("%s: got error %v, want %q", tc.name, err, tc.wantErr)
+		}
+	}
+}
+
+func TestJSONInto(t *testing.T) {
+	type summary struct {
+		Heroes  []string `json:"m.heroes"`
+		Joined  int      `json:"m.joined_member_count"`
+		Invited int      `json:"m.invited_member_count"`
+	}
+	atLeastJoined := func(n int) func(summary) error {
+		return func(s summary) error {
+			if s.Joined < n {
+				return fmt.Errorf("got %d joined members want at least %d", s.Joined, n)
+			}
+			return nil
+		}
+	}
+	testCases := []struct {
+		name       string
+		body       string
+		validators []func(summary) error
+		want       summary
+		wantErr    string
+	}{
+		{
+			name: "decoded",
+			body: `{"summary":{"m.heroes":["@bob:hs1"],"m.joined_member_count":2,"m.invited_member_count":1}}`,
+			want: summary{Heroes: []string{"@bob:hs1"}, Joined: 2, Invited: 1},
+		},
+		{
+			name:       "validated",
+			body:       `{"summary":{"m.joined_member_count":2}}`,
+			validators: []func(summary) error{atLeastJoined(1), atLeastJoined(2)},
+			want:       summary{Joined: 2},
+		},
+		{
+			// the target is set, so the test can report what it got
+			name:       "validator fails",
+			body:       `{"summary":{"m.joined_member_count":1}}`,
+			validators: []func(summary) error{atLeastJoined(2)},
+			want:       summary{Joined: 1},
+			wantErr:    "key 'summary': got 1 joined members want at least 2",
+		},
+		{
+			name:    "missing",
+			body:    `{}`,
+			wantErr: "key 'summary' missing",
+		},
+		{
+			name:    "wrong type",
+			body:    `{"summary":{"m.joined_member_count":"2"}}`,
+			wantErr: "key 'summary' could not be decoded into match.summary: json: cannot unmarshal string into Go struct field summary.m.joined_member_count of type int",
+		},
+	}
+	for _, tc := range testCases {
+		var got summary
+		err := JSONInto("summary", &got, tc.validators...)([]byte(tc.body))
+		if tc.wantErr == "" && err != nil {
+			t.Errorf("%s: got error %s, want none", tc.name, err)
+		}
+		if tc.wantErr != "" && (err == nil || err.Error() != tc.wantErr) {
+			t.Errorf("%s: got error %v, want %q", tc.name, err, tc.wantErr)
+		}
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%s: got %+v want %+v", tc.name, got, tc.want)
+		}
+	}
+
+	// a reused matcher doesn't keep fields from earlier bodies, which json.Unmarshal alone would
+	var got summary
+	check := JSONInto("summary", &got)
+	for _, body := range []string{
+		`{"summary":{"m.heroes":["@bob:hs1"],"m.invited_member_count":1}}`,
+		`{"summary":{"m.joined_member_count":2}}`,
+	} {
+		if err := check([]byte(body)); err != nil {
+			t.Fatalf("reused: got error %s, want none", err)
+		}
+	}
+	if want := (summary{Joined: 2}); !reflect.DeepEqual(got, want) {
+		t.Errorf("reused: got %+v want %+v", got, want)
+	}
+}
@@ -0,0 +1,65 @@
+package match
+
+import (
+	"fmt"
+
+	"github.com/tidwall/gjson"
+)
+
+// JSONThreadSummary returns a matcher which will check that the event JSON has a thread bundled aggregation
+// under `unsigned.m.relations.m.thread` with the given reply count, latest event and participation flag.
+// Use with JSONArrayEventMatches to check events in lists, or directly on the response from /event.
+func JSONThreadSummary(count int64, latestEventID string, currentUserParticipated bool) JSON {
+	return func(body []byte) error {
+		summary := gjson.GetBytes(body, `unsigned.m\.relations.m\.thread`)
+		if !summary.Exists() {
+			return fmt.Errorf("no thread summary in unsigned.m.relations")
+		}
+		if got := summary.Get("count").Int(); got != count {
+			return fmt.Errorf("thread summary count: got %d want %d", got, count)
+		}
+		if got := summary.Get("latest_event.event_id").Str; got != latestEventID {
+			return fmt.Errorf("thread summary latest_event: got %s want %s", got, latestEventID)
+		}
+		if got := summary.Get("current_user_participated").Bool(); got != currentUserParticipated {
+			return fmt.Errorf("thread summary current_user_participated: got %v want %v", got, currentUserParticipated)
+		}
+		return nil
+	}
+}
+
+// JSONReplacedBy returns a matcher which will check that the event JSON has a replacement bundled aggregation
+// under `unsigned.m.relations.m.replace` for the edit `editEventID`.
+func JSONReplacedBy(editEventID string) JSON {
+	return func(body []byte) error {
+		replace := gjson.GetBytes(body, `unsigned.m\.relations.m\.replace`)
+		if !replace.Exists() {
+			return fmt.Errorf("no replacement in unsigned.m.relations")
+		}
+		if got := replace.Get("event_id").Str; got != editEventID {
+			return fmt.Errorf("replacement event_id: got %s want %s", got, editEventID)
+		}
+		return nil
+	}
+}
+
+// JSONAnnotationCount returns a matcher which will check that the event JSON has an annotation bundled
+// aggregation under `unsigned.m.relations.m.annotation` with `count` annotations of type `eventType` with
+// the key `key`, e.g "m.reaction" and an emoji. Servers which do not bundle annotations fail this matcher.
+func JSONAnnotationCount(eventType, key string, count int64) JSON {
+	return func(body []byte) error {
+		chunk := gjson.GetBytes(body, `unsigned.m\.relations.m\.annotation.chunk`)
+		if !chunk.IsArray() {
+			return fmt.Errorf("no annotations in unsigned.m.relations")
+		}
+		for _, annotation := range chunk.Array() {
+			if annotation.Get("type").Str == eventType && annotation.Get("key").Str == key {
+				if got := annotation.Get("count").Int(); got != count {
+					return fmt.Errorf("annotation %s %s count: got %d want %d", eventType, key, got, count)
+				}
+				return nil
+			}
+		}
+		return fmt.Errorf("no annotation %s %s in %s", eventType, key, chunk.Raw)
+	}
+}
@@ -0,0 +1,478 @@
+package match
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"gopkg.in/yaml.v3"
+)
+
+// JSONSchema returns a matcher which will check that the JSON body is a valid response to the OpenAPI
+// operation with the operationId `operation`, e.g "getJoinedMembersByRoom", according to the schema of its
+// 200 response, or its first 2xx response if it has no 200 response. `spec` is the path to an OpenAPI (or
+// Swagger 2) definition, or a directory of them such as data/api/client-server in a checkout of matrix-spec.
+// If `spec` is empty, COMPLEMENT_SPEC_DIR is used, and if that isn't set either the body isn't checked, so
+// tests still run without a checkout of the spec.
+//
+// The definitions are loaded once and shared between tests. Relative $refs are followed to other files,
+// e.g the event schemas. The common JSON Schema keywords are checked: type, nullable, enum, const,
+// properties, required, additionalProperties, patternProperties, items, min/maxItems, minimum/maximum,
+// pattern, allOf, anyOf and oneOf. Other keywords, like format, are ignored.
+func JSONSchema(spec, operation string) JSON {
+	return func(body []byte) error {
+		if spec == "" {
+			spec = os.Getenv("COMPLEMENT_SPEC_DIR")
+			if spec == "" {
+				return nil
+			}
+		}
+		schema, err := loadOperationSchema(spec, operation)
+		if err != nil {
+			return fmt.Errorf("JSONSchema: %s", err)
+		}
+		var value interface{}
+		if err = json.Unmarshal(body, &value); err != nil {
+			return fmt.Errorf("JSONSchema: %s: body is not JSON: %s", operation, err)
+		}
+		if err = schema.validate(value, ""); err != nil {
+			return fmt.Errorf("JSONSchema: %s: %s", operation, err)
+		}
+		return nil
+	}
+}
+
+// schemaNode is a schema and the file it was found in, which $refs in it are relative to.
+type schemaNode struct {
+	file   string
+	schema interface{}
+}
+
+var (
+	schemaFilesMu sync.Mutex
+	// absolute path -> the parsed file, with its object keys converted to strings
+	schemaFiles = make(map[string]interface{})
+)
+
+// loadSchemaFile loads a YAML or JSON file from the cache, or disk.
+func loadSchemaFile(path string) (interface{}, error) {
+	path, err := filepath.Abs(path)
+	if err != nil {
+		return nil, err
+	}
+	schemaFilesMu.Lock()
+	defer schemaFilesMu.Unlock()
+	if doc, ok := schemaFiles[path]; ok {
+		return doc, nil
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var doc interface{}
+	if err = yaml.Unmarshal(data, &doc); err != nil {
+		return nil, fmt.Errorf("%s: %s", path, err)
+	}
+	doc = stringKeys(doc)
+	schemaFiles[path] = doc
+	return doc, nil
+}
+
+// stringKeys converts the maps decoded from YAML to map[string]interface{}, as response codes like 200 are
+// decoded as integer keys.
+func stringKeys(v interface{}) interface{} {
+	switch val := v.(type) {
+	case map[string]interface{}:
+		for k, item := range val {
+			val[k] = stringKeys(item)
+		}
+		return val
+	case map[interface{}]interface{}:
+		m := make(map[string]interface{}, len(val))
+		for k, item := range val {
+			m[fmt.Sprint(k)] = stringKeys(item)
+		}
+		return m
+	case []interface{}:
+		for i, item := range val {
+			val[i] = stringKeys(item)
+		}
+		return val
+	}
+	return v
+}
+
+// loadOperationSchema finds the response schema of the operation in the spec file or directory.
+func loadOperationSchema(spec, operation string) (*schemaNode, error) {
+	info, err := os.Stat(spec)
+	if err != nil {
+		return nil, err
+	}
+	files := []string{spec}
+	if info.IsDir() {
+		files, err = specFiles(spec)
+		if err != nil {
+			return nil, err
+		}
+	}
+	for _, file := range files {
+		doc, err := loadSchemaFile(file)
+		if err != nil {
+			return nil, err
+		}
+		op := findOperation(doc, operation)
+		if op == nil {
+			continue
+		}
+		responses, _ := op["responses"].(map[string]interface{})
+		res := responses["200"]
+		if res == nil {
+			codes := make([]string, 0, len(responses))
+			for code := range responses {
+				codes = append(codes, code)
+			}
+			sort.Strings(codes)
+			for _, code := range codes {
+				if strings.HasPrefix(code, "2") {
+					res = responses[code]
+					break
+				}
+			}
+		}
+		if res == nil {
+			return nil, fmt.Errorf("%s: operation %s has no successful response", file, operation)
+		}
+		node, err := (&schemaNode{file: file, schema: res}).resolve()
+		if err != nil {
+			return nil, err
+		}
+		resMap, _ := node.schema.(map[string]interface{})
+		// OpenAPI 3 puts the schema under the content type, Swagger 2 directly in the response
+		schema := resMap["schema"]
+		if content, ok := resMap["content"].(map[string]interface{}); ok {
+			mediaType, _ := content["application/json"].(map[string]interface{})
+			schema = mediaType["schema"]
+		}
+		if schema == nil {
+			return nil, fmt.Errorf("%s: operation %s has no JSON response schema", file, operation)
+		}
+		return &schemaNode{file: node.file, schema: schema}, nil
+	}
+	return nil, fmt.Errorf("no operation %s in %s", operation, spec)
+}
+
+func specFiles(dir string) ([]string, error) {
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var files []string
+	for _, e := range entries {
+		switch filepath.Ext(e.Name()) {
+		case ".yaml", ".yml", ".json":
+			if !e.IsDir() {
+				files = append(files, filepath.Join(dir, e.Name()))
+			}
+		}
+	}
+	return files, nil
+}
+
+func findOperation(doc interface{}, operationID string) map[string]interface{} {
+	docMap, _ := doc.(map[string]interface{})
+	paths, _ := docMap["paths"].(map[string]interface{})
+	for _, path := range paths {
+		methods, _ := path.(map[string]interface{})
+		for _, op := range methods {
+			opMap, ok := op.(map[string]interface{})
+			if ok && opMap["operationId"] == operationID {
+				return opMap
+			}
+		}
+	}
+	return nil
+}
+
+// resolve follows the $ref of the schema, if it has one, to the schema it refers to.
+func (n *schemaNode) resolve() (*schemaNode, error) {
+	for i := 0; i < 32; i++ {
+		m, ok := n.schema.(map[string]interface{})
+		if !ok {
+			return n, nil
+		}
+		ref, ok := m["$ref"].(string)
+		if !ok {
+			return n, nil
+		}
+		file := n.file
+		refPath, pointer, _ := strings.Cut(ref, "#")
+		if refPath != "" {
+			file = filepath.Join(filepath.Dir(n.file), refPath)
+		}
+		doc, err := loadSchemaFile(file)
+		if err != nil {
+			return nil, err
+		}
+		for _, part := range strings.Split(strings.Trim(pointer, "/"), "/") {
+			if part == "" {
+				continue
+			}
+			part = strings.ReplaceAll(strings.ReplaceAll(part, "~1", "/"), "~0", "~")
+			docMap, ok := doc.(map[string]interface{})
+			if !ok {
+				return nil, fmt.Errorf("%s: $ref %s not found", n.file, ref)
+			}
+			if doc, ok = docMap[part]; !ok {
+				return nil, fmt.Errorf("%s: $ref %s not found", n.file, ref)
+			}
+		}
+		n = &schemaNode{file: file, schema: doc}
+	}
+	return nil, fmt.Errorf("%s: too many nested $refs", n.file)
+}
+
+func (n *schemaNode) child(schema interface{}) *schemaNode {
+	return &schemaNode{file: n.file, schema: schema}
+}
+
+// validate checks `value`, which is at `path` in the body, against the schema.
+func (n *schemaNode) validate(value interface{}, path string) error {
+	n, err := n.resolve()
+	if err != nil {
+		return err
+	}
+	s, ok := n.schema.(map[string]interface{})
+	if !ok {
+		// `true`, `{}` or a schema we don't understand, which allow anything
+		if allowed, ok := n.schema.(bool); ok && !allowed {
+			return fmt.Errorf("%s: not allowed", pathName(path))
+		}
+		return nil
+	}
+	if value == nil && s["nullable"] == true {
+		return nil
+	}
+	if err = checkType(s["type"], value, path); err != nil {
+		return err
+	}
+	if enum, ok := s["enum"].([]interface{}); ok {
+		found := false
+		for _, e := range enum {
+			if schemaValueEqual(e, value) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return fmt.Errorf("%s: %v is not one of %v", pathName(path), value, enum)
+		}
+	}
+	if c, ok := s["const"]; ok && !schemaValueEqual(c, value) {
+		return fmt.Errorf("%s: %v is not %v", pathName(path), value, c)
+	}
+	for _, sub := range schemaList(s["allOf"]) {
+		if err = n.child(sub).validate(value, path); err != nil {
+			return err
+		}
+	}
+	if anyOf := schemaList(s["anyOf"]); len(anyOf) > 0 {
+		var errs []string
+		for _, sub := range anyOf {
+			if err = n.child(sub).validate(value, path); err == nil {
+				break
+			}
+			errs = append(errs, err.Error())
+		}
+		if len(errs) == len(anyOf) {
+			return fmt.Errorf("%s: matches none of anyOf: %s", pathName(path), strings.Join(errs, "; "))
+		}
+	}
+	if oneOf := schemaList(s["oneOf"]); len(oneOf) > 0 {
+		matches := 0
+		var errs []string
+		for _, sub := range oneOf {
+			if err = n.child(sub).validate(value, path); err != nil {
+				errs = append(errs, err.Error())
+			} else {
+				matches++
+			}
+		}
+		if matches != 1 {
+			return fmt.Errorf("%s: matches %d of oneOf, want 1: %s", pathName(path), matches, strings.Join(errs, "; "))
+		}
+	}
+	switch val := value.(type) {
+	case map[string]interface{}:
+		return n.validateObject(s, val, path)
+	case []interface{}:
+		if min, ok := schemaNumber(s["minItems"]); ok && float64(len(val)) < min {
+			return fmt.Errorf("%s: has %d items, want at least %v", pathName(path), len(val), min)
+		}
+		if max, ok := schemaNumber(s["maxItems"]); ok && float64(len(val)) > max {
+			return fmt.Errorf("%s: has %d items, want at most %v", pathName(path), len(val), max)
+		}
+		if items, ok := s["items"]; ok {
+			for i, item := range val {
+				if err = n.child(items).validate(item, joinPath(path, strconv.Itoa(i))); err != nil {
+					return err
+				}
+			}
+		}
+	case float64:
+		if min, ok := schemaNumber(s["minimum"]); ok && val < min {
+			return fmt.Errorf("%s: %v is less than %v", pathName(path), val, min)
+		}
+		if max, ok := schemaNumber(s["maximum"]); ok && val > max {
+			return fmt.Errorf("%s: %v is more than %v", pathName(path), val, max)
+		}
+	case string:
+		if pattern, ok := s["pattern"].(string); ok {
+			re, err := regexp.Compile(pattern)
+			if err == nil && !re.MatchString(val) {
+				return fmt.Errorf("%s: '%s' does not match %s", pathName(path), val, pattern)
+			}
+		}
+	}
+	return nil
+}
+
+func (n *schemaNode) validateObject(s map[string]interface{}, obj map[string]interface{}, path string) error {
+	for _, req := range schemaList(s["required"]) {
+		key, _ := req.(string)
+		if _, ok := obj[key]; !ok {
+			return fmt.Errorf("%s: required key '%s' missing", pathName(path), key)
+		}
+	}
+	properties, _ := s["properties"].(map[string]interface{})
+	patternProperties, _ := s["patternProperties"].(map[string]interface{})
+	keys := make([]string, 0, len(obj))
+	for key := range obj {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		keyPath := joinPath(path, key)
+		matched := false
+		if prop, ok := properties[key]; ok {
+			matched = true
+			if err := n.child(prop).validate(obj[key], keyPath); err != nil {
+				return err
+			}
+		}
+		for pattern, prop := range patternProperties {
+			re, err := regexp.Compile(pattern)
+			if err != nil || !re.MatchString(key) {
+				continue
+			}
+			matched = true
+			if err := n.child(prop).validate(obj[key], keyPath); err != nil {
+				return err
+			}
+		}
+		if matched {
+			continue
+		}
+		if additional, ok := s["additionalProperties"]; ok {
+			if err := n.child(additional).validate(obj[key], keyPath); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// checkType checks the value against the `type` of a schema, which is a type name or a list of them.
+func checkType(schemaType interface{}, value interface{}, path string) error {
+	var types []string
+	switch t := schemaType.(type) {
+	case string:
+		types = []string{t}
+	case []interface{}:
+		for _, item := range t {
+			if name, ok := item.(string); ok {
+				types = append(types, name)
+			}
+		}
+	default:
+		return nil
+	}
+	got := jsonTypeName(value)
+	for _, want := range types {
+		if want == got || (want == "number" && got == "integer") {
+			return nil
+		}
+	}
+	return fmt.Errorf("%s: got %s want %s", pathName(path), got, strings.Join(types, " or "))
+}
+
+func jsonTypeName(value interface{}) string {
+	switch val := value.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case float64:
+		if val == math.Trunc(val) {
+			return "integer"
+		}
+		return "number"
+	case string:
+		return "string"
+	case []interface{}:
+		return "array"
+	case map[string]interface{}:
+		return "object"
+	}
+	return fmt.Sprintf("%T", value)
+}
+
+// schemaValueEqual compares a value from the schema with one from the body, which only has float64 numbers.
+func schemaValueEqual(schemaValue, value interface{}) bool {
+	if num, ok := schemaNumber(schemaValue); ok {
+		f, ok := value.(float64)
+		return ok && f == num
+	}
+	return reflect.DeepEqual(schemaValue, value)
+}
+
+func schemaNumber(v interface{}) (float64, bool) {
+	switch num := v.(type) {
+	case int:
+		return float64(num), true
+	case int64:
+		return float64(num), true
+	case uint64:
+		return float64(num), true
+	case float64:
+		return num, true
+	}
+	return 0, false
+}
+
+func schemaList(v interface{}) []interface{} {
+	list, _ := v.([]interface{})
+	return list
+}
+
+func joinPath(path, key string) string {
+	if path == "" {
+		return key
+	}
+	return path + "." + key
+}
+
+func pathName(path string) string {
+	if path == "" {
+		return "body"
+	}
+	return "key '" + path + "'"
+}
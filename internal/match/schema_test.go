@@ -0,0 +1,139 @@
+package match
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestJSONSchema(t *testing.T) {
+	spec := filepath.Join("testdata", "spec")
+	testCases := []struct {
+		name      string
+		spec      string
+		operation string
+		body      string
+		wantErr   string
+	}{
+		{
+			name:      "valid",
+			operation: "getMembers",
+			body:      `{"chunk":[{"type":"m.room.member","content":{"membership":"join","displayname":null,"org.example.flag":true}}],"next_batch":"abc"}`,
+		},
+		{
+			name:      "type list",
+			operation: "getMembers",
+			body:      `{"chunk":[{"type":"m.room.member","content":{}}],"next_batch":null}`,
+		},
+		{
+			name:      "wrong type",
+			operation: "getMembers",
+			body:      `{"chunk":{}}`,
+			wantErr:   "key 'chunk': got object want array",
+		},
+		{
+			name:      "required key missing",
+			operation: "getMembers",
+			body:      `{}`,
+			wantErr:   "body: required key 'chunk' missing",
+		},
+		{
+			name:      "additional properties",
+			operation: "getMembers",
+			body:      `{"chunk":[{"type":"m.room.member","content":{}}],"extra":1}`,
+			wantErr:   "key 'extra': not allowed",
+		},
+		{
+			name:      "min items",
+			operation: "getMembers",
+			body:      `{"chunk":[]}`,
+			wantErr:   "has 0 items, want at least 1",
+		},
+		{
+			name:      "const in a $ref to another file",
+			operation: "getMembers",
+			body:      `{"chunk":[{"type":"m.room.message","content":{}}]}`,
+			wantErr:   "key 'chunk.0.type': m.room.message is not m.room.member",
+		},
+		{
+			name:      "enum",
+			operation: "getMembers",
+			body:      `{"chunk":[{"type":"m.room.member","content":{"membership":"joined"}}]}`,
+			wantErr:   "key 'chunk.0.content.membership': joined is not one of",
+		},
+		{
+			name:      "pattern properties",
+			operation: "getMembers",
+			body:      `{"chunk":[{"type":"m.room.member","content":{"org.example.flag":"yes"}}]}`,
+			wantErr:   "key 'chunk.0.content.org.example.flag': got string want boolean",
+		},
+		{
+			name:      "first 2xx response, via a $ref in the same file",
+			operation: "createRoomOnly",
+			body:      `{"room_id":"!abc:hs1","version":"10"}`,
+		},
+		{
+			name:      "pattern",
+			operation: "createRoomOnly",
+			body:      `{"room_id":"abc:hs1"}`,
+			wantErr:   "key 'room_id': 'abc:hs1' does not match ^!",
+		},
+		{
+			name:      "one of",
+			operation: "createRoomOnly",
+			body:      `{"room_id":"!abc:hs1","version":0}`,
+			wantErr:   "key 'version': matches 0 of oneOf, want 1",
+		},
+		{
+			name:      "swagger 2",
+			operation: "getVersions",
+			body:      `{"versions":["v1.1","v1.2","v1.3"]}`,
+			wantErr:   "key 'versions': has 3 items, want at most 2",
+		},
+		{
+			name:      "single file",
+			spec:      filepath.Join("testdata", "spec", "swagger.json"),
+			operation: "getVersions",
+			body:      `{"versions":["v1.1"]}`,
+		},
+		{
+			name:      "unknown operation",
+			operation: "getNothing",
+			body:      `{}`,
+			wantErr:   "no operation getNothing in",
+		},
+		{
+			name:      "not JSON",
+			operation: "getVersions",
+			body:      `{`,
+			wantErr:   "body is not JSON",
+		},
+	}
+	for _, tc := range testCases {
+		if tc.spec == "" {
+			tc.spec = spec
+		}
+		err := JSONSchema(tc.spec, tc.operation)([]byte(tc.body))
+		if tc.wantErr == "" {
+			if err != nil {
+				t.Errorf("%s: got error %s", tc.name, err)
+			}
+			continue
+		}
+		if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+			t.Errorf("%s: got error %v, want one containing %q", tc.name, err, tc.wantErr)
+		}
+	}
+}
+
+func TestJSONSchemaSpecDir(t *testing.T) {
+	invalid := []byte(`{"versions":"v1.1"}`)
+	t.Setenv("COMPLEMENT_SPEC_DIR", "")
+	if err := JSONSchema("", "getVersions")(invalid); err != nil {
+		t.Errorf("got error %s without COMPLEMENT_SPEC_DIR, want the check to be skipped", err)
+	}
+	t.Setenv("COMPLEMENT_SPEC_DIR", filepath.Join("testdata", "spec"))
+	if err := JSONSchema("", "getVersions")(invalid); err == nil {
+		t.Errorf("got no error with COMPLEMENT_SPEC_DIR set, want the body to be checked")
+	}
+}
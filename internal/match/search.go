@@ -0,0 +1,67 @@
+package match
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/tidwall/gjson"
+)
+
+// JSONSearchResultEventIDs returns a matcher which will check that the /search response has exactly the
+// room event results `wantEventIDs`, in that order.
+func JSONSearchResultEventIDs(wantEventIDs []string) JSON {
+	return JSONEventIDsInOrder("search_categories.room_events.results.#.result", wantEventIDs)
+}
+
+// JSONSearchHighlightsContain returns a matcher which will check that the /search response highlights
+// include all the `words`, ignoring case.
+func JSONSearchHighlightsContain(words ...string) JSON {
+	return func(body []byte) error {
+		highlights := gjson.GetBytes(body, "search_categories.room_events.highlights")
+		if !highlights.IsArray() {
+			return fmt.Errorf("search response has no highlights array")
+		}
+		for _, word := range words {
+			found := false
+			for _, highlight := range highlights.Array() {
+				if strings.EqualFold(highlight.Str, word) {
+					found = true
+					break
+				}
+			}
+			if !found {
+				return fmt.Errorf("search highlights %s do not contain '%s'", highlights.Raw, word)
+			}
+		}
+		return nil
+	}
+}
+
+// JSONSearchGroup returns a matcher which will check that the /search response has a group for `key` when
+// grouping by `groupBy`, e.g ("room_id", roomID), containing exactly the results `wantEventIDs` in any order.
+func JSONSearchGroup(groupBy, key string, wantEventIDs []string) JSON {
+	return func(body []byte) error {
+		group := gjson.GetBytes(body, "search_categories.room_events.groups."+escape(groupBy)+"."+escape(key))
+		if !group.Exists() {
+			return fmt.Errorf("search response has no group %s=%s", groupBy, key)
+		}
+		want := make([]interface{}, len(wantEventIDs))
+		for i, eventID := range wantEventIDs {
+			want[i] = eventID
+		}
+		err := JSONCheckOff("results", want, func(r gjson.Result) interface{} {
+			return r.Str
+		}, nil)([]byte(group.Raw))
+		if err != nil {
+			return fmt.Errorf("search group %s=%s: %s", groupBy, key, err)
+		}
+		return nil
+	}
+}
+
+// escape escapes . and * so the input can be used as a single key with gjson.Get
+func escape(in string) string {
+	in = strings.ReplaceAll(in, ".", `\.`)
+	in = strings.ReplaceAll(in, "*", `\*`)
+	return in
+}
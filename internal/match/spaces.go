@@ -0,0 +1,38 @@
+package match
+
+import (
+	"fmt"
+
+	"github.com/tidwall/gjson"
+)
+
+// JSONHierarchyRooms returns a matcher which will check that a /hierarchy response contains exactly the
+// rooms `wantRoomIDs`, in any order.
+func JSONHierarchyRooms(wantRoomIDs ...string) JSON {
+	want := make([]interface{}, len(wantRoomIDs))
+	for i, roomID := range wantRoomIDs {
+		want[i] = roomID
+	}
+	return JSONCheckOff("rooms", want, func(r gjson.Result) interface{} {
+		return r.Get("room_id").Str
+	}, nil)
+}
+
+// JSONHierarchyHasChild returns a matcher which will check that the room `parentID` in a /hierarchy response
+// has an m.space.child event for `childID` in its `children_state`.
+func JSONHierarchyHasChild(parentID, childID string) JSON {
+	return func(body []byte) error {
+		for _, room := range gjson.GetBytes(body, "rooms").Array() {
+			if room.Get("room_id").Str != parentID {
+				continue
+			}
+			for _, ev := range room.Get("children_state").Array() {
+				if ev.Get("type").Str == "m.space.child" && ev.Get("state_key").Str == childID {
+					return nil
+				}
+			}
+			return fmt.Errorf("room %s has no child %s in children_state: %s", parentID, childID, room.Get("children_state").Raw)
+		}
+		return fmt.Errorf("room %s is not in the hierarchy", parentID)
+	}
+}
@@ -0,0 +1,90 @@
+package match
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+
+	"github.com/tidwall/gjson"
+)
+
+// JSONStateEventContent returns a matcher which will check that the top-level array of state events, e.g from
+// /rooms/{roomID}/state, has a state event with type `eventType` and state key `stateKey`, and that its content
+// passes all the `matchers`.
+func JSONStateEventContent(eventType, stateKey string, matchers ...JSON) JSON {
+	return func(body []byte) error {
+		ev := findStateEvent(gjson.ParseBytes(body), eventType, stateKey)
+		if !ev.Exists() {
+			return fmt.Errorf("no state event (%s, %s)", eventType, stateKey)
+		}
+		for _, m := range matchers {
+			if err := m([]byte(ev.Get("content").Raw)); err != nil {
+				return fmt.Errorf("state event (%s, %s): %s", eventType, stateKey, err)
+			}
+		}
+		return nil
+	}
+}
+
+// JSONTombstonedTo returns a matcher which will check that the top-level array of state events of a room
+// which has been upgraded has an m.room.tombstone pointing to `newRoomID`.
+func JSONTombstonedTo(newRoomID string) JSON {
+	return JSONStateEventContent("m.room.tombstone", "", JSONKeyEqual("replacement_room", newRoomID))
+}
+
+// JSONUpgradedFrom returns a matcher which will check that the top-level array of state events of the room
+// created by an upgrade has carried over state from the old room, whose state before the upgrade was `oldState`:
+//   - the m.room.create event has a predecessor of `oldRoomID`,
+//   - the power levels are the same,
+//   - every user banned in the old room is banned in the new room.
+func JSONUpgradedFrom(oldRoomID string, oldState []byte) JSON {
+	return func(body []byte) error {
+		newState := gjson.ParseBytes(body)
+		old := gjson.ParseBytes(oldState)
+
+		create := findStateEvent(newState, "m.room.create", "")
+		if got := create.Get("content.predecessor.room_id").Str; got != oldRoomID {
+			return fmt.Errorf("m.room.create predecessor: got '%s' want '%s'", got, oldRoomID)
+		}
+
+		oldPL := findStateEvent(old, "m.room.power_levels", "").Get("content")
+		newPL := findStateEvent(newState, "m.room.power_levels", "").Get("content")
+		if !jsonEqual(oldPL.Raw, newPL.Raw) {
+			return fmt.Errorf("m.room.power_levels not carried over: got %s want %s", newPL.Raw, oldPL.Raw)
+		}
+
+		for _, ev := range old.Array() {
+			if ev.Get("type").Str != "m.room.member" || ev.Get("content.membership").Str != "ban" {
+				continue
+			}
+			userID := ev.Get("state_key").Str
+			newMember := findStateEvent(newState, "m.room.member", userID)
+			if newMember.Get("content.membership").Str != "ban" {
+				return fmt.Errorf("ban of %s not carried over, got membership '%s'", userID, newMember.Get("content.membership").Str)
+			}
+		}
+		return nil
+	}
+}
+
+func findStateEvent(state gjson.Result, eventType, stateKey string) gjson.Result {
+	for _, ev := range state.Array() {
+		sk := ev.Get("state_key")
+		if ev.Get("type").Str == eventType && sk.Exists() && sk.Str == stateKey {
+			return ev
+		}
+	}
+	return gjson.Result{}
+}
+
+// jsonEqual returns true if the two JSON strings are semantically equal, ignoring key ordering and whitespace.
+func jsonEqual(a, b string) bool {
+	var aVal, bVal interface{}
+	if err := json.Unmarshal([]byte(a), &aVal); err != nil {
+		return false
+	}
+	if err := json.Unmarshal([]byte(b), &bVal); err != nil {
+		return false
+	}
+	return reflect.DeepEqual(aVal, bVal)
+}
@@ -0,0 +1,35 @@
+package match
+
+import (
+	"fmt"
+
+	"github.com/tidwall/gjson"
+)
+
+// JSONRoomSummaryMembership returns a matcher which will check that a room summary (MSC3266) has the requesting
+// user's membership as `membership`. A missing membership is treated as "leave", as servers omit it when the
+// user has never been in the room.
+func JSONRoomSummaryMembership(membership string) JSON {
+	return func(body []byte) error {
+		got := gjson.GetBytes(body, "membership").Str
+		if got == "" {
+			got = "leave"
+		}
+		if got != membership {
+			return fmt.Errorf("room summary membership: got %s want %s", got, membership)
+		}
+		return nil
+	}
+}
+
+// JSONRoomSummaryJoinRule returns a matcher which will check that a room summary (MSC3266) has the join rule
+// `joinRule`.
+func JSONRoomSummaryJoinRule(joinRule string) JSON {
+	return JSONKeyEqual("join_rule", joinRule)
+}
+
+// JSONRoomSummaryJoinedMembers returns a matcher which will check that a room summary (MSC3266) has exactly
+// `count` joined members.
+func JSONRoomSummaryJoinedMembers(count int) JSON {
+	return JSONKeyEqual("num_joined_members", float64(count))
+}
@@ -0,0 +1,103 @@
+package match
+
+import (
+	"fmt"
+
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/tidwall/gjson"
+)
+
+// JSONEventsTopologicallyOrdered returns a matcher which will check that `wantKey` is an array of events in
+// which no event comes before an event it references, catching ordering bugs in /messages, /sync and backfill.
+// Set `reverse` for arrays which are newest first, e.g /messages with dir=b and backfill.
+//
+// References are prev_events and auth_events in the federation format (PDUs), and m.relates_to and redacts in
+// both formats. References to events which aren't in the array are ignored. PDUs must also have a greater
+// depth than their prev_events. `roomVersion` is used to work out the event IDs of PDUs, which aren't in the
+// events from room version 3 on.
+func JSONEventsTopologicallyOrdered(wantKey string, roomVersion gomatrixserverlib.RoomVersion, reverse bool) JSON {
+	return func(body []byte) error {
+		res := gjson.GetBytes(body, wantKey)
+		if !res.IsArray() {
+			return keyError(wantKey, nil, "key '%s' is missing or not an array", wantKey)
+		}
+		events := res.Array()
+		if reverse {
+			for i, j := 0, len(events)-1; i < j; i, j = i+1, j-1 {
+				events[i], events[j] = events[j], events[i]
+			}
+		}
+		eventIDs := make([]string, len(events))
+		positions := make(map[string]int, len(events))
+		for i, ev := range events {
+			eventID, err := topologyEventID(ev, roomVersion)
+			if err != nil {
+				return keyError(wantKey, nil, "key '%s' event %d: %s", wantKey, i, err)
+			}
+			eventIDs[i] = eventID
+			positions[eventID] = i
+		}
+		for i, ev := range events {
+			for _, ref := range eventReferences(ev) {
+				pos, ok := positions[ref.eventID]
+				if !ok {
+					continue
+				}
+				if pos >= i {
+					return keyError(wantKey, nil, "key '%s' has %s before %s, which it references in %s (reverse=%v)", wantKey, eventIDs[i], ref.eventID, ref.via, reverse)
+				}
+				if ref.via == "prev_events" && ev.Get("depth").Exists() && ev.Get("depth").Int() <= events[pos].Get("depth").Int() {
+					return keyError(
+						wantKey, nil, "key '%s' event %s has depth %d, which is not greater than the depth %d of its prev_event %s",
+						wantKey, eventIDs[i], ev.Get("depth").Int(), events[pos].Get("depth").Int(), ref.eventID,
+					)
+				}
+			}
+		}
+		return nil
+	}
+}
+
+type eventReference struct {
+	eventID string
+	// the key which referenced the event
+	via string
+}
+
+// eventReferences returns the events referenced by the event, in either format.
+func eventReferences(ev gjson.Result) []eventReference {
+	var refs []eventReference
+	for _, key := range []string{"prev_events", "auth_events"} {
+		for _, ref := range ev.Get(key).Array() {
+			// room versions 1 and 2 use [event_id, hashes] pairs
+			if ref.IsArray() {
+				ref = ref.Get("0")
+			}
+			refs = append(refs, eventReference{eventID: ref.Str, via: key})
+		}
+	}
+	if relatesTo := ev.Get(`content.m\.relates_to`); relatesTo.Exists() {
+		if eventID := relatesTo.Get("event_id").Str; eventID != "" {
+			refs = append(refs, eventReference{eventID: eventID, via: "m.relates_to"})
+		}
+		if eventID := relatesTo.Get(`m\.in_reply_to.event_id`).Str; eventID != "" {
+			refs = append(refs, eventReference{eventID: eventID, via: "m.relates_to"})
+		}
+	}
+	if eventID := ev.Get("redacts").Str; eventID != "" {
+		refs = append(refs, eventReference{eventID: eventID, via: "redacts"})
+	}
+	return refs
+}
+
+// topologyEventID returns the event ID of the event, working it out from the event if it is a PDU without one.
+func topologyEventID(ev gjson.Result, roomVersion gomatrixserverlib.RoomVersion) (string, error) {
+	if eventID := ev.Get("event_id").Str; eventID != "" {
+		return eventID, nil
+	}
+	pdu, err := gomatrixserverlib.NewEventFromTrustedJSON([]byte(ev.Raw), false, roomVersion)
+	if err != nil {
+		return "", fmt.Errorf("failed to work out event ID: %w", err)
+	}
+	return pdu.EventID(), nil
+}
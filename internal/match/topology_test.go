@@ -0,0 +1,157 @@
+package match
+
+import (
+	"crypto/ed25519"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+func TestJSONEventsTopologicallyOrdered(t *testing.T) {
+	// $create <- $msg <- $reply, with $msg redacted by $redaction
+	create := `{"event_id":"$create:hs1","type":"m.room.create","depth":1}`
+	msg := `{"event_id":"$msg:hs1","type":"m.room.message","depth":2,"prev_events":["$create:hs1"],"auth_events":["$create:hs1"]}`
+	reply := `{"event_id":"$reply:hs1","type":"m.room.message","content":{"m.relates_to":{"m.in_reply_to":{"event_id":"$msg:hs1"}}}}`
+	redaction := `{"event_id":"$redaction:hs1","type":"m.room.redaction","redacts":"$msg:hs1"}`
+	// room versions 1 and 2 reference events as [event_id, hashes]
+	msgV1 := `{"event_id":"$msg:hs1","type":"m.room.message","depth":2,"prev_events":[["$create:hs1",{"sha256":"abc"}]]}`
+	array := func(events ...string) []byte {
+		return []byte(`{"chunk":[` + strings.Join(events, ",") + `]}`)
+	}
+
+	testCases := []struct {
+		name        string
+		roomVersion gomatrixserverlib.RoomVersion
+		body        []byte
+		reverse     bool
+		wantErr     string
+	}{
+		{
+			name: "in order",
+			body: array(create, msg, reply, redaction),
+		},
+		{
+			name:    "in reverse order",
+			body:    array(redaction, reply, msg, create),
+			reverse: true,
+		},
+		{
+			name:    "reverse order without reverse",
+			body:    array(msg, create),
+			wantErr: "has $msg:hs1 before $create:hs1, which it references in prev_events (reverse=false)",
+		},
+		{
+			name:    "in order with reverse",
+			body:    array(create, msg),
+			reverse: true,
+			wantErr: "has $msg:hs1 before $create:hs1, which it references in prev_events (reverse=true)",
+		},
+		{
+			name:    "reply before its parent",
+			body:    array(create, reply, msg),
+			wantErr: "which it references in m.relates_to",
+		},
+		{
+			name:    "redaction before the event",
+			body:    array(redaction, create, msg),
+			wantErr: "which it references in redacts",
+		},
+		{
+			name:    "auth event after the event",
+			body:    array(`{"event_id":"$msg:hs1","auth_events":["$create:hs1"]}`, create),
+			wantErr: "which it references in auth_events",
+		},
+		{
+			name: "references to events not in the array are ignored",
+			body: array(msg, reply),
+		},
+		{
+			name:    "depth not greater than prev_events",
+			body:    array(create, strings.Replace(msg, `"depth":2`, `"depth":1`, 1)),
+			wantErr: "event $msg:hs1 has depth 1, which is not greater than the depth 1 of its prev_event $create:hs1",
+		},
+		{
+			name: "depth only checked for prev_events",
+			body: array(create, `{"event_id":"$member:hs1","depth":1,"auth_events":["$create:hs1"]}`),
+		},
+		{
+			name:        "v1 prev_events",
+			roomVersion: gomatrixserverlib.RoomVersionV1,
+			body:        array(create, msgV1),
+		},
+		{
+			name:        "v1 prev_events out of order",
+			roomVersion: gomatrixserverlib.RoomVersionV1,
+			body:        array(msgV1, create),
+			wantErr:     "has $msg:hs1 before $create:hs1, which it references in prev_events",
+		},
+		{
+			name:        "v1 prev_events with the same depth",
+			roomVersion: gomatrixserverlib.RoomVersionV1,
+			body:        array(create, strings.Replace(msgV1, `"depth":2`, `"depth":1`, 1)),
+			wantErr:     "is not greater than the depth 1",
+		},
+		{
+			name:    "not an array",
+			body:    []byte(`{"chunk":{}}`),
+			wantErr: "key 'chunk' is missing or not an array",
+		},
+	}
+	for _, tc := range testCases {
+		roomVersion := tc.roomVersion
+		if roomVersion == "" {
+			roomVersion = gomatrixserverlib.RoomVersionV6
+		}
+		err := JSONEventsTopologicallyOrdered("chunk", roomVersion, tc.reverse)(tc.body)
+		if tc.wantErr == "" && err != nil {
+			t.Errorf("%s: got error %s, want none", tc.name, err)
+		}
+		if tc.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tc.wantErr)) {
+			t.Errorf("%s: got error %v, want %q", tc.name, err, tc.wantErr)
+		}
+	}
+}
+
+func TestJSONEventsTopologicallyOrderedPDUs(t *testing.T) {
+	// PDUs from room version 3 on have no event IDs, so they are worked out from the events
+	_, privateKey, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatalf("failed to generate key: %s", err)
+	}
+	first := buildPDU(t, gomatrixserverlib.RoomVersionV6, privateKey)
+	eb := gomatrixserverlib.EventBuilder{
+		Sender:     "@alice:hs1",
+		RoomID:     "!room:hs1",
+		Type:       "m.room.message",
+		PrevEvents: []string{first.EventID()},
+		AuthEvents: []string{},
+		Depth:      2,
+	}
+	if err = eb.SetContent(map[string]interface{}{"body": "second"}); err != nil {
+		t.Fatalf("failed to set content: %s", err)
+	}
+	second, err := eb.Build(time.Now(), "hs1", "ed25519:1", privateKey, gomatrixserverlib.RoomVersionV6)
+	if err != nil {
+		t.Fatalf("failed to build event: %s", err)
+	}
+	for _, tc := range []struct {
+		events  []*gomatrixserverlib.Event
+		wantErr bool
+	}{
+		{events: []*gomatrixserverlib.Event{first, second}},
+		{events: []*gomatrixserverlib.Event{second, first}, wantErr: true},
+	} {
+		pdus := make([]json.RawMessage, len(tc.events))
+		for i, ev := range tc.events {
+			pdus[i] = ev.JSON()
+		}
+		body, _ := json.Marshal(map[string]interface{}{"pdus": pdus})
+		err := JSONEventsTopologicallyOrdered("pdus", gomatrixserverlib.RoomVersionV6, false)(body)
+		if (err != nil) != tc.wantErr {
+			t.Errorf("got error %v, want error: %v", err, tc.wantErr)
+		}
+	}
+}
@@ -0,0 +1,37 @@
+package match
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/tidwall/gjson"
+)
+
+// JSONTurnServerCredentials returns a matcher which will check that a /voip/turnServer response has a
+// non-empty username and password, and at least one turn: or turns: URI.
+func JSONTurnServerCredentials() JSON {
+	return func(body []byte) error {
+		res := gjson.ParseBytes(body)
+		for _, key := range []string{"username", "password"} {
+			if v := res.Get(key); v.Type != gjson.String || v.Str == "" {
+				return keyError(key, nil, "key '%s' is not a non-empty string: %s", key, v.Raw)
+			}
+		}
+		uris := res.Get("uris")
+		if !uris.IsArray() || len(uris.Array()) == 0 {
+			return fmt.Errorf("key 'uris' is not a non-empty array: %s", uris.Raw)
+		}
+		for _, uri := range uris.Array() {
+			if !strings.HasPrefix(uri.Str, "turn:") && !strings.HasPrefix(uri.Str, "turns:") {
+				return fmt.Errorf("uri %s is not a TURN URI", uri.Raw)
+			}
+		}
+		return nil
+	}
+}
+
+// JSONTurnServerTTL returns a matcher which will check that a /voip/turnServer response has a `ttl`, in seconds,
+// between `min` and `max` inclusive.
+func JSONTurnServerTTL(min, max int64) JSON {
+	return JSONKeyNumberInRange("ttl", float64(min), float64(max))
+}
@@ -15,6 +15,7 @@ import (
 	"github.com/matrix-org/gomatrixserverlib"
 
 	"github.com/matrix-org/complement/internal/match"
+	"github.com/matrix-org/complement/internal/timing"
 )
 
 // NotError will ensure `err` is nil else terminate the test with `msg`.
@@ -45,6 +46,7 @@ func MatchRequest(t *testing.T, req *http.Request, m match.HTTPRequest) []byte {
 	if err != nil {
 		t.Fatalf("MatchRequest: Failed to read request body: %s", err)
 	}
+	defer timing.Track(timing.PhaseAssertions)()
 
 	contextStr := fmt.Sprintf("%s => %s", req.URL.String(), string(body))
 
@@ -61,7 +63,7 @@ func MatchRequest(t *testing.T, req *http.Request, m match.HTTPRequest) []byte {
 		}
 		for _, jm := range m.JSON {
 			if err = jm(body); err != nil {
-				t.Fatalf("MatchRequest %s - %s", err, contextStr)
+				t.Fatalf("MatchRequest %s: %s", req.URL.String(), match.Diff(body, err))
 			}
 		}
 	}
@@ -85,34 +87,14 @@ func MatchFailure(t *testing.T, res *http.Response) {
 // MatchResponse consumes the HTTP response and performs HTTP-level assertions on it. Returns the raw response body.
 func MatchResponse(t *testing.T, res *http.Response, m match.HTTPResponse) []byte {
 	t.Helper()
-	body, err := ioutil.ReadAll(res.Body)
+	body, err := match.ReadHTTPResponseBody(res, m)
 	if err != nil {
 		t.Fatalf("MatchResponse: Failed to read response body: %s", err)
 	}
+	defer timing.Track(timing.PhaseAssertions)()
 
-	contextStr := fmt.Sprintf("%s => %s", res.Request.URL.String(), string(body))
-
-	if m.StatusCode != 0 {
-		if res.StatusCode != m.StatusCode {
-			t.Fatalf("MatchResponse got status %d want %d - %s", res.StatusCode, m.StatusCode, contextStr)
-		}
-	}
-	if m.Headers != nil {
-		for name, val := range m.Headers {
-			if res.Header.Get(name) != val {
-				t.Fatalf("MatchResponse got %s: %s want %s - %s", name, res.Header.Get(name), val, contextStr)
-			}
-		}
-	}
-	if m.JSON != nil {
-		if !gjson.ValidBytes(body) {
-			t.Fatalf("MatchResponse response body is not valid JSON - %s", contextStr)
-		}
-		for _, jm := range m.JSON {
-			if err = jm(body); err != nil {
-				t.Fatalf("MatchResponse %s - %s", err, contextStr)
-			}
-		}
+	if err = match.CheckHTTPResponse(res, body, m); err != nil {
+		t.Fatalf("MatchResponse %s: %s", res.Request.URL.String(), match.Diff(body, err))
 	}
 	return body
 }
@@ -120,6 +102,7 @@ func MatchResponse(t *testing.T, res *http.Response, m match.HTTPResponse) []byt
 // MatchFederationRequest performs JSON assertions on incoming federation requests.
 func MatchFederationRequest(t *testing.T, fedReq *gomatrixserverlib.FederationRequest, matchers ...match.JSON) {
 	t.Helper()
+	defer timing.Track(timing.PhaseAssertions)()
 	content := fedReq.Content()
 	if !gjson.ValidBytes(content) {
 		t.Fatalf("MatchFederationRequest content is not valid JSON - %s", fedReq.RequestURI())
@@ -127,32 +110,75 @@ func MatchFederationRequest(t *testing.T, fedReq *gomatrixserverlib.FederationRe
 
 	for _, jm := range matchers {
 		if err := jm(content); err != nil {
-			t.Fatalf("MatchFederationRequest %s - %s", err, fedReq.RequestURI())
+			t.Fatalf("MatchFederationRequest %s: %s", fedReq.RequestURI(), match.Diff(content, err))
 		}
 	}
 }
 
-// EqualStr ensures that got==want else logs an error.
-func EqualStr(t *testing.T, got, want, msg string) {
+// MatchFederationTransaction performs assertions on a /send transaction received from a homeserver, e.g
+// one from federation.Server.ReceivedTransactions().
+func MatchFederationTransaction(t *testing.T, body []byte, m match.FederationTransaction) {
+	t.Helper()
+	defer timing.Track(timing.PhaseAssertions)()
+	if err := match.CheckFederationTransaction(body, m); err != nil {
+		t.Fatalf("MatchFederationTransaction %s", match.Diff(body, err))
+	}
+}
+
+// MatchJSONBytes performs JSON assertions on a raw JSON body, e.g one which has already been read from a response.
+func MatchJSONBytes(t *testing.T, rawJson []byte, matchers ...match.JSON) {
+	t.Helper()
+	defer timing.Track(timing.PhaseAssertions)()
+	if !gjson.ValidBytes(rawJson) {
+		t.Fatalf("MatchJSONBytes: rawJson is not valid JSON")
+	}
+	for _, jm := range matchers {
+		if err := jm(rawJson); err != nil {
+			t.Fatalf("MatchJSONBytes %s", match.Diff(rawJson, err))
+		}
+	}
+}
+
+// Equal ensures that got==want else logs an error.
+func Equal[V comparable](t *testing.T, got, want V, msg string) {
 	t.Helper()
 	if got != want {
-		t.Errorf("EqualStr %s: got '%s' want '%s'", msg, got, want)
+		t.Errorf("Equal %s: got '%v' want '%v'", msg, got, want)
 	}
 }
 
-// NotEqualStr ensures that got!=want else logs an error.
-func NotEqualStr(t *testing.T, got, want, msg string) {
+// NotEqual ensures that got!=want else logs an error.
+func NotEqual[V comparable](t *testing.T, got, want V, msg string) {
 	t.Helper()
 	if got == want {
-		t.Errorf("NotEqualStr %s: got '%s', but didn't want it", msg, got)
+		t.Errorf("NotEqual %s: got '%v', but didn't want it", msg, got)
 	}
 }
 
-// StartWithStr ensures that got starts with wantPrefix else logs an error.
-func StartWithStr(t *testing.T, got, wantPrefix, msg string) {
+// ContainSubset ensures that every item in `smaller` is in `larger`, in any order, else logs an error
+// listing the missing items.
+func ContainSubset[V comparable](t *testing.T, larger []V, smaller []V, msg string) {
 	t.Helper()
-	if !strings.HasPrefix(got, wantPrefix) {
-		t.Errorf("StartWithStr: %s: got '%s' without prefix '%s'", msg, got, wantPrefix)
+	have := make(map[V]bool, len(larger))
+	for _, item := range larger {
+		have[item] = true
+	}
+	var missing []V
+	for _, item := range smaller {
+		if !have[item] {
+			missing = append(missing, item)
+		}
+	}
+	if len(missing) > 0 {
+		t.Errorf("ContainSubset %s: %v is missing %v", msg, larger, missing)
+	}
+}
+
+// StartWith ensures that got starts with wantPrefix else logs an error.
+func StartWith[S ~string](t *testing.T, got, wantPrefix S, msg string) {
+	t.Helper()
+	if !strings.HasPrefix(string(got), string(wantPrefix)) {
+		t.Errorf("StartWith %s: got '%s' without prefix '%s'", msg, got, wantPrefix)
 	}
 }
 
@@ -170,15 +196,15 @@ func GetJSONFieldStr(t *testing.T, body []byte, wantKey string) string {
 	return res.Str
 }
 
-// HaveInOrder checks that the two string slices match exactly, failing the test on mismatches or omissions.
-func HaveInOrder(t *testing.T, gots []string, wants []string) {
+// HaveInOrder checks that the two slices match exactly, failing the test on mismatches or omissions.
+func HaveInOrder[V comparable](t *testing.T, gots []V, wants []V) {
 	t.Helper()
 	if len(gots) != len(wants) {
-		t.Fatalf("HaveEventsInOrder: length mismatch, got %v want %v", gots, wants)
+		t.Fatalf("HaveInOrder: length mismatch, got %v want %v", gots, wants)
 	}
 	for i := range gots {
 		if gots[i] != wants[i] {
-			t.Errorf("HaveEventsInOrder: index %d got %s want %s", i, gots[i], wants[i])
+			t.Errorf("HaveInOrder: index %d got %v want %v", i, gots[i], wants[i])
 		}
 	}
 }
@@ -230,3 +256,30 @@ func CheckOff(t *testing.T, items []interface{}, wantItem interface{}) []interfa
 	items = append(items[:want], items[want+1:]...)
 	return items
 }
+
+// NotRateLimited fails the test if any of the status codes, e.g from CSAPI.Burst, is 429 Too Many Requests.
+func NotRateLimited(t *testing.T, statusCodes []int) {
+	t.Helper()
+	for i, code := range statusCodes {
+		if code == http.StatusTooManyRequests {
+			t.Fatalf("NotRateLimited: request %d of %d was rate limited: %v", i+1, len(statusCodes), statusCodes)
+		}
+	}
+}
+
+// RateLimitedAfter fails the test unless the first `burst` status codes, e.g from CSAPI.Burst, are not
+// 429 Too Many Requests and the one after them is.
+func RateLimitedAfter(t *testing.T, statusCodes []int, burst int) {
+	t.Helper()
+	if len(statusCodes) <= burst {
+		t.Fatalf("RateLimitedAfter: need more than %d requests to check the rate limit, got %d", burst, len(statusCodes))
+	}
+	for i, code := range statusCodes[:burst] {
+		if code == http.StatusTooManyRequests {
+			t.Fatalf("RateLimitedAfter: request %d was rate limited, want the first %d allowed: %v", i+1, burst, statusCodes)
+		}
+	}
+	if statusCodes[burst] != http.StatusTooManyRequests {
+		t.Fatalf("RateLimitedAfter: request %d was not rate limited: %v", burst+1, statusCodes)
+	}
+}
@@ -0,0 +1,197 @@
+// Package shard splits the tests of a package between CI jobs, so each job runs a share of them. Tests are
+// spread using how long they took in a previous run, so the shards take about as long as each other,
+// rather than by name, which leaves whichever shard gets the slow federation tests running long after
+// the others have finished.
+package shard
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"go/ast"
+	"go/build"
+	"go/parser"
+	"go/token"
+	"io/ioutil"
+	"log"
+	"path/filepath"
+	"regexp"
+	"runtime/debug"
+	"sort"
+	"strings"
+	"time"
+)
+
+// The duration assumed for tests with no recorded timing, if no tests have one.
+const defaultDuration = 10 * time.Second
+
+// Apply limits the tests of the package being tested to those in shard `index` of `total`, by setting the
+// -test.run flag, so it must be called from TestMain before m.Run. `timingsFile` is the JSON report written by
+// cmd/test-report for a previous run, or empty to spread the tests evenly by number. If -run was given, only
+// the tests it matches are sharded.
+//
+// Tests are found by parsing the _test.go files of the package in the working directory, which is the package
+// directory when run by `go test`, using the build tags the test binary was built with. Every shard must use
+// the same timings file for the shards to not overlap.
+func Apply(index, total int, timingsFile string) error {
+	if !flag.Parsed() {
+		flag.Parse()
+	}
+	runFlag := flag.Lookup("test.run")
+	if runFlag == nil {
+		return fmt.Errorf("shard: -test.run flag not found, Apply must be called from TestMain")
+	}
+	ctxt, pkg := buildContext()
+	tests, err := findTests(ctxt, ".")
+	if err != nil {
+		return fmt.Errorf("shard: failed to find tests: %w", err)
+	}
+	// only shard the tests -run selects, keeping the part of it which selects subtests
+	topPattern, subPattern := runFlag.Value.String(), ""
+	if i := strings.Index(topPattern, "/"); i >= 0 {
+		topPattern, subPattern = topPattern[:i], topPattern[i:]
+	}
+	if topPattern != "" {
+		re, err := regexp.Compile(topPattern)
+		if err != nil {
+			return fmt.Errorf("shard: bad -run pattern: %w", err)
+		}
+		var matched []string
+		for _, test := range tests {
+			if re.MatchString(test) {
+				matched = append(matched, test)
+			}
+		}
+		tests = matched
+	}
+	var timings map[string]time.Duration
+	if timingsFile != "" {
+		if timings, err = readTimings(timingsFile, pkg); err != nil {
+			return fmt.Errorf("shard: failed to read timings: %w", err)
+		}
+	}
+	shards, estimates := Partition(tests, timings, total)
+	selected := shards[index]
+	log.Printf("shard %d/%d: running %d of %d tests, estimated to take %v", index, total, len(selected), len(tests), estimates[index])
+	pattern := "^$" // nothing
+	if len(selected) > 0 {
+		quoted := make([]string, len(selected))
+		for i, test := range selected {
+			quoted[i] = regexp.QuoteMeta(test)
+		}
+		pattern = "^(" + strings.Join(quoted, "|") + ")$" + subPattern
+	}
+	return flag.Set("test.run", pattern)
+}
+
+// Partition splits the tests into `total` shards, each of about the same total duration, and returns them
+// along with their estimated durations. Tests with no timing are assumed to take as long as the average
+// test which has one. The result only depends on its arguments, so every shard computes the same partition.
+func Partition(tests []string, timings map[string]time.Duration, total int) ([][]string, []time.Duration) {
+	estimate := defaultDuration
+	if len(timings) > 0 {
+		var sum time.Duration
+		for _, d := range timings {
+			sum += d
+		}
+		estimate = sum / time.Duration(len(timings))
+	}
+	durations := make(map[string]time.Duration, len(tests))
+	for _, test := range tests {
+		if d, ok := timings[test]; ok {
+			durations[test] = d
+		} else {
+			durations[test] = estimate
+		}
+	}
+	sorted := append([]string(nil), tests...)
+	sort.Slice(sorted, func(i, j int) bool {
+		if durations[sorted[i]] != durations[sorted[j]] {
+			return durations[sorted[i]] > durations[sorted[j]]
+		}
+		return sorted[i] < sorted[j]
+	})
+	// give the longest remaining test to the shard with the least to do
+	shards := make([][]string, total)
+	estimates := make([]time.Duration, total)
+	for _, test := range sorted {
+		shortest := 0
+		for i := range estimates {
+			if estimates[i] < estimates[shortest] {
+				shortest = i
+			}
+		}
+		shards[shortest] = append(shards[shortest], test)
+		estimates[shortest] += durations[test]
+	}
+	for _, s := range shards {
+		sort.Strings(s)
+	}
+	return shards, estimates
+}
+
+// buildContext returns the build context the running test binary was built with, so findTests sees the same
+// files as `go test`, and the import path of the package being tested, or "" if it isn't known.
+func buildContext() (build.Context, string) {
+	ctxt := build.Default
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return ctxt, ""
+	}
+	for _, setting := range info.Settings {
+		if setting.Key == "-tags" && setting.Value != "" {
+			ctxt.BuildTags = strings.Split(setting.Value, ",")
+		}
+	}
+	return ctxt, strings.TrimSuffix(info.Path, ".test")
+}
+
+// findTests returns the names of the top-level tests in the package in `dir`, including its external _test
+// package, in the files which are built with `ctxt`.
+func findTests(ctxt build.Context, dir string) ([]string, error) {
+	pkg, err := ctxt.ImportDir(dir, 0)
+	if err != nil {
+		return nil, err
+	}
+	var tests []string
+	for _, name := range append(pkg.TestGoFiles, pkg.XTestGoFiles...) {
+		astFile, err := parser.ParseFile(token.NewFileSet(), filepath.Join(dir, name), nil, 0)
+		if err != nil {
+			return nil, err
+		}
+		for _, decl := range astFile.Decls {
+			fn, ok := decl.(*ast.FuncDecl)
+			if !ok || fn.Recv != nil || !strings.HasPrefix(fn.Name.Name, "Test") || fn.Name.Name == "TestMain" {
+				continue
+			}
+			tests = append(tests, fn.Name.Name)
+		}
+	}
+	sort.Strings(tests)
+	return tests, nil
+}
+
+// readTimings returns the durations of the top-level tests of the package `pkg` in a JSON report written by
+// cmd/test-report, which may cover several packages. If `pkg` is "", the tests of every package are returned.
+func readTimings(path, pkg string) (map[string]time.Duration, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var results []struct {
+		Package string  `json:"package"`
+		Test    string  `json:"test"`
+		Elapsed float64 `json:"elapsed_secs"`
+	}
+	if err = json.Unmarshal(b, &results); err != nil {
+		return nil, err
+	}
+	timings := make(map[string]time.Duration)
+	for _, r := range results {
+		if strings.Contains(r.Test, "/") || (pkg != "" && r.Package != pkg) {
+			continue
+		}
+		timings[r.Test] = time.Duration(r.Elapsed * float64(time.Second))
+	}
+	return timings, nil
+}
@@ -0,0 +1,128 @@
+package shard
+
+import (
+	"go/build"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestPartition(t *testing.T) {
+	testCases := []struct {
+		name          string
+		tests         []string
+		timings       map[string]time.Duration
+		total         int
+		wantShards    [][]string
+		wantEstimates []time.Duration
+	}{
+		{
+			name:          "no timings spreads tests evenly",
+			tests:         []string{"TestA", "TestB", "TestC"},
+			total:         2,
+			wantShards:    [][]string{{"TestA", "TestC"}, {"TestB"}},
+			wantEstimates: []time.Duration{2 * defaultDuration, defaultDuration},
+		},
+		{
+			name:  "slow tests are spread between shards",
+			tests: []string{"TestA", "TestB", "TestC", "TestD"},
+			timings: map[string]time.Duration{
+				"TestA": 10 * time.Second,
+				"TestB": 1 * time.Second,
+				"TestC": 9 * time.Second,
+				"TestD": 2 * time.Second,
+			},
+			total:         2,
+			wantShards:    [][]string{{"TestA", "TestB"}, {"TestC", "TestD"}},
+			wantEstimates: []time.Duration{11 * time.Second, 11 * time.Second},
+		},
+		{
+			name:  "tests without timings take the average",
+			tests: []string{"TestA", "TestB", "TestNew"},
+			timings: map[string]time.Duration{
+				"TestA":     6 * time.Second,
+				"TestB":     2 * time.Second,
+				"TestOther": 1 * time.Second,
+			},
+			total:         2,
+			wantShards:    [][]string{{"TestA"}, {"TestB", "TestNew"}},
+			wantEstimates: []time.Duration{6 * time.Second, 5 * time.Second},
+		},
+		{
+			name:          "more shards than tests",
+			tests:         []string{"TestA"},
+			total:         3,
+			wantShards:    [][]string{{"TestA"}, nil, nil},
+			wantEstimates: []time.Duration{defaultDuration, 0, 0},
+		},
+	}
+	for _, tc := range testCases {
+		shards, estimates := Partition(tc.tests, tc.timings, tc.total)
+		if !reflect.DeepEqual(shards, tc.wantShards) {
+			t.Errorf("%s: got shards %v want %v", tc.name, shards, tc.wantShards)
+		}
+		if !reflect.DeepEqual(estimates, tc.wantEstimates) {
+			t.Errorf("%s: got estimates %v want %v", tc.name, estimates, tc.wantEstimates)
+		}
+	}
+}
+
+func TestFindTests(t *testing.T) {
+	testCases := []struct {
+		tags []string
+		want []string
+	}{
+		{
+			want: []string{"TestA", "TestExternal"},
+		},
+		{
+			tags: []string{"tagged"},
+			want: []string{"TestA", "TestExternal", "TestTagged"},
+		},
+	}
+	for _, tc := range testCases {
+		ctxt := build.Default
+		ctxt.BuildTags = tc.tags
+		got, err := findTests(ctxt, "testdata/pkg")
+		if err != nil {
+			t.Fatalf("findTests with tags %v: %s", tc.tags, err)
+		}
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("findTests with tags %v: got %v want %v", tc.tags, got, tc.want)
+		}
+	}
+}
+
+func TestReadTimings(t *testing.T) {
+	testCases := []struct {
+		pkg  string
+		want map[string]time.Duration
+	}{
+		{
+			pkg: "example.com/pkg",
+			want: map[string]time.Duration{
+				"TestA":        1500 * time.Millisecond,
+				"TestExternal": 2 * time.Second,
+			},
+		},
+		{
+			pkg: "example.com/other",
+			want: map[string]time.Duration{
+				"TestA": 30 * time.Second,
+			},
+		},
+		{
+			pkg:  "example.com/missing",
+			want: map[string]time.Duration{},
+		},
+	}
+	for _, tc := range testCases {
+		got, err := readTimings("testdata/timings.json", tc.pkg)
+		if err != nil {
+			t.Fatalf("readTimings(%s): %s", tc.pkg, err)
+		}
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("readTimings(%s): got %v want %v", tc.pkg, got, tc.want)
+		}
+	}
+}
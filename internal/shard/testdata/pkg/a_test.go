@@ -0,0 +1,11 @@
+package pkg
+
+import "testing"
+
+func TestMain(m *testing.M) {}
+
+func TestA(t *testing.T) {}
+
+type suite struct{}
+
+func (s suite) TestMethod(t *testing.T) {}
@@ -0,0 +1,5 @@
+package pkg_test
+
+import "testing"
+
+func TestExternal(t *testing.T) {}
@@ -0,0 +1,7 @@
+//go:build tagged
+
+package pkg
+
+import "testing"
+
+func TestTagged(t *testing.T) {}
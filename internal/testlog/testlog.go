@@ -0,0 +1,222 @@
+// Package testlog is a leveled, structured logger for tests. Messages at or above the configured level are
+// logged to the test like t.Logf. Every message of a test given to Register, including those below the level,
+// is also kept, and written as JSON lines to a log file in COMPLEMENT_ARTIFACTS_DIR if the test fails, so failures which only happen
+// in CI can be debugged from the requests and waits which led up to them without rerunning with
+// COMPLEMENT_DEBUG=1.
+package testlog
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Level is the severity of a message.
+type Level int
+
+const (
+	LevelDebug Level = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+var levelNames = []string{"debug", "info", "warn", "error"}
+
+func (l Level) String() string {
+	if l < LevelDebug || l > LevelError {
+		return fmt.Sprintf("Level(%d)", int(l))
+	}
+	return levelNames[l]
+}
+
+// ParseLevel returns the level called `name`, e.g "debug".
+func ParseLevel(name string) (Level, error) {
+	for i, n := range levelNames {
+		if strings.EqualFold(name, n) {
+			return Level(i), nil
+		}
+	}
+	return LevelInfo, fmt.Errorf("unknown log level '%s', want one of %v", name, levelNames)
+}
+
+var unsafeFilenameChars = regexp.MustCompile(`[^a-zA-Z0-9_.-]+`)
+
+// Filename returns the name of the test `testName` with characters which are unsafe in filenames replaced, for
+// naming the files and directories Complement writes for the test, e.g in COMPLEMENT_ARTIFACTS_DIR. Every file
+// named after a test uses it, so the files of a test can be found by its name.
+func Filename(testName string) string {
+	return unsafeFilenameChars.ReplaceAllString(testName, "_")
+}
+
+var (
+	mu           sync.Mutex
+	artifactsDir string
+	minLevel     = LevelInfo
+	// test name -> messages logged for the test and its subtests, see Register
+	logs = make(map[string]*testLogs)
+)
+
+// Configure sets the directory to write the log files of failed tests to, empty to not write them, and the
+// lowest level of message which is logged to the test. It should be called from TestMain.
+func Configure(dir string, level Level) {
+	mu.Lock()
+	defer mu.Unlock()
+	artifactsDir = dir
+	minLevel = level
+}
+
+// The messages logged for a single test, as JSON lines.
+type testLogs struct {
+	mu    sync.Mutex
+	lines [][]byte
+	// True once the test finished and its log file was written, so later messages are dropped
+	done bool
+}
+
+// Logger logs messages for a test, along with its fields.
+type Logger struct {
+	t *testing.T
+	// The messages of the registered test, or nil if messages aren't kept
+	logs *testLogs
+	// key, value pairs added to every message
+	fields []interface{}
+}
+
+// Register keeps the messages logged for `t` and its subtests, and writes them to
+// COMPLEMENT_ARTIFACTS_DIR/<test name>/test.log when it finishes, if it failed. Cleanups run in reverse
+// order, so call it before registering anything which logs in a cleanup, e.g from Deploy. Messages logged
+// after the file is written are only logged to the test.
+func Register(t *testing.T) {
+	mu.Lock()
+	defer mu.Unlock()
+	name := t.Name()
+	if _, ok := logs[name]; ok {
+		return
+	}
+	l := &testLogs{}
+	logs[name] = l
+	t.Cleanup(func() {
+		mu.Lock()
+		delete(logs, name)
+		dir := artifactsDir
+		mu.Unlock()
+		l.mu.Lock()
+		l.done = true
+		l.mu.Unlock()
+		if t.Failed() && dir != "" {
+			l.write(t, filepath.Join(dir, Filename(name), "test.log"))
+		}
+	})
+}
+
+// ForTest returns a logger for `t`. Its messages are kept for the log file of `t`, or of the closest test it
+// is a subtest of, which was given to Register.
+func ForTest(t *testing.T) *Logger {
+	mu.Lock()
+	defer mu.Unlock()
+	name := t.Name()
+	for {
+		if l, ok := logs[name]; ok {
+			return &Logger{t: t, logs: l}
+		}
+		i := strings.LastIndex(name, "/")
+		if i < 0 {
+			return &Logger{t: t}
+		}
+		name = name[:i]
+	}
+}
+
+// With returns a logger which adds the key, value pairs to every message, e.g
+//
+//	testlog.ForTest(t).With("component", "client", "user", "@alice:hs1")
+func (l *Logger) With(keyvals ...interface{}) *Logger {
+	fields := make([]interface{}, 0, len(l.fields)+len(keyvals))
+	fields = append(fields, l.fields...)
+	fields = append(fields, keyvals...)
+	return &Logger{t: l.t, logs: l.logs, fields: fields}
+}
+
+// Debugf logs a message which is only shown in the test output with COMPLEMENT_LOG_LEVEL=debug.
+func (l *Logger) Debugf(format string, args ...interface{}) {
+	l.t.Helper()
+	l.Logf(LevelDebug, format, args...)
+}
+
+// Infof logs a message which is shown in the test output by default.
+func (l *Logger) Infof(format string, args ...interface{}) {
+	l.t.Helper()
+	l.Logf(LevelInfo, format, args...)
+}
+
+// Warnf logs a message about something which may make the test fail, e.g a request being retried.
+func (l *Logger) Warnf(format string, args ...interface{}) {
+	l.t.Helper()
+	l.Logf(LevelWarn, format, args...)
+}
+
+// Logf logs a message at `level`. It doesn't fail the test, even at LevelError.
+func (l *Logger) Logf(level Level, format string, args ...interface{}) {
+	l.t.Helper()
+	msg := fmt.Sprintf(format, args...)
+	entry := map[string]interface{}{
+		"time":  time.Now().Format(time.RFC3339Nano),
+		"level": level.String(),
+		"test":  l.t.Name(),
+		"msg":   msg,
+	}
+	var fields strings.Builder
+	for i := 0; i+1 < len(l.fields); i += 2 {
+		key := fmt.Sprint(l.fields[i])
+		entry[key] = l.fields[i+1]
+		fmt.Fprintf(&fields, " %s=%v", key, l.fields[i+1])
+	}
+	if line, err := json.Marshal(entry); err == nil && l.logs != nil {
+		l.logs.mu.Lock()
+		if !l.logs.done {
+			l.logs.lines = append(l.logs.lines, line)
+		}
+		l.logs.mu.Unlock()
+	}
+	mu.Lock()
+	show := level >= minLevel
+	mu.Unlock()
+	if !show {
+		return
+	}
+	if fields.Len() > 0 {
+		l.t.Logf("%s [%s]", msg, strings.TrimPrefix(fields.String(), " "))
+	} else {
+		l.t.Log(msg)
+	}
+}
+
+func (l *testLogs) write(t *testing.T, path string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if len(l.lines) == 0 {
+		return
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Logf("testlog: failed to create %s: %s", filepath.Dir(path), err)
+		return
+	}
+	var b []byte
+	for _, line := range l.lines {
+		b = append(b, line...)
+		b = append(b, '\n')
+	}
+	if err := ioutil.WriteFile(path, b, 0644); err != nil {
+		t.Logf("testlog: failed to write %s: %s", path, err)
+		return
+	}
+	t.Logf("testlog: wrote %d log lines to %s", len(l.lines), path)
+}
@@ -0,0 +1,132 @@
+package testlog
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// messages returns the messages kept in `l`.
+func messages(t *testing.T, l *testLogs) []string {
+	t.Helper()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	var msgs []string
+	for _, line := range l.lines {
+		var entry map[string]interface{}
+		if err := json.Unmarshal(line, &entry); err != nil {
+			t.Fatalf("log line %s is not JSON: %s", line, err)
+		}
+		msgs = append(msgs, entry["test"].(string)+": "+entry["msg"].(string))
+	}
+	return msgs
+}
+
+func TestRegister(t *testing.T) {
+	var l *testLogs
+	var late *Logger
+	t.Run("registered", func(t *testing.T) {
+		// registered before the writer, so run after it
+		t.Cleanup(func() {
+			ForTest(t).Infof("after the log file was written")
+			late = ForTest(t)
+		})
+		Register(t)
+		Register(t) // registering again does nothing
+		t.Cleanup(func() {
+			ForTest(t).Debugf("in cleanup")
+		})
+		mu.Lock()
+		l = logs[t.Name()]
+		mu.Unlock()
+		ForTest(t).With("user", "@alice:hs1").Infof("in test")
+		t.Run("subtest", func(t *testing.T) {
+			ForTest(t).Infof("in subtest")
+		})
+	})
+	want := []string{
+		"TestRegister/registered: in test",
+		"TestRegister/registered/subtest: in subtest",
+		"TestRegister/registered: in cleanup",
+	}
+	got := messages(t, l)
+	if len(got) != len(want) {
+		t.Fatalf("kept messages %v, want %v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("kept messages %v, want %v", got, want)
+			break
+		}
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if len(logs) != 0 {
+		t.Errorf("messages are still kept for %d tests after they finished", len(logs))
+	}
+	if late.logs != nil {
+		t.Errorf("logger made after the log file was written keeps messages")
+	}
+}
+
+func TestForTestWithoutRegister(t *testing.T) {
+	logger := ForTest(t)
+	logger.Infof("not kept")
+	if logger.logs != nil {
+		t.Errorf("logger of a test which wasn't registered keeps messages")
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if len(logs) != 0 {
+		t.Errorf("ForTest kept messages for %d tests, want none", len(logs))
+	}
+}
+
+func TestWrite(t *testing.T) {
+	l := &testLogs{lines: [][]byte{[]byte(`{"msg":"one"}`), []byte(`{"msg":"two"}`)}}
+	path := filepath.Join(t.TempDir(), "TestA", "test.log")
+	l.write(t, path)
+	got, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("failed to read log file: %s", err)
+	}
+	if want := "{\"msg\":\"one\"}\n{\"msg\":\"two\"}\n"; string(got) != want {
+		t.Errorf("log file is %q, want %q", got, want)
+	}
+}
+
+func TestParseLevel(t *testing.T) {
+	testCases := []struct {
+		name    string
+		want    Level
+		wantErr bool
+	}{
+		{name: "debug", want: LevelDebug},
+		{name: "WARN", want: LevelWarn},
+		{name: "verbose", want: LevelInfo, wantErr: true},
+	}
+	for _, tc := range testCases {
+		got, err := ParseLevel(tc.name)
+		if got != tc.want || (err != nil) != tc.wantErr {
+			t.Errorf("ParseLevel(%q) = %v, %v, want %v, error=%v", tc.name, got, err, tc.want, tc.wantErr)
+		}
+	}
+}
+
+func TestFilename(t *testing.T) {
+	testCases := []struct {
+		testName string
+		want     string
+	}{
+		{testName: "TestJoin", want: "TestJoin"},
+		{testName: "TestJoin/Parallel/join_v2.0", want: "TestJoin_Parallel_join_v2.0"},
+		{testName: "TestMedia/Can_download_'☃'", want: "TestMedia_Can_download__"},
+		{testName: "TestA//B", want: "TestA_B"},
+	}
+	for _, tc := range testCases {
+		if got := Filename(tc.testName); got != tc.want {
+			t.Errorf("Filename(%q) = %q, want %q", tc.testName, got, tc.want)
+		}
+	}
+}
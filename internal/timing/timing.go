@@ -0,0 +1,86 @@
+// Package timing records where the time of a test run goes, e.g building blueprints, deploying homeservers
+// and checking responses, so TestMain can print a summary at the end of the run. This shows whether making
+// tests faster means making Complement faster, or making the homeserver start faster.
+package timing
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The phases recorded by Complement itself.
+const (
+	PhaseBuild              = "build blueprints"
+	PhaseWaitForContainers  = "wait for COMPLEMENT_MAX_CONTAINERS"
+	PhaseDeploy             = "deploy homeservers"
+	PhaseHealthCheck        = "wait for homeservers to be healthy"
+	PhaseFederationStart    = "start federation servers"
+	PhaseFederationRequests = "handle federation requests"
+	PhaseAssertions         = "check responses"
+)
+
+type phase struct {
+	count int
+	total time.Duration
+	max   time.Duration
+}
+
+var (
+	mu     sync.Mutex
+	phases = make(map[string]*phase)
+)
+
+// Record adds `d` to the time spent in `name`.
+func Record(name string, d time.Duration) {
+	mu.Lock()
+	defer mu.Unlock()
+	p := phases[name]
+	if p == nil {
+		p = &phase{}
+		phases[name] = p
+	}
+	p.count++
+	p.total += d
+	if d > p.max {
+		p.max = d
+	}
+}
+
+// Track starts timing `name`, and returns a function which records the time since, e.g
+//
+//	defer timing.Track(timing.PhaseDeploy)()
+func Track(name string) func() {
+	start := time.Now()
+	return func() {
+		Record(name, time.Since(start))
+	}
+}
+
+// Summary returns a table of the time spent in each phase, longest first. `runTime` is the wall clock time of
+// the run, to compare against. Phases are timed for every test, so they add up to more than the run when
+// tests run in parallel, and some contain others, e.g deploying includes waiting for homeservers to be healthy.
+func Summary(runTime time.Duration) string {
+	mu.Lock()
+	defer mu.Unlock()
+	names := make([]string, 0, len(phases))
+	for name := range phases {
+		names = append(names, name)
+	}
+	sort.Slice(names, func(i, j int) bool {
+		return phases[names[i]].total > phases[names[j]].total
+	})
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "Timings for this run of %v:\n", runTime.Round(time.Millisecond))
+	fmt.Fprintf(&sb, "  %-40s %8s %12s %12s %12s\n", "phase", "count", "total", "mean", "max")
+	for _, name := range names {
+		p := phases[name]
+		fmt.Fprintf(
+			&sb, "  %-40s %8d %12v %12v %12v\n", name, p.count, p.total.Round(time.Millisecond),
+			(p.total / time.Duration(p.count)).Round(time.Millisecond), p.max.Round(time.Millisecond),
+		)
+	}
+	return strings.TrimSuffix(sb.String(), "\n")
+}
@@ -0,0 +1,145 @@
+// Package watchdog turns tests which hang into actionable failures. If a watched test is still running
+// after its timeout, the watchdog dumps what the test was waiting on, the most recent HTTP traffic,
+// any registered diagnostics such as homeserver logs, and the stacks of all goroutines, then panics to
+// stop the test run. Without this, `go test` kills the test binary on its own timeout and the test's
+// logs are lost.
+package watchdog
+
+import (
+	"fmt"
+	"log"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// The number of HTTP exchanges to keep for dumping
+const maxRecentHTTP = 100
+
+var (
+	mu         sync.Mutex
+	watchdogs  = make(map[*testing.T]*Watchdog)
+	recentHTTP []string
+	waiting    = make(map[int]string)
+	nextWaitID int
+)
+
+// Watchdog watches a single test. A nil Watchdog is valid and does nothing.
+type Watchdog struct {
+	t           *testing.T
+	timeout     time.Duration
+	timer       *time.Timer
+	mu          sync.Mutex
+	diagnostics []diagnostic
+}
+
+type diagnostic struct {
+	name string
+	fn   func()
+}
+
+// ForTest starts watching `t` if it isn't already being watched, and returns its Watchdog. The watchdog
+// stops when `t` finishes. Returns nil if `timeout` is 0, which disables the watchdog.
+func ForTest(t *testing.T, timeout time.Duration) *Watchdog {
+	if timeout == 0 {
+		return nil
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if w, ok := watchdogs[t]; ok {
+		return w
+	}
+	w := &Watchdog{
+		t:       t,
+		timeout: timeout,
+	}
+	w.timer = time.AfterFunc(timeout, w.fire)
+	watchdogs[t] = w
+	t.Cleanup(func() {
+		w.timer.Stop()
+		mu.Lock()
+		delete(watchdogs, t)
+		mu.Unlock()
+	})
+	return w
+}
+
+// AddDiagnostic registers a function which is called to print extra information if the test hangs,
+// e.g homeserver logs. `fn` should write to the standard logger.
+func (w *Watchdog) AddDiagnostic(name string, fn func()) {
+	if w == nil {
+		return
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.diagnostics = append(w.diagnostics, diagnostic{name, fn})
+}
+
+// Waiting records that `t` is blocked waiting for `what`, e.g a federation request to arrive. Call the
+// returned function when the wait is over.
+func Waiting(t *testing.T, what string) (done func()) {
+	mu.Lock()
+	defer mu.Unlock()
+	id := nextWaitID
+	nextWaitID++
+	waiting[id] = fmt.Sprintf("%s: %s (since %s)", t.Name(), what, time.Now().Format(time.RFC3339))
+	return func() {
+		mu.Lock()
+		defer mu.Unlock()
+		delete(waiting, id)
+	}
+}
+
+// RecordHTTP records a one line summary of an HTTP exchange, so the most recent exchanges can be dumped
+// if a test hangs.
+func RecordHTTP(t *testing.T, summary string) {
+	mu.Lock()
+	defer mu.Unlock()
+	recentHTTP = append(recentHTTP, fmt.Sprintf("%s %s: %s", time.Now().Format("15:04:05.000"), t.Name(), summary))
+	if len(recentHTTP) > maxRecentHTTP {
+		recentHTTP = recentHTTP[len(recentHTTP)-maxRecentHTTP:]
+	}
+}
+
+func (w *Watchdog) fire() {
+	log.Printf("============================================\n\n\n")
+	log.Printf("watchdog: %s is still running after %v, dumping diagnostics\n", w.t.Name(), w.timeout)
+
+	mu.Lock()
+	waits := make([]string, 0, len(waiting))
+	for _, what := range waiting {
+		waits = append(waits, what)
+	}
+	traffic := append([]string(nil), recentHTTP...)
+	mu.Unlock()
+	sort.Strings(waits)
+	log.Printf("watchdog: outstanding waits:\n%s\n", strings.Join(waits, "\n"))
+	log.Printf("watchdog: last %d HTTP exchanges:\n%s\n", len(traffic), strings.Join(traffic, "\n"))
+
+	w.mu.Lock()
+	diagnostics := append([]diagnostic(nil), w.diagnostics...)
+	w.mu.Unlock()
+	for _, d := range diagnostics {
+		log.Printf("watchdog: %s:\n", d.name)
+		d.fn()
+	}
+
+	log.Printf("watchdog: goroutines:\n%s\n", goroutineStacks())
+	log.Printf("============== watchdog: END DIAGNOSTICS ==============\n\n\n")
+	// The test goroutine is stuck so can't be failed from here. Panic like `go test -timeout` would.
+	panic(fmt.Sprintf("watchdog: %s timed out after %v", w.t.Name(), w.timeout))
+}
+
+func goroutineStacks() string {
+	buf := make([]byte, 1<<20)
+	for {
+		n := runtime.Stack(buf, true)
+		if n < len(buf) {
+			return string(buf[:n])
+		}
+		buf = make([]byte, 2*len(buf))
+	}
+}
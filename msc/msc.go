@@ -0,0 +1,44 @@
+// Package msc gates tests for Matrix Spec Change proposals (MSCs) at runtime, so a single build of
+// Complement can run any combination of MSC tests.
+//
+// MSC tests are skipped unless their MSC is listed in the COMPLEMENT_ENABLED_MSCS environment variable,
+// separated by spaces or commas e.g:
+//
+//	COMPLEMENT_ENABLED_MSCS="msc2716 msc3030" go test ./tests/...
+//
+// Setting it to "all" enables every MSC test.
+package msc
+
+import (
+	"os"
+	"strings"
+	"testing"
+)
+
+var enabled = parseEnabled(os.Getenv("COMPLEMENT_ENABLED_MSCS"))
+
+func parseEnabled(val string) map[string]bool {
+	mscs := make(map[string]bool)
+	for _, msc := range strings.FieldsFunc(val, func(r rune) bool {
+		return r == ' ' || r == ','
+	}) {
+		mscs[strings.ToLower(msc)] = true
+	}
+	return mscs
+}
+
+// Enabled returns true if tests for `msc` (e.g "msc2716") should run.
+func Enabled(msc string) bool {
+	return enabled["all"] || enabled[strings.ToLower(msc)]
+}
+
+// Test skips the test (via t.Skipf) unless `msc` is enabled, else returns. Call this at the start of
+// every test for an MSC, e.g:
+//
+//	msc.Test(t, "msc2716")
+func Test(t *testing.T, msc string) {
+	t.Helper()
+	if !Enabled(msc) {
+		t.Skipf("skipped as %s is not in COMPLEMENT_ENABLED_MSCS", msc)
+	}
+}
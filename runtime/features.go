@@ -0,0 +1,23 @@
+package runtime
+
+import (
+	"testing"
+
+	"github.com/matrix-org/complement/internal/client"
+)
+
+// Skip the test (via t.Skipf) if the homeserver `c` is connected to does not advertise all the `features` as
+// enabled in the `unstable_features` of /versions, e.g:
+//
+//	runtime.SkipIfUnsupported(t, alice, "org.matrix.msc3030")
+//
+// This allows tests for MSCs to skip cleanly on servers which haven't implemented them, rather than fail.
+func SkipIfUnsupported(t *testing.T, c *client.CSAPI, features ...string) {
+	t.Helper()
+	for _, feature := range features {
+		if !c.SupportsUnstableFeature(t, feature) {
+			t.Skipf("skipped as %s is not supported by the homeserver", feature)
+			return
+		}
+	}
+}
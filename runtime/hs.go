@@ -1,37 +1,177 @@
 package runtime
 
-import "testing"
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/complement/internal/docker"
+)
 
 const (
-	Dendrite = "dendrite"
-	Synapse  = "synapse"
+	Dendrite  = "dendrite"
+	Synapse   = "synapse"
+	Conduit   = "conduit"
+	Construct = "construct"
 )
 
+// The homeserver implementation being tested, or "" if it isn't known yet. Set via a `*_blacklist`
+// tag, the COMPLEMENT_HOMESERVER environment variable, or by asking the first deployed homeserver.
 var Homeserver string
 
-// Skip the test (via t.Skipf) if the homeserver being tested matches one of the homeservers, else return.
+var (
+	hsMu  sync.Mutex
+	skips []Skip
+	// Finds out which homeserver is being tested, see SetDetector
+	detector   func() (string, error)
+	detectOnce sync.Once
+)
+
+// Skip is a test which was skipped because of the homeserver implementation being tested.
+type Skip struct {
+	Test       string
+	Homeserver string
+	Reason     string
+}
+
+func init() {
+	if hs := os.Getenv("COMPLEMENT_HOMESERVER"); hs != "" {
+		Homeserver = strings.ToLower(hs)
+	}
+}
+
+// Skip the test (via t.Skipf) if the homeserver being tested is `hs`, else return. The `reason` is
+// included in the skip message and in Skips, so known failures can be reported per implementation, e.g:
+//
+//	runtime.SkipIf(t, runtime.Dendrite, "https://github.com/matrix-org/dendrite/issues/617")
 //
 // The homeserver being tested is detected via the presence of a `*_blacklist` tag e.g:
-//   go test -tags="dendrite_blacklist"
-// This means it is important to always specify this tag when running tests. Failure to do
-// so will result in a warning being printed to stdout, and the test will be run. When a new server
+//
+//	go test -tags="dendrite_blacklist"
+//
+// or the COMPLEMENT_HOMESERVER environment variable. Failing that, it is detected from the server name
+// in the federation /version response of the first homeserver deployed, or if SkipIf is called before
+// then, of the homeserver deployed by the function given to SetDetector. When a new server
 // implementation is added, a respective `hs_$name.go` needs to be created in this directory. This
 // file pairs together the tag name with a string constant declared in this package
 // e.g. dendrite_blacklist == runtime.Dendrite
-func SkipIf(t *testing.T, hses ...string) {
+func SkipIf(t *testing.T, hs string, reason string) {
 	t.Helper()
-	for _, hs := range hses {
-		if Homeserver == hs {
-			t.Skipf("skipped on %s", hs)
-			return
-		}
+	detectIfUnknown(t)
+	hsMu.Lock()
+	current := Homeserver
+	if current == hs {
+		skips = append(skips, Skip{
+			Test:       t.Name(),
+			Homeserver: hs,
+			Reason:     reason,
+		})
+	}
+	hsMu.Unlock()
+	if current == hs {
+		t.Skipf("skipped on %s: %s", hs, reason)
+		return
 	}
-	if Homeserver == "" {
+	if current == "" {
 		// they ran Complement without a blacklist so it's impossible to know what HS they are
 		// running, warn them.
 		t.Logf(
-			"WARNING: %s called runtime.SkipIf(%v) but Complement doesn't know which HS is running as it was run without a *_blacklist tag: executing test.",
-			t.Name(), hses,
+			"WARNING: %s called runtime.SkipIf(%s) but Complement doesn't know which HS is running as it was run without a *_blacklist tag: executing test.",
+			t.Name(), hs,
 		)
 	}
 }
+
+// Skips returns every test skipped by SkipIf so far, in the order they were skipped.
+func Skips() []Skip {
+	hsMu.Lock()
+	defer hsMu.Unlock()
+	return append([]Skip(nil), skips...)
+}
+
+// SetDetector sets the function SkipIf uses to find out which homeserver is being tested when it isn't known
+// yet, because no homeserver has been deployed. It is called at most once, and should deploy a homeserver
+// and return Detect of it. Call this from TestMain.
+func SetDetector(fn func() (string, error)) {
+	hsMu.Lock()
+	defer hsMu.Unlock()
+	detector = fn
+}
+
+// detectIfUnknown sets Homeserver using the function given to SetDetector, if it isn't already known.
+func detectIfUnknown(t *testing.T) {
+	t.Helper()
+	hsMu.Lock()
+	fn := detector
+	known := Homeserver != ""
+	hsMu.Unlock()
+	if known || fn == nil {
+		return
+	}
+	detectOnce.Do(func() {
+		hs, err := fn()
+		if err != nil {
+			t.Logf("runtime.SkipIf: failed to detect the homeserver: %s", err)
+			return
+		}
+		hsMu.Lock()
+		defer hsMu.Unlock()
+		if Homeserver == "" {
+			Homeserver = hs
+			t.Logf("runtime.SkipIf: detected %s", Homeserver)
+		}
+	})
+}
+
+// DetectHomeserver sets Homeserver from the federation /version response of `hsName` in the deployment,
+// if it isn't already known. Failures are logged rather than failing the test, as they only mean tests
+// will not be skipped.
+func DetectHomeserver(t *testing.T, deployment *docker.Deployment, hsName string) {
+	t.Helper()
+	hsMu.Lock()
+	defer hsMu.Unlock()
+	if Homeserver != "" {
+		return
+	}
+	hs, err := Detect(deployment, hsName)
+	if err != nil {
+		t.Logf("runtime.DetectHomeserver: %s", err)
+		return
+	}
+	Homeserver = hs
+	t.Logf("runtime.DetectHomeserver: detected %s", Homeserver)
+}
+
+// Detect returns the homeserver implementation of `hsName` in the deployment, e.g runtime.Synapse, from the
+// server name in its federation /version response.
+func Detect(deployment *docker.Deployment, hsName string) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, "GET", "https://"+hsName+"/_matrix/federation/v1/version", nil)
+	if err != nil {
+		return "", fmt.Errorf("failed to create request: %w", err)
+	}
+	cli := &http.Client{
+		Transport: &docker.RoundTripper{Deployment: deployment},
+	}
+	res, err := cli.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("failed to query %s: %w", hsName, err)
+	}
+	defer res.Body.Close()
+	var version struct {
+		Server struct {
+			Name string `json:"name"`
+		} `json:"server"`
+	}
+	if err = json.NewDecoder(res.Body).Decode(&version); err != nil {
+		return "", fmt.Errorf("failed to decode /version response from %s: %w", hsName, err)
+	}
+	return strings.ToLower(version.Server.Name), nil
+}
@@ -0,0 +1,8 @@
+//go:build conduit_blacklist
+// +build conduit_blacklist
+
+package runtime
+
+func init() {
+	Homeserver = Conduit
+}
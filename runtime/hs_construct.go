@@ -0,0 +1,8 @@
+//go:build construct_blacklist
+// +build construct_blacklist
+
+package runtime
+
+func init() {
+	Homeserver = Construct
+}
@@ -0,0 +1,48 @@
+package runtime
+
+import (
+	"sync"
+	"testing"
+)
+
+func TestSkipIfDetectsHomeserver(t *testing.T) {
+	if Homeserver != "" {
+		t.Skipf("the homeserver is already known to be %s", Homeserver)
+	}
+	calls := 0
+	SetDetector(func() (string, error) {
+		calls++
+		return Dendrite, nil
+	})
+	defer func() {
+		SetDetector(nil)
+		Homeserver = ""
+		detectOnce = sync.Once{}
+		skips = nil
+	}()
+	testCases := []struct {
+		hs          string
+		wantSkipped bool
+	}{
+		{hs: Dendrite, wantSkipped: true},
+		{hs: Synapse, wantSkipped: false},
+	}
+	for _, tc := range testCases {
+		var skipped bool
+		t.Run(tc.hs, func(t *testing.T) {
+			defer func() {
+				skipped = t.Skipped()
+			}()
+			SkipIf(t, tc.hs, "reason")
+		})
+		if skipped != tc.wantSkipped {
+			t.Errorf("SkipIf(%s) skipped=%v, want %v", tc.hs, skipped, tc.wantSkipped)
+		}
+	}
+	if calls != 1 {
+		t.Errorf("detector was called %d times, want once", calls)
+	}
+	if got := Skips(); len(got) != 1 || got[0].Homeserver != Dendrite {
+		t.Errorf("Skips() = %v, want the dendrite skip", got)
+	}
+}
@@ -0,0 +1,81 @@
+package tests
+
+import (
+	"testing"
+	"time"
+
+	"github.com/tidwall/gjson"
+
+	"github.com/matrix-org/complement/internal/appservice"
+	"github.com/matrix-org/complement/internal/b"
+	"github.com/matrix-org/complement/internal/client"
+	"github.com/matrix-org/complement/internal/match"
+	"github.com/matrix-org/complement/internal/must"
+)
+
+// Test that events are pushed to application services, and that application services can register
+// and masquerade as users in their namespace.
+func TestAppServiceMasqueradingAndTransactions(t *testing.T) {
+	as := appservice.NewServer(t)
+	cancel := as.Listen()
+	defer cancel()
+
+	deployment := Deploy(t, b.BlueprintAlice, as.DeployOption("hs1"))
+	defer deployment.Destroy(t)
+
+	alice := deployment.Client(t, "hs1", "@alice:hs1")
+	ghost := as.MustRegisterGhost(t, deployment, "hs1", as.Registration.ID+"_ghost")
+	roomID := alice.CreateRoom(t, map[string]interface{}{
+		"preset": "public_chat",
+	})
+	ghost.JoinRoom(t, roomID, nil)
+	alice.MustSyncUntil(t, client.SyncReq{}, client.SyncJoinedTo(ghost.UserID, roomID))
+
+	t.Run("Events in rooms with namespaced users are pushed to the application service", func(t *testing.T) {
+		eventID := alice.SendEventSynced(t, roomID, b.Event{
+			Type: "m.room.message",
+			Content: map[string]interface{}{
+				"msgtype": "m.text",
+				"body":    "Hello ghost",
+			},
+		})
+		as.AwaitTransaction(t, 10*time.Second, appservice.TransactionHasEvent(func(ev gjson.Result) bool {
+			return ev.Get("event_id").Str == eventID
+		}))
+	})
+
+	t.Run("Application services can set the timestamp of masqueraded events", func(t *testing.T) {
+		ts := time.Now().Add(-24 * time.Hour).Truncate(time.Millisecond)
+		res := ghost.MustDoFunc(
+			t, "PUT", []string{"_matrix", "client", "r0", "rooms", roomID, "send", "m.room.message", "ts-1"},
+			client.WithJSONBody(t, map[string]interface{}{
+				"msgtype": "m.text",
+				"body":    "Hello from yesterday",
+			}),
+			appservice.WithTimestamp(ts),
+		)
+		eventID := client.GetJSONFieldStr(t, client.ParseJSON(t, res), "event_id")
+		res = alice.MustDoFunc(t, "GET", []string{"_matrix", "client", "r0", "rooms", roomID, "event", eventID})
+		must.MatchResponse(t, res, match.HTTPResponse{
+			JSON: []match.JSON{
+				match.JSONKeyEqual("sender", ghost.UserID),
+				match.JSONKeyEqual("origin_server_ts", float64(ts.UnixNano()/int64(time.Millisecond))),
+			},
+		})
+	})
+
+	t.Run("Application services can be pinged by the homeserver", func(t *testing.T) {
+		asClient := as.Client(t, deployment, "hs1")
+		res := asClient.PingAppService(t, as.Registration.ID, "ping-1")
+		must.MatchResponse(t, res, match.HTTPResponse{
+			StatusCode: 200,
+			JSON: []match.JSON{
+				match.JSONKeyPresent("duration_ms"),
+			},
+		})
+		pings := as.Pings()
+		if len(pings) != 1 || pings[0] != "ping-1" {
+			t.Errorf("expected application service to receive a single ping with transaction ID ping-1, got %v", pings)
+		}
+	})
+}
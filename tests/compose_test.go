@@ -0,0 +1,33 @@
+package tests
+
+import (
+	"testing"
+
+	"github.com/matrix-org/complement/internal/b"
+	"github.com/matrix-org/complement/internal/client"
+)
+
+// The example from "Compose files" in the README.
+var blueprintProxiedHS = b.MustValidate(b.Blueprint{
+	Name: "proxied_hs",
+	Homeservers: []b.Homeserver{
+		{
+			Name:    "hs1",
+			Compose: &b.Compose{File: "testdata/proxied-hs.yaml", Service: "proxy"},
+			Users:   []b.User{{Localpart: "@alice"}},
+		},
+	},
+})
+
+// Tests that a homeserver can run from a compose file, behind a proxy service which Complement sends its
+// requests to.
+func TestComposeHomeserver(t *testing.T) {
+	deployment := Deploy(t, blueprintProxiedHS)
+	defer deployment.Destroy(t)
+
+	alice := deployment.Client(t, "hs1", "@alice:hs1")
+	roomID := alice.CreateRoom(t, map[string]interface{}{
+		"preset": "private_chat",
+	})
+	alice.MustSyncUntil(t, client.SyncReq{}, client.SyncJoinedTo(alice.UserID, roomID))
+}
@@ -7,6 +7,8 @@ package csapi_tests
 import (
 	"testing"
 
+	"github.com/tidwall/gjson"
+
 	"github.com/matrix-org/complement/internal/b"
 	"github.com/matrix-org/complement/internal/client"
 	"github.com/matrix-org/complement/internal/match"
@@ -47,3 +49,27 @@ func TestPresence(t *testing.T) {
 		})
 	})
 }
+
+func TestPresenceSync(t *testing.T) {
+	deployment := Deploy(t, b.BlueprintOneToOneRoom)
+	defer deployment.Destroy(t)
+
+	alice := deployment.Client(t, "hs1", "@alice:hs1")
+	bob := deployment.Client(t, "hs1", "@bob:hs1")
+
+	// sytest: Presence changes are reported to local room members
+	t.Run("Presence changes are reported to local room members", func(t *testing.T) {
+		statusMsg := "Away from keyboard"
+		bob.SetPresence(t, "unavailable", statusMsg)
+		alice.MustSyncUntil(t, client.SyncReq{}, client.SyncPresenceHas(bob.UserID, func(ev gjson.Result) bool {
+			return ev.Get("content.presence").Str == "unavailable" && ev.Get("content.status_msg").Str == statusMsg
+		}))
+		res := alice.GetPresence(t, bob.UserID)
+		must.MatchResponse(t, res, match.HTTPResponse{
+			JSON: []match.JSON{
+				match.JSONKeyEqual("presence", "unavailable"),
+				match.JSONKeyEqual("status_msg", statusMsg),
+			},
+		})
+	})
+}
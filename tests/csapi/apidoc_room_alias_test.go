@@ -1,46 +1,17 @@
 package csapi_tests
 
 import (
-	"net/http"
 	"testing"
 
 	"github.com/matrix-org/complement/internal/b"
 	"github.com/matrix-org/complement/internal/client"
+	"github.com/matrix-org/complement/internal/docker"
 	"github.com/matrix-org/complement/internal/match"
 	"github.com/matrix-org/complement/internal/must"
 )
 
-func setRoomAliasResp(t *testing.T, c *client.CSAPI, roomID, roomAlias string) *http.Response {
-	return c.DoFunc(t, "PUT", []string{"_matrix", "client", "r0", "directory", "room", roomAlias}, client.WithJSONBody(t, map[string]interface{}{
-		"room_id": roomID,
-	}))
-}
-
-func getRoomAliasResp(t *testing.T, c *client.CSAPI, roomAlias string) *http.Response {
-	return c.DoFunc(t, "GET", []string{"_matrix", "client", "r0", "directory", "room", roomAlias})
-}
-
-func deleteRoomAliasResp(t *testing.T, c *client.CSAPI, roomAlias string) *http.Response {
-	return c.DoFunc(t, "DELETE", []string{"_matrix", "client", "r0", "directory", "room", roomAlias})
-}
-
-func listRoomAliasesResp(t *testing.T, c *client.CSAPI, roomID string) *http.Response {
-	return c.DoFunc(t, "GET", []string{"_matrix", "client", "r0", "rooms", roomID, "aliases"})
-}
-
-func setCanonicalAlias(t *testing.T, c *client.CSAPI, roomID string, roomAlias string, altAliases *[]string) *http.Response {
-	content := map[string]interface{}{
-		"alias": roomAlias,
-	}
-	if altAliases != nil {
-		content["alt_aliases"] = altAliases
-	}
-
-	return c.DoFunc(t, "PUT", []string{"_matrix", "client", "r0", "rooms", roomID, "state", "m.room.canonical_alias"}, client.WithJSONBody(t, content))
-}
-
 func TestRoomAlias(t *testing.T) {
-	deployment := Deploy(t, b.BlueprintOneToOneRoom)
+	deployment := Deploy(t, b.BlueprintOneToOneRoom, docker.WithIsolation()) // uses fixed room aliases
 	defer deployment.Destroy(t)
 	alice := deployment.Client(t, "hs1", "@alice:hs1")
 	bob := deployment.Client(t, "hs1", "@bob:hs1")
@@ -54,9 +25,9 @@ func TestRoomAlias(t *testing.T) {
 
 			roomAlias := "#creates_alias:hs1"
 
-			setRoomAliasResp(t, alice, roomID, roomAlias)
+			alice.SetRoomAlias(t, roomID, roomAlias)
 
-			res := getRoomAliasResp(t, alice, roomAlias)
+			res := alice.GetRoomAlias(t, roomAlias)
 
 			must.MatchResponse(t, res, match.HTTPResponse{
 				JSON: []match.JSON{
@@ -70,7 +41,7 @@ func TestRoomAlias(t *testing.T) {
 			t.Parallel()
 			roomID := alice.CreateRoom(t, map[string]interface{}{})
 
-			res := listRoomAliasesResp(t, alice, roomID)
+			res := alice.GetRoomAliases(t, roomID)
 
 			must.MatchResponse(t, res, match.HTTPResponse{
 				JSON: []match.JSON{
@@ -80,9 +51,9 @@ func TestRoomAlias(t *testing.T) {
 
 			roomAlias := "#lists_aliases:hs1"
 
-			setRoomAliasResp(t, alice, roomID, roomAlias)
+			alice.SetRoomAlias(t, roomID, roomAlias)
 
-			res = listRoomAliasesResp(t, alice, roomID)
+			res = alice.GetRoomAliases(t, roomID)
 
 			must.MatchResponse(t, res, match.HTTPResponse{
 				JSON: []match.JSON{
@@ -98,13 +69,13 @@ func TestRoomAlias(t *testing.T) {
 
 			roomAlias := "#room_members_list:hs1"
 
-			res := setRoomAliasResp(t, alice, roomID, roomAlias)
+			res := alice.SetRoomAlias(t, roomID, roomAlias)
 			must.MatchResponse(t, res, match.HTTPResponse{
 				StatusCode: 200,
 			})
 
 			// An extra check to make sure we're not being racy rn
-			res = getRoomAliasResp(t, alice, roomAlias)
+			res = alice.GetRoomAlias(t, roomAlias)
 			must.MatchResponse(t, res, match.HTTPResponse{
 				StatusCode: 200,
 				JSON: []match.JSON{
@@ -112,7 +83,7 @@ func TestRoomAlias(t *testing.T) {
 				},
 			})
 
-			res = listRoomAliasesResp(t, bob, roomID)
+			res = bob.GetRoomAliases(t, roomID)
 			must.MatchResponse(t, res, match.HTTPResponse{
 				StatusCode: 403,
 			})
@@ -121,7 +92,7 @@ func TestRoomAlias(t *testing.T) {
 }
 
 func TestRoomDeleteAlias(t *testing.T) {
-	deployment := Deploy(t, b.BlueprintOneToOneRoom)
+	deployment := Deploy(t, b.BlueprintOneToOneRoom, docker.WithIsolation()) // uses fixed room aliases
 	defer deployment.Destroy(t)
 	alice := deployment.Client(t, "hs1", "@alice:hs1")
 	bob := deployment.Client(t, "hs1", "@bob:hs1")
@@ -139,13 +110,13 @@ func TestRoomDeleteAlias(t *testing.T) {
 
 			roomAlias := "#no_ops_delete:hs1"
 
-			res := setRoomAliasResp(t, bob, roomID, roomAlias)
+			res := bob.SetRoomAlias(t, roomID, roomAlias)
 			must.MatchResponse(t, res, match.HTTPResponse{
 				StatusCode: 200,
 			})
 
 			// An extra check to make sure we're not being racy rn
-			res = getRoomAliasResp(t, bob, roomAlias)
+			res = bob.GetRoomAlias(t, roomAlias)
 			must.MatchResponse(t, res, match.HTTPResponse{
 				StatusCode: 200,
 				JSON: []match.JSON{
@@ -153,7 +124,7 @@ func TestRoomDeleteAlias(t *testing.T) {
 				},
 			})
 
-			res = deleteRoomAliasResp(t, bob, roomAlias)
+			res = bob.DeleteRoomAlias(t, roomAlias)
 			must.MatchResponse(t, res, match.HTTPResponse{
 				StatusCode: 200,
 			})
@@ -171,13 +142,13 @@ func TestRoomDeleteAlias(t *testing.T) {
 
 			roomAlias := "#no_ops_delete_canonical:hs1"
 
-			res := setRoomAliasResp(t, bob, roomID, roomAlias)
+			res := bob.SetRoomAlias(t, roomID, roomAlias)
 			must.MatchResponse(t, res, match.HTTPResponse{
 				StatusCode: 200,
 			})
 
 			// An extra check to make sure we're not being racy rn
-			res = getRoomAliasResp(t, bob, roomAlias)
+			res = bob.GetRoomAlias(t, roomAlias)
 			must.MatchResponse(t, res, match.HTTPResponse{
 				StatusCode: 200,
 				JSON: []match.JSON{
@@ -185,7 +156,7 @@ func TestRoomDeleteAlias(t *testing.T) {
 				},
 			})
 
-			res = setCanonicalAlias(t, alice, roomID, roomAlias, nil)
+			res = alice.SetCanonicalAlias(t, roomID, roomAlias, nil)
 
 			must.MatchResponse(t, res, match.HTTPResponse{
 				StatusCode: 200,
@@ -194,7 +165,7 @@ func TestRoomDeleteAlias(t *testing.T) {
 				},
 			})
 
-			res = deleteRoomAliasResp(t, bob, roomAlias)
+			res = bob.DeleteRoomAlias(t, roomAlias)
 			must.MatchResponse(t, res, match.HTTPResponse{
 				StatusCode: 200,
 			})
@@ -206,7 +177,7 @@ func TestRoomDeleteAlias(t *testing.T) {
 
 			roomAlias := "#scatman_portal:hs1"
 
-			res := deleteRoomAliasResp(t, bob, roomAlias)
+			res := bob.DeleteRoomAlias(t, roomAlias)
 			must.MatchResponse(t, res, match.HTTPResponse{
 				StatusCode: 404,
 				JSON: []match.JSON{
@@ -218,7 +189,7 @@ func TestRoomDeleteAlias(t *testing.T) {
 }
 
 func TestRoomCanonicalAlias(t *testing.T) {
-	deployment := Deploy(t, b.BlueprintAlice)
+	deployment := Deploy(t, b.BlueprintAlice, docker.WithIsolation()) // uses fixed room aliases
 	defer deployment.Destroy(t)
 	alice := deployment.Client(t, "hs1", "@alice:hs1")
 
@@ -234,12 +205,12 @@ func TestRoomCanonicalAlias(t *testing.T) {
 
 			roomAlias := "#accepts_present_aliases:hs1"
 
-			res := setRoomAliasResp(t, alice, roomID, roomAlias)
+			res := alice.SetRoomAlias(t, roomID, roomAlias)
 			must.MatchResponse(t, res, match.HTTPResponse{
 				StatusCode: 200,
 			})
 
-			res = setCanonicalAlias(t, alice, roomID, roomAlias, nil)
+			res = alice.SetCanonicalAlias(t, roomID, roomAlias, nil)
 
 			must.MatchResponse(t, res, match.HTTPResponse{
 				StatusCode: 200,
@@ -258,7 +229,7 @@ func TestRoomCanonicalAlias(t *testing.T) {
 
 			roomAlias := "#rejects_missing:hs1"
 
-			res := setCanonicalAlias(t, alice, roomID, roomAlias, nil)
+			res := alice.SetCanonicalAlias(t, roomID, roomAlias, nil)
 
 			must.MatchResponse(t, res, match.HTTPResponse{
 				StatusCode: 400,
@@ -277,7 +248,7 @@ func TestRoomCanonicalAlias(t *testing.T) {
 
 			roomAlias := "%invalid_aliases:hs1"
 
-			res := setCanonicalAlias(t, alice, roomID, roomAlias, nil)
+			res := alice.SetCanonicalAlias(t, roomID, roomAlias, nil)
 
 			must.MatchResponse(t, res, match.HTTPResponse{
 				StatusCode: 400,
@@ -295,23 +266,23 @@ func TestRoomCanonicalAlias(t *testing.T) {
 
 			roomAlias := "#deleted_aliases:hs1"
 
-			res := setRoomAliasResp(t, alice, roomID, roomAlias)
+			res := alice.SetRoomAlias(t, roomID, roomAlias)
 			must.MatchResponse(t, res, match.HTTPResponse{
 				StatusCode: 200,
 			})
 
-			res = deleteRoomAliasResp(t, alice, roomAlias)
+			res = alice.DeleteRoomAlias(t, roomAlias)
 			must.MatchResponse(t, res, match.HTTPResponse{
 				StatusCode: 200,
 			})
 
 			// An extra check to make sure we're not being racy rn
-			res = getRoomAliasResp(t, alice, roomAlias)
+			res = alice.GetRoomAlias(t, roomAlias)
 			must.MatchResponse(t, res, match.HTTPResponse{
 				StatusCode: 404,
 			})
 
-			res = setCanonicalAlias(t, alice, roomID, roomAlias, nil)
+			res = alice.SetCanonicalAlias(t, roomID, roomAlias, nil)
 
 			must.MatchResponse(t, res, match.HTTPResponse{
 				StatusCode: 400,
@@ -330,12 +301,12 @@ func TestRoomCanonicalAlias(t *testing.T) {
 
 			roomAlias := "#diffroom1:hs1"
 
-			res := setRoomAliasResp(t, alice, room1, roomAlias)
+			res := alice.SetRoomAlias(t, room1, roomAlias)
 			must.MatchResponse(t, res, match.HTTPResponse{
 				StatusCode: 200,
 			})
 
-			res = setCanonicalAlias(t, alice, room2, roomAlias, nil)
+			res = alice.SetCanonicalAlias(t, room2, roomAlias, nil)
 
 			must.MatchResponse(t, res, match.HTTPResponse{
 				StatusCode: 400,
@@ -354,12 +325,12 @@ func TestRoomCanonicalAlias(t *testing.T) {
 
 			roomAlias := "#alt_present_alias:hs1"
 
-			res := setRoomAliasResp(t, alice, roomID, roomAlias)
+			res := alice.SetRoomAlias(t, roomID, roomAlias)
 			must.MatchResponse(t, res, match.HTTPResponse{
 				StatusCode: 200,
 			})
 
-			res = setCanonicalAlias(t, alice, roomID, roomAlias, &[]string{roomAlias})
+			res = alice.SetCanonicalAlias(t, roomID, roomAlias, []string{roomAlias})
 
 			must.MatchResponse(t, res, match.HTTPResponse{
 				StatusCode: 200,
@@ -378,12 +349,12 @@ func TestRoomCanonicalAlias(t *testing.T) {
 			roomAlias := "#alt_missing:hs1"
 			wrongRoomAlias := "#alt_missing_wrong:hs1"
 
-			res := setRoomAliasResp(t, alice, roomID, roomAlias)
+			res := alice.SetRoomAlias(t, roomID, roomAlias)
 			must.MatchResponse(t, res, match.HTTPResponse{
 				StatusCode: 200,
 			})
 
-			res = setCanonicalAlias(t, alice, roomID, roomAlias, &[]string{wrongRoomAlias})
+			res = alice.SetCanonicalAlias(t, roomID, roomAlias, []string{wrongRoomAlias})
 
 			must.MatchResponse(t, res, match.HTTPResponse{
 				StatusCode: 400,
@@ -402,12 +373,12 @@ func TestRoomCanonicalAlias(t *testing.T) {
 			roomAlias := "#alt_invalid:hs1"
 			wrongRoomAlias := "%alt_invalid_wrong:hs1"
 
-			res := setRoomAliasResp(t, alice, roomID, roomAlias)
+			res := alice.SetRoomAlias(t, roomID, roomAlias)
 			must.MatchResponse(t, res, match.HTTPResponse{
 				StatusCode: 200,
 			})
 
-			res = setCanonicalAlias(t, alice, roomID, roomAlias, &[]string{wrongRoomAlias})
+			res = alice.SetCanonicalAlias(t, roomID, roomAlias, []string{wrongRoomAlias})
 
 			must.MatchResponse(t, res, match.HTTPResponse{
 				StatusCode: 400,
@@ -428,17 +399,17 @@ func TestRoomCanonicalAlias(t *testing.T) {
 			room1Alias := "#alt_room1:hs1"
 			room2Alias := "#alt_room2:hs1"
 
-			res := setRoomAliasResp(t, alice, room1, room1Alias)
+			res := alice.SetRoomAlias(t, room1, room1Alias)
 			must.MatchResponse(t, res, match.HTTPResponse{
 				StatusCode: 200,
 			})
 
-			res = setRoomAliasResp(t, alice, room2, room2Alias)
+			res = alice.SetRoomAlias(t, room2, room2Alias)
 			must.MatchResponse(t, res, match.HTTPResponse{
 				StatusCode: 200,
 			})
 
-			res = setCanonicalAlias(t, alice, room2, room2Alias, &[]string{room1Alias})
+			res = alice.SetCanonicalAlias(t, room2, room2Alias, []string{room1Alias})
 
 			must.MatchResponse(t, res, match.HTTPResponse{
 				StatusCode: 400,
@@ -57,3 +57,42 @@ func TestRoomReceiptsReadMarkers(t *testing.T) {
 		})
 	})
 }
+
+func TestRoomReceiptsNotificationCounts(t *testing.T) {
+	deployment := Deploy(t, b.BlueprintOneToOneRoom)
+	defer deployment.Destroy(t)
+
+	alice := deployment.Client(t, "hs1", "@alice:hs1")
+	bob := deployment.Client(t, "hs1", "@bob:hs1")
+	roomID := alice.CreateRoom(t, map[string]interface{}{"preset": "trusted_private_chat", "invite": []string{bob.UserID}})
+	bob.JoinRoom(t, roomID, nil)
+	alice.MustSyncUntil(t, client.SyncReq{}, client.SyncJoinedTo(bob.UserID, roomID))
+
+	var eventID string
+	for i := 0; i < 2; i++ {
+		eventID = bob.SendEventSynced(t, roomID, b.Event{
+			Type: "m.room.message",
+			Content: map[string]interface{}{
+				"msgtype": "m.text",
+				"body":    "Unread message",
+			},
+		})
+	}
+	since := alice.MustSyncUntil(t, client.SyncReq{}, client.SyncUnreadNotificationsAre(roomID, 2, 0))
+
+	t.Run("Public receipts reset notification counts and are visible to others", func(t *testing.T) {
+		alice.SendReceipt(t, roomID, eventID, "m.read", "")
+		alice.MustSyncUntil(t, client.SyncReq{Since: since}, client.SyncUnreadNotificationsAre(roomID, 0, 0))
+		bob.MustSyncUntil(t, client.SyncReq{}, client.SyncReceiptHas(roomID, alice.UserID, "m.read", eventID))
+	})
+
+	t.Run("Private receipts are visible to the sender", func(t *testing.T) {
+		bob.SendReceipt(t, roomID, eventID, "m.read.private", "")
+		bob.MustSyncUntil(t, client.SyncReq{}, client.SyncReceiptHas(roomID, bob.UserID, "m.read.private", eventID))
+	})
+
+	t.Run("Read markers update m.fully_read", func(t *testing.T) {
+		alice.SetReadMarkers(t, roomID, eventID, "", "")
+		alice.MustSyncUntil(t, client.SyncReq{}, client.SyncFullyReadIs(roomID, eventID))
+	})
+}
@@ -3,17 +3,19 @@ package csapi_tests
 import (
 	"net/url"
 	"testing"
+	"time"
 
 	"github.com/tidwall/gjson"
 
 	"github.com/matrix-org/complement/internal/b"
 	"github.com/matrix-org/complement/internal/client"
+	"github.com/matrix-org/complement/internal/docker"
 	"github.com/matrix-org/complement/internal/match"
 	"github.com/matrix-org/complement/internal/must"
 )
 
 func TestRoomState(t *testing.T) {
-	deployment := Deploy(t, b.BlueprintAlice)
+	deployment := Deploy(t, b.BlueprintAlice, docker.WithIsolation()) // uses fixed room aliases
 	defer deployment.Destroy(t)
 	authedClient := deployment.Client(t, "hs1", "@alice:hs1")
 	t.Run("Parallel", func(t *testing.T) {
@@ -104,26 +106,16 @@ func TestRoomState(t *testing.T) {
 				"preset":     "public_chat",
 			})
 
-			res := authedClient.MustDoFunc(t, "GET", []string{"_matrix", "client", "r0", "publicRooms"})
-			foundRoom := false
-
-			must.MatchResponse(t, res, match.HTTPResponse{
+			// the room directory may be updated asynchronously, so poll until the room appears
+			authedClient.DoUntil(t, "GET", []string{"_matrix", "client", "r0", "publicRooms"}, match.HTTPResponse{
+				StatusCode: 200,
 				JSON: []match.JSON{
 					match.JSONKeyPresent("chunk"),
-					match.JSONArrayEach("chunk", func(val gjson.Result) error {
-						gotRoomID := val.Get("room_id").Str
-						if gotRoomID == roomID {
-							foundRoom = true
-							return nil
-						}
-						return nil
-					}),
+					match.JSONCheckOffAllowUnwanted("chunk", []interface{}{roomID}, func(r gjson.Result) interface{} {
+						return r.Get("room_id").Str
+					}, nil),
 				},
-			})
-
-			if !foundRoom {
-				t.Errorf("failed to find room with id: %s", roomID)
-			}
+			}, 5*time.Second)
 		})
 		// sytest: GET /directory/room/:room_alias yields room ID
 		t.Run("GET /directory/room/:room_alias yields room ID", func(t *testing.T) {
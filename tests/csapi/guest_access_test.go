@@ -0,0 +1,124 @@
+package csapi_tests
+
+import (
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/matrix-org/complement/internal/b"
+	"github.com/matrix-org/complement/internal/client"
+	"github.com/matrix-org/complement/internal/match"
+	"github.com/matrix-org/complement/internal/must"
+)
+
+func TestGuestAccess(t *testing.T) {
+	deployment := Deploy(t, b.MustValidate(b.Blueprint{
+		Name: "alice_and_guest",
+		Homeservers: []b.Homeserver{
+			{
+				Name: "hs1",
+				Users: []b.User{
+					{
+						Localpart:   "@alice",
+						DisplayName: "Alice",
+					},
+					{
+						Localpart:   "@guest",
+						DisplayName: "Guest",
+						Guest:       true,
+					},
+				},
+			},
+		},
+	}))
+	defer deployment.Destroy(t)
+
+	alice := deployment.Client(t, "hs1", "@alice:hs1")
+	guest := deployment.Client(t, "hs1", "@guest:hs1")
+
+	worldReadableRoomID := alice.CreateRoom(t, map[string]interface{}{
+		"preset": "public_chat",
+		"initial_state": []map[string]interface{}{
+			{
+				"type":      "m.room.history_visibility",
+				"state_key": "",
+				"content":   map[string]interface{}{"history_visibility": "world_readable"},
+			},
+			{
+				"type":      "m.room.guest_access",
+				"state_key": "",
+				"content":   map[string]interface{}{"guest_access": "can_join"},
+			},
+		},
+	})
+	sharedRoomID := alice.CreateRoom(t, map[string]interface{}{
+		"preset": "public_chat",
+	})
+	eventID := alice.SendEventSynced(t, worldReadableRoomID, b.Event{
+		Type: "m.room.message",
+		Content: map[string]interface{}{
+			"msgtype": "m.text",
+			"body":    "Hello guests",
+		},
+	})
+
+	t.Run("Guests in blueprints are given a user ID by the server", func(t *testing.T) {
+		if guest.UserID == "@guest:hs1" {
+			t.Fatalf("guest was not given a server assigned user ID")
+		}
+		res := alice.MustDoFunc(t, "GET", []string{"_matrix", "client", "r0", "profile", guest.UserID, "displayname"})
+		must.MatchResponse(t, res, match.HTTPResponse{
+			JSON: []match.JSON{
+				match.JSONKeyEqual("displayname", "Guest"),
+			},
+		})
+	})
+
+	t.Run("Guests can peek into world_readable rooms", func(t *testing.T) {
+		res := guest.MustDoFunc(t, "GET", []string{"_matrix", "client", "r0", "rooms", worldReadableRoomID, "messages"}, client.WithQueries(url.Values{
+			"dir": {"b"},
+		}))
+		must.MatchResponse(t, res, match.HTTPResponse{
+			JSON: []match.JSON{
+				match.JSONArrayEventMatches("chunk", eventID),
+			},
+		})
+	})
+
+	t.Run("Guests cannot peek into rooms which aren't world_readable", func(t *testing.T) {
+		res := guest.DoFunc(t, "GET", []string{"_matrix", "client", "r0", "rooms", sharedRoomID, "messages"}, client.WithQueries(url.Values{
+			"dir": {"b"},
+		}))
+		must.MatchResponse(t, res, match.HTTPResponse{
+			StatusCode: 403,
+		})
+	})
+
+	t.Run("Guests can only join rooms with guest access", func(t *testing.T) {
+		guest.JoinRoom(t, worldReadableRoomID, nil)
+		alice.MustSyncUntil(t, client.SyncReq{}, client.SyncJoinedTo(guest.UserID, worldReadableRoomID))
+
+		res := guest.DoFunc(t, "POST", []string{"_matrix", "client", "r0", "join", sharedRoomID})
+		must.MatchResponse(t, res, match.HTTPResponse{
+			StatusCode: 403,
+		})
+	})
+
+	t.Run("Guests cannot create rooms", func(t *testing.T) {
+		res := guest.DoFunc(t, "POST", []string{"_matrix", "client", "r0", "createRoom"}, client.WithJSONBody(t, map[string]interface{}{}))
+		must.MatchResponse(t, res, match.HTTPResponse{
+			StatusCode: 403,
+			JSON: []match.JSON{
+				match.JSONKeyEqual("errcode", "M_GUEST_ACCESS_FORBIDDEN"),
+			},
+		})
+	})
+
+	t.Run("Guests can upgrade to full accounts", func(t *testing.T) {
+		upgraded := deployment.RegisterGuest(t, "hs1")
+		localpart := strings.Split(strings.TrimPrefix(upgraded.UserID, "@"), ":")[0]
+		upgraded.MustUpgradeGuest(t, localpart, "sufficiently_long_password_guest")
+		// full accounts can create rooms
+		upgraded.CreateRoom(t, map[string]interface{}{})
+	})
+}
@@ -8,10 +8,9 @@ import (
 	"net/url"
 	"testing"
 
-	"github.com/tidwall/gjson"
-
 	"github.com/matrix-org/complement/internal/b"
 	"github.com/matrix-org/complement/internal/client"
+	"github.com/matrix-org/complement/internal/event"
 	"github.com/matrix-org/complement/internal/match"
 	"github.com/matrix-org/complement/internal/must"
 )
@@ -40,25 +39,10 @@ func TestInviteFromIgnoredUsersDoesNotAppearInSync(t *testing.T) {
 	alice.MustSyncUntil(t, client.SyncReq{}, client.SyncJoinedTo(alice.UserID, publicRoom))
 
 	// Alice ignores Bob.
-	alice.MustDoFunc(
-		t,
-		"PUT",
-		[]string{"_matrix", "client", "r0", "user", alice.UserID, "account_data", "m.ignored_user_list"},
-		client.WithJSONBody(t, map[string]interface{}{
-			"ignored_users": map[string]interface{}{
-				bob.UserID: map[string]interface{}{},
-			},
-		}),
-	)
+	alice.SetIgnoredUsers(t, bob.UserID)
 
 	// Alice waits to see that the ignore was successful.
-	sinceJoinedAndIgnored := alice.MustSyncUntil(t, client.SyncReq{}, client.SyncGlobalAccountDataHas(
-		func(ev gjson.Result) bool {
-			t.Logf(ev.Raw + "\n")
-			return ev.Get("type").Str == "m.ignored_user_list" &&
-				ev.Get("content.ignored_users."+client.GjsonEscape(bob.UserID)).Exists()
-		},
-	))
+	sinceJoinedAndIgnored := alice.MustSyncUntil(t, client.SyncReq{}, client.SyncIgnoredUsersAre(bob.UserID))
 
 	// Bob invites Alice to a private room.
 	bobRoom := bob.CreateRoom(t, map[string]interface{}{
@@ -97,3 +81,32 @@ func TestInviteFromIgnoredUsersDoesNotAppearInSync(t *testing.T) {
 		},
 	})
 }
+
+// Events sent by ignored users must not be returned to the ignoring user, but should reappear once the
+// user is unignored.
+func TestEventsFromIgnoredUsersDoNotAppearInSync(t *testing.T) {
+	deployment := Deploy(t, b.BlueprintCleanHS)
+	defer deployment.Destroy(t)
+	alice := deployment.RegisterUser(t, "hs1", "alice", "sufficiently_long_password_alice", false)
+	bob := deployment.RegisterUser(t, "hs1", "bob", "sufficiently_long_password_bob", false)
+	chris := deployment.RegisterUser(t, "hs1", "chris", "sufficiently_long_password_chris", false)
+
+	roomID := alice.CreateRoom(t, map[string]interface{}{
+		"preset": "public_chat",
+	})
+	bob.JoinRoom(t, roomID, nil)
+	chris.JoinRoom(t, roomID, nil)
+	since := alice.MustSyncUntil(t, client.SyncReq{}, client.SyncJoinedTo(chris.UserID, roomID))
+
+	alice.SetIgnoredUsers(t, bob.UserID)
+	since = alice.MustSyncUntil(t, client.SyncReq{Since: since}, client.SyncIgnoredUsersAre(bob.UserID))
+
+	bob.SendEventSynced(t, roomID, event.New(event.Text("You can't see me")))
+	chrisEventID := chris.SendEventSynced(t, roomID, event.New(event.Text("But you can see me")))
+	alice.MustSyncUntil(t, client.SyncReq{Since: since}, client.SyncTimelineHasEventIDWithoutSender(roomID, chrisEventID, bob.UserID))
+
+	alice.SetIgnoredUsers(t)
+	alice.MustSyncUntil(t, client.SyncReq{}, client.SyncIgnoredUsersAre())
+	bobEventID := bob.SendEventSynced(t, roomID, event.New(event.Text("Hello again")))
+	alice.MustSyncUntil(t, client.SyncReq{}, client.SyncTimelineHasEventID(roomID, bobEventID))
+}
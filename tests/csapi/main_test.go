@@ -2,6 +2,7 @@ package csapi_tests
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log"
 	"os"
@@ -15,6 +16,11 @@ import (
 	"github.com/matrix-org/complement/internal/b"
 	"github.com/matrix-org/complement/internal/config"
 	"github.com/matrix-org/complement/internal/docker"
+	"github.com/matrix-org/complement/internal/shard"
+	"github.com/matrix-org/complement/internal/testlog"
+	"github.com/matrix-org/complement/internal/timing"
+	"github.com/matrix-org/complement/internal/watchdog"
+	"github.com/matrix-org/complement/runtime"
 )
 
 var namespaceCounter uint64
@@ -22,26 +28,48 @@ var namespaceCounter uint64
 // persist the complement builder which is set when the tests start via TestMain
 var complementBuilder *docker.Builder
 
+// persist the deployment pool if COMPLEMENT_POOL_DEPLOYMENTS or COMPLEMENT_ENABLE_DIRTY_RUNS is set
+var deploymentPool *docker.Pool
+
 // TestMain is the main entry point for Complement.
 //
 // It will clean up any old containers/images/networks from the previous run, then run the tests, then clean up
 // again. No blueprints are made at this point as they are lazily made on demand.
 func TestMain(m *testing.M) {
+	start := time.Now()
 	cfg := config.NewConfigFromEnvVars("csapi", "")
 	log.Printf("config: %+v", cfg)
+	testlog.Configure(cfg.ArtifactsDir, cfg.LogLevel)
+	if cfg.ShardTotal > 1 {
+		if err := shard.Apply(cfg.ShardIndex, cfg.ShardTotal, cfg.ShardTimings); err != nil {
+			fmt.Printf("Error: %s", err)
+			os.Exit(1)
+		}
+	}
 	builder, err := docker.NewBuilder(cfg)
 	if err != nil {
 		fmt.Printf("Error: %s", err)
 		os.Exit(1)
 	}
 	complementBuilder = builder
+	if cfg.PoolDeployments || cfg.EnableDirtyRuns {
+		deploymentPool = docker.NewPool(cfg)
+	}
 	// remove any old images/containers/networks in case we died horribly before
 	builder.Cleanup()
+	runtime.SetDetector(detectHomeserver)
 
 	// we use GMSL which uses logrus by default. We don't want those logs in our test output unless they are Serious.
 	logrus.SetLevel(logrus.ErrorLevel)
 
 	exitCode := m.Run()
+	for _, skip := range runtime.Skips() {
+		log.Printf("Skipped %s on %s: %s", skip.Test, skip.Homeserver, skip.Reason)
+	}
+	log.Print(timing.Summary(time.Since(start)))
+	if deploymentPool != nil {
+		deploymentPool.Close()
+	}
 	builder.Cleanup()
 	os.Exit(exitCode)
 }
@@ -49,27 +77,127 @@ func TestMain(m *testing.M) {
 // Deploy will deploy the given blueprint or terminate the test.
 // It will construct the blueprint if it doesn't already exist in the docker image cache.
 // This function is the main setup function for all tests as it provides a deployment with
-// which tests can interact with.
-func Deploy(t *testing.T, blueprint b.Blueprint) *docker.Deployment {
+// which tests can interact with. Any `opts` modify how the blueprint is deployed.
+func Deploy(t *testing.T, blueprint b.Blueprint, opts ...docker.DeployOption) *docker.Deployment {
 	t.Helper()
 	timeStartBlueprint := time.Now()
 	if complementBuilder == nil {
 		t.Fatalf("complementBuilder not set, did you forget to call TestMain?")
 	}
-	if err := complementBuilder.ConstructBlueprintIfNotExist(blueprint); err != nil {
-		t.Fatalf("Deploy: Failed to construct blueprint: %s", err)
+	// before anything which logs in a cleanup, so its logs are written too
+	testlog.Register(t)
+	wd := watchdog.ForTest(t, complementBuilder.Config.TestTimeout)
+	if complementBuilder.Config.AttachBaseURL != "" {
+		return attach(t, blueprint, opts)
 	}
-	namespace := fmt.Sprintf("%d", atomic.AddUint64(&namespaceCounter, 1))
-	d, err := docker.NewDeployer(namespace, complementBuilder.Config)
-	if err != nil {
-		t.Fatalf("Deploy: NewDeployer returned error %s", err)
+	if complementBuilder.Config.KubernetesNamespace != "" {
+		return deployKubernetes(t, blueprint, opts)
+	}
+	if docker.UsesCompose(blueprint) {
+		opts = append(opts, docker.WithComposeHomeservers(blueprint))
+	}
+	if err := complementBuilder.ConstructBlueprintIfNotExist(blueprint); errors.Is(err, docker.ErrImagePlatform) {
+		t.Skipf("Deploy: %s", err)
+	} else if err != nil {
+		t.Fatalf("Deploy: Failed to construct blueprint: %s", err)
 	}
 	timeStartDeploy := time.Now()
-	dep, err := d.Deploy(context.Background(), blueprint.Name)
+	// a test deploying more than once mustn't wait for its own homeservers to be destroyed
+	ctx := docker.WithContainerHolder(context.Background(), t.Name())
+	var dep *docker.Deployment
+	var err error
+	if deploymentPool != nil {
+		dep, err = deploymentPool.Deploy(ctx, blueprint.Name, opts...)
+	} else {
+		namespace := fmt.Sprintf("%d", atomic.AddUint64(&namespaceCounter, 1))
+		var d *docker.Deployer
+		d, err = docker.NewDeployer(namespace, complementBuilder.Config)
+		if err != nil {
+			t.Fatalf("Deploy: NewDeployer returned error %s", err)
+		}
+		dep, err = d.Deploy(ctx, blueprint.Name, opts...)
+	}
 	if err != nil {
 		t.Fatalf("Deploy: Deploy returned error %s", err)
 	}
-	t.Logf("Deploy times: %v blueprints, %v containers", timeStartDeploy.Sub(timeStartBlueprint), time.Since(timeStartDeploy))
+	wd.AddDiagnostic("homeserver logs", dep.PrintLogs)
+	if complementBuilder.Config.StreamLogs {
+		dep.StreamLogs(t)
+	}
+	if len(blueprint.Homeservers) > 0 {
+		runtime.DetectHomeserver(t, dep, blueprint.Homeservers[0].Name)
+	}
+	testlog.ForTest(t).With("component", "deploy", "blueprint", blueprint.Name).Infof(
+		"Deploy times: %v blueprints, %v containers", timeStartDeploy.Sub(timeStartBlueprint), time.Since(timeStartDeploy),
+	)
+	return dep
+}
+
+// detectHomeserver deploys a clean homeserver to find out which implementation is being tested, for
+// runtime.SkipIf calls made before any homeserver has been deployed.
+func detectHomeserver() (string, error) {
+	cfg := complementBuilder.Config
+	if cfg.AttachBaseURL != "" {
+		dep, err := docker.Attach(cfg, b.BlueprintCleanHS)
+		if err != nil {
+			return "", err
+		}
+		return runtime.Detect(dep, "hs1")
+	}
+	var dep *docker.Deployment
+	var err error
+	if cfg.KubernetesNamespace != "" {
+		dep, err = docker.DeployKubernetes(context.Background(), cfg, "detect", b.BlueprintCleanHS)
+	} else {
+		if err = complementBuilder.ConstructBlueprintIfNotExist(b.BlueprintCleanHS); err != nil {
+			return "", err
+		}
+		var d *docker.Deployer
+		if d, err = docker.NewDeployer("detect", cfg); err != nil {
+			return "", err
+		}
+		dep, err = d.Deploy(context.Background(), b.BlueprintCleanHS.Name)
+	}
+	if err != nil {
+		return "", err
+	}
+	defer dep.Deployer.Destroy(dep, false)
+	return runtime.Detect(dep, "hs1")
+}
+
+// attach returns a deployment of the blueprint on the homeserver at COMPLEMENT_ATTACH_BASE_URL, or skips
+// the test if the blueprint or `opts` need homeservers which Complement starts.
+func attach(t *testing.T, blueprint b.Blueprint, opts []docker.DeployOption) *docker.Deployment {
+	t.Helper()
+	if len(blueprint.Homeservers) != 1 {
+		t.Skipf("Deploy: blueprint %s needs %d homeservers, but attached to 1", blueprint.Name, len(blueprint.Homeservers))
+	}
+	if len(opts) > 0 {
+		t.Skipf("Deploy: deploy options are not supported when attached to an existing homeserver")
+	}
+	dep, err := docker.Attach(complementBuilder.Config, blueprint)
+	if err != nil {
+		t.Fatalf("Deploy: Attach returned error %s", err)
+	}
+	runtime.DetectHomeserver(t, dep, blueprint.Homeservers[0].Name)
+	return dep
+}
+
+// deployKubernetes returns a deployment of the blueprint as pods in COMPLEMENT_KUBERNETES_NAMESPACE, or skips
+// the test if the blueprint or `opts` need containers.
+func deployKubernetes(t *testing.T, blueprint b.Blueprint, opts []docker.DeployOption) *docker.Deployment {
+	t.Helper()
+	namespace := fmt.Sprintf("%d", atomic.AddUint64(&namespaceCounter, 1))
+	ctx := docker.WithContainerHolder(context.Background(), t.Name())
+	dep, err := docker.DeployKubernetes(ctx, complementBuilder.Config, namespace, blueprint, opts...)
+	if errors.Is(err, docker.ErrKubernetesUnsupported) {
+		t.Skipf("Deploy: %s", err)
+	} else if err != nil {
+		t.Fatalf("Deploy: DeployKubernetes returned error %s", err)
+	}
+	if len(blueprint.Homeservers) > 0 {
+		runtime.DetectHomeserver(t, dep, blueprint.Homeservers[0].Name)
+	}
 	return dep
 }
 
@@ -95,8 +223,13 @@ func NewWaiter() *Waiter {
 // If the timeout is reached, the test is failed.
 func (w *Waiter) Wait(t *testing.T, timeout time.Duration) {
 	t.Helper()
+	defer watchdog.Waiting(t, "Wait")()
+	logger := testlog.ForTest(t).With("component", "waiter")
+	logger.Debugf("Wait: waiting up to %v", timeout)
+	start := time.Now()
 	select {
 	case <-w.ch:
+		logger.Debugf("Wait: finished after %v", time.Since(start))
 		return
 	case <-time.After(timeout):
 		t.Fatalf("Wait: timed out after %f seconds.", timeout.Seconds())
@@ -17,7 +17,7 @@ import (
 // sytest: Can send image in room message
 // sytest: Can fetch images in room
 func TestRoomImageRoundtrip(t *testing.T) {
-	runtime.SkipIf(t, runtime.Dendrite) // FIXME: https://github.com/matrix-org/dendrite/issues/1303
+	runtime.SkipIf(t, runtime.Dendrite, "https://github.com/matrix-org/dendrite/issues/1303")
 
 	deployment := Deploy(t, b.BlueprintAlice)
 	defer deployment.Destroy(t)
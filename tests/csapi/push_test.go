@@ -13,7 +13,7 @@ import (
 // @shadowjonathan: do we need this test anymore?
 // sytest: Getting push rules doesn't corrupt the cache SYN-390
 func TestPushRuleCacheHealth(t *testing.T) {
-	runtime.SkipIf(t, runtime.Dendrite) // Dendrite does not support push notifications (yet)
+	runtime.SkipIf(t, runtime.Dendrite, "Dendrite does not support push notifications (yet)")
 
 	deployment := Deploy(t, b.BlueprintAlice)
 	defer deployment.Destroy(t)
@@ -0,0 +1,67 @@
+package csapi_tests
+
+import (
+	"testing"
+
+	"github.com/matrix-org/complement/internal/b"
+	"github.com/matrix-org/complement/internal/event"
+	"github.com/matrix-org/complement/internal/match"
+	"github.com/matrix-org/complement/internal/must"
+)
+
+func TestReporting(t *testing.T) {
+	deployment := Deploy(t, b.BlueprintOneToOneRoom)
+	defer deployment.Destroy(t)
+
+	alice := deployment.Client(t, "hs1", "@alice:hs1")
+	bob := deployment.Client(t, "hs1", "@bob:hs1")
+	roomID := alice.CreateRoom(t, map[string]interface{}{"preset": "public_chat"})
+	bob.JoinRoom(t, roomID, nil)
+	eventID := bob.SendEventSynced(t, roomID, event.New(event.Text("Something objectionable")))
+
+	t.Run("Can report an event", func(t *testing.T) {
+		alice.MustReportEvent(t, roomID, eventID, "this is spam")
+	})
+
+	t.Run("Reporting an unknown event returns 404", func(t *testing.T) {
+		res := alice.ReportEvent(t, roomID, "$doesnotexist", "this is spam")
+		must.MatchResponse(t, res, match.HTTPResponse{
+			StatusCode: 404,
+			JSON: []match.JSON{
+				match.JSONKeyEqual("errcode", "M_NOT_FOUND"),
+			},
+		})
+	})
+
+	t.Run("Can report a room", func(t *testing.T) {
+		alice.MustReportRoom(t, roomID, "this room is spam")
+	})
+}
+
+// Policy lists are ordinary rooms with m.policy.rule.* state events, which homeservers must accept and
+// return like any other state.
+func TestPolicyListRules(t *testing.T) {
+	deployment := Deploy(t, b.BlueprintAlice)
+	defer deployment.Destroy(t)
+
+	alice := deployment.Client(t, "hs1", "@alice:hs1")
+	roomID := alice.CreateRoom(t, map[string]interface{}{"preset": "private_chat"})
+
+	rules := []b.Event{
+		b.PolicyRuleUser("@spammer:*", b.RecommendationBan, "spam"),
+		b.PolicyRuleRoom("!spam:example.org", b.RecommendationBan, "spam room"),
+		b.PolicyRuleServer("*.evil.example.org", b.RecommendationBan, "evil"),
+	}
+	for _, rule := range rules {
+		alice.SendEventSynced(t, roomID, rule)
+	}
+	for _, rule := range rules {
+		res := alice.MustDoFunc(t, "GET", []string{"_matrix", "client", "v3", "rooms", roomID, "state", rule.Type, *rule.StateKey})
+		must.MatchResponse(t, res, match.HTTPResponse{
+			JSON: []match.JSON{
+				match.JSONKeyEqual("entity", rule.Content["entity"]),
+				match.JSONKeyEqual("recommendation", b.RecommendationBan),
+			},
+		})
+	}
+}
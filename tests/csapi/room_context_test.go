@@ -0,0 +1,59 @@
+package csapi_tests
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/matrix-org/complement/internal/b"
+	"github.com/matrix-org/complement/internal/client"
+	"github.com/matrix-org/complement/internal/match"
+	"github.com/matrix-org/complement/internal/must"
+)
+
+func TestRoomEventContext(t *testing.T) {
+	deployment := Deploy(t, b.BlueprintOneToOneRoom)
+	defer deployment.Destroy(t)
+
+	alice := deployment.Client(t, "hs1", "@alice:hs1")
+	bob := deployment.Client(t, "hs1", "@bob:hs1")
+	roomID := alice.CreateRoom(t, map[string]interface{}{"preset": "public_chat"})
+	bob.JoinRoom(t, roomID, nil)
+
+	var eventIDs []string
+	for i := 0; i < 5; i++ {
+		eventIDs = append(eventIDs, alice.SendEventUnsynced(t, roomID, b.Event{
+			Type: "m.room.message",
+			Content: map[string]interface{}{
+				"msgtype": "m.text",
+				"body":    fmt.Sprintf("Message %d", i),
+			},
+		}))
+	}
+	alice.MustSyncUntil(t, client.SyncReq{}, client.SyncTimelineHasEventID(roomID, eventIDs[len(eventIDs)-1]))
+
+	t.Run("Parallel", func(t *testing.T) {
+		// sytest: /context/ on joined room works
+		t.Run("/context returns events before and after the event", func(t *testing.T) {
+			t.Parallel()
+			eventContext := alice.GetEventContext(t, roomID, eventIDs[2], 2, "")
+			must.Equal(t, eventContext.Event.Get("event_id").Str, eventIDs[2], "event_id")
+			must.MatchJSONBytes(
+				t, eventContext.Raw,
+				match.JSONEventIDsInOrder("events_before", []string{eventIDs[1], eventIDs[0]}),
+				match.JSONEventIDsInOrder("events_after", []string{eventIDs[3], eventIDs[4]}),
+				match.JSONArrayHasState("state", "m.room.member", alice.UserID),
+				match.JSONArrayHasState("state", "m.room.member", bob.UserID),
+			)
+		})
+		// sytest: /context/ with lazy_load_members filter works
+		t.Run("/context with lazy_load_members only returns members of senders", func(t *testing.T) {
+			t.Parallel()
+			eventContext := bob.GetEventContext(t, roomID, eventIDs[2], 2, `{"lazy_load_members":true,"types":["m.room.message"]}`)
+			must.MatchJSONBytes(
+				t, eventContext.Raw,
+				match.JSONKeyArrayOfSize("state", 1),
+				match.JSONArrayHasState("state", "m.room.member", alice.UserID),
+			)
+		})
+	})
+}
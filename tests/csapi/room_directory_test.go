@@ -0,0 +1,72 @@
+package csapi_tests
+
+import (
+	"testing"
+
+	"github.com/tidwall/gjson"
+
+	"github.com/matrix-org/complement/internal/b"
+	"github.com/matrix-org/complement/internal/client"
+	"github.com/matrix-org/complement/internal/match"
+	"github.com/matrix-org/complement/internal/must"
+)
+
+func TestPublicRooms(t *testing.T) {
+	deployment := Deploy(t, b.BlueprintOneToOneRoom)
+	defer deployment.Destroy(t)
+
+	alice := deployment.Client(t, "hs1", "@alice:hs1")
+	bob := deployment.Client(t, "hs1", "@bob:hs1")
+
+	bigRoomID := alice.CreateRoom(t, map[string]interface{}{
+		"preset": "public_chat",
+		"name":   "Big directory room",
+	})
+	bob.JoinRoom(t, bigRoomID, nil)
+	smallRoomID := alice.CreateRoom(t, map[string]interface{}{
+		"preset": "public_chat",
+		"name":   "Small directory room",
+	})
+	alice.SetRoomVisibility(t, bigRoomID, "public")
+	alice.SetRoomVisibility(t, smallRoomID, "public")
+
+	// sytest: Can get rooms/{roomId}/directory
+	t.Run("Room visibility can be set and fetched", func(t *testing.T) {
+		must.Equal(t, alice.GetRoomVisibility(t, bigRoomID), "public", "visibility")
+		unpublishedRoomID := alice.CreateRoom(t, map[string]interface{}{"preset": "public_chat"})
+		must.Equal(t, alice.GetRoomVisibility(t, unpublishedRoomID), "private", "visibility")
+	})
+
+	t.Run("Public rooms are ordered by joined members", func(t *testing.T) {
+		rooms := bob.QueryPublicRooms(t, client.PublicRoomsReq{
+			Filter: "directory room",
+		})
+		must.MatchJSONBytes(
+			t, rooms.Raw,
+			match.JSONArrayOrderedBy("chunk", "num_joined_members", true),
+			match.JSONCheckOff("chunk", []interface{}{bigRoomID, smallRoomID}, func(r gjson.Result) interface{} {
+				return r.Get("room_id").Str
+			}, nil),
+		)
+	})
+
+	t.Run("Public rooms can be paginated", func(t *testing.T) {
+		rooms := bob.QueryPublicRooms(t, client.PublicRoomsReq{
+			Filter:   "directory room",
+			Limit:    1,
+			Paginate: true,
+		})
+		if rooms.Pages < 2 {
+			t.Errorf("expected at least 2 pages with limit 1, got %d", rooms.Pages)
+		}
+		must.MatchJSONBytes(
+			t, rooms.Raw,
+			match.JSONArrayOrderedBy("chunk", "num_joined_members", true),
+			match.JSONCheckOff("chunk", []interface{}{bigRoomID, smallRoomID}, func(r gjson.Result) interface{} {
+				return r.Get("room_id").Str
+			}, nil),
+			// it's only an estimate, but there are only 2 public rooms
+			match.JSONKeyNumberInRange("total_room_count_estimate", 0, 2),
+		)
+	})
+}
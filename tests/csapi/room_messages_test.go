@@ -18,7 +18,7 @@ import (
 // sytest: POST /rooms/:room_id/send/:event_type sends a message
 // sytest: GET /rooms/:room_id/messages returns a message
 func TestSendAndFetchMessage(t *testing.T) {
-	runtime.SkipIf(t, runtime.Dendrite) // flakey
+	runtime.SkipIf(t, runtime.Dendrite, "flakey")
 	deployment := Deploy(t, b.BlueprintAlice)
 	defer deployment.Destroy(t)
 
@@ -237,3 +237,34 @@ func TestRoomMessagesLazyLoadingLocalUser(t *testing.T) {
 		},
 	})
 }
+
+// Tests that paginating /messages in both directions returns every event exactly once, in a consistent order.
+func TestRoomMessagesPagination(t *testing.T) {
+	deployment := Deploy(t, b.BlueprintAlice)
+	defer deployment.Destroy(t)
+
+	alice := deployment.Client(t, "hs1", "@alice:hs1")
+	roomID := alice.CreateRoom(t, map[string]interface{}{"preset": "public_chat"})
+
+	var messageIDs []string
+	for i := 0; i < 10; i++ {
+		messageIDs = append(messageIDs, alice.SendEventUnsynced(t, roomID, b.Event{
+			Type: "m.room.message",
+			Content: map[string]interface{}{
+				"msgtype": "m.text",
+				"body":    fmt.Sprintf("Message %d", i),
+			},
+		}))
+	}
+	alice.MustSyncUntil(t, client.SyncReq{}, client.SyncTimelineHasEventID(roomID, messageIDs[len(messageIDs)-1]))
+
+	events := alice.MustWalkMessages(t, roomID, client.MessagesWalkOpts{
+		Limit:  3,
+		Filter: `{"types":["m.room.message"]}`,
+	})
+	gotIDs := make([]string, len(events))
+	for i, ev := range events {
+		gotIDs[i] = ev.Get("event_id").Str
+	}
+	must.HaveInOrder(t, gotIDs, messageIDs)
+}
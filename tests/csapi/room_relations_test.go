@@ -0,0 +1,81 @@
+package csapi_tests
+
+import (
+	"net/url"
+	"testing"
+
+	"github.com/matrix-org/complement/internal/b"
+	"github.com/matrix-org/complement/internal/client"
+	"github.com/matrix-org/complement/internal/match"
+	"github.com/matrix-org/complement/internal/must"
+)
+
+func TestRelations(t *testing.T) {
+	deployment := Deploy(t, b.BlueprintAlice)
+	defer deployment.Destroy(t)
+
+	alice := deployment.Client(t, "hs1", "@alice:hs1")
+	roomID := alice.CreateRoom(t, map[string]interface{}{"preset": "public_chat"})
+
+	eventID := alice.SendEventSynced(t, roomID, b.Event{
+		Type: "m.room.message",
+		Content: map[string]interface{}{
+			"msgtype": "m.text",
+			"body":    "Original message",
+		},
+	})
+	reactionIDs := []interface{}{
+		alice.SendReaction(t, roomID, eventID, "👍"),
+		alice.SendReaction(t, roomID, eventID, "👀"),
+	}
+	editID := alice.SendEdit(t, roomID, eventID, map[string]interface{}{
+		"msgtype": "m.text",
+		"body":    "Edited message",
+	})
+	alice.MustSyncUntil(t, client.SyncReq{}, client.SyncTimelineHasEventID(roomID, editID))
+
+	t.Run("Parallel", func(t *testing.T) {
+		t.Run("/relations can be paginated", func(t *testing.T) {
+			t.Parallel()
+			relations := alice.GetRelationsPaginated(t, roomID, eventID, "", "", 1)
+			if len(relations) != 3 {
+				t.Fatalf("got %d relations, want 3", len(relations))
+			}
+			annotations := alice.GetRelationsPaginated(t, roomID, eventID, "m.annotation", "m.reaction", 1)
+			gotReactionIDs := make([]interface{}, len(annotations))
+			for i, ev := range annotations {
+				gotReactionIDs[i] = ev.Get("event_id").Str
+			}
+			must.CheckOffAll(t, gotReactionIDs, reactionIDs)
+		})
+		t.Run("Edits are bundled in /event", func(t *testing.T) {
+			t.Parallel()
+			res := alice.MustDoFunc(t, "GET", []string{"_matrix", "client", "r0", "rooms", roomID, "event", eventID})
+			must.MatchResponse(t, res, match.HTTPResponse{
+				JSON: []match.JSON{
+					match.JSONReplacedBy(editID),
+				},
+			})
+		})
+		t.Run("Edits are bundled in /messages", func(t *testing.T) {
+			t.Parallel()
+			res := alice.MustDoFunc(t, "GET", []string{"_matrix", "client", "r0", "rooms", roomID, "messages"}, client.WithQueries(url.Values{
+				"dir": []string{"b"},
+			}))
+			must.MatchResponse(t, res, match.HTTPResponse{
+				JSON: []match.JSON{
+					match.JSONArrayEventMatches("chunk", eventID, match.JSONReplacedBy(editID)),
+				},
+			})
+		})
+		t.Run("Edits are bundled in /context", func(t *testing.T) {
+			t.Parallel()
+			res := alice.MustDoFunc(t, "GET", []string{"_matrix", "client", "r0", "rooms", roomID, "context", eventID})
+			must.MatchResponse(t, res, match.HTTPResponse{
+				JSON: []match.JSON{
+					match.JSONKeyEqual(`event.unsigned.m\.relations.m\.replace.event_id`, editID),
+				},
+			})
+		})
+	})
+}
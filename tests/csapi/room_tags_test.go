@@ -0,0 +1,52 @@
+package csapi_tests
+
+import (
+	"testing"
+
+	"github.com/tidwall/gjson"
+
+	"github.com/matrix-org/complement/internal/b"
+	"github.com/matrix-org/complement/internal/client"
+	"github.com/matrix-org/complement/internal/match"
+	"github.com/matrix-org/complement/internal/must"
+)
+
+func TestRoomTagsAndAccountData(t *testing.T) {
+	deployment := Deploy(t, b.BlueprintAlice)
+	defer deployment.Destroy(t)
+
+	alice := deployment.Client(t, "hs1", "@alice:hs1")
+	roomID := alice.CreateRoom(t, map[string]interface{}{"preset": "private_chat"})
+
+	// sytest: Can add tag
+	// sytest: Tags appear in an initial v2 /sync
+	t.Run("Can add and remove tags", func(t *testing.T) {
+		alice.AddTagWithOrder(t, roomID, "m.favourite", 0.25)
+		alice.AddTag(t, roomID, "u.work")
+		since := alice.MustSyncUntil(t, client.SyncReq{}, client.SyncRoomHasTag(roomID, "m.favourite"), client.SyncRoomHasTag(roomID, "u.work"))
+
+		tags := alice.GetTags(t, roomID)
+		if order := tags.Get("m\\.favourite.order").Float(); order != 0.25 {
+			t.Errorf("m.favourite order: got %v want 0.25", order)
+		}
+
+		alice.RemoveTag(t, roomID, "u.work")
+		alice.MustSyncUntil(t, client.SyncReq{Since: since}, client.SyncRoomHasNoTag(roomID, "u.work"))
+	})
+
+	// sytest: Can add account data to room
+	t.Run("Room account data round-trips", func(t *testing.T) {
+		content := map[string]interface{}{
+			"layout": "compact",
+		}
+		alice.SetRoomAccountData(t, roomID, "com.example.client_config", content)
+		must.MatchResponse(t, alice.GetRoomAccountData(t, roomID, "com.example.client_config"), match.HTTPResponse{
+			JSON: []match.JSON{
+				match.JSONKeyEqual("layout", "compact"),
+			},
+		})
+		alice.MustSyncUntil(t, client.SyncReq{}, client.SyncRoomAccountDataHas(roomID, func(ev gjson.Result) bool {
+			return ev.Get("type").Str == "com.example.client_config" && ev.Get("content.layout").Str == "compact"
+		}))
+	})
+}
@@ -0,0 +1,92 @@
+package csapi_tests
+
+import (
+	"net/url"
+	"testing"
+
+	"github.com/tidwall/gjson"
+
+	"github.com/matrix-org/complement/internal/b"
+	"github.com/matrix-org/complement/internal/client"
+	"github.com/matrix-org/complement/internal/match"
+	"github.com/matrix-org/complement/internal/must"
+)
+
+func TestThreads(t *testing.T) {
+	deployment := Deploy(t, b.BlueprintOneToOneRoom)
+	defer deployment.Destroy(t)
+
+	alice := deployment.Client(t, "hs1", "@alice:hs1")
+	bob := deployment.Client(t, "hs1", "@bob:hs1")
+	roomID := alice.CreateRoom(t, map[string]interface{}{"preset": "public_chat"})
+	bob.JoinRoom(t, roomID, nil)
+
+	// alice neither sends the root nor replies, so hasn't participated in the thread
+	rootID := bob.SendEventSynced(t, roomID, b.Event{
+		Type: "m.room.message",
+		Content: map[string]interface{}{
+			"msgtype": "m.text",
+			"body":    "Thread root",
+		},
+	})
+	replyContent := map[string]interface{}{
+		"msgtype": "m.text",
+		"body":    "Thread reply",
+	}
+	firstReplyID := bob.SendThreadReply(t, roomID, rootID, replyContent)
+	latestReplyID := bob.SendThreadReply(t, roomID, rootID, replyContent)
+	bob.MustSyncUntil(t, client.SyncReq{}, client.SyncTimelineHasEventID(roomID, latestReplyID))
+
+	t.Run("Parallel", func(t *testing.T) {
+		t.Run("/relations can be filtered to thread replies", func(t *testing.T) {
+			t.Parallel()
+			res := alice.GetRelations(t, roomID, rootID, "m.thread", "")
+			must.MatchResponse(t, res, match.HTTPResponse{
+				JSON: []match.JSON{
+					match.JSONCheckOff("chunk", []interface{}{firstReplyID, latestReplyID}, func(r gjson.Result) interface{} {
+						return r.Get("event_id").Str
+					}, nil),
+				},
+			})
+		})
+		t.Run("/threads lists thread roots", func(t *testing.T) {
+			t.Parallel()
+			res := alice.GetThreads(t, roomID)
+			must.MatchResponse(t, res, match.HTTPResponse{
+				JSON: []match.JSON{
+					match.JSONArrayEventMatches("chunk", rootID, match.JSONThreadSummary(2, latestReplyID, false)),
+				},
+			})
+			res = alice.GetThreads(t, roomID, client.WithQueries(url.Values{"include": []string{"participated"}}))
+			must.MatchResponse(t, res, match.HTTPResponse{
+				JSON: []match.JSON{
+					match.JSONKeyArrayOfSize("chunk", 0),
+				},
+			})
+		})
+		t.Run("Thread roots have bundled aggregations in /event", func(t *testing.T) {
+			t.Parallel()
+			res := bob.MustDoFunc(t, "GET", []string{"_matrix", "client", "r0", "rooms", roomID, "event", rootID})
+			must.MatchResponse(t, res, match.HTTPResponse{
+				JSON: []match.JSON{
+					match.JSONThreadSummary(2, latestReplyID, true),
+				},
+			})
+		})
+		t.Run("Thread roots have bundled aggregations in /messages", func(t *testing.T) {
+			t.Parallel()
+			res := alice.MustDoFunc(t, "GET", []string{"_matrix", "client", "r0", "rooms", roomID, "messages"}, client.WithQueries(url.Values{
+				"dir": []string{"b"},
+			}))
+			must.MatchResponse(t, res, match.HTTPResponse{
+				JSON: []match.JSON{
+					match.JSONArrayEventMatches("chunk", rootID, match.JSONThreadSummary(2, latestReplyID, false)),
+				},
+			})
+		})
+		t.Run("Thread roots have bundled aggregations in /sync", func(t *testing.T) {
+			t.Parallel()
+			bob.MustSyncUntil(t, client.SyncReq{}, client.SyncTimelineEventMatches(roomID, rootID, match.JSONThreadSummary(2, latestReplyID, true)))
+		})
+	})
+}
@@ -1,10 +1,8 @@
 package csapi_tests
 
 import (
-	"fmt"
 	"testing"
-
-	"github.com/tidwall/gjson"
+	"time"
 
 	"github.com/matrix-org/complement/internal/b"
 	"github.com/matrix-org/complement/internal/client"
@@ -24,31 +22,24 @@ func TestTyping(t *testing.T) {
 
 	token := bob.MustSyncUntil(t, client.SyncReq{}, client.SyncJoinedTo(bob.UserID, roomID))
 
-	alice.MustDoFunc(t, "PUT", []string{"_matrix", "client", "r0", "rooms", roomID, "typing", alice.UserID}, client.WithJSONBody(t, map[string]interface{}{
-		"typing":  true,
-		"timeout": 10000,
-	}))
-
-	bob.MustSyncUntil(t, client.SyncReq{Since: token}, func(clientUserID string, topLevelSyncJSON gjson.Result) error {
-		key := "rooms.join." + client.GjsonEscape(roomID) + ".ephemeral.events"
-		array := topLevelSyncJSON.Get(key)
-		if !array.Exists() {
-			return fmt.Errorf("Key %s does not exist", key)
-		}
-		if !array.IsArray() {
-			return fmt.Errorf("Key %s exists but it isn't an array", key)
-		}
-		goArray := array.Array()
-		for _, ev := range goArray {
-			if ev.Get("type").Str != "m.typing" {
-				continue
-			}
-			for _, item := range ev.Get("content").Get("user_ids").Array() {
-				if item.Str == alice.UserID {
-					return nil
-				}
-			}
-		}
-		return fmt.Errorf("no typing events")
+	alice.SendTyping(t, roomID, true, 10*time.Second)
+
+	token = bob.MustSyncUntil(t, client.SyncReq{Since: token}, client.SyncUsersTyping(roomID, []string{alice.UserID}))
+
+	// sytest: Typing notifications can be explicitly stopped
+	t.Run("Typing notifications can be explicitly stopped", func(t *testing.T) {
+		alice.SendTyping(t, roomID, false, 0)
+		token = bob.MustSyncUntil(t, client.SyncReq{Since: token}, client.SyncUsersTyping(roomID, []string{}))
+	})
+
+	// sytest: Typing notifications timeout and can be resent
+	t.Run("Typing notifications timeout and can be resent", func(t *testing.T) {
+		alice.SendTyping(t, roomID, true, 2*time.Second)
+		token = bob.MustSyncUntil(t, client.SyncReq{Since: token}, client.SyncUsersTyping(roomID, []string{alice.UserID}))
+		// the homeserver may take a while to notice the timeout, so allow longer than SyncUntilTimeout
+		bob.SyncUntilTimeout = 30 * time.Second
+		token = bob.MustSyncUntil(t, client.SyncReq{Since: token}, client.SyncUsersTyping(roomID, []string{}))
+		alice.SendTyping(t, roomID, true, 10*time.Second)
+		bob.MustSyncUntil(t, client.SyncReq{Since: token}, client.SyncUsersTyping(roomID, []string{alice.UserID}))
 	})
 }
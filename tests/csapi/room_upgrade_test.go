@@ -0,0 +1,67 @@
+package csapi_tests
+
+import (
+	"testing"
+
+	"github.com/matrix-org/complement/internal/b"
+	"github.com/matrix-org/complement/internal/client"
+	"github.com/matrix-org/complement/internal/match"
+	"github.com/matrix-org/complement/internal/must"
+)
+
+func TestRoomUpgrade(t *testing.T) {
+	deployment := Deploy(t, b.BlueprintOneToOneRoom)
+	defer deployment.Destroy(t)
+
+	alice := deployment.Client(t, "hs1", "@alice:hs1")
+	bob := deployment.Client(t, "hs1", "@bob:hs1")
+
+	roomID := alice.CreateRoom(t, map[string]interface{}{
+		"preset": "public_chat",
+		"power_level_content_override": map[string]interface{}{
+			"users": map[string]interface{}{
+				alice.UserID: 100,
+				bob.UserID:   50,
+			},
+		},
+	})
+	bob.JoinRoom(t, roomID, nil)
+	bannedUserID := "@banned:hs1"
+	alice.MustDoFunc(t, "POST", []string{"_matrix", "client", "r0", "rooms", roomID, "ban"}, client.WithJSONBody(t, map[string]interface{}{
+		"user_id": bannedUserID,
+	}))
+	oldState := alice.GetRoomState(t, roomID)
+
+	// sytest: /upgrade creates a new room
+	newRoomID := alice.UpgradeRoom(t, roomID, "9")
+
+	t.Run("Parallel", func(t *testing.T) {
+		// sytest: /upgrade copies the power levels to the new room
+		// sytest: /upgrade copies ban events to the new room
+		t.Run("/upgrade carries over power levels and bans", func(t *testing.T) {
+			t.Parallel()
+			must.MatchJSONBytes(
+				t, alice.GetRoomState(t, newRoomID),
+				match.JSONUpgradedFrom(roomID, oldState),
+				match.JSONStateEventContent("m.room.create", "", match.JSONKeyEqual("room_version", "9")),
+			)
+		})
+		t.Run("/upgrade tombstones the old room", func(t *testing.T) {
+			t.Parallel()
+			must.MatchJSONBytes(t, bob.GetRoomState(t, roomID), match.JSONTombstonedTo(newRoomID))
+		})
+		// sytest: /upgrade to an unknown version is rejected
+		t.Run("/upgrade to an unknown version is rejected", func(t *testing.T) {
+			t.Parallel()
+			res := alice.DoFunc(t, "POST", []string{"_matrix", "client", "r0", "rooms", newRoomID, "upgrade"}, client.WithJSONBody(t, map[string]interface{}{
+				"new_version": "my_new_version",
+			}))
+			must.MatchResponse(t, res, match.HTTPResponse{
+				StatusCode: 400,
+				JSON: []match.JSON{
+					match.JSONKeyEqual("errcode", "M_UNSUPPORTED_ROOM_VERSION"),
+				},
+			})
+		})
+	})
+}
@@ -36,7 +36,7 @@ func TestMembersLocal(t *testing.T) {
 
 		// sytest: Existing members see new members' presence
 		t.Run("Existing members see new members' presence", func(t *testing.T) {
-			runtime.SkipIf(t, runtime.Dendrite) // Still failing
+			runtime.SkipIf(t, runtime.Dendrite, "Still failing")
 			t.Parallel()
 			alice.MustSyncUntil(t, client.SyncReq{},
 				client.SyncJoinedTo(bob.UserID, roomID),
@@ -0,0 +1,97 @@
+package csapi_tests
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/matrix-org/complement/internal/b"
+	"github.com/matrix-org/complement/internal/client"
+	"github.com/matrix-org/complement/internal/match"
+	"github.com/matrix-org/complement/internal/must"
+)
+
+func TestSearch(t *testing.T) {
+	deployment := Deploy(t, b.BlueprintAlice)
+	defer deployment.Destroy(t)
+
+	alice := deployment.Client(t, "hs1", "@alice:hs1")
+	roomA := alice.CreateRoom(t, map[string]interface{}{"preset": "private_chat"})
+	roomB := alice.CreateRoom(t, map[string]interface{}{"preset": "private_chat"})
+
+	sendMessage := func(roomID, body string) string {
+		return alice.SendEventSynced(t, roomID, b.Event{
+			Type: "m.room.message",
+			Content: map[string]interface{}{
+				"msgtype": "m.text",
+				"body":    body,
+			},
+		})
+	}
+	eventA := sendMessage(roomA, "The quick brown fox")
+	eventB := sendMessage(roomB, "The lazy brown dog")
+	sendMessage(roomB, "Nothing to see here")
+
+	t.Run("Parallel", func(t *testing.T) {
+		// sytest: Can search for an event by body
+		t.Run("Can search for an event by body", func(t *testing.T) {
+			t.Parallel()
+			result := alice.Search(t, client.SearchReq{
+				SearchTerm: "fox",
+				Keys:       []string{"content.body"},
+			})
+			must.MatchJSONBytes(
+				t, result.Raw,
+				match.JSONSearchResultEventIDs([]string{eventA}),
+				match.JSONSearchHighlightsContain("fox"),
+			)
+		})
+		t.Run("Search results can be ordered by recency", func(t *testing.T) {
+			t.Parallel()
+			result := alice.Search(t, client.SearchReq{
+				SearchTerm: "brown",
+				OrderBy:    "recent",
+			})
+			must.MatchJSONBytes(t, result.Raw, match.JSONSearchResultEventIDs([]string{eventB, eventA}))
+		})
+		t.Run("Search results can be grouped by room", func(t *testing.T) {
+			t.Parallel()
+			result := alice.Search(t, client.SearchReq{
+				SearchTerm: "brown",
+				GroupBy:    []string{"room_id"},
+			})
+			must.MatchJSONBytes(
+				t, result.Raw,
+				match.JSONSearchGroup("room_id", roomA, []string{eventA}),
+				match.JSONSearchGroup("room_id", roomB, []string{eventB}),
+			)
+		})
+		t.Run("Search results can be filtered by room", func(t *testing.T) {
+			t.Parallel()
+			result := alice.Search(t, client.SearchReq{
+				SearchTerm: "brown",
+				Filter: map[string]interface{}{
+					"rooms": []string{roomB},
+				},
+			})
+			must.MatchJSONBytes(t, result.Raw, match.JSONSearchResultEventIDs([]string{eventB}))
+		})
+	})
+
+	// sytest: Can back-paginate search results
+	t.Run("Can paginate search results", func(t *testing.T) {
+		roomID := alice.CreateRoom(t, map[string]interface{}{"preset": "private_chat"})
+		var eventIDs []string
+		for i := 0; i < 20; i++ {
+			eventIDs = append(eventIDs, sendMessage(roomID, fmt.Sprintf("Message number %d", i)))
+		}
+		events := alice.SearchPaginated(t, client.SearchReq{
+			SearchTerm: "number",
+			OrderBy:    "recent",
+		})
+		gotEventIDs := make([]string, len(events))
+		for i, ev := range events {
+			gotEventIDs[len(events)-1-i] = ev.Get("event_id").Str
+		}
+		must.HaveInOrder(t, gotEventIDs, eventIDs)
+	})
+}
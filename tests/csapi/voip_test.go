@@ -0,0 +1,63 @@
+package csapi_tests
+
+import (
+	"testing"
+	"time"
+
+	"github.com/tidwall/gjson"
+
+	"github.com/matrix-org/complement/internal/b"
+	"github.com/matrix-org/complement/internal/client"
+	"github.com/matrix-org/complement/internal/match"
+	"github.com/matrix-org/complement/internal/must"
+)
+
+func TestVoIPSignalling(t *testing.T) {
+	deployment := Deploy(t, b.BlueprintOneToOneRoom)
+	defer deployment.Destroy(t)
+
+	alice := deployment.Client(t, "hs1", "@alice:hs1")
+	bob := deployment.Client(t, "hs1", "@bob:hs1")
+	roomID := alice.CreateRoom(t, map[string]interface{}{"preset": "trusted_private_chat", "invite": []string{bob.UserID}})
+	bob.JoinRoom(t, roomID, nil)
+	alice.MustSyncUntil(t, client.SyncReq{}, client.SyncJoinedTo(bob.UserID, roomID))
+
+	callID := "call-1"
+	// each event is sent by one party and must arrive at the other intact
+	steps := []struct {
+		sender   *client.CSAPI
+		receiver *client.CSAPI
+		event    b.Event
+	}{
+		{alice, bob, b.CallInvite(callID, "alice-party", "v=0\r\n", 60*time.Second)},
+		{bob, alice, b.CallAnswer(callID, "bob-party", "v=0\r\n")},
+		{alice, bob, b.CallCandidates(callID, "alice-party", b.CallCandidate{
+			Candidate:     "candidate:0 1 UDP 2122252543 192.0.2.1 54400 typ host",
+			SDPMid:        "0",
+			SDPMLineIndex: 0,
+		})},
+		{bob, alice, b.CallHangup(callID, "bob-party", "user_hangup")},
+	}
+	for _, step := range steps {
+		eventID := step.sender.SendEventSynced(t, roomID, step.event)
+		step.receiver.MustSyncUntil(t, client.SyncReq{}, client.SyncTimelineEventMatches(
+			roomID, eventID,
+			match.JSONKeyEqual("type", step.event.Type),
+			match.JSONKeyEqual("content.call_id", callID),
+			match.JSONKeyEqual("content.version", b.VoIPVersion),
+		))
+	}
+}
+
+func TestTurnServer(t *testing.T) {
+	deployment := Deploy(t, b.BlueprintAlice)
+	defer deployment.Destroy(t)
+
+	alice := deployment.Client(t, "hs1", "@alice:hs1")
+	res := alice.GetTurnServer(t)
+	body := client.ParseJSON(t, res)
+	if res.StatusCode != 200 || !gjson.GetBytes(body, "uris").Exists() {
+		t.Skipf("no TURN server configured: HTTP %d %s", res.StatusCode, string(body))
+	}
+	must.MatchJSONBytes(t, body, match.JSONTurnServerCredentials(), match.JSONTurnServerTTL(1, 86400*7))
+}
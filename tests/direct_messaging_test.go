@@ -41,9 +41,7 @@ func TestWriteMDirectAccountData(t *testing.T) {
 			t.Errorf("m.direct event missing rooms array for user %s", bob.UserID)
 			return false
 		}
-		if rooms.Array()[0].Str != roomID {
-			t.Errorf("m.direct room for %s mismatch: got %v want %v", bob.UserID, rooms.Str, roomID)
-		}
+		must.Equal(t, rooms.Array()[0].Str, roomID, "m.direct room for "+bob.UserID)
 		return true
 	}
 	since := alice.MustSyncUntil(t, client.SyncReq{}, client.SyncGlobalAccountDataHas(checkAccountData))
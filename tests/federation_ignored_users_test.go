@@ -0,0 +1,47 @@
+package tests
+
+import (
+	"testing"
+
+	"github.com/matrix-org/complement/internal/b"
+	"github.com/matrix-org/complement/internal/client"
+	"github.com/matrix-org/complement/internal/event"
+)
+
+// Invites and events from ignored users on remote servers must not be returned to the ignoring user.
+func TestFederationIgnoredUsers(t *testing.T) {
+	deployment := Deploy(t, b.BlueprintFederationTwoLocalOneRemote)
+	defer deployment.Destroy(t)
+	alice := deployment.Client(t, "hs1", "@alice:hs1")
+	bob := deployment.Client(t, "hs1", "@bob:hs1")
+	charlie := deployment.Client(t, "hs2", "@charlie:hs2")
+
+	charlie.SetIgnoredUsers(t, alice.UserID)
+	charlie.MustSyncUntil(t, client.SyncReq{}, client.SyncIgnoredUsersAre(alice.UserID))
+
+	t.Run("Invites from ignored remote users are not returned", func(t *testing.T) {
+		aliceRoomID := alice.CreateRoom(t, map[string]interface{}{
+			"preset": "private_chat",
+			"invite": []string{charlie.UserID},
+		})
+		bobRoomID := bob.CreateRoom(t, map[string]interface{}{
+			"preset": "private_chat",
+			"invite": []string{charlie.UserID},
+		})
+		charlie.MustSyncUntil(t, client.SyncReq{}, client.SyncInvitedToWithout(charlie.UserID, bobRoomID, aliceRoomID))
+	})
+
+	t.Run("Events from ignored remote users are not returned", func(t *testing.T) {
+		roomID := bob.CreateRoom(t, map[string]interface{}{
+			"preset": "public_chat",
+		})
+		alice.JoinRoom(t, roomID, nil)
+		charlie.JoinRoom(t, roomID, []string{"hs1"})
+		since := charlie.MustSyncUntil(t, client.SyncReq{}, client.SyncJoinedTo(charlie.UserID, roomID))
+		bob.MustSyncUntil(t, client.SyncReq{}, client.SyncJoinedTo(charlie.UserID, roomID))
+
+		alice.SendEventSynced(t, roomID, event.New(event.Text("You can't see me")))
+		bobEventID := bob.SendEventSynced(t, roomID, event.New(event.Text("But you can see me")))
+		charlie.MustSyncUntil(t, client.SyncReq{Since: since}, client.SyncTimelineHasEventIDWithoutSender(roomID, bobEventID, alice.UserID))
+	})
+}
@@ -0,0 +1,51 @@
+package tests
+
+import (
+	"testing"
+
+	"github.com/matrix-org/complement/internal/b"
+	"github.com/matrix-org/complement/internal/client"
+)
+
+// Tests that a homeserver can federate with each of the images in COMPLEMENT_EXTRA_IMAGES, e.g the
+// previous release.
+func TestFederationAcrossImages(t *testing.T) {
+	images := complementBuilder.Config.ExtraImageNames()
+	if len(images) == 0 {
+		t.Skipf("no images to federate with, set COMPLEMENT_EXTRA_IMAGES")
+	}
+	for _, image := range images {
+		image := image
+		t.Run(image, func(t *testing.T) {
+			deployment := Deploy(t, b.WithImage(b.BlueprintFederationOneToOneRoom, "hs2", image))
+			defer deployment.Destroy(t)
+
+			alice := deployment.Client(t, "hs1", "@alice:hs1")
+			bob := deployment.Client(t, "hs2", "@bob:hs2")
+
+			roomID := alice.CreateRoom(t, map[string]interface{}{
+				"preset": "public_chat",
+			})
+			bob.JoinRoom(t, roomID, []string{"hs1"})
+			alice.MustSyncUntil(t, client.SyncReq{}, client.SyncJoinedTo(bob.UserID, roomID))
+
+			eventID := alice.SendEventSynced(t, roomID, b.Event{
+				Type: "m.room.message",
+				Content: map[string]interface{}{
+					"msgtype": "m.text",
+					"body":    "from the base image",
+				},
+			})
+			bob.MustSyncUntil(t, client.SyncReq{}, client.SyncTimelineHasEventID(roomID, eventID))
+
+			eventID = bob.SendEventSynced(t, roomID, b.Event{
+				Type: "m.room.message",
+				Content: map[string]interface{}{
+					"msgtype": "m.text",
+					"body":    "from " + image,
+				},
+			})
+			alice.MustSyncUntil(t, client.SyncReq{}, client.SyncTimelineHasEventID(roomID, eventID))
+		})
+	}
+}
@@ -0,0 +1,37 @@
+package tests
+
+import (
+	"testing"
+
+	"github.com/matrix-org/complement/internal/b"
+	"github.com/matrix-org/complement/internal/client"
+	"github.com/matrix-org/complement/internal/docker"
+)
+
+// Tests that a server which didn't exist when a federated room was made can join it.
+func TestFederationLateJoiningServer(t *testing.T) {
+	deployment := Deploy(t, b.BlueprintFederationOneToOneRoom, docker.WithIsolation()) // adds a homeserver
+	defer deployment.Destroy(t)
+
+	alice := deployment.Client(t, "hs1", "@alice:hs1")
+	bob := deployment.Client(t, "hs2", "@bob:hs2")
+
+	roomID := alice.CreateRoom(t, map[string]interface{}{
+		"preset": "public_chat",
+	})
+	bob.JoinRoom(t, roomID, []string{"hs1"})
+	eventID := bob.SendEventSynced(t, roomID, b.Event{
+		Type: "m.room.message",
+		Content: map[string]interface{}{
+			"msgtype": "m.text",
+			"body":    "sent before hs3 existed",
+		},
+	})
+
+	deployment.AddHomeserver(t, "hs3", "")
+	charlie := deployment.RegisterUser(t, "hs3", "charlie", "complement_meets_min_pasword_req_charlie", false)
+	charlie.JoinRoom(t, roomID, []string{"hs2"})
+
+	alice.MustSyncUntil(t, client.SyncReq{}, client.SyncJoinedTo(charlie.UserID, roomID))
+	charlie.MustSyncUntil(t, client.SyncReq{}, client.SyncTimelineHasEventID(roomID, eventID))
+}
@@ -0,0 +1,46 @@
+package tests
+
+import (
+	"testing"
+	"time"
+
+	"github.com/matrix-org/complement/internal/b"
+	"github.com/matrix-org/complement/internal/client"
+	"github.com/matrix-org/complement/internal/docker"
+)
+
+// Tests that events sent while a remote server is unreachable are delivered once it is reachable again.
+func TestFederationCatchUpAfterNetsplit(t *testing.T) {
+	deployment := Deploy(t, b.BlueprintFederationOneToOneRoom, docker.WithIsolation()) // partitions the homeservers
+	defer deployment.Destroy(t)
+
+	alice := deployment.Client(t, "hs1", "@alice:hs1")
+	bob := deployment.Client(t, "hs2", "@bob:hs2")
+
+	roomID := alice.CreateRoom(t, map[string]interface{}{
+		"preset": "public_chat",
+	})
+	bob.JoinRoom(t, roomID, []string{"hs1"})
+	alice.MustSyncUntil(t, client.SyncReq{}, client.SyncJoinedTo(bob.UserID, roomID))
+
+	deployment.Disconnect(t, "hs2")
+	eventID := alice.SendEventSynced(t, roomID, b.Event{
+		Type: "m.room.message",
+		Content: map[string]interface{}{
+			"msgtype": "m.text",
+			"body":    "sent during netsplit",
+		},
+	})
+	deployment.Reconnect(t, "hs2")
+
+	// hs1 may be backing off from hs2, so have hs2 contact hs1 to prompt it to retry
+	bob.SendEventSynced(t, roomID, b.Event{
+		Type: "m.room.message",
+		Content: map[string]interface{}{
+			"msgtype": "m.text",
+			"body":    "sent after netsplit",
+		},
+	})
+	bob.SyncUntilTimeout = 30 * time.Second
+	bob.MustSyncUntil(t, client.SyncReq{}, client.SyncTimelineHasEventID(roomID, eventID))
+}
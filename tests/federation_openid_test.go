@@ -0,0 +1,54 @@
+package tests
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/gomatrixserverlib"
+
+	"github.com/matrix-org/complement/internal/b"
+	"github.com/matrix-org/complement/internal/federation"
+	"github.com/matrix-org/complement/internal/must"
+)
+
+// Test that third parties can verify OpenID tokens issued to clients by calling /openid/userinfo over
+// federation.
+func TestFederationOpenIDUserInfo(t *testing.T) {
+	deployment := Deploy(t, b.BlueprintAlice)
+	defer deployment.Destroy(t)
+	alice := deployment.Client(t, "hs1", "@alice:hs1")
+
+	srv := federation.NewServer(t, deployment,
+		federation.HandleKeyRequests(),
+	)
+	cancel := srv.Listen()
+	defer cancel()
+	fedClient := srv.FederationClient(deployment)
+
+	token := alice.GetOpenIDToken(t)
+	must.Equal(t, token.TokenType, "Bearer", "token_type")
+	must.Equal(t, token.MatrixServerName, "hs1", "matrix_server_name")
+	if token.ExpiresIn <= 0 {
+		t.Errorf("expires_in: got %d want a positive number", token.ExpiresIn)
+	}
+
+	t.Run("Valid tokens resolve to the user", func(t *testing.T) {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		userInfo, err := fedClient.LookupUserInfo(ctx, gomatrixserverlib.ServerName(token.MatrixServerName), token.AccessToken)
+		if err != nil {
+			t.Fatalf("LookupUserInfo failed: %s", err)
+		}
+		must.Equal(t, userInfo.Sub, alice.UserID, "sub")
+	})
+
+	t.Run("Invalid tokens are rejected", func(t *testing.T) {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		_, err := fedClient.LookupUserInfo(ctx, "hs1", "not_a_real_token")
+		if err == nil {
+			t.Errorf("LookupUserInfo succeeded with an invalid token")
+		}
+	})
+}
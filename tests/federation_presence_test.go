@@ -0,0 +1,35 @@
+//go:build !dendrite_blacklist
+// +build !dendrite_blacklist
+
+// Rationale for being included in Dendrite's blacklist: presence is disabled by default in Dendrite
+
+package tests
+
+import (
+	"testing"
+
+	"github.com/tidwall/gjson"
+
+	"github.com/matrix-org/complement/internal/b"
+	"github.com/matrix-org/complement/internal/client"
+)
+
+func TestRemotePresence(t *testing.T) {
+	deployment := Deploy(t, b.BlueprintFederationOneToOneRoom)
+	defer deployment.Destroy(t)
+
+	alice := deployment.Client(t, "hs1", "@alice:hs1")
+	bob := deployment.Client(t, "hs2", "@bob:hs2")
+
+	// sytest: Presence changes are also reported to remote room members
+	t.Run("Presence changes are also reported to remote room members", func(t *testing.T) {
+		_, bobSinceToken := bob.MustSync(t, client.SyncReq{TimeoutMillis: "0"})
+
+		statusMsg := "Update for room members"
+		alice.SetPresence(t, "online", statusMsg)
+
+		bob.MustSyncUntil(t, client.SyncReq{Since: bobSinceToken}, client.SyncPresenceHas(alice.UserID, func(ev gjson.Result) bool {
+			return ev.Get("content.presence").Str == "online" && ev.Get("content.status_msg").Str == statusMsg
+		}))
+	})
+}
@@ -0,0 +1,64 @@
+package tests
+
+import (
+	"testing"
+
+	"github.com/matrix-org/complement/internal/b"
+	"github.com/matrix-org/complement/internal/docker"
+	"github.com/matrix-org/complement/internal/federation"
+	"github.com/matrix-org/complement/internal/match"
+	"github.com/matrix-org/complement/internal/must"
+)
+
+func TestRemoteAliasRequests(t *testing.T) {
+	deployment := Deploy(t, b.BlueprintFederationOneToOneRoom, docker.WithIsolation()) // uses fixed room aliases
+	defer deployment.Destroy(t)
+
+	alice := deployment.Client(t, "hs1", "@alice:hs1")
+	bob := deployment.Client(t, "hs2", "@bob:hs2")
+
+	srv := federation.NewServer(t, deployment,
+		federation.HandleKeyRequests(),
+	)
+	cancel := srv.Listen()
+	defer cancel()
+
+	t.Run("Remote room alias queries resolve aliases on other homeservers", func(t *testing.T) {
+		roomID := alice.CreateRoom(t, map[string]interface{}{"preset": "public_chat"})
+		roomAlias := "#remote_alias:hs1"
+		alice.MustSetRoomAlias(t, roomID, roomAlias)
+
+		gotRoomID, servers := bob.MustResolveRoomAlias(t, roomAlias)
+		must.Equal(t, gotRoomID, roomID, "room ID")
+		found := false
+		for _, server := range servers {
+			found = found || server == "hs1"
+		}
+		if !found {
+			t.Errorf("servers for %s does not include hs1: %v", roomAlias, servers)
+		}
+	})
+
+	t.Run("Remote room alias queries use the federation directory query", func(t *testing.T) {
+		ver := alice.GetDefaultRoomVersion(t)
+		serverRoom := srv.MustMakeRoom(t, ver, federation.InitialRoomEvents(ver, srv.UserID("charlie")))
+		roomAlias := srv.MakeAliasMapping("complement_alias", serverRoom.RoomID)
+
+		gotRoomID, _ := alice.MustResolveRoomAlias(t, roomAlias)
+		must.Equal(t, gotRoomID, serverRoom.RoomID, "room ID")
+
+		res := alice.GetRoomAlias(t, "#unknown_alias:"+srv.ServerName())
+		must.MatchResponse(t, res, match.HTTPResponse{
+			StatusCode: 404,
+			JSON: []match.JSON{
+				match.JSONKeyEqual("errcode", "M_NOT_FOUND"),
+			},
+		})
+	})
+
+	t.Run("Users cannot create aliases on remote homeservers", func(t *testing.T) {
+		roomID := alice.CreateRoom(t, map[string]interface{}{"preset": "public_chat"})
+		res := bob.SetRoomAlias(t, roomID, "#not_my_server:hs1")
+		must.MatchFailure(t, res)
+	})
+}
@@ -12,7 +12,7 @@ import (
 // Create a federation room. Bob bans Alice. Bob unbans Alice. Bob invites Alice (unbanning her). Ensure the invite is
 // received and can be accepted.
 func TestUnbanViaInvite(t *testing.T) {
-	runtime.SkipIf(t, runtime.Synapse) // https://github.com/matrix-org/synapse/issues/1563
+	runtime.SkipIf(t, runtime.Synapse, "https://github.com/matrix-org/synapse/issues/1563")
 	deployment := Deploy(t, b.BlueprintFederationOneToOneRoom)
 	defer deployment.Destroy(t)
 
@@ -0,0 +1,65 @@
+package tests
+
+import (
+	"testing"
+
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/tidwall/gjson"
+
+	"github.com/matrix-org/complement/internal/b"
+	"github.com/matrix-org/complement/internal/client"
+	"github.com/matrix-org/complement/internal/federation"
+	"github.com/matrix-org/complement/internal/match"
+	"github.com/matrix-org/complement/internal/must"
+)
+
+// Tests that clients can query the room directory of remote servers with `server=`.
+func TestRemotePublicRooms(t *testing.T) {
+	deployment := Deploy(t, b.BlueprintAlice)
+	defer deployment.Destroy(t)
+
+	alice := deployment.Client(t, "hs1", "@alice:hs1")
+
+	srv := federation.NewServer(t, deployment,
+		federation.HandleKeyRequests(),
+		federation.HandlePublicRoomsRequests([]gomatrixserverlib.PublicRoom{
+			{RoomID: "!big:remote", Name: "Big remote room", JoinedMembersCount: 30},
+			{RoomID: "!medium:remote", Name: "Medium remote room", JoinedMembersCount: 20},
+			{RoomID: "!small:remote", Name: "Small remote room", JoinedMembersCount: 10},
+		}),
+	)
+	cancel := srv.Listen()
+	defer cancel()
+
+	roomIDMapper := func(r gjson.Result) interface{} {
+		return r.Get("room_id").Str
+	}
+
+	t.Run("Remote public rooms can be paginated", func(t *testing.T) {
+		rooms := alice.QueryPublicRooms(t, client.PublicRoomsReq{
+			Server:   srv.ServerName(),
+			Limit:    2,
+			Paginate: true,
+		})
+		if rooms.Pages != 2 {
+			t.Errorf("expected 2 pages with limit 2, got %d", rooms.Pages)
+		}
+		must.MatchJSONBytes(
+			t, rooms.Raw,
+			match.JSONArrayOrderedBy("chunk", "num_joined_members", true),
+			match.JSONCheckOff("chunk", []interface{}{"!big:remote", "!medium:remote", "!small:remote"}, roomIDMapper, nil),
+			match.JSONKeyEqual("total_room_count_estimate", float64(3)),
+		)
+	})
+
+	t.Run("Remote public rooms can be filtered", func(t *testing.T) {
+		rooms := alice.QueryPublicRooms(t, client.PublicRoomsReq{
+			Server: srv.ServerName(),
+			Filter: "medium",
+		})
+		must.MatchJSONBytes(
+			t, rooms.Raw,
+			match.JSONCheckOff("chunk", []interface{}{"!medium:remote"}, roomIDMapper, nil),
+		)
+	})
+}
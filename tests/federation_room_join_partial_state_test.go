@@ -1,5 +1,3 @@
-// +build faster_joins
-
 // This file contains tests for joining rooms over federation, with the
 // features introduced in msc2775.
 
@@ -24,9 +22,11 @@ import (
 	"github.com/matrix-org/complement/internal/federation"
 	"github.com/matrix-org/complement/internal/match"
 	"github.com/matrix-org/complement/internal/must"
+	"github.com/matrix-org/complement/msc"
 )
 
 func TestPartialStateJoin(t *testing.T) {
+	msc.Test(t, "msc2775")
 	// test that a regular /sync request made during a partial-state /send_join
 	// request blocks until the state is correctly synced.
 	t.Run("SyncBlocksDuringPartialStateJoin", func(t *testing.T) {
@@ -40,33 +40,25 @@ func TestPartialStateJoin(t *testing.T) {
 		// Alice has now joined the room, and the server is syncing the state in the background.
 
 		// attempts to sync should now block. Fire off a goroutine to try it.
-		syncResponseChan := make(chan gjson.Result)
-		defer close(syncResponseChan)
+		syncResponseWaiter := NewChanWaiter[gjson.Result]()
 		go func() {
 			response, _ := alice.MustSync(t, client.SyncReq{})
-			syncResponseChan <- response
+			syncResponseWaiter.Send(response)
 		}()
 
 		// wait for the state_ids request to arrive
 		psjResult.AwaitStateIdsRequest(t)
 
 		// the client-side requests should still be waiting
-		select {
-		case <-syncResponseChan:
+		if _, ok := syncResponseWaiter.TryWait(); ok {
 			t.Fatalf("Sync completed before state resync complete")
-		default:
 		}
 
 		// release the federation /state response
 		psjResult.FinishStateRequest()
 
 		// the /sync request should now complete, with the new room
-		var syncRes gjson.Result
-		select {
-		case <-time.After(1 * time.Second):
-			t.Fatalf("/sync request request did not complete")
-		case syncRes = <-syncResponseChan:
-		}
+		syncRes := syncResponseWaiter.Waitf(t, 1*time.Second, "/sync request request did not complete")
 
 		roomRes := syncRes.Get("rooms.join." + client.GjsonEscape(psjResult.ServerRoom.RoomID))
 		if !roomRes.Exists() {
@@ -116,12 +108,11 @@ func TestPartialStateJoin(t *testing.T) {
 		psjResult := beginPartialStateJoin(t, deployment, alice)
 		defer psjResult.Destroy()
 
-		alice.Client.Timeout = 2 * time.Second
 		paths := []string{"_matrix", "client", "r0", "rooms", psjResult.ServerRoom.RoomID, "send", "m.room.message", "0"}
 		res := alice.MustDoFunc(t, "PUT", paths, client.WithJSONBody(t, map[string]interface{}{
 			"msgtype": "m.text",
 			"body":    "Hello world!",
-		}))
+		}), client.WithTimeout(2*time.Second))
 		body := gjson.ParseBytes(client.ParseJSON(t, res))
 		eventID := body.Get("event_id").Str
 		t.Logf("Alice sent event event ID %s", eventID)
@@ -147,40 +138,35 @@ func TestPartialStateJoin(t *testing.T) {
 		t.Logf("Alice successfully synced")
 
 		// Fire off a goroutine to send the request, and write the response back to a channel.
-		clientMembersRequestResponseChan := make(chan *http.Response)
-		defer close(clientMembersRequestResponseChan)
+		clientMembersRequestResponseWaiter := NewChanWaiter[*http.Response]()
 		go func() {
 			queryParams := url.Values{}
 			queryParams.Set("at", syncToken)
-			clientMembersRequestResponseChan <- alice.MustDoFunc(
+			clientMembersRequestResponseWaiter.Send(alice.MustDoFunc(
 				t,
 				"GET",
 				[]string{"_matrix", "client", "r0", "rooms", psjResult.ServerRoom.RoomID, "members"},
 				client.WithQueries(queryParams),
-			)
+			))
 		}()
 
 		// release the federation /state response
 		psjResult.FinishStateRequest()
 
 		// the client-side /members request should now complete, with a response that includes charlie and derek.
-		select {
-		case <-time.After(1 * time.Second):
-			t.Fatalf("client-side /members request did not complete")
-		case res := <-clientMembersRequestResponseChan:
-			must.MatchResponse(t, res, match.HTTPResponse{
-				JSON: []match.JSON{
-					match.JSONCheckOff("chunk",
-						[]interface{}{
-							"m.room.member|" + alice.UserID,
-							"m.room.member|" + psjResult.Server.UserID("charlie"),
-							"m.room.member|" + psjResult.Server.UserID("derek"),
-						}, func(result gjson.Result) interface{} {
-							return strings.Join([]string{result.Map()["type"].Str, result.Map()["state_key"].Str}, "|")
-						}, nil),
-				},
-			})
-		}
+		res := clientMembersRequestResponseWaiter.Waitf(t, 1*time.Second, "client-side /members request did not complete")
+		must.MatchResponse(t, res, match.HTTPResponse{
+			JSON: []match.JSON{
+				match.JSONCheckOff("chunk",
+					[]interface{}{
+						"m.room.member|" + alice.UserID,
+						"m.room.member|" + psjResult.Server.UserID("charlie"),
+						"m.room.member|" + psjResult.Server.UserID("derek"),
+					}, func(result gjson.Result) interface{} {
+						return strings.Join([]string{result.Map()["type"].Str, result.Map()["state_key"].Str}, "|")
+					}, nil),
+			},
+		})
 	})
 }
 
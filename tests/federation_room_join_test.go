@@ -201,7 +201,7 @@ func TestJoinFederatedRoomWithUnverifiableEvents(t *testing.T) {
 		alice.JoinRoom(t, roomAlias, nil)
 	})
 	t.Run("/send_join response with state with unverifiable auth events shouldn't block room join", func(t *testing.T) {
-		runtime.SkipIf(t, runtime.Dendrite) // https://github.com/matrix-org/dendrite/issues/2028
+		runtime.SkipIf(t, runtime.Dendrite, "https://github.com/matrix-org/dendrite/issues/2028")
 		room := srv.MustMakeRoom(t, ver, federation.InitialRoomEvents(ver, charlie))
 		roomAlias := srv.MakeAliasMapping("UnverifiableAuthEvents", room.RoomID)
 
@@ -302,13 +302,8 @@ func TestBannedUserCannotSendJoin(t *testing.T) {
 		t.Errorf("SendJoin returned 200, want 403")
 	} else if httpError, ok := err.(gomatrix.HTTPError); ok {
 		t.Logf("SendJoin => %d/%s", httpError.Code, string(httpError.Contents))
-		if httpError.Code != 403 {
-			t.Errorf("expected 403, got %d", httpError.Code)
-		}
-		errcode := must.GetJSONFieldStr(t, httpError.Contents, "errcode")
-		if errcode != "M_FORBIDDEN" {
-			t.Errorf("errcode: got %s, want M_FORBIDDEN", errcode)
-		}
+		must.Equal(t, httpError.Code, 403, "SendJoin status")
+		must.Equal(t, must.GetJSONFieldStr(t, httpError.Contents, "errcode"), "M_FORBIDDEN", "errcode")
 	} else {
 		t.Errorf("SendJoin: non-HTTPError: %v", err)
 	}
@@ -321,7 +316,7 @@ func TestBannedUserCannotSendJoin(t *testing.T) {
 	)
 	stateResp := client.ParseJSON(t, res)
 	membership := must.GetJSONFieldStr(t, stateResp, "membership")
-	must.EqualStr(t, membership, "ban", "membership of charlie")
+	must.Equal(t, membership, "ban", "membership of charlie")
 }
 
 // This test checks that we cannot submit anything via /v1/send_join except a join.
@@ -398,9 +393,7 @@ func testValidationForSendMembershipEndpoint(t *testing.T, baseApiPath, expected
 		}
 
 		t.Logf("%s returned %d/%s", baseApiPath, httpError.Code, string(httpError.Contents))
-		if httpError.Code != 400 {
-			t.Errorf("expected 400, got %d", httpError.Code)
-		}
+		must.Equal(t, httpError.Code, 400, baseApiPath+" status")
 	}
 
 	t.Run("regular event", func(t *testing.T) {
@@ -0,0 +1,99 @@
+package tests
+
+import (
+	"testing"
+
+	"github.com/tidwall/gjson"
+
+	"github.com/matrix-org/complement/internal/b"
+	"github.com/matrix-org/complement/internal/client"
+	"github.com/matrix-org/complement/internal/federation"
+	"github.com/matrix-org/complement/internal/match"
+	"github.com/matrix-org/complement/internal/must"
+)
+
+// Tests that space hierarchies include children on remote servers, which are fetched over federation.
+func TestSpaceHierarchyWithRemoteChildren(t *testing.T) {
+	deployment := Deploy(t, b.BlueprintAlice)
+	defer deployment.Destroy(t)
+
+	alice := deployment.Client(t, "hs1", "@alice:hs1")
+
+	srv := federation.NewServer(t, deployment,
+		federation.HandleKeyRequests(),
+		federation.HandleHierarchyRequests(),
+	)
+	cancel := srv.Listen()
+	defer cancel()
+
+	// the remote server has a named room
+	ver := alice.GetDefaultRoomVersion(t)
+	charlie := srv.UserID("charlie")
+	remoteRoom := srv.MustMakeRoom(t, ver, append(federation.InitialRoomEvents(ver, charlie), b.Event{
+		Type:     "m.room.name",
+		StateKey: b.Ptr(""),
+		Sender:   charlie,
+		Content: map[string]interface{}{
+			"name": "Remote room",
+		},
+	}))
+
+	space := alice.CreateSpace(t, map[string]interface{}{
+		"preset": "public_chat",
+		"name":   "Space",
+	})
+	localRoom := alice.CreateRoom(t, map[string]interface{}{
+		"preset": "public_chat",
+		"name":   "Local room",
+	})
+	alice.AddSpaceChild(t, space, localRoom, []string{"hs1"}, true)
+	eventID := alice.AddSpaceChild(t, space, remoteRoom.RoomID, []string{srv.ServerName()}, false)
+	alice.MustSyncUntil(t, client.SyncReq{}, client.SyncTimelineHasEventID(space, eventID))
+
+	t.Run("Hierarchy includes remote children", func(t *testing.T) {
+		hierarchy := alice.GetHierarchy(t, space, client.HierarchyReq{})
+		must.MatchJSONBytes(
+			t, hierarchy.Raw,
+			match.JSONHierarchyRooms(space, localRoom, remoteRoom.RoomID),
+			match.JSONHierarchyHasChild(space, localRoom),
+			match.JSONHierarchyHasChild(space, remoteRoom.RoomID),
+			match.JSONArrayEach("rooms", func(r gjson.Result) error {
+				if r.Get("room_id").Str == remoteRoom.RoomID {
+					return match.JSONKeyEqual("name", "Remote room")([]byte(r.Raw))
+				}
+				return nil
+			}),
+		)
+	})
+
+	t.Run("Hierarchy can be paginated", func(t *testing.T) {
+		hierarchy := alice.GetHierarchy(t, space, client.HierarchyReq{
+			Limit:    1,
+			Paginate: true,
+		})
+		if hierarchy.Pages != 3 {
+			t.Errorf("expected 3 pages with limit 1, got %d", hierarchy.Pages)
+		}
+		must.MatchJSONBytes(t, hierarchy.Raw, match.JSONHierarchyRooms(space, localRoom, remoteRoom.RoomID))
+	})
+
+	t.Run("Hierarchy can be limited to suggested children", func(t *testing.T) {
+		hierarchy := alice.GetHierarchy(t, space, client.HierarchyReq{
+			SuggestedOnly: true,
+		})
+		must.MatchJSONBytes(t, hierarchy.Raw, match.JSONHierarchyRooms(space, localRoom))
+	})
+
+	t.Run("Hierarchy can be limited by depth", func(t *testing.T) {
+		subspace := alice.CreateSpace(t, map[string]interface{}{
+			"preset": "public_chat",
+		})
+		deepRoom := alice.CreateRoom(t, map[string]interface{}{"preset": "public_chat"})
+		alice.AddSpaceChild(t, space, subspace, []string{"hs1"}, false)
+		alice.AddSpaceChild(t, subspace, deepRoom, []string{"hs1"}, false)
+		hierarchy := alice.GetHierarchy(t, space, client.HierarchyReq{
+			MaxDepth: 1,
+		})
+		must.MatchJSONBytes(t, hierarchy.Raw, match.JSONHierarchyRooms(space, localRoom, remoteRoom.RoomID, subspace))
+	})
+}
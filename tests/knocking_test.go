@@ -30,6 +30,9 @@ const testKnockReason string = "Let me in... LET ME IN!!!"
 // TestKnocking tests sending knock membership events and transitioning from knock to other membership states.
 // Knocking is currently an experimental feature and not in the matrix spec.
 // This function tests knocking on local and remote room.
+//
+// spec: client-server-api/#knocking-on-rooms
+// spec: MSC2403
 func TestKnocking(t *testing.T) {
 	// v7 is required for knocking support
 	doTestKnocking(t, "7", "knock")
@@ -158,8 +161,8 @@ func knockingBetweenTwoUsersTest(t *testing.T, roomID string, inRoomUser, knocki
 			if ev.Get("type").Str != "m.room.member" || ev.Get("sender").Str != knockingUser.UserID {
 				return false
 			}
-			must.EqualStr(t, ev.Get("content").Get("reason").Str, testKnockReason, "incorrect reason for knock")
-			must.EqualStr(t, ev.Get("content").Get("membership").Str, "knock", "incorrect membership for knocking user")
+			must.Equal(t, ev.Get("content").Get("reason").Str, testKnockReason, "incorrect reason for knock")
+			must.Equal(t, ev.Get("content").Get("membership").Str, "knock", "incorrect membership for knocking user")
 			return true
 		}))
 	})
@@ -194,7 +197,7 @@ func knockingBetweenTwoUsersTest(t *testing.T, roomID string, inRoomUser, knocki
 					if ev.Get("type").Str != "m.room.member" || ev.Get("sender").Str != knockingUser.UserID {
 						continue
 					}
-					must.EqualStr(t, ev.Get("content").Get("membership").Str, "leave", "expected leave membership after rescinding a knock")
+					must.Equal(t, ev.Get("content").Get("membership").Str, "leave", "expected leave membership after rescinding a knock")
 					return nil
 				}
 				return fmt.Errorf("leave timeline for %s doesn't have leave event for %s", roomID, knockingUser.UserID)
@@ -370,6 +373,9 @@ func knockOnRoomWithStatus(t *testing.T, c *client.CSAPI, roomID, reason string,
 // and then check that the room appears in the directory. The room's entry should also have a 'join_rule' field
 // representing a knock room. For sanity-checking, this test will also create a public room and ensure it has a
 // 'join_rule' representing a publicly-joinable room.
+//
+// spec: client-server-api/#knocking-on-rooms
+// spec: MSC2403
 func TestKnockRoomsInPublicRoomsDirectory(t *testing.T) {
 	// v7 is required for knocking
 	doTestKnockRoomsInPublicRoomsDirectory(t, "7", "knock")
@@ -469,6 +475,9 @@ func publishAndCheckRoomJoinRule(t *testing.T, c *client.CSAPI, roomID, expected
 }
 
 // TestCannotSendNonKnockViaSendKnock checks that we cannot submit anything via /send_knock except a knock
+//
+// spec: server-server-api/#knocking-upon-a-room
+// spec: MSC2403
 func TestCannotSendNonKnockViaSendKnock(t *testing.T) {
 	testValidationForSendMembershipEndpoint(t, "/_matrix/federation/v1/send_knock", "knock",
 		map[string]interface{}{
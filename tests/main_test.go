@@ -2,6 +2,7 @@ package tests
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log"
 	"os"
@@ -15,6 +16,11 @@ import (
 	"github.com/matrix-org/complement/internal/b"
 	"github.com/matrix-org/complement/internal/config"
 	"github.com/matrix-org/complement/internal/docker"
+	"github.com/matrix-org/complement/internal/shard"
+	"github.com/matrix-org/complement/internal/testlog"
+	"github.com/matrix-org/complement/internal/timing"
+	"github.com/matrix-org/complement/internal/watchdog"
+	"github.com/matrix-org/complement/runtime"
 )
 
 var namespaceCounter uint64
@@ -22,26 +28,48 @@ var namespaceCounter uint64
 // persist the complement builder which is set when the tests start via TestMain
 var complementBuilder *docker.Builder
 
+// persist the deployment pool if COMPLEMENT_POOL_DEPLOYMENTS or COMPLEMENT_ENABLE_DIRTY_RUNS is set
+var deploymentPool *docker.Pool
+
 // TestMain is the main entry point for Complement.
 //
 // It will clean up any old containers/images/networks from the previous run, then run the tests, then clean up
 // again. No blueprints are made at this point as they are lazily made on demand.
 func TestMain(m *testing.M) {
+	start := time.Now()
 	cfg := config.NewConfigFromEnvVars("fed", "")
 	log.Printf("config: %+v", cfg)
+	testlog.Configure(cfg.ArtifactsDir, cfg.LogLevel)
+	if cfg.ShardTotal > 1 {
+		if err := shard.Apply(cfg.ShardIndex, cfg.ShardTotal, cfg.ShardTimings); err != nil {
+			fmt.Printf("Error: %s", err)
+			os.Exit(1)
+		}
+	}
 	builder, err := docker.NewBuilder(cfg)
 	if err != nil {
 		fmt.Printf("Error: %s", err)
 		os.Exit(1)
 	}
 	complementBuilder = builder
+	if cfg.PoolDeployments || cfg.EnableDirtyRuns {
+		deploymentPool = docker.NewPool(cfg)
+	}
 	// remove any old images/containers/networks in case we died horribly before
 	builder.Cleanup()
+	runtime.SetDetector(detectHomeserver)
 
 	// we use GMSL which uses logrus by default. We don't want those logs in our test output unless they are Serious.
 	logrus.SetLevel(logrus.ErrorLevel)
 
 	exitCode := m.Run()
+	for _, skip := range runtime.Skips() {
+		log.Printf("Skipped %s on %s: %s", skip.Test, skip.Homeserver, skip.Reason)
+	}
+	log.Print(timing.Summary(time.Since(start)))
+	if deploymentPool != nil {
+		deploymentPool.Close()
+	}
 	builder.Cleanup()
 	os.Exit(exitCode)
 }
@@ -49,27 +77,127 @@ func TestMain(m *testing.M) {
 // Deploy will deploy the given blueprint or terminate the test.
 // It will construct the blueprint if it doesn't already exist in the docker image cache.
 // This function is the main setup function for all tests as it provides a deployment with
-// which tests can interact with.
-func Deploy(t *testing.T, blueprint b.Blueprint) *docker.Deployment {
+// which tests can interact with. Any `opts` modify how the blueprint is deployed.
+func Deploy(t *testing.T, blueprint b.Blueprint, opts ...docker.DeployOption) *docker.Deployment {
 	t.Helper()
 	timeStartBlueprint := time.Now()
 	if complementBuilder == nil {
 		t.Fatalf("complementBuilder not set, did you forget to call TestMain?")
 	}
-	if err := complementBuilder.ConstructBlueprintIfNotExist(blueprint); err != nil {
-		t.Fatalf("Deploy: Failed to construct blueprint: %s", err)
+	// before anything which logs in a cleanup, so its logs are written too
+	testlog.Register(t)
+	wd := watchdog.ForTest(t, complementBuilder.Config.TestTimeout)
+	if complementBuilder.Config.AttachBaseURL != "" {
+		return attach(t, blueprint, opts)
 	}
-	namespace := fmt.Sprintf("%d", atomic.AddUint64(&namespaceCounter, 1))
-	d, err := docker.NewDeployer(namespace, complementBuilder.Config)
-	if err != nil {
-		t.Fatalf("Deploy: NewDeployer returned error %s", err)
+	if complementBuilder.Config.KubernetesNamespace != "" {
+		return deployKubernetes(t, blueprint, opts)
+	}
+	if docker.UsesCompose(blueprint) {
+		opts = append(opts, docker.WithComposeHomeservers(blueprint))
+	}
+	if err := complementBuilder.ConstructBlueprintIfNotExist(blueprint); errors.Is(err, docker.ErrImagePlatform) {
+		t.Skipf("Deploy: %s", err)
+	} else if err != nil {
+		t.Fatalf("Deploy: Failed to construct blueprint: %s", err)
 	}
 	timeStartDeploy := time.Now()
-	dep, err := d.Deploy(context.Background(), blueprint.Name)
+	// a test deploying more than once mustn't wait for its own homeservers to be destroyed
+	ctx := docker.WithContainerHolder(context.Background(), t.Name())
+	var dep *docker.Deployment
+	var err error
+	if deploymentPool != nil {
+		dep, err = deploymentPool.Deploy(ctx, blueprint.Name, opts...)
+	} else {
+		namespace := fmt.Sprintf("%d", atomic.AddUint64(&namespaceCounter, 1))
+		var d *docker.Deployer
+		d, err = docker.NewDeployer(namespace, complementBuilder.Config)
+		if err != nil {
+			t.Fatalf("Deploy: NewDeployer returned error %s", err)
+		}
+		dep, err = d.Deploy(ctx, blueprint.Name, opts...)
+	}
 	if err != nil {
 		t.Fatalf("Deploy: Deploy returned error %s", err)
 	}
-	t.Logf("Deploy times: %v blueprints, %v containers", timeStartDeploy.Sub(timeStartBlueprint), time.Since(timeStartDeploy))
+	wd.AddDiagnostic("homeserver logs", dep.PrintLogs)
+	if complementBuilder.Config.StreamLogs {
+		dep.StreamLogs(t)
+	}
+	if len(blueprint.Homeservers) > 0 {
+		runtime.DetectHomeserver(t, dep, blueprint.Homeservers[0].Name)
+	}
+	testlog.ForTest(t).With("component", "deploy", "blueprint", blueprint.Name).Infof(
+		"Deploy times: %v blueprints, %v containers", timeStartDeploy.Sub(timeStartBlueprint), time.Since(timeStartDeploy),
+	)
+	return dep
+}
+
+// detectHomeserver deploys a clean homeserver to find out which implementation is being tested, for
+// runtime.SkipIf calls made before any homeserver has been deployed.
+func detectHomeserver() (string, error) {
+	cfg := complementBuilder.Config
+	if cfg.AttachBaseURL != "" {
+		dep, err := docker.Attach(cfg, b.BlueprintCleanHS)
+		if err != nil {
+			return "", err
+		}
+		return runtime.Detect(dep, "hs1")
+	}
+	var dep *docker.Deployment
+	var err error
+	if cfg.KubernetesNamespace != "" {
+		dep, err = docker.DeployKubernetes(context.Background(), cfg, "detect", b.BlueprintCleanHS)
+	} else {
+		if err = complementBuilder.ConstructBlueprintIfNotExist(b.BlueprintCleanHS); err != nil {
+			return "", err
+		}
+		var d *docker.Deployer
+		if d, err = docker.NewDeployer("detect", cfg); err != nil {
+			return "", err
+		}
+		dep, err = d.Deploy(context.Background(), b.BlueprintCleanHS.Name)
+	}
+	if err != nil {
+		return "", err
+	}
+	defer dep.Deployer.Destroy(dep, false)
+	return runtime.Detect(dep, "hs1")
+}
+
+// attach returns a deployment of the blueprint on the homeserver at COMPLEMENT_ATTACH_BASE_URL, or skips
+// the test if the blueprint or `opts` need homeservers which Complement starts.
+func attach(t *testing.T, blueprint b.Blueprint, opts []docker.DeployOption) *docker.Deployment {
+	t.Helper()
+	if len(blueprint.Homeservers) != 1 {
+		t.Skipf("Deploy: blueprint %s needs %d homeservers, but attached to 1", blueprint.Name, len(blueprint.Homeservers))
+	}
+	if len(opts) > 0 {
+		t.Skipf("Deploy: deploy options are not supported when attached to an existing homeserver")
+	}
+	dep, err := docker.Attach(complementBuilder.Config, blueprint)
+	if err != nil {
+		t.Fatalf("Deploy: Attach returned error %s", err)
+	}
+	runtime.DetectHomeserver(t, dep, blueprint.Homeservers[0].Name)
+	return dep
+}
+
+// deployKubernetes returns a deployment of the blueprint as pods in COMPLEMENT_KUBERNETES_NAMESPACE, or skips
+// the test if the blueprint or `opts` need containers.
+func deployKubernetes(t *testing.T, blueprint b.Blueprint, opts []docker.DeployOption) *docker.Deployment {
+	t.Helper()
+	namespace := fmt.Sprintf("%d", atomic.AddUint64(&namespaceCounter, 1))
+	ctx := docker.WithContainerHolder(context.Background(), t.Name())
+	dep, err := docker.DeployKubernetes(ctx, complementBuilder.Config, namespace, blueprint, opts...)
+	if errors.Is(err, docker.ErrKubernetesUnsupported) {
+		t.Skipf("Deploy: %s", err)
+	} else if err != nil {
+		t.Fatalf("Deploy: DeployKubernetes returned error %s", err)
+	}
+	if len(blueprint.Homeservers) > 0 {
+		runtime.DetectHomeserver(t, dep, blueprint.Homeservers[0].Name)
+	}
 	return dep
 }
 
@@ -100,11 +228,16 @@ func (w *Waiter) Wait(t *testing.T, timeout time.Duration) {
 // If the timeout is reached, the test is failed with the given error message.
 func (w *Waiter) Waitf(t *testing.T, timeout time.Duration, errFormat string, args ...interface{}) {
 	t.Helper()
+	errmsg := fmt.Sprintf(errFormat, args...)
+	defer watchdog.Waiting(t, errmsg)()
+	logger := testlog.ForTest(t).With("component", "waiter")
+	logger.Debugf("%s: waiting up to %v", errmsg, timeout)
+	start := time.Now()
 	select {
 	case <-w.ch:
+		logger.Debugf("%s: finished after %v", errmsg, time.Since(start))
 		return
 	case <-time.After(timeout):
-		errmsg := fmt.Sprintf(errFormat, args...)
 		t.Fatalf("%s: timed out after %f seconds.", errmsg, timeout.Seconds())
 	}
 }
@@ -121,3 +254,140 @@ func (w *Waiter) Finish() {
 	w.closed = true
 	close(w.ch)
 }
+
+// ChanWaiter is like a Waiter, but each call to Send delivers a payload to a single call to Wait, in the
+// order they were sent. Sending never blocks, so it is safe to call from federation request handlers.
+type ChanWaiter[T any] struct {
+	mu       sync.Mutex
+	payloads []T
+	notify   chan struct{}
+}
+
+// NewChanWaiter returns a ChanWaiter which delivers payloads of type T.
+func NewChanWaiter[T any]() *ChanWaiter[T] {
+	return &ChanWaiter[T]{
+		notify: make(chan struct{}, 1),
+	}
+}
+
+// Send queues `payload` to be returned by a call to Wait.
+func (w *ChanWaiter[T]) Send(payload T) {
+	w.mu.Lock()
+	w.payloads = append(w.payloads, payload)
+	w.mu.Unlock()
+	select {
+	case w.notify <- struct{}{}:
+	default:
+	}
+}
+
+// TryWait returns the oldest payload which has not been returned yet, if there is one. Does not block.
+func (w *ChanWaiter[T]) TryWait() (payload T, ok bool) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if len(w.payloads) == 0 {
+		return payload, false
+	}
+	payload = w.payloads[0]
+	w.payloads = w.payloads[1:]
+	return payload, true
+}
+
+// Wait blocks until a payload has been sent and returns it, or until the timeout is reached.
+// If the timeout is reached, the test is failed.
+func (w *ChanWaiter[T]) Wait(t *testing.T, timeout time.Duration) T {
+	t.Helper()
+	return w.Waitf(t, timeout, "Wait")
+}
+
+// Waitf blocks until a payload has been sent and returns it, or until the timeout is reached.
+// If the timeout is reached, the test is failed with the given error message.
+func (w *ChanWaiter[T]) Waitf(t *testing.T, timeout time.Duration, errFormat string, args ...interface{}) T {
+	t.Helper()
+	errmsg := fmt.Sprintf(errFormat, args...)
+	defer watchdog.Waiting(t, errmsg)()
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	logger := testlog.ForTest(t).With("component", "waiter")
+	logger.Debugf("%s: waiting up to %v", errmsg, timeout)
+	start := time.Now()
+	for {
+		if payload, ok := w.TryWait(); ok {
+			logger.Debugf("%s: received payload after %v", errmsg, time.Since(start))
+			return payload
+		}
+		select {
+		case <-w.notify:
+		case <-timer.C:
+			t.Fatalf("%s: timed out after %f seconds.", errmsg, timeout.Seconds())
+		}
+	}
+}
+
+// CountingWaiter is a Waiter which only finishes once Finish has been called `count` times, e.g to wait
+// for a number of requests to arrive.
+type CountingWaiter struct {
+	*Waiter
+	mu        sync.Mutex
+	remaining int
+}
+
+// NewCountingWaiter returns a CountingWaiter which finishes after `count` calls to Finish.
+func NewCountingWaiter(count int) *CountingWaiter {
+	w := &CountingWaiter{
+		Waiter:    NewWaiter(),
+		remaining: count,
+	}
+	if count <= 0 {
+		w.Waiter.Finish()
+	}
+	return w
+}
+
+// Finish records a completion, and causes all goroutines waiting via Wait to return if this was the
+// last one needed. Calls after that are ignored.
+func (w *CountingWaiter) Finish() {
+	w.mu.Lock()
+	w.remaining--
+	done := w.remaining == 0
+	w.mu.Unlock()
+	if done {
+		w.Waiter.Finish()
+	}
+}
+
+// MultiWaiter waits on a group of Waiters with a single timeout.
+type MultiWaiter struct {
+	waiters []*Waiter
+	names   []string
+}
+
+// Add adds a waiter to the group. `name` is used in the failure message if it does not finish in time.
+func (m *MultiWaiter) Add(name string, w *Waiter) {
+	m.waiters = append(m.waiters, w)
+	m.names = append(m.names, name)
+}
+
+// AwaitAll blocks until every waiter in the group has finished, or until the timeout is reached.
+// If the timeout is reached, the test is failed listing the waiters which did not finish.
+func (m *MultiWaiter) AwaitAll(t *testing.T, timeout time.Duration) {
+	t.Helper()
+	defer watchdog.Waiting(t, fmt.Sprintf("AwaitAll %v", m.names))()
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	for i, w := range m.waiters {
+		select {
+		case <-w.ch:
+		case <-timer.C:
+			var unfinished []string
+			for j := i; j < len(m.waiters); j++ {
+				select {
+				case <-m.waiters[j].ch:
+				default:
+					unfinished = append(unfinished, m.names[j])
+				}
+			}
+			t.Fatalf("AwaitAll: timed out after %f seconds waiting for %v.", timeout.Seconds(), unfinished)
+		}
+	}
+}
@@ -8,6 +8,7 @@ import (
 	"github.com/matrix-org/complement/internal/b"
 	"github.com/matrix-org/complement/internal/client"
 	"github.com/matrix-org/complement/internal/data"
+	"github.com/matrix-org/complement/internal/must"
 )
 
 const asciiFileName = "ascii"
@@ -45,9 +46,7 @@ func TestMediaFilenames(t *testing.T) {
 
 					name := downloadForFilename(t, alice, mxcUri, "")
 
-					if name != filename {
-						t.Fatalf("Incorrect filename '%s', expected '%s'", name, filename)
-					}
+					must.Equal(t, name, filename, "filename")
 				})
 			}
 
@@ -59,9 +58,7 @@ func TestMediaFilenames(t *testing.T) {
 
 				const altName = "file.png"
 				filename := downloadForFilename(t, alice, mxcUri, altName)
-				if filename != altName {
-					t.Fatalf("filename did not match, expected '%s', got '%s'", altName, filename)
-				}
+				must.Equal(t, filename, altName, "filename")
 			})
 		})
 
@@ -84,9 +81,7 @@ func TestMediaFilenames(t *testing.T) {
 				const diffUnicodeFilename = "\u2615" // coffee emoji
 
 				filename := downloadForFilename(t, alice, mxcUri, diffUnicodeFilename)
-				if filename != diffUnicodeFilename {
-					t.Fatalf("filename did not match, expected '%s', got '%s'", diffUnicodeFilename, filename)
-				}
+				must.Equal(t, filename, diffUnicodeFilename, "filename")
 			})
 
 			// sytest: Can download with Unicode file name locally
@@ -97,9 +92,7 @@ func TestMediaFilenames(t *testing.T) {
 
 				filename := downloadForFilename(t, alice, mxcUri, "")
 
-				if filename != unicodeFileName {
-					t.Fatalf("filename did not match, expected '%s', got '%s'", unicodeFileName, filename)
-				}
+				must.Equal(t, filename, unicodeFileName, "filename")
 			})
 
 			// sytest: Can download with Unicode file name over federation
@@ -110,9 +103,7 @@ func TestMediaFilenames(t *testing.T) {
 
 				filename := downloadForFilename(t, bob, mxcUri, "")
 
-				if filename != unicodeFileName {
-					t.Fatalf("filename did not match, expected '%s', got '%s'", unicodeFileName, filename)
-				}
+				must.Equal(t, filename, unicodeFileName, "filename")
 			})
 		})
 	})
@@ -139,9 +130,7 @@ func downloadForFilename(t *testing.T, c *client.CSAPI, mxcUri string, diffName
 		t.Fatalf("Got err when parsing content disposition: %s", err)
 	}
 
-	if mediaType != "inline" {
-		t.Fatalf("Found unexpected mediatype %s, expected inline", mediaType)
-	}
+	must.Equal(t, mediaType, "inline", "Content-Disposition type")
 
 	if filename, ok := params["filename"]; ok {
 		return filename
@@ -1,6 +1,3 @@
-//go:build msc2716
-// +build msc2716
-
 // This file contains tests for incrementally importing history to an existing room,
 // a currently experimental feature defined by MSC2716, which you can read here:
 // https://github.com/matrix-org/matrix-doc/pull/2716
@@ -13,7 +10,6 @@ import (
 	"io/ioutil"
 	"net/http"
 	"net/url"
-	"strings"
 	"testing"
 	"time"
 
@@ -23,29 +19,19 @@ import (
 	"github.com/matrix-org/complement/internal/client"
 	"github.com/matrix-org/complement/internal/match"
 	"github.com/matrix-org/complement/internal/must"
+	"github.com/matrix-org/complement/msc"
 )
 
-type event struct {
-	Type           string
-	Sender         string
-	OriginServerTS uint64
-	StateKey       *string
-	PrevEvents     []string
-	Content        map[string]interface{}
-}
-
 // This is configurable because it can be nice to change it to `time.Second` while
 // checking out the test result in a Synapse instance
 const timeBetweenMessages = time.Millisecond
 
 var (
-	insertionEventType = "org.matrix.msc2716.insertion"
-	batchEventType     = "org.matrix.msc2716.batch"
-	markerEventType    = "org.matrix.msc2716.marker"
+	insertionEventType = client.MSC2716InsertionEventType
+	batchEventType     = client.MSC2716BatchEventType
 
-	historicalContentField      = "org.matrix.msc2716.historical"
-	nextBatchIDContentField     = "org.matrix.msc2716.next_batch_id"
-	markerInsertionContentField = "org.matrix.msc2716.marker.insertion"
+	historicalContentField  = client.MSC2716HistoricalContentField
+	nextBatchIDContentField = client.MSC2716NextBatchIDContentField
 )
 
 var createPublicRoomOpts = map[string]interface{}{
@@ -60,7 +46,9 @@ var createPrivateRoomOpts = map[string]interface{}{
 	"room_version": "org.matrix.msc2716v3",
 }
 
+// spec: MSC2716
 func TestImportHistoricalMessages(t *testing.T) {
+	msc.Test(t, "msc2716")
 	deployment := Deploy(t, b.BlueprintHSWithApplicationService)
 	defer deployment.Destroy(t)
 
@@ -179,7 +167,7 @@ func TestImportHistoricalMessages(t *testing.T) {
 
 			must.MatchResponse(t, messagesRes, match.HTTPResponse{
 				JSON: []match.JSON{
-					matcherJSONEventIDArrayInOrder("chunk",
+					match.JSONEventIDsInOrderWhere("chunk",
 						expectedEventIDOrder,
 						relevantToScrollbackEventFilter,
 					),
@@ -1297,14 +1285,8 @@ func paginateUntilMessageCheckOff(t *testing.T, c *client.CSAPI, roomID string,
 	}
 }
 
-func historicalEventFilter(r gjson.Result) bool {
-	// This includes messages, insertion, batch, and marker events because we
-	// include the historical field on all of them.
-	return r.Get("content").Get(strings.ReplaceAll(historicalContentField, ".", "\\.")).Exists()
-}
-
 func relevantToScrollbackEventFilter(r gjson.Result) bool {
-	return r.Get("type").Str == "m.room.message" || historicalEventFilter(r)
+	return r.Get("type").Str == "m.room.message" || match.IsHistoricalEvent(r)
 }
 
 func mustGetRelevantEventDebugStringsFromMessagesResponse(t *testing.T, wantKey string, body []byte, eventFilter func(gjson.Result) bool) (eventIDsFromResponse []string) {
@@ -1368,18 +1350,8 @@ func ensureVirtualUserRegistered(t *testing.T, c *client.CSAPI, virtualUserLocal
 func sendMarkerAndEnsureBackfilled(t *testing.T, as *client.CSAPI, c *client.CSAPI, roomID, insertionEventID string) (markerEventID string) {
 	t.Helper()
 
-	markerEvent := b.Event{
-		Type: markerEventType,
-		Content: map[string]interface{}{
-			markerInsertionContentField: insertionEventID,
-		},
-	}
-	// Marker events should have unique state_key so they all show up in the current state to process.
-	unique_state_key := getTxnID("marker_state_key")
 	// We can't use as.SendEventSynced(...) because application services can't use the /sync API.
-	markerSendRes := as.MustDoFunc(t, "PUT", []string{"_matrix", "client", "r0", "rooms", roomID, "state", markerEvent.Type, unique_state_key}, client.WithJSONBody(t, markerEvent.Content))
-	markerSendBody := client.ParseJSON(t, markerSendRes)
-	markerEventID = client.GetJSONFieldStr(t, markerSendBody, "event_id")
+	markerEventID = as.SendMarker(t, roomID, insertionEventID)
 
 	// Make sure the marker event has reached the remote homeserver
 	c.MustSyncUntil(t, client.SyncReq{}, client.SyncTimelineHas(roomID, func(ev gjson.Result) bool {
@@ -1532,24 +1504,13 @@ func batchSendHistoricalMessages(
 ) (res *http.Response) {
 	t.Helper()
 
-	query := make(url.Values, 2)
-	query.Add("prev_event_id", insertAfterEventId)
-	// If provided, connect the batch to the last insertion point
-	if batchID != "" {
-		query.Add("batch_id", batchID)
-	}
-
-	res = c.DoFunc(
-		t,
-		"POST",
-		[]string{"_matrix", "client", "unstable", "org.matrix.msc2716", "rooms", roomID, "batch_send"},
-		client.WithJSONBody(t, map[string]interface{}{
-			"events":                events,
-			"state_events_at_start": stateEventsAtStart,
-		}),
-		client.WithContentType("application/json"),
-		client.WithQueries(query),
-	)
+	res = c.BatchSend(t, roomID, client.BatchSendReq{
+		PrevEventID: insertAfterEventId,
+		// If provided, connect the batch to the last insertion point
+		BatchID:            batchID,
+		StateEventsAtStart: stateEventsAtStart,
+		Events:             events,
+	})
 
 	if res.StatusCode != expectedStatus {
 		t.Fatalf("msc2716.batchSendHistoricalMessages got %d HTTP status code from batch send response but want %d", res.StatusCode, expectedStatus)
@@ -1597,9 +1558,9 @@ func validateBatchSendRes(t *testing.T, c *client.CSAPI, roomID string, batchSen
 	}))
 	must.MatchResponse(t, fullMessagesRes, match.HTTPResponse{
 		JSON: []match.JSON{
-			matcherJSONEventIDArrayInOrder("chunk",
+			match.JSONEventIDsInOrderWhere("chunk",
 				expectedEventIDOrder,
-				historicalEventFilter,
+				match.IsHistoricalEvent,
 			),
 		},
 	})
@@ -1623,77 +1584,3 @@ func validateBatchSendRes(t *testing.T, c *client.CSAPI, roomID string, batchSen
 		})
 	}
 }
-
-// matcherJSONEventIDArrayInOrder loops through `jsonArrayKey` in the response
-// to find the sliding window of expected event ID's(`expectedEventIDOrder`)
-// somewhere in the array in order. The expected list can start anywhere in the
-// overall list filtered by `eventFilter`.
-func matcherJSONEventIDArrayInOrder(jsonArrayKey string, expectedEventIDOrder []string, eventFilter func(gjson.Result) bool) match.JSON {
-	return func(body []byte) error {
-		if len(expectedEventIDOrder) == 0 {
-			return fmt.Errorf("expectedEventIDOrder can not be an empty list")
-		}
-
-		// Copy the array by slice so we can modify it as we iterate in the foreach loop.
-		// We save the full untouched `expectedEventIDOrder` for use in the log messages
-		workingExpectedEventIDOrder := expectedEventIDOrder
-
-		var res gjson.Result
-		if jsonArrayKey == "" {
-			res = gjson.ParseBytes(body)
-		} else {
-			res = gjson.GetBytes(body, jsonArrayKey)
-		}
-
-		if !res.Exists() {
-			return fmt.Errorf("missing key '%s'", jsonArrayKey)
-		}
-		if !res.IsArray() {
-			return fmt.Errorf("key '%s' is not an array", jsonArrayKey)
-		}
-
-		eventDebugStringsFromResponse, err := getRelevantEventDebugStringsFromMessagesResponse("chunk", body, eventFilter)
-		if err != nil {
-			return err
-		}
-
-		// Loop through the overall event list
-		foundFirstEvent := false
-		res.ForEach(func(_, r gjson.Result) bool {
-			eventID := r.Get("event_id").Str
-			nextEventIdInOrder := workingExpectedEventIDOrder[0]
-
-			// We need to find the start of the sliding window inside the overall
-			// event list
-			if !foundFirstEvent && eventID == nextEventIdInOrder {
-				foundFirstEvent = true
-			}
-
-			// Once we found the first event, find all events in order
-			if foundFirstEvent && eventFilter(r) {
-				if r.Get("event_id").Str != nextEventIdInOrder {
-					err = fmt.Errorf("Next event found was %s but expected %s\nActualEvents (%d): %v\nExpectedEvents (%d): %v", r.Get("event_id").Str, nextEventIdInOrder, len(eventDebugStringsFromResponse), eventDebugStringsFromResponse, len(expectedEventIDOrder), expectedEventIDOrder)
-					return false
-				}
-
-				// Now that we found it, pop the message off the expected list
-				workingExpectedEventIDOrder = workingExpectedEventIDOrder[1:]
-			}
-
-			// Found all of the expected events, stop iterating
-			if len(workingExpectedEventIDOrder) == 0 {
-				return false
-			}
-
-			return true
-		})
-
-		// There was some left-over events in the list but we should have found all
-		// of them
-		if len(workingExpectedEventIDOrder) != 0 {
-			return fmt.Errorf("Expected all events to be matched in message response but there were some left-over events (%d): %s\nActualEvents (%d): %v\nExpectedEvents (%d): %v", len(workingExpectedEventIDOrder), workingExpectedEventIDOrder, len(eventDebugStringsFromResponse), eventDebugStringsFromResponse, len(expectedEventIDOrder), expectedEventIDOrder)
-		}
-
-		return err
-	}
-}
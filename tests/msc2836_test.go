@@ -1,6 +1,3 @@
-//go:build msc2836
-// +build msc2836
-
 package tests
 
 import (
@@ -23,6 +20,7 @@ import (
 	"github.com/matrix-org/complement/internal/federation"
 	"github.com/matrix-org/complement/internal/match"
 	"github.com/matrix-org/complement/internal/must"
+	"github.com/matrix-org/complement/msc"
 )
 
 // This test checks that federated threading works when the remote server joins after the messages
@@ -38,6 +36,7 @@ import (
 // an event which the server does have, event B, to ensure that this request also works and also does
 // federated hits to return missing events (A,C).
 func TestEventRelationships(t *testing.T) {
+	msc.Test(t, "msc2836")
 	deployment := Deploy(t, b.BlueprintFederationOneToOneRoom)
 	defer deployment.Destroy(t)
 
@@ -188,6 +187,7 @@ func TestEventRelationships(t *testing.T) {
 // We then check that B, which wasn't on the return path on the previous request, was persisted by calling
 // /event_relationships again with event ID 'A' and direction 'down'.
 func TestFederatedEventRelationships(t *testing.T) {
+	msc.Test(t, "msc2836")
 	deployment := Deploy(t, b.BlueprintAlice)
 	defer deployment.Destroy(t)
 
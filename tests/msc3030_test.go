@@ -1,6 +1,3 @@
-//go:build msc3030
-// +build msc3030
-
 // This file contains tests for a jump to date API endpoint,
 // currently experimental feature defined by MSC3030, which you can read here:
 // https://github.com/matrix-org/matrix-doc/pull/3030
@@ -16,10 +13,14 @@ import (
 
 	"github.com/matrix-org/complement/internal/b"
 	"github.com/matrix-org/complement/internal/client"
+	"github.com/matrix-org/complement/internal/must"
+	"github.com/matrix-org/complement/msc"
 	"github.com/tidwall/gjson"
 )
 
+// spec: MSC3030
 func TestJumpToDateEndpoint(t *testing.T) {
+	msc.Test(t, "msc3030")
 	deployment := Deploy(t, b.BlueprintFederationTwoLocalOneRemote)
 	defer deployment.Destroy(t)
 
@@ -80,9 +81,7 @@ func TestJumpToDateEndpoint(t *testing.T) {
 
 			// A random user is not allowed to query for events in a private room
 			// they're not a member of (forbidden).
-			if timestampToEventRes.StatusCode != 403 {
-				t.Fatalf("/timestamp_to_event returned %d HTTP status code but expected %d", timestampToEventRes.StatusCode, 403)
-			}
+			must.Equal(t, timestampToEventRes.StatusCode, 403, "/timestamp_to_event status")
 		})
 
 		// Just a sanity check that we're not leaking anything from the `/timestamp_to_event` endpoint
@@ -108,9 +107,7 @@ func TestJumpToDateEndpoint(t *testing.T) {
 
 			// A random user is not allowed to query for events in a public room
 			// they're not a member of (forbidden).
-			if timestampToEventRes.StatusCode != 403 {
-				t.Fatalf("/timestamp_to_event returned %d HTTP status code but expected %d", timestampToEventRes.StatusCode, 403)
-			}
+			must.Equal(t, timestampToEventRes.StatusCode, 403, "/timestamp_to_event status")
 		})
 
 		t.Run("federation", func(t *testing.T) {
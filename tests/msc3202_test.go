@@ -0,0 +1,65 @@
+// This file contains tests for application services masquerading as devices and receiving
+// to-device messages, currently experimental features defined by MSC3202 and MSC2409, which
+// you can read here:
+// https://github.com/matrix-org/matrix-doc/pull/3202
+// https://github.com/matrix-org/matrix-doc/pull/2409
+
+package tests
+
+import (
+	"testing"
+	"time"
+
+	"github.com/tidwall/gjson"
+
+	"github.com/matrix-org/complement/internal/appservice"
+	"github.com/matrix-org/complement/internal/b"
+	"github.com/matrix-org/complement/internal/client"
+	"github.com/matrix-org/complement/internal/must"
+	"github.com/matrix-org/complement/msc"
+)
+
+func TestAppServiceDeviceMasquerading(t *testing.T) {
+	msc.Test(t, "msc3202")
+	as := appservice.NewServer(t, appservice.WithEphemeralEvents(), appservice.WithDeviceMasquerading())
+	cancel := as.Listen()
+	defer cancel()
+
+	deployment := Deploy(t, b.BlueprintAlice, as.DeployOption("hs1"))
+	defer deployment.Destroy(t)
+
+	alice := deployment.Client(t, "hs1", "@alice:hs1")
+
+	// register a ghost with a device, which the application service can then masquerade as
+	res := as.Client(t, deployment, "hs1").MustDoFunc(t, "POST", []string{"_matrix", "client", "r0", "register"}, client.WithJSONBody(t, map[string]interface{}{
+		"type":      "m.login.application_service",
+		"username":  as.Registration.ID + "_ghost",
+		"device_id": "GHOSTDEVICE",
+	}))
+	body := client.ParseJSON(t, res)
+	ghostUserID := client.GetJSONFieldStr(t, body, "user_id")
+	ghostDeviceID := client.GetJSONFieldStr(t, body, "device_id")
+	ghost := as.MasqueradeDeviceClient(t, deployment, "hs1", ghostUserID, ghostDeviceID)
+
+	t.Run("Application services can masquerade as a device", func(t *testing.T) {
+		res := ghost.MustDoFunc(t, "GET", []string{"_matrix", "client", "r0", "account", "whoami"})
+		body := client.ParseJSON(t, res)
+		must.Equal(t, client.GetJSONFieldStr(t, body, "device_id"), ghostDeviceID, "whoami device ID")
+	})
+
+	t.Run("To-device messages for namespaced users are pushed to the application service", func(t *testing.T) {
+		alice.SendToDevice(t, "com.example.test", map[string]map[string]interface{}{
+			ghostUserID: {
+				ghostDeviceID: map[string]interface{}{
+					"hello": "ghost",
+				},
+			},
+		})
+		as.AwaitTransaction(t, 10*time.Second, appservice.TransactionHasToDevice(func(msg gjson.Result) bool {
+			return msg.Get("type").Str == "com.example.test" &&
+				msg.Get("sender").Str == alice.UserID &&
+				msg.Get("to_user_id").Str == ghostUserID &&
+				msg.Get("to_device_id").Str == ghostDeviceID
+		}))
+	})
+}
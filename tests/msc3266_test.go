@@ -0,0 +1,93 @@
+// This file contains tests for room summaries, currently experimental and defined by MSC3266,
+// which you can read here:
+// https://github.com/matrix-org/matrix-spec-proposals/pull/3266
+
+package tests
+
+import (
+	"testing"
+
+	"github.com/matrix-org/complement/internal/b"
+	"github.com/matrix-org/complement/internal/federation"
+	"github.com/matrix-org/complement/internal/match"
+	"github.com/matrix-org/complement/internal/must"
+	"github.com/matrix-org/complement/msc"
+)
+
+func TestRoomSummary(t *testing.T) {
+	msc.Test(t, "msc3266")
+	deployment := Deploy(t, b.BlueprintOneToOneRoom)
+	defer deployment.Destroy(t)
+
+	alice := deployment.Client(t, "hs1", "@alice:hs1")
+	bob := deployment.Client(t, "hs1", "@bob:hs1")
+
+	publicRoomID := alice.CreateRoom(t, map[string]interface{}{
+		"preset": "public_chat",
+		"name":   "Public room",
+	})
+	privateRoomID := alice.CreateRoom(t, map[string]interface{}{
+		"preset": "private_chat",
+	})
+
+	t.Run("Members can get the summary of a room", func(t *testing.T) {
+		must.MatchJSONBytes(t, alice.MustGetRoomSummary(t, publicRoomID, nil),
+			match.JSONKeyEqual("room_id", publicRoomID),
+			match.JSONKeyEqual("name", "Public room"),
+			match.JSONRoomSummaryMembership("join"),
+			match.JSONRoomSummaryJoinRule("public"),
+			match.JSONRoomSummaryJoinedMembers(1),
+		)
+	})
+
+	t.Run("Non-members can get the summary of a public room", func(t *testing.T) {
+		must.MatchJSONBytes(t, bob.MustGetRoomSummary(t, publicRoomID, nil),
+			match.JSONRoomSummaryMembership("leave"),
+			match.JSONRoomSummaryJoinRule("public"),
+		)
+	})
+
+	t.Run("Invited users can get the summary of a private room", func(t *testing.T) {
+		alice.InviteRoom(t, privateRoomID, bob.UserID)
+		must.MatchJSONBytes(t, bob.MustGetRoomSummary(t, privateRoomID, nil),
+			match.JSONRoomSummaryMembership("invite"),
+			match.JSONRoomSummaryJoinRule("invite"),
+		)
+	})
+
+	t.Run("Non-members cannot get the summary of a private room", func(t *testing.T) {
+		charlie := deployment.RegisterUser(t, "hs1", "charlie", "sufficiently_long_password_charlie", false)
+		res := charlie.GetRoomSummary(t, privateRoomID, nil)
+		if res.StatusCode == 200 {
+			t.Fatalf("expected the summary of a private room to be hidden from non-members, got HTTP 200")
+		}
+	})
+
+	t.Run("Summaries of remote rooms are fetched over federation", func(t *testing.T) {
+		srv := federation.NewServer(t, deployment,
+			federation.HandleKeyRequests(),
+			federation.HandleHierarchyRequests(),
+		)
+		cancel := srv.Listen()
+		defer cancel()
+
+		ver := alice.GetDefaultRoomVersion(t)
+		charlie := srv.UserID("charlie")
+		remoteRoom := srv.MustMakeRoom(t, ver, append(federation.InitialRoomEvents(ver, charlie), b.Event{
+			Type:     "m.room.name",
+			StateKey: b.Ptr(""),
+			Sender:   charlie,
+			Content: map[string]interface{}{
+				"name": "Remote room",
+			},
+		}))
+
+		must.MatchJSONBytes(t, alice.MustGetRoomSummary(t, remoteRoom.RoomID, []string{srv.ServerName()}),
+			match.JSONKeyEqual("room_id", remoteRoom.RoomID),
+			match.JSONKeyEqual("name", "Remote room"),
+			match.JSONRoomSummaryMembership("leave"),
+			match.JSONRoomSummaryJoinRule("public"),
+			match.JSONRoomSummaryJoinedMembers(1),
+		)
+	})
+}
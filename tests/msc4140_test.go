@@ -0,0 +1,106 @@
+// This file contains tests for delayed events, currently experimental and defined by MSC4140,
+// which you can read here:
+// https://github.com/matrix-org/matrix-spec-proposals/pull/4140
+
+package tests
+
+import (
+	"testing"
+	"time"
+
+	"github.com/tidwall/gjson"
+
+	"github.com/matrix-org/complement/internal/b"
+	"github.com/matrix-org/complement/internal/client"
+	"github.com/matrix-org/complement/internal/match"
+	"github.com/matrix-org/complement/internal/must"
+	"github.com/matrix-org/complement/msc"
+	"github.com/matrix-org/complement/runtime"
+)
+
+func TestDelayedEvents(t *testing.T) {
+	msc.Test(t, "msc4140")
+	deployment := Deploy(t, b.BlueprintAlice)
+	defer deployment.Destroy(t)
+
+	alice := deployment.Client(t, "hs1", "@alice:hs1")
+	runtime.SkipIfUnsupported(t, alice, "org.matrix.msc4140")
+	roomID := alice.CreateRoom(t, map[string]interface{}{"preset": "private_chat"})
+
+	message := func(body string) b.Event {
+		return b.Event{
+			Type: "m.room.message",
+			Content: map[string]interface{}{
+				"msgtype": "m.text",
+				"body":    body,
+			},
+		}
+	}
+	hasBody := func(body string) func(gjson.Result) bool {
+		return func(ev gjson.Result) bool {
+			return ev.Get("content.body").Str == body
+		}
+	}
+
+	t.Run("Delayed events are sent after their delay", func(t *testing.T) {
+		delay := 2 * time.Second
+		scheduledAt := time.Now()
+		delayID := alice.SendDelayedEvent(t, roomID, message("delayed"), delay)
+
+		found := false
+		for _, ev := range alice.GetDelayedEvents(t) {
+			if ev.Get("delay_id").Str == delayID {
+				found = true
+			}
+		}
+		if !found {
+			t.Fatalf("delayed event %s is not listed", delayID)
+		}
+		alice.MustSyncUntil(t, client.SyncReq{}, client.SyncDelayedEventSent(roomID, scheduledAt.Add(delay), hasBody("delayed")))
+	})
+
+	t.Run("Delayed state events are sent after their delay", func(t *testing.T) {
+		delay := 2 * time.Second
+		scheduledAt := time.Now()
+		alice.SendDelayedEvent(t, roomID, b.Event{
+			Type:     "m.room.topic",
+			StateKey: b.Ptr(""),
+			Content: map[string]interface{}{
+				"topic": "delayed topic",
+			},
+		}, delay)
+		alice.MustSyncUntil(t, client.SyncReq{}, client.SyncDelayedEventSent(roomID, scheduledAt.Add(delay), func(ev gjson.Result) bool {
+			return ev.Get("type").Str == "m.room.topic" && ev.Get("content.topic").Str == "delayed topic"
+		}))
+	})
+
+	t.Run("Delayed events can be sent immediately", func(t *testing.T) {
+		delayID := alice.SendDelayedEvent(t, roomID, message("sent early"), time.Hour)
+		alice.MustSendDelayedEventNow(t, delayID)
+		alice.MustSyncUntil(t, client.SyncReq{}, client.SyncTimelineHas(roomID, hasBody("sent early")))
+	})
+
+	t.Run("Cancelled delayed events are not sent", func(t *testing.T) {
+		delay := 2 * time.Second
+		delayID := alice.SendDelayedEvent(t, roomID, message("cancelled"), delay)
+		alice.MustCancelDelayedEvent(t, delayID)
+		for _, ev := range alice.GetDelayedEvents(t) {
+			if ev.Get("delay_id").Str == delayID {
+				t.Fatalf("cancelled delayed event %s is still listed", delayID)
+			}
+		}
+		// cancelling twice fails as it no longer exists
+		must.MatchResponse(t, alice.UpdateDelayedEvent(t, delayID, client.DelayedEventActionCancel), match.HTTPResponse{
+			StatusCode: 404,
+		})
+	})
+
+	t.Run("Restarting a delayed event delays it again", func(t *testing.T) {
+		delay := 3 * time.Second
+		delayID := alice.SendDelayedEvent(t, roomID, message("restarted"), delay)
+		time.Sleep(time.Second)
+		restartedAt := time.Now()
+		alice.MustRestartDelayedEvent(t, delayID)
+		alice.MustSyncUntil(t, client.SyncReq{}, client.SyncDelayedEventSent(roomID, restartedAt.Add(delay), hasBody("restarted")))
+	})
+}
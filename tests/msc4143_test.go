@@ -0,0 +1,45 @@
+// This file contains tests for MatrixRTC call membership, currently experimental and defined by
+// MSC3401 and MSC4143, which you can read here:
+// https://github.com/matrix-org/matrix-spec-proposals/pull/3401
+// https://github.com/matrix-org/matrix-spec-proposals/pull/4143
+
+package tests
+
+import (
+	"testing"
+	"time"
+
+	"github.com/matrix-org/complement/internal/b"
+	"github.com/matrix-org/complement/internal/client"
+	"github.com/matrix-org/complement/msc"
+)
+
+func TestMatrixRTCCallMembership(t *testing.T) {
+	msc.Test(t, "msc4143")
+	deployment := Deploy(t, b.BlueprintFederationOneToOneRoom)
+	defer deployment.Destroy(t)
+
+	alice := deployment.Client(t, "hs1", "@alice:hs1")
+	bob := deployment.Client(t, "hs2", "@bob:hs2")
+	roomID := alice.CreateRoom(t, map[string]interface{}{
+		"preset": "public_chat",
+		// Element Call lets everyone in the room send call memberships
+		"power_level_content_override": map[string]interface{}{
+			"events": map[string]interface{}{
+				"m.call.member": 0,
+			},
+		},
+	})
+	bob.JoinRoom(t, roomID, []string{"hs1"})
+	alice.MustSyncUntil(t, client.SyncReq{}, client.SyncJoinedTo(bob.UserID, roomID))
+
+	// both users join the call, and each sees the other's membership
+	alice.SendEventSynced(t, roomID, b.CallMember(alice.UserID, alice.DeviceID, "", time.Hour))
+	bob.SendEventSynced(t, roomID, b.CallMember(bob.UserID, bob.DeviceID, "", time.Hour))
+	alice.MustSyncUntil(t, client.SyncReq{}, client.SyncCallMemberActive(roomID, bob.UserID, bob.DeviceID))
+	bob.MustSyncUntil(t, client.SyncReq{}, client.SyncCallMemberActive(roomID, alice.UserID, alice.DeviceID))
+
+	// bob leaves the call
+	bob.SendEventSynced(t, roomID, b.CallMemberLeave(bob.UserID, bob.DeviceID))
+	alice.MustSyncUntil(t, client.SyncReq{}, client.SyncCallMemberLeft(roomID, bob.UserID, bob.DeviceID))
+}
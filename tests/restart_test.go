@@ -0,0 +1,32 @@
+package tests
+
+import (
+	"testing"
+
+	"github.com/matrix-org/complement/internal/b"
+	"github.com/matrix-org/complement/internal/client"
+	"github.com/matrix-org/complement/internal/docker"
+)
+
+// Tests that a homeserver keeps access tokens and rooms across a restart.
+func TestHomeserverRestart(t *testing.T) {
+	deployment := Deploy(t, b.BlueprintAlice, docker.WithIsolation()) // restarts the homeserver
+	defer deployment.Destroy(t)
+
+	alice := deployment.Client(t, "hs1", "@alice:hs1")
+	roomID := alice.CreateRoom(t, map[string]interface{}{
+		"preset": "private_chat",
+	})
+	eventID := alice.SendEventSynced(t, roomID, b.Event{
+		Type: "m.room.message",
+		Content: map[string]interface{}{
+			"msgtype": "m.text",
+			"body":    "before restart",
+		},
+	})
+
+	deployment.Restart(t)
+
+	// alice's client now points at the restarted homeserver, and her access token still works
+	alice.MustSyncUntil(t, client.SyncReq{}, client.SyncJoinedTo(alice.UserID, roomID), client.SyncTimelineHasEventID(roomID, eventID))
+}
@@ -168,6 +168,9 @@ func checkRestrictedRoom(t *testing.T, alice *client.CSAPI, bob *client.CSAPI, a
 }
 
 // Test joining a room with join rules restricted to membership in another room.
+//
+// spec: client-server-api/#restricted-rooms
+// spec: MSC3083
 func TestRestrictedRoomsLocalJoin(t *testing.T) {
 	deployment := Deploy(t, b.BlueprintOneToOneRoom)
 	defer deployment.Destroy(t)
@@ -183,6 +186,9 @@ func TestRestrictedRoomsLocalJoin(t *testing.T) {
 }
 
 // Test joining a room with join rules restricted to membership in another room.
+//
+// spec: client-server-api/#restricted-rooms
+// spec: MSC3083
 func TestRestrictedRoomsRemoteJoin(t *testing.T) {
 	deployment := Deploy(t, b.BlueprintFederationOneToOneRoom)
 	defer deployment.Destroy(t)
@@ -204,7 +210,7 @@ func TestRestrictedRoomsRemoteJoinLocalUser(t *testing.T) {
 }
 
 func doTestRestrictedRoomsRemoteJoinLocalUser(t *testing.T, roomVersion string, joinRule string) {
-	runtime.SkipIf(t, runtime.Dendrite) // requires more debugging
+	runtime.SkipIf(t, runtime.Dendrite, "requires more debugging")
 
 	deployment := Deploy(t, b.BlueprintFederationTwoLocalOneRemote)
 	defer deployment.Destroy(t)
@@ -278,8 +284,8 @@ func doTestRestrictedRoomsRemoteJoinLocalUser(t *testing.T, roomVersion string,
 			if ev.Get("type").Str != "m.room.member" || ev.Get("state_key").Str != bob.UserID {
 				return false
 			}
-			must.EqualStr(t, ev.Get("sender").Str, bob.UserID, "Bob should have joined by himself")
-			must.EqualStr(t, ev.Get("content").Get("membership").Str, "join", "Bob failed to join the room")
+			must.Equal(t, ev.Get("sender").Str, bob.UserID, "Bob should have joined by himself")
+			must.Equal(t, ev.Get("content").Get("membership").Str, "join", "Bob failed to join the room")
 
 			return true
 		},
@@ -307,7 +313,7 @@ func doTestRestrictedRoomsRemoteJoinLocalUser(t *testing.T, roomVersion string,
 			if ev.Get("type").Str != "m.room.member" || ev.Get("state_key").Str != charlie.UserID {
 				return false
 			}
-			must.EqualStr(t, ev.Get("content").Get("membership").Str, "leave", "Charlie failed to leave the room")
+			must.Equal(t, ev.Get("content").Get("membership").Str, "leave", "Charlie failed to leave the room")
 
 			return true
 		},
@@ -331,7 +337,7 @@ func TestRestrictedRoomsRemoteJoinFailOver(t *testing.T) {
 }
 
 func doTestRestrictedRoomsRemoteJoinFailOver(t *testing.T, roomVersion string, joinRule string) {
-	runtime.SkipIf(t, runtime.Dendrite) // requires more debugging
+	runtime.SkipIf(t, runtime.Dendrite, "requires more debugging")
 
 	deployment := Deploy(t, b.Blueprint{
 		Name: "federation_three_homeservers",
@@ -407,8 +413,8 @@ func doTestRestrictedRoomsRemoteJoinFailOver(t *testing.T, roomVersion string, j
 			if ev.Get("type").Str != "m.room.member" || ev.Get("state_key").Str != charlie.UserID {
 				return false
 			}
-			must.EqualStr(t, ev.Get("content").Get("membership").Str, "join", "Charlie failed to join the room")
-			must.EqualStr(t, ev.Get("content").Get("join_authorised_via_users_server").Str, alice.UserID, "Join authorised via incorrect server")
+			must.Equal(t, ev.Get("content").Get("membership").Str, "join", "Charlie failed to join the room")
+			must.Equal(t, ev.Get("content").Get("join_authorised_via_users_server").Str, alice.UserID, "Join authorised via incorrect server")
 
 			return true
 		},
@@ -459,8 +465,8 @@ func doTestRestrictedRoomsRemoteJoinFailOver(t *testing.T, roomVersion string, j
 			if ev.Get("type").Str != "m.room.member" || ev.Get("state_key").Str != charlie.UserID {
 				return false
 			}
-			must.EqualStr(t, ev.Get("content").Get("membership").Str, "join", "Charlie failed to join the room")
-			must.EqualStr(t, ev.Get("content").Get("join_authorised_via_users_server").Str, alice.UserID, "Join authorised via incorrect server")
+			must.Equal(t, ev.Get("content").Get("membership").Str, "join", "Charlie failed to join the room")
+			must.Equal(t, ev.Get("content").Get("join_authorised_via_users_server").Str, alice.UserID, "Join authorised via incorrect server")
 
 			return true
 		},
@@ -62,6 +62,9 @@ func eventKey(srcRoomID, dstRoomID, evType string) string {
 // - Rooms are returned correctly along with the custom fields `room_type`.
 // - Events are returned correctly.
 // - Redacting links works correctly.
+//
+// spec: client-server-api/#get_matrixclientv1roomsroomidhierarchy
+// spec: MSC2946
 func TestClientSpacesSummary(t *testing.T) {
 	deployment := Deploy(t, b.BlueprintOneToOneRoom)
 	defer deployment.Destroy(t)